@@ -6,6 +6,8 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"strings"
 
 	"google.golang.org/grpc"
 
@@ -30,6 +32,10 @@ type apiController struct {
 	uploadSpeedLimit   *int
 	downloadSpeedLimit *int
 	ipLimit            *int
+	authConfig         *string
+	wsHost             *string
+	wsPaths            *string
+	month              *string
 	ctx                context.Context
 }
 
@@ -60,6 +66,29 @@ func (o *apiController) listUsers(apiClient service.TrojanServerServiceClient) e
 	return nil
 }
 
+func (o *apiController) listUDPSessions(apiClient service.TrojanServerServiceClient) error {
+	stream, err := apiClient.ListUDPSessions(o.ctx, &service.ListUDPSessionsRequest{})
+	if err != nil {
+		return err
+	}
+	defer stream.CloseSend()
+	result := []*service.ListUDPSessionsResponse{}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		result = append(result, resp)
+	}
+	data, err := json.Marshal(result)
+	common.Must(err)
+	fmt.Println(string(data))
+	return nil
+}
+
 func (o *apiController) getUsers(apiClient service.TrojanServerServiceClient) error {
 	stream, err := apiClient.GetUsers(o.ctx)
 	if err != nil {
@@ -133,6 +162,175 @@ func (o *apiController) setUsers(apiClient service.TrojanServerServiceClient) er
 	return nil
 }
 
+func (o *apiController) reloadAuthenticator(apiClient service.TrojanServerServiceClient) error {
+	req := &service.ReloadAuthenticatorRequest{}
+	if *o.authConfig != "" {
+		data, err := ioutil.ReadFile(*o.authConfig)
+		if err != nil {
+			return common.NewError("failed to read authenticator config").Base(err)
+		}
+		req.Config = data
+		if strings.HasSuffix(*o.authConfig, ".yaml") || strings.HasSuffix(*o.authConfig, ".yml") {
+			req.Format = "yaml"
+		}
+	}
+	resp, err := apiClient.ReloadAuthenticator(o.ctx, req)
+	if err != nil {
+		return err
+	}
+	if resp.Success {
+		fmt.Println("Done")
+	} else {
+		fmt.Println("Failed: " + resp.Info)
+	}
+	return nil
+}
+
+func (o *apiController) getClientStats(apiClient service.TrojanClientServiceClient) error {
+	resp, err := apiClient.GetClientStats(o.ctx, &service.GetClientStatsRequest{})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(resp)
+	common.Must(err)
+	fmt.Println(string(data))
+	return nil
+}
+
+func (o *apiController) getProbeHistory(apiClient service.TrojanClientServiceClient) error {
+	resp, err := apiClient.GetProbeHistory(o.ctx, &service.GetProbeHistoryRequest{})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(resp)
+	common.Must(err)
+	fmt.Println(string(data))
+	return nil
+}
+
+func (o *apiController) getDNSLeaks(apiClient service.TrojanClientServiceClient) error {
+	resp, err := apiClient.GetDNSLeaks(o.ctx, &service.GetDNSLeaksRequest{})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(resp)
+	common.Must(err)
+	fmt.Println(string(data))
+	return nil
+}
+
+func (o *apiController) getReplayStats(apiClient service.TrojanServerServiceClient) error {
+	resp, err := apiClient.GetReplayStats(o.ctx, &service.GetReplayStatsRequest{})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(resp)
+	common.Must(err)
+	fmt.Println(string(data))
+	return nil
+}
+
+func (o *apiController) getFallbackStatus(apiClient service.TrojanServerServiceClient) error {
+	resp, err := apiClient.GetFallbackStatus(o.ctx, &service.GetFallbackStatusRequest{})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(resp)
+	common.Must(err)
+	fmt.Println(string(data))
+	return nil
+}
+
+func (o *apiController) getMonthlyUsage(apiClient service.TrojanServerServiceClient) error {
+	req := &service.GetMonthlyUsageRequest{
+		Month: *o.month,
+	}
+	if *o.password != "" || *o.hash != "" {
+		req.User = &service.User{
+			Password: *o.password,
+			Hash:     *o.hash,
+		}
+	}
+	resp, err := apiClient.GetMonthlyUsage(o.ctx, req)
+	if err != nil {
+		return err
+	}
+	if !resp.Enabled {
+		fmt.Println("Monthly usage is disabled")
+		return nil
+	}
+	data, err := json.Marshal(resp)
+	common.Must(err)
+	fmt.Println(string(data))
+	return nil
+}
+
+// targetUsers returns the user specified by the flags, empty for all users
+func (o *apiController) targetUsers() []*service.User {
+	if *o.password == "" && *o.hash == "" {
+		return nil
+	}
+	return []*service.User{{
+		Password: *o.password,
+		Hash:     *o.hash,
+	}}
+}
+
+func (o *apiController) getTrafficSnapshot(apiClient service.TrojanServerServiceClient) error {
+	resp, err := apiClient.GetTrafficSnapshot(o.ctx, &service.GetTrafficSnapshotRequest{
+		Users: o.targetUsers(),
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		fmt.Println("Failed: " + resp.Info)
+		return nil
+	}
+	data, err := json.Marshal(resp)
+	common.Must(err)
+	fmt.Println(string(data))
+	return nil
+}
+
+func (o *apiController) resetTraffic(apiClient service.TrojanServerServiceClient) error {
+	resp, err := apiClient.ResetTraffic(o.ctx, &service.ResetTrafficRequest{
+		Users: o.targetUsers(),
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		fmt.Println("Failed: " + resp.Info)
+		return nil
+	}
+	data, err := json.Marshal(resp)
+	common.Must(err)
+	fmt.Println(string(data))
+	return nil
+}
+
+func (o *apiController) updateWebsocketRoute(apiClient service.TrojanServerServiceClient) error {
+	req := &service.UpdateWebsocketRouteRequest{
+		Hostname: *o.wsHost,
+	}
+	if *o.wsPaths != "" {
+		req.Paths = strings.Split(*o.wsPaths, ",")
+	}
+	resp, err := apiClient.UpdateWebsocketRoute(o.ctx, req)
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		fmt.Println("Failed: " + resp.Info)
+		return nil
+	}
+	data, err := json.Marshal(resp.Routes)
+	common.Must(err)
+	fmt.Println(string(data))
+	return nil
+}
+
 func (o *apiController) Handle() error {
 	if *o.cmd == "" {
 		return common.NewError("")
@@ -150,6 +348,61 @@ func (o *apiController) Handle() error {
 		if err != nil {
 			log.Error(err)
 		}
+	case "sessions":
+		err := o.listUDPSessions(apiClient)
+		if err != nil {
+			log.Error(err)
+		}
+	case "client-stats":
+		err := o.getClientStats(service.NewTrojanClientServiceClient(conn))
+		if err != nil {
+			log.Error(err)
+		}
+	case "probe":
+		err := o.getProbeHistory(service.NewTrojanClientServiceClient(conn))
+		if err != nil {
+			log.Error(err)
+		}
+	case "dns-leaks":
+		err := o.getDNSLeaks(service.NewTrojanClientServiceClient(conn))
+		if err != nil {
+			log.Error(err)
+		}
+	case "replay":
+		err := o.getReplayStats(apiClient)
+		if err != nil {
+			log.Error(err)
+		}
+	case "fallback":
+		err := o.getFallbackStatus(apiClient)
+		if err != nil {
+			log.Error(err)
+		}
+	case "usage":
+		err := o.getMonthlyUsage(apiClient)
+		if err != nil {
+			log.Error(err)
+		}
+	case "snapshot":
+		err := o.getTrafficSnapshot(apiClient)
+		if err != nil {
+			log.Error(err)
+		}
+	case "reset-traffic":
+		err := o.resetTraffic(apiClient)
+		if err != nil {
+			log.Error(err)
+		}
+	case "reload-auth":
+		err := o.reloadAuthenticator(apiClient)
+		if err != nil {
+			log.Error(err)
+		}
+	case "ws-route":
+		err := o.updateWebsocketRoute(apiClient)
+		if err != nil {
+			log.Error(err)
+		}
 	case "get":
 		err := o.getUsers(apiClient)
 		if err != nil {
@@ -173,7 +426,7 @@ func (o *apiController) Priority() int {
 // 模块加载时自动运行
 func init() {
 	option.RegisterHandler(&apiController{
-		cmd:                flag.String("api", "", "Connect to a Trojan-Go API service. \"-api add/get/list\""),
+		cmd:                flag.String("api", "", "Connect to a Trojan-Go API service. \"-api add/get/list/sessions/reload-auth/client-stats/probe/dns-leaks/replay/fallback/ws-route/usage/snapshot/reset-traffic\""),
 		address:            flag.String("api-addr", "127.0.0.1:10000", "Address of Trojan-Go API service"),
 		password:           flag.String("target-password", "", "Password of the target user"),
 		hash:               flag.String("target-hash", "", "Hash of the target user"),
@@ -183,6 +436,10 @@ func init() {
 		uploadSpeedLimit:   flag.Int("upload-speed-limit", 0, "Limit the upload speed with API"),     // 将密码为password的用户上传速度限制
 		downloadSpeedLimit: flag.Int("download-speed-limit", 0, "Limit the download speed with API"), // 将密码为password的用户下载速度限制
 		ipLimit:            flag.Int("ip-limit", 0, "Limit the number of IP with API"),               // 同时连接的IP数量
+		authConfig:         flag.String("auth-config", "", "Config file used to reload the authenticator with API"),
+		wsHost:             flag.String("ws-host", "", "New websocket hostname used by \"-api ws-route\""),
+		wsPaths:            flag.String("ws-paths", "", "New websocket paths separated by commas used by \"-api ws-route\""),
+		month:              flag.String("month", "", "Month in the format of 2006-01 used by \"-api usage\", empty for the current month"),
 		ctx:                context.Background(),
 	})
 }
@@ -19,6 +19,12 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type TrojanClientServiceClient interface {
 	GetTraffic(ctx context.Context, in *GetTrafficRequest, opts ...grpc.CallOption) (*GetTrafficResponse, error)
+	// obtain connection statistics of the client
+	GetClientStats(ctx context.Context, in *GetClientStatsRequest, opts ...grpc.CallOption) (*GetClientStatsResponse, error)
+	// obtain recent probe results of the server
+	GetProbeHistory(ctx context.Context, in *GetProbeHistoryRequest, opts ...grpc.CallOption) (*GetProbeHistoryResponse, error)
+	// obtain the direct dns queries blocked by the dns leak protection
+	GetDNSLeaks(ctx context.Context, in *GetDNSLeaksRequest, opts ...grpc.CallOption) (*GetDNSLeaksResponse, error)
 }
 
 type trojanClientServiceClient struct {
@@ -38,11 +44,44 @@ func (c *trojanClientServiceClient) GetTraffic(ctx context.Context, in *GetTraff
 	return out, nil
 }
 
+func (c *trojanClientServiceClient) GetClientStats(ctx context.Context, in *GetClientStatsRequest, opts ...grpc.CallOption) (*GetClientStatsResponse, error) {
+	out := new(GetClientStatsResponse)
+	err := c.cc.Invoke(ctx, "/trojan.api.TrojanClientService/GetClientStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trojanClientServiceClient) GetProbeHistory(ctx context.Context, in *GetProbeHistoryRequest, opts ...grpc.CallOption) (*GetProbeHistoryResponse, error) {
+	out := new(GetProbeHistoryResponse)
+	err := c.cc.Invoke(ctx, "/trojan.api.TrojanClientService/GetProbeHistory", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trojanClientServiceClient) GetDNSLeaks(ctx context.Context, in *GetDNSLeaksRequest, opts ...grpc.CallOption) (*GetDNSLeaksResponse, error) {
+	out := new(GetDNSLeaksResponse)
+	err := c.cc.Invoke(ctx, "/trojan.api.TrojanClientService/GetDNSLeaks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TrojanClientServiceServer is the server API for TrojanClientService service.
 // All implementations must embed UnimplementedTrojanClientServiceServer
 // for forward compatibility
 type TrojanClientServiceServer interface {
 	GetTraffic(context.Context, *GetTrafficRequest) (*GetTrafficResponse, error)
+	// obtain connection statistics of the client
+	GetClientStats(context.Context, *GetClientStatsRequest) (*GetClientStatsResponse, error)
+	// obtain recent probe results of the server
+	GetProbeHistory(context.Context, *GetProbeHistoryRequest) (*GetProbeHistoryResponse, error)
+	// obtain the direct dns queries blocked by the dns leak protection
+	GetDNSLeaks(context.Context, *GetDNSLeaksRequest) (*GetDNSLeaksResponse, error)
 	mustEmbedUnimplementedTrojanClientServiceServer()
 }
 
@@ -53,6 +92,15 @@ type UnimplementedTrojanClientServiceServer struct {
 func (UnimplementedTrojanClientServiceServer) GetTraffic(context.Context, *GetTrafficRequest) (*GetTrafficResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetTraffic not implemented")
 }
+func (UnimplementedTrojanClientServiceServer) GetClientStats(context.Context, *GetClientStatsRequest) (*GetClientStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetClientStats not implemented")
+}
+func (UnimplementedTrojanClientServiceServer) GetProbeHistory(context.Context, *GetProbeHistoryRequest) (*GetProbeHistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetProbeHistory not implemented")
+}
+func (UnimplementedTrojanClientServiceServer) GetDNSLeaks(context.Context, *GetDNSLeaksRequest) (*GetDNSLeaksResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDNSLeaks not implemented")
+}
 func (UnimplementedTrojanClientServiceServer) mustEmbedUnimplementedTrojanClientServiceServer() {}
 
 // UnsafeTrojanClientServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -84,6 +132,60 @@ func _TrojanClientService_GetTraffic_Handler(srv interface{}, ctx context.Contex
 	return interceptor(ctx, in, info, handler)
 }
 
+func _TrojanClientService_GetClientStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetClientStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrojanClientServiceServer).GetClientStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/trojan.api.TrojanClientService/GetClientStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrojanClientServiceServer).GetClientStats(ctx, req.(*GetClientStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrojanClientService_GetProbeHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetProbeHistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrojanClientServiceServer).GetProbeHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/trojan.api.TrojanClientService/GetProbeHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrojanClientServiceServer).GetProbeHistory(ctx, req.(*GetProbeHistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrojanClientService_GetDNSLeaks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetDNSLeaksRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrojanClientServiceServer).GetDNSLeaks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/trojan.api.TrojanClientService/GetDNSLeaks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrojanClientServiceServer).GetDNSLeaks(ctx, req.(*GetDNSLeaksRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // TrojanClientService_ServiceDesc is the grpc.ServiceDesc for TrojanClientService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -95,6 +197,18 @@ var TrojanClientService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetTraffic",
 			Handler:    _TrojanClientService_GetTraffic_Handler,
 		},
+		{
+			MethodName: "GetClientStats",
+			Handler:    _TrojanClientService_GetClientStats_Handler,
+		},
+		{
+			MethodName: "GetProbeHistory",
+			Handler:    _TrojanClientService_GetProbeHistory_Handler,
+		},
+		{
+			MethodName: "GetDNSLeaks",
+			Handler:    _TrojanClientService_GetDNSLeaks_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "api.proto",
@@ -110,6 +224,22 @@ type TrojanServerServiceClient interface {
 	GetUsers(ctx context.Context, opts ...grpc.CallOption) (TrojanServerService_GetUsersClient, error)
 	// setup existing users' config
 	SetUsers(ctx context.Context, opts ...grpc.CallOption) (TrojanServerService_SetUsersClient, error)
+	// list all active udp sessions
+	ListUDPSessions(ctx context.Context, in *ListUDPSessionsRequest, opts ...grpc.CallOption) (TrojanServerService_ListUDPSessionsClient, error)
+	// obtain the stats of the shadowsocks replay filter
+	GetReplayStats(ctx context.Context, in *GetReplayStatsRequest, opts ...grpc.CallOption) (*GetReplayStatsResponse, error)
+	// rebuild the authenticator backend and migrate online users to it
+	ReloadAuthenticator(ctx context.Context, in *ReloadAuthenticatorRequest, opts ...grpc.CallOption) (*ReloadAuthenticatorResponse, error)
+	// change the hostname and the paths accepted by the websocket servers, existing connections are kept
+	UpdateWebsocketRoute(ctx context.Context, in *UpdateWebsocketRouteRequest, opts ...grpc.CallOption) (*UpdateWebsocketRouteResponse, error)
+	// obtain the monthly traffic of the users, independent of the lifetime traffic
+	GetMonthlyUsage(ctx context.Context, in *GetMonthlyUsageRequest, opts ...grpc.CallOption) (*GetMonthlyUsageResponse, error)
+	// obtain the traffic of the users at the same instant
+	GetTrafficSnapshot(ctx context.Context, in *GetTrafficSnapshotRequest, opts ...grpc.CallOption) (*GetTrafficSnapshotResponse, error)
+	// obtain and reset the traffic of the users at the same instant, e.g. at the end of a billing cycle
+	ResetTraffic(ctx context.Context, in *ResetTrafficRequest, opts ...grpc.CallOption) (*ResetTrafficResponse, error)
+	// obtain the health of the fallback addresses, which are checked in the background
+	GetFallbackStatus(ctx context.Context, in *GetFallbackStatusRequest, opts ...grpc.CallOption) (*GetFallbackStatusResponse, error)
 }
 
 type trojanServerServiceClient struct {
@@ -214,6 +344,101 @@ func (x *trojanServerServiceSetUsersClient) Recv() (*SetUsersResponse, error) {
 	return m, nil
 }
 
+func (c *trojanServerServiceClient) ListUDPSessions(ctx context.Context, in *ListUDPSessionsRequest, opts ...grpc.CallOption) (TrojanServerService_ListUDPSessionsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &TrojanServerService_ServiceDesc.Streams[3], "/trojan.api.TrojanServerService/ListUDPSessions", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &trojanServerServiceListUDPSessionsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type TrojanServerService_ListUDPSessionsClient interface {
+	Recv() (*ListUDPSessionsResponse, error)
+	grpc.ClientStream
+}
+
+type trojanServerServiceListUDPSessionsClient struct {
+	grpc.ClientStream
+}
+
+func (x *trojanServerServiceListUDPSessionsClient) Recv() (*ListUDPSessionsResponse, error) {
+	m := new(ListUDPSessionsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *trojanServerServiceClient) GetReplayStats(ctx context.Context, in *GetReplayStatsRequest, opts ...grpc.CallOption) (*GetReplayStatsResponse, error) {
+	out := new(GetReplayStatsResponse)
+	err := c.cc.Invoke(ctx, "/trojan.api.TrojanServerService/GetReplayStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trojanServerServiceClient) ReloadAuthenticator(ctx context.Context, in *ReloadAuthenticatorRequest, opts ...grpc.CallOption) (*ReloadAuthenticatorResponse, error) {
+	out := new(ReloadAuthenticatorResponse)
+	err := c.cc.Invoke(ctx, "/trojan.api.TrojanServerService/ReloadAuthenticator", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trojanServerServiceClient) UpdateWebsocketRoute(ctx context.Context, in *UpdateWebsocketRouteRequest, opts ...grpc.CallOption) (*UpdateWebsocketRouteResponse, error) {
+	out := new(UpdateWebsocketRouteResponse)
+	err := c.cc.Invoke(ctx, "/trojan.api.TrojanServerService/UpdateWebsocketRoute", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trojanServerServiceClient) GetMonthlyUsage(ctx context.Context, in *GetMonthlyUsageRequest, opts ...grpc.CallOption) (*GetMonthlyUsageResponse, error) {
+	out := new(GetMonthlyUsageResponse)
+	err := c.cc.Invoke(ctx, "/trojan.api.TrojanServerService/GetMonthlyUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trojanServerServiceClient) GetTrafficSnapshot(ctx context.Context, in *GetTrafficSnapshotRequest, opts ...grpc.CallOption) (*GetTrafficSnapshotResponse, error) {
+	out := new(GetTrafficSnapshotResponse)
+	err := c.cc.Invoke(ctx, "/trojan.api.TrojanServerService/GetTrafficSnapshot", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trojanServerServiceClient) ResetTraffic(ctx context.Context, in *ResetTrafficRequest, opts ...grpc.CallOption) (*ResetTrafficResponse, error) {
+	out := new(ResetTrafficResponse)
+	err := c.cc.Invoke(ctx, "/trojan.api.TrojanServerService/ResetTraffic", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trojanServerServiceClient) GetFallbackStatus(ctx context.Context, in *GetFallbackStatusRequest, opts ...grpc.CallOption) (*GetFallbackStatusResponse, error) {
+	out := new(GetFallbackStatusResponse)
+	err := c.cc.Invoke(ctx, "/trojan.api.TrojanServerService/GetFallbackStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TrojanServerServiceServer is the server API for TrojanServerService service.
 // All implementations must embed UnimplementedTrojanServerServiceServer
 // for forward compatibility
@@ -224,6 +449,22 @@ type TrojanServerServiceServer interface {
 	GetUsers(TrojanServerService_GetUsersServer) error
 	// setup existing users' config
 	SetUsers(TrojanServerService_SetUsersServer) error
+	// list all active udp sessions
+	ListUDPSessions(*ListUDPSessionsRequest, TrojanServerService_ListUDPSessionsServer) error
+	// obtain the stats of the shadowsocks replay filter
+	GetReplayStats(context.Context, *GetReplayStatsRequest) (*GetReplayStatsResponse, error)
+	// rebuild the authenticator backend and migrate online users to it
+	ReloadAuthenticator(context.Context, *ReloadAuthenticatorRequest) (*ReloadAuthenticatorResponse, error)
+	// change the hostname and the paths accepted by the websocket servers, existing connections are kept
+	UpdateWebsocketRoute(context.Context, *UpdateWebsocketRouteRequest) (*UpdateWebsocketRouteResponse, error)
+	// obtain the monthly traffic of the users, independent of the lifetime traffic
+	GetMonthlyUsage(context.Context, *GetMonthlyUsageRequest) (*GetMonthlyUsageResponse, error)
+	// obtain the traffic of the users at the same instant
+	GetTrafficSnapshot(context.Context, *GetTrafficSnapshotRequest) (*GetTrafficSnapshotResponse, error)
+	// obtain and reset the traffic of the users at the same instant, e.g. at the end of a billing cycle
+	ResetTraffic(context.Context, *ResetTrafficRequest) (*ResetTrafficResponse, error)
+	// obtain the health of the fallback addresses, which are checked in the background
+	GetFallbackStatus(context.Context, *GetFallbackStatusRequest) (*GetFallbackStatusResponse, error)
 	mustEmbedUnimplementedTrojanServerServiceServer()
 }
 
@@ -240,6 +481,30 @@ func (UnimplementedTrojanServerServiceServer) GetUsers(TrojanServerService_GetUs
 func (UnimplementedTrojanServerServiceServer) SetUsers(TrojanServerService_SetUsersServer) error {
 	return status.Errorf(codes.Unimplemented, "method SetUsers not implemented")
 }
+func (UnimplementedTrojanServerServiceServer) ListUDPSessions(*ListUDPSessionsRequest, TrojanServerService_ListUDPSessionsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ListUDPSessions not implemented")
+}
+func (UnimplementedTrojanServerServiceServer) GetReplayStats(context.Context, *GetReplayStatsRequest) (*GetReplayStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetReplayStats not implemented")
+}
+func (UnimplementedTrojanServerServiceServer) ReloadAuthenticator(context.Context, *ReloadAuthenticatorRequest) (*ReloadAuthenticatorResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReloadAuthenticator not implemented")
+}
+func (UnimplementedTrojanServerServiceServer) UpdateWebsocketRoute(context.Context, *UpdateWebsocketRouteRequest) (*UpdateWebsocketRouteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateWebsocketRoute not implemented")
+}
+func (UnimplementedTrojanServerServiceServer) GetMonthlyUsage(context.Context, *GetMonthlyUsageRequest) (*GetMonthlyUsageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMonthlyUsage not implemented")
+}
+func (UnimplementedTrojanServerServiceServer) GetTrafficSnapshot(context.Context, *GetTrafficSnapshotRequest) (*GetTrafficSnapshotResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTrafficSnapshot not implemented")
+}
+func (UnimplementedTrojanServerServiceServer) ResetTraffic(context.Context, *ResetTrafficRequest) (*ResetTrafficResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResetTraffic not implemented")
+}
+func (UnimplementedTrojanServerServiceServer) GetFallbackStatus(context.Context, *GetFallbackStatusRequest) (*GetFallbackStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFallbackStatus not implemented")
+}
 func (UnimplementedTrojanServerServiceServer) mustEmbedUnimplementedTrojanServerServiceServer() {}
 
 // UnsafeTrojanServerServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -326,13 +591,189 @@ func (x *trojanServerServiceSetUsersServer) Recv() (*SetUsersRequest, error) {
 	return m, nil
 }
 
+func _TrojanServerService_ListUDPSessions_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListUDPSessionsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TrojanServerServiceServer).ListUDPSessions(m, &trojanServerServiceListUDPSessionsServer{stream})
+}
+
+type TrojanServerService_ListUDPSessionsServer interface {
+	Send(*ListUDPSessionsResponse) error
+	grpc.ServerStream
+}
+
+type trojanServerServiceListUDPSessionsServer struct {
+	grpc.ServerStream
+}
+
+func (x *trojanServerServiceListUDPSessionsServer) Send(m *ListUDPSessionsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _TrojanServerService_GetReplayStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetReplayStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrojanServerServiceServer).GetReplayStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/trojan.api.TrojanServerService/GetReplayStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrojanServerServiceServer).GetReplayStats(ctx, req.(*GetReplayStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrojanServerService_ReloadAuthenticator_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReloadAuthenticatorRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrojanServerServiceServer).ReloadAuthenticator(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/trojan.api.TrojanServerService/ReloadAuthenticator",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrojanServerServiceServer).ReloadAuthenticator(ctx, req.(*ReloadAuthenticatorRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrojanServerService_UpdateWebsocketRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateWebsocketRouteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrojanServerServiceServer).UpdateWebsocketRoute(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/trojan.api.TrojanServerService/UpdateWebsocketRoute",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrojanServerServiceServer).UpdateWebsocketRoute(ctx, req.(*UpdateWebsocketRouteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrojanServerService_GetMonthlyUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMonthlyUsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrojanServerServiceServer).GetMonthlyUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/trojan.api.TrojanServerService/GetMonthlyUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrojanServerServiceServer).GetMonthlyUsage(ctx, req.(*GetMonthlyUsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrojanServerService_GetTrafficSnapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTrafficSnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrojanServerServiceServer).GetTrafficSnapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/trojan.api.TrojanServerService/GetTrafficSnapshot",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrojanServerServiceServer).GetTrafficSnapshot(ctx, req.(*GetTrafficSnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrojanServerService_ResetTraffic_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResetTrafficRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrojanServerServiceServer).ResetTraffic(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/trojan.api.TrojanServerService/ResetTraffic",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrojanServerServiceServer).ResetTraffic(ctx, req.(*ResetTrafficRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrojanServerService_GetFallbackStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetFallbackStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrojanServerServiceServer).GetFallbackStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/trojan.api.TrojanServerService/GetFallbackStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrojanServerServiceServer).GetFallbackStatus(ctx, req.(*GetFallbackStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // TrojanServerService_ServiceDesc is the grpc.ServiceDesc for TrojanServerService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var TrojanServerService_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "trojan.api.TrojanServerService",
 	HandlerType: (*TrojanServerServiceServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetReplayStats",
+			Handler:    _TrojanServerService_GetReplayStats_Handler,
+		},
+		{
+			MethodName: "ReloadAuthenticator",
+			Handler:    _TrojanServerService_ReloadAuthenticator_Handler,
+		},
+		{
+			MethodName: "UpdateWebsocketRoute",
+			Handler:    _TrojanServerService_UpdateWebsocketRoute_Handler,
+		},
+		{
+			MethodName: "GetMonthlyUsage",
+			Handler:    _TrojanServerService_GetMonthlyUsage_Handler,
+		},
+		{
+			MethodName: "GetTrafficSnapshot",
+			Handler:    _TrojanServerService_GetTrafficSnapshot_Handler,
+		},
+		{
+			MethodName: "ResetTraffic",
+			Handler:    _TrojanServerService_ResetTraffic_Handler,
+		},
+		{
+			MethodName: "GetFallbackStatus",
+			Handler:    _TrojanServerService_GetFallbackStatus_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "ListUsers",
@@ -351,6 +792,11 @@ var TrojanServerService_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "ListUDPSessions",
+			Handler:       _TrojanServerService_ListUDPSessions_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "api.proto",
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/statistic"
+	"github.com/p4gefau1t/trojan-go/tunnel/router"
 	"github.com/p4gefau1t/trojan-go/tunnel/trojan"
 )
 
@@ -16,6 +17,8 @@ type ClientAPI struct {
 	TrojanClientServiceServer
 
 	auth          statistic.Authenticator
+	stats         *trojan.ClientStats // 客户端连接统计
+	prober        *trojan.Prober      // 服务器探测
 	ctx           context.Context
 	uploadSpeed   uint64
 	downloadSpeed uint64
@@ -51,21 +54,102 @@ func (s *ClientAPI) GetTraffic(ctx context.Context, req *GetTrafficRequest) (*Ge
 	return resp, nil
 }
 
+func (s *ClientAPI) GetClientStats(ctx context.Context, req *GetClientStatsRequest) (*GetClientStatsResponse, error) {
+	log.Debug("API: GetClientStats")
+	if s.stats == nil {
+		return nil, common.NewError("client stats is unavailable")
+	}
+	info := s.stats.Snapshot()
+	resp := &GetClientStatsResponse{
+		ActiveConnections: info.ActiveConnections,
+		Rtt:               info.RTT.Milliseconds(),
+		Dials:             info.Dials,
+		DialFailures:      info.DialFailures,
+		Destinations:      make([]*DestinationStats, 0, len(info.Destinations)),
+	}
+	for _, d := range info.Destinations {
+		resp.Destinations = append(resp.Destinations, &DestinationStats{
+			Destination: d.Destination,
+			TrafficTotal: &Traffic{
+				UploadTraffic:   d.Sent,
+				DownloadTraffic: d.Recv,
+			},
+			Connections:       d.Connections,
+			ActiveConnections: d.Active,
+		})
+	}
+	return resp, nil
+}
+
+func (s *ClientAPI) GetProbeHistory(ctx context.Context, req *GetProbeHistoryRequest) (*GetProbeHistoryResponse, error) {
+	log.Debug("API: GetProbeHistory")
+	if s.prober == nil {
+		return nil, common.NewError("server probing is disabled")
+	}
+	history := s.prober.History()
+	resp := &GetProbeHistoryResponse{
+		Healthy: s.prober.Healthy(),
+		Results: make([]*ProbeResult, 0, len(history)),
+	}
+	for _, r := range history {
+		result := &ProbeResult{
+			Time:      r.Time.Unix(),
+			Handshake: r.Handshake.Milliseconds(),
+			Rtt:       r.RTT.Milliseconds(),
+			Success:   r.Err == nil,
+		}
+		if r.Err != nil {
+			result.Error = r.Err.Error()
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	return resp, nil
+}
+
+func (s *ClientAPI) GetDNSLeaks(ctx context.Context, req *GetDNSLeaksRequest) (*GetDNSLeaksResponse, error) {
+	log.Debug("API: GetDNSLeaks")
+	enabled, total, attempts := router.DNSLeaks(s.ctx)
+	resp := &GetDNSLeaksResponse{
+		Enabled:  enabled,
+		Total:    total,
+		Attempts: make([]*DNSLeakAttempt, 0, len(attempts)),
+	}
+	for _, a := range attempts {
+		resp.Attempts = append(resp.Attempts, &DNSLeakAttempt{
+			Time:    a.Time.Unix(),
+			Kind:    a.Kind,
+			Target:  a.Target,
+			Inbound: a.Inbound,
+			Source:  a.Source,
+		})
+	}
+	return resp, nil
+}
+
 func RunClientAPI(ctx context.Context, auth statistic.Authenticator) error {
 	cfg := config.FromContext(ctx, Name).(*Config)
 	if !cfg.API.Enabled {
 		return nil
 	}
-	server, err := newAPIServer(cfg)
+	server, err := newAPIServer(cfg, false)
 	if err != nil {
 		return err
 	}
 	defer server.Stop()
 	service := &ClientAPI{
-		ctx:  ctx,
-		auth: auth,
+		ctx:    ctx,
+		auth:   auth,
+		stats:  trojan.ClientStatsFromContext(ctx),
+		prober: trojan.ProberFromContext(ctx),
 	}
 	RegisterTrojanClientServiceServer(server, service)
+	if cfg.API.WebSocket.Enabled { // 本地的 websocket 控制通道
+		go func() {
+			if err := RunWebSocketControl(ctx, auth, &cfg.API.WebSocket); err != nil {
+				log.Error(common.NewError("websocket control stopped").Base(err))
+			}
+		}()
+	}
 	addr, err := net.ResolveIPAddr("ip", cfg.API.APIHost)
 	if err != nil {
 		return common.NewError("api found invalid addr").Base(err)
@@ -6,11 +6,16 @@ import (
 	"testing"
 	"time"
 
+	"golang.org/x/net/websocket"
 	"google.golang.org/grpc"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/statistic/memory"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
+	"github.com/p4gefau1t/trojan-go/tunnel/transport"
+	"github.com/p4gefau1t/trojan-go/tunnel/trojan"
 )
 
 func TestClientAPI(t *testing.T) {
@@ -27,6 +32,7 @@ func TestClientAPI(t *testing.T) {
 			APIPort: port,
 		},
 	})
+	ctx = trojan.WithClientStats(ctx, trojan.NewClientStats())
 	auth, err := memory.NewAuthenticator(ctx)
 	common.Must(err)
 	go RunClientAPI(ctx, auth)
@@ -53,5 +59,95 @@ func TestClientAPI(t *testing.T) {
 	if err == nil {
 		t.Fail()
 	}
+	stats, err := client.GetClientStats(ctx, &GetClientStatsRequest{})
+	common.Must(err)
+	if stats.ActiveConnections != 0 || len(stats.Destinations) != 0 {
+		t.Fail()
+	}
 	cancel()
 }
+
+func TestWebSocketControl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = tunnel.WithScopedRegistry(ctx)
+	ctx = config.WithConfig(ctx, memory.Name,
+		&memory.Config{
+			Passwords: []string{"useless"},
+		})
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	ctx = config.WithConfig(ctx, transport.Name, &transport.Config{
+		RemoteHost: "127.0.0.1",
+		RemotePort: 443,
+	})
+	transportClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	defer transportClient.Close()
+	// 另一个代理的客户端不受控制通道影响
+	otherCtx := tunnel.WithScopedRegistry(context.Background())
+	otherCtx = config.WithConfig(otherCtx, freedom.Name, &freedom.Config{})
+	otherCtx = config.WithConfig(otherCtx, transport.Name, &transport.Config{
+		RemoteHost: "127.0.0.1",
+		RemotePort: 443,
+	})
+	otherClient, err := transport.NewClient(otherCtx, nil)
+	common.Must(err)
+	defer otherClient.Close()
+	auth, err := memory.NewAuthenticator(ctx)
+	common.Must(err)
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	go RunWebSocketControl(ctx, auth, &WebSocketConfig{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+		Path:      "/control",
+		Token:     "secret",
+	})
+	time.Sleep(time.Second)
+
+	url := fmt.Sprintf("ws://127.0.0.1:%d/control", port)
+	if _, err := websocket.Dial(url+"?token=wrong", "", "http://localhost/"); err == nil {
+		t.Fatal("invalid token should be rejected")
+	}
+	conn, err := websocket.Dial(url+"?token=secret", "", "http://localhost/")
+	common.Must(err)
+	defer conn.Close()
+
+	msg := new(controlMessage)
+	common.Must(websocket.JSON.Receive(conn, msg))
+	if msg.Type != controlStatus {
+		t.Fatal("status is not sent on connect", msg.Type)
+	}
+
+	common.Must(websocket.JSON.Send(conn, &controlRequest{ID: 1, Command: "switch_server", Server: "127.0.0.1:8443"}))
+	event := map[string]interface{}{}
+	common.Must(websocket.JSON.Receive(conn, &event))
+	if event["event"] != "server_switched" {
+		t.Fatal("wrong event", event)
+	}
+	resp := map[string]interface{}{}
+	common.Must(websocket.JSON.Receive(conn, &resp))
+	if resp["type"] != controlResponse || resp["id"] != float64(1) || resp["error"] != nil {
+		t.Fatal("wrong response", resp)
+	}
+	servers := transport.CurrentServers(ctx)
+	if len(servers) != 1 || servers[0].String() != "127.0.0.1:8443" {
+		t.Fatal("server is not switched", servers)
+	}
+	if servers := transport.CurrentServers(otherCtx); len(servers) != 1 || servers[0].String() != "127.0.0.1:443" {
+		t.Fatal("server of another proxy is switched", servers)
+	}
+
+	common.Must(websocket.JSON.Send(conn, &controlRequest{ID: 2, Command: "unknown"}))
+	for {
+		resp := map[string]interface{}{}
+		common.Must(websocket.JSON.Receive(conn, &resp))
+		if resp["type"] == controlStatus { // 跳过定期推送的状态
+			continue
+		}
+		if resp["id"] != float64(2) || resp["error"] == nil {
+			t.Fatal("unknown command should fail", resp)
+		}
+		break
+	}
+}
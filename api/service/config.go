@@ -12,11 +12,36 @@ type SSLConfig struct {
 	ClientCertPath []string `json:"client_cert" yaml:"client-cert"`
 }
 
+// TunnelUserConfig 允许通过隧道访问 API 的用户及其可以调用的方法
+type TunnelUserConfig struct {
+	Password string   `json:"password" yaml:"password"`
+	Hash     string   `json:"password_hash" yaml:"password-hash"` // 密码的 SHA224 十六进制值，可以代替明文密码
+	Methods  []string `json:"methods" yaml:"methods"`
+}
+
+type TunnelConfig struct {
+	Enabled bool               `json:"enabled" yaml:"enabled"`
+	Users   []TunnelUserConfig `json:"users" yaml:"users"`
+}
+
+// WebSocketConfig 客户端本地的 websocket 控制通道，供图形界面和浏览器扩展使用
+type WebSocketConfig struct {
+	Enabled        bool     `json:"enabled" yaml:"enabled"`
+	LocalHost      string   `json:"local_addr" yaml:"local-addr"`
+	LocalPort      int      `json:"local_port" yaml:"local-port"`
+	Path           string   `json:"path" yaml:"path"`
+	Token          string   `json:"token" yaml:"token"`
+	Origins        []string `json:"origins" yaml:"origins"`
+	StatusInterval int      `json:"status_interval" yaml:"status-interval"`
+}
+
 type APIConfig struct {
-	Enabled bool      `json:"enabled" yaml:"enabled"`
-	APIHost string    `json:"api_addr" yaml:"api-addr"`
-	APIPort int       `json:"api_port" yaml:"api-port"`
-	SSL     SSLConfig `json:"ssl" yaml:"ssl"`
+	Enabled   bool            `json:"enabled" yaml:"enabled"`
+	APIHost   string          `json:"api_addr" yaml:"api-addr"`
+	APIPort   int             `json:"api_port" yaml:"api-port"`
+	SSL       SSLConfig       `json:"ssl" yaml:"ssl"`
+	Tunnel    TunnelConfig    `json:"tunnel" yaml:"tunnel"`
+	WebSocket WebSocketConfig `json:"websocket" yaml:"websocket"`
 }
 
 type Config struct {
@@ -25,6 +50,14 @@ type Config struct {
 
 func init() {
 	config.RegisterConfigCreator(Name, func() interface{} {
-		return new(Config)
+		return &Config{
+			API: APIConfig{
+				WebSocket: WebSocketConfig{
+					LocalHost:      "127.0.0.1",
+					Path:           "/",
+					StatusInterval: 1,
+				},
+			},
+		}
 	})
 }
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel/trojan"
+)
+
+// permissions limits the API methods which can be called by each user through the trojan tunnel.
+// Connections from the API listener are not limited
+type permissions map[string]map[string]bool
+
+func newPermissions(users []TunnelUserConfig) permissions {
+	p := make(permissions)
+	for _, user := range users {
+		methods := make(map[string]bool)
+		for _, method := range user.Methods {
+			methods[method] = true
+		}
+		if user.Password != "" {
+			p[common.SHA224String(user.Password)] = methods
+		}
+		if user.Hash != "" {
+			p[strings.ToLower(user.Hash)] = methods
+		}
+	}
+	return p
+}
+
+func (p permissions) check(ctx context.Context, fullMethod string) error {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	addr, ok := pr.Addr.(*trojan.TunnelAddr)
+	if !ok {
+		return nil
+	}
+	method := path.Base(fullMethod)
+	methods := p[addr.Hash]
+	if methods["*"] || methods[method] {
+		return nil
+	}
+	log.Warn("user", addr.Hash, "is not allowed to call api", method, "through the tunnel")
+	return status.Error(codes.PermissionDenied, "method "+method+" is not allowed")
+}
+
+func (p permissions) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := p.check(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (p permissions) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := p.check(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// mutatingMethods change the state of the server, they are rejected when the api is read-only
+var mutatingMethods = map[string]bool{
+	"SetUsers":             true,
+	"ReloadAuthenticator":  true,
+	"UpdateWebsocketRoute": true,
+	"ResetTraffic":         true,
+}
+
+func checkReadOnly(fullMethod string) error {
+	method := path.Base(fullMethod)
+	if mutatingMethods[method] {
+		return status.Error(codes.PermissionDenied, "method "+method+" is not allowed, the api is read-only")
+	}
+	return nil
+}
+
+func readOnlyUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := checkReadOnly(info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func readOnlyStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := checkReadOnly(info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -15,13 +16,19 @@ import (
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/redirector"
 	"github.com/p4gefau1t/trojan-go/statistic"
+	"github.com/p4gefau1t/trojan-go/tunnel/shadowsocks"
 	"github.com/p4gefau1t/trojan-go/tunnel/trojan"
+	"github.com/p4gefau1t/trojan-go/tunnel/websocket"
 )
 
 type ServerAPI struct {
 	TrojanServerServiceServer
-	auth statistic.Authenticator // 认证模块
+	auth     statistic.Authenticator // 认证模块
+	sessions *trojan.SessionTable    // UDP 会话表
+	usage    *statistic.UsageTracker // 月度流量统计，未开启时为空
+	ctx      context.Context         // 代理的上下文，用于访问运行中的实例
 }
 
 // 获取用户
@@ -54,7 +61,7 @@ func (s *ServerAPI) GetUsers(stream TrojanServerService_GetUsersServer) error {
 		downloadSpeedLimit, uploadSpeedLimit := user.GetSpeedLimit()
 		ipLimit := user.GetIPLimit()
 		ipCurrent := user.GetIP()
-		err = stream.Send(&GetUsersResponse{
+		resp := &GetUsersResponse{
 			Success: true,
 			Status: &UserStatus{
 				User: req.User,
@@ -73,7 +80,9 @@ func (s *ServerAPI) GetUsers(stream TrojanServerService_GetUsersServer) error {
 				IpCurrent: int32(ipCurrent),
 				IpLimit:   int32(ipLimit),
 			},
-		})
+		}
+		setAccountedTraffic(resp.Status, user)
+		err = stream.Send(resp)
 		if err != nil {
 			return err
 		}
@@ -145,6 +154,24 @@ func (s *ServerAPI) SetUsers(stream TrojanServerService_SetUsersServer) error {
 	}
 }
 
+// setAccountedTraffic fills the wire and payload traffic if the user keeps them
+func setAccountedTraffic(status *UserStatus, user statistic.User) {
+	meter, ok := user.(statistic.AccountingMeter)
+	if !ok {
+		return
+	}
+	wireSent, wireRecv := meter.GetWire()
+	payloadSent, payloadRecv := meter.GetPayload()
+	status.TrafficWire = &Traffic{
+		DownloadTraffic: wireSent,
+		UploadTraffic:   wireRecv,
+	}
+	status.TrafficPayload = &Traffic{
+		DownloadTraffic: payloadSent,
+		UploadTraffic:   payloadRecv,
+	}
+}
+
 func (s *ServerAPI) ListUsers(req *ListUsersRequest, stream TrojanServerService_ListUsersServer) error {
 	log.Debug("API: ListUsers")
 	users := s.auth.ListUsers()
@@ -154,7 +181,7 @@ func (s *ServerAPI) ListUsers(req *ListUsersRequest, stream TrojanServerService_
 		downloadSpeedLimit, uploadSpeedLimit := user.GetSpeedLimit()
 		ipLimit := user.GetIPLimit()
 		ipCurrent := user.GetIP()
-		err := stream.Send(&ListUsersResponse{
+		resp := &ListUsersResponse{
 			Status: &UserStatus{
 				User: &User{
 					Hash: user.Hash(),
@@ -174,6 +201,38 @@ func (s *ServerAPI) ListUsers(req *ListUsersRequest, stream TrojanServerService_
 				IpLimit:   int32(ipLimit),
 				IpCurrent: int32(ipCurrent),
 			},
+		}
+		setAccountedTraffic(resp.Status, user)
+		err := stream.Send(resp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 列出所有活跃的 UDP 会话
+func (s *ServerAPI) ListUDPSessions(req *ListUDPSessionsRequest, stream TrojanServerService_ListUDPSessionsServer) error {
+	log.Debug("API: ListUDPSessions")
+	if s.sessions == nil {
+		return common.NewError("udp session table is unavailable")
+	}
+	for _, session := range s.sessions.List() {
+		err := stream.Send(&ListUDPSessionsResponse{
+			Session: &UDPSession{
+				Id: session.ID,
+				User: &User{
+					Hash: session.Hash,
+				},
+				Source:      session.Source,
+				Destination: session.Destination,
+				TrafficTotal: &Traffic{
+					DownloadTraffic: session.Sent,
+					UploadTraffic:   session.Recv,
+				},
+				Age:  int64(session.Age.Seconds()),
+				Idle: int64(session.Idle.Seconds()),
+			},
 		})
 		if err != nil {
 			return err
@@ -182,8 +241,200 @@ func (s *ServerAPI) ListUsers(req *ListUsersRequest, stream TrojanServerService_
 	return nil
 }
 
-func newAPIServer(cfg *Config) (*grpc.Server, error) {
-	var server *grpc.Server
+// 获取 shadowsocks 防重放过滤器的统计信息
+func (s *ServerAPI) GetReplayStats(ctx context.Context, req *GetReplayStatsRequest) (*GetReplayStatsResponse, error) {
+	log.Debug("API: GetReplayStats")
+	stats := shadowsocks.GetReplayStats(s.ctx)
+	if stats == nil {
+		return &GetReplayStatsResponse{}, nil
+	}
+	return &GetReplayStatsResponse{
+		Enabled:     true,
+		Window:      int64(stats.Window),
+		Entries:     int64(stats.Entries),
+		MemoryBytes: stats.MemoryBytes,
+		Checked:     stats.Checked,
+		Hits:        stats.Hits,
+	}, nil
+}
+
+// 重新加载认证模块，可用于切换 memory/mysql 或者更新数据库配置
+func (s *ServerAPI) ReloadAuthenticator(ctx context.Context, req *ReloadAuthenticatorRequest) (*ReloadAuthenticatorResponse, error) {
+	log.Debug("API: ReloadAuthenticator")
+	auth, ok := s.auth.(*statistic.SwappableAuthenticator)
+	if !ok {
+		return &ReloadAuthenticatorResponse{
+			Success: false,
+			Info:    "authenticator is not reloadable",
+		}, nil
+	}
+	if err := auth.Reload(req.Config, req.Format); err != nil {
+		log.Error(common.NewError("failed to reload authenticator").Base(err))
+		return &ReloadAuthenticatorResponse{
+			Success: false,
+			Info:    err.Error(),
+		}, nil
+	}
+	return &ReloadAuthenticatorResponse{
+		Success: true,
+	}, nil
+}
+
+// 更新 websocket 服务端接受的域名和路径，不影响已经建立的连接
+func (s *ServerAPI) UpdateWebsocketRoute(ctx context.Context, req *UpdateWebsocketRouteRequest) (*UpdateWebsocketRouteResponse, error) {
+	log.Debug("API: UpdateWebsocketRoute")
+	resp := &UpdateWebsocketRouteResponse{
+		Success: true,
+	}
+	if req.Hostname != "" || len(req.Paths) != 0 {
+		if _, err := websocket.UpdateRoute(s.ctx, req.Hostname, req.Paths); err != nil {
+			resp.Success = false
+			resp.Info = err.Error()
+		}
+	}
+	for _, route := range websocket.CurrentRoutes(s.ctx) {
+		resp.Routes = append(resp.Routes, &WebsocketRoute{
+			Hostname: route.Hostname,
+			Paths:    route.Paths,
+		})
+	}
+	return resp, nil
+}
+
+// 按月查询用户流量，与累计流量相互独立
+func (s *ServerAPI) GetMonthlyUsage(ctx context.Context, req *GetMonthlyUsageRequest) (*GetMonthlyUsageResponse, error) {
+	log.Debug("API: GetMonthlyUsage")
+	if s.usage == nil {
+		return &GetMonthlyUsageResponse{}, nil
+	}
+	hash := ""
+	if req.User != nil {
+		hash = req.User.Hash
+		if req.User.Password != "" {
+			hash = common.SHA224String(req.User.Password)
+		}
+	}
+	resp := &GetMonthlyUsageResponse{
+		Enabled: true,
+		Month:   req.Month,
+		Months:  s.usage.Months(),
+	}
+	if resp.Month == "" {
+		resp.Month = s.usage.CurrentMonth()
+	}
+	for _, usage := range s.usage.Usage(resp.Month) {
+		if hash != "" && usage.User != hash {
+			continue
+		}
+		u := &MonthlyUsage{
+			Hash: usage.User,
+			TrafficTotal: &Traffic{
+				UploadTraffic:   usage.Recv,
+				DownloadTraffic: usage.Sent,
+			},
+			Limit: usage.Limit,
+		}
+		for _, threshold := range usage.Alerts {
+			u.Alerts = append(u.Alerts, int32(threshold))
+		}
+		resp.Users = append(resp.Users, u)
+	}
+	return resp, nil
+}
+
+// trafficSnapshot reads the traffic of the users at the same instant, all users if users is empty
+func (s *ServerAPI) trafficSnapshot(users []*User, reset bool) ([]*UserTraffic, error) {
+	snapshotter, ok := s.auth.(statistic.Snapshotter)
+	if !ok {
+		return nil, common.NewError("authenticator does not support traffic snapshots")
+	}
+	hashes := make([]string, 0, len(users))
+	for _, user := range users {
+		if user.Hash == "" {
+			user.Hash = common.SHA224String(user.Password)
+		}
+		hashes = append(hashes, user.Hash)
+	}
+	snapshots, err := snapshotter.SnapshotTraffic(hashes, reset)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*UserTraffic, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		result = append(result, &UserTraffic{
+			User: &User{
+				Hash: snapshot.Hash,
+			},
+			TrafficTotal: &Traffic{
+				DownloadTraffic: snapshot.Sent,
+				UploadTraffic:   snapshot.Recv,
+			},
+		})
+	}
+	return result, nil
+}
+
+// 获取同一时刻所有用户的流量
+func (s *ServerAPI) GetTrafficSnapshot(ctx context.Context, req *GetTrafficSnapshotRequest) (*GetTrafficSnapshotResponse, error) {
+	log.Debug("API: GetTrafficSnapshot")
+	now := time.Now()
+	users, err := s.trafficSnapshot(req.Users, false)
+	if err != nil {
+		return &GetTrafficSnapshotResponse{
+			Success: false,
+			Info:    err.Error(),
+		}, nil
+	}
+	return &GetTrafficSnapshotResponse{
+		Success: true,
+		Time:    now.Unix(),
+		Users:   users,
+	}, nil
+}
+
+// 获取并清零用户的流量，获取与清零之间的流量不会丢失
+func (s *ServerAPI) ResetTraffic(ctx context.Context, req *ResetTrafficRequest) (*ResetTrafficResponse, error) {
+	log.Debug("API: ResetTraffic")
+	now := time.Now()
+	users, err := s.trafficSnapshot(req.Users, true)
+	if err != nil {
+		return &ResetTrafficResponse{
+			Success: false,
+			Info:    err.Error(),
+		}, nil
+	}
+	log.Info("traffic of", len(users), "users reset by api")
+	return &ResetTrafficResponse{
+		Success: true,
+		Time:    now.Unix(),
+		Users:   users,
+	}, nil
+}
+
+// 获取回落地址的健康状态，回落地址在后台定期检查
+func (s *ServerAPI) GetFallbackStatus(ctx context.Context, req *GetFallbackStatusRequest) (*GetFallbackStatusResponse, error) {
+	log.Debug("API: GetFallbackStatus")
+	resp := &GetFallbackStatusResponse{}
+	for _, status := range redirector.FallbackStatuses() {
+		resp.Fallbacks = append(resp.Fallbacks, &FallbackStatus{
+			Address: status.Address,
+			Healthy: status.Healthy,
+			Checked: status.Checked.Unix(),
+			Error:   status.Error,
+		})
+	}
+	return resp, nil
+}
+
+func newAPIServer(cfg *Config, readOnly bool) (*grpc.Server, error) {
+	var opts []grpc.ServerOption
+	if readOnly { // 只读模式下拒绝修改状态的方法
+		opts = append(opts, grpc.ChainUnaryInterceptor(readOnlyUnaryInterceptor), grpc.ChainStreamInterceptor(readOnlyStreamInterceptor))
+	}
+	if cfg.API.Tunnel.Enabled { // 限制通过隧道访问的用户可以调用的方法
+		p := newPermissions(cfg.API.Tunnel.Users)
+		opts = append(opts, grpc.ChainUnaryInterceptor(p.unaryInterceptor), grpc.ChainStreamInterceptor(p.streamInterceptor))
+	}
 	if cfg.API.SSL.Enabled { // 开启 SSL
 		log.Info("api tls enabled")
 		keyPair, err := tls.LoadX509KeyPair(cfg.API.SSL.CertPath, cfg.API.SSL.KeyPath)
@@ -210,11 +461,9 @@ func newAPIServer(cfg *Config) (*grpc.Server, error) {
 		}
 		// 使用 gRPC 创建一个安全的 gRPC 服务器，利用 TLS（传输层安全）来保护通信
 		creds := credentials.NewTLS(tlsConfig)
-		server = grpc.NewServer(grpc.Creds(creds))
-	} else {
-		server = grpc.NewServer()
+		opts = append(opts, grpc.Creds(creds))
 	}
-	return server, nil
+	return grpc.NewServer(opts...), nil
 }
 
 // 运行服务端 api 接口服务
@@ -224,14 +473,33 @@ func RunServerAPI(ctx context.Context, auth statistic.Authenticator) error {
 		return nil
 	}
 	service := &ServerAPI{
-		auth: auth, // 认证模块
+		auth:     auth, // 认证模块
+		sessions: trojan.SessionTableFromContext(ctx),
+		usage:    statistic.UsageTrackerFromContext(ctx),
+		ctx:      ctx,
 	}
-	server, err := newAPIServer(cfg)
+	server, err := newAPIServer(cfg, statistic.IsReadOnly(ctx))
 	if err != nil {
 		return err
 	}
 	defer server.Stop()
 	RegisterTrojanServerServiceServer(server, service)
+	errChan := make(chan error, 2)
+	if tunnelListener := trojan.APIListenerFromContext(ctx); tunnelListener != nil {
+		log.Info("server-side api service is available through the tunnel")
+		go func() {
+			errChan <- server.Serve(tunnelListener)
+		}()
+		if cfg.API.APIPort == 0 { // 只通过隧道提供服务
+			select {
+			case err := <-errChan:
+				return err
+			case <-ctx.Done():
+				log.Debug("closed")
+				return nil
+			}
+		}
+	}
 	addr, err := net.ResolveIPAddr("ip", cfg.API.APIHost)
 	if err != nil {
 		return common.NewError("api found invalid addr").Base(err)
@@ -246,7 +514,6 @@ func RunServerAPI(ctx context.Context, auth statistic.Authenticator) error {
 	}
 	defer listener.Close()
 	log.Info("server-side api service is listening on", listener.Addr().String())
-	errChan := make(chan error, 1)
 	go func() {
 		errChan <- server.Serve(listener)
 	}()
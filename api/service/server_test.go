@@ -5,16 +5,21 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/statistic/memory"
+	"github.com/p4gefau1t/trojan-go/tunnel/trojan"
 )
 
 func TestServerAPI(t *testing.T) {
@@ -70,6 +75,25 @@ func TestServerAPI(t *testing.T) {
 		t.Fatal("wrong traffic")
 	}
 
+	snapshot, err := server.GetTrafficSnapshot(ctx, &GetTrafficSnapshotRequest{})
+	common.Must(err)
+	if !snapshot.Success || len(snapshot.Users) != 1 || snapshot.Users[0].TrafficTotal.DownloadTraffic != 1234 {
+		t.Fatal("wrong snapshot", snapshot)
+	}
+	reset, err := server.ResetTraffic(ctx, &ResetTrafficRequest{Users: []*User{{Hash: "hash1234"}}})
+	common.Must(err)
+	if !reset.Success || len(reset.Users) != 1 || reset.Users[0].TrafficTotal.UploadTraffic != 5678 {
+		t.Fatal("wrong reset", reset)
+	}
+	if sent, recv := user.GetTraffic(); sent != 0 || recv != 0 {
+		t.Fatal("traffic is not reset")
+	}
+	reset, err = server.ResetTraffic(ctx, &ResetTrafficRequest{Users: []*User{{Hash: "invalid"}}})
+	common.Must(err)
+	if reset.Success {
+		t.Fatal("reset unknown user")
+	}
+
 	stream3, err := server.SetUsers(ctx)
 	common.Must(err)
 	stream3.Send(&SetUsersRequest{
@@ -157,6 +181,95 @@ func TestServerAPI(t *testing.T) {
 	cancel()
 }
 
+// tunnelListener marks the accepted connections as if they came from the trojan tunnel
+type tunnelListener struct {
+	net.Listener
+	hash string
+}
+
+type tunnelConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tunnelConn{
+		Conn: conn,
+		addr: &trojan.TunnelAddr{Addr: conn.RemoteAddr(), Hash: l.hash},
+	}, nil
+}
+
+func TestTunnelPermission(t *testing.T) {
+	cfg := &Config{
+		APIConfig{
+			Enabled: true,
+			Tunnel: TunnelConfig{
+				Enabled: true,
+				Users: []TunnelUserConfig{
+					{Password: "monitor", Methods: []string{"GetReplayStats"}},
+					{Hash: strings.ToUpper(common.SHA224String("hashed")), Methods: []string{"GetReplayStats"}},
+				},
+			},
+		},
+	}
+	server, err := newAPIServer(cfg, false)
+	common.Must(err)
+	defer server.Stop()
+	RegisterTrojanServerServiceServer(server, &ServerAPI{ctx: context.Background()})
+
+	for password, allowed := range map[string]bool{"monitor": true, "hashed": true, "other": false} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		common.Must(err)
+		go server.Serve(&tunnelListener{Listener: listener, hash: common.SHA224String(password)})
+		conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+		common.Must(err)
+		client := NewTrojanServerServiceClient(conn)
+		_, err = client.GetReplayStats(context.Background(), &GetReplayStatsRequest{})
+		if (err == nil) != allowed {
+			t.Fatal("wrong permission for", password, err)
+		}
+		_, err = client.ReloadAuthenticator(context.Background(), &ReloadAuthenticatorRequest{})
+		if status.Code(err) != codes.PermissionDenied {
+			t.Fatal("method should be denied", err)
+		}
+		conn.Close()
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	server, err := newAPIServer(&Config{APIConfig{Enabled: true}}, true)
+	common.Must(err)
+	defer server.Stop()
+	RegisterTrojanServerServiceServer(server, &ServerAPI{ctx: context.Background()})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	go server.Serve(listener)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	common.Must(err)
+	defer conn.Close()
+	client := NewTrojanServerServiceClient(conn)
+	if _, err := client.GetReplayStats(context.Background(), &GetReplayStatsRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReloadAuthenticator(context.Background(), &ReloadAuthenticatorRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("method should be denied", err)
+	}
+	stream, err := client.SetUsers(context.Background())
+	common.Must(err)
+	if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("stream should be denied", err)
+	}
+}
+
 func TestTLSRSA(t *testing.T) {
 	port := common.PickPort("tcp", "127.0.0.1")
 	cfg := &Config{
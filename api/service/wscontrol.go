@@ -0,0 +1,280 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
+	"github.com/p4gefau1t/trojan-go/statistic"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/router"
+	"github.com/p4gefau1t/trojan-go/tunnel/transport"
+	"github.com/p4gefau1t/trojan-go/tunnel/trojan"
+)
+
+// 控制通道的消息类型
+const (
+	controlStatus   = "status"   // 定期推送的状态
+	controlEvent    = "event"    // 状态变化的事件，推送给所有连接
+	controlResponse = "response" // 命令的响应
+)
+
+const controlWriteTimeout = time.Second * 5
+
+// controlRequest is a command sent by the frontend
+type controlRequest struct {
+	ID      int    `json:"id"`
+	Command string `json:"command"`
+	Server  string `json:"server,omitempty"`  // switch_server 的目标服务器 host:port
+	Enabled *bool  `json:"enabled,omitempty"` // set_rules 为空时切换当前状态
+}
+
+// controlMessage is a message sent to the frontend
+type controlMessage struct {
+	Type  string      `json:"type"`
+	ID    int         `json:"id,omitempty"`
+	Event string      `json:"event,omitempty"`
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// ControlStatus is the status of the client pushed through the websocket control channel
+type ControlStatus struct {
+	Servers           []string `json:"servers"`
+	RulesEnabled      bool     `json:"rules_enabled"`
+	UploadTraffic     uint64   `json:"upload_traffic"`
+	DownloadTraffic   uint64   `json:"download_traffic"`
+	UploadSpeed       uint64   `json:"upload_speed"`
+	DownloadSpeed     uint64   `json:"download_speed"`
+	ActiveConnections int64    `json:"active_connections"`
+	Healthy           bool     `json:"healthy"`
+	Latency           int64    `json:"latency"` // 最近一次探测的延迟，单位毫秒，未开启探测时为 0
+}
+
+type controlSession struct {
+	conn *websocket.Conn
+	lock sync.Mutex
+}
+
+func (s *controlSession) send(msg *controlMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout)) // 避免阻塞其他连接的推送
+	return websocket.JSON.Send(s.conn, msg)
+}
+
+// WebSocketControl is the local websocket endpoint emitting the status and events of the client and accepting commands
+type WebSocketControl struct {
+	auth         statistic.Authenticator
+	stats        *trojan.ClientStats
+	prober       *trojan.Prober
+	token        string
+	origins      []string
+	interval     time.Duration
+	sessions     map[*controlSession]struct{}
+	sessionsLock sync.Mutex
+	ctx          context.Context
+}
+
+func (c *WebSocketControl) status() *ControlStatus {
+	status := &ControlStatus{
+		Servers:      []string{},
+		RulesEnabled: router.RulesEnabled(c.ctx),
+		Healthy:      len(metrics.CheckHealth()) == 0, // 如传输层插件反复退出
+	}
+	for _, addr := range transport.CurrentServers(c.ctx) {
+		status.Servers = append(status.Servers, addr.String())
+	}
+	for _, user := range c.auth.ListUsers() {
+		sent, recv := user.GetTraffic()
+		sentSpeed, recvSpeed := user.GetSpeed()
+		status.UploadTraffic += sent
+		status.DownloadTraffic += recv
+		status.UploadSpeed += sentSpeed
+		status.DownloadSpeed += recvSpeed
+	}
+	if c.stats != nil {
+		status.ActiveConnections = c.stats.Snapshot().ActiveConnections
+	}
+	if c.prober != nil {
+		status.Healthy = status.Healthy && c.prober.Healthy()
+		if latency, ok := c.prober.Latency(); ok {
+			status.Latency = latency.Milliseconds()
+		}
+	}
+	return status
+}
+
+func (c *WebSocketControl) broadcast(msg *controlMessage) {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	for s := range c.sessions {
+		if err := s.send(msg); err != nil {
+			log.Debug(common.NewError("websocket control failed to send").Base(err))
+		}
+	}
+}
+
+// handle runs the command, the state changes are broadcast to all frontends as events
+func (c *WebSocketControl) handle(req *controlRequest) (interface{}, error) {
+	switch req.Command {
+	case "status":
+		return c.status(), nil
+	case "switch_server":
+		addr, err := tunnel.NewAddressFromAddr("tcp", req.Server)
+		if err != nil {
+			return nil, common.NewError("invalid server " + req.Server).Base(err)
+		}
+		if transport.SwitchServer(c.ctx, addr) == 0 {
+			return nil, common.NewError("no switchable server")
+		}
+		c.broadcast(&controlMessage{
+			Type:  controlEvent,
+			Event: "server_switched",
+			Data:  map[string]string{"server": addr.String()},
+		})
+		return nil, nil
+	case "set_rules":
+		enabled := !router.RulesEnabled(c.ctx)
+		if req.Enabled != nil {
+			enabled = *req.Enabled
+		}
+		if router.SetRulesEnabled(c.ctx, enabled) == 0 {
+			return nil, common.NewError("router is disabled")
+		}
+		c.broadcast(&controlMessage{
+			Type:  controlEvent,
+			Event: "rules_changed",
+			Data:  map[string]bool{"enabled": enabled},
+		})
+		return nil, nil
+	default:
+		return nil, common.NewError("unknown command " + req.Command)
+	}
+}
+
+func (c *WebSocketControl) serve(conn *websocket.Conn) {
+	defer conn.Close()
+	session := &controlSession{conn: conn}
+	if err := session.send(&controlMessage{Type: controlStatus, Data: c.status()}); err != nil {
+		return
+	}
+	c.sessionsLock.Lock()
+	c.sessions[session] = struct{}{}
+	c.sessionsLock.Unlock()
+	defer func() {
+		c.sessionsLock.Lock()
+		delete(c.sessions, session)
+		c.sessionsLock.Unlock()
+	}()
+	log.Info("websocket control connected from", conn.Request().RemoteAddr)
+
+	for {
+		req := new(controlRequest)
+		if err := websocket.JSON.Receive(conn, req); err != nil {
+			log.Debug(common.NewError("websocket control disconnected").Base(err))
+			return
+		}
+		log.Debug("websocket control command", req.Command)
+		resp := &controlMessage{
+			Type: controlResponse,
+			ID:   req.ID,
+		}
+		data, err := c.handle(req)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Data = data
+		}
+		if err := session.send(resp); err != nil {
+			return
+		}
+	}
+}
+
+// handshake checks the origin of the browser and the token in the query
+func (c *WebSocketControl) handshake(_ *websocket.Config, r *http.Request) error {
+	if len(c.origins) != 0 {
+		origin := r.Header.Get("Origin")
+		allowed := false
+		for _, o := range c.origins {
+			if o == "*" || o == origin {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return common.NewError("websocket control origin not allowed: " + origin)
+		}
+	}
+	if c.token != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(c.token)) != 1 {
+		return common.NewError("invalid websocket control token")
+	}
+	return nil
+}
+
+func (c *WebSocketControl) statusLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.broadcast(&controlMessage{Type: controlStatus, Data: c.status()})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RunWebSocketControl serves the websocket control channel until the context is done
+func RunWebSocketControl(ctx context.Context, auth statistic.Authenticator, cfg *WebSocketConfig) error {
+	control := &WebSocketControl{
+		auth:     auth,
+		stats:    trojan.ClientStatsFromContext(ctx),
+		prober:   trojan.ProberFromContext(ctx),
+		token:    cfg.Token,
+		origins:  cfg.Origins,
+		interval: time.Second * time.Duration(cfg.StatusInterval),
+		sessions: make(map[*controlSession]struct{}),
+		ctx:      ctx,
+	}
+	if control.interval <= 0 {
+		control.interval = time.Second
+	}
+	listener, err := net.Listen("tcp", tunnel.NewAddressFromHostPort("tcp", cfg.LocalHost, cfg.LocalPort).String())
+	if err != nil {
+		return common.NewError("websocket control failed to listen").Base(err)
+	}
+	if cfg.Token == "" && len(cfg.Origins) == 0 {
+		log.Warn("websocket control has no token or origins, any local process or web page can control the client")
+	}
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, websocket.Server{
+		Handshake: control.handshake,
+		Handler:   control.serve,
+	})
+	server := &http.Server{Handler: mux}
+	defer server.Close()
+	go control.statusLoop(ctx)
+	log.Info("websocket control is listening on", listener.Addr().String())
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Serve(listener)
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		log.Debug("closed")
+		return nil
+	}
+}
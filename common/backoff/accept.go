@@ -0,0 +1,84 @@
+package backoff
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// 接收连接失败后的等待时间，与 net/http 相同，从 5ms 翻倍到 1s
+var acceptConfig = Config{
+	InitialDelay: 5,
+	MaxDelay:     1000,
+	Multiplier:   2,
+}
+
+// AcceptBackoff waits between the failed accepts of a loop, so that the loop keeps serving after
+// the transient errors such as EMFILE instead of exiting or spinning
+type AcceptBackoff struct {
+	component string
+	backoff   *Backoff
+}
+
+// NewAcceptBackoff creates the backoff of the accept loop of the component
+func NewAcceptBackoff(component string) *AcceptBackoff {
+	policy, err := New("accept_"+component, &acceptConfig)
+	common.Must(err)
+	return &AcceptBackoff{
+		component: component,
+		backoff:   policy.NewBackoff(),
+	}
+}
+
+// Wait is called after the accept failed. It returns false if the loop should stop, i.e. the listener is closed
+// or the context is done, otherwise it returns true after waiting for the next accept
+func (a *AcceptBackoff) Wait(ctx context.Context, err error) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	default:
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	d := a.backoff.Next()
+	if Temporary(err) {
+		log.Warn(common.NewError(a.component + " accept error, retry in " + d.String()).Base(err))
+	} else {
+		log.Error(common.NewError(a.component + " accept error, retry in " + d.String()).Base(err))
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Reset is called after a connection is accepted
+func (a *AcceptBackoff) Reset() {
+	a.backoff.Reset()
+}
+
+// Temporary reports whether the accept error is expected to go away by itself,
+// e.g. running out of file descriptors or the connection aborted by the peer before it was accepted
+func Temporary(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var tempErr interface{ Temporary() bool }
+	return errors.As(err, &tempErr) && tempErr.Temporary()
+}
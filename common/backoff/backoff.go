@@ -0,0 +1,136 @@
+// Package backoff implements the jittered exponential retry policy shared by the components
+package backoff
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
+)
+
+// Config is the retry policy of a component
+type Config struct {
+	MaxAttempts  int     `json:"max_attempts" yaml:"max-attempts"`   // 包括第一次尝试，小于等于 1 表示不重试
+	InitialDelay int     `json:"initial_delay" yaml:"initial-delay"` // 第一次重试前等待的毫秒数
+	MaxDelay     int     `json:"max_delay" yaml:"max-delay"`         // 等待的最大毫秒数
+	Multiplier   float64 `json:"multiplier" yaml:"multiplier"`       // 每次重试后等待时间的倍数
+	Jitter       float64 `json:"jitter" yaml:"jitter"`               // 等待时间随机浮动的比例，0-1
+}
+
+// Policy retries the failed operations of a component with exponentially growing delays.
+// A nil Policy does not retry
+type Policy struct {
+	component    string
+	maxAttempts  int
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	multiplier   float64
+	jitter       float64
+	retries      *metrics.Counter
+	failures     *metrics.Counter
+}
+
+// Delay returns the time to wait after the attempt (starting from 0) failed
+func (p *Policy) Delay(attempt int) time.Duration {
+	d := float64(p.initialDelay) * math.Pow(p.multiplier, float64(attempt))
+	if p.jitter > 0 {
+		// 在 [1-jitter, 1+jitter] 之间浮动，避免大量客户端同时重试
+		d *= 1 - p.jitter + 2*p.jitter*rand.Float64()
+	}
+	if d > float64(p.maxDelay) {
+		return p.maxDelay
+	}
+	return time.Duration(d)
+}
+
+// Retry calls f until it succeeds, the attempts are used up or the context is done, the last error is returned
+func (p *Policy) Retry(ctx context.Context, f func() error) error {
+	if p == nil {
+		return f()
+	}
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if attempt+1 >= p.maxAttempts {
+			p.failures.Inc()
+			return err
+		}
+		p.retries.Inc()
+		d := p.Delay(attempt)
+		log.Debug(p.component, "attempt", attempt+1, "failed, retry in", d, "error:", err)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Backoff tracks the consecutive failures of a loop which never gives up
+type Backoff struct {
+	policy  *Policy
+	attempt int
+}
+
+// Next returns the time to wait after another failure
+func (b *Backoff) Next() time.Duration {
+	d := b.policy.Delay(b.attempt)
+	if d < b.policy.maxDelay {
+		b.attempt++
+	}
+	b.policy.retries.Inc()
+	return d
+}
+
+// Reset is called after a success
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// NewBackoff creates a backoff of the loop using the policy, the max attempts are ignored
+func (p *Policy) NewBackoff() *Backoff {
+	return &Backoff{
+		policy: p,
+	}
+}
+
+// Validate checks the delays, the multiplier and the jitter
+func (c *Config) Validate() error {
+	if c.InitialDelay <= 0 || c.MaxDelay < c.InitialDelay {
+		return common.NewError("invalid retry delays")
+	}
+	if c.Multiplier < 1 {
+		return common.NewError("invalid retry multiplier, it must be at least 1")
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return common.NewError("invalid retry jitter, it must be in [0, 1]")
+	}
+	return nil
+}
+
+// New creates the policy of the component from the config
+func New(component string, cfg *Config) (*Policy, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, common.NewError(component + " has " + err.Error())
+	}
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &Policy{
+		component:    component,
+		maxAttempts:  maxAttempts,
+		initialDelay: time.Duration(cfg.InitialDelay) * time.Millisecond,
+		maxDelay:     time.Duration(cfg.MaxDelay) * time.Millisecond,
+		multiplier:   cfg.Multiplier,
+		jitter:       cfg.Jitter,
+		retries:      metrics.NewCounter("trojan_go_retries_total", "Number of the retries after failures.", "component", component),
+		failures:     metrics.NewCounter("trojan_go_retry_exhausted_total", "Number of the operations failed after all the attempts.", "component", component),
+	}, nil
+}
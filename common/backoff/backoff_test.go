@@ -0,0 +1,152 @@
+package backoff
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	p, err := New("test_delay", &Config{
+		MaxAttempts:  5,
+		InitialDelay: 100,
+		MaxDelay:     1000,
+		Multiplier:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if p.Delay(i) != d*time.Millisecond {
+			t.Fatal("unexpected delay", i, p.Delay(i))
+		}
+	}
+
+	p.jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.Delay(1); d < 100*time.Millisecond || d > 300*time.Millisecond {
+			t.Fatal("jittered delay out of range", d)
+		}
+	}
+
+	p.jitter = 0
+	b := p.NewBackoff()
+	for _, d := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if b.Next() != d*time.Millisecond {
+			t.Fatal("unexpected backoff")
+		}
+	}
+	b.Reset()
+	if b.Next() != 100*time.Millisecond {
+		t.Fatal("backoff is not reset")
+	}
+
+	for _, cfg := range []*Config{
+		{InitialDelay: 0, MaxDelay: 100, Multiplier: 2},
+		{InitialDelay: 100, MaxDelay: 10, Multiplier: 2},
+		{InitialDelay: 100, MaxDelay: 1000, Multiplier: 0.5},
+		{InitialDelay: 100, MaxDelay: 1000, Multiplier: 2, Jitter: 2},
+	} {
+		if _, err := New("test_invalid", cfg); err == nil {
+			t.Fatal("invalid config is accepted", cfg)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	p, err := New("test_retry", &Config{
+		MaxAttempts:  3,
+		InitialDelay: 10,
+		MaxDelay:     100,
+		Multiplier:   2,
+		Jitter:       0.2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := 0
+	err = p.Retry(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatal("retry failed", attempts, err)
+	}
+	if p.retries.Value() != 2 {
+		t.Fatal("unexpected retries", p.retries.Value())
+	}
+
+	attempts = 0
+	err = p.Retry(context.Background(), func() error {
+		attempts++
+		return errors.New("failed")
+	})
+	if err == nil || attempts != 3 || p.failures.Value() != 1 {
+		t.Fatal("retry does not give up", attempts, err)
+	}
+
+	// 取消后不再重试
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	p.Retry(ctx, func() error {
+		attempts++
+		return errors.New("failed")
+	})
+	if attempts != 1 {
+		t.Fatal("retry after the context is done")
+	}
+
+	var nilPolicy *Policy
+	attempts = 0
+	nilPolicy.Retry(context.Background(), func() error {
+		attempts++
+		return errors.New("failed")
+	})
+	if attempts != 1 {
+		t.Fatal("nil policy retries")
+	}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+	if !Temporary(emfile) {
+		t.Fatal("EMFILE is not temporary")
+	}
+	if Temporary(errors.New("failed")) || Temporary(net.ErrClosed) {
+		t.Fatal("permanent error is temporary")
+	}
+
+	a := NewAcceptBackoff("test")
+	a.backoff.policy.maxDelay = 10 * time.Millisecond
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if !a.Wait(context.Background(), emfile) {
+			t.Fatal("accept loop stopped after a temporary error")
+		}
+	}
+	if time.Since(start) < 15*time.Millisecond {
+		t.Fatal("accept loop does not back off")
+	}
+	a.Reset()
+	if a.backoff.attempt != 0 {
+		t.Fatal("backoff is not reset")
+	}
+
+	if a.Wait(context.Background(), &net.OpError{Op: "accept", Err: net.ErrClosed}) {
+		t.Fatal("accept loop continues after the listener is closed")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if a.Wait(ctx, emfile) {
+		t.Fatal("accept loop continues after the context is done")
+	}
+}
@@ -8,6 +8,10 @@ import (
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
+
+	v2router "github.com/v2fly/v2ray-core/v4/app/router"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/common/geodata"
@@ -68,6 +72,42 @@ func TestDecodeGeoSite(t *testing.T) {
 	}
 }
 
+func TestSharedLoader(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "geoip.dat")
+	writeGeoIP := func(prefix uint32) {
+		data, err := proto.Marshal(&v2router.GeoIPList{
+			Entry: []*v2router.GeoIP{
+				{
+					CountryCode: "TEST",
+					Cidr:        []*v2router.CIDR{{Ip: []byte{10, 0, 0, 0}, Prefix: prefix}},
+				},
+			},
+		})
+		common.Must(err)
+		common.Must(common.WriteFile(filename, data))
+	}
+	writeGeoIP(8)
+
+	// 不同实例的加载器返回同一份数据
+	cidrs1, err := geodata.NewGeodataLoader().LoadIP(filename, "test")
+	common.Must(err)
+	cidrs2, err := geodata.NewGeodataLoader().LoadIP(filename, "test")
+	common.Must(err)
+	if len(cidrs1) != 1 || len(cidrs2) != 1 || cidrs1[0] != cidrs2[0] {
+		t.Fatal("geoip entries are not shared")
+	}
+
+	// 文件变化后重新加载
+	writeGeoIP(16)
+	later := time.Now().Add(time.Second)
+	common.Must(os.Chtimes(filename, later, later))
+	cidrs3, err := geodata.NewGeodataLoader().LoadIP(filename, "test")
+	common.Must(err)
+	if len(cidrs3) != 1 || cidrs3[0].Prefix != 16 {
+		t.Fatal("changed geoip file is not reloaded")
+	}
+}
+
 func BenchmarkLoadGeoIP(b *testing.B) {
 	m1 := runtime.MemStats{}
 	m2 := runtime.MemStats{}
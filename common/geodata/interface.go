@@ -2,6 +2,7 @@ package geodata
 
 import v2router "github.com/v2fly/v2ray-core/v4/app/router"
 
+// GeodataLoader loads the entries of the dat files, the returned slices are shared and must not be modified
 type GeodataLoader interface {
 	LoadIP(filename, country string) ([]*v2router.CIDR, error)
 	LoadSite(filename, list string) ([]*v2router.Domain, error)
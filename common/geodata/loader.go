@@ -1,24 +1,79 @@
 package geodata
 
 import (
+	"os"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	v2router "github.com/v2fly/v2ray-core/v4/app/router"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
 )
 
+// fileStamp identifies the version of a dat file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// geodataCache holds the decoded entries of the dat files. The entries are shared by all the loaders
+// and must not be modified
 type geodataCache struct {
+	sync.Mutex
 	geoipCache
 	geositeCache
+	stamps map[string]fileStamp // 文件路径 -> 加载条目时文件的版本
 }
 
+// 同一进程中的多个实例共用同一份解析后的数据，不会重复占用内存
+var sharedCache = &geodataCache{
+	geoipCache:   make(map[string]*v2router.GeoIP),
+	geositeCache: make(map[string]*v2router.GeoSite),
+	stamps:       make(map[string]fileStamp),
+}
+
+// NewGeodataLoader returns the loader backed by the cache shared in the process
 func NewGeodataLoader() GeodataLoader {
-	return &geodataCache{
-		make(map[string]*v2router.GeoIP),
-		make(map[string]*v2router.GeoSite),
+	return sharedCache
+}
+
+// refresh drops the cached entries of the file if it has been changed since they were loaded
+func (g *geodataCache) refresh(filename string) {
+	asset := common.GetAssetLocation(filename)
+	info, err := os.Stat(asset)
+	if err != nil {
+		return // 由 Unmarshal 报告错误
+	}
+	stamp := fileStamp{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+	old, found := g.stamps[asset]
+	g.stamps[asset] = stamp
+	if !found || (old.modTime.Equal(stamp.modTime) && old.size == stamp.size) {
+		return
+	}
+	prefix := strings.ToLower(asset + ":")
+	for key := range g.geoipCache {
+		if strings.HasPrefix(key, prefix) {
+			delete(g.geoipCache, key)
+		}
+	}
+	for key := range g.geositeCache {
+		if strings.HasPrefix(key, prefix) {
+			delete(g.geositeCache, key)
+		}
 	}
+	log.Info("geodata file", asset, "has changed, the cached entries are dropped")
 }
 
 func (g *geodataCache) LoadIP(filename, country string) ([]*v2router.CIDR, error) {
+	g.Lock()
+	defer g.Unlock()
+	g.refresh(filename)
 	geoip, err := g.geoipCache.Unmarshal(filename, country)
 	if err != nil {
 		return nil, err
@@ -28,6 +83,9 @@ func (g *geodataCache) LoadIP(filename, country string) ([]*v2router.CIDR, error
 }
 
 func (g *geodataCache) LoadSite(filename, list string) ([]*v2router.Domain, error) {
+	g.Lock()
+	defer g.Unlock()
+	g.refresh(filename)
 	geosite, err := g.geositeCache.Unmarshal(filename, list)
 	if err != nil {
 		return nil, err
@@ -73,6 +73,13 @@ func (r *RewindReader) Rewind() {
 	r.mu.Unlock()
 }
 
+// Buffered returns a copy of the bytes buffered so far
+func (r *RewindReader) Buffered() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.buf...)
+}
+
 func (r *RewindReader) StopBuffering() {
 	r.mu.Lock()
 	r.buffering = false
@@ -36,3 +36,18 @@ func TestBufferedReader(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestPacketBuffer(t *testing.T) {
+	defer SetPacketSize(DefaultPacketSize)
+	buf := GetPacketBuffer()
+	if len(buf) != DefaultPacketSize {
+		t.Fatal("wrong buffer size", len(buf))
+	}
+	PutPacketBuffer(buf[:10])
+	SetPacketSize(MaxPacketSize)
+	// 包大小改变之前的缓冲区不再使用
+	if buf := GetPacketBuffer(); len(buf) != MaxPacketSize {
+		t.Fatal("wrong buffer size after resized", len(buf))
+	}
+	PutPacketBuffer(buf)
+}
@@ -37,7 +37,7 @@ func PickPort(network string, host string) int {
 	switch network {
 	case "tcp":
 		for retry := 0; retry < 16; retry++ {
-			l, err := net.Listen("tcp", host+":0")
+			l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
 			if err != nil {
 				continue
 			}
@@ -50,7 +50,7 @@ func PickPort(network string, host string) int {
 		}
 	case "udp":
 		for retry := 0; retry < 16; retry++ {
-			conn, err := net.ListenPacket("udp", host+":0")
+			conn, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
 			if err != nil {
 				continue
 			}
@@ -122,3 +122,115 @@ func FetchHTTPContent(target string) ([]byte, error) {
 
 	return content, nil
 }
+
+// IsDomainNameMatched reports whether the domain name matches the pattern,
+// the pattern can be a wildcard like *.example.com, which matches exactly one level of subdomain
+func IsDomainNameMatched(pattern string, domainName string) bool {
+	pattern = strings.ToLower(pattern)
+	domainName = strings.ToLower(domainName)
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[2:]
+		domainPrefixLen := len(domainName) - len(suffix) - 1
+		return strings.HasSuffix(domainName, suffix) && domainPrefixLen > 0 && !strings.Contains(domainName[:domainPrefixLen], ".")
+	}
+	return pattern == domainName
+}
+
+// ParseIPNets parses a list of IP addresses and CIDRs, a single address is a network of itself
+func ParseIPNets(list []string) ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") { // 单个 IP 地址
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, NewError("invalid ip address " + s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, NewError("invalid cidr " + s).Base(err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// ProxyV2Signature is the signature at the beginning of the PROXY protocol v2 header
+var ProxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr
+	}
+	if addr == nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	portNum, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: portNum}
+}
+
+// ipv6String formats the ip in the ipv6 form, net.IP.String formats the ipv4-mapped addresses as ipv4 addresses
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// WriteProxyHeader writes the PROXY protocol header (version 1 or 2) of a tcp connection from src to dst,
+// the header without addresses is written if either of them is not an ip address
+func WriteProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcAddr, dstAddr := tcpAddrOf(src), tcpAddrOf(dst)
+	var srcIP, dstIP net.IP
+	if srcAddr != nil && dstAddr != nil {
+		// 地址族不同时都使用 IPv6 地址
+		if srcIP, dstIP = srcAddr.IP.To4(), dstAddr.IP.To4(); srcIP == nil || dstIP == nil {
+			srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+		}
+	}
+	switch version {
+	case 1:
+		var header string
+		switch {
+		case srcIP == nil:
+			header = "PROXY UNKNOWN\r\n"
+		case len(srcIP) == net.IPv4len:
+			header = fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, srcAddr.Port, dstAddr.Port)
+		default:
+			header = fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(srcIP), ipv6String(dstIP), srcAddr.Port, dstAddr.Port)
+		}
+		return WriteAllBytes(w, []byte(header))
+	case 2:
+		header := append([]byte(nil), ProxyV2Signature...)
+		header = append(header, 0x21) // 版本 2，PROXY 命令
+		switch {
+		case srcIP == nil:
+			header = append(header, 0x00, 0, 0) // AF_UNSPEC，接收方使用连接本身的地址
+		case len(srcIP) == net.IPv4len:
+			header = append(header, 0x11, 0, 12) // TCP over IPv4
+		default:
+			header = append(header, 0x21, 0, 36) // TCP over IPv6
+		}
+		if srcIP != nil {
+			header = append(header, srcIP...)
+			header = append(header, dstIP...)
+			header = append(header, byte(srcAddr.Port>>8), byte(srcAddr.Port), byte(dstAddr.Port>>8), byte(dstAddr.Port))
+		}
+		return WriteAllBytes(w, header)
+	}
+	return NewError("invalid proxy protocol version " + strconv.Itoa(version))
+}
@@ -0,0 +1,142 @@
+// Package overload sheds the connections of the data path when the server is flooded. The api and the
+// health checks have their own listeners and are not counted, so they can still be served under overload
+package overload
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
+)
+
+const Name = "OVERLOAD"
+
+// 过载时拒绝连接的顺序：先拒绝回落的连接（探测和非法请求），达到上限后拒绝所有新的连接
+const (
+	LaneFallback = "fallback"
+	LaneData     = "data"
+)
+
+type OverloadConfig struct {
+	Enabled           bool `json:"enabled" yaml:"enabled"`
+	MaxConns          int  `json:"max_conns" yaml:"max-conns"`                   // 同时处理的入站连接数的上限
+	FallbackThreshold int  `json:"fallback_threshold" yaml:"fallback-threshold"` // 连接数达到上限的该百分比后不再回落
+}
+
+type Config struct {
+	Overload OverloadConfig `json:"overload" yaml:"overload"`
+}
+
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if c.Overload.Enabled && c.Overload.MaxConns <= 0 {
+		errs.Add("overload.max_conns", "must be positive")
+	}
+	if c.Overload.FallbackThreshold < 0 || c.Overload.FallbackThreshold > 100 {
+		errs.Add("overload.fallback_threshold", "must be in [0, 100]")
+	}
+	return errs.Err()
+}
+
+func init() {
+	config.RegisterConfigCreator(Name, func() interface{} {
+		return &Config{
+			Overload: OverloadConfig{
+				MaxConns:          4096,
+				FallbackThreshold: 80,
+			},
+		}
+	})
+}
+
+// 过载期间最多每隔这么久输出一次警告
+const warnInterval = time.Second * 10
+
+// Limiter counts the inbound connections of the data path and sheds the new ones in order under overload
+type Limiter struct {
+	conns         int64
+	maxConns      int64
+	fallbackConns int64
+	lastWarn      int64 // 上次输出警告的时间
+	shed          map[string]*metrics.Counter
+}
+
+// NewLimiter creates the limiter, the fallback redirection stops when the connections reach
+// fallbackThreshold percent of maxConns
+func NewLimiter(maxConns int, fallbackThreshold int) (*Limiter, error) {
+	if maxConns <= 0 || fallbackThreshold < 0 || fallbackThreshold > 100 {
+		return nil, common.NewError("invalid overload max_conns or fallback_threshold")
+	}
+	help := "Number of the connections closed under overload."
+	return &Limiter{
+		maxConns:      int64(maxConns),
+		fallbackConns: int64(maxConns) * int64(fallbackThreshold) / 100,
+		shed: map[string]*metrics.Counter{
+			LaneFallback: metrics.NewCounter("trojan_go_overload_shed_total", help, "lane", LaneFallback),
+			LaneData:     metrics.NewCounter("trojan_go_overload_shed_total", help, "lane", LaneData),
+		},
+	}, nil
+}
+
+// Admit counts a new inbound connection, the returned function must be called after the connection is closed.
+// It returns false if the connection should be closed immediately. A nil limiter admits everything
+func (l *Limiter) Admit() (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	if atomic.AddInt64(&l.conns, 1) > l.maxConns {
+		atomic.AddInt64(&l.conns, -1)
+		l.reject(LaneData)
+		return nil, false
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&l.conns, -1)
+		})
+	}, true
+}
+
+// AdmitFallback returns false if the connection should be closed instead of being redirected to the fallback
+func (l *Limiter) AdmitFallback() bool {
+	if l == nil || atomic.LoadInt64(&l.conns) < l.fallbackConns {
+		return true
+	}
+	l.reject(LaneFallback)
+	return false
+}
+
+// Conns returns the number of the inbound connections being handled
+func (l *Limiter) Conns() int {
+	if l == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&l.conns))
+}
+
+func (l *Limiter) reject(lane string) {
+	l.shed[lane].Inc()
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&l.lastWarn)
+	if now-last >= int64(warnInterval) && atomic.CompareAndSwapInt64(&l.lastWarn, last, now) {
+		log.Warn("server is overloaded with", l.Conns(), "connections, shedding", lane, "connections")
+	}
+}
+
+type limiterKey struct{}
+
+// WithLimiter stores the limiter into the context, the inbound tunnels and the redirector get it from the context
+func WithLimiter(ctx context.Context, l *Limiter) context.Context {
+	return context.WithValue(ctx, limiterKey{}, l)
+}
+
+// LimiterFromContext extracts the limiter from a context, it returns nil if the shedding is disabled
+func LimiterFromContext(ctx context.Context) *Limiter {
+	l, _ := ctx.Value(limiterKey{}).(*Limiter)
+	return l
+}
@@ -0,0 +1,53 @@
+package overload
+
+import (
+	"context"
+	"testing"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+func TestLimiter(t *testing.T) {
+	if _, err := NewLimiter(0, 80); err == nil {
+		t.Fatal("invalid max_conns")
+	}
+	var disabled *Limiter
+	if _, ok := disabled.Admit(); !ok || !disabled.AdmitFallback() {
+		t.Fatal("nil limiter sheds connections")
+	}
+
+	l, err := NewLimiter(4, 50)
+	common.Must(err)
+	if LimiterFromContext(WithLimiter(context.Background(), l)) != l || LimiterFromContext(context.Background()) != nil {
+		t.Fatal("context")
+	}
+	var releases []func()
+	for i := 0; i < 4; i++ {
+		// 回落在连接数达到一半后先被拒绝
+		if l.AdmitFallback() != (i < 2) {
+			t.Fatal("fallback shedding at", i)
+		}
+		release, ok := l.Admit()
+		if !ok {
+			t.Fatal("admission under limit at", i)
+		}
+		releases = append(releases, release)
+	}
+	if _, ok := l.Admit(); ok {
+		t.Fatal("admission over limit")
+	}
+	if l.Conns() != 4 {
+		t.Fatal("rejected connection is counted", l.Conns())
+	}
+	releases[0]()
+	releases[0]() // 重复释放只计一次
+	if l.Conns() != 3 {
+		t.Fatal("release", l.Conns())
+	}
+	if _, ok := l.Admit(); !ok {
+		t.Fatal("admission after release")
+	}
+	if l.shed[LaneData].Value() != 1 || l.shed[LaneFallback].Value() != 2 {
+		t.Fatal("shed counters", l.shed[LaneData].Value(), l.shed[LaneFallback].Value())
+	}
+}
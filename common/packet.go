@@ -0,0 +1,44 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DefaultPacketSize = 1024 * 8 // 默认的 UDP 包大小 8k
+	MaxPacketSize     = 65507    // UDP 包的最大长度
+)
+
+var packetSize int32 = DefaultPacketSize
+
+var packetPool sync.Pool
+
+// SetPacketSize sets the max payload size of the udp packets relayed, the larger packets are dropped.
+// It should be called before the tunnels are created
+func SetPacketSize(size int) {
+	atomic.StoreInt32(&packetSize, int32(size))
+}
+
+// PacketSize returns the max payload size of the udp packets
+func PacketSize() int {
+	return int(atomic.LoadInt32(&packetSize))
+}
+
+// GetPacketBuffer returns a buffer of PacketSize bytes, it should be put back by PutPacketBuffer
+// after the data in it is no longer used
+func GetPacketBuffer() []byte {
+	if b, ok := packetPool.Get().(*[]byte); ok && len(*b) == PacketSize() {
+		return *b
+	}
+	return make([]byte, PacketSize())
+}
+
+// PutPacketBuffer puts the buffer back to the pool
+func PutPacketBuffer(b []byte) {
+	if cap(b) < PacketSize() {
+		return // 包大小改变之前的缓冲区
+	}
+	b = b[:PacketSize()]
+	packetPool.Put(&b)
+}
@@ -0,0 +1,26 @@
+//go:build darwin
+// +build darwin
+
+package sockopt
+
+import (
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	ipBoundIf   = 25  // IP_BOUND_IF
+	ipv6BoundIf = 125 // IPV6_BOUND_IF
+)
+
+func bindToInterface(fd uintptr, network string, name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(network, "6") {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6BoundIf, iface.Index)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipBoundIf, iface.Index)
+}
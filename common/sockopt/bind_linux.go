@@ -0,0 +1,11 @@
+//go:build linux
+// +build linux
+
+package sockopt
+
+import "golang.org/x/sys/unix"
+
+// SO_BINDTODEVICE，内核 5.7 之前需要 CAP_NET_RAW
+func bindToInterface(fd uintptr, _ string, name string) error {
+	return unix.BindToDevice(int(fd), name)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package sockopt
+
+import "github.com/p4gefau1t/trojan-go/common"
+
+func bindToInterface(uintptr, string, string) error {
+	return common.NewError("binding to interface is not supported on this platform")
+}
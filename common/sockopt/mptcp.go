@@ -0,0 +1,19 @@
+//go:build go1.21
+// +build go1.21
+
+package sockopt
+
+import "net"
+
+// MultipathSupported reports whether the binary is built with the multipath tcp support of Go 1.21
+const MultipathSupported = true
+
+// SetDialerMultipath makes the dialer use multipath tcp, it falls back to tcp if the kernel or the server doesn't support it
+func SetDialerMultipath(d *net.Dialer, enabled bool) {
+	d.SetMultipathTCP(enabled)
+}
+
+// SetListenerMultipath makes the listener accept multipath tcp connections besides the tcp ones
+func SetListenerMultipath(lc *net.ListenConfig, enabled bool) {
+	lc.SetMultipathTCP(enabled)
+}
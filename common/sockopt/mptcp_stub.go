@@ -0,0 +1,12 @@
+//go:build !go1.21
+// +build !go1.21
+
+package sockopt
+
+import "net"
+
+const MultipathSupported = false
+
+func SetDialerMultipath(*net.Dialer, bool) {}
+
+func SetListenerMultipath(*net.ListenConfig, bool) {}
@@ -0,0 +1,59 @@
+// Package sockopt sets the options of the sockets before they are bound or connected
+package sockopt
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// Control is called on the raw socket before it is bound or connected, see net.Dialer.Control
+type Control func(network, address string, c syscall.RawConn) error
+
+// Chain calls the controls in order, the nil ones are skipped. It returns nil if all of them are nil
+func Chain(controls ...Control) Control {
+	var chained []Control
+	for _, control := range controls {
+		if control != nil {
+			chained = append(chained, control)
+		}
+	}
+	if len(chained) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, control := range chained {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// BindToInterface returns the control which binds the sockets to the network interface, so the traffic goes
+// through it regardless of the routing table. It returns nil if the name is empty
+func BindToInterface(name string) Control {
+	if name == "" {
+		return nil
+	}
+	// 接口可能稍后才出现（如 VPN），不存在时只输出警告
+	if _, err := net.InterfaceByName(name); err != nil {
+		log.Warn(common.NewError("network interface " + name + " is not found").Base(err))
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = bindToInterface(fd, network, name)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return common.NewError("failed to bind socket to interface " + name).Base(sockErr)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+package sockopt
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+func TestChain(t *testing.T) {
+	if Chain(nil, nil) != nil {
+		t.Fatal("chain of nil controls is not nil")
+	}
+	var called []int
+	control := Chain(func(string, string, syscall.RawConn) error {
+		called = append(called, 1)
+		return nil
+	}, nil, func(string, string, syscall.RawConn) error {
+		called = append(called, 2)
+		return nil
+	})
+	common.Must(control("tcp", "", nil))
+	if len(called) != 2 || called[0] != 1 || called[1] != 2 {
+		t.Fatal("wrong order", called)
+	}
+}
+
+func TestBindToInterface(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("loopback interface name is only known on linux")
+	}
+	if BindToInterface("") != nil {
+		t.Fatal("empty interface is bound")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer l.Close()
+
+	dialer := &net.Dialer{Control: BindToInterface("lo")}
+	conn, err := dialer.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Skip("binding to interface is not permitted", err)
+	}
+	conn.Close()
+
+	dialer = &net.Dialer{Control: BindToInterface("nonexistent0")}
+	if _, err := dialer.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("bound to a nonexistent interface")
+	}
+}
+
+func TestTCPOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	common.Must(err)
+	defer conn.Close()
+
+	options := NewTCPOptions(false, true, 30, 10)
+	options.Apply(conn)
+	var nilOptions *TCPOptions
+	nilOptions.Apply(conn)
+	checkTCPOptions(t, conn)
+}
@@ -0,0 +1,80 @@
+package sockopt
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// TCPOptions are the options of the accepted and dialed tcp connections
+type TCPOptions struct {
+	NoDelay           bool
+	KeepAlive         bool
+	KeepAliveInterval time.Duration // 保活探测的间隔，0 使用默认值
+	UserTimeout       time.Duration // TCP_USER_TIMEOUT，发送的数据超过该时间未被确认时断开连接，0 使用系统默认值
+}
+
+var userTimeoutWarning sync.Once
+
+// NewTCPOptions creates the options from the config in seconds, the unsupported options are warned once here
+func NewTCPOptions(noDelay, keepAlive bool, keepAliveInterval, userTimeout int) *TCPOptions {
+	if userTimeout > 0 && !userTimeoutSupported {
+		userTimeoutWarning.Do(func() {
+			log.Warn("tcp user_timeout is not supported on this platform, ignored")
+		})
+		userTimeout = 0
+	}
+	return &TCPOptions{
+		NoDelay:           noDelay,
+		KeepAlive:         keepAlive,
+		KeepAliveInterval: time.Duration(keepAliveInterval) * time.Second,
+		UserTimeout:       time.Duration(userTimeout) * time.Second,
+	}
+}
+
+// Apply sets the options on the tcp connection, other connections are ignored.
+// The connection still works without the options, so the errors are only logged
+func (o *TCPOptions) Apply(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if o == nil || !ok {
+		return
+	}
+	if err := tcpConn.SetNoDelay(o.NoDelay); err != nil {
+		log.Debug(common.NewError("failed to set TCP_NODELAY").Base(err))
+	}
+	if err := tcpConn.SetKeepAlive(o.KeepAlive); err != nil {
+		log.Debug(common.NewError("failed to set SO_KEEPALIVE").Base(err))
+	}
+	keepAliveInterval := o.KeepAlive && o.KeepAliveInterval > 0
+	if keepAliveInterval {
+		// 空闲时间，新版本的 Go 不再同时设置探测的间隔
+		if err := tcpConn.SetKeepAlivePeriod(o.KeepAliveInterval); err != nil {
+			log.Debug(common.NewError("failed to set tcp keepalive period").Base(err))
+		}
+	}
+	if !keepAliveInterval && o.UserTimeout == 0 {
+		return
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return
+	}
+	err = rawConn.Control(func(fd uintptr) {
+		if keepAliveInterval {
+			if err := setKeepAliveInterval(fd, o.KeepAliveInterval); err != nil {
+				log.Debug(common.NewError("failed to set TCP_KEEPINTVL").Base(err))
+			}
+		}
+		if o.UserTimeout > 0 {
+			if err := setUserTimeout(fd, o.UserTimeout); err != nil {
+				log.Debug(common.NewError("failed to set TCP_USER_TIMEOUT").Base(err))
+			}
+		}
+	})
+	if err != nil {
+		log.Debug(common.NewError("failed to set tcp socket options").Base(err))
+	}
+}
@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package sockopt
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const userTimeoutSupported = true
+
+func setUserTimeout(fd uintptr, timeout time.Duration) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(timeout/time.Millisecond))
+}
+
+func setKeepAliveInterval(fd uintptr, interval time.Duration) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, int(interval/time.Second))
+}
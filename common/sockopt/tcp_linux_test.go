@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package sockopt
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+func checkTCPOptions(t *testing.T, conn net.Conn) {
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	common.Must(err)
+	var noDelay, keepAlive, idle, interval, userTimeout int
+	common.Must(rawConn.Control(func(fd uintptr) {
+		noDelay, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_NODELAY)
+		keepAlive, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+		idle, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+		interval, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL)
+		userTimeout, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT)
+	}))
+	if noDelay != 0 || keepAlive == 0 || idle != 30 || interval != 30 || userTimeout != 10000 {
+		t.Fatal("wrong socket options", noDelay, keepAlive, idle, interval, userTimeout)
+	}
+}
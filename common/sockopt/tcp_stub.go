@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package sockopt
+
+import (
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+const userTimeoutSupported = false
+
+func setUserTimeout(uintptr, time.Duration) error {
+	return common.NewError("TCP_USER_TIMEOUT is not supported on this platform")
+}
+
+// 其他平台只设置空闲时间
+func setKeepAliveInterval(uintptr, time.Duration) error {
+	return nil
+}
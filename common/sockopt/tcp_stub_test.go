@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package sockopt
+
+import (
+	"net"
+	"testing"
+)
+
+func checkTCPOptions(*testing.T, net.Conn) {}
@@ -6,10 +6,12 @@ package build
 import (
 	_ "github.com/p4gefau1t/trojan-go/proxy/custom"
 	_ "github.com/p4gefau1t/trojan-go/tunnel/adapter"
+	_ "github.com/p4gefau1t/trojan-go/tunnel/brutal"
 	_ "github.com/p4gefau1t/trojan-go/tunnel/dokodemo"
 	_ "github.com/p4gefau1t/trojan-go/tunnel/freedom"
 	_ "github.com/p4gefau1t/trojan-go/tunnel/http"
 	_ "github.com/p4gefau1t/trojan-go/tunnel/mux"
+	_ "github.com/p4gefau1t/trojan-go/tunnel/padding"
 	_ "github.com/p4gefau1t/trojan-go/tunnel/router"
 	_ "github.com/p4gefau1t/trojan-go/tunnel/shadowsocks"
 	_ "github.com/p4gefau1t/trojan-go/tunnel/simplesocks"
@@ -19,4 +21,5 @@ import (
 	_ "github.com/p4gefau1t/trojan-go/tunnel/transport"
 	_ "github.com/p4gefau1t/trojan-go/tunnel/trojan"
 	_ "github.com/p4gefau1t/trojan-go/tunnel/websocket"
+	_ "github.com/p4gefau1t/trojan-go/tunnel/windivert"
 )
@@ -0,0 +1,8 @@
+//go:build exporter || full
+// +build exporter full
+
+package build
+
+import (
+	_ "github.com/p4gefau1t/trojan-go/proxy/exporter"
+)
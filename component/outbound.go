@@ -0,0 +1,11 @@
+//go:build client || custom || full
+// +build client custom full
+
+package build
+
+// 以下协议只用于路由的出站链，不包含在 mini 中
+import (
+	_ "github.com/p4gefau1t/trojan-go/tunnel/naive"
+	_ "github.com/p4gefau1t/trojan-go/tunnel/vless"
+	_ "github.com/p4gefau1t/trojan-go/tunnel/vmess"
+)
@@ -3,23 +3,77 @@ package config
 import (
 	"context"
 	"encoding/json"
+	"sync"
 
 	"gopkg.in/yaml.v3"
 )
 
-var creators = make(map[string]Creator)
-
 // Creator creates default config struct for a module
 type Creator func() interface{}
 
-// RegisterConfigCreator registers a config struct for parsing
-func RegisterConfigCreator(name string, creator Creator) {
+// Registry holds the config creators used for parsing.
+// Each proxy instance can parse its config with its own registry, without affecting the others in the same process
+type Registry struct {
+	creators       map[string]Creator
+	reloadLock     sync.Mutex
+	reloadHandlers map[*ReloadHandler]struct{} // 重新加载配置时调用
+}
+
+// 各模块在 init 中注册到默认的注册表
+var defaultRegistry = &Registry{
+	creators:       make(map[string]Creator),
+	reloadHandlers: make(map[*ReloadHandler]struct{}),
+}
+
+// NewRegistry creates a registry containing all the creators registered to the default registry so far
+func NewRegistry() *Registry {
+	r := &Registry{
+		creators:       make(map[string]Creator, len(defaultRegistry.creators)),
+		reloadHandlers: make(map[*ReloadHandler]struct{}),
+	}
+	for name, creator := range defaultRegistry.creators {
+		r.creators[name] = creator
+	}
+	return r
+}
+
+// RegisterConfigCreator registers a config struct for parsing to the registry
+func (r *Registry) RegisterConfigCreator(name string, creator Creator) {
 	name += "_CONFIG"
-	creators[name] = creator
+	r.creators[name] = creator
+}
+
+// RegisterConfigCreator registers a config struct for parsing to the default registry
+func RegisterConfigCreator(name string, creator Creator) {
+	defaultRegistry.RegisterConfigCreator(name, creator)
+}
+
+type registryKey struct{}
+
+// WithRegistry makes the configs in the context parsed with the registry
+func WithRegistry(ctx context.Context, r *Registry) context.Context {
+	return context.WithValue(ctx, registryKey{}, r)
+}
+
+// RegistryFromContext returns the registry in the context, or the default registry if there is none
+func RegistryFromContext(ctx context.Context) *Registry {
+	if r, ok := ctx.Value(registryKey{}).(*Registry); ok {
+		return r
+	}
+	return defaultRegistry
+}
+
+// WithScopedRegistry returns ctx if it has a registry, otherwise a context with a new registry,
+// so that the reload handlers of a proxy are kept apart from the other proxies in the process
+func WithScopedRegistry(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(registryKey{}).(*Registry); ok {
+		return ctx
+	}
+	return WithRegistry(ctx, NewRegistry())
 }
 
 // 解析JSON格式数据
-func parseJSON(data []byte) (map[string]interface{}, error) {
+func parseJSON(creators map[string]Creator, data []byte) (map[string]interface{}, error) {
 	result := make(map[string]interface{})
 	for name, creator := range creators {
 		config := creator()
@@ -33,7 +87,7 @@ func parseJSON(data []byte) (map[string]interface{}, error) {
 }
 
 // 解析YAML格式数据
-func parseYAML(data []byte) (map[string]interface{}, error) {
+func parseYAML(creators map[string]Creator, data []byte) (map[string]interface{}, error) {
 	result := make(map[string]interface{})
 	for name, creator := range creators {
 		config := creator()
@@ -50,7 +104,7 @@ func parseYAML(data []byte) (map[string]interface{}, error) {
 func WithJSONConfig(ctx context.Context, data []byte) (context.Context, error) {
 	var configs map[string]interface{}
 	var err error
-	configs, err = parseJSON(data)
+	configs, err = parseJSON(RegistryFromContext(ctx).creators, data)
 	if err != nil {
 		return ctx, err
 	}
@@ -65,7 +119,7 @@ func WithJSONConfig(ctx context.Context, data []byte) (context.Context, error) {
 func WithYAMLConfig(ctx context.Context, data []byte) (context.Context, error) {
 	var configs map[string]interface{}
 	var err error
-	configs, err = parseYAML(data)
+	configs, err = parseYAML(RegistryFromContext(ctx).creators, data)
 	if err != nil {
 		return ctx, err
 	}
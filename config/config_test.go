@@ -3,6 +3,7 @@ package config
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
 )
@@ -60,3 +61,100 @@ field3:
 		t.Fail()
 	}
 }
+
+func TestReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(WithScopedRegistry(context.Background()))
+	var got []string
+	OnReload(ctx, func(data []byte, format string) error {
+		got = append(got, string(data)+" "+format)
+		return nil
+	})
+	OnReload(ctx, func([]byte, string) error {
+		return common.NewError("failed")
+	})
+	// 其他实例的处理函数不受影响
+	other := WithScopedRegistry(context.Background())
+	OnReload(other, func([]byte, string) error {
+		t.Fatal("handler of another registry is called")
+		return nil
+	})
+	if failed := Reload(ctx, []byte("{}"), "json"); failed != 1 {
+		t.Fatal("failed handlers", failed)
+	}
+	if len(got) != 1 || got[0] != "{} json" {
+		t.Fatal("reload", got)
+	}
+
+	cancel()
+	time.Sleep(time.Millisecond * 100)
+	if failed := Reload(ctx, []byte("{}"), "json"); failed != 0 || len(got) != 1 {
+		t.Fatal("handlers should be removed")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r1 := NewRegistry()
+	r1.RegisterConfigCreator("registry", creator)
+	r2 := NewRegistry()
+	r2.RegisterConfigCreator("registry", func() interface{} {
+		return &Foo{}
+	})
+	data := []byte(`{"field1": "test"}`)
+
+	ctx1, err := WithJSONConfig(WithRegistry(context.Background(), r1), data)
+	common.Must(err)
+	if c, ok := FromContext(ctx1, "registry").(*TestStruct); !ok || c.Field1 != "test" {
+		t.Fatal("config not parsed with the registry in the context")
+	}
+	ctx2, err := WithJSONConfig(WithRegistry(context.Background(), r2), data)
+	common.Must(err)
+	if _, ok := FromContext(ctx2, "registry").(*Foo); !ok {
+		t.Fatal("registries are not isolated")
+	}
+	ctx, err := WithJSONConfig(context.Background(), data)
+	common.Must(err)
+	if FromContext(ctx, "registry") != nil {
+		t.Fatal("default registry is affected")
+	}
+}
+
+type ValidatedStruct struct {
+	KeyName string `json:"key_name" yaml:"key-name"`
+}
+
+func (s *ValidatedStruct) Validate() error {
+	var errs Errors
+	if s.KeyName != "valid" {
+		errs.Add("section.key_name", "must be valid")
+	}
+	return errs.Err()
+}
+
+func TestValidate(t *testing.T) {
+	r := NewRegistry()
+	// 两个配置共用同一个字段时只报告一次
+	r.RegisterConfigCreator("validated1", func() interface{} {
+		return &ValidatedStruct{}
+	})
+	r.RegisterConfigCreator("validated2", func() interface{} {
+		return &ValidatedStruct{}
+	})
+	ctx := WithRegistry(context.Background(), r)
+
+	valid, err := WithJSONConfig(ctx, []byte(`{"key_name": "valid"}`))
+	common.Must(err)
+	common.Must(Validate(valid, "json"))
+
+	invalid, err := WithJSONConfig(ctx, []byte(`{"key_name": "invalid"}`))
+	common.Must(err)
+	err = Validate(invalid, "json")
+	if err == nil || err.Error() != "invalid config section.key_name: must be valid" {
+		t.Fatal("unexpected error", err)
+	}
+	invalid, err = WithYAMLConfig(ctx, []byte("key-name: invalid"))
+	common.Must(err)
+	err = Validate(invalid, "yaml")
+	if err == nil || err.Error() != "invalid config section.key-name: must be valid" {
+		t.Fatal("unexpected error", err)
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"context"
+
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// ReloadHandler is called with the content of the config file when the config is reloaded.
+// The format is json or yaml
+type ReloadHandler func(data []byte, format string) error
+
+// OnReload registers the handler to the registry of the context until the context is done,
+// so that a reload of a proxy only reaches the handlers of the same proxy
+func OnReload(ctx context.Context, handler ReloadHandler) {
+	r := RegistryFromContext(ctx)
+	h := &handler
+	r.reloadLock.Lock()
+	r.reloadHandlers[h] = struct{}{}
+	r.reloadLock.Unlock()
+	go func() {
+		<-ctx.Done()
+		r.reloadLock.Lock()
+		delete(r.reloadHandlers, h)
+		r.reloadLock.Unlock()
+	}()
+}
+
+// Reload passes the config data to the handlers registered to the registry of the context and returns
+// the number of failed handlers. A failed handler does not stop the others
+func Reload(ctx context.Context, data []byte, format string) int {
+	r := RegistryFromContext(ctx)
+	r.reloadLock.Lock()
+	handlers := make([]ReloadHandler, 0, len(r.reloadHandlers))
+	for h := range r.reloadHandlers {
+		handlers = append(handlers, *h)
+	}
+	r.reloadLock.Unlock()
+
+	failed := 0
+	for _, handler := range handlers {
+		if err := handler(data, format); err != nil {
+			log.Error(err)
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Validator is implemented by the config structs which check their fields before the tunnels are created.
+// All the registered configs are parsed from the same document, so the checks must not depend on the run type
+type Validator interface {
+	Validate() error
+}
+
+// FieldError is an invalid field of a config, the path is made of the json keys, e.g. "ssl.min_version"
+type FieldError struct {
+	Path   string
+	Reason string
+	yaml   bool // 配置为 YAML 格式时，使用 YAML 的键名
+}
+
+func (e *FieldError) Error() string {
+	path := e.Path
+	if e.yaml {
+		path = strings.ReplaceAll(path, "_", "-")
+	}
+	return "invalid config " + path + ": " + e.Reason
+}
+
+// Errors collects the invalid fields of the configs
+type Errors []*FieldError
+
+// Add records an invalid field
+func (errs *Errors) Add(path string, reason string) {
+	*errs = append(*errs, &FieldError{
+		Path:   path,
+		Reason: reason,
+	})
+}
+
+// Err returns nil if there is no invalid field
+func (errs Errors) Err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (errs Errors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks the configs in the context parsed from the document in the format ("json" or "yaml").
+// The errors of the same field reported by several configs sharing the field are merged
+func Validate(ctx context.Context, format string) error {
+	creators := RegistryFromContext(ctx).creators
+	names := make([]string, 0, len(creators))
+	for name := range creators {
+		names = append(names, name)
+	}
+	sort.Strings(names) // 错误的顺序保持稳定
+
+	var result Errors
+	seen := make(map[string]bool)
+	for _, name := range names {
+		v, ok := ctx.Value(name).(Validator)
+		if !ok {
+			continue
+		}
+		err := v.Validate()
+		if err == nil {
+			continue
+		}
+		var errs Errors
+		switch e := err.(type) {
+		case Errors:
+			errs = e
+		case *FieldError:
+			errs = Errors{e}
+		default:
+			errs = Errors{{Path: strings.ToLower(strings.TrimSuffix(name, "_CONFIG")), Reason: err.Error()}}
+		}
+		for _, e := range errs {
+			key := e.Path + "\x00" + e.Reason
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			result = append(result, &FieldError{
+				Path:   e.Path,
+				Reason: e.Reason,
+				yaml:   format == "yaml",
+			})
+		}
+	}
+	return result.Err()
+}
@@ -1,34 +1,60 @@
 package easy
 
 import (
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"flag"
+	"io/ioutil"
 	"net"
 	"strconv"
+	"strings"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/option"
 	"github.com/p4gefau1t/trojan-go/proxy"
+	"github.com/p4gefau1t/trojan-go/url"
 )
 
 type easy struct {
 	server   *bool
 	client   *bool
 	password *string
+	hash     *string // 代替明文密码的 SHA224 值
 	local    *string
 	remote   *string
 	cert     *string
 	key      *string
+	sysProxy *bool
 }
 
 type ClientConfig struct {
-	RunType    string   `json:"run_type"`
-	LocalAddr  string   `json:"local_addr"`
-	LocalPort  int      `json:"local_port"`
-	RemoteAddr string   `json:"remote_addr"`
-	RemotePort int      `json:"remote_port"`
-	Password   []string `json:"password"`
+	RunType     string      `json:"run_type"`
+	LocalAddr   string      `json:"local_addr"`
+	LocalPort   int         `json:"local_port"`
+	RemoteAddr  string      `json:"remote_addr"`
+	RemotePort  int         `json:"remote_port"`
+	Password    []string    `json:"password"`
+	Hash        []string    `json:"password_hash,omitempty"`
+	SystemProxy SystemProxy `json:"system_proxy"`
+	TLS         *ClientTLS  `json:"ssl,omitempty"`       // 仅使用分享链接时设置
+	Websocket   *Websocket  `json:"websocket,omitempty"` // 仅使用分享链接时设置
+}
+
+type SystemProxy struct {
+	Enabled bool `json:"enabled"`
+}
+
+type ClientTLS struct {
+	SNI    string `json:"sni"`
+	Verify bool   `json:"verify"`
+}
+
+type Websocket struct {
+	Enabled bool   `json:"enabled"`
+	Host    string `json:"host"`
+	Path    string `json:"path"`
 }
 
 type TLS struct {
@@ -44,6 +70,7 @@ type ServerConfig struct {
 	RemoteAddr string   `json:"remote_addr"`
 	RemotePort int      `json:"remote_port"`
 	Password   []string `json:"password"`
+	Hash       []string `json:"password_hash,omitempty"`
 	TLS        `json:"ssl"`
 }
 
@@ -55,9 +82,29 @@ func (o *easy) Handle() error {
 	if !*o.server && !*o.client { // 必须指定 client 或者 server
 		return common.NewError("empty")
 	}
-	if *o.password == "" {
+	// 客户端的 -remote 可以是 trojan:// 分享链接，密码等参数从链接中读取
+	var info *url.ShareInfo
+	if *o.client && (strings.HasPrefix(*o.remote, "trojan://") || strings.HasPrefix(*o.remote, "trojan-go://")) {
+		shareInfo, err := url.NewShareInfoFromURL(*o.remote)
+		if err != nil {
+			log.Fatal(common.NewError("invalid share link").Base(err))
+		}
+		if shareInfo.Encryption != "" || shareInfo.Plugin != "" {
+			log.Fatal("encryption and plugin in the share link are not supported in easy mode, use -url instead")
+		}
+		info = &shareInfo
+		*o.password = info.TrojanPassword
+	}
+	if *o.password == "" && *o.hash == "" {
 		log.Fatal("empty password is not allowed")
 	}
+	var passwords, hashes []string
+	if *o.password != "" {
+		passwords = append(passwords, *o.password)
+	}
+	if *o.hash != "" {
+		hashes = append(hashes, *o.hash)
+	}
 	log.Info("easy mode enabled, trojan-go will NOT use the config file")
 	if *o.client {
 		if *o.local == "" {
@@ -68,17 +115,24 @@ func (o *easy) Handle() error {
 		if err != nil {
 			log.Fatal(common.NewError("invalid local addr format:" + *o.local).Base(err))
 		}
-		remoteHost, remotePortStr, err := net.SplitHostPort(*o.remote)
-		if err != nil {
-			log.Fatal(common.NewError("invalid remote addr format:" + *o.remote).Base(err))
-		}
 		localPort, err := strconv.Atoi(localPortStr)
 		if err != nil {
 			log.Fatal(err)
 		}
-		remotePort, err := strconv.Atoi(remotePortStr)
-		if err != nil {
-			log.Fatal(err)
+		var remoteHost string
+		var remotePort int
+		if info != nil {
+			remoteHost, remotePort = info.TrojanHost, int(info.Port)
+		} else {
+			host, remotePortStr, err := net.SplitHostPort(*o.remote)
+			if err != nil {
+				log.Fatal(common.NewError("invalid remote addr format:" + *o.remote).Base(err))
+			}
+			remoteHost = host
+			remotePort, err = strconv.Atoi(remotePortStr)
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
 		clientConfig := ClientConfig{ // 创建客户端配置
 			RunType:    "client",   // 客户端角色
@@ -86,10 +140,25 @@ func (o *easy) Handle() error {
 			LocalPort:  localPort,  // 本地端口
 			RemoteAddr: remoteHost, // 远程host
 			RemotePort: remotePort, // 远程端口
-			Password: []string{ // 连接密码
-				*o.password,
+			Password:   passwords,  // 连接密码
+			Hash:       hashes,
+			SystemProxy: SystemProxy{ // 设置系统代理
+				Enabled: *o.sysProxy,
 			},
 		}
+		if info != nil {
+			clientConfig.TLS = &ClientTLS{
+				SNI:    info.SNI,
+				Verify: !info.AllowInsecure,
+			}
+			if info.Type == url.ShareInfoTypeWebSocket {
+				clientConfig.Websocket = &Websocket{
+					Enabled: true,
+					Host:    info.Host,
+					Path:    info.Path,
+				}
+			}
+		}
 		clientConfigJSON, err := json.Marshal(&clientConfig) // 将 Go 数据结构编码为 JSON 格式
 		common.Must(err)                                     // 是一种简化错误处理的模式，适用于需要立即终止程序的场景
 		log.Info("generated config:")
@@ -133,9 +202,8 @@ func (o *easy) Handle() error {
 			LocalPort:  localPort,
 			RemoteAddr: remoteHost,
 			RemotePort: remotePort,
-			Password: []string{
-				*o.password,
-			},
+			Password:   passwords,
+			Hash:       hashes,
 			TLS: TLS{ // 证书
 				Cert: *o.cert,
 				Key:  *o.key,
@@ -145,6 +213,22 @@ func (o *easy) Handle() error {
 		common.Must(err)
 		log.Info("generated json config:")
 		log.Info(string(serverConfigJSON))
+		if host, insecure := shareHost(*o.cert, localHost); *o.password == "" {
+			log.Warn("share link is not generated without the plaintext password")
+		} else if host != "" {
+			info := url.ShareInfo{
+				TrojanHost:     host,
+				Port:           uint16(localPort),
+				TrojanPassword: *o.password,
+				SNI:            host,
+				Type:           url.ShareInfoTypeOriginal,
+				Description:    "trojan-go",
+				AllowInsecure:  insecure,
+			}
+			log.Info("share link:", info.TrojanURL())
+		} else {
+			log.Warn("server name is unknown, share link is not generated")
+		}
 		proxy, err := proxy.NewProxyFromConfigData(serverConfigJSON, true)
 		if err != nil {
 			log.Fatal(err)
@@ -156,18 +240,52 @@ func (o *easy) Handle() error {
 	return nil
 }
 
+// shareHost returns the server name for the share link from the certificate, or the local address.
+// The clients need to skip the verification if the certificate is self-signed, e.g. generated by -gencert
+func shareHost(certFile, localHost string) (string, bool) {
+	if data, err := ioutil.ReadFile(certFile); err == nil {
+		if block, _ := pem.Decode(data); block != nil {
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				selfSigned := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+				if len(cert.DNSNames) != 0 {
+					return cert.DNSNames[0], selfSigned
+				}
+				if len(cert.IPAddresses) != 0 {
+					return cert.IPAddresses[0].String(), selfSigned
+				}
+			}
+		}
+	}
+	if ip := net.ParseIP(localHost); localHost == "" || (ip != nil && ip.IsUnspecified()) {
+		return "", false
+	}
+	return localHost, false
+}
+
 func (o *easy) Priority() int {
 	return 50
 }
 
 func init() {
+	// -gencert 生成的证书和私钥可以直接用于 easy 模式的服务端
+	key := flag.String("key", "server.key", "Key of the server")
+	cert := flag.String("cert", "server.crt", "Certificates of the server")
 	option.RegisterHandler(&easy{
 		server:   flag.Bool("server", false, "Run a trojan-go server"),
 		client:   flag.Bool("client", false, "Run a trojan-go client"),
 		password: flag.String("password", "", "Password for authentication"),
-		remote:   flag.String("remote", "", "Remote address, e.g. 127.0.0.1:12345"),
+		hash:     flag.String("password-hash", "", "SHA224 hash of the password in hex, used instead of -password"),
+		remote:   flag.String("remote", "", "Remote address, e.g. 127.0.0.1:12345, or a trojan:// share link for the client"),
 		local:    flag.String("local", "", "Local address, e.g. 127.0.0.1:12345"),
-		key:      flag.String("key", "server.key", "Key of the server"),
-		cert:     flag.String("cert", "server.crt", "Certificates of the server"),
+		key:      key,
+		cert:     cert,
+		sysProxy: flag.Bool("system-proxy", true, "Set the system proxy to the client in easy mode, and restore it on exit"),
+	})
+	option.RegisterHandler(&gencert{
+		enabled: flag.Bool("gencert", false, "Generate a self-signed certificate to -cert and -key for testing"),
+		domain:  flag.String("domain", "", "Domain names or IP addresses of the certificate generated by -gencert, separated by commas"),
+		days:    flag.Int("days", 365, "Validity of the certificate generated by -gencert in days"),
+		cert:    cert,
+		key:     key,
 	})
 }
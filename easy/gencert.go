@@ -0,0 +1,113 @@
+package easy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// 生成自签名证书的选项，证书和私钥写入 -cert 和 -key 指定的文件
+type gencert struct {
+	enabled *bool
+	domain  *string
+	days    *int
+	cert    *string
+	key     *string
+}
+
+func (*gencert) Name() string {
+	return "gencert"
+}
+
+func (*gencert) Priority() int {
+	return 10
+}
+
+// GenerateCertificate generates a self-signed ECDSA certificate for the domain names or ip addresses,
+// the certificate and the key are PEM encoded
+func GenerateCertificate(names []string, validity time.Duration) ([]byte, []byte, error) {
+	if len(names) == 0 {
+		return nil, nil, common.NewError("empty domain name")
+	}
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, common.NewError("failed to generate key").Base(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, common.NewError("failed to generate serial number").Base(err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		NotBefore:             now.Add(-time.Hour), // 容忍客户端时钟误差
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, nil, common.NewError("failed to create certificate").Base(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, common.NewError("failed to marshal key").Base(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func (o *gencert) Handle() error {
+	if !*o.enabled {
+		return common.NewError("not set")
+	}
+	if *o.days <= 0 {
+		log.Fatal("invalid days:", *o.days)
+	}
+	names := make([]string, 0, 1)
+	for _, name := range strings.Split(*o.domain, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	// 不覆盖已有的文件
+	for _, path := range []string{*o.cert, *o.key} {
+		if _, err := os.Stat(path); err == nil {
+			log.Fatal(path + " already exists")
+		}
+	}
+	certPEM, keyPEM, err := GenerateCertificate(names, time.Duration(*o.days)*24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*o.cert, certPEM, 0o644); err != nil {
+		log.Fatal(common.NewError("failed to write certificate").Base(err))
+	}
+	if err := ioutil.WriteFile(*o.key, keyPEM, 0o600); err != nil {
+		log.Fatal(common.NewError("failed to write key").Base(err))
+	}
+	log.Info("self-signed certificate for", strings.Join(names, ","), "is written to", *o.cert, "and", *o.key)
+	return nil
+}
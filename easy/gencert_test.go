@@ -0,0 +1,56 @@
+package easy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+func TestGenerateCertificate(t *testing.T) {
+	if _, _, err := GenerateCertificate(nil, time.Hour); err == nil {
+		t.Fatal("empty domain name")
+	}
+	certPEM, keyPEM, err := GenerateCertificate([]string{"example.com", "127.0.0.1"}, time.Hour*24)
+	common.Must(err)
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	common.Must(err)
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	common.Must(err)
+	if cert.Subject.CommonName != "example.com" || len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatal("wrong names", cert.DNSNames, cert.IPAddresses)
+	}
+
+	// the certificate is trusted by the clients as a root
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	for _, name := range []string{"example.com", "127.0.0.1"} {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: name, Roots: pool}); err != nil {
+			t.Fatal("failed to verify", name, err)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: "other.com", Roots: pool}); err == nil {
+		t.Fatal("wrong name verified")
+	}
+}
+
+func TestShareHost(t *testing.T) {
+	certPEM, _, err := GenerateCertificate([]string{"example.com"}, time.Hour)
+	common.Must(err)
+	certFile := filepath.Join(t.TempDir(), "server.crt")
+	common.Must(ioutil.WriteFile(certFile, certPEM, 0o644))
+	if host, insecure := shareHost(certFile, "0.0.0.0"); host != "example.com" || !insecure {
+		t.Fatal("wrong host of self-signed certificate", host, insecure)
+	}
+	if host, _ := shareHost("not-exist.crt", "1.2.3.4"); host != "1.2.3.4" {
+		t.Fatal("wrong host of local address", host)
+	}
+	if host, _ := shareHost("not-exist.crt", "0.0.0.0"); host != "" {
+		t.Fatal("unspecified address shared", host)
+	}
+}
@@ -0,0 +1,296 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// DefaultBuckets are the upper bounds of the latency histograms in seconds
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts the durations in buckets
+type Histogram struct {
+	name    string
+	help    string
+	labels  string
+	buckets []float64
+	counts  []uint64 // 每个桶的计数，最后一个为 +Inf
+	sum     int64    // 纳秒
+	count   uint64
+}
+
+// Observe records a duration
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(h.buckets, seconds)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+// ObserveSince records the duration since t
+func (h *Histogram) ObserveSince(t time.Time) {
+	h.Observe(time.Since(t))
+}
+
+// Count returns the number of the durations observed
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Gauge reports the current value of the function
+type Gauge struct {
+	name   string
+	help   string
+	labels string
+	value  func() float64
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	name   string
+	help   string
+	labels string
+	value  uint64
+}
+
+// Inc increases the counter by 1
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+var (
+	lock       sync.Mutex
+	histograms = make(map[string]*Histogram)
+	counters   = make(map[string]*Counter)
+	checks     = make(map[string]*healthCheck)
+)
+
+type healthCheck struct {
+	check func() error
+}
+
+// formatLabels formats the label pairs, e.g. "queue", "tls" -> {queue="tls"}
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// NewHistogram registers a histogram with the label pairs, the registered one is returned if it exists
+func NewHistogram(name string, help string, labels ...string) *Histogram {
+	lock.Lock()
+	defer lock.Unlock()
+	l := formatLabels(labels)
+	if h, found := histograms[name+l]; found {
+		return h
+	}
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  l,
+		buckets: DefaultBuckets,
+		counts:  make([]uint64, len(DefaultBuckets)+1),
+	}
+	histograms[name+l] = h
+	return h
+}
+
+// NewCounter registers a counter with the label pairs, the registered one is returned if it exists
+func NewCounter(name string, help string, labels ...string) *Counter {
+	lock.Lock()
+	defer lock.Unlock()
+	l := formatLabels(labels)
+	if c, found := counters[name+l]; found {
+		return c
+	}
+	c := &Counter{
+		name:   name,
+		help:   help,
+		labels: l,
+	}
+	counters[name+l] = c
+	return c
+}
+
+// gaugeKind 在注册表中记录代理实例的 gauge，同一进程中的多个代理互不影响
+const gaugeKind = "metrics.gauge"
+
+// RegisterGauge registers a gauge with the label pairs to the tunnel registry of ctx, the returned function unregisters it.
+// The values of the gauges with the same name and labels in a registry are summed up
+func RegisterGauge(ctx context.Context, name string, help string, value func() float64, labels ...string) func() {
+	g := &Gauge{
+		name:   name,
+		help:   help,
+		labels: formatLabels(labels),
+		value:  value,
+	}
+	return tunnel.RegistryFromContext(ctx).AddInstance(gaugeKind, g)
+}
+
+// RegisterHealthCheck registers the health check of the component, which returns an error when the component is unhealthy.
+// The returned function unregisters it
+func RegisterHealthCheck(component string, check func() error) func() {
+	lock.Lock()
+	defer lock.Unlock()
+	c := &healthCheck{
+		check: check,
+	}
+	checks[component] = c
+	return func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if checks[component] == c {
+			delete(checks, component)
+		}
+	}
+}
+
+// CheckHealth runs the health checks, the errors of the unhealthy components are returned
+func CheckHealth() map[string]error {
+	lock.Lock()
+	cs := make(map[string]*healthCheck, len(checks))
+	for component, c := range checks {
+		cs[component] = c
+	}
+	lock.Unlock()
+	result := make(map[string]error)
+	for component, c := range cs {
+		if err := c.check(); err != nil {
+			result[component] = err
+		}
+	}
+	return result
+}
+
+// withLabel adds a label to the formatted labels
+func withLabel(labels string, label string) string {
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprint(f)
+}
+
+// WriteTo writes the metrics of the process and the gauges in the tunnel registry of ctx in the prometheus text format
+func WriteTo(ctx context.Context, w io.Writer) error {
+	lock.Lock()
+	hs := make([]*Histogram, 0, len(histograms))
+	for _, h := range histograms {
+		hs = append(hs, h)
+	}
+	cs := make([]*Counter, 0, len(counters))
+	for _, c := range counters {
+		cs = append(cs, c)
+	}
+	lock.Unlock()
+	var gs []*Gauge
+	values := make(map[string]float64)
+	for _, instance := range tunnel.RegistryFromContext(ctx).Instances(gaugeKind) {
+		g := instance.(*Gauge)
+		if _, found := values[g.name+g.labels]; !found {
+			gs = append(gs, g)
+		}
+		values[g.name+g.labels] += g.value()
+	}
+	sort.Slice(hs, func(i, j int) bool {
+		return hs[i].name+hs[i].labels < hs[j].name+hs[j].labels
+	})
+	sort.Slice(gs, func(i, j int) bool {
+		return gs[i].name+gs[i].labels < gs[j].name+gs[j].labels
+	})
+	sort.Slice(cs, func(i, j int) bool {
+		return cs[i].name+cs[i].labels < cs[j].name+cs[j].labels
+	})
+
+	b := &strings.Builder{}
+	lastName := ""
+	for _, h := range hs {
+		if h.name != lastName {
+			fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+			lastName = h.name
+		}
+		cumulative := uint64(0)
+		for i := range h.counts {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, withLabel(h.labels, fmt.Sprintf("le=%q", formatFloat(le))), cumulative)
+		}
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, h.labels, formatFloat(time.Duration(atomic.LoadInt64(&h.sum)).Seconds()))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, h.labels, atomic.LoadUint64(&h.count))
+	}
+	for _, g := range gs {
+		if g.name != lastName {
+			fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+			lastName = g.name
+		}
+		fmt.Fprintf(b, "%s%s %s\n", g.name, g.labels, formatFloat(values[g.name+g.labels]))
+	}
+	for _, c := range cs {
+		if c.name != lastName {
+			fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+			lastName = c.name
+		}
+		fmt.Fprintf(b, "%s%s %d\n", c.name, c.labels, c.Value())
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// 服务端连接建立各阶段的耗时
+var (
+	TLSHandshake = NewHistogram("trojan_go_tls_handshake_seconds", "Time spent on the tls handshake of the server.")
+	TrojanAuth   = NewHistogram("trojan_go_trojan_auth_seconds", "Time spent on reading and authenticating the trojan request.")
+	AcceptToAuth = NewHistogram("trojan_go_accept_to_auth_seconds", "Time from accepting the tcp connection to the trojan authentication completed.")
+
+	SlowHandshakes    = NewCounter("trojan_go_slow_handshakes_total", "Number of the handshakes exceeding the slow handshake threshold.")
+	HandshakeProfiles = NewCounter("trojan_go_handshake_profiles_total", "Number of the cpu profiles captured on sustained slow handshakes.")
+)
+
+// QueueWait returns the histogram of the time blocked on sending connections to the full queue
+func QueueWait(queue string) *Histogram {
+	return NewHistogram("trojan_go_queue_wait_seconds", "Time blocked on sending connections to the full queue.", "queue", queue)
+}
+
+// RegisterQueue registers the length and the capacity of the queue to the tunnel registry of ctx,
+// the returned function unregisters them
+func RegisterQueue(ctx context.Context, queue string, length func() int, capacity int) func() {
+	unregisterLength := RegisterGauge(ctx, "trojan_go_queue_length", "Number of connections waiting in the queue.", func() float64 {
+		return float64(length())
+	}, "queue", queue)
+	unregisterCapacity := RegisterGauge(ctx, "trojan_go_queue_capacity", "Capacity of the queue.", func() float64 {
+		return float64(capacity)
+	}, "queue", queue)
+	return func() {
+		unregisterLength()
+		unregisterCapacity()
+	}
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_seconds", "Test histogram.", "stage", "a")
+	if NewHistogram("test_seconds", "Test histogram.", "stage", "a") != h {
+		t.Fatal("histogram is registered twice")
+	}
+	h.Observe(time.Millisecond * 3)
+	h.Observe(time.Second * 20)
+	c := NewCounter("test_total", "Test counter.", "stage", "a")
+	c.Inc()
+	NewCounter("test_total", "Test counter.", "stage", "a").Inc()
+
+	ctx := tunnel.WithScopedRegistry(context.Background())
+	queue := make(chan int, 4)
+	queue <- 1
+	unregister := RegisterQueue(ctx, "test", func() int { return len(queue) }, cap(queue))
+	unregisterOther := RegisterQueue(ctx, "test", func() int { return 0 }, 2)
+	defer unregisterOther()
+
+	buf := &bytes.Buffer{}
+	common.Must(WriteTo(ctx, buf))
+	for _, line := range []string{
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{stage="a",le="0.001"} 0`,
+		`test_seconds_bucket{stage="a",le="0.005"} 1`,
+		`test_seconds_bucket{stage="a",le="+Inf"} 2`,
+		`test_seconds_count{stage="a"} 2`,
+		`trojan_go_queue_length{queue="test"} 1`,
+		`trojan_go_queue_capacity{queue="test"} 6`,
+		"# TYPE test_total counter",
+		`test_total{stage="a"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatal("missing", line, "in", buf.String())
+		}
+	}
+
+	// 其他代理的 gauge 互不影响
+	buf.Reset()
+	common.Must(WriteTo(tunnel.WithScopedRegistry(context.Background()), buf))
+	if strings.Contains(buf.String(), `queue="test"`) {
+		t.Fatal("queue of another registry is written")
+	}
+
+	unregister()
+	unregisterOther()
+	buf.Reset()
+	common.Must(WriteTo(ctx, buf))
+	if strings.Contains(buf.String(), `queue="test"`) {
+		t.Fatal("queue is not unregistered")
+	}
+}
+
+func TestServe(t *testing.T) {
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = config.WithConfig(ctx, Name, &Config{
+		Metrics: MetricsConfig{
+			Enabled:   true,
+			LocalHost: "127.0.0.1",
+			LocalPort: port,
+			Path:      "/metrics",
+		},
+	})
+	common.Must(Serve(ctx))
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", port))
+	common.Must(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	common.Must(err)
+	if !strings.Contains(string(body), "trojan_go_tls_handshake_seconds_count") {
+		t.Fatal("unexpected metrics", string(body))
+	}
+}
+
+func TestHealth(t *testing.T) {
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = config.WithConfig(ctx, Name, &Config{
+		Metrics: MetricsConfig{
+			Enabled:    true,
+			LocalHost:  "127.0.0.1",
+			LocalPort:  port,
+			Path:       "/metrics",
+			HealthPath: "/health",
+		},
+	})
+	common.Must(Serve(ctx))
+	check := func(status int, content string) {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/health", port))
+		common.Must(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		common.Must(err)
+		if resp.StatusCode != status || !strings.Contains(string(body), content) {
+			t.Fatal("unexpected health", resp.StatusCode, string(body))
+		}
+	}
+	check(http.StatusOK, "ok")
+	unregister := RegisterHealthCheck("test", func() error {
+		return errors.New("broken")
+	})
+	check(http.StatusServiceUnavailable, "test: broken")
+	unregister()
+	check(http.StatusOK, "ok")
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+const Name = "METRICS"
+
+type MetricsConfig struct {
+	Enabled    bool   `json:"enabled" yaml:"enabled"`
+	LocalHost  string `json:"local_addr" yaml:"local-addr"`
+	LocalPort  int    `json:"local_port" yaml:"local-port"`
+	Path       string `json:"path" yaml:"path"`
+	HealthPath string `json:"health_path" yaml:"health-path"` // 所有组件正常时返回 200，否则返回 503
+}
+
+type Config struct {
+	Metrics MetricsConfig `json:"metrics" yaml:"metrics"`
+}
+
+func init() {
+	config.RegisterConfigCreator(Name, func() interface{} {
+		return &Config{
+			Metrics: MetricsConfig{
+				LocalHost:  "127.0.0.1",
+				Path:       "/metrics",
+				HealthPath: "/health",
+			},
+		}
+	})
+}
+
+// Handler serves the metrics of the proxy built with ctx in the prometheus text format
+func Handler(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := WriteTo(ctx, w); err != nil {
+			log.Debug(common.NewError("failed to write metrics").Base(err))
+		}
+	})
+}
+
+// HealthHandler responds 200 if all the components are healthy, or 503 with the errors of the unhealthy ones
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		errs := CheckHealth()
+		if len(errs) == 0 {
+			io.WriteString(w, "ok\n")
+			return
+		}
+		components := make([]string, 0, len(errs))
+		for component := range errs {
+			components = append(components, component)
+		}
+		sort.Strings(components)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, component := range components {
+			io.WriteString(w, component+": "+errs[component].Error()+"\n")
+		}
+	})
+}
+
+// Serve starts the metrics endpoint if it is enabled in the config, it is stopped when the context is done
+func Serve(ctx context.Context) error {
+	cfg, ok := config.FromContext(ctx, Name).(*Config)
+	if !ok || !cfg.Metrics.Enabled {
+		return nil
+	}
+	addr := net.JoinHostPort(cfg.Metrics.LocalHost, strconv.Itoa(cfg.Metrics.LocalPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return common.NewError("failed to listen metrics endpoint").Base(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Metrics.Path, Handler(ctx))
+	if cfg.Metrics.HealthPath != "" {
+		mux.Handle(cfg.Metrics.HealthPath, HealthHandler())
+	}
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error(common.NewError("metrics endpoint stopped").Base(err))
+		}
+	}()
+	log.Info("metrics endpoint is listening on", listener.Addr().String()+cfg.Metrics.Path)
+	return nil
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 
 	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/proxy"
 	"github.com/p4gefau1t/trojan-go/tunnel/adapter"
 	"github.com/p4gefau1t/trojan-go/tunnel/http"
 	"github.com/p4gefau1t/trojan-go/tunnel/mux"
+	"github.com/p4gefau1t/trojan-go/tunnel/padding"
 	"github.com/p4gefau1t/trojan-go/tunnel/router"
 	"github.com/p4gefau1t/trojan-go/tunnel/shadowsocks"
 	"github.com/p4gefau1t/trojan-go/tunnel/simplesocks"
@@ -21,7 +23,7 @@ import (
 const Name = "CLIENT"
 
 // GenerateClientTree generate general outbound protocol stack
-func GenerateClientTree(transportPlugin bool, muxEnabled bool, wsEnabled bool, ssEnabled bool, routerEnabled bool) []string {
+func GenerateClientTree(transportPlugin bool, muxEnabled bool, wsEnabled bool, ssEnabled bool, paddingEnabled bool, routerEnabled bool) []string {
 	clientStack := []string{transport.Name}
 	// 传输层插件的作用，是替代 tansport 隧道的 TLS 进行传输加密和混淆
 	if !transportPlugin {
@@ -33,6 +35,9 @@ func GenerateClientTree(transportPlugin bool, muxEnabled bool, wsEnabled bool, s
 	if ssEnabled { // 开启 shadowsocks
 		clientStack = append(clientStack, shadowsocks.Name)
 	}
+	if paddingEnabled { // 填充和拆分 trojan 协议的记录
+		clientStack = append(clientStack, padding.Name)
+	}
 	// 必须支持 trojan 协议
 	clientStack = append(clientStack, trojan.Name)
 	if muxEnabled { // 开启多路复用
@@ -91,7 +96,7 @@ func init() {
 
 		// 出站路径
 		// 生成出站协议栈 trojan->tls->transport
-		clientStack := GenerateClientTree(cfg.TransportPlugin.Enabled, cfg.Mux.Enabled, cfg.Websocket.Enabled, cfg.Shadowsocks.Enabled, cfg.Router.Enabled)
+		clientStack := GenerateClientTree(cfg.TransportPlugin.Enabled, cfg.Mux.Enabled, cfg.Websocket.Enabled, cfg.Shadowsocks.Enabled, cfg.Padding.Enabled, cfg.Router.Enabled)
 		c, err := proxy.CreateClientStack(ctx, clientStack)
 		if err != nil {
 			cancel()
@@ -99,6 +104,15 @@ func init() {
 		}
 		// 获取入站协议栈
 		s := proxy.FindAllEndpoints(root)
-		return proxy.NewProxy(ctx, cancel, s, c), nil
+		p := proxy.NewProxy(ctx, cancel, s, c)
+		if cfg.SystemProxy.Enabled { // 设置系统代理，代理停止时恢复。设置失败不影响客户端运行
+			restore, err := enableSystemProxy(cfg.LocalHost, cfg.LocalPort, cfg.SystemProxy.Bypass)
+			if err != nil {
+				log.Warn(err)
+			} else {
+				p.OnClose(restore)
+			}
+		}
+		return p, nil
 	})
 }
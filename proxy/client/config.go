@@ -18,15 +18,29 @@ type ShadowsocksConfig struct {
 	Enabled bool `json:"enabled" yaml:"enabled"`
 }
 
+type PaddingConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+}
+
 type TransportPluginConfig struct {
 	Enabled bool `json:"enabled" yaml:"enabled"`
 }
 
+// SystemProxyConfig 启动时将系统代理设置为客户端的本地地址，退出时恢复
+type SystemProxyConfig struct {
+	Enabled bool     `json:"enabled" yaml:"enabled"`
+	Bypass  []string `json:"bypass" yaml:"bypass"`
+}
+
 type Config struct {
+	LocalHost       string                `json:"local_addr" yaml:"local-addr"`
+	LocalPort       int                   `json:"local_port" yaml:"local-port"`
+	SystemProxy     SystemProxyConfig     `json:"system_proxy" yaml:"system-proxy"`
 	Mux             MuxConfig             `json:"mux" yaml:"mux"`
 	Websocket       WebsocketConfig       `json:"websocket" yaml:"websocket"`
 	Router          RouterConfig          `json:"router" yaml:"router"`
 	Shadowsocks     ShadowsocksConfig     `json:"shadowsocks" yaml:"shadowsocks"`
+	Padding         PaddingConfig         `json:"padding" yaml:"padding"`
 	TransportPlugin TransportPluginConfig `json:"transport_plugin" yaml:"transport-plugin"`
 }
 
@@ -34,6 +48,10 @@ type Config struct {
 func init() {
 	// new 是一个内置函数，用于分配内存并初始化值。它通常用于创建指向类型的指针
 	config.RegisterConfigCreator(Name, func() interface{} {
-		return new(Config)
+		return &Config{
+			SystemProxy: SystemProxyConfig{
+				Bypass: []string{"localhost", "127.0.0.1", "::1", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"},
+			},
+		}
 	})
 }
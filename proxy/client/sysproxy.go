@@ -0,0 +1,38 @@
+package client
+
+import (
+	"os/exec"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// run executes the command and returns its trimmed output
+func run(name string, args ...string) (string, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", common.NewError(name + " " + strings.Join(args, " ") + " failed: " + strings.TrimSpace(string(output))).Base(err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// enableSystemProxy points the system proxy settings to the local inbound,
+// the returned function restores the settings and should be called when the proxy is closed
+func enableSystemProxy(host string, port int, bypass []string) (func(), error) {
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	restore, err := setSystemProxy(host, port, bypass)
+	if err != nil {
+		return nil, common.NewError("failed to set system proxy").Base(err)
+	}
+	log.Info("system proxy is set to", host, port)
+	return func() {
+		if err := restore(); err != nil {
+			log.Error(common.NewError("failed to restore system proxy").Base(err))
+		} else {
+			log.Info("system proxy restored")
+		}
+	}, nil
+}
@@ -0,0 +1,129 @@
+//go:build darwin
+// +build darwin
+
+package client
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// 需要设置的代理类型，分别为 HTTP，HTTPS 和 SOCKS
+var darwinProxyKinds = []string{"webproxy", "securewebproxy", "socksfirewallproxy"}
+
+type darwinProxyState struct {
+	enabled bool
+	server  string
+	port    string
+}
+
+// networkServices lists the enabled network services, e.g. Wi-Fi and Ethernet
+func networkServices() ([]string, error) {
+	output, err := run("networksetup", "-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for i, line := range strings.Split(output, "\n") {
+		// 第一行是说明，以 * 开头的服务已被禁用
+		if i == 0 || line == "" || strings.HasPrefix(line, "*") {
+			continue
+		}
+		services = append(services, line)
+	}
+	return services, nil
+}
+
+func getDarwinProxy(service, kind string) (*darwinProxyState, error) {
+	output, err := run("networksetup", "-get"+kind, service)
+	if err != nil {
+		return nil, err
+	}
+	state := &darwinProxyState{}
+	for _, line := range strings.Split(output, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "Enabled":
+			state.enabled = value == "Yes"
+		case "Server":
+			state.server = value
+		case "Port":
+			state.port = value
+		}
+	}
+	return state, nil
+}
+
+func setSystemProxy(host string, port int, bypass []string) (func() error, error) {
+	services, err := networkServices()
+	if err != nil {
+		return nil, err
+	}
+	type saved struct {
+		service string
+		states  map[string]*darwinProxyState
+		bypass  []string
+	}
+	var savedStates []*saved
+	restore := func() error {
+		var lastErr error
+		for _, s := range savedStates {
+			for kind, state := range s.states {
+				var err error
+				if state.enabled {
+					_, err = run("networksetup", "-set"+kind, s.service, state.server, state.port)
+				} else {
+					_, err = run("networksetup", "-set"+kind+"state", s.service, "off")
+				}
+				if err != nil {
+					lastErr = err
+				}
+			}
+			if _, err := run("networksetup", append([]string{"-setproxybypassdomains", s.service}, s.bypass...)...); err != nil {
+				lastErr = err
+			}
+		}
+		return lastErr
+	}
+
+	for _, service := range services {
+		s := &saved{
+			service: service,
+			states:  make(map[string]*darwinProxyState),
+			bypass:  []string{"Empty"},
+		}
+		for _, kind := range darwinProxyKinds {
+			state, err := getDarwinProxy(service, kind)
+			if err != nil {
+				restore()
+				return nil, err
+			}
+			s.states[kind] = state
+		}
+		if output, err := run("networksetup", "-getproxybypassdomains", service); err == nil && !strings.HasPrefix(output, "There aren't any") {
+			s.bypass = strings.Split(output, "\n")
+		}
+		savedStates = append(savedStates, s)
+
+		for _, kind := range darwinProxyKinds {
+			if _, err := run("networksetup", "-set"+kind, service, host, strconv.Itoa(port)); err != nil {
+				restore()
+				return nil, err
+			}
+		}
+		if len(bypass) != 0 {
+			if _, err := run("networksetup", append([]string{"-setproxybypassdomains", service}, bypass...)...); err != nil {
+				restore()
+				return nil, err
+			}
+		}
+		log.Debug("system proxy of", service, "is set")
+	}
+	return restore, nil
+}
@@ -0,0 +1,143 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// gsettingsKeys are the GNOME proxy settings modified, in the order of restoring
+var gsettingsKeys = [][2]string{
+	{"org.gnome.system.proxy.http", "host"},
+	{"org.gnome.system.proxy.http", "port"},
+	{"org.gnome.system.proxy.https", "host"},
+	{"org.gnome.system.proxy.https", "port"},
+	{"org.gnome.system.proxy.socks", "host"},
+	{"org.gnome.system.proxy.socks", "port"},
+	{"org.gnome.system.proxy", "ignore-hosts"},
+	{"org.gnome.system.proxy", "mode"},
+}
+
+func setGNOMEProxy(host string, port int, bypass []string) (func() error, error) {
+	saved := make(map[[2]string]string)
+	for _, key := range gsettingsKeys {
+		value, err := run("gsettings", "get", key[0], key[1])
+		if err != nil {
+			return nil, err
+		}
+		saved[key] = value
+	}
+	restore := func() error {
+		var lastErr error
+		for _, key := range gsettingsKeys {
+			if _, err := run("gsettings", "set", key[0], key[1], saved[key]); err != nil {
+				lastErr = err
+			}
+		}
+		return lastErr
+	}
+
+	ignoreHosts := "@as []" // 空数组需要指定类型
+	if len(bypass) != 0 {
+		quoted := make([]string, 0, len(bypass))
+		for _, h := range bypass {
+			quoted = append(quoted, "'"+h+"'")
+		}
+		ignoreHosts = "[" + strings.Join(quoted, ", ") + "]"
+	}
+	values := map[[2]string]string{
+		{"org.gnome.system.proxy.http", "host"}:    host,
+		{"org.gnome.system.proxy.http", "port"}:    strconv.Itoa(port),
+		{"org.gnome.system.proxy.https", "host"}:   host,
+		{"org.gnome.system.proxy.https", "port"}:   strconv.Itoa(port),
+		{"org.gnome.system.proxy.socks", "host"}:   host,
+		{"org.gnome.system.proxy.socks", "port"}:   strconv.Itoa(port),
+		{"org.gnome.system.proxy", "ignore-hosts"}: ignoreHosts,
+		{"org.gnome.system.proxy", "mode"}:         "manual",
+	}
+	for _, key := range gsettingsKeys {
+		if _, err := run("gsettings", "set", key[0], key[1], values[key]); err != nil {
+			restore()
+			return nil, err
+		}
+	}
+	return restore, nil
+}
+
+// kdeKeys are the KDE proxy settings in kioslaverc
+var kdeKeys = []string{"ProxyType", "httpProxy", "httpsProxy", "socksProxy", "NoProxyFor"}
+
+func kdeTools() (read, write string, err error) {
+	for _, version := range []string{"6", "5", ""} {
+		if _, err := exec.LookPath("kwriteconfig" + version); err == nil {
+			return "kreadconfig" + version, "kwriteconfig" + version, nil
+		}
+	}
+	return "", "", common.NewError("kwriteconfig is not found")
+}
+
+func setKDEProxy(host string, port int, bypass []string) (func() error, error) {
+	read, write, err := kdeTools()
+	if err != nil {
+		return nil, err
+	}
+	writeKey := func(key, value string) error {
+		_, err := run(write, "--file", "kioslaverc", "--group", "Proxy Settings", "--key", key, value)
+		return err
+	}
+	// 通知正在运行的程序重新读取代理设置
+	reload := func() {
+		run("dbus-send", "--type=signal", "/KIO/Scheduler", "org.kde.KIO.Scheduler.reparseSlaveConfiguration", "string:")
+	}
+	saved := make(map[string]string)
+	for _, key := range kdeKeys {
+		value, err := run(read, "--file", "kioslaverc", "--group", "Proxy Settings", "--key", key)
+		if err != nil {
+			return nil, err
+		}
+		saved[key] = value
+	}
+	restore := func() error {
+		var lastErr error
+		for _, key := range kdeKeys {
+			if err := writeKey(key, saved[key]); err != nil {
+				lastErr = err
+			}
+		}
+		reload()
+		return lastErr
+	}
+
+	values := map[string]string{
+		"ProxyType":  "1", // 手动配置
+		"httpProxy":  fmt.Sprintf("http://%s %d", host, port),
+		"httpsProxy": fmt.Sprintf("http://%s %d", host, port),
+		"socksProxy": fmt.Sprintf("socks://%s %d", host, port),
+		"NoProxyFor": strings.Join(bypass, ","),
+	}
+	for _, key := range kdeKeys {
+		if err := writeKey(key, values[key]); err != nil {
+			restore()
+			return nil, err
+		}
+	}
+	reload()
+	return restore, nil
+}
+
+func setSystemProxy(host string, port int, bypass []string) (func() error, error) {
+	if strings.Contains(strings.ToUpper(os.Getenv("XDG_CURRENT_DESKTOP")), "KDE") {
+		return setKDEProxy(host, port, bypass)
+	}
+	if _, err := exec.LookPath("gsettings"); err == nil {
+		return setGNOMEProxy(host, port, bypass)
+	}
+	return nil, common.NewError("neither gsettings nor kwriteconfig is available, the desktop environment is not supported")
+}
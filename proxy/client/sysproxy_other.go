@@ -0,0 +1,10 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package client
+
+import "github.com/p4gefau1t/trojan-go/common"
+
+func setSystemProxy(string, int, []string) (func() error, error) {
+	return nil, common.NewError("system proxy configuration is not supported on this platform")
+}
@@ -1,18 +1,52 @@
 package proxy
 
-import "github.com/p4gefau1t/trojan-go/config"
+import (
+	"strconv"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+)
+
+type ShutdownReportConfig struct {
+	File string `json:"file" yaml:"file"`
+}
+
+// SchedulerConfig 中继繁忙时优先转发 UDP 和指定端口的 TCP 流量
+type SchedulerConfig struct {
+	Enabled       bool  `json:"enabled" yaml:"enabled"`
+	Rate          int   `json:"rate" yaml:"rate"` // 所有中继共用的带宽(字节/秒)
+	Tick          int   `json:"tick" yaml:"tick"` // 分配预算的周期(毫秒)
+	PriorityPorts []int `json:"priority_ports" yaml:"priority-ports"`
+}
 
 type Config struct {
-	RunType  string `json:"run_type" yaml:"run-type"`
-	LogLevel int    `json:"log_level" yaml:"log-level"`
-	LogFile  string `json:"log_file" yaml:"log-file"`
+	RunType        string               `json:"run_type" yaml:"run-type"`
+	LogLevel       int                  `json:"log_level" yaml:"log-level"`
+	LogFile        string               `json:"log_file" yaml:"log-file"`
+	ShutdownReport ShutdownReportConfig `json:"shutdown_report" yaml:"shutdown-report"`
+	UDPTimeout     int                  `json:"udp_timeout" yaml:"udp-timeout"` // UDP 中继的空闲超时(秒)
+	UDPPacketSize  int                  `json:"udp_packet_size" yaml:"udp-packet-size"`
+	Scheduler      SchedulerConfig      `json:"scheduler" yaml:"scheduler"`
+}
+
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if c.UDPPacketSize < 512 || c.UDPPacketSize > common.MaxPacketSize {
+		errs.Add("udp_packet_size", "must be between 512 and "+strconv.Itoa(common.MaxPacketSize))
+	}
+	return errs.Err()
 }
 
 func init() {
 	config.RegisterConfigCreator(Name, func() interface{} {
 		// 返回一个指向 Config 类型的指针，初始化 LogLevel 为 1
 		return &Config{
-			LogLevel: 1,
+			LogLevel:      1,
+			UDPTimeout:    60,
+			UDPPacketSize: common.DefaultPacketSize,
+			Scheduler: SchedulerConfig{
+				Tick: 10,
+			},
 		}
 	})
 }
@@ -2,12 +2,14 @@ package custom
 
 import (
 	"context"
+	"fmt"
 	"strings"
 
 	"gopkg.in/yaml.v3"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/proxy"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
@@ -31,8 +33,14 @@ func convert(i interface{}) interface{} {
 func buildNodes(ctx context.Context, nodeConfigList []NodeConfig) (map[string]*proxy.Node, error) {
 	nodes := make(map[string]*proxy.Node)
 	for _, nodeCfg := range nodeConfigList {
+		if nodeCfg.Tag == "" {
+			return nil, common.NewError("empty node tag for protocol " + nodeCfg.Protocol)
+		}
+		if _, found := nodes[nodeCfg.Tag]; found {
+			return nil, common.NewError("duplicated node tag: " + nodeCfg.Tag)
+		}
 		nodeCfg.Protocol = strings.ToUpper(nodeCfg.Protocol)
-		if _, err := tunnel.GetTunnel(nodeCfg.Protocol); err != nil {
+		if _, err := tunnel.RegistryFromContext(ctx).GetTunnel(nodeCfg.Protocol); err != nil {
 			return nil, common.NewError("invalid protocol name:" + nodeCfg.Protocol)
 		}
 		data, err := yaml.Marshal(nodeCfg.Config)
@@ -43,6 +51,7 @@ func buildNodes(ctx context.Context, nodeConfigList []NodeConfig) (map[string]*p
 		}
 		node := &proxy.Node{
 			Name:    nodeCfg.Protocol,
+			Tag:     nodeCfg.Tag,
 			Next:    make(map[string]*proxy.Node),
 			Context: nodeContext,
 		}
@@ -51,6 +60,86 @@ func buildNodes(ctx context.Context, nodeConfigList []NodeConfig) (map[string]*p
 	return nodes, nil
 }
 
+// checkInboundPaths checks whether the paths form a tree before any server is created:
+// all paths start from the same root, and every node has only one parent
+func checkInboundPaths(paths [][]string, nodes map[string]*proxy.Node) error {
+	if len(paths) == 0 {
+		return common.NewError("there must be at least 1 path for inbound protocol tree")
+	}
+	parents := make(map[string]string)
+	var root string
+	for i, path := range paths {
+		if len(path) == 0 {
+			return common.NewError(fmt.Sprintf("inbound path %d is empty", i))
+		}
+		if root == "" {
+			root = path[0]
+		}
+		if path[0] != root {
+			return common.NewError(fmt.Sprintf("inbound path %d starts from %s, but the root is %s", i, path[0], root))
+		}
+		for j, tag := range path {
+			if _, found := nodes[tag]; !found {
+				return common.NewError("invalid node tag: " + tag)
+			}
+			if j == 0 {
+				continue
+			}
+			if tag == root {
+				return common.NewError("root node " + root + " can not be a child")
+			}
+			if parent, found := parents[tag]; found && parent != path[j-1] {
+				return common.NewError("node " + tag + " has more than 1 parent: " + parent + ", " + path[j-1])
+			}
+			parents[tag] = path[j-1]
+		}
+	}
+	for tag := range nodes {
+		if _, found := parents[tag]; !found && tag != root {
+			log.Warn("inbound node", tag, "is not used")
+		}
+	}
+	return nil
+}
+
+// checkOutboundPath checks whether the outbound path is a chain
+func checkOutboundPath(paths [][]string, nodes map[string]*proxy.Node) error {
+	if len(paths) != 1 {
+		return common.NewError("there must be only 1 path for outbound protocol stack")
+	}
+	if len(paths[0]) == 0 {
+		return common.NewError("outbound path is empty")
+	}
+	used := make(map[string]bool)
+	for _, tag := range paths[0] {
+		if _, found := nodes[tag]; !found {
+			return common.NewError("invalid node tag: " + tag)
+		}
+		if used[tag] {
+			return common.NewError("node " + tag + " appears more than once in the outbound path")
+		}
+		used[tag] = true
+	}
+	for tag := range nodes {
+		if !used[tag] {
+			log.Warn("outbound node", tag, "is not used")
+		}
+	}
+	return nil
+}
+
+func formatChain(path []string, nodes map[string]*proxy.Node) string {
+	names := make([]string, 0, len(path))
+	for _, tag := range path {
+		name := tag
+		if protocol := strings.ToLower(nodes[tag].Name); protocol != tag {
+			name += " (" + protocol + ")"
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, " -> ")
+}
+
 func init() {
 	proxy.RegisterProxyCreator(Name, func(ctx context.Context) (*proxy.Proxy, error) {
 		cfg := config.FromContext(ctx, Name).(*Config)
@@ -62,70 +151,56 @@ func init() {
 				cancel()
 			}
 		}()
-		// inbound
-		nodes, err := buildNodes(ctx, cfg.Inbound.Node)
+		// 创建任何服务之前检查协议树和出站链
+		inboundNodes, err := buildNodes(ctx, cfg.Inbound.Node)
 		if err != nil {
 			return nil, err
 		}
+		if err := checkInboundPaths(cfg.Inbound.Path, inboundNodes); err != nil {
+			return nil, common.NewError("invalid inbound protocol tree").Base(err)
+		}
+		outboundNodes, err := buildNodes(ctx, cfg.Outbound.Node)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkOutboundPath(cfg.Outbound.Path, outboundNodes); err != nil {
+			return nil, common.NewError("invalid outbound protocol stack").Base(err)
+		}
 
-		var root *proxy.Node
 		// build server tree
+		root := inboundNodes[cfg.Inbound.Path[0][0]]
+		t, err := tunnel.RegistryFromContext(root.Context).GetTunnel(root.Name)
+		if err != nil {
+			return nil, common.NewError("failed to find root tunnel").Base(err)
+		}
+		root.Server, err = t.NewServer(root.Context, nil)
+		if err != nil {
+			return nil, common.NewError("failed to init root server").Base(err)
+		}
 		for _, path := range cfg.Inbound.Path {
-			var lastNode *proxy.Node
-			for _, tag := range path {
-				if _, found := nodes[tag]; !found {
-					return nil, common.NewError("invalid node tag: " + tag)
-				}
-				if lastNode == nil {
-					if root == nil {
-						lastNode = nodes[tag]
-						root = lastNode
-						t, err := tunnel.GetTunnel(root.Name)
-						if err != nil {
-							return nil, common.NewError("failed to find root tunnel").Base(err)
-						}
-						s, err := t.NewServer(root.Context, nil)
-						if err != nil {
-							return nil, common.NewError("failed to init root server").Base(err)
-						}
-						root.Server = s
-					} else {
-						lastNode = root
-					}
-				} else {
-					lastNode = lastNode.LinkNextNode(nodes[tag])
-				}
+			lastNode := root
+			for _, tag := range path[1:] {
+				lastNode = lastNode.LinkNextNode(inboundNodes[tag])
 			}
 			lastNode.IsEndpoint = true
 		}
+		log.Info("inbound protocol tree:\n" + proxy.FormatTree(root))
 
 		servers := proxy.FindAllEndpoints(root)
 
-		if len(cfg.Outbound.Path) != 1 {
-			return nil, common.NewError("there must be only 1 path for outbound protocol stack")
-		}
-
-		// outbound
-		nodes, err = buildNodes(ctx, cfg.Outbound.Node)
-		if err != nil {
-			return nil, err
-		}
-
 		// build client stack
 		var client tunnel.Client
 		for _, tag := range cfg.Outbound.Path[0] {
-			if _, found := nodes[tag]; !found {
-				return nil, common.NewError("invalid node tag: " + tag)
-			}
-			t, err := tunnel.GetTunnel(nodes[tag].Name)
+			t, err := tunnel.RegistryFromContext(outboundNodes[tag].Context).GetTunnel(outboundNodes[tag].Name)
 			if err != nil {
 				return nil, common.NewError("invalid tunnel name").Base(err)
 			}
-			client, err = t.NewClient(nodes[tag].Context, client)
+			client, err = t.NewClient(outboundNodes[tag].Context, client)
 			if err != nil {
 				return nil, common.NewError("failed to create client").Base(err)
 			}
 		}
+		log.Info("outbound protocol stack: " + formatChain(cfg.Outbound.Path[0], outboundNodes))
 
 		success = true
 		return proxy.NewProxy(ctx, cancel, servers, client), nil
@@ -0,0 +1,72 @@
+package custom
+
+import (
+	"testing"
+
+	"github.com/p4gefau1t/trojan-go/proxy"
+)
+
+func TestCheckPaths(t *testing.T) {
+	nodes := make(map[string]*proxy.Node)
+	for tag, protocol := range map[string]string{
+		"transport": "TRANSPORT",
+		"tls":       "TLS",
+		"websocket": "WEBSOCKET",
+		"trojan1":   "TROJAN",
+		"trojan2":   "TROJAN",
+	} {
+		nodes[tag] = &proxy.Node{
+			Name: protocol,
+			Tag:  tag,
+			Next: make(map[string]*proxy.Node),
+		}
+	}
+
+	for i, c := range []struct {
+		paths [][]string
+		valid bool
+	}{
+		{[][]string{{"transport", "tls", "trojan1"}, {"transport", "tls", "websocket", "trojan2"}}, true},
+		{[][]string{{"transport", "tls", "trojan1"}, {"transport", "tls", "trojan1"}}, true},
+		{[][]string{}, false},
+		{[][]string{{"transport", "tls"}, {"tls", "trojan1"}}, false},                           // 不同的根
+		{[][]string{{"transport", "tls", "trojan1"}, {"transport", "websocket", "tls"}}, false}, // 多个父节点
+		{[][]string{{"transport", "tls", "transport"}}, false},                                  // 环
+		{[][]string{{"transport", "unknown"}}, false},
+	} {
+		if err := checkInboundPaths(c.paths, nodes); (err == nil) != c.valid {
+			t.Fatal("inbound case", i, err)
+		}
+	}
+
+	for i, c := range []struct {
+		paths [][]string
+		valid bool
+	}{
+		{[][]string{{"transport", "tls", "trojan1"}}, true},
+		{[][]string{{"transport", "tls"}, {"transport", "tls"}}, false},
+		{[][]string{{"transport", "tls", "tls"}}, false},
+		{[][]string{{}}, false},
+	} {
+		if err := checkOutboundPath(c.paths, nodes); (err == nil) != c.valid {
+			t.Fatal("outbound case", i, err)
+		}
+	}
+
+	root := nodes["transport"]
+	root.Next["tls"] = nodes["tls"]
+	nodes["tls"].Next["websocket"] = nodes["websocket"]
+	nodes["tls"].Next["trojan1"] = nodes["trojan1"]
+	nodes["websocket"].Next["trojan2"] = nodes["trojan2"]
+	expected := "transport\n" +
+		"└── tls\n" +
+		"    ├── trojan1 (trojan) *\n" +
+		"    └── websocket\n" +
+		"        └── trojan2 (trojan) *\n"
+	if tree := proxy.FormatTree(root); tree != expected {
+		t.Fatal("wrong tree:\n" + tree)
+	}
+	if chain := formatChain([]string{"transport", "tls", "trojan1"}, nodes); chain != "transport -> tls -> trojan1 (trojan)" {
+		t.Fatal("wrong chain:", chain)
+	}
+}
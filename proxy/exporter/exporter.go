@@ -0,0 +1,56 @@
+package exporter
+
+import (
+	"context"
+
+	"github.com/p4gefau1t/trojan-go/api"
+	_ "github.com/p4gefau1t/trojan-go/api/service"
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/proxy"
+	"github.com/p4gefau1t/trojan-go/statistic"
+	"github.com/p4gefau1t/trojan-go/statistic/mysql"
+	"github.com/p4gefau1t/trojan-go/tunnel/trojan"
+)
+
+// 只读的统计导出，连接数据面共用的数据库，只提供 API 服务，不监听代理端口
+const Name = "EXPORTER"
+
+func init() {
+	proxy.RegisterProxyCreator(Name, func(ctx context.Context) (*proxy.Proxy, error) {
+		// 使用服务端的 mysql、api 和 usage 配置
+		cfg := config.FromContext(ctx, trojan.Name).(*trojan.Config)
+		if !cfg.MySQL.Enabled {
+			return nil, common.NewError("exporter requires mysql")
+		}
+		if !cfg.API.Enabled {
+			return nil, common.NewError("exporter requires api")
+		}
+		ctx, cancel := context.WithCancel(statistic.WithReadOnly(ctx))
+		if cfg.Usage.Enabled {
+			usage, err := statistic.NewUsageTracker(ctx, &cfg.Usage)
+			if err != nil {
+				cancel()
+				return nil, common.NewError("exporter failed to create usage tracker").Base(err)
+			}
+			ctx = statistic.WithUsageTracker(ctx, usage)
+		}
+		auth, err := statistic.NewAuthenticator(ctx, mysql.Name)
+		if err != nil {
+			cancel()
+			return nil, common.NewError("exporter failed to create authenticator").Base(err)
+		}
+		go func() {
+			if err := api.RunService(ctx, trojan.Name+"_SERVER", auth); err != nil {
+				log.Error(common.NewError("exporter api service failed").Base(err))
+				cancel()
+			}
+		}()
+		p := proxy.NewProxy(ctx, cancel, nil, nil)
+		p.OnClose(func() {
+			auth.Close()
+		})
+		return p, nil
+	})
+}
@@ -0,0 +1,50 @@
+//go:build windows
+// +build windows
+
+package nat
+
+import (
+	"context"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/proxy"
+	"github.com/p4gefau1t/trojan-go/proxy/client"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/windivert"
+)
+
+// 基于 WinDivert 的透明代理，仅支持 IPv4 TCP
+
+const Name = "NAT"
+
+func init() {
+	proxy.RegisterProxyCreator(Name, func(ctx context.Context) (*proxy.Proxy, error) {
+		cfg := config.FromContext(ctx, Name).(*client.Config)
+		if cfg.Router.Enabled {
+			return nil, common.NewError("router is not allowed in nat mode")
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		// 入站路径 windivert
+		serverStack := []string{windivert.Name}
+		// 默认出站路径 trojan->tls->transport
+		clientStack := client.GenerateClientTree(cfg.TransportPlugin.Enabled, cfg.Mux.Enabled, cfg.Websocket.Enabled, cfg.Shadowsocks.Enabled, cfg.Padding.Enabled, false)
+		c, err := proxy.CreateClientStack(ctx, clientStack)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		s, err := proxy.CreateServerStack(ctx, serverStack)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		return proxy.NewProxy(ctx, cancel, []tunnel.Server{s}, c), nil
+	})
+}
+
+func init() {
+	config.RegisterConfigCreator(Name, func() interface{} {
+		return new(client.Config)
+	})
+}
@@ -56,8 +56,9 @@ func (o *Option) Handle() error {
 	isJSON := false
 	var data []byte
 	var err error
+	path := *o.path
 
-	switch *o.path {
+	switch path {
 	case "":
 		log.Warn("no specified config file, use default path to detect config file")
 		for _, file := range defaultConfigPath {
@@ -67,6 +68,7 @@ func (o *Option) Handle() error {
 				log.Warn(err)
 				continue
 			}
+			path = file
 			break
 		}
 	default:
@@ -82,10 +84,13 @@ func (o *Option) Handle() error {
 		if err != nil {
 			log.Fatal(err)
 		}
+		// 收到 SIGHUP 时重新加载
+		proxy.SetConfigFile(path)
 		err = proxy.Run() // 启动代理
 		if err != nil {
 			log.Fatal(err)
 		}
+		return nil // 代理正常退出
 	}
 
 	log.Fatal("no valid config")
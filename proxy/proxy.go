@@ -6,19 +6,29 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/backoff"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
+	"github.com/p4gefau1t/trojan-go/statistic"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
 
 const Name = "PROXY"
 
-const (
-	MaxPacketSize = 1024 * 8 // UDP包大小 8k
-)
+// Filter decides whether a request is allowed to reach its destination, it may record the addresses
+// it has checked in the Resolved of the metadata
+type Filter interface {
+	Filter(*tunnel.Metadata) error
+}
 
 // Proxy relay connections and packets
 // Proxy 中继连接和数据包
@@ -36,24 +46,116 @@ type Proxy struct {
 	ctx context.Context
 	// 这是一个函数，可以用来取消上下文 ctx。当代理需要停止工作时，可以调用这个函数来终止所有与上下文相关联的操作
 	cancel context.CancelFunc
+	// 可选的请求过滤器，在连接目标地址之前检查入站请求
+	filter Filter
+	// 中继的统计，退出时生成报告
+	stats *stats
+	// 退出报告的输出文件，为空时仅输出到日志
+	reportFile string
+	// UDP 中继的空闲超时，两个方向都没有数据包时结束中继，0 表示不超时
+	udpTimeout time.Duration
+	// 中继繁忙时的调度器，为空时不限制
+	scheduler *Scheduler
+	// 统计用户的应用层流量，为空时不统计
+	accounting *statistic.Accounting
+	// 配置文件路径，收到 SIGHUP 时重新加载，为空时忽略 SIGHUP
+	configFile string
+	// 停止代理时执行的清理函数
+	closers   []func()
+	closeOnce sync.Once
+}
+
+// SetFilter 设置请求过滤器，需要在 Run 之前调用
+func (p *Proxy) SetFilter(filter Filter) {
+	p.filter = filter
 }
 
-// Run 启动代理的简单方法
+// OnClose 注册停止代理时执行的清理函数，需要在 Run 之前调用
+func (p *Proxy) OnClose(f func()) {
+	p.closers = append(p.closers, f)
+}
+
+// SetConfigFile 设置配置文件路径，收到 SIGHUP 时从中重新加载证书和用户，需要在 Run 之前调用
+func (p *Proxy) SetConfigFile(path string) {
+	p.configFile = path
+}
+
+// reload reads the config file and passes it to the reload handlers, the existing connections are kept
+func (p *Proxy) reload() {
+	data, isJSON, err := detectAndReadConfig(p.configFile)
+	if err != nil {
+		log.Error(common.NewError("failed to reload config").Base(err))
+		return
+	}
+	format := "yaml"
+	if isJSON {
+		format = "json"
+	}
+	if failed := config.Reload(p.ctx, data, format); failed != 0 {
+		log.Error("config reloaded from", p.configFile, "with", failed, "failures")
+		return
+	}
+	log.Info("config reloaded from", p.configFile)
+}
+
+// Report returns the current summary of the proxy
+func (p *Proxy) Report(reason string) *Report {
+	return p.stats.report(reason)
+}
+
+// Run 启动代理的简单方法，收到 SIGINT 或 SIGTERM 时停止代理，返回前输出退出报告。
+// 设置了配置文件时，收到 SIGHUP 重新加载配置
 func (p *Proxy) Run() error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	hup := make(chan os.Signal, 1)
+	if p.configFile != "" {
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
+	if err := metrics.Serve(p.ctx); err != nil {
+		return err
+	}
 	p.relayConnLoop()   // TCP 连接中继
 	p.relayPacketLoop() // UDP 连接中继
 	// p.ctx.Done() 返回一个通道，当上下文被取消时，这个通道会接收到一个信号。这样可以优雅地停止 Run 方法的执行，确保所有的 goroutine 在停止时都有机会完成其操作
-	<-p.ctx.Done() // 阻塞
+	reason := "closed"
+loop:
+	for {
+		select { // 阻塞
+		case <-p.ctx.Done():
+			break loop
+		case sig := <-sigs:
+			log.Info("received signal", sig, ", shutting down")
+			reason = "signal " + sig.String()
+			p.Close()
+			break loop
+		case <-hup:
+			log.Info("received SIGHUP, reloading config")
+			p.reload()
+		}
+	}
+	writeReport(p.Report(reason), p.reportFile)
 	return nil
 }
 
 // Close 停止代理
 func (p *Proxy) Close() error {
 	p.cancel() // 取消上下文，停止所有操作
-	p.sink.Close()
+	// 只提供 API 的代理没有出站
+	if p.sink != nil {
+		p.sink.Close()
+	}
 	for _, source := range p.sources {
 		source.Close()
 	}
+	p.closeOnce.Do(func() {
+		for _, f := range p.closers {
+			f()
+		}
+	})
 	return nil
 }
 
@@ -64,46 +166,74 @@ func (p *Proxy) relayConnLoop() {
 	// 循环遍历所有协议服务栈，针对每个协议服务栈启动一个新的 goroutine
 	for _, source := range p.sources {
 		go func(source tunnel.Server) {
+			b := backoff.NewAcceptBackoff("proxy")
 			for {
 				// 1. 接受连接
-				// 尝试接受一个新的连接。如果失败，则检查上下文是否已取消，若是则退出循环
+				// 尝试接受一个新的连接。如果失败，则检查上下文是否已取消，若是则退出循环，否则等待一段时间后重试，避免 EMFILE 等错误时空转
 				inbound, err := source.AcceptConn(nil)
 				if err != nil {
-					// select 用于等待多个通道操作，其中至少一个通道准备好时会执行相应的代码块。在这里，它用于监听上下文的取消信号
-					select {
-					case <-p.ctx.Done(): // 阻塞
+					if !b.Wait(p.ctx, err) {
 						log.Debug("exiting")
-						return // 如果检查上下文已取消，若是则退出循环
-					default: // default 是空的，表示如果上下文没有被取消，则继续执行后续代码，所以，不会阻塞
+						return
 					}
-					log.Error(common.NewError("failed to accept connection").Base(err))
+					// 关闭时的错误不计入
+					p.stats.addError(ErrorAccept)
 					continue
 				}
+				b.Reset()
 				// 2. 处理连接
 				// 启动另一个 goroutine 来处理接受到的连接。使用 defer inbound.Close() 确保在函数退出时关闭连接
 				go func(inbound tunnel.Conn) {
 					defer inbound.Close()
-					// 尝试建立与目标客户端的出站连接
-					outbound, err := p.sink.DialConn(inbound.Metadata().Address, nil)
+					defer p.stats.open(false)()
+					// 过滤器可能修改 metadata，入站可能共用同一个 metadata，如 dokodemo
+					metadata := *inbound.Metadata()
+					if p.filter != nil {
+						if err := p.filter.Filter(&metadata); err != nil {
+							log.Warn(common.NewError("proxy rejected connection").Base(err))
+							p.stats.addError(ErrorFilter)
+							return
+						}
+					}
+					// 尝试建立与目标客户端的出站连接，出站需要完整的请求信息时（如按入站协议路由）传入 metadata
+					var outbound tunnel.Conn
+					var err error
+					if dialer, ok := p.sink.(tunnel.MetadataDialer); ok {
+						if metadata.Source == nil {
+							metadata.Source = inbound.RemoteAddr()
+						}
+						outbound, err = dialer.DialConnWithMetadata(&metadata, nil)
+					} else {
+						outbound, err = p.sink.DialConn(metadata.Address, nil)
+					}
 					if err != nil {
 						log.Error(common.NewError("proxy failed to dial connection").Base(err))
+						p.stats.addError(ErrorDial)
 						return
 					}
 					defer outbound.Close()
 					// 定义一个 errChan 通道来收集错误
 					errChan := make(chan error, 2)
-					copyConn := func(a, b net.Conn) {
-						_, err := io.Copy(a, b)
+					priority := p.scheduler.IsPriority(inbound.Metadata().Address.Port)
+					user := inbound.Metadata().User
+					copyConn := func(a, b net.Conn, counter *uint64, upload bool) {
+						w := p.scheduler.Writer(a, priority)
+						if p.accounting != nil && user != nil {
+							w = &payloadWriter{Writer: w, account: p.accounting, user: user, upload: upload}
+						}
+						n, err := io.Copy(w, b)
+						atomic.AddUint64(counter, uint64(n))
 						errChan <- err
 					}
 					// 两个连接之间转发数据
-					go copyConn(inbound, outbound)
-					go copyConn(outbound, inbound)
+					go copyConn(inbound, outbound, &p.stats.download, false)
+					go copyConn(outbound, inbound, &p.stats.upload, true)
 					// 使用 select 等待 errChan 中的错误或上下文的取消信号，这里如果都没有获取消息，则阻塞
 					select {
 					case err = <-errChan:
 						if err != nil { // 如果数据转发存在错误，则记录错误，结束连接中继
 							log.Error(err)
+							p.stats.addError(ErrorRelay)
 						}
 					case <-p.ctx.Done(): // 如果收到上下文的取消信号，则结束连接中继
 						log.Debug("shutting down conn relay")
@@ -120,52 +250,104 @@ func (p *Proxy) relayConnLoop() {
 func (p *Proxy) relayPacketLoop() {
 	for _, source := range p.sources {
 		go func(source tunnel.Server) {
+			b := backoff.NewAcceptBackoff("proxy_packet")
 			for {
 				inbound, err := source.AcceptPacket(nil)
 				if err != nil {
-					select {
-					case <-p.ctx.Done():
+					if !b.Wait(p.ctx, err) {
 						log.Debug("exiting")
 						return
-					default:
 					}
-					log.Error(common.NewError("failed to accept packet").Base(err))
+					// 关闭时的错误不计入
+					p.stats.addError(ErrorAccept)
 					continue
 				}
+				b.Reset()
 				go func(inbound tunnel.PacketConn) {
 					defer inbound.Close()
-					outbound, err := p.sink.DialPacket(nil)
+					defer p.stats.open(true)()
+					// 入站的数据包来自同一个用户时（如 trojan），出站需要按用户选择源地址
+					var outbound tunnel.PacketConn
+					var err error
+					dialer, ok := p.sink.(tunnel.MetadataPacketDialer)
+					inboundConn, hasMetadata := inbound.(interface{ Metadata() *tunnel.Metadata })
+					if ok && hasMetadata {
+						outbound, err = dialer.DialPacketWithMetadata(inboundConn.Metadata(), nil)
+					} else {
+						outbound, err = p.sink.DialPacket(nil)
+					}
 					if err != nil {
 						log.Error(common.NewError("proxy failed to dial packet").Base(err))
+						p.stats.addError(ErrorDial)
 						return
 					}
 					defer outbound.Close()
 					errChan := make(chan error, 2)
-					copyPacket := func(a, b tunnel.PacketConn) {
+					lastActive := time.Now().UnixNano() // 任一方向收到数据包的时间
+					var user atomic.Value               // 入站数据包的用户，统计应用层流量
+					copyPacket := func(a, b tunnel.PacketConn, filter Filter, counter *uint64, upload bool) {
+						buf := common.GetPacketBuffer()
+						defer common.PutPacketBuffer(buf)
 						for {
-							buf := make([]byte, MaxPacketSize)
+							if p.udpTimeout > 0 {
+								a.SetReadDeadline(time.Now().Add(p.udpTimeout))
+							}
 							n, metadata, err := a.ReadWithMetadata(buf)
 							if err != nil {
+								if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+									// 另一个方向仍有数据包时继续等待
+									if time.Since(time.Unix(0, atomic.LoadInt64(&lastActive))) < p.udpTimeout {
+										continue
+									}
+									log.Debug("packet relay idle timeout")
+									errChan <- nil
+									return
+								}
 								errChan <- err
 								return
 							}
+							atomic.StoreInt64(&lastActive, time.Now().UnixNano())
 							if n == 0 {
 								errChan <- nil
 								return
 							}
+							if filter != nil {
+								m := *metadata // 入站可能共用同一个 metadata
+								metadata = &m
+								if err := filter.Filter(metadata); err != nil {
+									log.Debug(common.NewError("proxy dropped packet").Base(err))
+									p.stats.addError(ErrorFilter)
+									continue
+								}
+							}
+							p.scheduler.wait(true, n) // UDP 总是优先转发
 							_, err = b.WriteWithMetadata(buf[:n], metadata)
 							if err != nil {
 								errChan <- err
 								return
 							}
+							atomic.AddUint64(counter, uint64(n))
+							if p.accounting != nil {
+								if upload && metadata.User != nil {
+									user.Store(packetUser{metadata.User}) // atomic.Value 要求类型一致
+								}
+								if u, ok := user.Load().(packetUser); ok {
+									if upload {
+										p.accounting.AddPayload(u.User, 0, n)
+									} else {
+										p.accounting.AddPayload(u.User, n, 0)
+									}
+								}
+							}
 						}
 					}
-					go copyPacket(inbound, outbound)
-					go copyPacket(outbound, inbound)
+					go copyPacket(inbound, outbound, p.filter, &p.stats.upload, true)
+					go copyPacket(outbound, inbound, nil, &p.stats.download, false)
 					select {
 					case err = <-errChan:
 						if err != nil {
 							log.Error(err)
+							p.stats.addError(ErrorRelay)
 						}
 					case <-p.ctx.Done():
 						log.Debug("shutting down packet relay")
@@ -179,12 +361,51 @@ func (p *Proxy) relayPacketLoop() {
 
 // 提供了一种方便的方式来创建和初始化 Proxy 实例。通过传递上下文和取消函数，可以确保代理能够有效地管理其生命周期，并在需要时优雅地停止
 func NewProxy(ctx context.Context, cancel context.CancelFunc, sources []tunnel.Server, sink tunnel.Client) *Proxy {
-	return &Proxy{
+	p := &Proxy{
 		sources: sources, // 入站协议服务
 		sink:    sink,    // 出站请求服务，已经构建协议栈
 		ctx:     ctx,
 		cancel:  cancel,
+		stats:   newStats(),
+		// 服务端开启流量口径统计时由创建器放入 ctx
+		accounting: statistic.AccountingFromContext(ctx),
 	}
+	if cfg, ok := config.FromContext(ctx, Name).(*Config); ok {
+		p.reportFile = cfg.ShutdownReport.File
+		p.udpTimeout = time.Duration(cfg.UDPTimeout) * time.Second
+		if cfg.Scheduler.Enabled {
+			scheduler, err := NewScheduler(ctx, cfg.Scheduler.Rate, time.Duration(cfg.Scheduler.Tick)*time.Millisecond, cfg.Scheduler.PriorityPorts)
+			if err != nil {
+				log.Error(common.NewError("scheduler disabled").Base(err))
+			} else {
+				p.scheduler = scheduler
+				log.Info("relay scheduler enabled, rate:", cfg.Scheduler.Rate, "bytes/s")
+			}
+		}
+	}
+	return p
+}
+
+// payloadWriter counts the application data relayed for the user, upload is true if the data is from the user
+type payloadWriter struct {
+	io.Writer
+	account *statistic.Accounting
+	user    statistic.User
+	upload  bool
+}
+
+func (w *payloadWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if w.upload {
+		w.account.AddPayload(w.user, 0, n)
+	} else {
+		w.account.AddPayload(w.user, n, 0)
+	}
+	return n, err
+}
+
+type packetUser struct {
+	statistic.User
 }
 
 // 代理创建器，ctx中包含配置
@@ -200,21 +421,35 @@ func RegisterProxyCreator(name string, creator Creator) {
 
 // NewProxyFromConfigData 根据传入的配置数据（以 JSON 或 YAML 格式）创建并返回一个新的 Proxy 实例
 func NewProxyFromConfigData(data []byte, isJSON bool) (*Proxy, error) {
+	return NewProxyFromConfigDataContext(context.Background(), data, isJSON)
+}
+
+// NewProxyFromConfigDataContext creates a proxy with the registries in the parent context,
+// see config.WithRegistry and tunnel.WithRegistry
+func NewProxyFromConfigDataContext(parent context.Context, data []byte, isJSON bool) (*Proxy, error) {
 	// create a unique context for each proxy instance to avoid duplicated authenticator
 	// 为每个代理实例创建一个唯一的上下文，以避免认证信息重复
-	ctx := context.WithValue(context.Background(), Name+"_ID", rand.Int())
+	ctx := context.WithValue(parent, Name+"_ID", rand.Int())
+	ctx = tunnel.WithScopedRegistry(ctx) // 运行中的实例不与同一进程中的其他代理共享
+	ctx = config.WithScopedRegistry(ctx) // 重新加载配置时只通知本实例
 	var err error
+	format := "json"
 	if isJSON {
 		ctx, err = config.WithJSONConfig(ctx, data)
 		if err != nil {
 			return nil, err
 		}
 	} else {
+		format = "yaml"
 		ctx, err = config.WithYAMLConfig(ctx, data)
 		if err != nil {
 			return nil, err
 		}
 	}
+	// 在创建各层之前检查配置，错误中包含字段的路径
+	if err := config.Validate(ctx, format); err != nil {
+		return nil, err
+	}
 	// 用此函数后进行类型断言，以获取具体类型的数据
 	cfg := config.FromContext(ctx, Name).(*Config)
 	create, ok := creators[strings.ToUpper(cfg.RunType)] // 获取该类型的工厂
@@ -222,6 +457,7 @@ func NewProxyFromConfigData(data []byte, isJSON bool) (*Proxy, error) {
 		return nil, common.NewError("unknown proxy type: " + cfg.RunType)
 	}
 	log.SetLogLevel(log.LogLevel(cfg.LogLevel)) // 设置日志层级
+	common.SetPacketSize(cfg.UDPPacketSize)     // 在创建各层之前设置
 	if cfg.LogFile != "" {
 		file, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
 		if err != nil {
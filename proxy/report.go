@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// 错误分类
+const (
+	ErrorAccept = "accept"
+	ErrorFilter = "filter"
+	ErrorDial   = "dial"
+	ErrorRelay  = "relay"
+)
+
+// Report is the summary of the proxy emitted on exit
+type Report struct {
+	Start          time.Time         `json:"start"`
+	Stop           time.Time         `json:"stop"`
+	Uptime         string            `json:"uptime"`
+	Reason         string            `json:"reason"` // 退出原因
+	Connections    uint64            `json:"connections"`
+	PacketSessions uint64            `json:"packet_sessions"`
+	Upload         uint64            `json:"upload"`   // 入站到出站的字节数
+	Download       uint64            `json:"download"` // 出站到入站的字节数
+	PeakConcurrent int64             `json:"peak_concurrent"`
+	Errors         map[string]uint64 `json:"errors"`
+}
+
+func (r *Report) String() string {
+	categories := make([]string, 0, len(r.Errors))
+	for category, count := range r.Errors {
+		categories = append(categories, fmt.Sprintf("%s=%d", category, count))
+	}
+	sort.Strings(categories)
+	return fmt.Sprintf("uptime: %s, reason: %s, connections: %d, packet sessions: %d, upload: %s, download: %s, peak concurrent: %d, errors: [%s]",
+		r.Uptime, r.Reason, r.Connections, r.PacketSessions,
+		common.HumanFriendlyTraffic(r.Upload), common.HumanFriendlyTraffic(r.Download),
+		r.PeakConcurrent, strings.Join(categories, " "))
+}
+
+// stats counts the relayed connections, packets and errors of the proxy
+type stats struct {
+	connections    uint64 // 原子操作的字段放在前面以保证 32 位平台上的对齐
+	packetSessions uint64
+	upload         uint64
+	download       uint64
+	active         int64
+	peak           int64
+	start          time.Time
+	errorsLock     sync.Mutex
+	errors         map[string]uint64
+}
+
+func newStats() *stats {
+	return &stats{
+		start:  time.Now(),
+		errors: make(map[string]uint64),
+	}
+}
+
+// open records a new connection or packet session, the returned function should be called when it ends
+func (s *stats) open(packet bool) func() {
+	if packet {
+		atomic.AddUint64(&s.packetSessions, 1)
+	} else {
+		atomic.AddUint64(&s.connections, 1)
+	}
+	active := atomic.AddInt64(&s.active, 1)
+	for {
+		peak := atomic.LoadInt64(&s.peak)
+		if active <= peak || atomic.CompareAndSwapInt64(&s.peak, peak, active) {
+			break
+		}
+	}
+	return func() {
+		atomic.AddInt64(&s.active, -1)
+	}
+}
+
+func (s *stats) addError(category string) {
+	s.errorsLock.Lock()
+	defer s.errorsLock.Unlock()
+	s.errors[category]++
+}
+
+func (s *stats) report(reason string) *Report {
+	s.errorsLock.Lock()
+	errors := make(map[string]uint64, len(s.errors))
+	for category, count := range s.errors {
+		errors[category] = count
+	}
+	s.errorsLock.Unlock()
+	now := time.Now()
+	return &Report{
+		Start:          s.start,
+		Stop:           now,
+		Uptime:         now.Sub(s.start).Round(time.Second).String(),
+		Reason:         reason,
+		Connections:    atomic.LoadUint64(&s.connections),
+		PacketSessions: atomic.LoadUint64(&s.packetSessions),
+		Upload:         atomic.LoadUint64(&s.upload),
+		Download:       atomic.LoadUint64(&s.download),
+		PeakConcurrent: atomic.LoadInt64(&s.peak),
+		Errors:         errors,
+	}
+}
+
+// writeReport logs the report, and writes it to the file in JSON if the path is not empty
+func writeReport(report *Report, path string) {
+	log.Info("shutdown report:", report)
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Error(common.NewError("failed to encode shutdown report").Base(err))
+		return
+	}
+	if err := ioutil.WriteFile(path, data, 0o644); err != nil {
+		log.Error(common.NewError("failed to write shutdown report to " + path).Base(err))
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+func TestReport(t *testing.T) {
+	s := newStats()
+	done1 := s.open(false)
+	done2 := s.open(false)
+	done2()
+	done3 := s.open(true)
+	done1()
+	done3()
+	s.addError(ErrorDial)
+	s.addError(ErrorDial)
+	s.addError(ErrorRelay)
+	s.upload += 100
+	s.download += 200
+
+	report := s.report("test")
+	if report.Connections != 2 || report.PacketSessions != 1 || report.PeakConcurrent != 2 {
+		t.Fatal("wrong counters", report)
+	}
+	if report.Errors[ErrorDial] != 2 || report.Errors[ErrorRelay] != 1 {
+		t.Fatal("wrong errors", report.Errors)
+	}
+
+	dir, err := ioutil.TempDir("", "trojan-go-report")
+	common.Must(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.json")
+	writeReport(report, path)
+	data, err := ioutil.ReadFile(path)
+	common.Must(err)
+	decoded := &Report{}
+	common.Must(json.Unmarshal(data, decoded))
+	if decoded.Upload != 100 || decoded.Download != 200 || decoded.Reason != "test" {
+		t.Fatal("wrong report file", string(data))
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// Scheduler shares a byte budget per tick among the relays. When the budget is used up,
+// the priority relays (udp and the configured ports) are served before the bulk tcp relays in the next tick,
+// so that the latency sensitive flows stay usable on congested servers.
+// A nil Scheduler does not limit
+type Scheduler struct {
+	lock            sync.Mutex
+	priorityCond    *sync.Cond
+	bulkCond        *sync.Cond
+	budget          int64 // 每个周期的字节预算
+	available       int64 // 当前周期剩余的预算，可以为负，由之后的周期偿还
+	priorityWaiting int   // 等待预算的优先连接数，不为 0 时普通连接不能使用预算
+	priorityPorts   map[int]bool
+}
+
+// wait blocks until the bytes can be sent
+func (s *Scheduler) wait(priority bool, n int) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if priority {
+		if s.available <= 0 {
+			s.priorityWaiting++
+			for s.available <= 0 {
+				s.priorityCond.Wait()
+			}
+			s.priorityWaiting--
+			if s.priorityWaiting == 0 {
+				s.bulkCond.Broadcast()
+			}
+		}
+	} else {
+		for s.available <= 0 || s.priorityWaiting > 0 {
+			s.bulkCond.Wait()
+		}
+	}
+	s.available -= int64(n)
+}
+
+// refill adds the budget of a tick, the unused budget is not accumulated
+func (s *Scheduler) refill() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.available += s.budget
+	if s.available > s.budget {
+		s.available = s.budget
+	}
+	s.priorityCond.Broadcast()
+	s.bulkCond.Broadcast()
+}
+
+func (s *Scheduler) run(ctx context.Context, tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.refill()
+		case <-ctx.Done():
+			// 不再限制，避免中继阻塞在已经停止的调度器上
+			s.lock.Lock()
+			s.budget = 1 << 62
+			s.available = s.budget
+			s.lock.Unlock()
+			s.priorityCond.Broadcast()
+			s.bulkCond.Broadcast()
+			return
+		}
+	}
+}
+
+// IsPriority reports whether the tcp relay to the port is served before the bulk ones
+func (s *Scheduler) IsPriority(port int) bool {
+	return s != nil && s.priorityPorts[port]
+}
+
+// Writer returns the writer limited by the scheduler
+func (s *Scheduler) Writer(w io.Writer, priority bool) io.Writer {
+	if s == nil {
+		return w
+	}
+	return &scheduledWriter{
+		Writer:    w,
+		scheduler: s,
+		priority:  priority,
+	}
+}
+
+type scheduledWriter struct {
+	io.Writer
+	scheduler *Scheduler
+	priority  bool
+}
+
+func (w *scheduledWriter) Write(p []byte) (int, error) {
+	w.scheduler.wait(w.priority, len(p))
+	return w.Writer.Write(p)
+}
+
+// NewScheduler creates a scheduler sending at most rate bytes per second, the budget is refilled every tick
+func NewScheduler(ctx context.Context, rate int, tick time.Duration, priorityPorts []int) (*Scheduler, error) {
+	if rate <= 0 {
+		return nil, common.NewError("invalid scheduler rate")
+	}
+	if tick <= 0 || tick > time.Second {
+		return nil, common.NewError("invalid scheduler tick")
+	}
+	budget := int64(rate) * int64(tick) / int64(time.Second)
+	if budget == 0 {
+		budget = 1
+	}
+	s := &Scheduler{
+		budget:        budget,
+		available:     budget,
+		priorityPorts: make(map[int]bool),
+	}
+	s.priorityCond = sync.NewCond(&s.lock)
+	s.bulkCond = sync.NewCond(&s.lock)
+	for _, port := range priorityPorts {
+		s.priorityPorts[port] = true
+	}
+	go s.run(ctx, tick)
+	return s, nil
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	var nilScheduler *Scheduler
+	if nilScheduler.Writer(ioutil.Discard, false) != ioutil.Discard || nilScheduler.IsPriority(53) {
+		t.Fatal("nil scheduler should not limit")
+	}
+	if _, err := NewScheduler(context.Background(), 0, time.Millisecond*10, nil); err == nil {
+		t.Fatal("invalid rate accepted")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// 每 10ms 分配 1000 字节
+	s, err := NewScheduler(ctx, 100000, time.Millisecond*10, []int{53})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.IsPriority(53) || s.IsPriority(443) {
+		t.Fatal("wrong priority ports")
+	}
+
+	// 大量普通连接占满带宽
+	bulk := uint64(0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := s.Writer(ioutil.Discard, false)
+			buf := make([]byte, 1000)
+			for ctx.Err() == nil {
+				w.Write(buf)
+				atomic.AddUint64(&bulk, uint64(len(buf)))
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// 公平分配时需要约 1.7 秒，优先连接在每个周期先得到预算
+	start := time.Now()
+	w := s.Writer(ioutil.Discard, true)
+	buf := make([]byte, 500)
+	for i := 0; i < 20; i++ {
+		w.Write(buf)
+	}
+	elapsed := time.Since(start)
+	sent := atomic.LoadUint64(&bulk)
+	total := time.Since(start) + time.Millisecond*100
+	cancel()
+	wg.Wait()
+	if elapsed > time.Millisecond*800 {
+		t.Fatal("priority writes are not prioritized", elapsed)
+	}
+	// 加上预算的透支，不应超过速率太多
+	if limit := uint64(total.Seconds()*100000) + 16*1000 + 2000; sent > limit {
+		t.Fatal("rate is not limited", sent, limit)
+	}
+}
@@ -3,10 +3,58 @@ package server
 import (
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/proxy/client"
+	"github.com/p4gefau1t/trojan-go/statistic"
 )
 
+type EgressUserConfig struct {
+	Password      string   `json:"password" yaml:"password"`
+	Hash          string   `json:"hash" yaml:"hash"`
+	DefaultPolicy string   `json:"default_policy" yaml:"default-policy"`
+	BlockPrivate  *bool    `json:"block_private" yaml:"block-private"`
+	Allow         []string `json:"allow" yaml:"allow"`
+	Deny          []string `json:"deny" yaml:"deny"`
+}
+
+type EgressConfig struct {
+	Enabled       bool               `json:"enabled" yaml:"enabled"`
+	DefaultPolicy string             `json:"default_policy" yaml:"default-policy"`
+	BlockPrivate  bool               `json:"block_private" yaml:"block-private"`
+	Allow         []string           `json:"allow" yaml:"allow"`
+	Deny          []string           `json:"deny" yaml:"deny"`
+	Users         []EgressUserConfig `json:"users" yaml:"users"`
+}
+
+// AccountingConfig 分别统计连接上的流量和应用层的流量，quota 为计入用户流量（配额、限速）的口径
+type AccountingConfig struct {
+	Enabled bool   `json:"enabled" yaml:"enabled"`
+	Quota   string `json:"quota" yaml:"quota"`
+}
+
+type Config struct {
+	client.Config `yaml:",inline"`
+	Egress        EgressConfig     `json:"egress" yaml:"egress"`
+	Accounting    AccountingConfig `json:"accounting" yaml:"accounting"`
+}
+
+func (c *Config) Validate() error {
+	var errs config.Errors
+	switch c.Accounting.Quota {
+	case statistic.AccountingWire, statistic.AccountingPayload:
+	default:
+		errs.Add("accounting.quota", "must be wire or payload")
+	}
+	return errs.Err()
+}
+
 func init() {
 	config.RegisterConfigCreator(Name, func() interface{} {
-		return new(client.Config)
+		return &Config{
+			Egress: EgressConfig{
+				DefaultPolicy: "allow",
+			},
+			Accounting: AccountingConfig{
+				Quota: statistic.AccountingWire,
+			},
+		}
 	})
 }
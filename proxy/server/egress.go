@@ -0,0 +1,374 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/statistic/memory"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+type egressRule struct {
+	raw      string
+	private  bool
+	cidr     *net.IPNet
+	domain   string
+	full     bool
+	portFrom int
+	portTo   int
+}
+
+func (r *egressRule) needIP() bool {
+	return r.private || r.cidr != nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+func (r *egressRule) match(addr *tunnel.Address, ip net.IP) bool {
+	switch {
+	case r.portTo != 0:
+		return addr.Port >= r.portFrom && addr.Port <= r.portTo
+	case r.private:
+		return ip != nil && isPrivateIP(ip)
+	case r.cidr != nil:
+		return ip != nil && r.cidr.Contains(ip)
+	case r.full:
+		return addr.AddressType == tunnel.DomainName && strings.ToLower(addr.DomainName) == r.domain
+	case r.domain != "":
+		if addr.AddressType != tunnel.DomainName {
+			return false
+		}
+		domain := strings.ToLower(addr.DomainName)
+		return domain == r.domain || strings.HasSuffix(domain, "."+r.domain)
+	}
+	return false
+}
+
+// newEgressRule parses rules like "private", "port:25", "port:6000-7000", "cidr:10.0.0.0/8",
+// "domain:example.com" and "full:www.example.com"
+func newEgressRule(s string) (*egressRule, error) {
+	rule := &egressRule{raw: s}
+	switch {
+	case s == "private":
+		rule.private = true
+	case strings.HasPrefix(s, "port:"):
+		ports := strings.SplitN(s[len("port:"):], "-", 2)
+		from, err := strconv.Atoi(ports[0])
+		if err != nil {
+			return nil, common.NewError("invalid egress port rule: " + s).Base(err)
+		}
+		to := from
+		if len(ports) == 2 {
+			if to, err = strconv.Atoi(ports[1]); err != nil {
+				return nil, common.NewError("invalid egress port rule: " + s).Base(err)
+			}
+		}
+		if from <= 0 || to > 65535 || from > to {
+			return nil, common.NewError("invalid egress port range: " + s)
+		}
+		rule.portFrom, rule.portTo = from, to
+	case strings.HasPrefix(s, "cidr:"):
+		cidr := s[len("cidr:"):]
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, common.NewError("invalid egress cidr rule: " + s).Base(err)
+		}
+		rule.cidr = ipNet
+	case strings.HasPrefix(s, "domain:"):
+		rule.domain = strings.ToLower(s[len("domain:"):])
+	case strings.HasPrefix(s, "full:"):
+		rule.domain = strings.ToLower(s[len("full:"):])
+		rule.full = true
+	default:
+		return nil, common.NewError("unknown egress rule: " + s)
+	}
+	return rule, nil
+}
+
+func newEgressRules(list []string) ([]*egressRule, error) {
+	rules := make([]*egressRule, 0, len(list))
+	for _, s := range list {
+		rule, err := newEgressRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseDefaultPolicy(policy string) (bool, error) {
+	switch strings.ToLower(policy) {
+	case "", "allow":
+		return true, nil
+	case "deny", "block":
+		return false, nil
+	default:
+		return false, common.NewError("unknown egress default policy: " + policy)
+	}
+}
+
+type egressRuleSet struct {
+	allow []*egressRule
+	deny  []*egressRule
+}
+
+func (s *egressRuleSet) needIP() bool {
+	for _, list := range [][]*egressRule{s.allow, s.deny} {
+		for _, r := range list {
+			if r.needIP() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check returns (matched, allowed, rule)
+func (s *egressRuleSet) check(addr *tunnel.Address, ip net.IP) (bool, bool, string) {
+	for _, r := range s.deny {
+		if r.match(addr, ip) {
+			return true, false, r.raw
+		}
+	}
+	for _, r := range s.allow {
+		if r.match(addr, ip) {
+			return true, true, r.raw
+		}
+	}
+	return false, false, ""
+}
+
+type egressPolicy struct {
+	user         *egressRuleSet
+	global       *egressRuleSet
+	blockPrivate bool
+	defaultAllow bool
+}
+
+// Egress is the outbound destination policy of the server
+// The rules of a user are evaluated before the global ones, in the order:
+// user deny, user allow, global deny, private ranges, global allow, default policy
+type Egress struct {
+	global *egressPolicy
+	users  map[string]*egressPolicy // 用户 hash -> 策略
+	cache  *lookupCache
+}
+
+const (
+	lookupTimeout   = time.Second * 5
+	lookupCacheTTL  = time.Minute // 每个 UDP 数据包都会检查，缓存解析结果
+	lookupCacheSize = 4096
+)
+
+// lookupIP 可在测试中替换
+var lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+type lookupEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+// lookupCache caches the addresses of the domain names checked by the policy, the failures are not cached
+type lookupCache struct {
+	sync.Mutex
+	entries map[string]*lookupEntry
+}
+
+func (c *lookupCache) lookup(host string) ([]net.IP, error) {
+	now := time.Now()
+	c.Lock()
+	if e, found := c.entries[host]; found && now.Before(e.expire) {
+		c.Unlock()
+		return e.ips, nil
+	}
+	c.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	ips, err := lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) >= lookupCacheSize {
+		for h, e := range c.entries {
+			if !now.Before(e.expire) {
+				delete(c.entries, h)
+			}
+		}
+		if len(c.entries) >= lookupCacheSize {
+			c.entries = make(map[string]*lookupEntry)
+		}
+	}
+	c.entries[host] = &lookupEntry{
+		ips:    ips,
+		expire: now.Add(lookupCacheTTL),
+	}
+	return ips, nil
+}
+
+// filter checks the destination with a resolved ip, which is nil if no rule needs it
+func (p *egressPolicy) filter(addr *tunnel.Address, ip net.IP) error {
+	deny := func(rule string) error {
+		return common.NewError("egress policy denied " + addr.String() + " by rule " + rule)
+	}
+	if matched, allowed, rule := p.user.check(addr, ip); matched {
+		if !allowed {
+			return deny(rule)
+		}
+		return nil
+	}
+	for _, r := range p.global.deny {
+		if r.match(addr, ip) {
+			return deny(r.raw)
+		}
+	}
+	if p.blockPrivate && ip != nil && isPrivateIP(ip) {
+		return deny("private")
+	}
+	for _, r := range p.global.allow {
+		if r.match(addr, ip) {
+			return nil
+		}
+	}
+	if !p.defaultAllow {
+		return deny("default")
+	}
+	return nil
+}
+
+func (e *Egress) Filter(m *tunnel.Metadata) error {
+	policy := e.global
+	if m.User != nil {
+		if p, found := e.users[m.User.Hash()]; found {
+			policy = p
+		}
+	}
+	addr := m.Address
+	if addr.AddressType != tunnel.DomainName {
+		return policy.filter(addr, addr.IP)
+	}
+	if !policy.blockPrivate && !policy.user.needIP() && !policy.global.needIP() {
+		return policy.filter(addr, nil)
+	}
+
+	// resolve the domain name, or internal hosts can be reached with a domain name.
+	// Every resolved address is checked, and the checked addresses are dialed instead of resolving the name again,
+	// otherwise the name may resolve to another address when dialing (DNS rebinding).
+	// The domain name is kept for the router and the dial override rules
+	ips, err := e.cache.lookup(addr.DomainName)
+	if err != nil {
+		return common.NewError("egress policy failed to resolve " + addr.String()).Base(err)
+	}
+	if len(ips) == 0 {
+		return common.NewError("egress policy failed to resolve " + addr.String() + ": no address")
+	}
+	for _, ip := range ips {
+		if err := policy.filter(addr, ip); err != nil {
+			return err
+		}
+	}
+	m.Resolved = ips
+	return nil
+}
+
+func newEgressPolicy(global *egressPolicy, allow, deny []string, blockPrivate *bool, defaultPolicy string) (*egressPolicy, error) {
+	user := &egressRuleSet{}
+	var err error
+	if user.allow, err = newEgressRules(allow); err != nil {
+		return nil, err
+	}
+	if user.deny, err = newEgressRules(deny); err != nil {
+		return nil, err
+	}
+	policy := &egressPolicy{
+		user:         user,
+		global:       global.global,
+		blockPrivate: global.blockPrivate,
+		defaultAllow: global.defaultAllow,
+	}
+	if blockPrivate != nil {
+		policy.blockPrivate = *blockPrivate
+	}
+	if defaultPolicy != "" {
+		if policy.defaultAllow, err = parseDefaultPolicy(defaultPolicy); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// NewEgress creates the egress policy. Members of a user group inherit the policy of the group,
+// unless they have their own policy in the users list
+func NewEgress(cfg *EgressConfig, groups []memory.GroupConfig) (*Egress, error) {
+	global := &egressRuleSet{}
+	var err error
+	if global.allow, err = newEgressRules(cfg.Allow); err != nil {
+		return nil, err
+	}
+	if global.deny, err = newEgressRules(cfg.Deny); err != nil {
+		return nil, err
+	}
+	defaultAllow, err := parseDefaultPolicy(cfg.DefaultPolicy)
+	if err != nil {
+		return nil, err
+	}
+	e := &Egress{
+		global: &egressPolicy{
+			user:         &egressRuleSet{},
+			global:       global,
+			blockPrivate: cfg.BlockPrivate,
+			defaultAllow: defaultAllow,
+		},
+		users: make(map[string]*egressPolicy),
+		cache: &lookupCache{entries: make(map[string]*lookupEntry)},
+	}
+	for _, userCfg := range cfg.Users {
+		hash := userCfg.Hash
+		if hash == "" {
+			if userCfg.Password == "" {
+				return nil, common.NewError("egress user has neither password nor hash")
+			}
+			hash = common.SHA224String(userCfg.Password)
+		}
+		policy, err := newEgressPolicy(e.global, userCfg.Allow, userCfg.Deny, userCfg.BlockPrivate, userCfg.DefaultPolicy)
+		if err != nil {
+			return nil, err
+		}
+		e.users[hash] = policy
+	}
+	for _, group := range groups {
+		if group.Egress == nil {
+			continue
+		}
+		policy, err := newEgressPolicy(e.global, group.Egress.Allow, group.Egress.Deny, group.Egress.BlockPrivate, group.Egress.DefaultPolicy)
+		if err != nil {
+			return nil, common.NewError("invalid egress policy of group " + group.Name).Base(err)
+		}
+		for _, hash := range group.UserHashes() {
+			if _, found := e.users[hash]; !found {
+				e.users[hash] = policy
+			}
+		}
+	}
+	log.Debug("egress policy loaded with", len(e.users), "user overrides")
+	return e, nil
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/statistic/memory"
+	"github.com/p4gefau1t/trojan-go/test/util"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
+	"github.com/p4gefau1t/trojan-go/tunnel/router"
+)
+
+type testUser struct {
+	memory.User
+	hash string
+}
+
+func (u *testUser) Hash() string {
+	return u.hash
+}
+
+func TestEgress(t *testing.T) {
+	blockPrivate := false
+	egress, err := NewEgress(&EgressConfig{
+		Enabled:      true,
+		BlockPrivate: true,
+		Deny:         []string{"port:25", "domain:blocked.com"},
+		Users: []EgressUserConfig{
+			{
+				Password:     "admin",
+				BlockPrivate: &blockPrivate,
+				Allow:        []string{"port:25"},
+			},
+			{
+				Password:      "trial",
+				DefaultPolicy: "deny",
+				BlockPrivate:  &blockPrivate,
+				Allow:         []string{"full:www.example.com"},
+			},
+		},
+	}, []memory.GroupConfig{
+		{
+			Name:      "trial",
+			Passwords: []string{"trial", "member"},
+			Egress: &memory.GroupEgressConfig{
+				Deny: []string{"port:80"},
+			},
+		},
+	})
+	common.Must(err)
+
+	check := func(user string, addr string, allowed bool) {
+		address, err := tunnel.NewAddressFromAddr("tcp", addr)
+		common.Must(err)
+		m := &tunnel.Metadata{
+			Address: address,
+		}
+		if user != "" {
+			m.User = &testUser{hash: common.SHA224String(user)}
+		}
+		err = egress.Filter(m)
+		if (err == nil) != allowed {
+			t.Fatal("unexpected result", user, addr, err)
+		}
+	}
+	check("", "1.1.1.1:443", true)
+	check("", "1.1.1.1:25", false)
+	check("", "127.0.0.1:443", false)
+	check("", "10.0.0.1:80", false)
+	check("", "a.blocked.com:443", false)
+	check("admin", "127.0.0.1:443", true)
+	check("admin", "1.1.1.1:25", true)
+	check("admin", "a.blocked.com:443", false)
+	check("trial", "www.example.com:443", true)
+	check("trial", "1.1.1.1:443", false)
+	check("unknown", "1.1.1.1:443", true)
+	check("member", "1.1.1.1:443", true)
+	check("member", "1.1.1.1:80", false)
+	check("member", "1.1.1.1:25", false)
+
+	// 域名解析出的所有地址都要检查，之后直接连接检查过的地址
+	defer func(f func(context.Context, string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		if host == "rebind.test" {
+			return []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("127.0.0.1")}, nil
+		}
+		return []net.IP{net.ParseIP("1.1.1.1")}, nil
+	}
+	check("", "rebind.test:443", false)
+	address, err := tunnel.NewAddressFromAddr("tcp", "public.test:443")
+	common.Must(err)
+	m := &tunnel.Metadata{Address: address}
+	common.Must(egress.Filter(m))
+	if m.Address != address || len(m.Resolved) != 1 || !m.Resolved[0].Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatal("checked address is not recorded", m.Address, m.Resolved)
+	}
+
+	_, err = NewEgress(&EgressConfig{Deny: []string{"port:70000"}}, nil)
+	if err == nil {
+		t.Fatal("invalid rule accepted")
+	}
+}
+
+func TestEgressKeepsDomain(t *testing.T) {
+	lookups := 0
+	defer func(f func(context.Context, string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		lookups++
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	}
+	egress, err := NewEgress(&EgressConfig{
+		Enabled:       true,
+		DefaultPolicy: "deny",
+		Allow:         []string{"cidr:127.0.0.0/8"},
+	}, nil)
+	common.Must(err)
+	newMetadata := func(port int) *tunnel.Metadata {
+		m := &tunnel.Metadata{Address: tunnel.NewAddressFromHostPort("tcp", "echo.test", port)}
+		common.Must(egress.Filter(m))
+		return m
+	}
+	m := newMetadata(util.EchoPort)
+	newMetadata(util.EchoPort)
+	if lookups != 1 {
+		t.Fatal("lookup is not cached", lookups)
+	}
+
+	// 路由的域名规则仍然匹配
+	ctx, err := config.WithYAMLConfig(context.Background(), []byte(`
+router:
+    enabled: true
+    default-policy: proxy
+    block:
+    - "domain:echo.test"
+`))
+	common.Must(err)
+	direct, err := freedom.NewClient(config.WithConfig(ctx, freedom.Name, &freedom.Config{}), nil)
+	common.Must(err)
+	defer direct.Close()
+	routerClient, err := router.NewClient(ctx, direct)
+	common.Must(err)
+	defer routerClient.Close()
+	if policy := routerClient.RouteMetadata(m); policy != router.Block {
+		t.Fatal("domain rule does not match", policy)
+	}
+
+	// 直接连接检查过的地址，echo.test 无法解析
+	conn, err := direct.DialConnWithMetadata(m, nil)
+	common.Must(err)
+	conn.Close()
+
+	// 改写规则仍然匹配域名
+	overrideClient, err := freedom.NewClient(config.WithConfig(ctx, freedom.Name, &freedom.Config{
+		DialOverride: []freedom.OverrideConfig{{Match: "echo.test:1", Rewrite: util.EchoAddr}},
+	}), nil)
+	common.Must(err)
+	defer overrideClient.Close()
+	conn, err = overrideClient.DialConnWithMetadata(newMetadata(1), nil)
+	common.Must(err)
+	payload := util.GeneratePayload(128)
+	buf := make([]byte, 128)
+	common.Must2(conn.Write(payload))
+	common.Must2(io.ReadFull(conn, buf))
+	if !bytes.Equal(payload, buf) {
+		t.Fatal("wrong echo")
+	}
+	conn.Close()
+}
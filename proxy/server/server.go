@@ -3,11 +3,16 @@ package server
 import (
 	"context"
 
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/overload"
 	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/metrics"
 	"github.com/p4gefau1t/trojan-go/proxy"
-	"github.com/p4gefau1t/trojan-go/proxy/client"
+	"github.com/p4gefau1t/trojan-go/statistic"
+	"github.com/p4gefau1t/trojan-go/statistic/memory"
 	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
 	"github.com/p4gefau1t/trojan-go/tunnel/mux"
+	"github.com/p4gefau1t/trojan-go/tunnel/padding"
 	"github.com/p4gefau1t/trojan-go/tunnel/router"
 	"github.com/p4gefau1t/trojan-go/tunnel/shadowsocks"
 	"github.com/p4gefau1t/trojan-go/tunnel/simplesocks"
@@ -23,7 +28,25 @@ const Name = "SERVER"
 func init() {
 	proxy.RegisterProxyCreator(Name, func(ctx context.Context) (*proxy.Proxy, error) {
 		// 获取服务器端配置
-		cfg := config.FromContext(ctx, Name).(*client.Config)
+		cfg := config.FromContext(ctx, Name).(*Config)
+		if cfg.Accounting.Enabled {
+			accounting, err := statistic.NewAccounting(cfg.Accounting.Quota)
+			if err != nil {
+				return nil, err
+			}
+			// 传输层、trojan 和中继从 ctx 中获取，分别统计连接上和应用层的流量
+			ctx = statistic.WithAccounting(ctx, accounting)
+		}
+		var limiter *overload.Limiter
+		if overloadCfg := config.FromContext(ctx, overload.Name).(*overload.Config); overloadCfg.Overload.Enabled {
+			var err error
+			limiter, err = overload.NewLimiter(overloadCfg.Overload.MaxConns, overloadCfg.Overload.FallbackThreshold)
+			if err != nil {
+				return nil, err
+			}
+			// 传输层和回落从 ctx 中获取，API 和健康检查使用各自的监听器，不受限制
+			ctx = overload.WithLimiter(ctx, limiter)
+		}
 		ctx, cancel := context.WithCancel(ctx)
 		// 传输层协议服务端创建
 		transportServer, err := transport.NewServer(ctx, nil)
@@ -54,6 +77,9 @@ func init() {
 		if cfg.Shadowsocks.Enabled {
 			trojanSubTree = trojanSubTree.BuildNext(shadowsocks.Name)
 		}
+		if cfg.Padding.Enabled {
+			trojanSubTree = trojanSubTree.BuildNext(padding.Name)
+		}
 		// 入站路径 transport->tls->trojan->mux->simplesocks
 		trojanSubTree.BuildNext(trojan.Name).BuildNext(mux.Name).BuildNext(simplesocks.Name).IsEndpoint = true
 		// 入站路径 transport->tls->trojan
@@ -63,6 +89,9 @@ func init() {
 		if cfg.Shadowsocks.Enabled {
 			wsSubTree = wsSubTree.BuildNext(shadowsocks.Name)
 		}
+		if cfg.Padding.Enabled {
+			wsSubTree = wsSubTree.BuildNext(padding.Name)
+		}
 		// 入站路径 transport->tls->websocket->trojan->mux->simplesocks
 		wsSubTree.BuildNext(trojan.Name).BuildNext(mux.Name).BuildNext(simplesocks.Name).IsEndpoint = true
 		// 入站路径 transport->tls->websocket->trojan
@@ -74,6 +103,28 @@ func init() {
 			cancel()
 			return nil, err
 		}
-		return proxy.NewProxy(ctx, cancel, serverList, clientList), nil
+		p := proxy.NewProxy(ctx, cancel, serverList, clientList)
+		if limiter != nil {
+			p.OnClose(metrics.RegisterGauge(ctx, "trojan_go_overload_conns", "Number of the inbound connections being handled.", func() float64 {
+				return float64(limiter.Conns())
+			}))
+		}
+		// 出站目标地址策略，用户组的策略同样需要启用过滤
+		groups := config.FromContext(ctx, memory.Name).(*memory.Config).Groups
+		enableEgress := cfg.Egress.Enabled
+		for _, group := range groups {
+			if group.Egress != nil {
+				enableEgress = true
+			}
+		}
+		if enableEgress {
+			egress, err := NewEgress(&cfg.Egress, groups)
+			if err != nil {
+				cancel()
+				return nil, common.NewError("invalid egress policy").Base(err)
+			}
+			p.SetFilter(egress)
+		}
+		return p, nil
 	})
 }
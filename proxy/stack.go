@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"context"
+	"sort"
+	"strings"
 
 	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/tunnel"
@@ -10,7 +12,8 @@ import (
 // Trojan-Go将所有协议抽象为隧道，每个隧道可能提供客户端，负责发送；也可能提供服务端，负责接受；或者两者皆提供。自定义协议栈即自定义隧道的堆叠方式
 // 自定义协议栈的工作方式是，定义树/链上节点并分别它们起名（tag）并添加配置，然后使用tag组成的有向路径，描述这棵树/链
 type Node struct {
-	Name       string // 协议 tag
+	Name       string // 协议名称
+	Tag        string // 自定义协议栈中节点的 tag，为空时使用协议名称
 	Next       map[string]*Node
 	IsEndpoint bool
 	context.Context
@@ -18,12 +21,34 @@ type Node struct {
 	tunnel.Client
 }
 
+// key 返回节点在父节点 Next 中的键
+func (n *Node) key() string {
+	if n.Tag != "" {
+		return n.Tag
+	}
+	return n.Name
+}
+
+// children 返回按键排序的子节点，使遍历的顺序与配置无关且固定
+func (n *Node) children() []*Node {
+	keys := make([]string, 0, len(n.Next))
+	for key := range n.Next {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]*Node, 0, len(keys))
+	for _, key := range keys {
+		children = append(children, n.Next[key])
+	}
+	return children
+}
+
 // 通过名称构建一个新的协议节点
 func (n *Node) BuildNext(name string) *Node {
 	if next, found := n.Next[name]; found {
 		return next
 	}
-	t, err := tunnel.GetTunnel(name)
+	t, err := tunnel.RegistryFromContext(n.Context).GetTunnel(name)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -43,11 +68,11 @@ func (n *Node) BuildNext(name string) *Node {
 
 // 通过一个原有的协议节点来构建协议栈
 func (n *Node) LinkNextNode(next *Node) *Node {
-	if next, found := n.Next[next.Name]; found {
+	if next, found := n.Next[next.key()]; found {
 		return next
 	}
-	n.Next[next.Name] = next
-	t, err := tunnel.GetTunnel(next.Name)
+	n.Next[next.key()] = next
+	t, err := tunnel.RegistryFromContext(next.Context).GetTunnel(next.Name)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -65,17 +90,49 @@ func FindAllEndpoints(root *Node) []tunnel.Server {
 	if root.IsEndpoint || len(root.Next) == 0 {
 		list = append(list, root.Server)
 	}
-	for _, next := range root.Next {
+	for _, next := range root.children() {
 		list = append(list, FindAllEndpoints(next)...)
 	}
 	return list
 }
 
+// FormatTree renders the protocol tree for logging, the endpoints are marked with "*"
+func FormatTree(root *Node) string {
+	b := &strings.Builder{}
+	var format func(n *Node, prefix string, last bool, depth int)
+	format = func(n *Node, prefix string, last bool, depth int) {
+		if depth > 0 {
+			b.WriteString(prefix)
+			if last {
+				b.WriteString("└── ")
+				prefix += "    "
+			} else {
+				b.WriteString("├── ")
+				prefix += "│   "
+			}
+		}
+		b.WriteString(n.key())
+		if n.Tag != "" && !strings.EqualFold(n.Tag, n.Name) {
+			b.WriteString(" (" + strings.ToLower(n.Name) + ")")
+		}
+		if n.IsEndpoint || len(n.Next) == 0 {
+			b.WriteString(" *")
+		}
+		b.WriteString("\n")
+		children := n.children()
+		for i, child := range children {
+			format(child, prefix, i == len(children)-1, depth+1)
+		}
+	}
+	format(root, "", true, 0)
+	return b.String()
+}
+
 // CreateClientStack create client tunnel stacks from lists
 func CreateClientStack(ctx context.Context, clientStack []string) (tunnel.Client, error) {
 	var client tunnel.Client
 	for _, name := range clientStack {
-		t, err := tunnel.GetTunnel(name)
+		t, err := tunnel.RegistryFromContext(ctx).GetTunnel(name)
 		if err != nil {
 			return nil, err
 		}
@@ -91,7 +148,7 @@ func CreateClientStack(ctx context.Context, clientStack []string) (tunnel.Client
 func CreateServerStack(ctx context.Context, serverStack []string) (tunnel.Server, error) {
 	var server tunnel.Server
 	for _, name := range serverStack {
-		t, err := tunnel.GetTunnel(name)
+		t, err := tunnel.RegistryFromContext(ctx).GetTunnel(name)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,210 @@
+package redirector
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
+)
+
+const (
+	recordQueueSize  = 64
+	recordsPerSecond = 10 // 超出的记录被丢弃，避免扫描时频繁写入磁盘
+)
+
+var droppedRecords = metrics.NewCounter("trojan_go_capture_dropped_total", "Number of the capture records dropped for the rate limit or a full queue.")
+
+// Recorder saves the first bytes of the rejected connections to a ring of files on the disk,
+// so that the operators can inspect what the scanners are sending without capturing on the host.
+// Records are written in the background, at most recordsPerSecond of them per second.
+// A nil Recorder records nothing
+type Recorder struct {
+	sync.Mutex
+	name       string
+	dir        string
+	maxBytes   int
+	maxRecords int
+	next       int // 下一条记录写入的位置
+	second     int64
+	count      int // 本秒已经提交的记录数
+	queue      chan string
+}
+
+func (r *Recorder) fileName(i int) string {
+	return fmt.Sprintf("capture-%s-%04d.txt", r.name, i)
+}
+
+func (r *Recorder) header(stage string, addr net.Addr) *strings.Builder {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "time: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(b, "stage: %s\n", stage)
+	if addr != nil {
+		fmt.Fprintf(b, "from: %s\n", addr.String())
+	}
+	return b
+}
+
+// submit queues the record, it is dropped when the rate limit is reached or the queue is full
+func (r *Recorder) submit(record string) {
+	r.Lock()
+	now := time.Now().Unix()
+	if now != r.second {
+		r.second, r.count = now, 0
+	}
+	allowed := r.count < recordsPerSecond
+	if allowed {
+		r.count++
+	}
+	r.Unlock()
+	if !allowed {
+		droppedRecords.Inc()
+		return
+	}
+	select {
+	case r.queue <- record:
+	default:
+		droppedRecords.Inc()
+	}
+}
+
+// Record records the bytes received on the wire from the rejected connection, the data is truncated and hex dumped
+func (r *Recorder) Record(stage string, addr net.Addr, data []byte, reason error) {
+	if r == nil {
+		return
+	}
+	b := r.header(stage, addr)
+	if reason != nil {
+		// 原因中可能含有探测者发送的数据
+		fmt.Fprintf(b, "reason: %q\n", reason.Error())
+	}
+	if len(data) > r.maxBytes {
+		fmt.Fprintf(b, "length: %d (truncated to %d)\n\n", len(data), r.maxBytes)
+		data = data[:r.maxBytes]
+	} else {
+		fmt.Fprintf(b, "length: %d\n\n", len(data))
+	}
+	b.WriteString(hex.Dump(data)) // 不可打印的字符不会原样写入
+	r.submit(b.String())
+}
+
+// RecordDecrypted records the decrypted bytes of the rejected connection. They may contain the credentials
+// of the users, such as the password hash or the Cookie and Authorization headers, so only the length is recorded,
+// and for a http request the request line without the query and the header names
+func (r *Recorder) RecordDecrypted(stage string, addr net.Addr, data []byte) {
+	if r == nil {
+		return
+	}
+	b := r.header(stage, addr)
+	fmt.Fprintf(b, "length: %d\n", len(data))
+	if len(data) > r.maxBytes {
+		data = data[:r.maxBytes]
+	}
+	if head := redactHTTP(data); head != "" {
+		b.WriteString("\n")
+		b.WriteString(head)
+	}
+	r.submit(b.String())
+}
+
+// redactHTTP returns the request line and header names of a http request with the values redacted,
+// or an empty string if the data is not a http request
+func redactHTTP(data []byte) string {
+	lines := strings.Split(string(data), "\r\n")
+	requestLine := strings.Split(lines[0], " ")
+	if len(requestLine) != 3 || !strings.HasPrefix(requestLine[2], "HTTP/") || !isToken(requestLine[0]) {
+		return ""
+	}
+	target := requestLine[1]
+	if i := strings.IndexByte(target, '?'); i >= 0 {
+		target = target[:i] + "?<redacted>"
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%q\n", requestLine[0]+" "+target+" "+requestLine[2])
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 || !isToken(line[:i]) {
+			break // 头部结束或者被截断
+		}
+		fmt.Fprintf(b, "%s: <redacted>\n", line[:i])
+	}
+	return b.String()
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Recorder) write(record string) {
+	path := filepath.Join(r.dir, r.fileName(r.next))
+	r.next = (r.next + 1) % r.maxRecords
+	if err := ioutil.WriteFile(path, []byte(record), 0o600); err != nil {
+		log.Error(common.NewError("failed to write capture record").Base(err))
+	}
+}
+
+func (r *Recorder) writeLoop(ctx context.Context) {
+	for {
+		select {
+		case record := <-r.queue:
+			r.write(record)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// NewRecorder creates the recorder of a server saving at most maxRecords records in dir, the files are named
+// after the server so that the servers sharing the dir do not overwrite each other. It stops when ctx is done
+func NewRecorder(ctx context.Context, name string, dir string, maxBytes int, maxRecords int) (*Recorder, error) {
+	if maxBytes <= 0 || maxRecords <= 0 {
+		return nil, common.NewError("invalid capture max_bytes or max_records")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, common.NewError("invalid capture path").Base(err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, common.NewError("failed to create capture path").Base(err)
+	}
+	r := &Recorder{
+		name:       name,
+		dir:        dir,
+		maxBytes:   maxBytes,
+		maxRecords: maxRecords,
+		queue:      make(chan string, recordQueueSize),
+	}
+	// 重启后从最旧的记录继续覆盖
+	var latest time.Time
+	for i := 0; i < maxRecords; i++ {
+		info, err := os.Stat(filepath.Join(dir, r.fileName(i)))
+		if err != nil {
+			r.next = i
+			break
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+			r.next = (i + 1) % maxRecords
+		}
+	}
+	go r.writeLoop(ctx)
+	log.Info("capturing rejected connections of", name, "to", dir)
+	return r, nil
+}
@@ -0,0 +1,52 @@
+package redirector
+
+import (
+	"github.com/p4gefau1t/trojan-go/config"
+)
+
+const Name = "REDIRECTOR"
+
+type ProxyProtocolConfig struct {
+	Fallback int `json:"fallback" yaml:"fallback"` // 向回落地址发送的 PROXY 协议头部版本，0 表示不发送
+}
+
+// FallbackConfig 回落地址不可达时的处理方式
+type FallbackConfig struct {
+	OnDown        string `json:"on_down" yaml:"on-down"`               // fail，retry 或 static
+	CheckInterval int    `json:"check_interval" yaml:"check-interval"` // 检查回落地址的间隔秒数
+	Response      string `json:"response" yaml:"response"`             // static 时返回的原始数据文件，留空使用内置的 HTTP 503 响应
+}
+
+type Config struct {
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol" yaml:"proxy-protocol"`
+	Fallback      FallbackConfig      `json:"fallback" yaml:"fallback"`
+}
+
+func (c *Config) Validate() error {
+	var errs config.Errors
+	switch c.ProxyProtocol.Fallback {
+	case 0, 1, 2:
+	default:
+		errs.Add("proxy_protocol.fallback", "must be 0, 1 or 2")
+	}
+	switch c.Fallback.OnDown {
+	case fallbackFail, fallbackRetry, fallbackStatic:
+	default:
+		errs.Add("fallback.on_down", "must be fail, retry or static")
+	}
+	if c.Fallback.CheckInterval <= 0 {
+		errs.Add("fallback.check_interval", "must be positive")
+	}
+	return errs.Err()
+}
+
+func init() {
+	config.RegisterConfigCreator(Name, func() interface{} {
+		return &Config{
+			Fallback: FallbackConfig{
+				OnDown:        fallbackFail,
+				CheckInterval: 10,
+			},
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package redirector
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
+)
+
+// 回落地址不可达时的处理方式
+const (
+	fallbackFail   = "fail"   // 启动时不可达则启动失败
+	fallbackRetry  = "retry"  // 照常启动，在后台重试，不可达时关闭连接
+	fallbackStatic = "static" // 照常启动，在后台重试，不可达时返回静态响应
+)
+
+// staticResponse is sent to the connections redirected to an unreachable fallback if no response file is specified
+var staticResponse = func() []byte {
+	body := "<html>\r\n<head><title>503 Service Temporarily Unavailable</title></head>\r\n<body>\r\n" +
+		"<center><h1>503 Service Temporarily Unavailable</h1></center>\r\n<hr><center>nginx</center>\r\n</body>\r\n</html>\r\n"
+	return []byte("HTTP/1.1 503 Service Temporarily Unavailable\r\n" +
+		"Server: nginx\r\n" +
+		"Content-Type: text/html\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n\r\n" + body)
+}()
+
+// fallbackState is the health of a fallback address, shared by the redirectors watching it
+type fallbackState struct {
+	address string
+	healthy bool
+	checked time.Time
+	err     error
+	refs    int // 监视该地址的转发器数量
+}
+
+var (
+	fallbacksLock sync.Mutex
+	fallbacks     = make(map[string]*fallbackState)
+)
+
+func init() {
+	metrics.RegisterHealthCheck("fallback", func() error {
+		var down []string
+		for _, status := range FallbackStatuses() {
+			if !status.Healthy {
+				down = append(down, status.Address)
+			}
+		}
+		if len(down) != 0 {
+			return common.NewError("fallback " + strings.Join(down, ", ") + " is unreachable")
+		}
+		return nil
+	})
+}
+
+// FallbackStatus is the health of a fallback address
+type FallbackStatus struct {
+	Address string
+	Healthy bool
+	Checked time.Time // 最近一次检查的时间
+	Error   string    // 最近一次检查失败的原因
+}
+
+// FallbackStatuses returns the health of the fallback addresses watched by the running servers, sorted by the address
+func FallbackStatuses() []FallbackStatus {
+	fallbacksLock.Lock()
+	defer fallbacksLock.Unlock()
+	result := make([]FallbackStatus, 0, len(fallbacks))
+	for _, state := range fallbacks {
+		status := FallbackStatus{
+			Address: state.address,
+			Healthy: state.healthy,
+			Checked: state.checked,
+		}
+		if state.err != nil {
+			status.Error = state.err.Error()
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
+
+func acquireFallback(address string) *fallbackState {
+	fallbacksLock.Lock()
+	defer fallbacksLock.Unlock()
+	state, found := fallbacks[address]
+	if !found {
+		state = &fallbackState{
+			address: address,
+			healthy: true,
+		}
+		fallbacks[address] = state
+	}
+	state.refs++
+	return state
+}
+
+func releaseFallback(state *fallbackState) {
+	fallbacksLock.Lock()
+	defer fallbacksLock.Unlock()
+	state.refs--
+	if state.refs == 0 && fallbacks[state.address] == state {
+		delete(fallbacks, state.address)
+	}
+}
+
+// update records the result of a check or a redirection, the changes of the health are logged
+func (s *fallbackState) update(err error) {
+	fallbacksLock.Lock()
+	defer fallbacksLock.Unlock()
+	healthy := err == nil
+	if healthy && !s.healthy {
+		log.Info("fallback", s.address, "is reachable again")
+	} else if !healthy && s.healthy {
+		log.Error(common.NewError("fallback " + s.address + " is unreachable").Base(err))
+	}
+	s.healthy = healthy
+	s.err = err
+	s.checked = time.Now()
+}
+
+func checkFallback(address string) error {
+	conn, err := net.DialTimeout("tcp", address, time.Second*5)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// Watch checks the fallback address and keeps checking it in the background until the redirector is closed.
+// An error is returned if it is unreachable and the servers are configured to fail in this case
+func (r *Redirector) Watch(addr net.Addr) error {
+	address := addr.String()
+	err := checkFallback(address)
+	if err != nil && r.onDown == fallbackFail {
+		return err
+	}
+	r.watchLock.Lock()
+	defer r.watchLock.Unlock()
+	if r.watched == nil { // 已经关闭
+		return nil
+	}
+	if _, found := r.watched[address]; found {
+		return nil
+	}
+	state := acquireFallback(address)
+	state.update(err) // 不可达时输出日志，在后台继续检查
+	if len(r.watched) == 0 {
+		go r.watchLoop()
+	}
+	r.watched[address] = state
+	return nil
+}
+
+func (r *Redirector) watchLoop() {
+	ticker := time.NewTicker(r.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			r.watchLock.Lock()
+			for _, state := range r.watched {
+				releaseFallback(state)
+			}
+			r.watched = nil
+			r.watchLock.Unlock()
+			return
+		}
+		r.watchLock.Lock()
+		states := make([]*fallbackState, 0, len(r.watched))
+		for _, state := range r.watched {
+			states = append(states, state)
+		}
+		r.watchLock.Unlock()
+		for _, state := range states {
+			state.update(checkFallback(state.address))
+		}
+	}
+}
+
+// fallbackOf returns the state of the watched fallback address, or nil if it is not watched
+func (r *Redirector) fallbackOf(addr net.Addr) *fallbackState {
+	r.watchLock.Lock()
+	defer r.watchLock.Unlock()
+	return r.watched[addr.String()]
+}
+
+// serveStatic sends the static response to the connection redirected to an unreachable fallback
+func (r *Redirector) serveStatic(conn net.Conn) {
+	// 先读取客户端的请求，避免关闭时丢弃未读的数据导致 RST
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	conn.Write(r.response)
+}
@@ -0,0 +1,45 @@
+package redirector
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// Normalizer delays the rejections of the probes to a random deadline measured from the accept of the connection,
+// so that an active prober can not tell at which stage the connection is rejected by the timing.
+// A nil Normalizer does not delay
+type Normalizer struct {
+	min time.Duration
+	max time.Duration
+}
+
+// duration returns a random duration in [min, max]
+func (n *Normalizer) duration() time.Duration {
+	if n.max <= n.min {
+		return n.min
+	}
+	return n.min + time.Duration(rand.Int63n(int64(n.max-n.min)+1))
+}
+
+// Delay blocks until a random time in [min, max] has passed since the connection was accepted,
+// the time spent in the earlier stages is not added to the delay
+func (n *Normalizer) Delay(accepted time.Time) {
+	if n == nil {
+		return
+	}
+	if d := time.Until(accepted.Add(n.duration())); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func NewNormalizer(min, max time.Duration) (*Normalizer, error) {
+	if min < 0 || max < min {
+		return nil, common.NewError("invalid probe resistance delay range")
+	}
+	return &Normalizer{
+		min: min,
+		max: max,
+	}, nil
+}
@@ -3,10 +3,15 @@ package redirector
 import (
 	"context"
 	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
+	"sync"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/overload"
+	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
 )
 
@@ -25,6 +30,13 @@ type Redirection struct {
 type Redirector struct {
 	ctx             context.Context
 	redirectionChan chan *Redirection
+	proxyProtocol   int    // 向回落地址发送的 PROXY 协议头部版本，0 表示不发送
+	onDown          string // 回落地址不可达时的处理方式
+	response        []byte // 回落地址不可达时返回的静态响应
+	checkInterval   time.Duration
+	limiter         *overload.Limiter         // 过载时不再回落，为空时不限制
+	watched         map[string]*fallbackState // 回落地址 -> 健康状态
+	watchLock       sync.Mutex
 }
 
 func (r *Redirector) Redirect(redirection *Redirection) {
@@ -46,6 +58,9 @@ func (r *Redirector) worker() {
 					return
 				}
 				defer redirection.InboundConn.Close()
+				if !r.limiter.AdmitFallback() {
+					return
+				}
 				if redirection.RedirectTo == nil || reflect.ValueOf(redirection.RedirectTo).IsNil() {
 					log.Error("nil redirection addr")
 					return
@@ -55,11 +70,26 @@ func (r *Redirector) worker() {
 				}
 				log.Warn("redirecting connection from", redirection.InboundConn.RemoteAddr(), "to", redirection.RedirectTo.String())
 				outboundConn, err := redirection.Dial(redirection.RedirectTo)
+				state := r.fallbackOf(redirection.RedirectTo)
+				if state != nil {
+					state.update(err)
+				}
 				if err != nil {
 					log.Error(common.NewError("failed to redirect to target address").Base(err))
+					if r.onDown == fallbackStatic {
+						r.serveStatic(redirection.InboundConn)
+					}
 					return
 				}
 				defer outboundConn.Close()
+				if r.proxyProtocol != 0 {
+					// 使回落网站看到客户端的真实地址
+					err := common.WriteProxyHeader(outboundConn, r.proxyProtocol, redirection.InboundConn.RemoteAddr(), redirection.InboundConn.LocalAddr())
+					if err != nil {
+						log.Error(common.NewError("failed to send proxy protocol header").Base(err))
+						return
+					}
+				}
 				errChan := make(chan error, 2)
 				copyConn := func(a, b net.Conn) {
 					_, err := io.Copy(a, b)
@@ -90,6 +120,26 @@ func NewRedirector(ctx context.Context) *Redirector {
 	r := &Redirector{
 		ctx:             ctx,
 		redirectionChan: make(chan *Redirection, 64),
+		onDown:          fallbackFail,
+		response:        staticResponse,
+		checkInterval:   time.Second * 10,
+		watched:         make(map[string]*fallbackState),
+		limiter:         overload.LimiterFromContext(ctx),
+	}
+	if cfg, ok := config.FromContext(ctx, Name).(*Config); ok {
+		r.proxyProtocol = cfg.ProxyProtocol.Fallback
+		r.onDown = cfg.Fallback.OnDown
+		if cfg.Fallback.CheckInterval > 0 {
+			r.checkInterval = time.Duration(cfg.Fallback.CheckInterval) * time.Second
+		}
+		if cfg.Fallback.Response != "" {
+			response, err := ioutil.ReadFile(cfg.Fallback.Response)
+			if err != nil {
+				log.Error(common.NewError("failed to read fallback response, using the built-in one").Base(err))
+			} else {
+				r.response = response
+			}
+		}
 	}
 	go r.worker()
 	return r
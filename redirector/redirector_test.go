@@ -1,15 +1,22 @@
 package redirector
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/test/util"
 )
 
@@ -65,3 +72,287 @@ func TestRedirector(t *testing.T) {
 	conn1.Close()
 	conn2.Close()
 }
+
+func TestTarpit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tarpit := NewTarpit(ctx, 1, time.Millisecond*10, time.Millisecond*200)
+
+	conn1, probe1 := net.Pipe()
+	if !tarpit.Hold(conn1) {
+		t.Fatal("failed to hold the connection")
+	}
+	conn2, probe2 := net.Pipe()
+	if tarpit.Hold(conn2) {
+		t.Fatal("max connections exceeded")
+	}
+	conn2.Close()
+	probe2.Close()
+
+	buf := [64]byte{}
+	start := time.Now()
+	received := 0
+	for received < 17 {
+		n, err := probe1.Read(buf[received:])
+		common.Must(err)
+		received += n
+	}
+	if string(buf[:17]) != "HTTP/1.1 200 OK\r\n" {
+		t.Fatal("wrong response", string(buf[:17]))
+	}
+	if time.Since(start) < time.Millisecond*100 {
+		t.Fatal("bytes are not drip-fed")
+	}
+	// 超过拖延时间后连接被关闭
+	for {
+		if _, err := probe1.Read(buf[:]); err != nil {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond * 10)
+	if tarpit.Holding() != 0 {
+		t.Fatal("connection not released")
+	}
+}
+
+func TestNormalizer(t *testing.T) {
+	if _, err := NewNormalizer(time.Millisecond*10, time.Millisecond); err == nil {
+		t.Fatal("invalid delay range")
+	}
+	var nilNormalizer *Normalizer
+	nilNormalizer.Delay(time.Now())
+
+	n, err := NewNormalizer(time.Millisecond*20, time.Millisecond*40)
+	common.Must(err)
+	for i := 0; i < 100; i++ {
+		if d := n.duration(); d < time.Millisecond*20 || d > time.Millisecond*40 {
+			t.Fatal("delay out of range", d)
+		}
+	}
+	start := time.Now()
+	n.Delay(start)
+	if time.Since(start) < time.Millisecond*20 {
+		t.Fatal("not delayed")
+	}
+	// 之前阶段花费的时间计入延迟，拒绝的时间与阶段无关
+	start = time.Now()
+	n.Delay(start.Add(-time.Millisecond * 30))
+	if d := time.Since(start); d >= time.Millisecond*20 {
+		t.Fatal("delay is not measured from accept", d)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	common.Must(err)
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := NewRecorder(ctx, "tls", dir, 0, 2); err == nil {
+		t.Fatal("invalid max bytes")
+	}
+	r, err := NewRecorder(ctx, "tls", dir, 8, 2)
+	common.Must(err)
+	var nilRecorder *Recorder
+	nilRecorder.Record("tls", nil, nil, nil)
+	nilRecorder.RecordDecrypted("trojan", nil, nil)
+
+	read := func(r *Recorder, i int) string {
+		for j := 0; j < 100; j++ {
+			data, err := ioutil.ReadFile(filepath.Join(dir, r.fileName(i)))
+			if err == nil && len(data) != 0 {
+				return string(data)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatal("record not written", i)
+		return ""
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	r.Record("tls", addr, []byte("GET / HTTP/1.1\r\n\x1b[2J"), errors.New("bad\x1b"))
+	record := read(r, 0)
+	if !strings.Contains(record, "stage: tls") || !strings.Contains(record, "from: 127.0.0.1:1234") ||
+		!strings.Contains(record, "length: 20 (truncated to 8)") || !strings.Contains(record, "|GET / HT|") {
+		t.Fatal("wrong record", record)
+	}
+	if strings.Contains(record, "\x1b") {
+		t.Fatal("record is not sanitized", record)
+	}
+
+	// the ring is overwritten from the oldest record
+	r.Record("tls", addr, []byte("second"), nil)
+	r.Record("tls", addr, []byte("third"), nil)
+	for i := 0; !strings.Contains(read(r, 0), "third"); i++ {
+		if i == 100 {
+			t.Fatal("oldest record is not overwritten")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, err := os.Stat(filepath.Join(dir, r.fileName(2))); err == nil {
+		t.Fatal("too many records")
+	}
+
+	// 解密后的数据只记录长度和 http 头部的名称
+	r2, err := NewRecorder(ctx, "trojan", dir, 512, 2)
+	common.Must(err)
+	r2.RecordDecrypted("trojan", addr, []byte("GET /login?token=secret HTTP/1.1\r\nHost: example.com\r\nCookie: session=secret\r\n\r\n"))
+	record = read(r2, 0)
+	if strings.Contains(record, "secret") || !strings.Contains(record, "Cookie: <redacted>") ||
+		!strings.Contains(record, "GET /login?<redacted> HTTP/1.1") {
+		t.Fatal("decrypted record is not redacted", record)
+	}
+	r2.RecordDecrypted("trojan", addr, []byte(common.SHA224String("password")+"\r\n"))
+	record = read(r2, 1)
+	if strings.Contains(record, common.SHA224String("password")) || !strings.Contains(record, "length: 58") {
+		t.Fatal("decrypted record is not redacted", record)
+	}
+
+	// 超出速率的记录被丢弃
+	dropped := droppedRecords.Value()
+	for i := 0; i < recordsPerSecond*2; i++ {
+		r.Record("tls", addr, nil, nil)
+	}
+	if droppedRecords.Value() == dropped {
+		t.Fatal("records are not rate limited")
+	}
+}
+
+func TestRedirectorProxyProtocol(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = config.WithConfig(ctx, Name, &Config{
+		ProxyProtocol: ProxyProtocolConfig{
+			Fallback: 2,
+		},
+	})
+	redir := NewRedirector(ctx)
+
+	fallback, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer fallback.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer l.Close()
+	conn1, err := net.Dial("tcp", l.Addr().String())
+	common.Must(err)
+	defer conn1.Close()
+	conn2, err := l.Accept()
+	common.Must(err)
+	redir.Redirect(&Redirection{
+		RedirectTo:  fallback.Addr(),
+		InboundConn: conn2,
+	})
+	conn3, err := fallback.Accept()
+	common.Must(err)
+	defer conn3.Close()
+	conn1.Write([]byte("hello"))
+
+	src := conn1.LocalAddr().(*net.TCPAddr)
+	dst := l.Addr().(*net.TCPAddr)
+	expected := append([]byte(nil), common.ProxyV2Signature...)
+	expected = append(expected, 0x21, 0x11, 0, 12)
+	expected = append(expected, src.IP.To4()...)
+	expected = append(expected, dst.IP.To4()...)
+	expected = append(expected, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	expected = append(expected, []byte("hello")...)
+	buf := make([]byte, len(expected))
+	conn3.SetReadDeadline(time.Now().Add(time.Second * 3))
+	_, err = io.ReadFull(conn3, buf)
+	common.Must(err)
+	if !bytes.Equal(buf, expected) {
+		t.Fatal("unexpected header", buf)
+	}
+}
+
+func TestFallbackDown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := common.PickPort("tcp", "127.0.0.1")
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	common.Must(err)
+
+	failing := NewRedirector(config.WithConfig(ctx, Name, &Config{
+		Fallback: FallbackConfig{
+			OnDown:        fallbackFail,
+			CheckInterval: 1,
+		},
+	}))
+	if err := failing.Watch(addr); err == nil {
+		t.Fatal("unreachable fallback is accepted")
+	}
+
+	redir := NewRedirector(config.WithConfig(ctx, Name, &Config{
+		Fallback: FallbackConfig{
+			OnDown:        fallbackStatic,
+			CheckInterval: 1,
+		},
+	}))
+	common.Must(redir.Watch(addr))
+	statuses := FallbackStatuses()
+	if len(statuses) != 1 || statuses[0].Address != addr.String() || statuses[0].Healthy || statuses[0].Error == "" {
+		t.Fatal("wrong fallback status", statuses)
+	}
+
+	// 不可达时返回静态响应
+	conn, probe := net.Pipe()
+	redir.Redirect(&Redirection{
+		RedirectTo:  addr,
+		InboundConn: conn,
+	})
+	go probe.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	resp, err := ioutil.ReadAll(probe)
+	common.Must(err)
+	if !bytes.HasPrefix(resp, []byte("HTTP/1.1 503 ")) {
+		t.Fatal("unexpected response", string(resp))
+	}
+
+	// 回落地址恢复后在后台检查中变为可达
+	l, err := net.Listen("tcp", addr.String())
+	common.Must(err)
+	defer l.Close()
+	deadline := time.Now().Add(time.Second * 5)
+	for !FallbackStatuses()[0].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("fallback is still unhealthy")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	cancel()
+	time.Sleep(time.Millisecond * 100)
+	if len(FallbackStatuses()) != 0 {
+		t.Fatal("fallback is still watched after the redirector is closed")
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	f := NewReplayFilter(time.Minute, 2)
+	now := time.Now()
+	random := bytes.Repeat([]byte{1}, 32)
+	if f.Check(random, now) {
+		t.Fatal("first handshake is a replay")
+	}
+	replayed := replayedHandshakes.Value()
+	if !f.Check(random, now) || replayedHandshakes.Value() != replayed+1 {
+		t.Fatal("replay is not detected")
+	}
+	if f.Check(bytes.Repeat([]byte{2}, 32), now) {
+		t.Fatal("different handshake is a replay")
+	}
+	var nilFilter *ReplayFilter
+	if f.Check(nil, now) || f.Check(nil, now) || nilFilter.Check(random, now) {
+		t.Fatal("empty handshake is checked")
+	}
+
+	// 超出窗口或数量的记录被淘汰
+	if f.Check(random, now.Add(time.Minute*2)) {
+		t.Fatal("expired handshake is a replay")
+	}
+	f.Check([]byte("a"), now.Add(time.Minute*2))
+	f.Check([]byte("b"), now.Add(time.Minute*2))
+	if f.Check(random, now.Add(time.Minute*2)) {
+		t.Fatal("evicted handshake is a replay")
+	}
+}
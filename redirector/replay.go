@@ -0,0 +1,59 @@
+package redirector
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/metrics"
+)
+
+var replayedHandshakes = metrics.NewCounter("trojan_go_replayed_handshakes_total", "Number of the handshakes rejected as replays.")
+
+type replayEntry struct {
+	key  [sha256.Size]byte
+	seen time.Time
+}
+
+// ReplayFilter remembers the digests of the first bytes of the recent handshakes, e.g. the tls client hello.
+// A handshake with the same digest as a remembered one is a replay of the recorded bytes sent by an active prober.
+// A nil ReplayFilter detects nothing
+type ReplayFilter struct {
+	sync.Mutex
+	window  time.Duration
+	size    int
+	seen    map[[sha256.Size]byte]struct{}
+	entries []replayEntry // 按时间排列，用于淘汰过期的记录
+}
+
+// Check records the digest of the data and reports whether it has been seen in the window
+func (f *ReplayFilter) Check(data []byte, now time.Time) bool {
+	if f == nil || len(data) == 0 {
+		return false
+	}
+	key := sha256.Sum256(data)
+
+	f.Lock()
+	defer f.Unlock()
+	i := 0
+	for i < len(f.entries) && (now.Sub(f.entries[i].seen) > f.window || len(f.entries)-i >= f.size) {
+		delete(f.seen, f.entries[i].key)
+		i++
+	}
+	f.entries = f.entries[i:]
+	if _, found := f.seen[key]; found {
+		replayedHandshakes.Inc()
+		return true
+	}
+	f.seen[key] = struct{}{}
+	f.entries = append(f.entries, replayEntry{key: key, seen: now})
+	return false
+}
+
+func NewReplayFilter(window time.Duration, size int) *ReplayFilter {
+	return &ReplayFilter{
+		window: window,
+		size:   size,
+		seen:   make(map[[sha256.Size]byte]struct{}),
+	}
+}
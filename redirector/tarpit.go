@@ -0,0 +1,96 @@
+package redirector
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+const tarpitCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-"
+
+// Tarpit holds the connections of the probes open and drip-feeds them with bytes
+// which look like an endless HTTP response header, to slow down the scanners
+type Tarpit struct {
+	ctx      context.Context
+	sem      chan struct{} // 限制同时被拖住的连接数量
+	interval time.Duration // 两次写入之间的间隔
+	duration time.Duration // 单个连接最长的拖延时间
+}
+
+// headerLine generates a random HTTP header line
+func headerLine() []byte {
+	line := make([]byte, 0, 64)
+	for i := rand.Intn(8) + 4; i > 0; i-- {
+		line = append(line, tarpitCharset[rand.Intn(len(tarpitCharset))])
+	}
+	line = append(line, ':', ' ')
+	for i := rand.Intn(32) + 8; i > 0; i-- {
+		line = append(line, tarpitCharset[rand.Intn(len(tarpitCharset))])
+	}
+	return append(line, '\r', '\n')
+}
+
+func (t *Tarpit) hold(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		<-t.sem
+	}()
+	timer := time.NewTimer(t.duration)
+	defer timer.Stop()
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	data := []byte("HTTP/1.1 200 OK\r\n")
+	start := time.Now()
+	sent := 0
+	for {
+		if len(data) == 0 {
+			data = headerLine()
+		}
+		conn.SetWriteDeadline(time.Now().Add(t.interval * 4))
+		if _, err := conn.Write(data[:1]); err != nil {
+			break
+		}
+		data = data[1:]
+		sent++
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			log.Debug("tarpit released", conn.RemoteAddr(), "after", time.Since(start), "bytes sent:", sent)
+			return
+		case <-t.ctx.Done():
+			return
+		}
+	}
+	log.Debug("tarpitted connection from", conn.RemoteAddr(), "closed after", time.Since(start), "bytes sent:", sent)
+}
+
+// Hold takes over the connection, it returns false if too many connections are being held,
+// in which case the connection is left for the caller
+func (t *Tarpit) Hold(conn net.Conn) bool {
+	select {
+	case t.sem <- struct{}{}:
+	default:
+		return false
+	}
+	log.Debug("tarpitting connection from", conn.RemoteAddr())
+	go t.hold(conn)
+	return true
+}
+
+// Holding returns the number of connections being held
+func (t *Tarpit) Holding() int {
+	return len(t.sem)
+}
+
+func NewTarpit(ctx context.Context, maxConns int, interval, duration time.Duration) *Tarpit {
+	return &Tarpit{
+		ctx:      ctx,
+		sem:      make(chan struct{}, maxConns),
+		interval: interval,
+		duration: duration,
+	}
+}
@@ -0,0 +1,78 @@
+package statistic
+
+import (
+	"context"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// 流量统计的口径
+const (
+	AccountingWire    = "wire"    // TCP 连接上的字节，包括 TLS、websocket、trojan 和 mux 的开销
+	AccountingPayload = "payload" // 应用层的数据，即 mux 解复用之后转发的字节
+)
+
+// AccountingMeter is implemented by the users which keep the wire and payload traffic separately
+type AccountingMeter interface {
+	AddWire(sent, recv int)
+	AddPayload(sent, recv int)
+	GetWire() (sent, recv uint64)
+	GetPayload() (sent, recv uint64)
+}
+
+// Accounting counts the wire and payload traffic of the users separately. The traffic of the quota metric
+// is also added as the user traffic, which the quota, speed limit and monthly usage apply to
+type Accounting struct {
+	quota string
+}
+
+// NewAccounting creates the accounting, quota is the metric of the user traffic
+func NewAccounting(quota string) (*Accounting, error) {
+	switch quota {
+	case AccountingWire, AccountingPayload:
+	default:
+		return nil, common.NewError("invalid accounting quota metric: " + quota)
+	}
+	return &Accounting{
+		quota: quota,
+	}, nil
+}
+
+// AddWire records the bytes on the connection of the user
+func (a *Accounting) AddWire(user User, sent, recv int) {
+	if sent == 0 && recv == 0 {
+		return
+	}
+	if m, ok := user.(AccountingMeter); ok {
+		m.AddWire(sent, recv)
+	}
+	if a.quota == AccountingWire {
+		user.AddTraffic(sent, recv)
+	}
+}
+
+// AddPayload records the application data relayed for the user
+func (a *Accounting) AddPayload(user User, sent, recv int) {
+	if sent == 0 && recv == 0 {
+		return
+	}
+	if m, ok := user.(AccountingMeter); ok {
+		m.AddPayload(sent, recv)
+	}
+	if a.quota == AccountingPayload {
+		user.AddTraffic(sent, recv)
+	}
+}
+
+type accountingKey struct{}
+
+// WithAccounting stores the accounting into the context, the tunnels and the proxy count the traffic with it
+func WithAccounting(ctx context.Context, a *Accounting) context.Context {
+	return context.WithValue(ctx, accountingKey{}, a)
+}
+
+// AccountingFromContext extracts the accounting from a context, it returns nil if the accounting is disabled
+func AccountingFromContext(ctx context.Context) *Accounting {
+	a, _ := ctx.Value(accountingKey{}).(*Accounting)
+	return a
+}
@@ -1,11 +1,100 @@
 package memory
 
 import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
 )
 
+type SpeedLimitConfig struct {
+	UploadSpeed   int `json:"upload_speed" yaml:"upload-speed"`
+	DownloadSpeed int `json:"download_speed" yaml:"download-speed"`
+}
+
+// GroupEgressConfig is the outbound destination policy shared by the members of a group
+type GroupEgressConfig struct {
+	DefaultPolicy string   `json:"default_policy" yaml:"default-policy"`
+	BlockPrivate  *bool    `json:"block_private" yaml:"block-private"`
+	Allow         []string `json:"allow" yaml:"allow"`
+	Deny          []string `json:"deny" yaml:"deny"`
+}
+
+// GroupConfig 用户组，组内成员继承组的限速、流量配额和出站策略
+type GroupConfig struct {
+	Name         string             `json:"name" yaml:"name"`
+	Passwords    []string           `json:"password" yaml:"password"`
+	Hashes       []string           `json:"password_hash" yaml:"password-hash"` // 密码的 SHA224 十六进制值
+	SpeedLimit   SpeedLimitConfig   `json:"speed_limit" yaml:"speed-limit"`
+	IPLimit      int                `json:"ip_limit" yaml:"ip-limit"`
+	Quota        uint64             `json:"quota" yaml:"quota"`                 // 流量配额(字节)，0 表示不限制
+	MonthlyLimit uint64             `json:"monthly_limit" yaml:"monthly-limit"` // 覆盖 usage 的每月流量额度
+	Egress       *GroupEgressConfig `json:"egress" yaml:"egress"`
+}
+
 type Config struct {
-	Passwords []string `json:"password" yaml:"password"`
+	Passwords []string      `json:"password" yaml:"password"`
+	Hashes    []string      `json:"password_hash" yaml:"password-hash"` // 密码的 SHA224 十六进制值，配置文件中不必保存明文密码
+	Groups    []GroupConfig `json:"groups" yaml:"groups"`
+}
+
+// userHashes returns the hashes of the passwords followed by the password hashes
+func userHashes(passwords, hashes []string) []string {
+	result := make([]string, 0, len(passwords)+len(hashes))
+	for _, password := range passwords {
+		result = append(result, common.SHA224String(password))
+	}
+	for _, hash := range hashes {
+		result = append(result, strings.ToLower(hash))
+	}
+	return result
+}
+
+// UserHashes returns the hashes of the members of the group
+func (g *GroupConfig) UserHashes() []string {
+	return userHashes(g.Passwords, g.Hashes)
+}
+
+// UserHashes returns the hashes of the users listed outside the groups
+func (c *Config) UserHashes() []string {
+	return userHashes(c.Passwords, c.Hashes)
+}
+
+// validHash reports whether s is a hex encoded SHA224 hash
+func validHash(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 28
+}
+
+func (c *Config) Validate() error {
+	var errs config.Errors
+	for i, hash := range c.Hashes {
+		if !validHash(hash) {
+			errs.Add("password_hash["+strconv.Itoa(i)+"]", "must be a SHA224 hash in hex")
+		}
+	}
+	for i, group := range c.Groups {
+		for j, hash := range group.Hashes {
+			if !validHash(hash) {
+				errs.Add("groups["+strconv.Itoa(i)+"].password_hash["+strconv.Itoa(j)+"]", "must be a SHA224 hash in hex")
+			}
+		}
+	}
+	return errs.Err()
+}
+
+// MemberHashes returns the password hashes of the members of the group, false if the group is not found
+func (c *Config) MemberHashes(group string) ([]string, bool) {
+	for i := range c.Groups {
+		g := &c.Groups[i]
+		if g.Name != group {
+			continue
+		}
+		return g.UserHashes(), true
+	}
+	return nil, false
 }
 
 // 模块加载时自动执行
@@ -2,6 +2,7 @@ package memory
 
 import (
 	"context"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,37 +17,132 @@ import (
 
 const Name = "MEMORY"
 
+// trafficCounter is a generation of the traffic counters of a user
+type trafficCounter struct {
+	sent uint64
+	recv uint64
+}
+
+// trafficEpoch splits the traffic counters of the users of an authenticator into two generations.
+// A snapshot flips the generation and waits for the writers of the previous one, which only add two
+// counters, so that the traffic of all users is read at the same point without blocking the relays
+type trafficEpoch struct {
+	current uint32
+	writers [2]int32
+}
+
+// enter returns the generation to write, leave must be called after writing
+func (e *trafficEpoch) enter() uint32 {
+	for {
+		i := atomic.LoadUint32(&e.current)
+		atomic.AddInt32(&e.writers[i], 1)
+		if atomic.LoadUint32(&e.current) == i {
+			return i
+		}
+		// 已经切换，写入新的一代
+		atomic.AddInt32(&e.writers[i], -1)
+	}
+}
+
+func (e *trafficEpoch) leave(i uint32) {
+	atomic.AddInt32(&e.writers[i], -1)
+}
+
+// flip makes the writers use the other generation, and returns the previous one after its writers left
+func (e *trafficEpoch) flip() uint32 {
+	prev := atomic.LoadUint32(&e.current)
+	atomic.StoreUint32(&e.current, prev^1)
+	for atomic.LoadInt32(&e.writers[prev]) != 0 {
+		runtime.Gosched()
+	}
+	return prev
+}
+
 type User struct {
 	// WARNING: do not change the order of these fields.
 	// 64-bit fields that use `sync/atomic` package functions
 	// must be 64-bit aligned on 32-bit systems.
 	// Reference: https://github.com/golang/go/issues/599
 	// Solution: https://github.com/golang/go/issues/11891#issuecomment-433623786
-	sent      uint64
-	recv      uint64
+	traffic   [2]trafficCounter // 两代流量计数，由 epoch 切换
 	lastSent  uint64
 	lastRecv  uint64
 	sendSpeed uint64
 	recvSpeed uint64
+	quota     uint64 // 流量配额，0 表示不限制
+	wireSent  uint64 // 开启 accounting 时 TCP 连接上的字节
+	wireRecv  uint64
+	dataSent  uint64 // 开启 accounting 时应用层的数据
+	dataRecv  uint64
 
 	hash        string
+	group       string // 由 limiterLock 保护，重载配置时可能改变
+	static      bool   // 来自配置文件的用户，重载配置时被移除
 	ipTable     sync.Map
 	ipNum       int32
 	maxIPNum    int
 	limiterLock sync.RWMutex
 	sendLimiter *rate.Limiter
 	recvLimiter *rate.Limiter
+	usage       *statistic.UsageTracker // 为空时不按月统计
 	ctx         context.Context
 	cancel      context.CancelFunc
+	next        atomic.Value // 切换认证模块后替换此用户的 *User
+	epoch       *trafficEpoch
+}
+
+// successor returns the user replacing u after a swap of the authenticator, or nil
+func (u *User) successor() *User {
+	next, _ := u.next.Load().(*User)
+	return next
+}
+
+// Succeed takes over the traffic and the online ips of prev, which forwards its meters to u from now on,
+// so that the connections established before a swap are still counted and limited
+func (u *User) Succeed(prev statistic.User) bool {
+	p, ok := prev.(*User)
+	if !ok || p == u {
+		return false
+	}
+	p.next.Store(u)
+	// 之后计入 p 的流量由 p 自己转移，这里转移之前的
+	p.drain(u)
+	// 在线的 IP 不受新用户的限制，避免断开已有的连接
+	p.ipTable.Range(func(ip, _ interface{}) bool {
+		if _, loaded := u.ipTable.LoadOrStore(ip, true); !loaded {
+			atomic.AddInt32(&u.ipNum, 1)
+		}
+		return true
+	})
+	return true
+}
+
+// drain moves the traffic counted by u to next
+func (u *User) drain(next *User) {
+	var sent, recv uint64
+	for i := range u.traffic {
+		sent += atomic.SwapUint64(&u.traffic[i].sent, 0)
+		recv += atomic.SwapUint64(&u.traffic[i].recv, 0)
+	}
+	next.addTraffic(sent, recv)
+	atomic.AddUint64(&next.wireSent, atomic.SwapUint64(&u.wireSent, 0))
+	atomic.AddUint64(&next.wireRecv, atomic.SwapUint64(&u.wireRecv, 0))
+	atomic.AddUint64(&next.dataSent, atomic.SwapUint64(&u.dataSent, 0))
+	atomic.AddUint64(&next.dataRecv, atomic.SwapUint64(&u.dataRecv, 0))
 }
 
 func (u *User) Close() error {
-	u.ResetTraffic()
+	if u.successor() == nil { // 已经转移的流量不能清零
+		u.ResetTraffic()
+	}
 	u.cancel()
 	return nil
 }
 
 func (u *User) AddIP(ip string) bool {
+	if next := u.successor(); next != nil {
+		return next.AddIP(ip)
+	}
 	if u.maxIPNum <= 0 {
 		return true
 	}
@@ -63,6 +159,9 @@ func (u *User) AddIP(ip string) bool {
 }
 
 func (u *User) DelIP(ip string) bool {
+	if next := u.successor(); next != nil {
+		return next.DelIP(ip)
+	}
 	if u.maxIPNum <= 0 {
 		return true
 	}
@@ -87,17 +186,47 @@ func (u *User) GetIPLimit() int {
 	return u.maxIPNum
 }
 
+// addTraffic adds the traffic to the current generation of the counters
+func (u *User) addTraffic(sent, recv uint64) {
+	i := u.epoch.enter()
+	atomic.AddUint64(&u.traffic[i].sent, sent)
+	atomic.AddUint64(&u.traffic[i].recv, recv)
+	u.epoch.leave(i)
+}
+
+// AddTraffic only counts the traffic, the speed limit is enforced by WaitSent and WaitRecv
 func (u *User) AddTraffic(sent, recv int) {
-	u.limiterLock.RLock()
-	defer u.limiterLock.RUnlock()
+	u.addTraffic(uint64(sent), uint64(recv))
+	if u.usage != nil {
+		u.usage.Add(u.hash, uint64(sent), uint64(recv))
+	}
+	if next := u.successor(); next != nil {
+		u.drain(next)
+	}
+}
+
+func (u *User) AddWire(sent, recv int) {
+	atomic.AddUint64(&u.wireSent, uint64(sent))
+	atomic.AddUint64(&u.wireRecv, uint64(recv))
+	if next := u.successor(); next != nil {
+		u.drain(next)
+	}
+}
 
-	if u.sendLimiter != nil && sent >= 0 {
-		u.sendLimiter.WaitN(u.ctx, sent)
-	} else if u.recvLimiter != nil && recv >= 0 {
-		u.recvLimiter.WaitN(u.ctx, recv)
+func (u *User) AddPayload(sent, recv int) {
+	atomic.AddUint64(&u.dataSent, uint64(sent))
+	atomic.AddUint64(&u.dataRecv, uint64(recv))
+	if next := u.successor(); next != nil {
+		u.drain(next)
 	}
-	atomic.AddUint64(&u.sent, uint64(sent))
-	atomic.AddUint64(&u.recv, uint64(recv))
+}
+
+func (u *User) GetWire() (uint64, uint64) {
+	return atomic.LoadUint64(&u.wireSent), atomic.LoadUint64(&u.wireRecv)
+}
+
+func (u *User) GetPayload() (uint64, uint64) {
+	return atomic.LoadUint64(&u.dataSent), atomic.LoadUint64(&u.dataRecv)
 }
 
 func (u *User) SetSpeedLimit(send, recv int) {
@@ -116,6 +245,48 @@ func (u *User) SetSpeedLimit(send, recv int) {
 	}
 }
 
+// waitN takes n tokens from the bucket, the requests larger than the burst are split
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) {
+	for n > 0 {
+		chunk := n
+		if burst := limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if limiter.WaitN(ctx, chunk) != nil { // 用户被删除
+			return
+		}
+		n -= chunk
+	}
+}
+
+// WaitSent blocks until the send speed limit allows n bytes. 等待时不持有锁，限速可以随时修改
+func (u *User) WaitSent(n int) {
+	if next := u.successor(); next != nil {
+		next.WaitSent(n)
+		return
+	}
+	u.limiterLock.RLock()
+	limiter := u.sendLimiter
+	u.limiterLock.RUnlock()
+	if limiter != nil {
+		waitN(u.ctx, limiter, n)
+	}
+}
+
+// WaitRecv blocks until the receive speed limit allows n bytes
+func (u *User) WaitRecv(n int) {
+	if next := u.successor(); next != nil {
+		next.WaitRecv(n)
+		return
+	}
+	u.limiterLock.RLock()
+	limiter := u.recvLimiter
+	u.limiterLock.RUnlock()
+	if limiter != nil {
+		waitN(u.ctx, limiter, n)
+	}
+}
+
 func (u *User) GetSpeedLimit() (send, recv int) {
 	u.limiterLock.RLock()
 	defer u.limiterLock.RUnlock()
@@ -133,18 +304,55 @@ func (u *User) Hash() string {
 	return u.hash
 }
 
+// Group returns the name of the group which the user belongs to
+func (u *User) Group() string {
+	u.limiterLock.RLock()
+	defer u.limiterLock.RUnlock()
+	return u.group
+}
+
+func (u *User) setGroup(group string) {
+	u.limiterLock.Lock()
+	defer u.limiterLock.Unlock()
+	u.group = group
+}
+
+func (u *User) SetQuota(quota uint64) {
+	atomic.StoreUint64(&u.quota, quota)
+}
+
+func (u *User) GetQuota() uint64 {
+	return atomic.LoadUint64(&u.quota)
+}
+
+// QuotaExceeded reports whether the total traffic of the user has reached the quota
+func (u *User) QuotaExceeded() bool {
+	quota := u.GetQuota()
+	if quota == 0 {
+		return false
+	}
+	sent, recv := u.GetTraffic()
+	return sent+recv >= quota
+}
+
 func (u *User) SetTraffic(send, recv uint64) {
-	atomic.StoreUint64(&u.sent, send)
-	atomic.StoreUint64(&u.recv, recv)
+	atomic.StoreUint64(&u.traffic[1].sent, 0)
+	atomic.StoreUint64(&u.traffic[1].recv, 0)
+	atomic.StoreUint64(&u.traffic[0].sent, send)
+	atomic.StoreUint64(&u.traffic[0].recv, recv)
 }
 
 func (u *User) GetTraffic() (uint64, uint64) {
-	return atomic.LoadUint64(&u.sent), atomic.LoadUint64(&u.recv)
+	return atomic.LoadUint64(&u.traffic[0].sent) + atomic.LoadUint64(&u.traffic[1].sent),
+		atomic.LoadUint64(&u.traffic[0].recv) + atomic.LoadUint64(&u.traffic[1].recv)
 }
 
 func (u *User) ResetTraffic() (uint64, uint64) {
-	sent := atomic.SwapUint64(&u.sent, 0)
-	recv := atomic.SwapUint64(&u.recv, 0)
+	var sent, recv uint64
+	for i := range u.traffic {
+		sent += atomic.SwapUint64(&u.traffic[i].sent, 0)
+		recv += atomic.SwapUint64(&u.traffic[i].recv, 0)
+	}
 	atomic.StoreUint64(&u.lastSent, 0)
 	atomic.StoreUint64(&u.lastRecv, 0)
 	return sent, recv
@@ -158,8 +366,8 @@ func (u *User) speedUpdater() {
 			return
 		case <-ticker.C:
 			sent, recv := u.GetTraffic()
-			atomic.StoreUint64(&u.sendSpeed, sent-u.lastSent)
-			atomic.StoreUint64(&u.recvSpeed, recv-u.lastRecv)
+			atomic.StoreUint64(&u.sendSpeed, sent-atomic.LoadUint64(&u.lastSent))
+			atomic.StoreUint64(&u.recvSpeed, recv-atomic.LoadUint64(&u.lastRecv))
 			atomic.StoreUint64(&u.lastSent, sent)
 			atomic.StoreUint64(&u.lastRecv, recv)
 		}
@@ -171,39 +379,150 @@ func (u *User) GetSpeed() (uint64, uint64) {
 }
 
 type Authenticator struct {
-	users sync.Map // 保存用户 map
-	ctx   context.Context
+	users    sync.Map   // 保存用户 map
+	loadLock sync.Mutex // 串行化配置的加载
+	snapLock sync.Mutex // 串行化流量快照
+	cfg      *Config
+	ctx      context.Context
+	epoch    *trafficEpoch
 }
 
 func (a *Authenticator) AuthUser(hash string) (bool, statistic.User) {
 	if user, found := a.users.Load(hash); found {
+		if user.(*User).QuotaExceeded() {
+			log.Warn("user", hash, "has exceeded the traffic quota")
+			return false, nil
+		}
 		return true, user.(*User)
 	}
 	return false, nil
 }
 
-func (a *Authenticator) AddUser(hash string) error {
-	if _, found := a.users.Load(hash); found {
-		return common.NewError("hash " + hash + " is already exist")
+// joinGroup applies the limits of the group to the user. The speed and ip limits set at runtime are kept
+// if the group sets none, the same as a reload by swapping the backend
+func joinGroup(user *User, group *GroupConfig) {
+	user.setGroup(group.Name)
+	if group.SpeedLimit.DownloadSpeed != 0 || group.SpeedLimit.UploadSpeed != 0 {
+		user.SetSpeedLimit(group.SpeedLimit.DownloadSpeed, group.SpeedLimit.UploadSpeed)
+	}
+	if group.IPLimit != 0 {
+		user.SetIPLimit(group.IPLimit)
+	}
+	user.SetQuota(group.Quota)
+	if user.usage != nil {
+		user.usage.SetLimit(user.hash, group.MonthlyLimit)
+	}
+}
+
+// leaveGroup removes the limits of the group which the user no longer belongs to
+func leaveGroup(user *User) {
+	user.setGroup("")
+	user.SetSpeedLimit(0, 0)
+	user.SetIPLimit(0)
+	user.SetQuota(0)
+	if user.usage != nil {
+		user.usage.SetLimit(user.hash, 0)
 	}
+}
+
+// load applies the config to the users in place. The users of the previous config which are not in cfg are removed,
+// the users added at runtime by AddUser are kept. The users are not changed if cfg is invalid
+func (a *Authenticator) load(cfg *Config) error {
+	if err := cfg.Validate(); err != nil { // 重载的配置未经过校验
+		return err
+	}
+	members := make(map[string]*GroupConfig)
+	for i := range cfg.Groups {
+		group := &cfg.Groups[i]
+		if group.Name == "" {
+			return common.NewError("user group must have a name")
+		}
+		for _, hash := range group.UserHashes() {
+			if prev, found := members[hash]; found && prev.Name != group.Name {
+				return common.NewError("failed to setup user group " + group.Name).Base(
+					common.NewError("user " + hash + " belongs to both group " + prev.Name + " and " + group.Name))
+			}
+			members[hash] = group
+		}
+	}
+	hashes := make(map[string]struct{}, len(cfg.Passwords)+len(cfg.Hashes)+len(members))
+	for _, hash := range cfg.UserHashes() {
+		hashes[hash] = struct{}{}
+	}
+	for hash := range members {
+		hashes[hash] = struct{}{}
+	}
+
+	a.loadLock.Lock()
+	defer a.loadLock.Unlock()
+	removed := 0
+	a.users.Range(func(k, v interface{}) bool {
+		user := v.(*User)
+		if _, found := hashes[user.hash]; user.static && !found {
+			if a.DelUser(user.hash) == nil {
+				removed++
+			}
+		}
+		return true
+	})
+	for hash := range hashes {
+		user, _ := a.addUser(hash) // 已存在的用户同样返回
+		user.static = true
+		if group, found := members[hash]; found {
+			joinGroup(user, group)
+		} else if user.Group() != "" {
+			leaveGroup(user)
+		}
+	}
+	a.cfg = cfg
+	log.Debug("memory authenticator loaded", len(hashes), "users from config,", removed, "removed")
+	return nil
+}
+
+// Merge loads the config of next, which must be a memory authenticator, into the authenticator in place,
+// so that the connections online keep counting on the same user meters and the users added at runtime are kept
+func (a *Authenticator) Merge(next statistic.Authenticator) bool {
+	n, ok := next.(*Authenticator)
+	if !ok || n.cfg == nil {
+		return false
+	}
+	if err := a.load(n.cfg); err != nil {
+		log.Warn(common.NewError("failed to merge authenticator config").Base(err))
+		return false
+	}
+	return true
+}
+
+// addUser creates the user, the existing one is returned with an error if the hash is already added
+func (a *Authenticator) addUser(hash string) (*User, error) {
 	ctx, cancel := context.WithCancel(a.ctx)
 	meter := &User{
 		hash:   hash,
+		usage:  statistic.UsageTrackerFromContext(a.ctx),
 		ctx:    ctx,
 		cancel: cancel,
+		epoch:  a.epoch,
+	}
+	if v, loaded := a.users.LoadOrStore(hash, meter); loaded {
+		cancel()
+		return v.(*User), common.NewError("hash " + hash + " is already exist")
 	}
 	go meter.speedUpdater()
-	a.users.Store(hash, meter)
-	return nil
+	return meter, nil
+}
+
+// AddUser adds the user at runtime, it is safe to call concurrently with the other methods
+func (a *Authenticator) AddUser(hash string) error {
+	_, err := a.addUser(hash)
+	return err
 }
 
 func (a *Authenticator) DelUser(hash string) error {
-	meter, found := a.users.Load(hash)
+	meter, found := a.users.LoadAndDelete(hash)
 	if !found {
 		return common.NewError("hash " + hash + " not found")
 	}
 	meter.(*User).Close()
-	a.users.Delete(hash)
 	return nil
 }
 
@@ -216,6 +535,57 @@ func (a *Authenticator) ListUsers() []statistic.User {
 	return result
 }
 
+// SnapshotTraffic reads the traffic of the users, the traffic of all users is read if hashes is empty.
+// The counters of the users are read at the same point: the traffic before it is moved into one generation
+// of the counters, and the generation is flipped, so the traffic after it goes to the other one.
+// The generation read is reset if reset is set, so that no traffic is lost or counted twice between two snapshots.
+// The relays are never blocked by a snapshot, the reads of GetTraffic may miss the traffic being moved
+func (a *Authenticator) SnapshotTraffic(hashes []string, reset bool) ([]statistic.TrafficSnapshot, error) {
+	var users []*User
+	if len(hashes) == 0 {
+		a.users.Range(func(k, v interface{}) bool {
+			users = append(users, v.(*User))
+			return true
+		})
+	} else {
+		for _, hash := range hashes {
+			v, found := a.users.Load(hash)
+			if !found {
+				return nil, common.NewError("hash " + hash + " not found")
+			}
+			users = append(users, v.(*User))
+		}
+	}
+
+	a.snapLock.Lock()
+	defer a.snapLock.Unlock()
+	// 上次快照后没有写入者的一代并入当前一代，切换后它只包含快照之后的流量
+	current := atomic.LoadUint32(&a.epoch.current)
+	for _, user := range users {
+		idle := &user.traffic[current^1]
+		atomic.AddUint64(&user.traffic[current].sent, atomic.SwapUint64(&idle.sent, 0))
+		atomic.AddUint64(&user.traffic[current].recv, atomic.SwapUint64(&idle.recv, 0))
+	}
+	prev := a.epoch.flip()
+
+	result := make([]statistic.TrafficSnapshot, 0, len(users))
+	for _, user := range users {
+		counter := &user.traffic[prev]
+		var sent, recv uint64
+		if reset {
+			sent, recv = atomic.SwapUint64(&counter.sent, 0), atomic.SwapUint64(&counter.recv, 0)
+		} else {
+			sent, recv = atomic.LoadUint64(&counter.sent), atomic.LoadUint64(&counter.recv)
+		}
+		result = append(result, statistic.TrafficSnapshot{
+			Hash: user.hash,
+			Sent: sent,
+			Recv: recv,
+		})
+	}
+	return result, nil
+}
+
 func (a *Authenticator) Close() error {
 	return nil
 }
@@ -223,11 +593,11 @@ func (a *Authenticator) Close() error {
 func NewAuthenticator(ctx context.Context) (statistic.Authenticator, error) {
 	cfg := config.FromContext(ctx, Name).(*Config)
 	u := &Authenticator{
-		ctx: ctx,
+		ctx:   ctx,
+		epoch: &trafficEpoch{},
 	}
-	for _, password := range cfg.Passwords {
-		hash := common.SHA224String(password)
-		u.AddUser(hash)
+	if err := u.load(cfg); err != nil {
+		return nil, err
 	}
 	log.Debug("memory authenticator created")
 	return u, nil
@@ -2,13 +2,21 @@ package memory
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/statistic"
 )
 
 func TestMemoryAuth(t *testing.T) {
@@ -76,6 +84,9 @@ func TestMemoryAuth(t *testing.T) {
 		for {
 			k := 100
 			time.Sleep(time.Second / time.Duration(k))
+			// 限速由连接在读写时等待
+			statistic.WaitSent(user, 2000/k)
+			statistic.WaitRecv(user, 1000/k)
 			user.AddTraffic(2000/k, 1000/k)
 		}
 	}()
@@ -121,6 +132,46 @@ func TestMemoryAuth(t *testing.T) {
 	auth.Close()
 }
 
+func TestSpeedLimit(t *testing.T) {
+	ctx := config.WithConfig(context.Background(), Name, &Config{})
+	auth, err := NewAuthenticator(ctx)
+	common.Must(err)
+	defer auth.Close()
+	common.Must(auth.AddUser("user"))
+	_, user := auth.AuthUser("user")
+	user.SetSpeedLimit(10000, 0)
+
+	// 统计流量不受限速影响
+	start := time.Now()
+	user.AddTraffic(100000, 100000)
+	if time.Since(start) > time.Millisecond*100 {
+		t.Fatal("AddTraffic is throttled")
+	}
+
+	// 超过突发容量的请求被拆分，先用完 20000 字节的桶
+	start = time.Now()
+	statistic.WaitSent(user, 25000)
+	if d := time.Since(start); d < time.Millisecond*400 || d > time.Second*2 {
+		t.Fatal("unexpected wait", d)
+	}
+	start = time.Now()
+	statistic.WaitRecv(user, 1000000)
+	if time.Since(start) > time.Millisecond*100 {
+		t.Fatal("unlimited direction is throttled")
+	}
+
+	// 删除用户后不再等待
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		auth.DelUser("user")
+	}()
+	start = time.Now()
+	statistic.WaitSent(user, 1000000)
+	if time.Since(start) > time.Second*2 {
+		t.Fatal("wait is not canceled after the user is deleted")
+	}
+}
+
 func BenchmarkMemoryUsage(b *testing.B) {
 	cfg := &Config{
 		Passwords: nil,
@@ -140,3 +191,421 @@ func BenchmarkMemoryUsage(b *testing.B) {
 	b.ReportMetric(float64(m2.Alloc-m1.Alloc)/1024/1024, "MiB(Alloc)")
 	b.ReportMetric(float64(m2.TotalAlloc-m1.TotalAlloc)/1024/1024, "MiB(TotalAlloc)")
 }
+
+func TestUserGroup(t *testing.T) {
+	cfg := &Config{
+		Passwords: []string{"admin"},
+		Groups: []GroupConfig{
+			{
+				Name:      "trial",
+				Passwords: []string{"trial1", "trial2"},
+				SpeedLimit: SpeedLimitConfig{
+					UploadSpeed:   1024,
+					DownloadSpeed: 2048,
+				},
+				IPLimit: 1,
+				Quota:   1000,
+			},
+		},
+	}
+	ctx := config.WithConfig(context.Background(), Name, cfg)
+	auth, err := NewAuthenticator(ctx)
+	common.Must(err)
+
+	valid, user := auth.AuthUser(common.SHA224String("trial1"))
+	if !valid {
+		t.Fatal("group member")
+	}
+	if user.(*User).Group() != "trial" {
+		t.Fatal("Group")
+	}
+	if send, recv := user.GetSpeedLimit(); send != 2048 || recv != 1024 {
+		t.Fatal("speed limit", send, recv)
+	}
+	if user.GetIPLimit() != 1 {
+		t.Fatal("ip limit")
+	}
+	user.AddTraffic(600, 400)
+	if valid, _ := auth.AuthUser(common.SHA224String("trial1")); valid {
+		t.Fatal("quota")
+	}
+	if valid, _ := auth.AuthUser(common.SHA224String("trial2")); !valid {
+		t.Fatal("quota of another member")
+	}
+	valid, user = auth.AuthUser(common.SHA224String("admin"))
+	if !valid || user.(*User).Group() != "" {
+		t.Fatal("admin")
+	}
+
+	cfg.Groups = append(cfg.Groups, GroupConfig{
+		Name:      "premium",
+		Passwords: []string{"trial1"},
+	})
+	ctx = config.WithConfig(context.Background(), Name, cfg)
+	if _, err := NewAuthenticator(ctx); err == nil {
+		t.Fatal("user in two groups")
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	cfg := &Config{
+		Passwords: []string{"user1"},
+		Hashes:    []string{strings.ToUpper(common.SHA224String("user2"))},
+		Groups: []GroupConfig{
+			{
+				Name:   "trial",
+				Hashes: []string{common.SHA224String("trial1")},
+				Quota:  1000,
+			},
+		},
+	}
+	common.Must(cfg.Validate())
+	auth, err := NewAuthenticator(config.WithConfig(context.Background(), Name, cfg))
+	common.Must(err)
+	for _, password := range []string{"user1", "user2", "trial1"} {
+		if valid, _ := auth.AuthUser(common.SHA224String(password)); !valid {
+			t.Fatal("auth", password)
+		}
+	}
+	_, user := auth.AuthUser(common.SHA224String("trial1"))
+	if user.(*User).Group() != "trial" || user.(*User).GetQuota() != 1000 {
+		t.Fatal("group member by hash")
+	}
+	if hashes, _ := cfg.MemberHashes("trial"); len(hashes) != 1 || hashes[0] != common.SHA224String("trial1") {
+		t.Fatal("member hashes", hashes)
+	}
+
+	cfg.Hashes = []string{"user2"}
+	cfg.Groups[0].Hashes = append(cfg.Groups[0].Hashes, common.SHA224String("x")[1:])
+	errs, ok := cfg.Validate().(config.Errors)
+	if !ok || len(errs) != 2 || errs[0].Path != "password_hash[0]" || errs[1].Path != "groups[0].password_hash[1]" {
+		t.Fatal("invalid hashes", errs)
+	}
+	if _, err := NewAuthenticator(config.WithConfig(context.Background(), Name, cfg)); err == nil {
+		t.Fatal("invalid hash should be rejected")
+	}
+}
+
+func TestSwappableAuthenticator(t *testing.T) {
+	ctx := config.WithConfig(context.Background(), Name, &Config{
+		Passwords: []string{"user1", "user2"},
+	})
+	auth, err := statistic.NewSwappableAuthenticator(ctx, NewAuthenticator)
+	common.Must(err)
+	defer auth.Close()
+
+	valid, user := auth.AuthUser(common.SHA224String("user1"))
+	if !valid {
+		t.Fatal("auth")
+	}
+	user.AddTraffic(100, 200)
+	user.SetIPLimit(3)
+
+	common.Must(auth.Reload([]byte(`{"password": ["user1", "user3"]}`), "json"))
+	valid, user = auth.AuthUser(common.SHA224String("user1"))
+	if !valid {
+		t.Fatal("migrated user")
+	}
+	if sent, recv := user.GetTraffic(); sent != 100 || recv != 200 {
+		t.Fatal("migrated traffic", sent, recv)
+	}
+	if user.GetIPLimit() != 3 {
+		t.Fatal("migrated ip limit")
+	}
+	if valid, _ := auth.AuthUser(common.SHA224String("user2")); valid {
+		t.Fatal("removed user")
+	}
+	if valid, _ := auth.AuthUser(common.SHA224String("user3")); !valid {
+		t.Fatal("new user")
+	}
+	if err := auth.Reload([]byte(`{"password": `), "json"); err == nil {
+		t.Fatal("invalid config")
+	}
+	if valid, _ := auth.AuthUser(common.SHA224String("user3")); !valid {
+		t.Fatal("backend should be kept after a failed reload")
+	}
+}
+
+func TestRuntimeUsers(t *testing.T) {
+	ctx := config.WithConfig(context.Background(), Name, &Config{
+		Passwords: []string{"user1"},
+		Groups: []GroupConfig{
+			{
+				Name:      "trial",
+				Passwords: []string{"trial1"},
+				IPLimit:   1,
+				Quota:     1000,
+			},
+		},
+	})
+	auth, err := statistic.NewSwappableAuthenticator(ctx, NewAuthenticator)
+	common.Must(err)
+	defer auth.Close()
+
+	// 并发添加和删除同一个用户，只有一次成功
+	hash := common.SHA224String("runtime")
+	var added, deleted int32
+	done := make(chan struct{})
+	for i := 0; i < 16; i++ {
+		go func() {
+			if auth.AddUser(hash) == nil {
+				atomic.AddInt32(&added, 1)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 16; i++ {
+		<-done
+	}
+	for i := 0; i < 16; i++ {
+		go func() {
+			if auth.DelUser(hash) == nil {
+				atomic.AddInt32(&deleted, 1)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 16; i++ {
+		<-done
+	}
+	if added != 1 || deleted != 1 {
+		t.Fatal("concurrent add and delete", added, deleted)
+	}
+
+	common.Must(auth.AddUser(hash))
+	_, user1 := auth.AuthUser(common.SHA224String("user1"))
+	user1.AddTraffic(100, 200)
+	_, trial1 := auth.AuthUser(common.SHA224String("trial1"))
+
+	common.Must(auth.Reload([]byte(`{"password": ["trial1", "user3"], "groups": [{"name": "premium", "password": ["user1"], "ip_limit": 2}]}`), "json"))
+	valid, user := auth.AuthUser(common.SHA224String("user1"))
+	if !valid || user != user1 {
+		t.Fatal("user should be reloaded in place")
+	}
+	if sent, recv := user.GetTraffic(); sent != 100 || recv != 200 {
+		t.Fatal("traffic", sent, recv)
+	}
+	if user.(*User).Group() != "premium" || user.GetIPLimit() != 2 {
+		t.Fatal("joined group")
+	}
+	valid, user = auth.AuthUser(common.SHA224String("trial1"))
+	if !valid || user != trial1 || user.(*User).Group() != "" || user.GetIPLimit() != 0 || user.(*User).GetQuota() != 0 {
+		t.Fatal("left group")
+	}
+	if valid, _ := auth.AuthUser(hash); !valid {
+		t.Fatal("user added at runtime should be kept")
+	}
+	if valid, _ := auth.AuthUser(common.SHA224String("user3")); !valid {
+		t.Fatal("new user")
+	}
+
+	common.Must(auth.Reload([]byte(`{"password": ["user3"]}`), "json"))
+	if valid, _ := auth.AuthUser(common.SHA224String("user1")); valid {
+		t.Fatal("removed user")
+	}
+	if valid, _ := auth.AuthUser(hash); !valid {
+		t.Fatal("user added at runtime should be kept")
+	}
+}
+
+func TestMonthlyUsage(t *testing.T) {
+	alerts := make(chan statistic.UsageAlert, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert statistic.UsageAlert
+		common.Must(json.NewDecoder(r.Body).Decode(&alert))
+		alerts <- alert
+	}))
+	defer webhook.Close()
+
+	file := filepath.Join(t.TempDir(), "usage.json")
+	usageCfg := &statistic.UsageConfig{
+		MonthlyLimit: 10000,
+		Webhook:      webhook.URL,
+		File:         file,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	usage, err := statistic.NewUsageTracker(ctx, usageCfg)
+	common.Must(err)
+	ctx = statistic.WithUsageTracker(ctx, usage)
+	ctx = config.WithConfig(ctx, Name, &Config{
+		Groups: []GroupConfig{
+			{
+				Name:         "trial",
+				Passwords:    []string{"trial"},
+				MonthlyLimit: 1000,
+			},
+		},
+	})
+	auth, err := statistic.NewSwappableAuthenticator(ctx, NewAuthenticator)
+	common.Must(err)
+	hash := common.SHA224String("trial")
+
+	_, user := auth.AuthUser(hash)
+	user.AddTraffic(500, 350)
+	alert := <-alerts
+	if alert.User != hash || alert.Threshold != 80 || alert.Used != 850 || alert.Limit != 1000 {
+		t.Fatal("80% alert", alert)
+	}
+	user.ResetTraffic()
+	common.Must(auth.Reload(nil, ""))
+	_, user = auth.AuthUser(hash)
+	user.AddTraffic(100, 100)
+	if alert := <-alerts; alert.Threshold != 100 || alert.Used != 1050 {
+		t.Fatal("100% alert", alert)
+	}
+	user.AddTraffic(100, 100)
+	select {
+	case alert := <-alerts:
+		t.Fatal("duplicated alert", alert)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	result := usage.Usage("")
+	if len(result) != 1 || result[0].Sent != 700 || result[0].Recv != 550 || len(result[0].Alerts) != 2 {
+		t.Fatal("usage", result)
+	}
+	if len(usage.Usage("2000-01")) != 0 {
+		t.Fatal("usage of another month")
+	}
+
+	auth.Close()
+	cancel()
+	time.Sleep(time.Millisecond * 100)
+	usage, err = statistic.NewUsageTracker(context.Background(), usageCfg)
+	common.Must(err)
+	if result := usage.Usage(""); len(result) != 1 || result[0].Sent+result[0].Recv != 1250 {
+		t.Fatal("saved usage", result)
+	}
+}
+
+func TestTrafficSnapshot(t *testing.T) {
+	ctx := config.WithConfig(context.Background(), Name, &Config{
+		Passwords: []string{"user1", "user2"},
+	})
+	backend, err := NewAuthenticator(ctx)
+	common.Must(err)
+	a := backend.(*Authenticator)
+	hash1, hash2 := common.SHA224String("user1"), common.SHA224String("user2")
+	_, user1 := a.AuthUser(hash1)
+	_, user2 := a.AuthUser(hash2)
+
+	// 快照与流量更新并发进行，流量不会丢失或者重复计算
+	const rounds = 10000
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < rounds; i++ {
+			user1.AddTraffic(1, 2)
+			user2.AddTraffic(1, 2)
+		}
+		close(done)
+	}()
+	totals := map[string]uint64{}
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		snapshots, err := a.SnapshotTraffic(nil, true)
+		common.Must(err)
+		if len(snapshots) != 2 {
+			t.Fatal("wrong snapshot", snapshots)
+		}
+		for _, snapshot := range snapshots {
+			totals[snapshot.Hash] += snapshot.Sent + snapshot.Recv
+		}
+	}
+	if totals[hash1] != 3*rounds || totals[hash2] != 3*rounds {
+		t.Fatal("traffic lost or counted twice", totals)
+	}
+
+	// 所有用户在同一时刻读取：user1 总是先于 user2 计数，快照中 user2 不会超过 user1，
+	// 且每个用户的上传和下载来自同一次计数
+	const writers = 4
+	wg := sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				user1.AddTraffic(1, 2)
+				user2.AddTraffic(1, 2)
+			}
+		}()
+	}
+	done = make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		snapshots, err := a.SnapshotTraffic(nil, false)
+		common.Must(err)
+		sent := map[string]uint64{}
+		for _, snapshot := range snapshots {
+			if snapshot.Recv != 2*snapshot.Sent {
+				t.Fatal("sent and recv are not read at the same point", snapshot)
+			}
+			sent[snapshot.Hash] = snapshot.Sent
+		}
+		if sent[hash2] > sent[hash1] || sent[hash1] > sent[hash2]+writers {
+			t.Fatal("users are not read at the same point", sent)
+		}
+	}
+	if sent, recv := user1.GetTraffic(); sent != writers*rounds || recv != 2*writers*rounds {
+		t.Fatal("traffic lost", sent, recv)
+	}
+
+	auth, err := statistic.NewSwappableAuthenticator(ctx, NewAuthenticator)
+	common.Must(err)
+	defer auth.Close()
+	_, user1 = auth.AuthUser(hash1)
+	user1.AddTraffic(100, 200)
+	snapshots, err := auth.SnapshotTraffic([]string{hash1}, false)
+	common.Must(err)
+	if len(snapshots) != 1 || snapshots[0].Hash != hash1 || snapshots[0].Sent != 100 || snapshots[0].Recv != 200 {
+		t.Fatal("wrong snapshot", snapshots)
+	}
+	if sent, recv := user1.GetTraffic(); sent != 100 || recv != 200 {
+		t.Fatal("traffic reset without reset", sent, recv)
+	}
+	if _, err := auth.SnapshotTraffic([]string{"invalid"}, true); err == nil {
+		t.Fatal("unknown user")
+	}
+}
+
+func TestAccounting(t *testing.T) {
+	if _, err := statistic.NewAccounting("invalid"); err == nil {
+		t.Fatal("invalid quota metric")
+	}
+	for _, quota := range []string{statistic.AccountingWire, statistic.AccountingPayload} {
+		ctx := config.WithConfig(context.Background(), Name, &Config{})
+		auth, err := NewAuthenticator(ctx)
+		common.Must(err)
+		auth.AddUser("user1")
+		_, user := auth.AuthUser("user1")
+		accounting, err := statistic.NewAccounting(quota)
+		common.Must(err)
+		accounting.AddWire(user, 150, 250)
+		accounting.AddPayload(user, 100, 200)
+
+		meter := user.(statistic.AccountingMeter)
+		if sent, recv := meter.GetWire(); sent != 150 || recv != 250 {
+			t.Fatal("wire traffic", sent, recv)
+		}
+		if sent, recv := meter.GetPayload(); sent != 100 || recv != 200 {
+			t.Fatal("payload traffic", sent, recv)
+		}
+		// 只有配额口径的流量计入用户流量
+		sent, recv := user.GetTraffic()
+		if quota == statistic.AccountingWire && (sent != 150 || recv != 250) ||
+			quota == statistic.AccountingPayload && (sent != 100 || recv != 200) {
+			t.Fatal("user traffic of", quota, sent, recv)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package memory
+
+import (
+	"github.com/p4gefau1t/trojan-go/statistic"
+)
+
+// grouped is implemented by the users which may belong to a group
+type grouped interface {
+	Group() string
+}
+
+// Selector finds the first of a list of per-user configs which contains a user, listed by its hash or by the
+// name of its group. The groups are looked up when selecting, so that the users joining or leaving a group on
+// reload or through the api are selected by their current group
+type Selector struct {
+	hashes map[string]int // 用户 hash -> 配置下标
+	groups map[string]int // 用户组名 -> 配置下标
+}
+
+func NewSelector() *Selector {
+	return &Selector{
+		hashes: make(map[string]int),
+		groups: make(map[string]int),
+	}
+}
+
+// Add adds the users and the groups of the config at index, the earlier configs are kept for the users and
+// the groups already added
+func (s *Selector) Add(index int, hashes []string, groups []string) {
+	for _, hash := range hashes {
+		if _, found := s.hashes[hash]; !found {
+			s.hashes[hash] = index
+		}
+	}
+	for _, group := range groups {
+		if group == "" {
+			continue
+		}
+		if _, found := s.groups[group]; !found {
+			s.groups[group] = index
+		}
+	}
+}
+
+// Select returns the index of the first config containing the user, false if there is none
+func (s *Selector) Select(user statistic.User) (int, bool) {
+	if user == nil {
+		return 0, false
+	}
+	index, found := s.hashes[user.Hash()]
+	if g, ok := user.(grouped); ok {
+		if i, ok := s.groups[g.Group()]; ok && (!found || i < index) {
+			index, found = i, true
+		}
+	}
+	return index, found
+}
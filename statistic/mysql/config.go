@@ -1,29 +1,57 @@
 package mysql
 
 import (
+	"strconv"
+
+	"github.com/p4gefau1t/trojan-go/common/backoff"
 	"github.com/p4gefau1t/trojan-go/config"
 )
 
 type MySQLConfig struct {
-	Enabled    bool   `json:"enabled" yaml:"enabled"`
-	ServerHost string `json:"server_addr" yaml:"server-addr"`
-	ServerPort int    `json:"server_port" yaml:"server-port"`
-	Database   string `json:"database" yaml:"database"`
-	Username   string `json:"username" yaml:"username"`
-	Password   string `json:"password" yaml:"password"`
-	CheckRate  int    `json:"check_rate" yaml:"check-rate"`
+	Enabled    bool           `json:"enabled" yaml:"enabled"`
+	ServerHost string         `json:"server_addr" yaml:"server-addr"`
+	ServerPort int            `json:"server_port" yaml:"server-port"`
+	Database   string         `json:"database" yaml:"database"`
+	Username   string         `json:"username" yaml:"username"`
+	Password   string         `json:"password" yaml:"password"`
+	CheckRate  int            `json:"check_rate" yaml:"check-rate"`
+	Retry      backoff.Config `json:"retry" yaml:"retry"`
+	SpeedLimit bool           `json:"speed_limit" yaml:"speed-limit"` // 从 users 表的 upload_speed 和 download_speed 列读取限速
 }
 
 type Config struct {
 	MySQL MySQLConfig `json:"mysql" yaml:"mysql"`
 }
 
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if !c.MySQL.Enabled {
+		return nil
+	}
+	if c.MySQL.ServerPort <= 0 || c.MySQL.ServerPort > 65535 {
+		errs.Add("mysql.server_port", "invalid port "+strconv.Itoa(c.MySQL.ServerPort))
+	}
+	if c.MySQL.CheckRate <= 0 {
+		errs.Add("mysql.check_rate", "must be positive")
+	}
+	if err := c.MySQL.Retry.Validate(); err != nil {
+		errs.Add("mysql.retry", err.Error())
+	}
+	return errs.Err()
+}
+
 func init() {
 	config.RegisterConfigCreator(Name, func() interface{} {
 		return &Config{
 			MySQL: MySQLConfig{
 				ServerPort: 3306,
 				CheckRate:  30,
+				Retry: backoff.Config{
+					InitialDelay: 1000,
+					MaxDelay:     30000,
+					Multiplier:   2,
+					Jitter:       0.2,
+				},
 			},
 		}
 	})
@@ -11,6 +11,7 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/backoff"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/statistic"
@@ -22,42 +23,80 @@ const Name = "MYSQL"
 type Authenticator struct {
 	*memory.Authenticator
 	db             *sql.DB
-	updateDuration time.Duration // 从MySQL获取用户数据并更新缓存的间隔时间
+	updateDuration time.Duration    // 从MySQL获取用户数据并更新缓存的间隔时间
+	readOnly       bool             // 只读取数据库中的流量，不写回缓存的流量
+	backoff        *backoff.Backoff // 查询失败后等待的时间
+	speedLimit     bool             // 读取用户的限速
 	ctx            context.Context
 }
 
+// flush 将缓存的流量写入数据库
+func (a *Authenticator) flush() {
+	for _, user := range a.ListUsers() {
+		// swap upload and download for users
+		hash := user.Hash()
+		sent, recv := user.ResetTraffic()
+
+		s, err := a.db.Exec("UPDATE `users` SET `upload`=`upload`+?, `download`=`download`+? WHERE `password`=?;", recv, sent, hash)
+		if err != nil {
+			log.Error(common.NewError("failed to update data to user table").Base(err))
+			continue
+		}
+		if r, err := s.RowsAffected(); err != nil {
+			if r == 0 {
+				a.DelUser(hash)
+			}
+		}
+	}
+	log.Info("buffered data has been written into the database")
+}
+
+// Merge overrides the one of the embedded memory authenticator, the users are loaded from the database
+// so a reload always swaps the backend
+func (a *Authenticator) Merge(statistic.Authenticator) bool {
+	return false
+}
+
+// SnapshotTraffic is not supported, the memory only holds the traffic not yet flushed to the database,
+// the totals should be read from the database
+func (a *Authenticator) SnapshotTraffic([]string, bool) ([]statistic.TrafficSnapshot, error) {
+	return nil, common.NewError("traffic snapshots are not supported by the mysql authenticator, read the totals from the database")
+}
+
 // 同步内存和 mysql 中的数据
 func (a *Authenticator) updater() {
 	for {
-		for _, user := range a.ListUsers() {
-			// swap upload and download for users
-			hash := user.Hash()
-			sent, recv := user.ResetTraffic()
-
-			s, err := a.db.Exec("UPDATE `users` SET `upload`=`upload`+?, `download`=`download`+? WHERE `password`=?;", recv, sent, hash)
-			if err != nil {
-				log.Error(common.NewError("failed to update data to user table").Base(err))
-				continue
-			}
-			if r, err := s.RowsAffected(); err != nil {
-				if r == 0 {
-					a.DelUser(hash)
-				}
-			}
+		if !a.readOnly { // 只读模式下流量由数据面节点写入
+			a.flush()
 		}
-		log.Info("buffered data has been written into the database")
 
 		// update memory
-		rows, err := a.db.Query("SELECT password,quota,download,upload FROM users")
+		query := "SELECT password,quota,download,upload FROM users"
+		if a.speedLimit {
+			query = "SELECT password,quota,download,upload,upload_speed,download_speed FROM users"
+		}
+		rows, err := a.db.Query(query)
 		if err != nil || rows.Err() != nil {
 			log.Error(common.NewError("failed to pull data from the database").Base(err))
-			time.Sleep(a.updateDuration)
-			continue
+			select {
+			case <-time.After(a.backoff.Next()):
+				continue
+			case <-a.ctx.Done():
+				log.Debug("MySQL daemon exiting...")
+				return
+			}
 		}
+		a.backoff.Reset()
 		for rows.Next() {
 			var hash string
 			var quota, download, upload int64
-			err := rows.Scan(&hash, &quota, &download, &upload)
+			var uploadSpeed, downloadSpeed int
+			var err error
+			if a.speedLimit {
+				err = rows.Scan(&hash, &quota, &download, &upload, &uploadSpeed, &downloadSpeed)
+			} else {
+				err = rows.Scan(&hash, &quota, &download, &upload)
+			}
 			if err != nil {
 				log.Error(common.NewError("failed to obtain data from the query result").Base(err))
 				break
@@ -65,6 +104,15 @@ func (a *Authenticator) updater() {
 
 			if download+upload < quota || quota < 0 {
 				a.AddUser(hash)
+				if valid, user := a.AuthUser(hash); valid {
+					if a.readOnly {
+						// 数据库中是所有节点累计的流量
+						user.SetTraffic(uint64(download), uint64(upload))
+					}
+					if a.speedLimit {
+						a.setSpeedLimit(user, downloadSpeed, uploadSpeed)
+					}
+				}
 			} else { // 如果download+upload>quota，trojan-go服务器将拒绝该用户的连接
 				a.DelUser(hash)
 			}
@@ -79,6 +127,20 @@ func (a *Authenticator) updater() {
 	}
 }
 
+// setSpeedLimit updates the speed limit of the user if it is changed in the database,
+// the token buckets are kept otherwise
+func (a *Authenticator) setSpeedLimit(user statistic.User, send, recv int) {
+	if send < 0 {
+		send = 0
+	}
+	if recv < 0 {
+		recv = 0
+	}
+	if oldSend, oldRecv := user.GetSpeedLimit(); oldSend != send || oldRecv != recv {
+		user.SetSpeedLimit(send, recv)
+	}
+}
+
 func connectDatabase(driverName, username, password, ip string, port int, dbName string) (*sql.DB, error) {
 	path := strings.Join([]string{username, ":", password, "@tcp(", ip, ":", fmt.Sprintf("%d", port), ")/", dbName, "?charset=utf8"}, "")
 	return sql.Open(driverName, path)
@@ -97,6 +159,10 @@ func NewAuthenticator(ctx context.Context) (statistic.Authenticator, error) {
 	if err != nil {
 		return nil, common.NewError("Failed to connect to database server").Base(err)
 	}
+	retry, err := backoff.New("mysql", &cfg.MySQL.Retry)
+	if err != nil {
+		return nil, err
+	}
 	memoryAuth, err := memory.NewAuthenticator(ctx)
 	if err != nil {
 		return nil, err
@@ -105,6 +171,9 @@ func NewAuthenticator(ctx context.Context) (statistic.Authenticator, error) {
 		db:             db,
 		ctx:            ctx,
 		updateDuration: time.Duration(cfg.MySQL.CheckRate) * time.Second,
+		readOnly:       statistic.IsReadOnly(ctx),
+		backoff:        retry.NewBackoff(),
+		speedLimit:     cfg.MySQL.SpeedLimit,
 		Authenticator:  memoryAuth.(*memory.Authenticator),
 	}
 	go a.updater()
@@ -44,6 +44,52 @@ type Authenticator interface {
 	ListUsers() []User
 }
 
+// Throttler is implemented by the users whose speed can be limited, the calls block until the bytes are allowed
+// by the speed limit of the user
+type Throttler interface {
+	WaitSent(n int)
+	WaitRecv(n int)
+}
+
+// WaitSent blocks until the user is allowed to send n bytes, it returns at once if the speed is not limited
+func WaitSent(user User, n int) {
+	if t, ok := user.(Throttler); ok {
+		t.WaitSent(n)
+	}
+}
+
+// WaitRecv blocks until the user is allowed to receive n bytes, it returns at once if the speed is not limited
+func WaitRecv(user User, n int) {
+	if t, ok := user.(Throttler); ok {
+		t.WaitRecv(n)
+	}
+}
+
+// TrafficSnapshot is the traffic of a user at the instant of the snapshot
+type TrafficSnapshot struct {
+	Hash string
+	Sent uint64
+	Recv uint64
+}
+
+// Snapshotter is implemented by the authenticators which can read and reset the traffic of the users at the same point,
+// without losing or counting twice the traffic in between
+type Snapshotter interface {
+	SnapshotTraffic(hashes []string, reset bool) ([]TrafficSnapshot, error)
+}
+
+// Merger is implemented by the authenticators which can apply the config of a newly built backend of the same kind in place,
+// Merge returns false if the backend should be swapped instead
+type Merger interface {
+	Merge(next Authenticator) bool
+}
+
+// Successor is implemented by the users which can take over the user they replace when the authenticator is swapped.
+// Succeed returns false if prev can not be taken over
+type Successor interface {
+	Succeed(prev User) bool
+}
+
 type Creator func(ctx context.Context) (Authenticator, error)
 
 var (
@@ -75,3 +121,17 @@ func NewAuthenticator(ctx context.Context, name string) (Authenticator, error) {
 	createdAuth[ctx] = auth
 	return auth, err
 }
+
+type readOnlyKey struct{}
+
+// WithReadOnly marks the context as read-only, the authenticators and trackers created with it
+// only read the shared backend and never write the statistics back
+func WithReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyKey{}, true)
+}
+
+// IsReadOnly reports whether the context is marked as read-only
+func IsReadOnly(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(readOnlyKey{}).(bool)
+	return readOnly
+}
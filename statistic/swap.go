@@ -0,0 +1,153 @@
+package statistic
+
+import (
+	"context"
+	"sync"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// Builder creates an authenticator backend with the config stored in the context.
+// The backend should release all its resources when the context is cancelled
+type Builder func(ctx context.Context) (Authenticator, error)
+
+// SwappableAuthenticator delegates to a backend which can be replaced at runtime,
+// e.g. switching between memory and database, or reconnecting the database with new credentials
+type SwappableAuthenticator struct {
+	sync.RWMutex
+	current Authenticator
+	cancel  context.CancelFunc
+	build   Builder
+	ctx     context.Context
+}
+
+func (a *SwappableAuthenticator) backend() Authenticator {
+	a.RLock()
+	defer a.RUnlock()
+	return a.current
+}
+
+func (a *SwappableAuthenticator) AuthUser(hash string) (bool, User) {
+	return a.backend().AuthUser(hash)
+}
+
+func (a *SwappableAuthenticator) AddUser(hash string) error {
+	return a.backend().AddUser(hash)
+}
+
+func (a *SwappableAuthenticator) DelUser(hash string) error {
+	return a.backend().DelUser(hash)
+}
+
+func (a *SwappableAuthenticator) ListUsers() []User {
+	return a.backend().ListUsers()
+}
+
+func (a *SwappableAuthenticator) SnapshotTraffic(hashes []string, reset bool) ([]TrafficSnapshot, error) {
+	backend, ok := a.backend().(Snapshotter)
+	if !ok {
+		return nil, common.NewError("authenticator does not support traffic snapshots")
+	}
+	return backend.SnapshotTraffic(hashes, reset)
+}
+
+func (a *SwappableAuthenticator) Close() error {
+	a.Lock()
+	defer a.Unlock()
+	a.cancel()
+	return a.current.Close()
+}
+
+// migrate moves the traffic, the online ips and the limits of the users to the new backend.
+// The users held by the active connections forward their meters to the new users if they are Successors.
+// Runtime limits are kept only when the new backend sets no limit for the user
+func migrate(from, to Authenticator) int {
+	newUsers := make(map[string]User)
+	for _, user := range to.ListUsers() {
+		newUsers[user.Hash()] = user
+	}
+	count := 0
+	for _, oldUser := range from.ListUsers() {
+		newUser, found := newUsers[oldUser.Hash()]
+		if !found {
+			continue
+		}
+		if s, ok := newUser.(Successor); !ok || !s.Succeed(oldUser) {
+			oldSent, oldRecv := oldUser.GetTraffic()
+			sent, recv := newUser.GetTraffic()
+			newUser.SetTraffic(sent+oldSent, recv+oldRecv)
+		}
+		if send, recv := newUser.GetSpeedLimit(); send == 0 && recv == 0 {
+			newUser.SetSpeedLimit(oldUser.GetSpeedLimit())
+		}
+		if newUser.GetIPLimit() == 0 {
+			newUser.SetIPLimit(oldUser.GetIPLimit())
+		}
+		count++
+	}
+	return count
+}
+
+// Reload builds a new backend and swaps it in. The config data overrides the initial config if it is not empty.
+// If the current backend is a Merger accepting the new one, the new config is applied in place instead.
+// Connections established before a swap keep the users of the old backend, which forward to the new ones if possible
+func (a *SwappableAuthenticator) Reload(data []byte, format string) error {
+	ctx, cancel := context.WithCancel(a.ctx)
+	var err error
+	switch format {
+	case "", "json":
+		if len(data) != 0 {
+			ctx, err = config.WithJSONConfig(ctx, data)
+		}
+	case "yaml":
+		if len(data) != 0 {
+			ctx, err = config.WithYAMLConfig(ctx, data)
+		}
+	default:
+		err = common.NewError("unknown config format: " + format)
+	}
+	if err != nil {
+		cancel()
+		return common.NewError("invalid authenticator config").Base(err)
+	}
+	next, err := a.build(ctx)
+	if err != nil {
+		cancel()
+		return common.NewError("failed to create authenticator").Base(err)
+	}
+	if merger, ok := a.backend().(Merger); ok && merger.Merge(next) {
+		cancel()
+		next.Close()
+		log.Info("authenticator reloaded in place")
+		return nil
+	}
+
+	a.Lock()
+	prev, prevCancel := a.current, a.cancel
+	a.current, a.cancel = next, cancel
+	a.Unlock()
+
+	count := migrate(prev, next)
+	prevCancel()
+	prev.Close()
+	log.Info("authenticator reloaded,", count, "users migrated")
+	return nil
+}
+
+// NewSwappableAuthenticator builds the initial backend with the config in ctx
+func NewSwappableAuthenticator(ctx context.Context, build Builder) (*SwappableAuthenticator, error) {
+	backendCtx, cancel := context.WithCancel(ctx)
+	current, err := build(backendCtx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &SwappableAuthenticator{
+		current: current,
+		cancel:  cancel,
+		build:   build,
+		ctx:     ctx,
+	}, nil
+}
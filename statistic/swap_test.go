@@ -0,0 +1,74 @@
+package statistic_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/statistic"
+	"github.com/p4gefau1t/trojan-go/statistic/memory"
+)
+
+// noMerge hides the Merger of the memory backend, so that a reload always swaps the backend
+type noMerge struct {
+	statistic.Authenticator
+}
+
+func TestSwapInFlightTraffic(t *testing.T) {
+	ctx := config.WithConfig(context.Background(), memory.Name, &memory.Config{
+		Passwords: []string{"user1"},
+	})
+	auth, err := statistic.NewSwappableAuthenticator(ctx, func(ctx context.Context) (statistic.Authenticator, error) {
+		a, err := memory.NewAuthenticator(ctx)
+		return noMerge{a}, err
+	})
+	common.Must(err)
+	defer auth.Close()
+
+	hash := common.SHA224String("user1")
+	_, old := auth.AuthUser(hash)
+	old.SetIPLimit(2)
+	if !old.AddIP("1.1.1.1") {
+		t.Fatal("add ip")
+	}
+
+	// 连接在切换期间和之后继续使用旧的用户
+	const workers, rounds = 4, 1000
+	wg := sync.WaitGroup{}
+	start := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for j := 0; j < rounds; j++ {
+				old.AddTraffic(1, 2)
+			}
+		}()
+	}
+	close(start)
+	common.Must(auth.Reload(nil, ""))
+	wg.Wait()
+	old.AddTraffic(10, 20)
+
+	_, user := auth.AuthUser(hash)
+	if user == old {
+		t.Fatal("backend not swapped")
+	}
+	if sent, recv := user.GetTraffic(); sent != workers*rounds+10 || recv != 2*workers*rounds+20 {
+		t.Fatal("in-flight traffic lost", sent, recv)
+	}
+	// 在线的 IP 随用户迁移，旧用户的操作转发给新用户
+	if user.GetIP() != 1 || user.GetIPLimit() != 2 {
+		t.Fatal("ip table not migrated", user.GetIP(), user.GetIPLimit())
+	}
+	if !old.AddIP("2.2.2.2") || user.GetIP() != 2 || user.AddIP("3.3.3.3") {
+		t.Fatal("ip not forwarded", user.GetIP())
+	}
+	old.DelIP("1.1.1.1")
+	if user.GetIP() != 1 {
+		t.Fatal("ip not forwarded", user.GetIP())
+	}
+}
@@ -0,0 +1,443 @@
+package statistic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+const monthFormat = "2006-01"
+
+// 检查是否跨月的间隔
+var rolloverInterval = time.Second
+
+// UsageConfig 按月统计用户流量，跨月自动清零，并在达到阈值时告警
+type UsageConfig struct {
+	Enabled      bool   `json:"enabled" yaml:"enabled"`
+	MonthlyLimit uint64 `json:"monthly_limit" yaml:"monthly-limit"` // 每月流量额度(字节)，0 表示不告警
+	Alerts       []int  `json:"alerts" yaml:"alerts"`               // 告警阈值，额度的百分比
+	Webhook      string `json:"webhook" yaml:"webhook"`
+	File         string `json:"file" yaml:"file"`       // 保存统计的文件，为空时重启后清零
+	History      int    `json:"history" yaml:"history"` // 保留的月份数
+}
+
+// UsageAlert is emitted once per user, month and threshold
+type UsageAlert struct {
+	User      string `json:"user"`
+	Month     string `json:"month"`
+	Threshold int    `json:"threshold"`
+	Used      uint64 `json:"used"`
+	Limit     uint64 `json:"limit"`
+	Time      int64  `json:"time"`
+}
+
+// MonthlyUsage is the traffic of a user in a month
+type MonthlyUsage struct {
+	User   string `json:"user"`
+	Month  string `json:"month"`
+	Sent   uint64 `json:"sent"`
+	Recv   uint64 `json:"recv"`
+	Limit  uint64 `json:"limit"`
+	Alerts []int  `json:"alerts"` // 本月已触发的告警阈值
+}
+
+// usageCounter is the traffic of a user in a month, updated with atomic operations
+type usageCounter struct {
+	sent   uint64
+	recv   uint64
+	limit  uint64
+	alerts int32 // 已触发的告警阈值个数，阈值按升序触发
+}
+
+// usageBucket holds the counters of the users in a month
+type usageBucket struct {
+	month string
+	users sync.Map // hash -> *usageCounter
+}
+
+// UsageTracker records the monthly traffic of the users, independent of the lifetime counters of the meters,
+// so that it is kept when the authenticator is reloaded or the counters are reset by the database.
+// The traffic is added to the per-user atomic counters of the current month, which is rolled over by a ticker
+type UsageTracker struct {
+	sync.Mutex
+	current      atomic.Value            // 当前月份的 *usageBucket
+	months       map[string]*usageBucket // 由 Mutex 保护
+	limits       map[string]uint64       // 用户组设置的额度
+	defaultLimit uint64
+	thresholds   []int
+	history      int
+	webhook      string
+	file         string
+	client       *http.Client
+	ctx          context.Context
+	now          func() time.Time
+}
+
+// limit returns the monthly limit of the user, the lock must be held
+func (t *UsageTracker) limit(hash string) uint64 {
+	if limit, found := t.limits[hash]; found {
+		return limit
+	}
+	return t.defaultLimit
+}
+
+// bucket returns the bucket of the month, creating it and dropping the months beyond the history if needed.
+// The lock must be held
+func (t *UsageTracker) bucket(month string) *usageBucket {
+	if b, found := t.months[month]; found {
+		return b
+	}
+	b := &usageBucket{month: month}
+	t.months[month] = b
+	if len(t.months) > t.history {
+		months := make([]string, 0, len(t.months))
+		for m := range t.months {
+			months = append(months, m)
+		}
+		sort.Strings(months)
+		for _, m := range months[:len(months)-t.history] {
+			delete(t.months, m)
+		}
+	}
+	return b
+}
+
+// rollover switches the current bucket when the month changes
+func (t *UsageTracker) rollover(now time.Time) {
+	month := now.Format(monthFormat)
+	if b, ok := t.current.Load().(*usageBucket); ok && b.month == month {
+		return
+	}
+	t.Lock()
+	t.current.Store(t.bucket(month))
+	t.Unlock()
+	log.Info("monthly usage rolled over to", month)
+}
+
+func (t *UsageTracker) rolloverLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.rollover(t.now())
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// counter returns the counter of the user in the bucket
+func (t *UsageTracker) counter(b *usageBucket, hash string) *usageCounter {
+	if c, found := b.users.Load(hash); found {
+		return c.(*usageCounter)
+	}
+	t.Lock()
+	c := &usageCounter{limit: t.limit(hash)}
+	t.Unlock()
+	v, _ := b.users.LoadOrStore(hash, c)
+	return v.(*usageCounter)
+}
+
+// Add records the traffic into the counters of the current month
+func (t *UsageTracker) Add(hash string, sent, recv uint64) {
+	if sent == 0 && recv == 0 {
+		return
+	}
+	b := t.current.Load().(*usageBucket)
+	c := t.counter(b, hash)
+	used := atomic.AddUint64(&c.sent, sent) + atomic.AddUint64(&c.recv, recv)
+	limit := atomic.LoadUint64(&c.limit)
+	if limit == 0 {
+		return
+	}
+	for {
+		n := atomic.LoadInt32(&c.alerts)
+		if int(n) >= len(t.thresholds) || float64(used) < float64(limit)*float64(t.thresholds[n])/100 {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&c.alerts, n, n+1) {
+			t.alert(&UsageAlert{
+				User:      hash,
+				Month:     b.month,
+				Threshold: t.thresholds[n],
+				Used:      used,
+				Limit:     limit,
+				Time:      t.now().Unix(),
+			})
+		}
+	}
+}
+
+func (t *UsageTracker) alert(alert *UsageAlert) {
+	log.Warn("user", alert.User, "has used", alert.Threshold, "percent of the monthly traffic limit in", alert.Month)
+	if t.webhook == "" {
+		return
+	}
+	go func() {
+		payload, err := json.Marshal(alert)
+		common.Must(err)
+		ctx, cancel := context.WithTimeout(t.ctx, time.Second*5)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.webhook, bytes.NewReader(payload))
+		if err != nil {
+			log.Warn(common.NewError("invalid usage webhook " + t.webhook).Base(err))
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := t.client.Do(req)
+		if err != nil {
+			log.Warn(common.NewError("usage webhook " + t.webhook + " failed").Base(err))
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Warn("usage webhook", t.webhook, "returned", resp.Status)
+		}
+	}()
+}
+
+// SetLimit overrides the monthly limit of the user, 0 restores the default limit
+func (t *UsageTracker) SetLimit(hash string, limit uint64) {
+	t.Lock()
+	defer t.Unlock()
+	if limit == 0 {
+		delete(t.limits, hash)
+	} else {
+		t.limits[hash] = limit
+	}
+	if c, found := t.current.Load().(*usageBucket).users.Load(hash); found {
+		atomic.StoreUint64(&c.(*usageCounter).limit, t.limit(hash))
+	}
+}
+
+// CurrentMonth returns the month which the traffic is recorded into
+func (t *UsageTracker) CurrentMonth() string {
+	return t.current.Load().(*usageBucket).month
+}
+
+// usage reads the counters of the bucket
+func (t *UsageTracker) usage(b *usageBucket) map[string]*MonthlyUsage {
+	result := make(map[string]*MonthlyUsage)
+	b.users.Range(func(k, v interface{}) bool {
+		c := v.(*usageCounter)
+		n := int(atomic.LoadInt32(&c.alerts))
+		if n > len(t.thresholds) {
+			n = len(t.thresholds)
+		}
+		result[k.(string)] = &MonthlyUsage{
+			User:   k.(string),
+			Month:  b.month,
+			Sent:   atomic.LoadUint64(&c.sent),
+			Recv:   atomic.LoadUint64(&c.recv),
+			Limit:  atomic.LoadUint64(&c.limit),
+			Alerts: append([]int(nil), t.thresholds[:n]...),
+		}
+		return true
+	})
+	return result
+}
+
+// Usage returns the usage of the users in the month, the current month is used if month is empty
+func (t *UsageTracker) Usage(month string) []MonthlyUsage {
+	if month == "" {
+		month = t.CurrentMonth()
+	}
+	t.Lock()
+	b, found := t.months[month]
+	t.Unlock()
+	if !found {
+		return []MonthlyUsage{}
+	}
+	usage := t.usage(b)
+	result := make([]MonthlyUsage, 0, len(usage))
+	for _, u := range usage {
+		result = append(result, *u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].User < result[j].User
+	})
+	return result
+}
+
+// Months returns the recorded months in ascending order
+func (t *UsageTracker) Months() []string {
+	t.Lock()
+	defer t.Unlock()
+	months := make([]string, 0, len(t.months))
+	for month := range t.months {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+	return months
+}
+
+func (t *UsageTracker) save() error {
+	t.Lock()
+	buckets := make([]*usageBucket, 0, len(t.months))
+	for _, b := range t.months {
+		buckets = append(buckets, b)
+	}
+	t.Unlock()
+	months := make(map[string]map[string]*MonthlyUsage, len(buckets))
+	for _, b := range buckets {
+		months[b.month] = t.usage(b)
+	}
+	data, err := json.Marshal(months)
+	common.Must(err)
+	tmp := t.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.file)
+}
+
+// restore replaces the buckets with the saved usage
+func (t *UsageTracker) restore(months map[string]map[string]*MonthlyUsage) {
+	buckets := make(map[string]*usageBucket, len(months))
+	for month, users := range months {
+		b := &usageBucket{month: month}
+		for hash, u := range users {
+			alerts := 0 // 已触发的阈值个数
+			for _, threshold := range t.thresholds {
+				if len(u.Alerts) != 0 && threshold <= u.Alerts[len(u.Alerts)-1] {
+					alerts++
+				}
+			}
+			b.users.Store(hash, &usageCounter{
+				sent:   u.Sent,
+				recv:   u.Recv,
+				limit:  u.Limit,
+				alerts: int32(alerts),
+			})
+		}
+		buckets[month] = b
+	}
+	t.Lock()
+	t.months = buckets
+	t.current.Store(t.bucket(t.now().Format(monthFormat)))
+	t.Unlock()
+}
+
+func (t *UsageTracker) load() error {
+	data, err := ioutil.ReadFile(t.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	months := make(map[string]map[string]*MonthlyUsage)
+	if err := json.Unmarshal(data, &months); err != nil {
+		return err
+	}
+	t.restore(months)
+	return nil
+}
+
+// loadLoop keeps loading the usage saved by other processes in the read-only mode
+func (t *UsageTracker) loadLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			months := make(map[string]map[string]*MonthlyUsage)
+			data, err := ioutil.ReadFile(t.file)
+			if err == nil {
+				err = json.Unmarshal(data, &months)
+			}
+			if err != nil {
+				log.Error(common.NewError("failed to load monthly usage").Base(err))
+				continue
+			}
+			t.restore(months)
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *UsageTracker) saveLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.save(); err != nil {
+				log.Error(common.NewError("failed to save monthly usage").Base(err))
+			}
+		case <-t.ctx.Done():
+			if err := t.save(); err != nil {
+				log.Error(common.NewError("failed to save monthly usage").Base(err))
+			}
+			return
+		}
+	}
+}
+
+// NewUsageTracker loads the saved usage from the file in the config and keeps saving it until the context is done
+func NewUsageTracker(ctx context.Context, cfg *UsageConfig) (*UsageTracker, error) {
+	thresholds := append([]int(nil), cfg.Alerts...)
+	if len(thresholds) == 0 {
+		thresholds = []int{80, 100}
+	}
+	sort.Ints(thresholds)
+	for _, threshold := range thresholds {
+		if threshold <= 0 {
+			return nil, common.NewError("invalid usage alert threshold")
+		}
+	}
+	history := cfg.History
+	if history <= 0 {
+		history = 12
+	}
+	t := &UsageTracker{
+		months:       make(map[string]*usageBucket),
+		limits:       make(map[string]uint64),
+		defaultLimit: cfg.MonthlyLimit,
+		thresholds:   thresholds,
+		history:      history,
+		webhook:      cfg.Webhook,
+		file:         cfg.File,
+		client:       &http.Client{},
+		ctx:          ctx,
+		now:          time.Now,
+	}
+	t.current.Store(t.bucket(t.now().Format(monthFormat)))
+	if t.file != "" {
+		if err := t.load(); err != nil {
+			return nil, common.NewError("failed to load monthly usage from " + t.file).Base(err)
+		}
+		if IsReadOnly(ctx) {
+			go t.loadLoop()
+		} else {
+			go t.saveLoop()
+		}
+	}
+	go t.rolloverLoop(rolloverInterval)
+	return t, nil
+}
+
+type usageTrackerKey struct{}
+
+// WithUsageTracker stores the usage tracker into the context, so that the authenticators and the API service can access it
+func WithUsageTracker(ctx context.Context, t *UsageTracker) context.Context {
+	return context.WithValue(ctx, usageTrackerKey{}, t)
+}
+
+// UsageTrackerFromContext extracts the usage tracker from a context
+func UsageTrackerFromContext(ctx context.Context) *UsageTracker {
+	t, _ := ctx.Value(usageTrackerKey{}).(*UsageTracker)
+	return t
+}
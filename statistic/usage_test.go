@@ -0,0 +1,98 @@
+package statistic
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+func TestUsageTrackerConcurrentAdd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	usage, err := NewUsageTracker(ctx, &UsageConfig{
+		MonthlyLimit: 100000,
+		Alerts:       []int{50, 100},
+	})
+	common.Must(err)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				usage.Add("user", 3, 4)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := usage.Usage("")
+	if len(result) != 1 || result[0].Sent != 48000 || result[0].Recv != 64000 {
+		t.Fatal("wrong usage", result)
+	}
+	// 每个阈值只告警一次
+	if len(result[0].Alerts) != 2 || result[0].Alerts[0] != 50 || result[0].Alerts[1] != 100 {
+		t.Fatal("wrong alerts", result[0].Alerts)
+	}
+}
+
+func TestUsageTrackerRollover(t *testing.T) {
+	// 由测试驱动跨月
+	rolloverInterval = time.Hour
+	defer func() { rolloverInterval = time.Second }()
+	ctx, cancel := context.WithCancel(context.Background())
+	file := filepath.Join(t.TempDir(), "usage.json")
+	usage, err := NewUsageTracker(ctx, &UsageConfig{
+		MonthlyLimit: 1000,
+		File:         file,
+		History:      2,
+	})
+	common.Must(err)
+	now := time.Date(2030, 1, 31, 23, 59, 59, 0, time.UTC)
+	usage.rollover(now)
+	if usage.CurrentMonth() != "2030-01" {
+		t.Fatal("wrong month", usage.CurrentMonth())
+	}
+	usage.Add("user", 500, 400)
+	usage.SetLimit("user", 2000)
+
+	now = now.Add(time.Second)
+	usage.rollover(now)
+	if usage.CurrentMonth() != "2030-02" {
+		t.Fatal("wrong month", usage.CurrentMonth())
+	}
+	usage.Add("user", 10, 20)
+	if result := usage.Usage(""); len(result) != 1 || result[0].Sent != 10 || result[0].Recv != 20 || result[0].Limit != 2000 {
+		t.Fatal("usage not rolled over", result)
+	}
+	if result := usage.Usage("2030-01"); len(result) != 1 || result[0].Sent != 500 || result[0].Recv != 400 || len(result[0].Alerts) != 1 {
+		t.Fatal("wrong usage of the last month", result)
+	}
+
+	now = now.AddDate(0, 1, 0)
+	usage.rollover(now)
+	months := usage.Months()
+	if len(months) != 2 || months[0] != "2030-02" || months[1] != "2030-03" {
+		t.Fatal("history not pruned", months)
+	}
+
+	// 退出时保存，重新加载后保持计数和告警
+	usage.Add("user", 1600, 0)
+	cancel()
+	time.Sleep(time.Millisecond * 200)
+	usage, err = NewUsageTracker(context.Background(), &UsageConfig{
+		MonthlyLimit: 1000,
+		File:         file,
+		History:      2,
+	})
+	common.Must(err)
+	result := usage.Usage("2030-03")
+	if len(result) != 1 || result[0].Sent != 1600 || len(result[0].Alerts) != 1 || result[0].Alerts[0] != 80 {
+		t.Fatal("wrong saved usage", result)
+	}
+}
@@ -145,7 +145,7 @@ ssl:
 websocket:
     enabled: true
     path: /ws
-    host: somedomainname.com
+    host: localhost
 shadowsocks:
     enabled: true
     method: AEAD_CHACHA20_POLY1305
@@ -6,6 +6,7 @@ import (
 	"sync"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/backoff"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/tunnel"
@@ -26,17 +27,17 @@ type Server struct {
 }
 
 func (s *Server) acceptConnLoop() {
+	b := backoff.NewAcceptBackoff("adapter")
 	for {
 		conn, err := s.tcpListener.Accept()
 		if err != nil {
-			select {
-			case <-s.ctx.Done():
+			if !b.Wait(s.ctx, err) {
 				log.Debug("exiting")
 				return
-			default:
-				continue
 			}
+			continue
 		}
+		b.Reset()
 		rewindConn := common.NewRewindConn(conn)
 		rewindConn.SetBufferSize(16)
 		buf := [3]byte{}
@@ -0,0 +1,179 @@
+package brutal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/test/util"
+)
+
+func TestBrutal(t *testing.T) {
+	port := common.PickPort("udp", "127.0.0.1")
+	cfg := &Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+		Brutal: BrutalConfig{
+			UpMbps:   100,
+			DownMbps: 100,
+		},
+	}
+	ctx := config.WithConfig(context.Background(), Name, cfg)
+	s, err := NewServer(ctx, nil)
+	common.Must(err)
+	defer s.Close()
+	c, err := NewClient(ctx, nil)
+	common.Must(err)
+
+	conn1, err := c.DialConn(nil, nil)
+	common.Must(err)
+	conn2, err := s.AcceptConn(nil)
+	common.Must(err)
+	if !util.CheckConn(conn1, conn2) {
+		t.Fail()
+	}
+
+	// 一方关闭后另一方读取到 EOF
+	conn1.Close()
+	conn2.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := conn2.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("EOF expected", err)
+	}
+	conn2.Close()
+
+	if _, err := NewClient(config.WithConfig(context.Background(), Name, &Config{}), nil); err == nil {
+		t.Fatal("bandwidth should be required")
+	}
+}
+
+// lossyPipe delivers the packets between two connections, dropping some of them
+func lossyPipe(loss float64) (*Conn, *Conn) {
+	var a, b *Conn
+	link := func(to **Conn) func([]byte) error {
+		ch := make(chan []byte, 1024)
+		go func() {
+			for buf := range ch {
+				p, err := unmarshalPacket(buf)
+				common.Must(err)
+				(*to).input(p)
+			}
+		}()
+		return func(buf []byte) error {
+			if rand.Float64() < loss {
+				return nil
+			}
+			select {
+			case ch <- buf:
+			default: // 队列已满时同样丢弃
+			}
+			return nil
+		}
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	a = newConn(1, mbpsToBytes(50), addr, addr, link(&b), func() {})
+	b = newConn(1, mbpsToBytes(50), addr, addr, link(&a), func() {})
+	return a, b
+}
+
+func TestLossyLink(t *testing.T) {
+	a, b := lossyPipe(0.1)
+	// 序号在传输过程中回绕
+	start := uint32(math.MaxUint32 - 100)
+	a.lock.Lock()
+	a.nextSeq, a.peerAck, a.highestAck = start, start, start
+	a.lock.Unlock()
+	b.lock.Lock()
+	b.recvNext = start
+	b.lock.Unlock()
+	payload := util.GeneratePayload(1024 * 1024)
+	go func() {
+		common.Must2(a.Write(payload))
+		a.Close()
+	}()
+	b.SetReadDeadline(time.Now().Add(time.Second * 20))
+	buf := make([]byte, len(payload))
+	common.Must2(io.ReadFull(b, buf))
+	if !bytes.Equal(buf, payload) {
+		t.Fatal("payload mismatch")
+	}
+	if _, err := b.Read(buf); err != io.EOF {
+		t.Fatal("EOF expected", err)
+	}
+	b.Close()
+	// 丢包后发送速率提高以补偿
+	a.lock.Lock()
+	rate := a.cc.rate(time.Now())
+	a.lock.Unlock()
+	if rate <= float64(mbpsToBytes(50)) {
+		t.Fatal("rate not compensated", rate)
+	}
+}
+
+func TestHalfOpenLimit(t *testing.T) {
+	port := common.PickPort("udp", "127.0.0.1")
+	cfg := &Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+		Brutal: BrutalConfig{
+			UpMbps:   100,
+			DownMbps: 100,
+		},
+	}
+	ctx := config.WithConfig(context.Background(), Name, cfg)
+	s, err := NewServer(ctx, nil)
+	common.Must(err)
+	defer s.Close()
+
+	// 不完成握手的 SYN 不会创建连接，且数量受限
+	udpConn, err := net.Dial("udp", s.udpConn.LocalAddr().String())
+	common.Must(err)
+	defer udpConn.Close()
+	for i := 0; i < maxHalfOpenPerSource*2; i++ {
+		common.Must2(udpConn.Write((&packet{
+			typ:     typeSYN,
+			id:      uint32(i),
+			payload: marshalRates(0, 0),
+		}).marshal()))
+	}
+	time.Sleep(time.Millisecond * 200)
+	s.connsLock.Lock()
+	pending, conns := len(s.pending), len(s.conns)
+	s.connsLock.Unlock()
+	if pending != maxHalfOpenPerSource || conns != 0 {
+		t.Fatal("half-open connections not limited", pending, conns)
+	}
+
+	c, err := NewClient(ctx, nil)
+	common.Must(err)
+	if conn, err := c.DialConn(nil, nil); err == nil {
+		conn.Close()
+		t.Fatal("SYN over the limit accepted")
+	}
+
+	// 过期的半开连接被清理后可以正常连接
+	s.connsLock.Lock()
+	for _, h := range s.pending {
+		h.created = time.Now().Add(-halfOpenTimeout * 2)
+	}
+	s.connsLock.Unlock()
+	conn1, err := c.DialConn(nil, nil)
+	common.Must(err)
+	conn2, err := s.AcceptConn(nil)
+	common.Must(err)
+	if !util.CheckConn(conn1, conn2) {
+		t.Fail()
+	}
+	conn1.Close()
+	conn2.Close()
+}
@@ -0,0 +1,146 @@
+package brutal
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+const (
+	handshakeTimeout  = 10 * time.Second
+	handshakeInterval = 500 * time.Millisecond
+)
+
+// Client dials a udp socket for each connection
+type Client struct {
+	serverAddress string
+	upRate        uint64
+	downRate      uint64
+}
+
+func mbpsToBytes(mbps int) uint64 {
+	return uint64(mbps) * 1000 * 1000 / 8
+}
+
+// handshake sends the SYN until the SYNACK arrives, and returns the sending rate agreed by the server
+func (c *Client) handshake(conn *net.UDPConn, id uint32) (uint64, error) {
+	syn := (&packet{
+		typ:     typeSYN,
+		id:      id,
+		payload: marshalRates(c.upRate, c.downRate),
+	}).marshal()
+	deadline := time.Now().Add(handshakeTimeout)
+	buf := make([]byte, packetSize*2)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(syn); err != nil {
+			return 0, err
+		}
+		conn.SetReadDeadline(time.Now().Add(handshakeInterval))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break // 重新发送 SYN
+				}
+				return 0, err
+			}
+			p, err := unmarshalPacket(buf[:n])
+			if err != nil || p.id != id {
+				continue
+			}
+			if p.typ == typeRST {
+				return 0, common.NewError("brutal server refused the connection")
+			}
+			if p.typ != typeSYNACK {
+				continue
+			}
+			rates, err := unmarshalRates(p.payload, 1)
+			if err != nil {
+				return 0, err
+			}
+			conn.SetReadDeadline(time.Time{})
+			// 不超过服务端接收的带宽
+			rate := c.upRate
+			if rates[0] != 0 && rates[0] < rate {
+				rate = rates[0]
+			}
+			return rate, nil
+		}
+	}
+	return 0, common.NewError("brutal handshake timed out")
+}
+
+func (c *Client) DialConn(*tunnel.Address, tunnel.Tunnel) (tunnel.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", c.serverAddress)
+	if err != nil {
+		return nil, common.NewError("brutal failed to resolve the server address").Base(err)
+	}
+	udpConn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, common.NewError("brutal failed to dial the server").Base(err)
+	}
+	id := rand.Uint32()
+	rate, err := c.handshake(udpConn, id)
+	if err != nil {
+		udpConn.Close()
+		return nil, common.NewError("brutal failed to connect to the server").Base(err)
+	}
+	conn := newConn(id, rate, udpConn.LocalAddr(), udpConn.RemoteAddr(), func(b []byte) error {
+		_, err := udpConn.Write(b)
+		return err
+	}, func() {
+		udpConn.Close()
+	})
+	// 确认 SYNACK，服务端收到后才建立连接
+	conn.lock.Lock()
+	conn.scheduleAck(time.Now())
+	conn.lock.Unlock()
+	go func() {
+		buf := make([]byte, packetSize*2)
+		for {
+			n, err := udpConn.Read(buf)
+			if err != nil {
+				conn.lock.Lock()
+				conn.destroy(err)
+				conn.lock.Unlock()
+				return
+			}
+			p, err := unmarshalPacket(buf[:n])
+			if err != nil || p.id != id {
+				continue
+			}
+			conn.input(p)
+		}
+	}()
+	log.Debug("brutal connection to", addr, "established, sending at", rate*8/1000/1000, "mbps")
+	return conn, nil
+}
+
+func (c *Client) DialPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
+	return nil, common.NewError("brutal udp is not supported")
+}
+
+func (c *Client) Close() error {
+	return nil
+}
+
+// NewClient creates a brutal client
+func NewClient(ctx context.Context, _ tunnel.Client) (*Client, error) {
+	cfg := config.FromContext(ctx, Name).(*Config)
+	if cfg.Brutal.UpMbps <= 0 || cfg.Brutal.DownMbps <= 0 {
+		return nil, common.NewError("brutal up_mbps and down_mbps must be set")
+	}
+	log.Debug("brutal client created")
+	return &Client{
+		serverAddress: net.JoinHostPort(cfg.RemoteHost, strconv.Itoa(cfg.RemotePort)),
+		upRate:        mbpsToBytes(cfg.Brutal.UpMbps),
+		downRate:      mbpsToBytes(cfg.Brutal.DownMbps),
+	}, nil
+}
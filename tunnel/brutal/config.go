@@ -0,0 +1,22 @@
+package brutal
+
+import "github.com/p4gefau1t/trojan-go/config"
+
+type BrutalConfig struct {
+	UpMbps   int `json:"up_mbps" yaml:"up-mbps"`     // 本端发送的带宽
+	DownMbps int `json:"down_mbps" yaml:"down-mbps"` // 本端接收的带宽，对端的发送速率不会超过它
+}
+
+type Config struct {
+	LocalHost  string       `json:"local_addr" yaml:"local-addr"`
+	LocalPort  int          `json:"local_port" yaml:"local-port"`
+	RemoteHost string       `json:"remote_addr" yaml:"remote-addr"`
+	RemotePort int          `json:"remote_port" yaml:"remote-port"`
+	Brutal     BrutalConfig `json:"brutal" yaml:"brutal"`
+}
+
+func init() {
+	config.RegisterConfigCreator(Name, func() interface{} {
+		return &Config{}
+	})
+}
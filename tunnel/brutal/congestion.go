@@ -0,0 +1,99 @@
+package brutal
+
+import (
+	"time"
+)
+
+const (
+	statSlots   = 5   // 统计最近 5 秒的确认和丢失
+	minAckRate  = 0.8 // 丢包率再高也最多只补偿到 1.25 倍，避免加剧拥塞
+	minSamples  = 50
+	maxBurst    = 20 * time.Millisecond
+	minCwndTime = 50 * time.Millisecond
+)
+
+// brutal sends at a fixed rate, and increases the rate by the loss rate so that the goodput stays at the target
+type brutal struct {
+	bps    float64 // 目标速率，字节每秒
+	slots  [statSlots]struct{ sec, acked, lost int64 }
+	tokens float64
+	last   time.Time
+}
+
+func (b *brutal) slot(now time.Time) *struct{ sec, acked, lost int64 } {
+	sec := now.Unix()
+	s := &b.slots[sec%statSlots]
+	if s.sec != sec {
+		s.sec, s.acked, s.lost = sec, 0, 0
+	}
+	return s
+}
+
+func (b *brutal) onAck(now time.Time, n int) {
+	b.slot(now).acked += int64(n)
+}
+
+func (b *brutal) onLoss(now time.Time, n int) {
+	b.slot(now).lost += int64(n)
+}
+
+// ackRate is the ratio of the packets acknowledged recently
+func (b *brutal) ackRate(now time.Time) float64 {
+	var acked, lost int64
+	for _, s := range b.slots {
+		if now.Unix()-s.sec < statSlots {
+			acked += s.acked
+			lost += s.lost
+		}
+	}
+	if acked+lost < minSamples {
+		return 1
+	}
+	rate := float64(acked) / float64(acked+lost)
+	if rate < minAckRate {
+		return minAckRate
+	}
+	return rate
+}
+
+// rate returns the sending rate in bytes per second
+func (b *brutal) rate(now time.Time) float64 {
+	return b.bps / b.ackRate(now)
+}
+
+// cwnd limits the bytes in flight to twice of the bandwidth delay product
+func (b *brutal) cwnd(now time.Time, rtt time.Duration) int {
+	if rtt < minCwndTime {
+		rtt = minCwndTime
+	}
+	return int(b.rate(now)*rtt.Seconds()*2) + 10*packetSize
+}
+
+// allow paces the packets with a token bucket
+func (b *brutal) allow(now time.Time, n int) bool {
+	rate := b.rate(now)
+	if !b.last.IsZero() {
+		b.tokens += rate * now.Sub(b.last).Seconds()
+	}
+	b.last = now
+	if burst := rate*maxBurst.Seconds() + packetSize; b.tokens > burst {
+		b.tokens = burst
+	}
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// wait returns how long it takes to accumulate the tokens of n bytes, after allow has failed at now
+func (b *brutal) wait(now time.Time, n int) time.Duration {
+	return time.Duration((float64(n) - b.tokens) / b.rate(now) * float64(time.Second))
+}
+
+func newBrutal(bps uint64) *brutal {
+	return &brutal{
+		bps:    float64(bps),
+		tokens: packetSize * 10,
+	}
+}
@@ -0,0 +1,585 @@
+package brutal
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+const (
+	window        = 4096 // 发送和接收缓冲的最大分段数
+	ackDelay      = 5 * time.Millisecond
+	minInterval   = time.Millisecond
+	initialRTO    = time.Second
+	minRTO        = 200 * time.Millisecond
+	maxRTO        = 10 * time.Second
+	keepAlive     = 10 * time.Second
+	idleTimeout   = 60 * time.Second
+	lingerTimeout = 10 * time.Second // 关闭后等待对端确认的最长时间
+	dupThreshold  = 3                // 之后的分段被确认了 3 个时视为丢失
+)
+
+var (
+	errClosed = common.NewError("brutal connection closed")
+	errReset  = common.NewError("brutal connection reset by peer")
+	errIdle   = common.NewError("brutal connection timed out")
+)
+
+type segment struct {
+	seq           uint32
+	typ           byte
+	data          []byte
+	sentAt        time.Time
+	retransmitted bool
+	acked         bool
+}
+
+// Conn is a reliable stream over udp
+type Conn struct {
+	id      uint32
+	output  func([]byte) error
+	local   net.Addr
+	remote  net.Addr
+	onClose func()
+
+	lock sync.Mutex
+	cc   *brutal
+	// 发送
+	queue      []*segment // 从最早的未确认分段开始，序号连续
+	sent       int        // queue 中已经发送过的分段数
+	nextSeq    uint32
+	peerAck    uint32
+	peerWindow uint32
+	highestAck uint32 // 选择确认的最大序号加一
+	srtt       time.Duration
+	rttvar     time.Duration
+	// 接收
+	recvNext    uint32
+	recvBuf     map[uint32]*segment
+	readBuf     []byte
+	finReceived bool
+	needAck     bool
+	ackAt       time.Time
+	advertised  uint16
+	// 状态
+	lastRecv      time.Time
+	lastSend      time.Time
+	closing       bool
+	closeTime     time.Time
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readable chan struct{}
+	writable chan struct{}
+	notify   chan struct{}
+	die      chan struct{}
+	dieOnce  sync.Once
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// seqLess compares the sequence numbers with serial number arithmetic, so that they can wrap around
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func earlier(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func (c *Conn) Metadata() *tunnel.Metadata {
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	signal(c.readable) // 唤醒阻塞的读取，重新检查超时
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.writeDeadline = t
+	c.lock.Unlock()
+	signal(c.writable)
+	return nil
+}
+
+func (c *Conn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+	case <-c.die:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// window returns the number of segments the receive buffer can hold
+func (c *Conn) window() uint16 {
+	used := len(c.recvBuf) + (len(c.readBuf)+mss-1)/mss
+	if used >= window {
+		return 0
+	}
+	return uint16(window - used)
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		c.lock.Lock()
+		if len(c.readBuf) != 0 {
+			n := copy(p, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			if c.advertised < window/4 { // 对端可能因为窗口已满而停止发送
+				c.scheduleAck(time.Now())
+			}
+			c.lock.Unlock()
+			return n, nil
+		}
+		if c.finReceived {
+			c.lock.Unlock()
+			return 0, io.EOF
+		}
+		if c.closing {
+			c.lock.Unlock()
+			return 0, errClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.lock.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.lock.Unlock()
+		if err := c.wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	defer signal(c.notify)
+	for len(p) > 0 {
+		c.lock.Lock()
+		if c.closing {
+			c.lock.Unlock()
+			return written, errClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.lock.Unlock()
+			return written, err
+		}
+		if len(c.queue) >= window {
+			deadline := c.writeDeadline
+			c.lock.Unlock()
+			signal(c.notify)
+			if err := c.wait(c.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		for len(p) > 0 && len(c.queue) < window {
+			n := len(p)
+			if n > mss {
+				n = mss
+			}
+			c.queue = append(c.queue, &segment{
+				seq:  c.nextSeq,
+				typ:  typeData,
+				data: append([]byte(nil), p[:n]...),
+			})
+			c.nextSeq++
+			written += n
+			p = p[n:]
+		}
+		c.lock.Unlock()
+	}
+	return written, nil
+}
+
+// Close sends the remaining data and then a FIN, the connection lingers until they are acknowledged
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	if c.closing || c.err != nil {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closing = true
+	c.closeTime = time.Now()
+	c.queue = append(c.queue, &segment{
+		seq: c.nextSeq,
+		typ: typeFIN,
+	})
+	c.nextSeq++
+	c.lock.Unlock()
+	signal(c.notify)
+	signal(c.readable)
+	return nil
+}
+
+// destroy releases the connection immediately, the lock must be held
+func (c *Conn) destroy(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.dieOnce.Do(func() {
+		close(c.die)
+		go c.onClose()
+	})
+}
+
+// sack returns the bitmap of the segments received after the missing one
+func (c *Conn) sack() uint64 {
+	var sack uint64
+	if len(c.recvBuf) == 0 {
+		return 0
+	}
+	for i := uint32(0); i < 64; i++ {
+		if _, found := c.recvBuf[c.recvNext+1+i]; found {
+			sack |= 1 << i
+		}
+	}
+	return sack
+}
+
+// scheduleAck sends an ACK after ackDelay, so that the segments received meanwhile are acknowledged together.
+// The lock must be held
+func (c *Conn) scheduleAck(now time.Time) {
+	if c.needAck {
+		return
+	}
+	c.needAck = true
+	c.ackAt = now.Add(ackDelay)
+	signal(c.notify)
+}
+
+func (c *Conn) send(typ byte, seq uint32, payload []byte, now time.Time) {
+	c.advertised = c.window()
+	p := &packet{
+		typ:     typ,
+		id:      c.id,
+		seq:     seq,
+		ack:     c.recvNext,
+		sack:    c.sack(),
+		window:  c.advertised,
+		payload: payload,
+	}
+	c.output(p.marshal())
+	c.lastSend = now
+	c.needAck = false
+}
+
+func (c *Conn) rto() time.Duration {
+	if c.srtt == 0 {
+		return initialRTO
+	}
+	rto := c.srtt + 4*c.rttvar
+	if rto < minRTO {
+		return minRTO
+	}
+	if rto > maxRTO {
+		return maxRTO
+	}
+	return rto
+}
+
+func (c *Conn) updateRTT(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+		return
+	}
+	delta := c.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	c.rttvar = (3*c.rttvar + delta) / 4
+	c.srtt = (7*c.srtt + rtt) / 8
+}
+
+// flush retransmits the lost segments, sends the new ones as the pacing allows, and checks the timeouts.
+// It returns when it needs to be called again, unless a packet or a write comes earlier
+func (c *Conn) flush(now time.Time) time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return now.Add(idleTimeout)
+	}
+	if now.Sub(c.lastRecv) > idleTimeout || (c.closing && now.Sub(c.closeTime) > lingerTimeout) {
+		c.send(typeRST, 0, nil, now)
+		c.destroy(errIdle)
+		return now.Add(idleTimeout)
+	}
+	next := c.lastRecv.Add(idleTimeout)
+	if c.closing {
+		next = earlier(next, c.closeTime.Add(lingerTimeout))
+	}
+
+	rto := c.rto()
+	fastRTO := c.srtt
+	if fastRTO < ackDelay {
+		fastRTO = ackDelay
+	}
+	inflight := 0
+	for _, seg := range c.queue[:c.sent] {
+		if seg.acked {
+			continue
+		}
+		size := headerSize + len(seg.data)
+		fast := seqLess(seg.seq+dupThreshold, c.highestAck)
+		lost := now.Sub(seg.sentAt) > rto || (fast && now.Sub(seg.sentAt) > fastRTO)
+		if lost {
+			if !c.cc.allow(now, size) {
+				next = earlier(next, now.Add(c.cc.wait(now, size)))
+				inflight += size
+				continue
+			}
+			c.cc.onLoss(now, 1)
+			seg.retransmitted = true
+			seg.sentAt = now
+			c.send(seg.typ, seg.seq, seg.data, now)
+		}
+		next = earlier(next, seg.sentAt.Add(rto))
+		if fast {
+			next = earlier(next, seg.sentAt.Add(fastRTO))
+		}
+		inflight += size
+	}
+
+	// 受窗口限制时等待对端的确认
+	cwnd := c.cc.cwnd(now, c.srtt)
+	for c.sent < len(c.queue) {
+		seg := c.queue[c.sent]
+		size := headerSize + len(seg.data)
+		if !seqLess(seg.seq, c.peerAck+c.peerWindow) || inflight+size > cwnd {
+			break
+		}
+		if !c.cc.allow(now, size) {
+			next = earlier(next, now.Add(c.cc.wait(now, size)))
+			break
+		}
+		seg.sentAt = now
+		c.send(seg.typ, seg.seq, seg.data, now)
+		next = earlier(next, now.Add(rto))
+		c.sent++
+		inflight += size
+	}
+
+	if (c.needAck && !now.Before(c.ackAt)) || now.Sub(c.lastSend) >= keepAlive {
+		c.send(typeACK, 0, nil, now)
+	} else if c.needAck {
+		next = earlier(next, c.ackAt)
+	}
+	next = earlier(next, c.lastSend.Add(keepAlive))
+	// 双方的数据和 FIN 都已经确认
+	if c.closing && len(c.queue) == 0 && c.finReceived {
+		c.destroy(errClosed)
+	}
+	return next
+}
+
+// run sleeps until the next retransmission, pacing, ack or timeout deadline
+func (c *Conn) run() {
+	timer := time.NewTimer(minInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-c.notify:
+		case <-c.die:
+			return
+		}
+		now := time.Now()
+		d := c.flush(now).Sub(now)
+		if d < minInterval {
+			d = minInterval
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d)
+	}
+}
+
+// processAck removes the acknowledged segments from the queue, and returns whether more segments may be sent
+func (c *Conn) processAck(p *packet, now time.Time) bool {
+	if seqLess(c.nextSeq, p.ack) { // 确认了没有发送过的分段
+		return false
+	}
+	progress := false
+	if !seqLess(p.ack, c.peerAck) {
+		progress = p.ack != c.peerAck || uint32(p.window) > c.peerWindow
+		c.peerAck = p.ack
+		c.peerWindow = uint32(p.window)
+	}
+	acked := 0
+	var sample time.Duration
+	for len(c.queue) != 0 && seqLess(c.queue[0].seq, p.ack) && c.sent > 0 {
+		seg := c.queue[0]
+		if !seg.acked {
+			acked++
+			if !seg.retransmitted {
+				sample = now.Sub(seg.sentAt)
+			}
+		}
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		c.sent--
+	}
+	if len(c.queue) != 0 && p.sack != 0 {
+		base := c.queue[0].seq
+		for i := uint32(0); i < 64; i++ {
+			if p.sack&(1<<i) == 0 {
+				continue
+			}
+			seq := p.ack + 1 + i
+			if seqLess(seq, base) || int(seq-base) >= c.sent {
+				continue
+			}
+			if seg := c.queue[seq-base]; !seg.acked {
+				seg.acked = true
+				acked++
+				if !seg.retransmitted {
+					sample = now.Sub(seg.sentAt)
+				}
+			}
+			if seqLess(c.highestAck, seq+1) {
+				c.highestAck = seq + 1
+			}
+		}
+	}
+	if acked != 0 {
+		c.cc.onAck(now, acked)
+		signal(c.writable)
+		progress = true
+	}
+	if sample > 0 {
+		c.updateRTT(sample)
+	}
+	return progress
+}
+
+// receive buffers the segment and delivers the continuous ones to the reader
+func (c *Conn) receive(p *packet, now time.Time) {
+	c.scheduleAck(now)
+	if seqLess(p.seq, c.recvNext) || !seqLess(p.seq, c.recvNext+window) {
+		return
+	}
+	if _, found := c.recvBuf[p.seq]; found {
+		return
+	}
+	c.recvBuf[p.seq] = &segment{
+		typ:  p.typ,
+		data: append([]byte(nil), p.payload...),
+	}
+	delivered := false
+	for {
+		seg, found := c.recvBuf[c.recvNext]
+		if !found {
+			break
+		}
+		delete(c.recvBuf, c.recvNext)
+		c.recvNext++
+		if seg.typ == typeFIN {
+			c.finReceived = true
+		} else {
+			c.readBuf = append(c.readBuf, seg.data...)
+		}
+		delivered = true
+	}
+	if delivered {
+		signal(c.readable)
+	}
+}
+
+// input handles a packet from the peer
+func (c *Conn) input(p *packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	now := time.Now()
+	c.lastRecv = now
+	switch p.typ {
+	case typeRST:
+		c.destroy(errReset)
+		return
+	case typeSYN, typeSYNACK:
+		return
+	}
+	if c.processAck(p, now) {
+		signal(c.notify)
+	}
+	if p.typ == typeData || p.typ == typeFIN {
+		c.receive(p, now)
+	}
+}
+
+func newConn(id uint32, sendRate uint64, local, remote net.Addr, output func([]byte) error, onClose func()) *Conn {
+	c := &Conn{
+		id:         id,
+		output:     output,
+		local:      local,
+		remote:     remote,
+		onClose:    onClose,
+		cc:         newBrutal(sendRate),
+		peerWindow: window,
+		recvBuf:    make(map[uint32]*segment),
+		lastRecv:   time.Now(),
+		lastSend:   time.Now(),
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		notify:     make(chan struct{}, 1),
+		die:        make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
@@ -0,0 +1,83 @@
+package brutal
+
+import (
+	"encoding/binary"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// 包的类型
+const (
+	typeSYN    byte = 1 // 客户端发起连接，携带双方向的带宽
+	typeSYNACK byte = 2 // 服务端接受连接，携带服务端接收的带宽
+	typeData   byte = 3
+	typeFIN    byte = 4 // 数据结束，与数据包共用序号
+	typeACK    byte = 5
+	typeRST    byte = 6 // 立即关闭连接
+)
+
+const (
+	headerSize = 1 + 4 + 4 + 4 + 8 + 2
+	packetSize = 1200 // 避免在常见的链路上分片
+	mss        = packetSize - headerSize
+)
+
+// packet is [type 1][conn id 4][seq 4][ack 4][sack 8][window 2][payload].
+// Every packet acknowledges the data received so far: ack is the next expected seq, the i-th bit of sack
+// tells whether seq ack+1+i has been received, and window is the number of segments the receiver can buffer
+type packet struct {
+	typ     byte
+	id      uint32
+	seq     uint32
+	ack     uint32
+	sack    uint64
+	window  uint16
+	payload []byte
+}
+
+func (p *packet) marshal() []byte {
+	buf := make([]byte, headerSize+len(p.payload))
+	buf[0] = p.typ
+	binary.BigEndian.PutUint32(buf[1:], p.id)
+	binary.BigEndian.PutUint32(buf[5:], p.seq)
+	binary.BigEndian.PutUint32(buf[9:], p.ack)
+	binary.BigEndian.PutUint64(buf[13:], p.sack)
+	binary.BigEndian.PutUint16(buf[21:], p.window)
+	copy(buf[headerSize:], p.payload)
+	return buf
+}
+
+func unmarshalPacket(buf []byte) (*packet, error) {
+	if len(buf) < headerSize || buf[0] < typeSYN || buf[0] > typeRST {
+		return nil, common.NewError("invalid brutal packet")
+	}
+	return &packet{
+		typ:     buf[0],
+		id:      binary.BigEndian.Uint32(buf[1:]),
+		seq:     binary.BigEndian.Uint32(buf[5:]),
+		ack:     binary.BigEndian.Uint32(buf[9:]),
+		sack:    binary.BigEndian.Uint64(buf[13:]),
+		window:  binary.BigEndian.Uint16(buf[21:]),
+		payload: buf[headerSize:],
+	}, nil
+}
+
+// 握手包中的带宽，单位为字节每秒，0 表示不限制
+func marshalRates(rates ...uint64) []byte {
+	buf := make([]byte, 8*len(rates))
+	for i, rate := range rates {
+		binary.BigEndian.PutUint64(buf[8*i:], rate)
+	}
+	return buf
+}
+
+func unmarshalRates(buf []byte, n int) ([]uint64, error) {
+	if len(buf) < 8*n {
+		return nil, common.NewError("invalid brutal handshake")
+	}
+	rates := make([]uint64, n)
+	for i := range rates {
+		rates[i] = binary.BigEndian.Uint64(buf[8*i:])
+	}
+	return rates, nil
+}
@@ -0,0 +1,233 @@
+package brutal
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+const (
+	maxHalfOpen          = 1024 // 尚未收到客户端确认的连接数上限
+	maxHalfOpenPerSource = 16
+	halfOpenTimeout      = handshakeTimeout + keepAlive // 客户端确认丢失时，之后的保活包也会完成握手
+)
+
+type connKey struct {
+	addr string
+	id   uint32
+}
+
+// halfOpen is a SYN answered with a SYNACK. No connection is created for it until the client
+// acknowledges the SYNACK, so that spoofed SYNs can not exhaust the server
+type halfOpen struct {
+	rate    uint64
+	source  string
+	created time.Time
+}
+
+// Server accepts the connections of all the clients from one udp socket
+type Server struct {
+	udpConn   *net.UDPConn
+	upRate    uint64
+	downRate  uint64
+	conns     map[connKey]*Conn
+	pending   map[connKey]*halfOpen
+	sources   map[string]int // 每个源地址的半开连接数
+	connsLock sync.Mutex
+	connChan  chan tunnel.Conn
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+func (s *Server) reply(typ byte, id uint32, payload []byte, addr *net.UDPAddr) {
+	s.udpConn.WriteToUDP((&packet{
+		typ:     typ,
+		id:      id,
+		payload: payload,
+	}).marshal(), addr)
+}
+
+// expire drops the half-open connections that are not acknowledged in time, the lock must be held
+func (s *Server) expire(now time.Time) {
+	for key, h := range s.pending {
+		if now.Sub(h.created) > halfOpenTimeout {
+			s.dropHalfOpen(key, h)
+		}
+	}
+}
+
+func (s *Server) dropHalfOpen(key connKey, h *halfOpen) {
+	delete(s.pending, key)
+	if s.sources[h.source]--; s.sources[h.source] <= 0 {
+		delete(s.sources, h.source)
+	}
+}
+
+// accept answers a SYN, the sending rate is limited by the bandwidth of both sides
+func (s *Server) accept(key connKey, p *packet, addr *net.UDPAddr) {
+	rates, err := unmarshalRates(p.payload, 2)
+	if err != nil {
+		log.Debug(common.NewError("invalid handshake from " + addr.String()).Base(err))
+		return
+	}
+	rate := rates[1]
+	if s.upRate != 0 && (rate == 0 || s.upRate < rate) {
+		rate = s.upRate
+	}
+	if rate == 0 {
+		s.reply(typeRST, p.id, nil, addr)
+		return
+	}
+	now := time.Now()
+	source := addr.IP.String()
+	if len(s.pending) >= maxHalfOpen || s.sources[source] >= maxHalfOpenPerSource {
+		s.expire(now)
+		if len(s.pending) >= maxHalfOpen || s.sources[source] >= maxHalfOpenPerSource {
+			// 不回复，避免被用于反射放大
+			log.Debug("brutal too many half-open connections, SYN from", addr, "dropped")
+			return
+		}
+	}
+	s.pending[key] = &halfOpen{
+		rate:    rate,
+		source:  source,
+		created: now,
+	}
+	s.sources[source]++
+	s.reply(typeSYNACK, p.id, marshalRates(s.downRate), addr)
+}
+
+// establish creates the connection of a half-open one acknowledged by the client
+func (s *Server) establish(key connKey, h *halfOpen, addr *net.UDPAddr) *Conn {
+	s.dropHalfOpen(key, h)
+	conn := newConn(key.id, h.rate, s.udpConn.LocalAddr(), addr, func(b []byte) error {
+		_, err := s.udpConn.WriteToUDP(b, addr)
+		return err
+	}, func() {
+		s.connsLock.Lock()
+		delete(s.conns, key)
+		s.connsLock.Unlock()
+	})
+	s.conns[key] = conn
+	log.Info("brutal connection from", addr)
+	go func() {
+		select {
+		case s.connChan <- conn:
+		case <-s.ctx.Done():
+			conn.Close()
+		}
+	}()
+	return conn
+}
+
+func (s *Server) readLoop() {
+	buf := make([]byte, packetSize*2)
+	for {
+		n, addr, err := s.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+			default:
+				log.Error(common.NewError("brutal failed to read from udp").Base(err))
+				s.cancel()
+			}
+			return
+		}
+		p, err := unmarshalPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		key := connKey{addr: addr.String(), id: p.id}
+		s.connsLock.Lock()
+		conn, found := s.conns[key]
+		h, pending := s.pending[key]
+		switch {
+		case (found || pending) && p.typ == typeSYN:
+			// SYNACK 丢失时客户端重新发送 SYN
+			s.reply(typeSYNACK, p.id, marshalRates(s.downRate), addr)
+		case found:
+			s.connsLock.Unlock()
+			conn.input(p)
+			continue
+		case pending && p.typ == typeRST:
+			s.dropHalfOpen(key, h)
+		case pending:
+			conn := s.establish(key, h, addr)
+			s.connsLock.Unlock()
+			conn.input(p)
+			continue
+		case p.typ == typeSYN:
+			s.accept(key, p, addr)
+		case p.typ != typeRST:
+			s.reply(typeRST, p.id, nil, addr)
+		}
+		s.connsLock.Unlock()
+	}
+}
+
+func (s *Server) AcceptConn(tunnel.Tunnel) (tunnel.Conn, error) {
+	select {
+	case conn := <-s.connChan:
+		return conn, nil
+	case <-s.ctx.Done():
+		return nil, common.NewError("brutal server closed")
+	}
+}
+
+func (s *Server) AcceptPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
+	return nil, common.NewError("brutal udp is not supported")
+}
+
+func (s *Server) Close() error {
+	s.cancel()
+	s.connsLock.Lock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.pending = make(map[connKey]*halfOpen)
+	s.sources = make(map[string]int)
+	s.connsLock.Unlock()
+	for _, conn := range conns {
+		conn.lock.Lock()
+		conn.send(typeRST, 0, nil, time.Now())
+		conn.destroy(errClosed)
+		conn.lock.Unlock()
+	}
+	return s.udpConn.Close()
+}
+
+// NewServer creates a brutal server
+func NewServer(ctx context.Context, _ tunnel.Server) (*Server, error) {
+	cfg := config.FromContext(ctx, Name).(*Config)
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(cfg.LocalHost, strconv.Itoa(cfg.LocalPort)))
+	if err != nil {
+		return nil, common.NewError("brutal invalid listen address").Base(err)
+	}
+	udpConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, common.NewError("brutal failed to listen").Base(err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	server := &Server{
+		udpConn:  udpConn,
+		upRate:   mbpsToBytes(cfg.Brutal.UpMbps),
+		downRate: mbpsToBytes(cfg.Brutal.DownMbps),
+		conns:    make(map[connKey]*Conn),
+		pending:  make(map[connKey]*halfOpen),
+		sources:  make(map[string]int),
+		connChan: make(chan tunnel.Conn, 32),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	go server.readLoop()
+	log.Info("brutal server listening on udp", udpConn.LocalAddr())
+	return server, nil
+}
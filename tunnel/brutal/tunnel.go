@@ -0,0 +1,30 @@
+// Package brutal implements an experimental reliable stream transport over UDP. Like Hysteria, it sends at the
+// configured bandwidth and compensates for the packet loss instead of backing off, which suits lossy international
+// links. It replaces the transport tunnel at the bottom of the stack, and the packets are not encrypted by itself
+package brutal
+
+import (
+	"context"
+
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+const Name = "BRUTAL"
+
+type Tunnel struct{}
+
+func (*Tunnel) Name() string {
+	return Name
+}
+
+func (*Tunnel) NewClient(ctx context.Context, client tunnel.Client) (tunnel.Client, error) {
+	return NewClient(ctx, client)
+}
+
+func (*Tunnel) NewServer(ctx context.Context, server tunnel.Server) (tunnel.Server, error) {
+	return NewServer(ctx, server)
+}
+
+func init() {
+	tunnel.RegisterTunnel(Name, &Tunnel{})
+}
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// ReadDeadline implements the read deadline of the packet conns which receive packets from channels.
+// The socket under these conns is shared with other conns, so its own deadline can't be used.
+// The zero value is ready to use and has no deadline
+type ReadDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // 到达截止时间后关闭
+}
+
+// Set sets the deadline, the zero time means no deadline
+func (d *ReadDeadline) Set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // 等待计时器关闭 cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// Wait returns a channel which is closed when the deadline is exceeded
+func (d *ReadDeadline) Wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
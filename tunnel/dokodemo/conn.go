@@ -3,13 +3,13 @@ package dokodemo
 import (
 	"context"
 	"net"
+	"os"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
 
-const MaxPacketSize = 1024 * 8
-
 type Conn struct {
 	net.Conn
 	src            *tunnel.Address
@@ -29,6 +29,7 @@ type PacketConn struct {
 	src      net.Addr
 	ctx      context.Context
 	cancel   context.CancelFunc
+	deadline tunnel.ReadDeadline
 }
 
 func (c *PacketConn) Close() error {
@@ -56,11 +57,27 @@ func (c *PacketConn) ReadWithMetadata(p []byte) (int, *tunnel.Metadata, error) {
 	case payload := <-c.input:
 		n := copy(p, payload)
 		return n, c.metadata, nil
+	case <-c.deadline.Wait():
+		return 0, nil, os.ErrDeadlineExceeded
 	case <-c.ctx.Done():
 		return 0, nil, common.NewError("dokodemo packet conn closed")
 	}
 }
 
+// SetReadDeadline doesn't touch the shared udp socket
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.deadline.Set(t)
+	return nil
+}
+
+func (c *PacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
 func (c *PacketConn) WriteWithMetadata(p []byte, m *tunnel.Metadata) (int, error) {
 	select {
 	case c.output <- p:
@@ -6,6 +6,7 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
@@ -94,3 +95,47 @@ func TestDokodemo(t *testing.T) {
 	wg.Wait()
 	s.Close()
 }
+
+func TestReadDeadline(t *testing.T) {
+	cfg := &Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  common.PickPort("udp", "127.0.0.1"),
+		TargetHost: "127.0.0.1",
+		TargetPort: common.PickPort("udp", "127.0.0.1"),
+		UDPTimeout: 30,
+	}
+	ctx := config.WithConfig(context.Background(), Name, cfg)
+	s, err := NewServer(ctx, nil)
+	common.Must(err)
+	defer s.Close()
+
+	client, err := net.ListenPacket("udp", "")
+	common.Must(err)
+	defer client.Close()
+	serverAddr := &net.UDPAddr{
+		IP:   net.ParseIP("127.0.0.1"),
+		Port: cfg.LocalPort,
+	}
+	common.Must2(client.WriteTo([]byte("hello"), serverAddr))
+	conn, err := s.AcceptPacket(nil)
+	common.Must(err)
+	buf := [100]byte{}
+	_, _, err = conn.ReadWithMetadata(buf[:])
+	common.Must(err)
+
+	common.Must(conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100)))
+	if _, _, err := conn.ReadWithMetadata(buf[:]); err == nil {
+		t.Fatal("read should time out")
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatal("not a timeout error:", err)
+	}
+
+	// 清除截止时间后可以继续读取，共享的 UDP 套接字不受影响
+	common.Must(conn.SetReadDeadline(time.Time{}))
+	common.Must2(client.WriteTo([]byte("world"), serverAddr))
+	n, _, err := conn.ReadWithMetadata(buf[:])
+	common.Must(err)
+	if string(buf[:n]) != "world" {
+		t.Fatal("wrong payload", string(buf[:n]))
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/backoff"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/tunnel"
@@ -31,17 +32,18 @@ func (s *Server) dispatchLoop() {
 	fixedMetadata := &tunnel.Metadata{
 		Address: s.targetAddr,
 	}
+	b := backoff.NewAcceptBackoff("dokodemo_udp")
 	for {
-		buf := make([]byte, MaxPacketSize)
+		buf := make([]byte, common.PacketSize())
 		n, addr, err := s.udpListener.ReadFrom(buf)
 		if err != nil {
-			select {
-			case <-s.ctx.Done():
-			default:
-				log.Fatal(common.NewError("dokodemo failed to read from udp socket").Base(err))
+			// 仅在关闭时退出，其他错误等待后继续读取
+			if !b.Wait(s.ctx, err) {
+				return
 			}
-			return
+			continue
 		}
+		b.Reset()
 		log.Debug("udp packet from", addr)
 		s.mappingLock.Lock()
 		if conn, found := s.mapping[addr.String()]; found {
@@ -94,7 +96,8 @@ func (s *Server) dispatchLoop() {
 func (s *Server) AcceptConn(tunnel.Tunnel) (tunnel.Conn, error) {
 	conn, err := s.tcpListener.Accept() // 直接获取 TCP 连接
 	if err != nil {
-		log.Fatal(common.NewError("dokodemo failed to accept connection").Base(err))
+		// 由上层的接收循环等待后重试
+		return nil, common.NewError("dokodemo failed to accept connection").Base(err)
 	}
 	return &Conn{ // 封装和返回连接对象
 		Conn: conn,
@@ -0,0 +1,87 @@
+package freedom
+
+import (
+	"context"
+	"net"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/sockopt"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/statistic/memory"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// binding is the source address and the interface of the outbound connections of a user
+type binding struct {
+	ip      net.IP          // 为空时由系统选择源地址
+	control sockopt.Control // 为空时使用 outbound_interface
+}
+
+// network returns the network restricted to the family of the source ip, e.g. tcp4
+func (b *binding) network(network string) string {
+	if b.ip == nil {
+		return network
+	}
+	if b.ip.To4() != nil {
+		return network[:3] + "4"
+	}
+	return network[:3] + "6"
+}
+
+// userBindings maps the users and the groups to their bindings
+type userBindings struct {
+	selector *memory.Selector
+	bindings []*binding // 与 outbound_bindings 一一对应
+}
+
+// bindingOf returns the binding of the user of the request, nil if there is none
+func (c *Client) bindingOf(metadata *tunnel.Metadata) *binding {
+	if metadata == nil || metadata.User == nil || c.bindings.selector == nil {
+		return nil
+	}
+	if i, found := c.bindings.selector.Select(metadata.User); found {
+		return c.bindings.bindings[i]
+	}
+	return nil
+}
+
+// newBindings maps the users and the groups to their bindings, a user only uses the first binding containing it.
+// The groups of the users are looked up at dial time, so that the members changed on reload use their new bindings
+func newBindings(ctx context.Context, cfgs []OutboundBindingConfig) (userBindings, error) {
+	bindings := userBindings{
+		selector: memory.NewSelector(),
+		bindings: make([]*binding, 0, len(cfgs)),
+	}
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		b := &binding{
+			control: sockopt.BindToInterface(cfg.Interface),
+		}
+		if cfg.SourceIP != "" {
+			if b.ip = net.ParseIP(cfg.SourceIP); b.ip == nil {
+				return userBindings{}, common.NewError("invalid outbound source ip: " + cfg.SourceIP)
+			}
+		}
+		hashes := make([]string, 0, len(cfg.Password)+len(cfg.Hash))
+		for _, password := range cfg.Password {
+			hashes = append(hashes, common.SHA224String(password))
+		}
+		hashes = append(hashes, cfg.Hash...)
+		if len(cfg.Groups) != 0 {
+			memoryCfg, ok := config.FromContext(ctx, memory.Name).(*memory.Config)
+			if !ok {
+				return userBindings{}, common.NewError("freedom failed to find the user groups")
+			}
+			for _, name := range cfg.Groups {
+				if _, found := memoryCfg.MemberHashes(name); !found {
+					return userBindings{}, common.NewError("outbound binding refers to unknown user group: " + name)
+				}
+			}
+		}
+		bindings.selector.Add(i, hashes, cfg.Groups)
+		bindings.bindings = append(bindings.bindings, b)
+		log.Info("outbound binding", cfg.SourceIP, cfg.Interface, "loaded for", len(hashes), "users and", len(cfg.Groups), "groups")
+	}
+	return bindings, nil
+}
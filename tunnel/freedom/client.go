@@ -3,70 +3,183 @@ package freedom
 import (
 	"context"
 	"net"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/txthinking/socks5"
-	"golang.org/x/net/proxy"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/sockopt"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
 
 type Client struct {
 	preferIPv4   bool
-	noDelay      bool
-	keepAlive    bool
+	tcp          *sockopt.TCPOptions // 直接连接的 TCP 选项
 	ctx          context.Context
 	cancel       context.CancelFunc
-	forwardProxy bool // 是否启用前置代理(socks5)
+	forwardProxy bool   // 是否启用前置代理
+	proxyType    string // 前置代理的类型，socks5 或 http
 	proxyAddr    *tunnel.Address
 	username     string
 	password     string
+	overrider    *Overrider      // 拨号前改写或阻断目标地址
+	proxyProto   int             // 向目标地址发送的 PROXY 协议头部版本，0 表示不发送
+	bind         sockopt.Control // 绑定出站连接的网络接口，为空时不绑定
+	bindings     userBindings    // 指定用户的出站连接的源地址和网络接口
+
+	// Control is called on the tcp sockets dialed directly before connecting, may be nil
+	Control func(network, address string, c syscall.RawConn) error
+	// MultipathTCP makes the connections dialed directly use multipath tcp if possible
+	MultipathTCP bool
+	// HappyEyeballs races the IPv6 and IPv4 addresses of the domain names dialed directly, may be nil
+	HappyEyeballs *HappyEyeballs
+	// NoForwardProxy makes the client ignore the forward proxy, e.g. when dialing the local transport plugin
+	NoForwardProxy bool
+}
+
+func (c *Client) DialConn(addr *tunnel.Address, overlay tunnel.Tunnel) (tunnel.Conn, error) {
+	return c.DialConnWithMetadata(&tunnel.Metadata{Address: addr}, overlay)
+}
+
+// DialConnWithMetadata dials the address of the request, the source of the request is sent to the target
+// in the PROXY protocol header if enabled
+func (c *Client) DialConnWithMetadata(metadata *tunnel.Metadata, _ tunnel.Tunnel) (tunnel.Conn, error) {
+	conn, err := c.dial(metadata, c.bindingOf(metadata))
+	if err != nil {
+		return nil, err
+	}
+	if c.proxyProto != 0 {
+		if err := common.WriteProxyHeader(conn, c.proxyProto, metadata.Source, conn.RemoteAddr()); err != nil {
+			conn.Close()
+			return nil, common.NewError("freedom failed to send proxy protocol header").Base(err)
+		}
+	}
+	return conn, nil
+}
+
+// resolvedOf returns the checked addresses of the destination, they are dropped if the host is rewritten
+func resolvedOf(metadata *tunnel.Metadata, addr *tunnel.Address) []net.IP {
+	if metadata == nil || len(metadata.Resolved) == 0 || addr.AddressType != tunnel.DomainName ||
+		!strings.EqualFold(addr.DomainName, metadata.Address.DomainName) {
+		return nil
+	}
+	return metadata.Resolved
+}
+
+// filterIPs returns the addresses which can be used by the network, e.g. tcp4 or udp6
+func filterIPs(ips []net.IP, network string) []net.IP {
+	result := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		switch {
+		case strings.HasSuffix(network, "4") && ip.To4() == nil:
+		case strings.HasSuffix(network, "6") && ip.To4() != nil:
+		default:
+			result = append(result, ip)
+		}
+	}
+	return result
 }
 
-func (c *Client) DialConn(addr *tunnel.Address, _ tunnel.Tunnel) (tunnel.Conn, error) {
+// dialResolved dials the checked addresses of the domain name instead of resolving it again
+func (c *Client) dialResolved(dialer *net.Dialer, network string, addr *tunnel.Address, resolved []net.IP) (net.Conn, error) {
+	ips := filterIPs(resolved, network)
+	if len(ips) == 0 {
+		return nil, common.NewError("no " + network + " address of " + addr.DomainName)
+	}
+	if c.HappyEyeballs != nil && network == "tcp" {
+		ipAddrs := make([]net.IPAddr, 0, len(ips))
+		for _, ip := range ips {
+			ipAddrs = append(ipAddrs, net.IPAddr{IP: ip})
+		}
+		return c.HappyEyeballs.race(c.ctx, dialer, addr.DomainName, ipAddrs, addr.Port)
+	}
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(c.ctx, network, net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port)))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// dial connects to the destination of the request, from the source address and the interface of the binding if it is not nil
+func (c *Client) dial(metadata *tunnel.Metadata, b *binding) (tunnel.Conn, error) {
+	addr, err := c.overrider.Override(metadata.Address)
+	if err != nil {
+		return nil, err
+	}
+	resolved := resolvedOf(metadata, addr)
+	bind := c.bind
+	dialer := &net.Dialer{}
+	if b != nil {
+		if b.control != nil {
+			bind = b.control
+		}
+		if b.ip != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: b.ip}
+		}
+	}
+	dialer.Control = sockopt.Chain(bind, c.Control)
 	// forward proxy
-	if c.forwardProxy { // 是否启用前置代理(socks5)
-		var auth *proxy.Auth
-		if c.username != "" {
-			auth = &proxy.Auth{
-				User:     c.username,
-				Password: c.password,
-			}
-		}
-		dialer, err := proxy.SOCKS5("tcp", c.proxyAddr.String(), auth, proxy.Direct)
-		if err != nil {
-			return nil, common.NewError("freedom failed to init socks dialer")
+	if c.forwardProxy && !c.NoForwardProxy { // 是否启用前置代理(socks5 或 http)
+		target := addr.String()
+		if len(resolved) != 0 {
+			target = net.JoinHostPort(resolved[0].String(), strconv.Itoa(addr.Port))
 		}
-		conn, err := dialer.Dial("tcp", addr.String())
+		conn, err := c.dialForward(dialer, target)
 		if err != nil {
-			return nil, common.NewError("freedom failed to dial target address via socks proxy " + addr.String()).Base(err)
+			return nil, common.NewError("freedom failed to dial target address via forward proxy " + addr.String()).Base(err)
 		}
 		return &Conn{
 			Conn: conn,
 		}, nil
 	}
-	// 如果没有开启前置代理(socks5)
+	// 如果没有开启前置代理
 	network := "tcp"
 	if c.preferIPv4 {
 		network = "tcp4"
 	}
-	dialer := new(net.Dialer)
-	tcpConn, err := dialer.DialContext(c.ctx, network, addr.String())
+	if b != nil {
+		network = b.network(network) // 源地址的协议族决定目标地址的协议族
+	}
+	sockopt.SetDialerMultipath(dialer, c.MultipathTCP)
+	var tcpConn net.Conn
+	switch {
+	case len(resolved) != 0:
+		tcpConn, err = c.dialResolved(dialer, network, addr, resolved)
+	case c.HappyEyeballs != nil && network == "tcp" && addr.AddressType == tunnel.DomainName:
+		tcpConn, err = c.HappyEyeballs.dial(c.ctx, dialer, addr.DomainName, addr.Port)
+	default:
+		tcpConn, err = dialer.DialContext(c.ctx, network, addr.String())
+	}
 	if err != nil {
 		return nil, common.NewError("freedom failed to dial " + addr.String()).Base(err)
 	}
 
-	tcpConn.(*net.TCPConn).SetKeepAlive(c.keepAlive)
-	tcpConn.(*net.TCPConn).SetNoDelay(c.noDelay)
+	c.tcp.Apply(tcpConn)
 	return &Conn{
 		Conn: tcpConn,
 	}, nil
 }
 
 // 支持发送 UDP 数据包
-func (c *Client) DialPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
+func (c *Client) DialPacket(overlay tunnel.Tunnel) (tunnel.PacketConn, error) {
+	return c.DialPacketWithMetadata(nil, overlay)
+}
+
+// DialPacketWithMetadata creates the udp socket from the source address and the interface of the user of the inbound
+func (c *Client) DialPacketWithMetadata(metadata *tunnel.Metadata, _ tunnel.Tunnel) (tunnel.PacketConn, error) {
 	if c.forwardProxy {
+		if c.proxyType == forwardHTTP {
+			return nil, common.NewError("freedom can't relay udp through the http forward proxy")
+		}
 		socksClient, err := socks5.NewClient(c.proxyAddr.String(), c.username, c.password, 0, 0)
 		common.Must(err)
 		if err := socksClient.Negotiate(&net.TCPAddr{}); err != nil {
@@ -91,18 +204,34 @@ func (c *Client) DialPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
 			PacketConn:  packetConn,
 			socksAddr:   socksAddr,
 			socksClient: socksClient,
+			overrider:   c.overrider,
 		}, nil
 	}
 	network := "udp"
 	if c.preferIPv4 {
 		network = "udp4"
 	}
-	udpConn, err := net.ListenPacket(network, "")
+	lc := net.ListenConfig{
+		Control: c.bind,
+	}
+	localAddr := ""
+	if b := c.bindingOf(metadata); b != nil {
+		if b.control != nil {
+			lc.Control = b.control
+		}
+		if b.ip != nil {
+			network = b.network(network)
+			localAddr = net.JoinHostPort(b.ip.String(), "0")
+		}
+	}
+	udpConn, err := lc.ListenPacket(c.ctx, network, localAddr)
 	if err != nil {
 		return nil, common.NewError("freedom failed to listen udp socket").Base(err)
 	}
 	return &PacketConn{
-		UDPConn: udpConn.(*net.UDPConn),
+		UDPConn:   udpConn.(*net.UDPConn),
+		network:   network,
+		overrider: c.overrider,
 	}, nil
 }
 
@@ -115,16 +244,28 @@ func NewClient(ctx context.Context, _ tunnel.Client) (*Client, error) {
 	cfg := config.FromContext(ctx, Name).(*Config)
 	// forward_proxy前置代理选项
 	addr := tunnel.NewAddressFromHostPort("tcp", cfg.ForwardProxy.ProxyHost, cfg.ForwardProxy.ProxyPort)
+	overrider, err := NewOverrider(cfg.DialOverride)
+	if err != nil {
+		return nil, common.NewError("freedom failed to load dial override rules").Base(err)
+	}
+	bindings, err := newBindings(ctx, cfg.OutboundBindings)
+	if err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	return &Client{
 		ctx:          ctx,
 		cancel:       cancel,
-		noDelay:      cfg.TCP.NoDelay,
-		keepAlive:    cfg.TCP.KeepAlive,
+		tcp:          sockopt.NewTCPOptions(cfg.TCP.NoDelay, cfg.TCP.KeepAlive, cfg.TCP.KeepAliveInterval, cfg.TCP.UserTimeout),
 		preferIPv4:   cfg.TCP.PreferIPV4,
 		forwardProxy: cfg.ForwardProxy.Enabled,
+		proxyType:    cfg.ForwardProxy.Type,
 		proxyAddr:    addr,
 		username:     cfg.ForwardProxy.Username,
 		password:     cfg.ForwardProxy.Password,
+		overrider:    overrider,
+		proxyProto:   cfg.ProxyProtocol.Outbound,
+		bind:         sockopt.BindToInterface(cfg.OutboundInterface),
+		bindings:     bindings,
 	}, nil
 }
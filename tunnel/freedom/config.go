@@ -1,28 +1,100 @@
 package freedom
 
-import "github.com/p4gefau1t/trojan-go/config"
+import (
+	"net"
+	"strconv"
+
+	"github.com/p4gefau1t/trojan-go/config"
+)
 
 type Config struct {
 	LocalHost    string             `json:"local_addr" yaml:"local-addr"`
 	LocalPort    int                `json:"local_port" yaml:"local-port"`
 	TCP          TCPConfig          `json:"tcp" yaml:"tcp"`
 	ForwardProxy ForwardProxyConfig `json:"forward_proxy" yaml:"forward-proxy"`
+	DialOverride []OverrideConfig   `json:"dial_override" yaml:"dial-override"`
+	// 出站连接使用的网络接口，如 wg0，为空时由路由表决定
+	OutboundInterface string `json:"outbound_interface" yaml:"outbound-interface"`
+	// 与入站的 PROXY 协议配置共用同一个配置项
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol" yaml:"proxy-protocol"`
+	// 指定用户的出站连接使用的源地址或网络接口，仅服务端有效
+	OutboundBindings []OutboundBindingConfig `json:"outbound_bindings" yaml:"outbound-bindings"`
+}
+
+type OutboundBindingConfig struct {
+	Password  []string `json:"password" yaml:"password"`
+	Hash      []string `json:"hash" yaml:"hash"`
+	Groups    []string `json:"groups" yaml:"groups"`
+	SourceIP  string   `json:"source_ip" yaml:"source-ip"`
+	Interface string   `json:"interface" yaml:"interface"`
+}
+
+type ProxyProtocolConfig struct {
+	Outbound int `json:"outbound" yaml:"outbound"` // 向目标地址发送的 PROXY 协议头部版本，0 表示不发送
 }
 
 type TCPConfig struct {
-	PreferIPV4 bool `json:"prefer_ipv4" yaml:"prefer-ipv4"`
-	KeepAlive  bool `json:"keep_alive" yaml:"keep-alive"`
-	NoDelay    bool `json:"no_delay" yaml:"no-delay"`
+	PreferIPV4        bool `json:"prefer_ipv4" yaml:"prefer-ipv4"`
+	KeepAlive         bool `json:"keep_alive" yaml:"keep-alive"`
+	KeepAliveInterval int  `json:"keep_alive_interval" yaml:"keep-alive-interval"` // 保活探测的间隔秒数，0 使用默认值
+	NoDelay           bool `json:"no_delay" yaml:"no-delay"`
+	UserTimeout       int  `json:"user_timeout" yaml:"user-timeout"` // TCP_USER_TIMEOUT 秒数，0 使用系统默认值
 }
 
 type ForwardProxyConfig struct {
 	Enabled   bool   `json:"enabled" yaml:"enabled"`
+	Type      string `json:"type" yaml:"type"` // socks5 或 http（CONNECT）
 	ProxyHost string `json:"proxy_addr" yaml:"proxy-addr"`
 	ProxyPort int    `json:"proxy_port" yaml:"proxy-port"`
 	Username  string `json:"username" yaml:"username"`
 	Password  string `json:"password" yaml:"password"`
 }
 
+type OverrideConfig struct {
+	Match   string `json:"match" yaml:"match"`
+	Rewrite string `json:"rewrite" yaml:"rewrite"`
+	Block   bool   `json:"block" yaml:"block"`
+}
+
+func (c *Config) Validate() error {
+	var errs config.Errors
+	switch c.ProxyProtocol.Outbound {
+	case 0, 1, 2:
+	default:
+		errs.Add("proxy_protocol.outbound", "must be 0, 1 or 2")
+	}
+	if c.TCP.KeepAliveInterval < 0 {
+		errs.Add("tcp.keep_alive_interval", "must not be negative")
+	}
+	if c.TCP.UserTimeout < 0 {
+		errs.Add("tcp.user_timeout", "must not be negative")
+	}
+	for i, binding := range c.OutboundBindings {
+		path := "outbound_bindings[" + strconv.Itoa(i) + "]"
+		if len(binding.Password) == 0 && len(binding.Hash) == 0 && len(binding.Groups) == 0 {
+			errs.Add(path, "no password, hash or group specified")
+		}
+		if binding.SourceIP == "" && binding.Interface == "" {
+			errs.Add(path, "either source_ip or interface is required")
+		}
+		if binding.SourceIP != "" && net.ParseIP(binding.SourceIP) == nil {
+			errs.Add(path+".source_ip", "invalid ip "+strconv.Quote(binding.SourceIP))
+		}
+	}
+	if c.ForwardProxy.Enabled {
+		if c.ForwardProxy.Type != forwardSocks5 && c.ForwardProxy.Type != forwardHTTP {
+			errs.Add("forward_proxy.type", "must be socks5 or http")
+		}
+		if c.ForwardProxy.ProxyHost == "" {
+			errs.Add("forward_proxy.proxy_addr", "is required")
+		}
+		if c.ForwardProxy.ProxyPort <= 0 || c.ForwardProxy.ProxyPort > 65535 {
+			errs.Add("forward_proxy.proxy_port", "must be in [1, 65535]")
+		}
+	}
+	return errs.Err()
+}
+
 func init() {
 	config.RegisterConfigCreator(Name, func() interface{} {
 		return &Config{
@@ -31,6 +103,9 @@ func init() {
 				NoDelay:    true,
 				KeepAlive:  true,
 			},
+			ForwardProxy: ForwardProxyConfig{
+				Type: forwardSocks5,
+			},
 		}
 	})
 }
@@ -3,6 +3,7 @@ package freedom
 import (
 	"bytes"
 	"net"
+	"sync"
 
 	"github.com/txthinking/socks5"
 
@@ -11,8 +12,6 @@ import (
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
 
-const MaxPacketSize = 1024 * 8
-
 type Conn struct {
 	net.Conn
 }
@@ -23,10 +22,55 @@ func (c *Conn) Metadata() *tunnel.Metadata {
 
 type PacketConn struct {
 	*net.UDPConn
+	network   string // udp 或者为空时为双栈，udp4 仅 IPv4
+	overrider *Overrider
+	mapped    sync.Map // 改写后的地址 -> 原始目标地址，用于还原回包的来源
+}
+
+// resolve resolves the target address according to the network of the socket,
+// the ipv4 address of the domain name is preferred unless there is only ipv6 address.
+// The checked addresses of the domain name are used if there are any
+func (c *PacketConn) resolve(addr *tunnel.Address, resolved []net.IP) (*net.UDPAddr, error) {
+	if len(resolved) != 0 {
+		ips := filterIPs(resolved, c.network)
+		if len(ips) == 0 {
+			return nil, common.NewError("no " + c.network + " address of " + addr.DomainName)
+		}
+		return &net.UDPAddr{
+			IP:   ips[0],
+			Port: addr.Port,
+		}, nil
+	}
+	if addr.IP == nil {
+		network := c.network
+		if network == "" {
+			network = "udp"
+		}
+		return net.ResolveUDPAddr(network, addr.String())
+	}
+	if c.network == "udp4" && addr.IP.To4() == nil {
+		return nil, common.NewError("ipv6 target " + addr.String() + " is not supported by udp4 socket")
+	}
+	return &net.UDPAddr{
+		IP:   addr.IP,
+		Port: addr.Port,
+	}, nil
 }
 
 func (c *PacketConn) WriteWithMetadata(p []byte, m *tunnel.Metadata) (int, error) {
-	return c.WriteTo(p, m.Address)
+	addr, err := c.overrider.Override(m.Address)
+	if err != nil {
+		return 0, err
+	}
+	udpAddr, err := c.resolve(addr, resolvedOf(m, addr))
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.WriteToUDP(p, udpAddr)
+	if addr != m.Address {
+		c.mapped.Store(udpAddr.String(), m.Address)
+	}
+	return n, err
 }
 
 func (c *PacketConn) ReadWithMetadata(p []byte) (int, *tunnel.Metadata, error) {
@@ -34,6 +78,11 @@ func (c *PacketConn) ReadWithMetadata(p []byte) (int, *tunnel.Metadata, error) {
 	if err != nil {
 		return 0, nil, err
 	}
+	if original, found := c.mapped.Load(addr.String()); found {
+		return n, &tunnel.Metadata{
+			Address: original.(*tunnel.Address),
+		}, nil
+	}
 	address, err := tunnel.NewAddressFromAddr("udp", addr.String())
 	common.Must(err)
 	metadata := &tunnel.Metadata{
@@ -46,14 +95,10 @@ func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 	if udpAddr, ok := addr.(*net.UDPAddr); ok {
 		return c.WriteToUDP(p, udpAddr)
 	}
-	ip, err := addr.(*tunnel.Address).ResolveIP()
+	udpAddr, err := c.resolve(addr.(*tunnel.Address), nil)
 	if err != nil {
 		return 0, err
 	}
-	udpAddr := &net.UDPAddr{
-		IP:   ip,
-		Port: addr.(*tunnel.Address).Port,
-	}
 	return c.WriteToUDP(p, udpAddr)
 }
 
@@ -61,14 +106,25 @@ type SocksPacketConn struct {
 	net.PacketConn
 	socksAddr   *net.UDPAddr
 	socksClient *socks5.Client
+	overrider   *Overrider
 }
 
 func (c *SocksPacketConn) WriteWithMetadata(payload []byte, metadata *tunnel.Metadata) (int, error) {
-	buf := bytes.NewBuffer(make([]byte, 0, MaxPacketSize))
+	addr, err := c.overrider.Override(metadata.Address)
+	if err != nil {
+		return 0, err
+	}
+	if resolved := resolvedOf(metadata, addr); len(resolved) != 0 {
+		// 前置代理不再解析域名
+		addr = tunnel.NewAddressFromHostPort(addr.NetworkType, resolved[0].String(), addr.Port)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, common.PacketSize()))
 	buf.Write([]byte{0, 0, 0}) // RSV, FRAG
-	common.Must(metadata.Address.WriteTo(buf))
+	if err := addr.WriteTo(buf); err != nil {
+		return 0, err
+	}
 	buf.Write(payload)
-	_, err := c.PacketConn.WriteTo(buf.Bytes(), c.socksAddr)
+	_, err = c.PacketConn.WriteTo(buf.Bytes(), c.socksAddr)
 	if err != nil {
 		return 0, err
 	}
@@ -77,7 +133,7 @@ func (c *SocksPacketConn) WriteWithMetadata(payload []byte, metadata *tunnel.Met
 }
 
 func (c *SocksPacketConn) ReadWithMetadata(payload []byte) (int, *tunnel.Metadata, error) {
-	buf := make([]byte, MaxPacketSize)
+	buf := make([]byte, common.PacketSize())
 	n, from, err := c.PacketConn.ReadFrom(buf)
 	if err != nil {
 		return 0, nil, err
@@ -0,0 +1,115 @@
+package freedom
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// HappyEyeballs dials the domain names with both A and AAAA records by racing the addresses (RFC 8305):
+// the addresses of the two families are interleaved and each attempt starts after the previous one
+// failed or the delay passed, the first established connection is used
+type HappyEyeballs struct {
+	PreferIPv4 bool          // 首先尝试 IPv4 地址，默认首先尝试 IPv6
+	Delay      time.Duration // 开始下一次尝试前等待的时间
+}
+
+// order interleaves the addresses of the two families, starting with the preferred one
+func (h *HappyEyeballs) order(ips []net.IPAddr) []net.IPAddr {
+	var preferred, other []net.IPAddr
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == h.PreferIPv4 {
+			preferred = append(preferred, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+	result := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(preferred) || i < len(other); i++ {
+		if i < len(preferred) {
+			result = append(result, preferred[i])
+		}
+		if i < len(other) {
+			result = append(result, other[i])
+		}
+	}
+	return result
+}
+
+type eyeballsResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dial resolves the host and races the connections to its addresses
+func (h *HappyEyeballs) dial(ctx context.Context, dialer *net.Dialer, host string, port int) (net.Conn, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, common.NewError("failed to resolve " + host).Base(err)
+	}
+	return h.race(ctx, dialer, host, ips, port)
+}
+
+// race races the connections to the addresses of the host
+func (h *HappyEyeballs) race(ctx context.Context, dialer *net.Dialer, host string, ips []net.IPAddr, port int) (net.Conn, error) {
+	addrs := h.order(ips)
+	if len(addrs) == 0 {
+		return nil, common.NewError("no address of " + host)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // 放弃其他尚未完成的尝试
+	results := make(chan eyeballsResult, len(addrs))
+	start := func(ip net.IPAddr) {
+		address := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			results <- eyeballsResult{conn: conn, err: err}
+		}()
+	}
+
+	start(addrs[0])
+	started, pending := 1, 1
+	var next <-chan time.Time
+	if started < len(addrs) {
+		next = time.After(h.Delay)
+	}
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 取消后仍可能有连接建立，关闭它们
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			log.Debug("happy eyeballs attempt to", host, "failed:", r.err)
+		case <-next:
+		}
+		// 上一次尝试失败或等待超时，立即开始下一次尝试
+		if started < len(addrs) {
+			start(addrs[started])
+			started++
+			pending++
+			next = nil
+			if started < len(addrs) {
+				next = time.After(h.Delay)
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,100 @@
+package freedom
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// 前置代理的类型
+const (
+	forwardSocks5 = "socks5"
+	forwardHTTP   = "http" // HTTP CONNECT
+)
+
+// 等待 HTTP 代理响应 CONNECT 请求的时间
+const forwardHandshakeTimeout = time.Second * 10
+
+// bufferedConn reads the data the http proxy sent after the response from the buffer first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// dialForward connects to the target through the forward proxy
+func (c *Client) dialForward(dialer *net.Dialer, target string) (net.Conn, error) {
+	if c.proxyType == forwardHTTP {
+		return c.dialHTTPProxy(dialer, target)
+	}
+	var auth *proxy.Auth
+	if c.username != "" {
+		auth = &proxy.Auth{
+			User:     c.username,
+			Password: c.password,
+		}
+	}
+	socksDialer, err := proxy.SOCKS5("tcp", c.proxyAddr.String(), auth, dialer)
+	if err != nil {
+		return nil, common.NewError("freedom failed to init socks dialer").Base(err)
+	}
+	conn, err := socksDialer.(proxy.ContextDialer).DialContext(c.ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	c.tcp.Apply(conn)
+	return conn, nil
+}
+
+// dialHTTPProxy sends the CONNECT request to the http proxy, the connection is relayed after the proxy responded 200
+func (c *Client) dialHTTPProxy(dialer *net.Dialer, target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, forwardHandshakeTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", c.proxyAddr.String())
+	if err != nil {
+		return nil, common.NewError("freedom failed to dial http proxy " + c.proxyAddr.String()).Base(err)
+	}
+	c.tcp.Apply(conn)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if c.username != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password)))
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, common.NewError("freedom failed to send connect request to http proxy").Base(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, common.NewError("freedom failed to read connect response from http proxy").Base(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, common.NewError("http proxy refused to connect to " + target + ": " + resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
@@ -1,15 +1,21 @@
 package freedom
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"testing"
 	"time"
 
 	"github.com/txthinking/socks5"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/statistic/memory"
 	"github.com/p4gefau1t/trojan-go/test/util"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
@@ -69,7 +75,6 @@ func TestSocks(t *testing.T) {
 		cancel:       cancel,
 		proxyAddr:    socksAddr,
 		forwardProxy: true,
-		noDelay:      true,
 	}
 	target, err := tunnel.NewAddressFromAddr("tcp", util.EchoAddr)
 	common.Must(err)
@@ -109,3 +114,317 @@ func TestSocks(t *testing.T) {
 	packet.Close()
 	client.Close()
 }
+
+func TestDialOverride(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	overrider, err := NewOverrider([]OverrideConfig{
+		{Match: ":25", Block: true},
+		{Match: "echo.internal", Rewrite: util.EchoAddr},
+		{Match: "*.example.com:80", Rewrite: "127.0.0.1"},
+	})
+	common.Must(err)
+	client := &Client{
+		ctx:       ctx,
+		cancel:    cancel,
+		overrider: overrider,
+	}
+
+	if _, err := client.DialConn(tunnel.NewAddressFromHostPort("tcp", "smtp.example.org", 25), nil); err == nil {
+		t.Fatal("port 25 should be blocked")
+	}
+	rewritten, err := overrider.Override(tunnel.NewAddressFromHostPort("tcp", "www.example.com", 80))
+	common.Must(err)
+	if rewritten.String() != "127.0.0.1:80" {
+		t.Fatal("wrong rewritten address", rewritten)
+	}
+
+	target := tunnel.NewAddressFromHostPort("tcp", "echo.internal", 1234)
+	conn, err := client.DialConn(target, nil)
+	common.Must(err)
+	payload := util.GeneratePayload(1024)
+	recvBuf := [1024]byte{}
+	common.Must2(conn.Write(payload))
+	common.Must2(conn.Read(recvBuf[:]))
+	if !bytes.Equal(payload, recvBuf[:]) {
+		t.Fail()
+	}
+	conn.Close()
+
+	packet, err := client.DialPacket(nil)
+	common.Must(err)
+	target.NetworkType = "udp"
+	common.Must2(packet.WriteWithMetadata(payload, &tunnel.Metadata{Address: target}))
+	_, m, err := packet.ReadWithMetadata(recvBuf[:])
+	common.Must(err)
+	if m.Address.String() != target.String() || !bytes.Equal(payload, recvBuf[:]) {
+		t.Fatal("wrong packet source", m)
+	}
+	packet.Close()
+	client.Close()
+}
+
+func TestPacketIPv6(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 is not available")
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, common.PacketSize())
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &Client{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	defer client.Close()
+	conn, err := client.DialPacket(nil)
+	common.Must(err)
+	defer conn.Close()
+
+	target := tunnel.NewAddressFromHostPort("udp", "::1", echo.LocalAddr().(*net.UDPAddr).Port)
+	payload := util.GeneratePayload(1024)
+	common.Must2(conn.WriteWithMetadata(payload, &tunnel.Metadata{Address: target}))
+	recvBuf := make([]byte, common.PacketSize())
+	n, m, err := conn.ReadWithMetadata(recvBuf)
+	common.Must(err)
+	if m.AddressType != tunnel.IPv6 || m.String() != target.String() || !bytes.Equal(recvBuf[:n], payload) {
+		t.Fatal("wrong packet from", m)
+	}
+
+	// the udp4 socket can not send to ipv6 targets
+	client.preferIPv4 = true
+	conn4, err := client.DialPacket(nil)
+	common.Must(err)
+	defer conn4.Close()
+	if _, err := conn4.WriteWithMetadata(payload, &tunnel.Metadata{Address: target}); err == nil {
+		t.Fatal("ipv6 target sent with udp4 socket")
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &Client{
+		ctx:        ctx,
+		cancel:     cancel,
+		proxyProto: 1,
+	}
+	defer client.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer l.Close()
+	addr, err := tunnel.NewAddressFromAddr("tcp", l.Addr().String())
+	common.Must(err)
+
+	testCases := []struct {
+		source net.Addr
+		header string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}, fmt.Sprintf("PROXY TCP4 1.2.3.4 127.0.0.1 5678 %d\r\n", addr.Port)},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5678}, fmt.Sprintf("PROXY TCP6 2001:db8::1 ::ffff:127.0.0.1 5678 %d\r\n", addr.Port)},
+		{nil, "PROXY UNKNOWN\r\n"},
+	}
+	for _, tc := range testCases {
+		conn1, err := client.DialConnWithMetadata(&tunnel.Metadata{Address: addr, Source: tc.source}, nil)
+		common.Must(err)
+		conn2, err := l.Accept()
+		common.Must(err)
+		conn1.Write([]byte("hello"))
+		buf := make([]byte, len(tc.header)+5)
+		conn2.SetReadDeadline(time.Now().Add(time.Second * 3))
+		_, err = io.ReadFull(conn2, buf)
+		common.Must(err)
+		if string(buf) != tc.header+"hello" {
+			t.Fatalf("unexpected header %q", buf)
+		}
+		conn1.Close()
+		conn2.Close()
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	h := &HappyEyeballs{Delay: time.Millisecond * 50}
+	ips := []net.IPAddr{
+		{IP: net.ParseIP("1.1.1.1")},
+		{IP: net.ParseIP("1.0.0.1")},
+		{IP: net.ParseIP("2606:4700::1111")},
+	}
+	expected := []string{"2606:4700::1111", "1.1.1.1", "1.0.0.1"}
+	for i, ip := range h.order(ips) {
+		if ip.String() != expected[i] {
+			t.Fatal("unexpected order", i, ip.String())
+		}
+	}
+	h.PreferIPv4 = true
+	expected = []string{"1.1.1.1", "2606:4700::1111", "1.0.0.1"}
+	for i, ip := range h.order(ips) {
+		if ip.String() != expected[i] {
+			t.Fatal("unexpected order", i, ip.String())
+		}
+	}
+
+	// localhost 的 IPv6 地址没有监听时使用 IPv4 地址
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	h.PreferIPv4 = false
+	conn, err := h.dial(context.Background(), &net.Dialer{}, "localhost", port)
+	common.Must(err)
+	defer conn.Close()
+	if conn.RemoteAddr().String() != listener.Addr().String() {
+		t.Fatal("unexpected remote addr", conn.RemoteAddr())
+	}
+
+	if _, err := h.dial(context.Background(), &net.Dialer{}, "localhost", common.PickPort("tcp", "127.0.0.1")); err == nil {
+		t.Fatal("dial to a closed port succeeded")
+	}
+}
+
+func TestHTTPForwardProxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				remote, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer remote.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(remote, conn)
+				io.Copy(conn, remote)
+			}(conn)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proxyAddr, err := tunnel.NewAddressFromAddr("tcp", listener.Addr().String())
+	common.Must(err)
+	client := &Client{
+		ctx:          ctx,
+		cancel:       cancel,
+		proxyAddr:    proxyAddr,
+		forwardProxy: true,
+		proxyType:    forwardHTTP,
+		username:     "user",
+		password:     "pass",
+	}
+	defer client.Close()
+	target, err := tunnel.NewAddressFromAddr("tcp", util.EchoAddr)
+	common.Must(err)
+	conn, err := client.DialConn(target, nil)
+	common.Must(err)
+	payload := util.GeneratePayload(1024)
+	common.Must2(conn.Write(payload))
+	recvBuf := [1024]byte{}
+	common.Must2(io.ReadFull(conn, recvBuf[:]))
+	if !bytes.Equal(recvBuf[:], payload) {
+		t.Fatal("payload mismatch")
+	}
+	conn.Close()
+
+	client.password = "wrong"
+	if _, err := client.DialConn(target, nil); err == nil {
+		t.Fatal("dial succeeded with a wrong password")
+	}
+	if _, err := client.DialPacket(nil); err == nil {
+		t.Fatal("udp is relayed through the http proxy")
+	}
+}
+
+type testUser struct {
+	memory.User
+	hash  string
+	group string
+}
+
+func (u *testUser) Hash() string {
+	return u.hash
+}
+
+func (u *testUser) Group() string {
+	return u.group
+}
+
+func TestOutboundBinding(t *testing.T) {
+	ctx := config.WithConfig(context.Background(), memory.Name, &memory.Config{
+		Groups: []memory.GroupConfig{
+			{Name: "customer", Passwords: []string{"member"}},
+		},
+	})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		OutboundBindings: []OutboundBindingConfig{
+			{Password: []string{"user"}, Groups: []string{"customer"}, SourceIP: "127.0.0.2"},
+		},
+	})
+	client, err := NewClient(ctx, nil)
+	common.Must(err)
+	defer client.Close()
+
+	addr, err := tunnel.NewAddressFromAddr("tcp", util.EchoAddr)
+	common.Must(err)
+	for _, c := range []struct {
+		password string
+		group    string
+		source   string
+	}{
+		{"user", "", "127.0.0.2"},
+		{"member", "customer", "127.0.0.2"},
+		{"other", "", "127.0.0.1"},
+		// 按拨号时所在的组查找
+		{"joined", "customer", "127.0.0.2"},
+		{"member", "", "127.0.0.1"},
+	} {
+		metadata := &tunnel.Metadata{
+			Address: addr,
+			User:    &testUser{hash: common.SHA224String(c.password), group: c.group},
+		}
+		conn, err := client.DialConnWithMetadata(metadata, nil)
+		common.Must(err)
+		if ip := conn.LocalAddr().(*net.TCPAddr).IP.String(); ip != c.source {
+			t.Fatal("wrong tcp source address of", c.password, ip)
+		}
+		conn.Close()
+
+		packetConn, err := client.DialPacketWithMetadata(metadata, nil)
+		common.Must(err)
+		if ip := packetConn.LocalAddr().(*net.UDPAddr).IP; c.source == "127.0.0.2" && ip.String() != c.source {
+			t.Fatal("wrong udp source address of", c.password, ip)
+		}
+		packetConn.Close()
+	}
+
+	ctx = config.WithConfig(context.Background(), Name, &Config{
+		OutboundBindings: []OutboundBindingConfig{
+			{Groups: []string{"unknown"}, SourceIP: "127.0.0.2"},
+		},
+	})
+	if _, err := NewClient(ctx, nil); err == nil {
+		t.Fatal("unknown group accepted")
+	}
+}
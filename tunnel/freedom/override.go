@@ -0,0 +1,131 @@
+package freedom
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// overrideRule rewrites or blocks a destination before dialing.
+// An empty host or a zero port matches any host or port
+type overrideRule struct {
+	host    string
+	port    int
+	block   bool
+	toHost  string
+	toPort  int
+	rawRule string
+}
+
+// splitHostPort accepts "host", "host:port", ":port" and "[ipv6]:port"
+func splitHostPort(s string) (string, int, error) {
+	if !strings.Contains(s, ":") || (strings.Count(s, ":") > 1 && !strings.HasPrefix(s, "[")) {
+		return strings.ToLower(s), 0, nil
+	}
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, common.NewError("invalid port " + portStr)
+	}
+	return strings.ToLower(host), port, nil
+}
+
+func newOverrideRule(cfg OverrideConfig) (*overrideRule, error) {
+	host, port, err := splitHostPort(cfg.Match)
+	if err != nil {
+		return nil, common.NewError("invalid dial override match " + cfg.Match).Base(err)
+	}
+	if host == "" && port == 0 {
+		return nil, common.NewError("empty dial override match")
+	}
+	rule := &overrideRule{
+		host:    host,
+		port:    port,
+		block:   cfg.Block,
+		rawRule: cfg.Match,
+	}
+	if !cfg.Block {
+		rule.toHost, rule.toPort, err = splitHostPort(cfg.Rewrite)
+		if err != nil {
+			return nil, common.NewError("invalid dial override rewrite " + cfg.Rewrite).Base(err)
+		}
+		if rule.toHost == "" && rule.toPort == 0 {
+			return nil, common.NewError("dial override " + cfg.Match + " has neither rewrite nor block")
+		}
+	}
+	return rule, nil
+}
+
+func (r *overrideRule) match(addr *tunnel.Address) bool {
+	if r.port != 0 && r.port != addr.Port {
+		return false
+	}
+	if r.host == "" {
+		return true
+	}
+	host := addr.DomainName
+	if addr.AddressType != tunnel.DomainName {
+		host = addr.IP.String()
+	}
+	host = strings.ToLower(host)
+	if strings.HasPrefix(r.host, "*.") {
+		return strings.HasSuffix(host, r.host[1:])
+	}
+	return host == r.host
+}
+
+// Overrider applies dial override rules to the destinations
+type Overrider struct {
+	rules []*overrideRule
+}
+
+// Override returns the rewritten address, or an error if the address is blocked.
+// The original address is returned if no rule matches
+func (o *Overrider) Override(addr *tunnel.Address) (*tunnel.Address, error) {
+	if o == nil {
+		return addr, nil
+	}
+	for _, r := range o.rules {
+		if !r.match(addr) {
+			continue
+		}
+		if r.block {
+			return nil, common.NewError("freedom blocked address " + addr.String() + " by rule " + r.rawRule)
+		}
+		host := r.toHost
+		if host == "" {
+			host = addr.DomainName
+			if addr.AddressType != tunnel.DomainName {
+				host = addr.IP.String()
+			}
+		}
+		port := r.toPort
+		if port == 0 {
+			port = addr.Port
+		}
+		return tunnel.NewAddressFromHostPort(addr.NetworkType, host, port), nil
+	}
+	return addr, nil
+}
+
+// NewOverrider creates an overrider from the config. It returns nil if there is no rule
+func NewOverrider(list []OverrideConfig) (*Overrider, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	o := &Overrider{}
+	for _, cfg := range list {
+		rule, err := newOverrideRule(cfg)
+		if err != nil {
+			return nil, err
+		}
+		o.rules = append(o.rules, rule)
+	}
+	return o, nil
+}
@@ -0,0 +1,20 @@
+package http
+
+import "github.com/p4gefau1t/trojan-go/config"
+
+type HTTPConfig struct {
+	TLS      bool   `json:"tls" yaml:"tls"`
+	CertPath string `json:"cert" yaml:"cert"`
+	KeyPath  string `json:"key" yaml:"key"`
+	H2       bool   `json:"h2" yaml:"h2"`
+}
+
+type Config struct {
+	HTTP HTTPConfig `json:"http" yaml:"http"`
+}
+
+func init() {
+	config.RegisterConfigCreator(Name, func() interface{} {
+		return new(Config)
+	})
+}
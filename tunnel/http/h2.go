@@ -0,0 +1,113 @@
+package http
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// H2Conn is a CONNECT stream of the HTTP/2 connection
+type H2Conn struct {
+	net.Conn // 底层连接，仅用于获取地址
+	reader   io.ReadCloser
+	writer   io.Writer
+	flusher  http.Flusher
+	metadata *tunnel.Metadata
+	done     chan struct{}
+	once     sync.Once
+	lock     sync.Mutex // 处理函数返回后不能再写入
+	finished bool
+}
+
+func (c *H2Conn) Metadata() *tunnel.Metadata {
+	return c.metadata
+}
+
+func (c *H2Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *H2Conn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.finished {
+		return 0, common.NewError("h2 stream closed")
+	}
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	c.flusher.Flush()
+	return n, nil
+}
+
+func (c *H2Conn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.reader.Close()
+	})
+	return nil
+}
+
+// 多个流共用底层连接，不能设置底层连接的超时
+func (c *H2Conn) SetDeadline(time.Time) error      { return nil }
+func (c *H2Conn) SetReadDeadline(time.Time) error  { return nil }
+func (c *H2Conn) SetWriteDeadline(time.Time) error { return nil }
+
+// serveH2 serves the CONNECT requests of the HTTP/2 connection, each stream is passed to the proxy as a connection
+func (s *Server) serveH2(conn net.Conn) {
+	defer conn.Close()
+	server := &http2.Server{}
+	server.ServeConn(conn, &http2.ServeConnOpts{
+		Context: s.ctx,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.ToUpper(r.Method) != http.MethodConnect {
+				http.Error(w, "only CONNECT is supported over HTTP/2", http.StatusMethodNotAllowed)
+				return
+			}
+			addr, err := tunnel.NewAddressFromAddr("tcp", r.Host)
+			if err != nil {
+				log.Error(common.NewError("invalid h2 dest address").Base(err))
+				http.Error(w, "invalid address", http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			flusher := w.(http.Flusher)
+			flusher.Flush()
+			streamConn := &H2Conn{
+				Conn:    conn,
+				reader:  r.Body,
+				writer:  w,
+				flusher: flusher,
+				metadata: &tunnel.Metadata{
+					Address: addr,
+					Inbound: Name,
+				},
+				done: make(chan struct{}),
+			}
+			select {
+			case s.connChan <- streamConn:
+			case <-s.ctx.Done():
+				return
+			}
+			// 流在中继结束后关闭，处理函数返回时才会结束流
+			select {
+			case <-streamConn.done:
+			case <-r.Context().Done():
+				streamConn.Close()
+			}
+			streamConn.lock.Lock()
+			streamConn.finished = true
+			streamConn.lock.Unlock()
+		}),
+	})
+}
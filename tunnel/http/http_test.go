@@ -3,16 +3,30 @@ package http
 import (
 	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
+	"os"
 	"testing"
 	"time"
 
+	"golang.org/x/net/http2"
+
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/test/util"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
 	"github.com/p4gefau1t/trojan-go/tunnel/transport"
 )
 
@@ -87,3 +101,104 @@ func TestHTTP(t *testing.T) {
 	conn2.Close()
 	s.Close()
 }
+
+type listenerServer struct {
+	net.Listener
+}
+
+func (s *listenerServer) AcceptConn(tunnel.Tunnel) (tunnel.Conn, error) {
+	conn, err := s.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &freedom.Conn{Conn: conn}, nil
+}
+
+func (s *listenerServer) AcceptPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
+	panic("not supported")
+}
+
+func TestH2Connect(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	common.Must(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	common.Must(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	common.Must(err)
+	common.Must(os.WriteFile("http-inbound.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	common.Must(os.WriteFile("http-inbound.key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	defer os.Remove("http-inbound.crt")
+	defer os.Remove("http-inbound.key")
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), Name, &Config{
+		HTTP: HTTPConfig{
+			TLS:      true,
+			CertPath: "http-inbound.crt",
+			KeyPath:  "http-inbound.key",
+			H2:       true,
+		},
+	})
+	// 客户端中 adapter 会将 TLS 和 HTTP/2 连接交给 http
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	common.Must(err)
+	s, err := NewServer(ctx, &listenerServer{Listener: l})
+	common.Must(err)
+	defer s.Close()
+
+	for _, useTLS := range []bool{true, false} {
+		h2Transport := &http2.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		if !useTLS { // 明文 HTTP/2
+			h2Transport.AllowHTTP = true
+			h2Transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			}
+		}
+		reqReader, reqWriter := io.Pipe()
+		req, err := http.NewRequest(http.MethodConnect, fmt.Sprintf("https://127.0.0.1:%d", port), reqReader)
+		common.Must(err)
+		req.Host = "example.com:443"
+		go func() {
+			common.Must2(reqWriter.Write([]byte("12345678")))
+		}()
+		respChan := make(chan *http.Response, 1)
+		go func() {
+			resp, err := h2Transport.RoundTrip(req)
+			common.Must(err)
+			respChan <- resp
+		}()
+
+		conn, err := s.AcceptConn(nil)
+		common.Must(err)
+		if conn.Metadata().DomainName != "example.com" || conn.Metadata().Port != 443 {
+			t.Fatal("wrong metadata", conn.Metadata())
+		}
+		buf := [8]byte{}
+		common.Must2(io.ReadFull(conn, buf[:]))
+		if string(buf[:]) != "12345678" {
+			t.Fatal("wrong request data", string(buf[:]))
+		}
+		resp := <-respChan
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+			t.Fatal("wrong response", resp.Status, resp.Proto)
+		}
+		common.Must2(conn.Write([]byte("87654321")))
+		common.Must2(io.ReadFull(resp.Body, buf[:]))
+		if string(buf[:]) != "87654321" {
+			t.Fatal("wrong response data", string(buf[:]))
+		}
+		conn.Close()
+		resp.Body.Close()
+		reqWriter.Close()
+		h2Transport.CloseIdleConnections()
+	}
+}
@@ -3,6 +3,7 @@ package http
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,7 +11,10 @@ import (
 	"net/http"
 	"strings"
 
+	"golang.org/x/net/http2"
+
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
@@ -62,10 +66,12 @@ func (c *OtherConn) Close() error {
 }
 
 type Server struct {
-	underlay tunnel.Server
-	connChan chan tunnel.Conn
-	ctx      context.Context
-	cancel   context.CancelFunc
+	underlay  tunnel.Server
+	connChan  chan tunnel.Conn
+	tlsConfig *tls.Config // 为空时不接受 TLS 连接
+	h2        bool        // 是否接受 HTTP/2 CONNECT
+	ctx       context.Context
+	cancel    context.CancelFunc
 }
 
 func (s *Server) acceptLoop() {
@@ -82,93 +88,135 @@ func (s *Server) acceptLoop() {
 			}
 		}
 
-		go func(conn net.Conn) {
-			/**
-			ioutil.NopCloser 是一个包装器，它将一个 io.Reader（在这里是 conn，通常是一个网络连接）包装为 io.ReadCloser。它的作用是提供一个 Close 方法，但实际并不执行任何操作（即不做任何关闭连接的工作）。
-			这样做的目的是为了满足 http.ReadRequest 函数对 io.ReadCloser 类型的要求
+		go s.handle(conn)
+	}
+}
+
+// serveHTTP serves the HTTP/1.x requests of the connection
+func (s *Server) serveHTTP(conn net.Conn) {
+	/**
+	ioutil.NopCloser 是一个包装器，它将一个 io.Reader（在这里是 conn，通常是一个网络连接）包装为 io.ReadCloser。它的作用是提供一个 Close 方法，但实际并不执行任何操作（即不做任何关闭连接的工作）。
+	这样做的目的是为了满足 http.ReadRequest 函数对 io.ReadCloser 类型的要求
+
+	bufio.NewReader 创建一个带缓冲的读取器，可以提高读取效率。它会对底层的读取器（这里是 NopCloser(conn)）进行缓冲，从而减少系统调用的次数
+	*/
+	reqBufReader := bufio.NewReader(ioutil.NopCloser(conn))
+	req, err := http.ReadRequest(reqBufReader)
+	if err != nil {
+		log.Error(common.NewError("not a valid http request").Base(err))
+		return
+	}
+
+	if strings.ToUpper(req.Method) == "CONNECT" { // CONNECT
+		addr, err := tunnel.NewAddressFromAddr("tcp", req.Host)
+		if err != nil {
+			log.Error(common.NewError("invalid http dest address").Base(err))
+			conn.Close()
+			return
+		}
+		resp := fmt.Sprintf("HTTP/%d.%d 200 Connection established\r\n\r\n", req.ProtoMajor, req.ProtoMinor)
+		_, err = conn.Write([]byte(resp))
+		if err != nil {
+			log.Error("http failed to respond connect request")
+			conn.Close()
+			return
+		}
+		s.connChan <- &ConnectConn{ // http tcp连接建立
+			Conn: conn,
+			metadata: &tunnel.Metadata{
+				Address: addr,
+				Inbound: Name,
+			},
+		}
+	} else { // GET, POST, PUT...
+		defer conn.Close()
+		for { // 建立转发
+			reqReader, reqWriter := io.Pipe()
+			respReader, respWriter := io.Pipe()
+			var addr *tunnel.Address
+			if addr, err = tunnel.NewAddressFromAddr("tcp", req.Host); err != nil {
+				addr = tunnel.NewAddressFromHostPort("tcp", req.Host, 80)
+			}
+			log.Debug("http dest", addr)
+
+			ctx, cancel := context.WithCancel(s.ctx)
+			newConn := &OtherConn{
+				Conn: conn,
+				metadata: &tunnel.Metadata{
+					Address: addr,
+					Inbound: Name,
+				},
+				ctx:        ctx,
+				cancel:     cancel,
+				reqReader:  reqReader,
+				respWriter: respWriter,
+			}
+			s.connChan <- newConn // pass this http session connection to proxy.RelayConn
+
+			err = req.Write(reqWriter) // write request to the remote
+			if err != nil {
+				log.Error(common.NewError("http failed to write http request").Base(err))
+				return
+			}
 
-			bufio.NewReader 创建一个带缓冲的读取器，可以提高读取效率。它会对底层的读取器（这里是 NopCloser(conn)）进行缓冲，从而减少系统调用的次数
-			*/
-			reqBufReader := bufio.NewReader(ioutil.NopCloser(conn))
-			req, err := http.ReadRequest(reqBufReader)
+			respBufReader := bufio.NewReader(ioutil.NopCloser(respReader)) // read response from the remote
+			resp, err := http.ReadResponse(respBufReader, req)
 			if err != nil {
-				log.Error(common.NewError("not a valid http request").Base(err))
+				log.Error(common.NewError("http failed to read http response").Base(err))
 				return
 			}
+			err = resp.Write(conn) // send the response back to the local
+			if err != nil {
+				log.Error(common.NewError("http failed to write the response back").Base(err))
+				return
+			}
+			newConn.Close()
+			req.Body.Close()
+			resp.Body.Close()
 
-			if strings.ToUpper(req.Method) == "CONNECT" { // CONNECT
-				addr, err := tunnel.NewAddressFromAddr("tcp", req.Host)
-				if err != nil {
-					log.Error(common.NewError("invalid http dest address").Base(err))
-					conn.Close()
-					return
-				}
-				resp := fmt.Sprintf("HTTP/%d.%d 200 Connection established\r\n\r\n", req.ProtoMajor, req.ProtoMinor)
-				_, err = conn.Write([]byte(resp))
-				if err != nil {
-					log.Error("http failed to respond connect request")
-					conn.Close()
-					return
-				}
-				s.connChan <- &ConnectConn{ // http tcp连接建立
-					Conn: conn,
-					metadata: &tunnel.Metadata{
-						Address: addr,
-					},
-				}
-			} else { // GET, POST, PUT...
-				defer conn.Close()
-				for { // 建立转发
-					reqReader, reqWriter := io.Pipe()
-					respReader, respWriter := io.Pipe()
-					var addr *tunnel.Address
-					if addr, err = tunnel.NewAddressFromAddr("tcp", req.Host); err != nil {
-						addr = tunnel.NewAddressFromHostPort("tcp", req.Host, 80)
-					}
-					log.Debug("http dest", addr)
-
-					ctx, cancel := context.WithCancel(s.ctx)
-					newConn := &OtherConn{
-						Conn: conn,
-						metadata: &tunnel.Metadata{
-							Address: addr,
-						},
-						ctx:        ctx,
-						cancel:     cancel,
-						reqReader:  reqReader,
-						respWriter: respWriter,
-					}
-					s.connChan <- newConn // pass this http session connection to proxy.RelayConn
-
-					err = req.Write(reqWriter) // write request to the remote
-					if err != nil {
-						log.Error(common.NewError("http failed to write http request").Base(err))
-						return
-					}
-
-					respBufReader := bufio.NewReader(ioutil.NopCloser(respReader)) // read response from the remote
-					resp, err := http.ReadResponse(respBufReader, req)
-					if err != nil {
-						log.Error(common.NewError("http failed to read http response").Base(err))
-						return
-					}
-					err = resp.Write(conn) // send the response back to the local
-					if err != nil {
-						log.Error(common.NewError("http failed to write the response back").Base(err))
-						return
-					}
-					newConn.Close()
-					req.Body.Close()
-					resp.Body.Close()
-
-					req, err = http.ReadRequest(reqBufReader) // read the next http request from local
-					if err != nil {
-						log.Error(common.NewError("http failed to the read request from local").Base(err))
-						return
-					}
-				}
+			req, err = http.ReadRequest(reqBufReader) // read the next http request from local
+			if err != nil {
+				log.Error(common.NewError("http failed to the read request from local").Base(err))
+				return
 			}
-		}(conn)
+		}
+	}
+}
+
+// handle detects TLS and HTTP/2 prior knowledge connections if they are enabled
+func (s *Server) handle(conn net.Conn) {
+	if s.tlsConfig == nil && !s.h2 {
+		s.serveHTTP(conn)
+		return
+	}
+	rewindConn := common.NewRewindConn(conn)
+	rewindConn.SetBufferSize(16)
+	buf := [4]byte{}
+	_, err := io.ReadFull(rewindConn, buf[:])
+	rewindConn.Rewind()
+	rewindConn.StopBuffering()
+	if err != nil {
+		log.Error(common.NewError("http failed to detect protocol").Base(err))
+		conn.Close()
+		return
+	}
+	switch {
+	case buf[0] == 0x16 && s.tlsConfig != nil: // TLS 握手
+		tlsConn := tls.Server(rewindConn, s.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			log.Error(common.NewError("http tls handshake failed").Base(err))
+			tlsConn.Close()
+			return
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			s.serveH2(tlsConn)
+			return
+		}
+		s.serveHTTP(tlsConn)
+	case string(buf[:]) == "PRI " && s.h2: // 明文 HTTP/2
+		s.serveH2(rewindConn)
+	default:
+		s.serveHTTP(rewindConn)
 	}
 }
 
@@ -194,12 +242,33 @@ func (s *Server) Close() error {
 }
 
 func NewServer(ctx context.Context, underlay tunnel.Server) (*Server, error) {
+	var tlsConfig *tls.Config
+	h2 := false
+	if cfg, ok := config.FromContext(ctx, Name).(*Config); ok {
+		h2 = cfg.HTTP.H2
+		if cfg.HTTP.TLS {
+			keyPair, err := tls.LoadX509KeyPair(cfg.HTTP.CertPath, cfg.HTTP.KeyPath)
+			if err != nil {
+				return nil, common.NewError("http failed to load key pair").Base(err)
+			}
+			tlsConfig = &tls.Config{
+				Certificates: []tls.Certificate{keyPair},
+				NextProtos:   []string{"http/1.1"},
+			}
+			if h2 {
+				tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+			}
+			log.Info("http inbound accepts tls connections, h2:", h2)
+		}
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	server := &Server{
-		underlay: underlay,
-		connChan: make(chan tunnel.Conn, 32),
-		ctx:      ctx,
-		cancel:   cancel,
+		underlay:  underlay,
+		connChan:  make(chan tunnel.Conn, 32),
+		tlsConfig: tlsConfig,
+		h2:        h2,
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 	go server.acceptLoop()
 	return server, nil
@@ -7,8 +7,10 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"strings"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/statistic"
 )
 
 // 一些辅助方法
@@ -37,7 +39,11 @@ where:
 */
 type Metadata struct {
 	Command
-	*Address // 目标地址信息
+	*Address                // 目标地址信息
+	User     statistic.User // 发起请求的用户，仅在服务端认证后有效，不参与序列化
+	Inbound  string         // 接受请求的入站协议名，如 HTTP，SOCKS，不参与序列化
+	Source   net.Addr       // 发起请求的客户端地址，用于出站的 PROXY 协议头部，不参与序列化
+	Resolved []net.IP       // 出站策略检查过的域名地址，拨号时代替域名，不参与序列化
 }
 
 func (r *Metadata) ReadFrom(rr io.Reader) error {
@@ -134,6 +140,10 @@ func NewAddressFromAddr(network string, addr string) (*Address, error) {
 }
 
 func NewAddressFromHostPort(network string, host string, port int) *Address {
+	// IPv6 的 zone 无法在协议中传递，如 fe80::1%eth0
+	if i := strings.LastIndexByte(host, '%'); i > 0 && net.ParseIP(host[:i]) != nil {
+		host = host[:i]
+	}
 	if ip := net.ParseIP(host); ip != nil {
 		if ip.To4() != nil {
 			return &Address{
@@ -221,12 +231,23 @@ func (a *Address) WriteTo(w io.Writer) error {
 	}
 	switch a.AddressType {
 	case DomainName:
+		if len(a.DomainName) > 255 {
+			return common.NewError("domain name too long " + a.DomainName)
+		}
 		w.Write([]byte{byte(len(a.DomainName))})
 		_, err = w.Write([]byte(a.DomainName))
 	case IPv4:
-		_, err = w.Write(a.IP.To4())
+		ip := a.IP.To4()
+		if ip == nil {
+			return common.NewError("invalid IPv4 address " + a.IP.String())
+		}
+		_, err = w.Write(ip)
 	case IPv6:
-		_, err = w.Write(a.IP.To16())
+		ip := a.IP.To16()
+		if ip == nil {
+			return common.NewError("invalid IPv6 address " + a.IP.String())
+		}
+		_, err = w.Write(ip)
 	default:
 		return common.NewError("invalid ATYP " + strconv.FormatInt(int64(a.AddressType), 10))
 	}
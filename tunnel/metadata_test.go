@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+func TestAddress(t *testing.T) {
+	for _, c := range []struct {
+		host        string
+		addressType AddressType
+		encoded     []byte
+		str         string
+	}{
+		{"1.2.3.4", IPv4, []byte{1, 1, 2, 3, 4, 0, 53}, "1.2.3.4:53"},
+		{"::ffff:1.2.3.4", IPv4, []byte{1, 1, 2, 3, 4, 0, 53}, "1.2.3.4:53"},
+		{"2001:db8::1", IPv6, []byte{4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53}, "[2001:db8::1]:53"},
+		{"fe80::1%eth0", IPv6, []byte{4, 0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53}, "[fe80::1]:53"},
+		{"example.com", DomainName, []byte{3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 53}, "example.com:53"},
+	} {
+		addr := NewAddressFromHostPort("udp", c.host, 53)
+		if addr.AddressType != c.addressType || addr.String() != c.str {
+			t.Fatal("wrong address of", c.host, addr.AddressType, addr.String())
+		}
+		buf := bytes.NewBuffer(nil)
+		common.Must(addr.WriteTo(buf))
+		if !bytes.Equal(buf.Bytes(), c.encoded) {
+			t.Fatal("wrong encoding of", c.host, buf.Bytes())
+		}
+		decoded := new(Address)
+		common.Must(decoded.ReadFrom(buf))
+		if decoded.AddressType != c.addressType || decoded.String() != c.str {
+			t.Fatal("wrong decoded address of", c.host, decoded.String())
+		}
+	}
+
+	// ip literals sent as domain names
+	for host, expected := range map[string]AddressType{
+		"1.2.3.4":     IPv4,
+		"2001:db8::1": IPv6,
+	} {
+		buf := bytes.NewBuffer([]byte{3, byte(len(host))})
+		buf.WriteString(host)
+		buf.Write([]byte{0, 53})
+		addr := new(Address)
+		common.Must(addr.ReadFrom(buf))
+		if addr.AddressType != expected || !addr.IP.Equal(net.ParseIP(host)) {
+			t.Fatal("wrong address type of", host, addr.AddressType)
+		}
+	}
+
+	if err := (&Address{AddressType: IPv4, IP: net.ParseIP("2001:db8::1")}).WriteTo(bytes.NewBuffer(nil)); err == nil {
+		t.Fatal("ipv6 address encoded as ipv4")
+	}
+	if err := (&Address{AddressType: IPv6}).WriteTo(bytes.NewBuffer(nil)); err == nil {
+		t.Fatal("empty ipv6 address encoded")
+	}
+	if err := (&Address{AddressType: DomainName, DomainName: strings.Repeat("a", 256)}).WriteTo(bytes.NewBuffer(nil)); err == nil {
+		t.Fatal("long domain name encoded")
+	}
+}
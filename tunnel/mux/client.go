@@ -13,6 +13,7 @@ import (
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/transport"
 )
 
 type muxID uint32
@@ -59,8 +60,26 @@ func (c *Client) cleanLoop() {
 		checkDuration = c.timeout / 4
 	}
 	log.Debug("check duration:", checkDuration.Seconds(), "s")
+	networkChanged := transport.WatchNetworkChange(c.ctx)
 	for {
 		select {
+		case <-networkChanged:
+			// 底层连接已经在网络变化或服务端证书变化时关闭，立即建立新的会话，之后的流不必等待重新连接
+			c.clientPoolLock.Lock()
+			active := len(c.clientPool)
+			for id, info := range c.clientPool {
+				info.client.Close()
+				info.underlayConn.Close()
+				delete(c.clientPool, id)
+			}
+			if active != 0 {
+				if _, err := c.newMuxClient(); err != nil {
+					log.Warn(common.NewError("mux failed to reconnect after carriers reset").Base(err))
+				} else {
+					log.Info("mux client reconnected after carriers reset")
+				}
+			}
+			c.clientPoolLock.Unlock()
 		case <-time.After(checkDuration):
 			c.clientPoolLock.Lock()
 			for id, info := range c.clientPool {
@@ -12,6 +12,14 @@ type Config struct {
 	Mux MuxConfig `json:"mux" yaml:"mux"`
 }
 
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if c.Mux.Enabled && c.Mux.IdleTimeout < 0 {
+		errs.Add("mux.idle_timeout", "must not be negative")
+	}
+	return errs.Err()
+}
+
 func init() {
 	config.RegisterConfigCreator(Name, func() interface{} {
 		return &Config{
@@ -0,0 +1,130 @@
+package naive
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/http2"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+type Client struct {
+	underlay  tunnel.Client
+	transport *http2.Transport
+	auth      string
+	padding   bool
+	ccLock    sync.Mutex
+	cc        *http2.ClientConn // 当前的 http2 连接，所有请求作为其中的流
+	raw       tunnel.Conn
+}
+
+// clientConn returns the http2 connection which can take a new stream, or creates a new one
+func (c *Client) clientConn() (*http2.ClientConn, tunnel.Conn, error) {
+	c.ccLock.Lock()
+	defer c.ccLock.Unlock()
+	if c.cc != nil && c.cc.CanTakeNewRequest() {
+		return c.cc, c.raw, nil
+	}
+	conn, err := c.underlay.DialConn(nil, &Tunnel{})
+	if err != nil {
+		return nil, nil, common.NewError("naive failed to dial using underlying tunnel").Base(err)
+	}
+	cc, err := c.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, common.NewError("naive failed to start http2").Base(err)
+	}
+	log.Debug("naive http2 connection to", conn.RemoteAddr(), "created")
+	c.cc, c.raw = cc, conn
+	return cc, conn, nil
+}
+
+func (c *Client) DialConn(addr *tunnel.Address, t tunnel.Tunnel) (tunnel.Conn, error) {
+	cc, raw, err := c.clientConn()
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method:        http.MethodConnect,
+		URL:           &url.URL{Host: addr.String()},
+		Host:          addr.String(),
+		Header:        make(http.Header),
+		Body:          pr,
+		ContentLength: -1,
+	}
+	if c.auth != "" {
+		req.Header.Set("Proxy-Authorization", c.auth)
+	}
+	if c.padding {
+		req.Header.Set("Padding", paddingHeader())
+	}
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		c.ccLock.Lock()
+		if c.cc == cc { // 连接已经失效，下一次请求重新连接
+			c.cc = nil
+			raw.Close()
+		}
+		c.ccLock.Unlock()
+		return nil, common.NewError("naive failed to send connect request").Base(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		pw.Close()
+		resp.Body.Close()
+		return nil, common.NewError("naive server refused to connect to " + addr.String() + ": " + resp.Status)
+	}
+	conn := &Conn{
+		Conn:   raw,
+		reader: resp.Body,
+		writer: pw,
+		body:   resp.Body,
+		pipe:   pw,
+		metadata: &tunnel.Metadata{
+			Address: addr,
+		},
+	}
+	// 服务端同样带有填充头部时才使用填充
+	if c.padding && resp.Header.Get("Padding") != "" {
+		conn.reader = &paddingReader{r: resp.Body}
+		conn.writer = &paddingWriter{w: pw}
+	}
+	return conn, nil
+}
+
+func (c *Client) DialPacket(t tunnel.Tunnel) (tunnel.PacketConn, error) {
+	return nil, common.NewError("naive udp is not supported")
+}
+
+func (c *Client) Close() error {
+	c.ccLock.Lock()
+	if c.cc != nil {
+		c.cc.Close()
+		c.cc = nil
+	}
+	c.ccLock.Unlock()
+	return c.underlay.Close()
+}
+
+func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
+	cfg := config.FromContext(ctx, Name).(*Config)
+	client := &Client{
+		underlay:  underlay,
+		transport: &http2.Transport{},
+		padding:   cfg.Naive.Padding,
+	}
+	if cfg.Naive.Username != "" {
+		client.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.Naive.Username+":"+cfg.Naive.Password))
+	}
+	log.Debug("naive client created")
+	return client, nil
+}
@@ -0,0 +1,23 @@
+package naive
+
+import "github.com/p4gefau1t/trojan-go/config"
+
+type NaiveConfig struct {
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+	Padding  bool   `json:"padding" yaml:"padding"` // 在每个方向的前几个数据帧中加入随机填充
+}
+
+type Config struct {
+	Naive NaiveConfig `json:"naive" yaml:"naive"`
+}
+
+func init() {
+	config.RegisterConfigCreator(Name, func() interface{} {
+		return &Config{
+			Naive: NaiveConfig{
+				Padding: true,
+			},
+		}
+	})
+}
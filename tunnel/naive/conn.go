@@ -0,0 +1,49 @@
+package naive
+
+import (
+	"io"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// Conn is a CONNECT stream of the http2 connection to the server
+type Conn struct {
+	tunnel.Conn // 多个流共用的底层连接，只用于获取地址
+	reader      io.Reader
+	writer      io.Writer
+	body        io.ReadCloser  // 响应的正文，即服务端发送的数据
+	pipe        *io.PipeWriter // 请求的正文，即发往服务端的数据
+	metadata    *tunnel.Metadata
+}
+
+func (c *Conn) Metadata() *tunnel.Metadata {
+	return c.metadata
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+// Close resets the stream only, the http2 connection is kept for the other streams
+func (c *Conn) Close() error {
+	c.pipe.Close()
+	return c.body.Close()
+}
+
+// 底层连接由多个流共用，不能设置单个流的超时
+func (c *Conn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,122 @@
+package naive
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/http2"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/test/util"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
+	"github.com/p4gefau1t/trojan-go/tunnel/transport"
+)
+
+func TestPadding(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := &paddingWriter{w: buf}
+	var payload []byte
+	for i := 0; i < firstPaddings+4; i++ {
+		p := util.GeneratePayload(100 * (i + 1))
+		payload = append(payload, p...)
+		common.Must2(w.Write(p))
+	}
+	if buf.Len() <= len(payload) {
+		t.Fatal("no padding")
+	}
+	result, err := ioutil.ReadAll(&paddingReader{r: buf})
+	common.Must(err)
+	if !bytes.Equal(result, payload) {
+		t.Fatal("padding mismatch")
+	}
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.w.(http.Flusher).Flush()
+	return n, err
+}
+
+func TestNaive(t *testing.T) {
+	port := common.PickPort("tcp", "127.0.0.1")
+	transportConfig := &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+	}
+	ctx := config.WithConfig(context.Background(), transport.Name, transportConfig)
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		Naive: NaiveConfig{
+			Username: "user",
+			Password: "pass",
+			Padding:  true,
+		},
+	})
+	tcpClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	defer tcpServer.Close()
+
+	// 模拟 naive 服务端，将数据原样返回
+	go func() {
+		conn, err := tcpServer.AcceptConn(nil)
+		if err != nil {
+			return
+		}
+		(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodConnect || r.Host != "example.com:443" ||
+					r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" || r.Header.Get("Padding") == "" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Header().Set("Padding", paddingHeader())
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				io.Copy(&paddingWriter{w: flushWriter{w}}, &paddingReader{r: r.Body})
+			}),
+		})
+	}()
+
+	c, err := NewClient(ctx, tcpClient)
+	common.Must(err)
+	defer c.Close()
+	addr := &tunnel.Address{
+		DomainName:  "example.com",
+		AddressType: tunnel.DomainName,
+		Port:        443,
+	}
+	// 多个流使用同一个 http2 连接
+	for i := 0; i < 3; i++ {
+		conn, err := c.DialConn(addr, nil)
+		common.Must(err)
+		for j := 0; j < firstPaddings+2; j++ {
+			payload := util.GeneratePayload(1024)
+			common.Must2(conn.Write(payload))
+			buf := make([]byte, len(payload))
+			common.Must2(io.ReadFull(conn, buf))
+			if !bytes.Equal(buf, payload) {
+				t.Fatal("payload mismatch")
+			}
+		}
+		conn.Close()
+	}
+
+	addr.Port = 80
+	if _, err := c.DialConn(addr, nil); err == nil {
+		t.Fatal("refused request should fail")
+	}
+}
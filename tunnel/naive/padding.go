@@ -0,0 +1,99 @@
+package naive
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+)
+
+const (
+	firstPaddings  = 8 // 每个方向只有前 8 个数据帧带有填充
+	maxPaddingSize = 255
+	maxPayloadSize = 65535 // 长度字段为 2 字节
+)
+
+// paddingChars are not compressed well by the huffman coding of hpack, so the length of the header is kept
+const paddingChars = "!#$()+<>?@[]^`{}"
+
+// paddingHeader returns the value of the padding header
+func paddingHeader() string {
+	b := make([]byte, 16+rand.Intn(17))
+	for i := range b {
+		b[i] = paddingChars[rand.Intn(len(paddingChars))]
+	}
+	return string(b)
+}
+
+// paddingWriter writes the first frames as [payload length 2][padding length 1][payload][padding]
+type paddingWriter struct {
+	w      io.Writer
+	frames int
+}
+
+func (w *paddingWriter) Write(p []byte) (int, error) {
+	if w.frames >= firstPaddings {
+		return w.w.Write(p)
+	}
+	written := 0
+	for len(p) > 0 && w.frames < firstPaddings {
+		n := len(p)
+		if n > maxPayloadSize {
+			n = maxPayloadSize
+		}
+		padding := rand.Intn(maxPaddingSize + 1)
+		frame := make([]byte, 3+n+padding)
+		binary.BigEndian.PutUint16(frame, uint16(n))
+		frame[2] = byte(padding)
+		copy(frame[3:], p[:n])
+		if _, err := w.w.Write(frame); err != nil {
+			return written, err
+		}
+		w.frames++
+		written += n
+		p = p[n:]
+	}
+	if len(p) > 0 {
+		n, err := w.w.Write(p)
+		return written + n, err
+	}
+	return written, nil
+}
+
+// paddingReader removes the padding of the first frames
+type paddingReader struct {
+	r         io.Reader
+	frames    int
+	remaining int // 当前帧尚未读取的数据长度
+	padding   int // 当前帧的填充长度
+}
+
+func (r *paddingReader) Read(p []byte) (int, error) {
+	for r.remaining == 0 {
+		if r.padding > 0 {
+			if _, err := io.CopyN(ioutil.Discard, r.r, int64(r.padding)); err != nil {
+				return 0, err
+			}
+			r.padding = 0
+		}
+		if r.frames >= firstPaddings {
+			return r.r.Read(p)
+		}
+		var header [3]byte
+		if _, err := io.ReadFull(r.r, header[:]); err != nil {
+			return 0, err
+		}
+		r.frames++
+		r.remaining = int(binary.BigEndian.Uint16(header[:2]))
+		r.padding = int(header[2])
+	}
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.r.Read(p)
+	r.remaining -= n
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,30 @@
+// Package naive implements the client side of the NaïveProxy protocol, which tunnels the requests through
+// the padded HTTP/2 CONNECT streams of a fronting server
+package naive
+
+import (
+	"context"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+const Name = "NAIVE"
+
+type Tunnel struct{}
+
+func (*Tunnel) Name() string {
+	return Name
+}
+
+func (*Tunnel) NewServer(ctx context.Context, underlay tunnel.Server) (tunnel.Server, error) {
+	return nil, common.NewError("naive server is not supported")
+}
+
+func (*Tunnel) NewClient(ctx context.Context, underlay tunnel.Client) (tunnel.Client, error) {
+	return NewClient(ctx, underlay)
+}
+
+func init() {
+	tunnel.RegisterTunnel(Name, &Tunnel{})
+}
@@ -0,0 +1,43 @@
+package padding
+
+import (
+	"context"
+
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+type Client struct {
+	underlay tunnel.Client
+	options  *connOptions
+}
+
+func (c *Client) DialConn(address *tunnel.Address, tunnel tunnel.Tunnel) (tunnel.Conn, error) {
+	conn, err := c.underlay.DialConn(address, &Tunnel{})
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, conn, c.options), nil
+}
+
+func (c *Client) DialPacket(tunnel tunnel.Tunnel) (tunnel.PacketConn, error) {
+	panic("not supported")
+}
+
+func (c *Client) Close() error {
+	return c.underlay.Close()
+}
+
+func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
+	cfg := config.FromContext(ctx, Name).(*Config)
+	options, err := newOptions(&cfg.Padding)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("padding client created")
+	return &Client{
+		underlay: underlay,
+		options:  options,
+	}, nil
+}
@@ -0,0 +1,34 @@
+package padding
+
+import "github.com/p4gefau1t/trojan-go/config"
+
+type PaddingConfig struct {
+	Enabled   bool            `json:"enabled" yaml:"enabled"`
+	Records   int             `json:"records" yaml:"records"`   // 每个方向开头填充的记录数，0 表示全部填充
+	Lengths   []string        `json:"lengths" yaml:"lengths"`   // 填充后记录长度的分布，如 "200-1400"
+	Interval  int             `json:"interval" yaml:"interval"` // 发送空帧的平均间隔，毫秒，0 表示不发送
+	Heartbeat HeartbeatConfig `json:"heartbeat" yaml:"heartbeat"`
+}
+
+// HeartbeatConfig 连接空闲时发送心跳，避免 NAT 网关和有状态防火墙断开空闲的连接
+type HeartbeatConfig struct {
+	Interval int `json:"interval" yaml:"interval"` // 秒，没有写入数据时发送心跳的间隔，0 表示不发送
+	Timeout  int `json:"timeout" yaml:"timeout"`   // 秒，没有收到对端的帧时关闭连接，0 表示不检查
+}
+
+type Config struct {
+	RemoteHost string        `json:"remote_addr" yaml:"remote-addr"`
+	RemotePort int           `json:"remote_port" yaml:"remote-port"`
+	Padding    PaddingConfig `json:"padding" yaml:"padding"`
+}
+
+func init() {
+	config.RegisterConfigCreator(Name, func() interface{} {
+		return &Config{
+			Padding: PaddingConfig{
+				Records: 8,
+				Lengths: []string{"200-1400"},
+			},
+		}
+	})
+}
@@ -0,0 +1,213 @@
+package padding
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// Conn splits the data into frames, the first records of each direction are padded to the lengths of the distribution.
+// Frame format: [2 bytes data length][2 bytes padding length][data][padding]
+// The frames without data are dummy frames, they are dropped by the reader
+type Conn struct {
+	// WARNING: 64-bit fields that use `sync/atomic` package functions
+	// must be 64-bit aligned on 32-bit systems.
+	lastRead  int64 // 最后一次收到帧的时间
+	lastWrite int64 // 最后一次写入帧的时间
+
+	tunnel.Conn
+	reader  io.Reader // 服务端为已经读取了帧头部的 RewindConn
+	lengths lengths
+	records int // 需要填充的记录数，0 表示全部
+	written int // 已经写入的填充记录数
+	data    int // 当前帧中未读取的数据长度
+	padding int // 当前帧中未丢弃的填充长度
+	mu      sync.Mutex
+	done    chan struct{}
+	once    sync.Once
+}
+
+// connOptions are the options of the conns of a client or server
+type connOptions struct {
+	lengths   lengths
+	records   int
+	interval  time.Duration // 发送空帧的平均间隔，0 表示不发送
+	heartbeat time.Duration // 没有写入时发送心跳的间隔，0 表示不发送
+	timeout   time.Duration // 没有收到对端的帧时关闭连接的时间，0 表示不检查
+}
+
+func newOptions(cfg *PaddingConfig) (*connOptions, error) {
+	lengths, err := newLengths(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Heartbeat.Interval < 0 || cfg.Heartbeat.Timeout < 0 {
+		return nil, common.NewError("invalid padding heartbeat interval or timeout")
+	}
+	if cfg.Heartbeat.Interval > 0 && cfg.Heartbeat.Timeout > 0 && cfg.Heartbeat.Timeout <= cfg.Heartbeat.Interval {
+		return nil, common.NewError("padding heartbeat timeout must be longer than the interval")
+	}
+	return &connOptions{
+		lengths:   lengths,
+		records:   cfg.Records,
+		interval:  time.Duration(cfg.Interval) * time.Millisecond,
+		heartbeat: time.Duration(cfg.Heartbeat.Interval) * time.Second,
+		timeout:   time.Duration(cfg.Heartbeat.Timeout) * time.Second,
+	}, nil
+}
+
+func newConn(conn tunnel.Conn, reader io.Reader, options *connOptions) *Conn {
+	now := time.Now().UnixNano()
+	c := &Conn{
+		lastRead:  now,
+		lastWrite: now,
+		Conn:      conn,
+		reader:    reader,
+		lengths:   options.lengths,
+		records:   options.records,
+		done:      make(chan struct{}),
+	}
+	if options.interval > 0 {
+		go c.sendDummy(options.interval)
+	}
+	if options.heartbeat > 0 || options.timeout > 0 {
+		go c.keepAlive(options.heartbeat, options.timeout)
+	}
+	return c
+}
+
+// keepAlive writes an empty frame if nothing is written in the heartbeat interval, so that the idle connection
+// is not dropped by the NAT gateways and firewalls. The conn is closed if nothing is received in the timeout
+func (c *Conn) keepAlive(heartbeat, timeout time.Duration) {
+	period := heartbeat
+	if period == 0 || (timeout > 0 && timeout/2 < period) {
+		period = timeout / 2
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+		now := time.Now()
+		if timeout > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastRead))) > timeout {
+			log.Info("padding connection timed out, no frame received in", timeout)
+			c.Close()
+			return
+		}
+		if heartbeat > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastWrite))) >= heartbeat {
+			c.mu.Lock()
+			err := c.writeFrame(nil, c.lengths.sample()-headerSize)
+			c.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sendDummy writes a dummy frame of the distribution at random intervals until the conn is closed
+func (c *Conn) sendDummy(interval time.Duration) {
+	for {
+		// 间隔在 interval 的一半到一倍半之间随机，避免固定的周期
+		d := interval/2 + time.Duration(rand.Int63n(int64(interval)))
+		select {
+		case <-time.After(d):
+		case <-c.done:
+			return
+		}
+		c.mu.Lock()
+		err := c.writeFrame(nil, c.lengths.sample()-headerSize)
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *Conn) writeFrame(p []byte, padding int) error {
+	frame := make([]byte, headerSize+len(p)+padding)
+	binary.BigEndian.PutUint16(frame[0:2], uint16(len(p)))
+	binary.BigEndian.PutUint16(frame[2:4], uint16(padding))
+	copy(frame[headerSize:], p)
+	_, err := c.Conn.Write(frame)
+	atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+	return err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for c.data == 0 {
+		if c.padding > 0 {
+			if _, err := io.CopyN(ioutil.Discard, c.reader, int64(c.padding)); err != nil {
+				return 0, err
+			}
+			c.padding = 0
+		}
+		var header [headerSize]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return 0, err
+		}
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+		c.data = int(binary.BigEndian.Uint16(header[0:2]))
+		c.padding = int(binary.BigEndian.Uint16(header[2:4]))
+	}
+	if len(p) > c.data {
+		p = p[:c.data]
+	}
+	n, err := c.reader.Read(p)
+	c.data -= n
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		size, padding := len(p), 0
+		if c.records == 0 || c.written < c.records {
+			// 每一帧单独写入，成为一个 TLS 记录
+			length := c.lengths.sample()
+			if size > length-headerSize {
+				size = length - headerSize
+			}
+			padding = length - headerSize - size
+			c.written++
+		} else if size > maxRecord-headerSize {
+			size = maxRecord - headerSize
+		}
+		if err := c.writeFrame(p[:size], padding); err != nil {
+			return written, err
+		}
+		written += size
+		p = p[size:]
+	}
+	return written, nil
+}
+
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		if c.done != nil {
+			close(c.done)
+		}
+	})
+	return c.Conn.Close()
+}
+
+func (c *Conn) Metadata() *tunnel.Metadata {
+	return c.Conn.Metadata()
+}
+
+func (c *Conn) WireTraffic() (uint64, uint64, bool) {
+	return tunnel.WireTrafficOf(c.Conn)
+}
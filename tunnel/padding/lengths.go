@@ -0,0 +1,73 @@
+package padding
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+const (
+	headerSize = 4     // 2 字节数据长度 + 2 字节填充长度
+	maxRecord  = 16384 // 单个 TLS 记录的最大明文长度，填充的帧不会被拆成多个记录
+)
+
+type lengthRange struct {
+	min int
+	max int
+}
+
+// lengths is the distribution of the padded frame lengths, a range is picked at random
+// and the length is picked uniformly in the range
+type lengths []lengthRange
+
+func (l lengths) sample() int {
+	r := l[rand.Intn(len(l))]
+	return r.min + rand.Intn(r.max-r.min+1)
+}
+
+func (l lengths) contains(n int) bool {
+	for _, r := range l {
+		if n >= r.min && n <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLengths parses the ranges like "200-1400" or "600"
+func parseLengths(s []string) (lengths, error) {
+	if len(s) == 0 {
+		return nil, common.NewError("padding lengths are unspecified")
+	}
+	result := make(lengths, 0, len(s))
+	for _, item := range s {
+		bounds := strings.SplitN(strings.TrimSpace(item), "-", 2)
+		min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, common.NewError("invalid padding length " + item).Base(err)
+		}
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				return nil, common.NewError("invalid padding length " + item).Base(err)
+			}
+		}
+		if min <= headerSize || max < min || max > maxRecord {
+			return nil, common.NewError("padding length " + item + " out of range " + strconv.Itoa(headerSize+1) + "-" + strconv.Itoa(maxRecord))
+		}
+		result = append(result, lengthRange{min: min, max: max})
+	}
+	return result, nil
+}
+
+func newLengths(cfg *PaddingConfig) (lengths, error) {
+	if cfg.Records < 0 {
+		return nil, common.NewError("invalid padding records")
+	}
+	if cfg.Interval < 0 {
+		return nil, common.NewError("invalid padding interval")
+	}
+	return parseLengths(cfg.Lengths)
+}
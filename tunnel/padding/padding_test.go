@@ -0,0 +1,242 @@
+package padding
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/test/util"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
+	"github.com/p4gefau1t/trojan-go/tunnel/transport"
+)
+
+// recordConn records the sizes of the writes to the underlying connection
+type recordConn struct {
+	net.Conn
+	sizes []int
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.sizes = append(c.sizes, len(p))
+	return len(p), nil
+}
+
+func (c *recordConn) Metadata() *tunnel.Metadata {
+	return nil
+}
+
+func TestConn(t *testing.T) {
+	l, err := parseLengths([]string{"100-200", "300"})
+	common.Must(err)
+	for _, invalid := range []string{"4", "300-200", "20000", "a-b"} {
+		if _, err := parseLengths([]string{invalid}); err == nil {
+			t.Fatal("invalid lengths accepted", invalid)
+		}
+	}
+
+	w := &recordConn{}
+	c := &Conn{
+		Conn:    w,
+		lengths: l,
+		records: 3,
+	}
+	payload := util.GeneratePayload(40000)
+	n, err := c.Write(payload[:58])
+	common.Must(err)
+	if n != 58 {
+		t.Fatal("wrong written length", n)
+	}
+	n, err = c.Write(payload[58:])
+	common.Must(err)
+	if n != len(payload)-58 {
+		t.Fatal("wrong written length", n)
+	}
+	for i, size := range w.sizes[:3] {
+		if !l.contains(size) {
+			t.Fatal("record", i, "is not padded", size)
+		}
+	}
+	if len(w.sizes) != 6 || w.sizes[3] != maxRecord {
+		t.Fatal("wrong records after padding", w.sizes)
+	}
+}
+
+// bufferConn keeps the bytes written to it
+type bufferConn struct {
+	net.Conn
+	sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (c *bufferConn) Write(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.buf.Write(p)
+}
+
+func (c *bufferConn) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *bufferConn) Metadata() *tunnel.Metadata {
+	return nil
+}
+
+func TestDummyFrames(t *testing.T) {
+	l, err := parseLengths([]string{"100-200"})
+	common.Must(err)
+	w := &bufferConn{}
+	c := newConn(w, nil, &connOptions{lengths: l, records: 1, interval: time.Millisecond * 20})
+	time.Sleep(time.Millisecond * 200)
+	common.Must2(c.Write([]byte("12345678")))
+	time.Sleep(time.Millisecond * 100)
+	c.Close()
+	w.Lock()
+	written := w.buf.Len()
+	data := append([]byte(nil), w.buf.Bytes()...)
+	w.Unlock()
+	if written < 100*5 {
+		t.Fatal("dummy frames are not sent", written)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if w.buf.Len() != written || !w.closed {
+		t.Fatal("dummy frames are sent after closed")
+	}
+
+	// 读取时丢弃空帧
+	r := &Conn{reader: bytes.NewReader(data)}
+	buf := [8]byte{}
+	common.Must2(io.ReadFull(r, buf[:]))
+	if string(buf[:]) != "12345678" {
+		t.Fatal("wrong data", buf)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	l, err := parseLengths([]string{"100"})
+	common.Must(err)
+	w := &bufferConn{}
+	c := newConn(w, nil, &connOptions{
+		lengths:   l,
+		heartbeat: time.Millisecond * 20,
+		timeout:   time.Millisecond * 150,
+	})
+	time.Sleep(time.Millisecond * 70)
+	w.Lock()
+	written := w.buf.Len()
+	data := append([]byte(nil), w.buf.Bytes()...)
+	w.Unlock()
+	if written < 100*2 || written%100 != 0 {
+		t.Fatal("heartbeats are not sent", written)
+	}
+	if data[0] != 0 || data[1] != 0 {
+		t.Fatal("heartbeat carries data")
+	}
+
+	// 没有收到对端的帧，超时后关闭
+	time.Sleep(time.Millisecond * 200)
+	w.Lock()
+	closed := w.closed
+	w.Unlock()
+	if !closed {
+		t.Fatal("conn is not closed after timeout")
+	}
+	c.Close()
+
+	_, err = newOptions(&PaddingConfig{
+		Lengths:   []string{"100"},
+		Heartbeat: HeartbeatConfig{Interval: 30, Timeout: 10},
+	})
+	if err == nil {
+		t.Fatal("timeout shorter than heartbeat interval is accepted")
+	}
+}
+
+func TestPadding(t *testing.T) {
+	p, err := strconv.ParseInt(util.HTTPPort, 10, 32)
+	common.Must(err)
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+	})
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	tcpClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	ctx = config.WithConfig(ctx, Name, &Config{
+		RemoteHost: "127.0.0.1",
+		RemotePort: int(p),
+		Padding: PaddingConfig{
+			Enabled: true,
+			Records: 4,
+			Lengths: []string{"1100-1400"},
+		},
+	})
+	c, err := NewClient(ctx, tcpClient)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	var conn1, conn2 net.Conn
+	go func() {
+		var err error
+		conn1, err = c.DialConn(nil, nil)
+		common.Must(err)
+		conn1.Write(util.GeneratePayload(1024))
+		wg.Done()
+	}()
+	go func() {
+		var err error
+		conn2, err = s.AcceptConn(nil)
+		common.Must(err)
+		buf := [1024]byte{}
+		io.ReadFull(conn2, buf[:])
+		wg.Done()
+	}()
+	wg.Wait()
+	if !util.CheckConn(conn1, conn2) {
+		t.Fail()
+	}
+
+	go func() {
+		if _, err := s.AcceptConn(nil); err == nil {
+			t.Fail()
+		}
+	}()
+
+	// 未填充的数据被重定向
+	conn3, err := tcpClient.DialConn(nil, nil)
+	common.Must(err)
+	_, err = conn3.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	common.Must(err)
+	buf := [1024]byte{}
+	n, err := conn3.Read(buf[:])
+	common.Must(err)
+	if !strings.Contains(string(buf[:n]), "HTTP/1.1") {
+		t.Fatal("not redirected", string(buf[:n]))
+	}
+	conn1.Close()
+	conn3.Close()
+	c.Close()
+	s.Close()
+}
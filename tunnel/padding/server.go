@@ -0,0 +1,79 @@
+package padding
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/redirector"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+type Server struct {
+	*redirector.Redirector
+	underlay  tunnel.Server
+	redirAddr net.Addr
+	options   *connOptions
+}
+
+func (s *Server) AcceptConn(overlay tunnel.Tunnel) (tunnel.Conn, error) {
+	conn, err := s.underlay.AcceptConn(&Tunnel{})
+	if err != nil {
+		return nil, common.NewError("padding failed to accept connection from underlying tunnel").Base(err)
+	}
+	rewindConn := common.NewRewindConn(conn)
+	rewindConn.SetBufferSize(headerSize)
+	defer rewindConn.StopBuffering()
+
+	// 客户端的第一帧总是被填充到分布中的长度，其他数据（如主动探测）交给重定向处理
+	var header [headerSize]byte
+	if _, err := io.ReadFull(rewindConn, header[:]); err != nil {
+		conn.Close()
+		return nil, common.NewError("padding failed to read the frame header").Base(err)
+	}
+	length := headerSize + int(binary.BigEndian.Uint16(header[0:2])) + int(binary.BigEndian.Uint16(header[2:4]))
+	rewindConn.Rewind()
+	rewindConn.StopBuffering()
+	if !s.options.lengths.contains(length) {
+		log.Error(common.NewError("padding found invalid frame from " + conn.RemoteAddr().String()))
+		s.Redirect(&redirector.Redirection{
+			RedirectTo:  s.redirAddr,
+			InboundConn: rewindConn,
+		})
+		return nil, common.NewError("invalid padding frame")
+	}
+	return newConn(conn, rewindConn, s.options), nil
+}
+
+func (s *Server) AcceptPacket(t tunnel.Tunnel) (tunnel.PacketConn, error) {
+	panic("not supported")
+}
+
+func (s *Server) Close() error {
+	return s.underlay.Close()
+}
+
+func NewServer(ctx context.Context, underlay tunnel.Server) (*Server, error) {
+	cfg := config.FromContext(ctx, Name).(*Config)
+	options, err := newOptions(&cfg.Padding)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RemoteHost == "" {
+		return nil, common.NewError("invalid padding redirection address")
+	}
+	if cfg.RemotePort == 0 {
+		return nil, common.NewError("invalid padding redirection port")
+	}
+	log.Debug("padding server created")
+	return &Server{
+		underlay:   underlay,
+		Redirector: redirector.NewRedirector(ctx),
+		redirAddr:  tunnel.NewAddressFromHostPort("tcp", cfg.RemoteHost, cfg.RemotePort),
+		options:    options,
+	}, nil
+}
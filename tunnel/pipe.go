@@ -0,0 +1,338 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// 连接和数据包流尚未被服务端接受时，最多排队的数量
+const pipeBacklog = 16
+
+// pipe is shared by the two ends of an in-memory tunnel
+type pipe struct {
+	conns   chan Conn
+	packets chan PacketConn
+	ctx     context.Context // 服务端关闭后取消
+	cancel  context.CancelFunc
+	addr    *net.TCPAddr
+	port    uint32 // 上一个分配给客户端连接的端口
+}
+
+// PipeClient dials the conns and packet streams accepted by the PipeServer of the same pipe
+type PipeClient struct {
+	*pipe
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// check fails if either end has been closed, sending to the backlog succeeds even if the server is closed
+func (c *PipeClient) check() error {
+	select {
+	case <-c.ctx.Done():
+		return common.NewError("pipe client closed")
+	case <-c.pipe.ctx.Done():
+		return common.NewError("pipe server closed")
+	default:
+		return nil
+	}
+}
+
+func (c *PipeClient) DialConn(*Address, Tunnel) (Conn, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	local, remote := net.Pipe()
+	clientAddr := &net.TCPAddr{
+		IP:   c.addr.IP,
+		Port: int(atomic.AddUint32(&c.port, 1)),
+	}
+	server := newPipeConn(remote, c.addr, clientAddr)
+	select {
+	case c.conns <- server:
+		return newPipeConn(local, clientAddr, c.addr), nil
+	case <-c.pipe.ctx.Done():
+		server.Close()
+		local.Close()
+		return nil, common.NewError("pipe server closed")
+	case <-c.ctx.Done():
+		server.Close()
+		local.Close()
+		return nil, common.NewError("pipe client closed")
+	}
+}
+
+func (c *PipeClient) DialPacket(Tunnel) (PacketConn, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	local, remote := newPipePacketConn(c.addr)
+	select {
+	case c.packets <- remote:
+		return local, nil
+	case <-c.pipe.ctx.Done():
+		return nil, common.NewError("pipe server closed")
+	case <-c.ctx.Done():
+		return nil, common.NewError("pipe client closed")
+	}
+}
+
+// Close makes the client stop dialing, the conns already dialed are not affected
+func (c *PipeClient) Close() error {
+	c.cancel()
+	return nil
+}
+
+// PipeServer accepts the conns and packet streams dialed by the PipeClient of the same pipe
+type PipeServer struct {
+	*pipe
+}
+
+func (s *PipeServer) AcceptConn(Tunnel) (Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.ctx.Done():
+		return nil, common.NewError("pipe server closed")
+	}
+}
+
+func (s *PipeServer) AcceptPacket(Tunnel) (PacketConn, error) {
+	select {
+	case conn := <-s.packets:
+		return conn, nil
+	case <-s.ctx.Done():
+		return nil, common.NewError("pipe server closed")
+	}
+}
+
+// Close makes the server stop accepting, and the client fails to dial since then
+func (s *PipeServer) Close() error {
+	s.cancel()
+	return nil
+}
+
+// NewPipe creates an in-memory tunnel without binding any socket, the conns dialed from the client are accepted by the server.
+// The ends can be used as the underlays of the protocol stacks, e.g. in the tests.
+// The server conns report 127.0.0.1:443 as their local address, and the client conns have distinct ports
+func NewPipe() (*PipeClient, *PipeServer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pipe{
+		conns:   make(chan Conn, pipeBacklog),
+		packets: make(chan PacketConn, pipeBacklog),
+		ctx:     ctx,
+		cancel:  cancel,
+		addr: &net.TCPAddr{
+			IP:   net.IPv4(127, 0, 0, 1),
+			Port: 443,
+		},
+		port: 1023,
+	}
+	clientCtx, clientCancel := context.WithCancel(context.Background())
+	return &PipeClient{
+		pipe:   p,
+		ctx:    clientCtx,
+		cancel: clientCancel,
+	}, &PipeServer{pipe: p}
+}
+
+// pipeConn is one end of an in-memory connection. Like the socket, the data written is buffered
+// and sent to the peer in the background, so a write doesn't wait for the peer to read
+type pipeConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+	writes chan []byte
+	closed chan struct{}
+	broken chan struct{} // 对端关闭后不再发送
+	once   sync.Once
+}
+
+func newPipeConn(conn net.Conn, local, remote net.Addr) *pipeConn {
+	c := &pipeConn{
+		Conn:   conn,
+		local:  local,
+		remote: remote,
+		writes: make(chan []byte, pipeBacklog),
+		closed: make(chan struct{}),
+		broken: make(chan struct{}),
+	}
+	go c.sendLoop()
+	return c
+}
+
+func (c *pipeConn) sendLoop() {
+	defer c.Conn.Close()
+	for {
+		select {
+		case b := <-c.writes:
+			if _, err := c.Conn.Write(b); err != nil {
+				close(c.broken)
+				return
+			}
+		case <-c.closed:
+			// 关闭前发送已经写入的数据
+			for {
+				select {
+				case b := <-c.writes:
+					if _, err := c.Conn.Write(b); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	copy(b, p)
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	case <-c.broken:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case c.writes <- b:
+		return len(p), nil
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	case <-c.broken:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *pipeConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline only sets the read deadline, the writes never block for long
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *pipeConn) Metadata() *Metadata {
+	return nil
+}
+
+type pipePacket struct {
+	metadata *Metadata
+	payload  []byte
+}
+
+// pipePacketConn is one end of an in-memory packet stream, closing either end closes both
+type pipePacketConn struct {
+	input    chan *pipePacket
+	output   chan *pipePacket
+	done     chan struct{}
+	once     *sync.Once
+	addr     net.Addr
+	deadline ReadDeadline
+}
+
+func newPipePacketConn(addr net.Addr) (*pipePacketConn, *pipePacketConn) {
+	a := make(chan *pipePacket, pipeBacklog)
+	b := make(chan *pipePacket, pipeBacklog)
+	done := make(chan struct{})
+	once := new(sync.Once)
+	return &pipePacketConn{input: a, output: b, done: done, once: once, addr: addr},
+		&pipePacketConn{input: b, output: a, done: done, once: once, addr: addr}
+}
+
+func (c *pipePacketConn) WriteWithMetadata(p []byte, m *Metadata) (int, error) {
+	payload := make([]byte, len(p))
+	copy(payload, p)
+	select {
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case c.output <- &pipePacket{metadata: m, payload: payload}:
+		return len(p), nil
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *pipePacketConn) ReadWithMetadata(p []byte) (int, *Metadata, error) {
+	select {
+	case packet := <-c.input:
+		n := copy(p, packet.payload)
+		return n, packet.metadata, nil
+	case <-c.deadline.Wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.done:
+		return 0, nil, io.EOF
+	}
+}
+
+func (c *pipePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, m, err := c.ReadWithMetadata(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	if m == nil {
+		return n, nil, nil
+	}
+	return n, m.Address, nil
+}
+
+func (c *pipePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	address, err := NewAddressFromAddr("udp", addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return c.WriteWithMetadata(p, &Metadata{
+		Address: address,
+	})
+}
+
+func (c *pipePacketConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
+
+func (c *pipePacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *pipePacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *pipePacketConn) SetReadDeadline(t time.Time) error {
+	c.deadline.Set(t)
+	return nil
+}
+
+func (c *pipePacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
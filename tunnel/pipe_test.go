@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+func TestPipe(t *testing.T) {
+	c, s := NewPipe()
+
+	conn1, err := c.DialConn(nil, nil)
+	common.Must(err)
+	conn2, err := s.AcceptConn(nil)
+	common.Must(err)
+	if conn1.LocalAddr().String() != conn2.RemoteAddr().String() || conn2.LocalAddr().String() != "127.0.0.1:443" {
+		t.Fatal("wrong addresses", conn1.LocalAddr(), conn2.RemoteAddr(), conn2.LocalAddr())
+	}
+	go conn1.Write([]byte("hello"))
+	buf := make([]byte, 16)
+	common.Must2(io.ReadFull(conn2, buf[:5]))
+	if string(buf[:5]) != "hello" {
+		t.Fatal("unexpected data", string(buf[:5]))
+	}
+	conn1.Close()
+	if _, err := conn2.Read(buf); err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+
+	packet1, err := c.DialPacket(nil)
+	common.Must(err)
+	packet2, err := s.AcceptPacket(nil)
+	common.Must(err)
+	payload := []byte("12345678")
+	common.Must2(packet1.WriteWithMetadata(payload, &Metadata{
+		Address: NewAddressFromHostPort("udp", "example.com", 53),
+	}))
+	payload[0] = 0 // 写入后修改不影响对端
+	n, m, err := packet2.ReadWithMetadata(buf)
+	common.Must(err)
+	if !bytes.Equal(buf[:n], []byte("12345678")) || m.String() != "example.com:53" {
+		t.Fatal("unexpected packet", buf[:n], m)
+	}
+	packet2.Close()
+	if _, _, err := packet1.ReadWithMetadata(buf); err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+
+	s.Close()
+	if _, err := c.DialConn(nil, nil); err == nil {
+		t.Fatal("dialed a closed pipe")
+	}
+	c.Close()
+}
@@ -7,13 +7,17 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	v2router "github.com/v2fly/v2ray-core/v4/app/router"
+	"gopkg.in/yaml.v3"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/common/geodata"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/proxy"
+	"github.com/p4gefau1t/trojan-go/statistic/memory"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
 	"github.com/p4gefau1t/trojan-go/tunnel/transport"
@@ -23,6 +27,8 @@ const (
 	Block  = 0
 	Bypass = 1
 	Proxy  = 2
+	// Chain is the policy of the first outbound chain, the n-th chain uses Chain+n
+	Chain = 3
 )
 
 const (
@@ -31,8 +37,6 @@ const (
 	IPOnDemand   = 2
 )
 
-const MaxPacketSize = 1024 * 8
-
 func matchDomain(list []*v2router.Domain, target string) bool {
 	for _, d := range list {
 		switch d.GetType() {
@@ -119,64 +123,168 @@ func newIPAddress(address *tunnel.Address) (*tunnel.Address, error) {
 	return newAddress, nil
 }
 
-type Client struct {
-	domains        [3][]*v2router.Domain
-	cidrs          [3][]*v2router.CIDR
-	defaultPolicy  int
-	domainStrategy int
-	underlay       tunnel.Client
-	direct         *freedom.Client // freedom 客户端
-	ctx            context.Context
-	cancel         context.CancelFunc
+// portRange is a range of the destination ports, e.g. "port:6881-6889"
+type portRange struct {
+	from, to int
 }
 
-func (c *Client) Route(address *tunnel.Address) int {
+func matchPort(list []portRange, port int) bool {
+	for _, r := range list {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleSet is the compiled rules, indexed by the policy
+type ruleSet struct {
+	domains [][]*v2router.Domain
+	cidrs   [][]*v2router.CIDR
+	ports   [][]portRange
+	order   []int // 匹配的顺序：block，各出站链，bypass，proxy
+}
+
+func newRuleSet(policies int) *ruleSet {
+	order := []int{Block}
+	for i := Chain; i < policies; i++ {
+		order = append(order, i)
+	}
+	order = append(order, Bypass, Proxy)
+	return &ruleSet{
+		domains: make([][]*v2router.Domain, policies),
+		cidrs:   make([][]*v2router.CIDR, policies),
+		ports:   make([][]portRange, policies),
+		order:   order,
+	}
+}
+
+// match returns the policy of the first matched rule, the port rules are matched before the domain and ip rules
+func (r *ruleSet) match(address *tunnel.Address, domainStrategy int) (int, bool) {
+	for _, i := range r.order {
+		if matchPort(r.ports[i], address.Port) {
+			return i, true
+		}
+	}
 	if address.AddressType == tunnel.DomainName {
-		if c.domainStrategy == IPOnDemand {
+		if domainStrategy == IPOnDemand {
 			resolvedIP, err := newIPAddress(address)
 			if err == nil {
-				for i := Block; i <= Proxy; i++ {
-					if matchIP(c.cidrs[i], resolvedIP.IP) {
-						return i
+				for _, i := range r.order {
+					if matchIP(r.cidrs[i], resolvedIP.IP) {
+						return i, true
 					}
 				}
 			}
 		}
-		for i := Block; i <= Proxy; i++ {
-			if matchDomain(c.domains[i], address.DomainName) {
-				return i
+		for _, i := range r.order {
+			if matchDomain(r.domains[i], address.DomainName) {
+				return i, true
 			}
 		}
-		if c.domainStrategy == IPIfNonMatch {
+		if domainStrategy == IPIfNonMatch {
 			resolvedIP, err := newIPAddress(address)
 			if err == nil {
-				for i := Block; i <= Proxy; i++ {
-					if matchIP(c.cidrs[i], resolvedIP.IP) {
-						return i
+				for _, i := range r.order {
+					if matchIP(r.cidrs[i], resolvedIP.IP) {
+						return i, true
 					}
 				}
 			}
 		}
 	} else {
-		for i := Block; i <= Proxy; i++ {
-			if matchIP(c.cidrs[i], address.IP) {
-				return i
+		for _, i := range r.order {
+			if matchIP(r.cidrs[i], address.IP) {
+				return i, true
 			}
 		}
 	}
+	return 0, false
+}
+
+// inboundPolicy overrides the routing of the requests from an inbound or a user
+type inboundPolicy struct {
+	rules         *ruleSet
+	defaultPolicy int // 未命中入站规则时使用的策略，-1 表示使用全局规则
+}
+
+// route returns the policy of the request, false if the global rules should be used
+func (p *inboundPolicy) route(address *tunnel.Address, domainStrategy int) (int, bool) {
+	if policy, ok := p.rules.match(address, domainStrategy); ok {
+		return policy, true
+	}
+	return p.defaultPolicy, p.defaultPolicy >= 0
+}
+
+type Client struct {
+	rules          *ruleSet
+	inbounds       map[string]*inboundPolicy // 入站协议名 -> 路由规则
+	users          *memory.Selector          // 选择用户或用户组的路由规则
+	userPolicies   []*inboundPolicy
+	defaultPolicy  int
+	domainStrategy int
+	rulesDisabled  int32 // 运行时关闭规则后全部代理
+	underlay       tunnel.Client
+	direct         *freedom.Client // freedom 客户端
+	chains         []tunnel.Client // 命名的出站链，策略为 Chain+下标
+	chainTags      []string
+	leaks          *leakGuard // 为空时不阻止直连的 DNS 查询
+	ctx            context.Context
+	cancel         context.CancelFunc
+	unregister     func() // 从注册表中移除
+}
+
+func (c *Client) Route(address *tunnel.Address) int {
+	if policy, ok := c.rules.match(address, c.domainStrategy); ok {
+		return policy
+	}
 	return c.defaultPolicy
 }
 
+// RouteMetadata applies the rules of the authenticated user first, then the rules of the inbound and the global rules
+func (c *Client) RouteMetadata(metadata *tunnel.Metadata) int {
+	if atomic.LoadInt32(&c.rulesDisabled) == 1 {
+		return Proxy
+	}
+	if metadata.User != nil {
+		if i, found := c.users.Select(metadata.User); found {
+			if policy, ok := c.userPolicies[i].route(metadata.Address, c.domainStrategy); ok {
+				return policy
+			}
+		}
+	}
+	if inbound, found := c.inbounds[metadata.Inbound]; found {
+		if policy, ok := inbound.route(metadata.Address, c.domainStrategy); ok {
+			return policy
+		}
+	}
+	return c.Route(metadata.Address)
+}
+
 // TCP 连接
 func (c *Client) DialConn(address *tunnel.Address, overlay tunnel.Tunnel) (tunnel.Conn, error) {
-	policy := c.Route(address)
+	return c.DialConnWithMetadata(&tunnel.Metadata{Address: address}, overlay)
+}
+
+// DialConnWithMetadata routes the connection according to the inbound of the request
+func (c *Client) DialConnWithMetadata(metadata *tunnel.Metadata, overlay tunnel.Tunnel) (tunnel.Conn, error) {
+	address := metadata.Address
+	policy := c.RouteMetadata(metadata)
+	if policy == Bypass && c.leaks != nil {
+		if kind := c.leaks.check(metadata); kind != "" {
+			return nil, common.NewError("router blocked direct " + kind + " query to " + address.String())
+		}
+	}
 	switch policy {
 	case Proxy:
+		if dialer, ok := c.underlay.(tunnel.MetadataDialer); ok {
+			return dialer.DialConnWithMetadata(metadata, overlay)
+		}
 		return c.underlay.DialConn(address, overlay) // 需要代理，则使用底层 连接
 	case Block:
 		return nil, common.NewError("router blocked address: " + address.String())
 	case Bypass:
-		conn, err := c.direct.DialConn(address, &Tunnel{}) // 直接连接
+		conn, err := c.direct.DialConnWithMetadata(metadata, &Tunnel{}) // 直接连接
 		if err != nil {
 			return nil, common.NewError("router dial error").Base(err)
 		}
@@ -184,16 +292,33 @@ func (c *Client) DialConn(address *tunnel.Address, overlay tunnel.Tunnel) (tunne
 			Conn: conn,
 		}, nil
 	}
+	if i := policy - Chain; i >= 0 && i < len(c.chains) {
+		conn, err := c.chains[i].DialConn(address, overlay)
+		if err != nil {
+			return nil, common.NewError("router failed to dial through chain " + c.chainTags[i]).Base(err)
+		}
+		return conn, nil
+	}
 	panic("unknown policy")
 }
 
 // UDP 连接
 func (c *Client) DialPacket(overlay tunnel.Tunnel) (tunnel.PacketConn, error) {
+	return c.DialPacketWithMetadata(nil, overlay)
+}
+
+// DialPacketWithMetadata passes the metadata of the inbound to the underlay, e.g. the user to choose the source address
+func (c *Client) DialPacketWithMetadata(metadata *tunnel.Metadata, overlay tunnel.Tunnel) (tunnel.PacketConn, error) {
 	directConn, err := net.ListenPacket("udp", "")
 	if err != nil {
 		return nil, common.NewError("router failed to dial udp (direct)").Base(err)
 	}
-	proxy, err := c.underlay.DialPacket(overlay)
+	var proxy tunnel.PacketConn
+	if dialer, ok := c.underlay.(tunnel.MetadataPacketDialer); ok && metadata != nil {
+		proxy, err = dialer.DialPacketWithMetadata(metadata, overlay)
+	} else {
+		proxy, err = c.underlay.DialPacket(overlay)
+	}
 	if err != nil {
 		return nil, common.NewError("router failed to dial udp (proxy)").Base(err)
 	}
@@ -202,6 +327,7 @@ func (c *Client) DialPacket(overlay tunnel.Tunnel) (tunnel.PacketConn, error) {
 		Client:     c,
 		PacketConn: directConn,
 		proxy:      proxy,
+		chainConns: make(map[int]tunnel.PacketConn),
 		cancel:     cancel,
 		ctx:        ctx,
 		packetChan: make(chan *packetInfo, 16),
@@ -211,7 +337,11 @@ func (c *Client) DialPacket(overlay tunnel.Tunnel) (tunnel.PacketConn, error) {
 }
 
 func (c *Client) Close() error {
+	c.unregister()
 	c.cancel()
+	for _, chain := range c.chains {
+		chain.Close()
+	}
 	return c.underlay.Close()
 }
 
@@ -220,48 +350,50 @@ type codeInfo struct {
 	strategy int
 }
 
-func loadCode(cfg *Config, prefix string) []codeInfo {
+// loadCode extracts the rules with the prefix from the lists indexed by the policy
+func loadCode(lists [][]string, prefix string) []codeInfo {
 	codes := []codeInfo{}
-	for _, s := range cfg.Router.Proxy {
-		if strings.HasPrefix(s, prefix) {
-			if left := s[len(prefix):]; len(left) > 0 {
-				codes = append(codes, codeInfo{
-					code:     left,
-					strategy: Proxy,
-				})
-			} else {
-				log.Warn("invalid empty rule:", s)
-			}
-		}
+	strategies := []int{Proxy, Bypass, Block}
+	for i := Chain; i < len(lists); i++ {
+		strategies = append(strategies, i)
 	}
-	for _, s := range cfg.Router.Bypass {
-		if strings.HasPrefix(s, prefix) {
-			if left := s[len(prefix):]; len(left) > 0 {
-				codes = append(codes, codeInfo{
-					code:     left,
-					strategy: Bypass,
-				})
-			} else {
-				log.Warn("invalid empty rule:", s)
+	for _, strategy := range strategies {
+		for _, s := range lists[strategy] {
+			if strings.HasPrefix(s, prefix) {
+				if left := s[len(prefix):]; len(left) > 0 {
+					codes = append(codes, codeInfo{
+						code:     left,
+						strategy: strategy,
+					})
+				} else {
+					log.Warn("invalid empty rule:", s)
+				}
 			}
 		}
 	}
-	for _, s := range cfg.Router.Block {
-		if strings.HasPrefix(s, prefix) {
-			if left := s[len(prefix):]; len(left) > 0 {
-				codes = append(codes, codeInfo{
-					code:     left,
-					strategy: Block,
-				})
-			} else {
-				log.Warn("invalid empty rule:", s)
-			}
+	return codes
+}
+
+// parsePolicy parses proxy, bypass, block or the tag of an outbound chain
+func parsePolicy(policy string, chainTags []string) (int, error) {
+	switch strings.ToLower(policy) {
+	case "proxy":
+		return Proxy, nil
+	case "bypass":
+		return Bypass, nil
+	case "block":
+		return Block, nil
+	}
+	for i, tag := range chainTags {
+		if tag == policy {
+			return Chain + i, nil
 		}
 	}
-	return codes
+	return 0, common.NewError("unknown policy: " + policy)
 }
 
-func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
+// loadRules compiles the proxy, bypass and block lists
+func loadRules(cfg *Config, lists [][]string, geodataLoader geodata.GeodataLoader) (*ruleSet, error) {
 	// 用于记录 Go 运行时的内存分配统计信息。使用 m1 := runtime.MemStats{} 可以创建一个新的 MemStats 变量，但这并不会自动填充其内容。
 	// 你通常需要调用 runtime.ReadMemStats(&m1) 来获取当前的内存使用情况
 	m1 := runtime.MemStats{}
@@ -269,58 +401,10 @@ func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
 	m3 := runtime.MemStats{}
 	m4 := runtime.MemStats{}
 
-	cfg := config.FromContext(ctx, Name).(*Config)
-	var cancel context.CancelFunc
-	ctx, cancel = context.WithCancel(ctx)
-
-	direct, err := freedom.NewClient(ctx, nil)
-	if err != nil {
-		cancel()
-		return nil, common.NewError("router failed to initialize raw client").Base(err)
-	}
-
-	client := &Client{
-		domains:  [3][]*v2router.Domain{},
-		cidrs:    [3][]*v2router.CIDR{},
-		underlay: underlay, // 下一层协议服务
-		direct:   direct,
-		ctx:      ctx,
-		cancel:   cancel,
-	}
-	/**
-	域名解析策略，默认"as_is"。合法的值有：
-		1. “as_is”，只在各列表中的域名规则内进行匹配。
-		2. “ip_if_non_match”，先在各列表中的域名规则内进行匹配；如果不匹配，则解析为IP后，在各列表中的IP地址规则内进行匹配。该策略可能导致DNS泄漏或遭到污染。
-		3. “ip_on_demand”，先解析为IP，在各列表中的IP地址规则内进行匹配；如果不匹配，则在各列表中的域名规则内进行匹配。该策略可能导致DNS泄漏或遭到污染。
-	*/
-	switch strings.ToLower(cfg.Router.DomainStrategy) {
-	case "as_is", "as-is", "asis":
-		client.domainStrategy = AsIs
-	case "ip_if_non_match", "ip-if-non-match", "ipifnonmatch":
-		client.domainStrategy = IPIfNonMatch
-	case "ip_on_demand", "ip-on-demand", "ipondemand":
-		client.domainStrategy = IPOnDemand
-	default:
-		return nil, common.NewError("unknown strategy: " + cfg.Router.DomainStrategy)
-	}
-
-	// 指的是三个列表匹配均失败后，使用的默认策略，默认为"proxy”，即进行代理
-	switch strings.ToLower(cfg.Router.DefaultPolicy) {
-	case "proxy":
-		client.defaultPolicy = Proxy
-	case "bypass":
-		client.defaultPolicy = Bypass
-	case "block":
-		client.defaultPolicy = Block
-	default:
-		return nil, common.NewError("unknown strategy: " + cfg.Router.DomainStrategy)
-	}
+	rules := newRuleSet(len(lists))
 
 	runtime.ReadMemStats(&m1) // 获取当前的内存使用情况
-
-	geodataLoader := geodata.NewGeodataLoader()
-
-	ipCode := loadCode(cfg, "geoip:")
+	ipCode := loadCode(lists, "geoip:")
 	for _, c := range ipCode {
 		code := c.code
 		cidrs, err := geodataLoader.LoadIP(cfg.Router.GeoIPFilename, code) // geoip.dat
@@ -328,13 +412,13 @@ func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
 			log.Error(err)
 		} else {
 			log.Infof("geoip:%s loaded", code)
-			client.cidrs[c.strategy] = append(client.cidrs[c.strategy], cidrs...)
+			rules.cidrs[c.strategy] = append(rules.cidrs[c.strategy], cidrs...)
 		}
 	}
 
 	runtime.ReadMemStats(&m2) // 获取当前的内存使用情况
 
-	siteCode := loadCode(cfg, "geosite:")
+	siteCode := loadCode(lists, "geosite:")
 	for _, c := range siteCode {
 		code := c.code
 		attrWanted := ""
@@ -361,13 +445,13 @@ func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
 				for _, domain := range domainList {
 					for _, attr := range domain.GetAttribute() {
 						if strings.EqualFold(attrWanted, attr.GetKey()) {
-							client.domains[c.strategy] = append(client.domains[c.strategy], domain)
+							rules.domains[c.strategy] = append(rules.domains[c.strategy], domain)
 							found = true
 						}
 					}
 				}
 			} else {
-				client.domains[c.strategy] = append(client.domains[c.strategy], domainList...)
+				rules.domains[c.strategy] = append(rules.domains[c.strategy], domainList...)
 				found = true
 			}
 			if found {
@@ -380,30 +464,30 @@ func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
 
 	runtime.ReadMemStats(&m3)
 
-	domainInfo := loadCode(cfg, "domain:")
+	domainInfo := loadCode(lists, "domain:")
 	for _, info := range domainInfo {
-		client.domains[info.strategy] = append(client.domains[info.strategy], &v2router.Domain{
+		rules.domains[info.strategy] = append(rules.domains[info.strategy], &v2router.Domain{
 			Type:      v2router.Domain_Domain,
 			Value:     strings.ToLower(info.code),
 			Attribute: nil,
 		})
 	}
 
-	keywordInfo := loadCode(cfg, "keyword:")
+	keywordInfo := loadCode(lists, "keyword:")
 	for _, info := range keywordInfo {
-		client.domains[info.strategy] = append(client.domains[info.strategy], &v2router.Domain{
+		rules.domains[info.strategy] = append(rules.domains[info.strategy], &v2router.Domain{
 			Type:      v2router.Domain_Plain,
 			Value:     strings.ToLower(info.code),
 			Attribute: nil,
 		})
 	}
 
-	regexInfo := loadCode(cfg, "regex:")
+	regexInfo := loadCode(lists, "regex:")
 	for _, info := range regexInfo {
 		if _, err := regexp.Compile(info.code); err != nil {
 			return nil, common.NewError("invalid regular expression: " + info.code).Base(err)
 		}
-		client.domains[info.strategy] = append(client.domains[info.strategy], &v2router.Domain{
+		rules.domains[info.strategy] = append(rules.domains[info.strategy], &v2router.Domain{
 			Type:      v2router.Domain_Regex,
 			Value:     info.code,
 			Attribute: nil,
@@ -411,28 +495,47 @@ func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
 	}
 
 	// Just for compatibility with V2Ray rule type `regexp`
-	regexpInfo := loadCode(cfg, "regexp:")
+	regexpInfo := loadCode(lists, "regexp:")
 	for _, info := range regexpInfo {
 		if _, err := regexp.Compile(info.code); err != nil {
 			return nil, common.NewError("invalid regular expression: " + info.code).Base(err)
 		}
-		client.domains[info.strategy] = append(client.domains[info.strategy], &v2router.Domain{
+		rules.domains[info.strategy] = append(rules.domains[info.strategy], &v2router.Domain{
 			Type:      v2router.Domain_Regex,
 			Value:     info.code,
 			Attribute: nil,
 		})
 	}
 
-	fullInfo := loadCode(cfg, "full:")
+	fullInfo := loadCode(lists, "full:")
 	for _, info := range fullInfo {
-		client.domains[info.strategy] = append(client.domains[info.strategy], &v2router.Domain{
+		rules.domains[info.strategy] = append(rules.domains[info.strategy], &v2router.Domain{
 			Type:      v2router.Domain_Full,
 			Value:     strings.ToLower(info.code),
 			Attribute: nil,
 		})
 	}
 
-	cidrInfo := loadCode(cfg, "cidr:")
+	portInfo := loadCode(lists, "port:")
+	for _, info := range portInfo {
+		ports := strings.SplitN(info.code, "-", 2)
+		from, err := strconv.Atoi(ports[0])
+		if err != nil {
+			return nil, common.NewError("invalid port rule: " + info.code).Base(err)
+		}
+		to := from
+		if len(ports) == 2 {
+			if to, err = strconv.Atoi(ports[1]); err != nil {
+				return nil, common.NewError("invalid port rule: " + info.code).Base(err)
+			}
+		}
+		if from <= 0 || to > 65535 || from > to {
+			return nil, common.NewError("invalid port range: " + info.code)
+		}
+		rules.ports[info.strategy] = append(rules.ports[info.strategy], portRange{from: from, to: to})
+	}
+
+	cidrInfo := loadCode(lists, "cidr:")
 	for _, info := range cidrInfo {
 		tmp := strings.Split(info.code, "/")
 		if len(tmp) != 2 {
@@ -446,14 +549,12 @@ func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
 		if err != nil {
 			return nil, common.NewError("invalid prefix").Base(err)
 		}
-		client.cidrs[info.strategy] = append(client.cidrs[info.strategy], &v2router.CIDR{
+		rules.cidrs[info.strategy] = append(rules.cidrs[info.strategy], &v2router.CIDR{
 			Ip:     ip,
 			Prefix: uint32(prefix),
 		})
 	}
 
-	log.Info("router client created")
-
 	runtime.ReadMemStats(&m4)
 
 	log.Debugf("GeoIP rules -> Alloc: %s; TotalAlloc: %s", common.HumanFriendlyTraffic(m2.Alloc-m1.Alloc), common.HumanFriendlyTraffic(m2.TotalAlloc-m1.TotalAlloc))
@@ -461,5 +562,194 @@ func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
 	log.Debugf("Plaintext rules -> Alloc: %s; TotalAlloc: %s", common.HumanFriendlyTraffic(m4.Alloc-m3.Alloc), common.HumanFriendlyTraffic(m4.TotalAlloc-m3.TotalAlloc))
 	log.Debugf("Total(router) -> Alloc: %s; TotalAlloc: %s", common.HumanFriendlyTraffic(m4.Alloc-m1.Alloc), common.HumanFriendlyTraffic(m4.TotalAlloc-m1.TotalAlloc))
 
+	return rules, nil
+}
+
+// newInboundPolicy compiles the rules of an inbound or a user
+func (c *Client) newInboundPolicy(cfg *Config, proxyRules, bypassRules, blockRules []string, defaultPolicy string, geodataLoader geodata.GeodataLoader) (*inboundPolicy, error) {
+	policy := &inboundPolicy{
+		defaultPolicy: -1,
+	}
+	if defaultPolicy != "" {
+		var err error
+		policy.defaultPolicy, err = parsePolicy(defaultPolicy, c.chainTags)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lists := make([][]string, Chain+len(cfg.Router.Chains))
+	lists[Proxy], lists[Bypass], lists[Block] = proxyRules, bypassRules, blockRules
+	rules, err := loadRules(cfg, lists, geodataLoader)
+	if err != nil {
+		return nil, err
+	}
+	policy.rules = rules
+	return policy, nil
+}
+
+// userHashes returns the hashes of the users in the config, the groups are checked to be known
+func userHashes(ctx context.Context, cfg *UserRouterConfig) ([]string, error) {
+	hashes := make([]string, 0, len(cfg.Password)+len(cfg.Hash))
+	for _, password := range cfg.Password {
+		hashes = append(hashes, common.SHA224String(password))
+	}
+	hashes = append(hashes, cfg.Hash...)
+	if len(cfg.Groups) == 0 {
+		return hashes, nil
+	}
+	memoryCfg, ok := config.FromContext(ctx, memory.Name).(*memory.Config)
+	if !ok {
+		return nil, common.NewError("router failed to find the user groups")
+	}
+	for _, name := range cfg.Groups {
+		if _, found := memoryCfg.MemberHashes(name); !found {
+			return nil, common.NewError("router rules refer to unknown user group: " + name)
+		}
+	}
+	return hashes, nil
+}
+
+// newChain creates the client stack of the chain with its own config
+func newChain(ctx context.Context, cfg *ChainConfig) (tunnel.Client, error) {
+	data, err := yaml.Marshal(cfg.Config)
+	common.Must(err)
+	ctx, err = config.WithYAMLConfig(ctx, data)
+	if err != nil {
+		return nil, common.NewError("invalid config of router chain " + cfg.Tag).Base(err)
+	}
+	stack := make([]string, 0, len(cfg.Stack))
+	for _, name := range cfg.Stack {
+		stack = append(stack, strings.ToUpper(name))
+	}
+	client, err := proxy.CreateClientStack(ctx, stack)
+	if err != nil {
+		return nil, common.NewError("router failed to create chain " + cfg.Tag).Base(err)
+	}
+	log.Info("router chain", cfg.Tag, "created:", strings.Join(cfg.Stack, " -> "))
+	return client, nil
+}
+
+func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
+	cfg := config.FromContext(ctx, Name).(*Config)
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(ctx)
+
+	direct, err := freedom.NewClient(ctx, nil)
+	if err != nil {
+		cancel()
+		return nil, common.NewError("router failed to initialize raw client").Base(err)
+	}
+
+	client := &Client{
+		underlay: underlay, // 下一层协议服务
+		direct:   direct,
+		inbounds: make(map[string]*inboundPolicy),
+		users:    memory.NewSelector(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	/**
+	域名解析策略，默认"as_is"。合法的值有：
+		1. “as_is”，只在各列表中的域名规则内进行匹配。
+		2. “ip_if_non_match”，先在各列表中的域名规则内进行匹配；如果不匹配，则解析为IP后，在各列表中的IP地址规则内进行匹配。该策略可能导致DNS泄漏或遭到污染。
+		3. “ip_on_demand”，先解析为IP，在各列表中的IP地址规则内进行匹配；如果不匹配，则在各列表中的域名规则内进行匹配。该策略可能导致DNS泄漏或遭到污染。
+	*/
+	switch strings.ToLower(cfg.Router.DomainStrategy) {
+	case "as_is", "as-is", "asis":
+		client.domainStrategy = AsIs
+	case "ip_if_non_match", "ip-if-non-match", "ipifnonmatch":
+		client.domainStrategy = IPIfNonMatch
+	case "ip_on_demand", "ip-on-demand", "ipondemand":
+		client.domainStrategy = IPOnDemand
+	default:
+		cancel()
+		return nil, common.NewError("unknown strategy: " + cfg.Router.DomainStrategy)
+	}
+
+	// 出站链的 tag 不能与内置的策略重复
+	for _, chain := range cfg.Router.Chains {
+		if chain.Tag == "" {
+			cancel()
+			return nil, common.NewError("empty router chain tag")
+		}
+		if _, err := parsePolicy(chain.Tag, client.chainTags); err == nil {
+			cancel()
+			return nil, common.NewError("duplicated router chain tag: " + chain.Tag)
+		}
+		if len(chain.Stack) == 0 {
+			cancel()
+			return nil, common.NewError("empty stack of router chain " + chain.Tag)
+		}
+		client.chainTags = append(client.chainTags, chain.Tag)
+	}
+
+	// 指的是三个列表匹配均失败后，使用的默认策略，默认为"proxy”，即进行代理
+	client.defaultPolicy, err = parsePolicy(cfg.Router.DefaultPolicy, client.chainTags)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	geodataLoader := geodata.NewGeodataLoader()
+
+	lists := make([][]string, Chain+len(cfg.Router.Chains))
+	lists[Proxy], lists[Bypass], lists[Block] = cfg.Router.Proxy, cfg.Router.Bypass, cfg.Router.Block
+	for i, chain := range cfg.Router.Chains {
+		lists[Chain+i] = chain.Rules
+	}
+	client.rules, err = loadRules(cfg, lists, geodataLoader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// 各个入站协议单独的路由规则
+	for name, inboundCfg := range cfg.Router.Inbounds {
+		policy, err := client.newInboundPolicy(cfg, inboundCfg.Proxy, inboundCfg.Bypass, inboundCfg.Block, inboundCfg.DefaultPolicy, geodataLoader)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		client.inbounds[strings.ToUpper(name)] = policy
+		log.Info("router rules for inbound", name, "loaded")
+	}
+
+	// 各个用户单独的路由规则，同一个用户只使用第一条匹配的配置，用户组在路由时按用户当前所在的组查找
+	for i, userCfg := range cfg.Router.Users {
+		policy, err := client.newInboundPolicy(cfg, userCfg.Proxy, userCfg.Bypass, userCfg.Block, userCfg.DefaultPolicy, geodataLoader)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		hashes, err := userHashes(ctx, &userCfg)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		client.users.Add(i, hashes, userCfg.Groups)
+		client.userPolicies = append(client.userPolicies, policy)
+		log.Info("router rules for", len(hashes), "users and", len(userCfg.Groups), "groups loaded")
+	}
+
+	// 使用各自的配置创建出站链
+	for i := range cfg.Router.Chains {
+		chain, err := newChain(ctx, &cfg.Router.Chains[i])
+		if err != nil {
+			for _, c := range client.chains {
+				c.Close()
+			}
+			cancel()
+			return nil, err
+		}
+		client.chains = append(client.chains, chain)
+	}
+
+	if cfg.Router.DNSLeak.Enabled {
+		client.leaks = newLeakGuard(cfg.Router.DNSLeak.DoHHosts)
+		log.Info("dns leak protection enabled")
+	}
+
+	client.unregister = tunnel.RegistryFromContext(ctx).AddInstance(instanceKind, client)
+	log.Info("router client created")
 	return client, nil
 }
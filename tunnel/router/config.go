@@ -1,6 +1,9 @@
 package router
 
 import (
+	"strconv"
+	"strings"
+
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
 )
@@ -10,14 +13,108 @@ type Config struct {
 }
 
 type RouterConfig struct {
-	Enabled         bool     `json:"enabled" yaml:"enabled"`
-	Bypass          []string `json:"bypass" yaml:"bypass"`
-	Proxy           []string `json:"proxy" yaml:"proxy"`
-	Block           []string `json:"block" yaml:"block"`
-	DomainStrategy  string   `json:"domain_strategy" yaml:"domain-strategy"`
-	DefaultPolicy   string   `json:"default_policy" yaml:"default-policy"`
-	GeoIPFilename   string   `json:"geoip" yaml:"geoip"`
-	GeoSiteFilename string   `json:"geosite" yaml:"geosite"`
+	Enabled         bool                           `json:"enabled" yaml:"enabled"`
+	Bypass          []string                       `json:"bypass" yaml:"bypass"`
+	Proxy           []string                       `json:"proxy" yaml:"proxy"`
+	Block           []string                       `json:"block" yaml:"block"`
+	DomainStrategy  string                         `json:"domain_strategy" yaml:"domain-strategy"`
+	DefaultPolicy   string                         `json:"default_policy" yaml:"default-policy"`
+	GeoIPFilename   string                         `json:"geoip" yaml:"geoip"`
+	GeoSiteFilename string                         `json:"geosite" yaml:"geosite"`
+	Inbounds        map[string]InboundRouterConfig `json:"inbounds" yaml:"inbounds"`
+	Users           []UserRouterConfig             `json:"users" yaml:"users"`
+	Chains          []ChainConfig                  `json:"chains" yaml:"chains"`
+	DNSLeak         DNSLeakConfig                  `json:"dns_leak_protection" yaml:"dns-leak-protection"`
+}
+
+// DNSLeakConfig 阻止直连的 DNS 查询（53 端口，DoT 和已知的 DoH 服务器），使 DNS 查询只能经过代理
+type DNSLeakConfig struct {
+	Enabled  bool     `json:"enabled" yaml:"enabled"`
+	DoHHosts []string `json:"doh_hosts" yaml:"doh-hosts"` // 额外的 DoH 服务器的域名或 IP
+}
+
+// ChainConfig 命名的出站链，路由规则可以将请求发往该出站链，例如经过第二个 trojan 服务器
+type ChainConfig struct {
+	Tag    string      `json:"tag" yaml:"tag"`
+	Stack  []string    `json:"stack" yaml:"stack"`   // 出站协议栈，从底层开始，如 transport, tls, trojan
+	Config interface{} `json:"config" yaml:"config"` // 出站链使用的配置，与自定义协议栈的节点配置格式相同
+	Rules  []string    `json:"rules" yaml:"rules"`   // 发往该出站链的规则，优先于 bypass 和 proxy
+}
+
+// InboundRouterConfig 入站协议（如 http，socks）单独的路由规则，优先于全局规则
+type InboundRouterConfig struct {
+	Bypass        []string `json:"bypass" yaml:"bypass"`
+	Proxy         []string `json:"proxy" yaml:"proxy"`
+	Block         []string `json:"block" yaml:"block"`
+	DefaultPolicy string   `json:"default_policy" yaml:"default-policy"`
+}
+
+// UserRouterConfig 指定用户单独的路由规则，优先于入站协议和全局规则，仅服务端有效
+type UserRouterConfig struct {
+	Password      []string `json:"password" yaml:"password"`
+	Hash          []string `json:"hash" yaml:"hash"`
+	Groups        []string `json:"groups" yaml:"groups"` // 用户组的名称，组内所有成员使用此规则
+	Bypass        []string `json:"bypass" yaml:"bypass"`
+	Proxy         []string `json:"proxy" yaml:"proxy"`
+	Block         []string `json:"block" yaml:"block"`
+	DefaultPolicy string   `json:"default_policy" yaml:"default-policy"`
+}
+
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if !c.Router.Enabled {
+		return nil
+	}
+	switch strings.ToLower(c.Router.DomainStrategy) {
+	case "as_is", "as-is", "asis", "ip_if_non_match", "ip-if-non-match", "ipifnonmatch", "ip_on_demand", "ip-on-demand", "ipondemand":
+	default:
+		errs.Add("router.domain_strategy", "unknown strategy "+strconv.Quote(c.Router.DomainStrategy))
+	}
+	if c.Router.DNSLeak.Enabled && c.Router.DomainStrategy != "" {
+		switch strings.ToLower(c.Router.DomainStrategy) {
+		case "as_is", "as-is", "asis":
+		default:
+			errs.Add("router.domain_strategy", "must be as_is when dns_leak_protection is enabled, other strategies resolve the domains locally")
+		}
+	}
+	var chainTags []string
+	for i, chain := range c.Router.Chains {
+		path := "router.chains[" + strconv.Itoa(i) + "]"
+		if chain.Tag == "" {
+			errs.Add(path+".tag", "empty tag")
+		} else if _, err := parsePolicy(chain.Tag, chainTags); err == nil {
+			errs.Add(path+".tag", "duplicated tag "+strconv.Quote(chain.Tag))
+		} else {
+			chainTags = append(chainTags, chain.Tag)
+		}
+		if len(chain.Stack) == 0 {
+			errs.Add(path+".stack", "empty stack")
+		}
+	}
+	if _, err := parsePolicy(c.Router.DefaultPolicy, chainTags); err != nil {
+		errs.Add("router.default_policy", err.Error())
+	}
+	for name, inbound := range c.Router.Inbounds {
+		if inbound.DefaultPolicy == "" {
+			continue
+		}
+		if _, err := parsePolicy(inbound.DefaultPolicy, chainTags); err != nil {
+			errs.Add("router.inbounds."+name+".default_policy", err.Error())
+		}
+	}
+	for i, user := range c.Router.Users {
+		path := "router.users[" + strconv.Itoa(i) + "]"
+		if len(user.Password) == 0 && len(user.Hash) == 0 && len(user.Groups) == 0 {
+			errs.Add(path, "no password, hash or group specified")
+		}
+		if user.DefaultPolicy == "" {
+			continue
+		}
+		if _, err := parsePolicy(user.DefaultPolicy, chainTags); err != nil {
+			errs.Add(path+".default_policy", err.Error())
+		}
+	}
+	return errs.Err()
 }
 
 func init() {
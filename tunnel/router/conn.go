@@ -4,6 +4,9 @@ import (
 	"context"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/log"
@@ -20,32 +23,54 @@ type PacketConn struct {
 	net.PacketConn
 	packetChan chan *packetInfo
 	*Client
-	ctx    context.Context
-	cancel context.CancelFunc
+	chainConns     map[int]tunnel.PacketConn // 出站链的 UDP 连接，首次使用时建立
+	chainConnsLock sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+	deadline       tunnel.ReadDeadline
 }
 
-func (c *PacketConn) packetLoop() {
-	go func() {
-		for {
-			buf := make([]byte, MaxPacketSize)
-			n, addr, err := c.proxy.ReadWithMetadata(buf)
-			if err != nil {
-				select {
-				case <-c.ctx.Done():
-					return
-				default:
-					log.Error("router packetConn error", err)
-					continue
-				}
-			}
-			c.packetChan <- &packetInfo{
-				src:     addr,
-				payload: buf[:n],
+// readLoop forwards the packets from the proxied packet conn
+func (c *PacketConn) readLoop(conn tunnel.PacketConn) {
+	for {
+		buf := make([]byte, common.PacketSize())
+		n, addr, err := conn.ReadWithMetadata(buf)
+		if err != nil {
+			select {
+			case <-c.ctx.Done():
+			default:
+				// 出站的连接已经失效，不再读取，由中继的超时关闭连接
+				log.Error("router packetConn error", err)
 			}
+			return
 		}
-	}()
+		c.packetChan <- &packetInfo{
+			src:     addr,
+			payload: buf[:n],
+		}
+	}
+}
+
+// chainConn returns the packet conn of the chain, it is dialed when the chain is used for the first time
+func (c *PacketConn) chainConn(i int) (tunnel.PacketConn, error) {
+	c.chainConnsLock.Lock()
+	defer c.chainConnsLock.Unlock()
+	if conn, found := c.chainConns[i]; found {
+		return conn, nil
+	}
+	conn, err := c.chains[i].DialPacket(nil)
+	if err != nil {
+		return nil, common.NewError("router failed to dial udp through chain " + c.chainTags[i]).Base(err)
+	}
+	c.chainConns[i] = conn
+	go c.readLoop(conn)
+	return conn, nil
+}
+
+func (c *PacketConn) packetLoop() {
+	go c.readLoop(c.proxy)
 	for {
-		buf := make([]byte, MaxPacketSize)
+		buf := make([]byte, common.PacketSize())
 		n, addr, err := c.PacketConn.ReadFrom(buf)
 		if err != nil {
 			select {
@@ -68,6 +93,11 @@ func (c *PacketConn) packetLoop() {
 
 func (c *PacketConn) Close() error {
 	c.cancel()
+	c.chainConnsLock.Lock()
+	for _, conn := range c.chainConns {
+		conn.Close()
+	}
+	c.chainConnsLock.Unlock()
 	c.proxy.Close()
 	return c.PacketConn.Close()
 }
@@ -81,13 +111,24 @@ func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 }
 
 func (c *PacketConn) WriteWithMetadata(p []byte, m *tunnel.Metadata) (int, error) {
-	policy := c.Route(m.Address)
+	policy := c.RouteMetadata(m)
+	if policy == Bypass && c.leaks != nil {
+		if kind := c.leaks.check(m); kind != "" {
+			return 0, common.NewError("router blocked direct " + kind + " query to " + m.Address.String() + " (udp)")
+		}
+	}
 	switch policy {
 	case Proxy:
 		return c.proxy.WriteWithMetadata(p, m)
 	case Block:
 		return 0, common.NewError("router blocked address (udp): " + m.Address.String())
 	case Bypass:
+		if len(m.Resolved) != 0 { // 出站策略检查过的地址
+			return c.PacketConn.WriteTo(p, &net.UDPAddr{
+				IP:   m.Resolved[0],
+				Port: m.Address.Port,
+			})
+		}
 		ip, err := m.Address.ResolveIP()
 		if err != nil {
 			return 0, common.NewError("router failed to resolve udp address").Base(err)
@@ -96,9 +137,15 @@ func (c *PacketConn) WriteWithMetadata(p []byte, m *tunnel.Metadata) (int, error
 			IP:   ip,
 			Port: m.Address.Port,
 		})
-	default:
-		panic("unknown policy")
 	}
+	if i := policy - Chain; i >= 0 && i < len(c.chains) {
+		conn, err := c.chainConn(i)
+		if err != nil {
+			return 0, err
+		}
+		return conn.WriteWithMetadata(p, m)
+	}
+	panic("unknown policy")
 }
 
 func (c *PacketConn) ReadWithMetadata(p []byte) (int, *tunnel.Metadata, error) {
@@ -106,7 +153,23 @@ func (c *PacketConn) ReadWithMetadata(p []byte) (int, *tunnel.Metadata, error) {
 	case info := <-c.packetChan:
 		n := copy(p, info.payload)
 		return n, info.src, nil
+	case <-c.deadline.Wait():
+		return 0, nil, os.ErrDeadlineExceeded
 	case <-c.ctx.Done():
 		return 0, nil, io.EOF
 	}
 }
+
+// SetReadDeadline doesn't touch the udp socket, which is read by the packet loop
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.deadline.Set(t)
+	return nil
+}
+
+func (c *PacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
@@ -0,0 +1,126 @@
+package router
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// 直连的 DNS 查询的类型
+const (
+	leakDNS = "dns" // 53 端口的 TCP 和 UDP
+	leakDoT = "dot" // 853 端口的 DNS over TLS 和 DNS over QUIC
+	leakDoH = "doh" // 443 端口的已知 DNS over HTTPS 服务器
+)
+
+// 常见的公共 DoH 服务器
+var defaultDoHHosts = []string{
+	"dns.google", "dns.google.com", "8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844",
+	"cloudflare-dns.com", "one.one.one.one", "1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001",
+	"dns.quad9.net", "9.9.9.9", "149.112.112.112", "2620:fe::fe",
+	"doh.opendns.com", "dns.adguard.com", "dns.adguard-dns.com", "dns.nextdns.io", "doh.pub", "dns.alidns.com",
+}
+
+// 最多保留的最近的泄漏记录
+const maxLeakAttempts = 64
+
+// LeakAttempt is a dns query which would be sent directly and is blocked
+type LeakAttempt struct {
+	Time    time.Time
+	Kind    string // dns, dot 或 doh
+	Target  string
+	Inbound string
+	Source  string
+}
+
+// leakGuard blocks the dns queries which would bypass the proxy, and records them
+type leakGuard struct {
+	sync.Mutex
+	hosts    map[string]bool // 小写的 DoH 域名和 IP
+	total    uint64
+	attempts []LeakAttempt
+}
+
+func newLeakGuard(extraHosts []string) *leakGuard {
+	g := &leakGuard{
+		hosts: make(map[string]bool, len(defaultDoHHosts)+len(extraHosts)),
+	}
+	for _, host := range append(append([]string{}, defaultDoHHosts...), extraHosts...) {
+		if ip := net.ParseIP(host); ip != nil {
+			host = ip.String()
+		}
+		g.hosts[strings.ToLower(strings.TrimSuffix(host, "."))] = true
+	}
+	return g
+}
+
+// kind returns the type of the dns query to the address, or an empty string if it is not one
+func (g *leakGuard) kind(address *tunnel.Address) string {
+	switch address.Port {
+	case 53:
+		return leakDNS
+	case 853:
+		return leakDoT
+	case 443:
+		host := strings.ToLower(strings.TrimSuffix(address.DomainName, "."))
+		if address.AddressType != tunnel.DomainName {
+			host = address.IP.String()
+		}
+		if g.hosts[host] {
+			return leakDoH
+		}
+	}
+	return ""
+}
+
+// check returns the type of the query if the direct request is a dns query, the attempt is recorded
+func (g *leakGuard) check(metadata *tunnel.Metadata) string {
+	kind := g.kind(metadata.Address)
+	if kind == "" {
+		return ""
+	}
+	attempt := LeakAttempt{
+		Time:    time.Now(),
+		Kind:    kind,
+		Target:  metadata.Address.String(),
+		Inbound: metadata.Inbound,
+	}
+	if metadata.Source != nil {
+		attempt.Source = metadata.Source.String()
+	}
+	g.Lock()
+	g.total++
+	if len(g.attempts) == maxLeakAttempts {
+		g.attempts = g.attempts[1:]
+	}
+	g.attempts = append(g.attempts, attempt)
+	g.Unlock()
+	log.Warn("router blocked direct", kind, "query to", attempt.Target, "from", attempt.Source, "to prevent dns leak")
+	return kind
+}
+
+// DNSLeaks returns whether the dns leak protection is enabled in any running router client in the registry of ctx,
+// the number of the blocked queries and the recent ones, the latest last
+func DNSLeaks(ctx context.Context) (enabled bool, total uint64, attempts []LeakAttempt) {
+	for _, c := range runningClients(ctx) {
+		if c.leaks == nil {
+			continue
+		}
+		enabled = true
+		c.leaks.Lock()
+		total += c.leaks.total
+		attempts = append(attempts, c.leaks.attempts...)
+		c.leaks.Unlock()
+	}
+	// 多个路由客户端时按时间排序
+	sort.SliceStable(attempts, func(i, j int) bool {
+		return attempts[i].Time.Before(attempts[j].Time)
+	})
+	return enabled, total, attempts
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/statistic/memory"
 	"github.com/p4gefau1t/trojan-go/test/util"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
@@ -157,3 +158,264 @@ router:
 		t.Fail()
 	}
 }
+
+func TestInboundRouter(t *testing.T) {
+	data := `
+router:
+    enabled: true
+    default-policy: bypass
+    block:
+    - "domain:block.com"
+    proxy:
+    - "domain:proxy.com"
+    inbounds:
+        http:
+            default-policy: proxy
+        socks:
+            block:
+            - "domain:proxy.com"
+`
+	ctx, err := config.WithYAMLConfig(context.Background(), []byte(data))
+	common.Must(err)
+	client, err := NewClient(ctx, &MockClient{})
+	common.Must(err)
+	route := func(inbound, domain string) int {
+		return client.RouteMetadata(&tunnel.Metadata{
+			Inbound: inbound,
+			Address: &tunnel.Address{
+				AddressType: tunnel.DomainName,
+				DomainName:  domain,
+				Port:        80,
+			},
+		})
+	}
+	for _, c := range []struct {
+		inbound string
+		domain  string
+		policy  int
+	}{
+		{"", "example.com", Bypass},
+		{"", "proxy.com", Proxy},
+		{"HTTP", "example.com", Proxy},
+		{"HTTP", "block.com", Proxy},
+		{"SOCKS", "proxy.com", Block},
+		{"SOCKS", "example.com", Bypass},
+		{"SOCKS", "block.com", Block},
+	} {
+		if policy := route(c.inbound, c.domain); policy != c.policy {
+			t.Fatal("wrong policy for", c.inbound, c.domain, policy)
+		}
+	}
+}
+
+type testUser struct {
+	memory.User
+	hash  string
+	group string
+}
+
+func (u *testUser) Hash() string {
+	return u.hash
+}
+
+func (u *testUser) Group() string {
+	return u.group
+}
+
+func TestUserRouter(t *testing.T) {
+	data := `
+groups:
+    - name: trial
+      password:
+      - trial1
+      - trial2
+router:
+    enabled: true
+    default-policy: bypass
+    block:
+    - "domain:block.com"
+    users:
+      - groups:
+        - trial
+        block:
+        - "port:6881-6889"
+      - password:
+        - vip
+        - trial2
+        default-policy: proxy
+`
+	ctx, err := config.WithYAMLConfig(context.Background(), []byte(data))
+	common.Must(err)
+	client, err := NewClient(ctx, &MockClient{})
+	common.Must(err)
+	route := func(password, group, domain string, port int) int {
+		m := &tunnel.Metadata{
+			Address: &tunnel.Address{
+				AddressType: tunnel.DomainName,
+				DomainName:  domain,
+				Port:        port,
+			},
+		}
+		if password != "" {
+			m.User = &testUser{hash: common.SHA224String(password), group: group}
+		}
+		return client.RouteMetadata(m)
+	}
+	for _, c := range []struct {
+		password string
+		group    string
+		domain   string
+		port     int
+		policy   int
+	}{
+		{"", "", "example.com", 6881, Bypass},
+		{"other", "", "example.com", 6881, Bypass},
+		{"trial1", "trial", "example.com", 6881, Block},
+		{"trial1", "trial", "example.com", 443, Bypass},
+		{"trial2", "trial", "example.com", 6889, Block}, // 只使用第一条匹配的配置
+		{"trial2", "", "example.com", 6889, Proxy},      // 离开用户组后使用自己的规则
+		{"added", "trial", "example.com", 6881, Block},  // 运行时加入用户组
+		{"vip", "", "example.com", 6881, Proxy},
+		{"vip", "", "block.com", 443, Proxy},
+	} {
+		if policy := route(c.password, c.group, c.domain, c.port); policy != c.policy {
+			t.Fatal("wrong policy for", c.password, c.domain, c.port, policy)
+		}
+	}
+
+	ctx, err = config.WithYAMLConfig(context.Background(), []byte(`
+router:
+    enabled: true
+    users:
+      - groups:
+        - unknown
+`))
+	common.Must(err)
+	if _, err := NewClient(ctx, &MockClient{}); err == nil {
+		t.Fatal("unknown group accepted")
+	}
+}
+
+func TestRouterChain(t *testing.T) {
+	data := `
+router:
+    enabled: true
+    default-policy: block
+    proxy:
+    - "full:localhost"
+    inbounds:
+        http:
+            default-policy: second
+    chains:
+    - tag: second
+      stack:
+      - freedom
+      rules:
+      - "full:localhost"
+`
+	ctx, err := config.WithYAMLConfig(context.Background(), []byte(data))
+	common.Must(err)
+	client, err := NewClient(ctx, &MockClient{})
+	common.Must(err)
+	defer client.Close()
+
+	port, err := strconv.Atoi(util.HTTPPort)
+	common.Must(err)
+	for _, c := range []struct {
+		inbound string
+		domain  string
+		policy  int
+	}{
+		{"", "localhost", Chain}, // 出站链的规则优先于 proxy
+		{"", "example.com", Block},
+		{"HTTP", "example.com", Chain},
+	} {
+		if policy := client.RouteMetadata(&tunnel.Metadata{
+			Inbound: c.inbound,
+			Address: &tunnel.Address{
+				AddressType: tunnel.DomainName,
+				DomainName:  c.domain,
+				Port:        port,
+			},
+		}); policy != c.policy {
+			t.Fatal("wrong policy for", c.inbound, c.domain, policy)
+		}
+	}
+
+	conn, err := client.DialConn(&tunnel.Address{
+		AddressType: tunnel.DomainName,
+		DomainName:  "localhost",
+		Port:        port,
+	}, nil)
+	if err != nil {
+		t.Fatal("dial http through chain failed", err)
+	}
+	conn.Close()
+
+	for _, chains := range []string{
+		"[{tag: proxy, stack: [freedom]}]",
+		"[{tag: a, stack: [freedom]}, {tag: a, stack: [freedom]}]",
+		"[{tag: a, stack: []}]",
+		"[{tag: a, stack: [unknown]}]",
+	} {
+		ctx, err := config.WithYAMLConfig(context.Background(), []byte("router:\n    chains: "+chains+"\n"))
+		common.Must(err)
+		if _, err := NewClient(ctx, &MockClient{}); err == nil {
+			t.Fatal("invalid chains should be rejected:", chains)
+		}
+	}
+}
+
+func TestDNSLeakProtection(t *testing.T) {
+	data := `
+router:
+    enabled: true
+    default-policy: bypass
+    proxy:
+    - "domain:proxy.com"
+    dns-leak-protection:
+        enabled: true
+        doh-hosts:
+        - "doh.example.com"
+`
+	ctx, err := config.WithYAMLConfig(context.Background(), []byte(data))
+	common.Must(err)
+	client, err := NewClient(ctx, &MockClient{})
+	common.Must(err)
+	defer client.Close()
+	dial := func(host string, port int) error {
+		address := tunnel.NewAddressFromHostPort("tcp", host, port)
+		_, err := client.DialConnWithMetadata(&tunnel.Metadata{Address: address, Inbound: "SOCKS"}, nil)
+		return err
+	}
+	for _, target := range []struct {
+		host string
+		port int
+	}{
+		{"127.0.0.1", 53},
+		{"dns.example.com", 853},
+		{"1.1.1.1", 443},
+		{"doh.example.com", 443},
+	} {
+		if err := dial(target.host, target.port); err == nil || !strings.Contains(err.Error(), "router blocked direct") {
+			t.Fatal("direct dns query is not blocked", target, err)
+		}
+	}
+	// 经过代理的查询不受影响
+	if err := dial("proxy.com", 53); err == nil || !strings.Contains(err.Error(), "mockproxy") {
+		t.Fatal("proxied dns query", err)
+	}
+	enabled, total, attempts := DNSLeaks(ctx)
+	if !enabled || total != 4 || len(attempts) != 4 {
+		t.Fatal("wrong leak attempts", enabled, total, attempts)
+	}
+	if attempts[0].Kind != leakDNS || attempts[1].Kind != leakDoT || attempts[3].Kind != leakDoH || attempts[3].Inbound != "SOCKS" {
+		t.Fatal("wrong leak attempts", attempts)
+	}
+
+	ctx, err = config.WithYAMLConfig(context.Background(), []byte(data+"    domain-strategy: ip_if_non_match\n"))
+	common.Must(err)
+	if err := config.FromContext(ctx, Name).(*Config).Validate(); err == nil {
+		t.Fatal("local resolution is allowed with dns leak protection")
+	}
+}
@@ -0,0 +1,48 @@
+package router
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// instanceKind 在注册表中记录运行中的路由客户端
+const instanceKind = "router.client"
+
+func runningClients(ctx context.Context) []*Client {
+	instances := tunnel.RegistryFromContext(ctx).Instances(instanceKind)
+	clients := make([]*Client, 0, len(instances))
+	for _, instance := range instances {
+		clients = append(clients, instance.(*Client))
+	}
+	return clients
+}
+
+// SetRulesEnabled turns the routing rules of the running router clients in the registry of ctx on or off.
+// All requests are proxied when the rules are off. It returns the number of clients updated
+func SetRulesEnabled(ctx context.Context, enabled bool) int {
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	clients := runningClients(ctx)
+	for _, c := range clients {
+		atomic.StoreInt32(&c.rulesDisabled, disabled)
+	}
+	if len(clients) != 0 {
+		log.Info("router rules enabled:", enabled)
+	}
+	return len(clients)
+}
+
+// RulesEnabled reports whether the routing rules are applied, it returns false if there is no router client
+func RulesEnabled(ctx context.Context) bool {
+	for _, c := range runningClients(ctx) {
+		if atomic.LoadInt32(&c.rulesDisabled) == 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -2,10 +2,17 @@ package shadowsocks
 
 import "github.com/p4gefau1t/trojan-go/config"
 
+type ReplayFilterConfig struct {
+	Enabled   bool `json:"enabled" yaml:"enabled"`
+	Window    int  `json:"window" yaml:"window"`
+	MaxMemory int  `json:"max_memory" yaml:"max-memory"` // MiB
+}
+
 type ShadowsocksConfig struct {
-	Enabled  bool   `json:"enabled" yaml:"enabled"`
-	Method   string `json:"method" yaml:"method"`
-	Password string `json:"password" yaml:"password"`
+	Enabled      bool               `json:"enabled" yaml:"enabled"`
+	Method       string             `json:"method" yaml:"method"`
+	Password     string             `json:"password" yaml:"password"`
+	ReplayFilter ReplayFilterConfig `json:"replay_filter" yaml:"replay-filter"`
 }
 
 type Config struct {
@@ -19,6 +26,10 @@ func init() {
 		return &Config{
 			Shadowsocks: ShadowsocksConfig{
 				Method: "AES-128-GCM",
+				ReplayFilter: ReplayFilterConfig{
+					Enabled: true,
+					Window:  100000,
+				},
 			},
 		}
 	})
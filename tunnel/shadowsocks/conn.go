@@ -27,3 +27,7 @@ func (c *Conn) Close() error {
 func (c *Conn) Metadata() *tunnel.Metadata {
 	return c.Conn.Metadata()
 }
+
+func (c *Conn) WireTraffic() (uint64, uint64, bool) {
+	return tunnel.WireTrafficOf(c.Conn)
+}
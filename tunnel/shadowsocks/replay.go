@@ -0,0 +1,96 @@
+package shadowsocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// replayEntrySize is the estimated memory used by a salt in the filter
+const replayEntrySize = 64
+
+// ReplayStats is the snapshot of the replay filter
+type ReplayStats struct {
+	Window      int    // 记住的 salt 数量上限
+	Entries     int    // 当前记住的 salt 数量
+	MemoryBytes uint64 // 内存占用上限的估计值
+	Checked     uint64
+	Hits        uint64
+}
+
+// ReplayFilter remembers the salts of recent shadowsocks connections and rejects the repeated ones.
+// Salts are kept in two generations, when the current generation is full, the previous one is dropped,
+// so at least window/2 and at most window salts are remembered
+type ReplayFilter struct {
+	sync.Mutex
+	current  map[string]struct{}
+	previous map[string]struct{}
+	window   int
+	checked  uint64
+	hits     uint64
+}
+
+// Check returns true if the salt has been seen, otherwise the salt is recorded
+func (f *ReplayFilter) Check(salt []byte) bool {
+	f.Lock()
+	defer f.Unlock()
+	f.checked++
+	key := string(salt)
+	_, inCurrent := f.current[key]
+	_, inPrevious := f.previous[key]
+	if inCurrent || inPrevious {
+		f.hits++
+		return true
+	}
+	if len(f.current) >= f.window/2 {
+		f.previous = f.current
+		f.current = make(map[string]struct{}, f.window/2)
+	}
+	f.current[key] = struct{}{}
+	return false
+}
+
+func (f *ReplayFilter) Stats() *ReplayStats {
+	f.Lock()
+	defer f.Unlock()
+	return &ReplayStats{
+		Window:      f.window,
+		Entries:     len(f.current) + len(f.previous),
+		MemoryBytes: uint64(f.window) * replayEntrySize,
+		Checked:     f.checked,
+		Hits:        f.hits,
+	}
+}
+
+func NewReplayFilter(window int) *ReplayFilter {
+	if window < 2 {
+		window = 2
+	}
+	return &ReplayFilter{
+		current:  make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+		window:   window,
+	}
+}
+
+// replayKind is the kind of the replay filter shared by the shadowsocks servers in the registry of the context
+const replayKind = "shadowsocks.replay_filter"
+
+// sharedReplayFilter returns the replay filter of the proxy instance in ctx, so that a salt seen by
+// one listener (e.g. the TLS subtree) can not be replayed on another (e.g. the websocket subtree)
+func sharedReplayFilter(ctx context.Context, window int) *ReplayFilter {
+	return tunnel.RegistryFromContext(ctx).Shared(replayKind, func() interface{} {
+		return NewReplayFilter(window)
+	}).(*ReplayFilter)
+}
+
+// GetReplayStats returns the stats of the replay filter of the proxy instance in ctx,
+// or nil if none of the shadowsocks servers enables the filter
+func GetReplayStats(ctx context.Context) *ReplayStats {
+	f, ok := tunnel.RegistryFromContext(ctx).Shared(replayKind, nil).(*ReplayFilter)
+	if !ok {
+		return nil
+	}
+	return f.Stats()
+}
@@ -2,6 +2,7 @@ package shadowsocks
 
 import (
 	"context"
+	"io"
 	"net"
 
 	"github.com/shadowsocks/go-shadowsocks2/core"
@@ -18,6 +19,7 @@ type Server struct {
 	*redirector.Redirector
 	underlay  tunnel.Server
 	redirAddr net.Addr
+	replay    *ReplayFilter // 同一实例的所有监听共享
 }
 
 // 让上一层协议获取当前层协议的连接
@@ -46,6 +48,22 @@ func (s *Server) AcceptConn(overlay tunnel.Tunnel) (tunnel.Conn, error) {
 		return nil, common.NewError("invalid aead payload")
 	}
 	rewindConn.Rewind()
+	// 没有 salt 的加密方式（如 DUMMY）不做重放检查
+	if sizer, ok := s.Cipher.(interface{ SaltSize() int }); ok && s.replay != nil {
+		// 重放的连接同样交给重定向处理，避免被主动探测识别
+		salt := make([]byte, sizer.SaltSize())
+		if _, err := io.ReadFull(rewindConn, salt); err == nil && s.replay.Check(salt) {
+			log.Error(common.NewError("shadowsocks replayed salt detected from " + conn.RemoteAddr().String()))
+			rewindConn.Rewind()
+			rewindConn.StopBuffering()
+			s.Redirect(&redirector.Redirection{
+				RedirectTo:  s.redirAddr,
+				InboundConn: rewindConn,
+			})
+			return nil, common.NewError("replayed aead payload")
+		}
+		rewindConn.Rewind()
+	}
 	rewindConn.StopBuffering()
 
 	return &Conn{
@@ -75,11 +93,21 @@ func NewServer(ctx context.Context, underlay tunnel.Server) (*Server, error) {
 	if cfg.RemotePort == 0 {
 		return nil, common.NewError("invalid shadowsocks redirection port")
 	}
-	log.Debug("shadowsocks client created")
+	var replay *ReplayFilter
+	if cfg.Shadowsocks.ReplayFilter.Enabled {
+		window := cfg.Shadowsocks.ReplayFilter.Window
+		if maxMemory := cfg.Shadowsocks.ReplayFilter.MaxMemory; maxMemory > 0 && window > maxMemory*1024*1024/replayEntrySize {
+			window = maxMemory * 1024 * 1024 / replayEntrySize
+		}
+		replay = sharedReplayFilter(ctx, window)
+		log.Debug("shadowsocks replay filter window:", replay.Stats().Window)
+	}
+	log.Debug("shadowsocks server created")
 	return &Server{
 		underlay:   underlay,
 		Cipher:     cipher,
 		Redirector: redirector.NewRedirector(ctx),
 		redirAddr:  tunnel.NewAddressFromHostPort("tcp", cfg.RemoteHost, cfg.RemotePort),
+		replay:     replay,
 	}, nil
 }
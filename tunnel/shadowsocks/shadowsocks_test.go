@@ -1,17 +1,24 @@
 package shadowsocks
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/test/util"
+	"github.com/p4gefau1t/trojan-go/tunnel"
 	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
 	"github.com/p4gefau1t/trojan-go/tunnel/transport"
 )
@@ -99,3 +106,107 @@ func TestShadowsocks(t *testing.T) {
 	c.Close()
 	s.Close()
 }
+
+func TestReplayFilter(t *testing.T) {
+	f := NewReplayFilter(4)
+	for i := 0; i < 4; i++ {
+		if f.Check([]byte{byte(i)}) {
+			t.Fatal("false positive", i)
+		}
+	}
+	// salt 0 and 1 are in the previous generation
+	if !f.Check([]byte{1}) || !f.Check([]byte{3}) {
+		t.Fatal("replay not detected")
+	}
+	f.Check([]byte{4})
+	// the oldest generation has been dropped
+	if f.Check([]byte{0}) {
+		t.Fatal("salt out of window")
+	}
+	stats := f.Stats()
+	if stats.Window != 4 || stats.Hits != 2 || stats.Checked != 8 || stats.Entries > 4 {
+		t.Fatal("wrong stats", stats)
+	}
+}
+
+func TestReplayFilterShared(t *testing.T) {
+	ctx := tunnel.WithScopedRegistry(context.Background())
+	if GetReplayStats(ctx) != nil {
+		t.Fatal("no server is running")
+	}
+	newServer := func(method string, window int) (*Server, int) {
+		port := common.PickPort("tcp", "127.0.0.1")
+		ctx := config.WithConfig(ctx, transport.Name, &transport.Config{
+			LocalHost:  "127.0.0.1",
+			LocalPort:  port,
+			RemoteHost: "127.0.0.1",
+			RemotePort: port,
+		})
+		tcpServer, err := transport.NewServer(ctx, nil)
+		common.Must(err)
+		ctx = config.WithConfig(ctx, Name, &Config{
+			RemoteHost: "127.0.0.1",
+			RemotePort: port,
+			Shadowsocks: ShadowsocksConfig{
+				Enabled:      true,
+				Method:       method,
+				Password:     "password",
+				ReplayFilter: ReplayFilterConfig{Enabled: true, Window: window},
+			},
+		})
+		s, err := NewServer(ctx, tcpServer)
+		common.Must(err)
+		return s, port
+	}
+	s1, port1 := newServer("AES-128-GCM", 8)
+	defer s1.Close()
+	s2, port2 := newServer("AES-128-GCM", 8)
+	defer s2.Close()
+
+	// 手动加密，避免 go-shadowsocks2 记住客户端写出的 salt
+	cipher, err := core.PickCipher("AES-128-GCM", nil, "password")
+	common.Must(err)
+	aeadCipher := cipher.(shadowaead.Cipher)
+	salt := make([]byte, aeadCipher.SaltSize())
+	rand.Read(salt)
+	aead, err := aeadCipher.Encrypter(salt)
+	common.Must(err)
+	record := bytes.NewBuffer(salt)
+	shadowaead.NewWriter(record, aead).Write(util.GeneratePayload(128))
+
+	send := func(port int) {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		common.Must(err)
+		conn.Write(record.Bytes())
+		time.Sleep(time.Millisecond * 100)
+		conn.Close()
+	}
+	go send(port1)
+	conn, err := s1.AcceptConn(nil)
+	common.Must(err)
+	conn.Close()
+	// 在另一个监听上重放同一个 salt
+	go send(port2)
+	if _, err := s2.AcceptConn(nil); err == nil {
+		t.Fatal("salt replayed on another listener is accepted")
+	}
+	stats := GetReplayStats(ctx)
+	if stats.Window != 8 || stats.Checked != 2 || stats.Hits != 1 {
+		t.Fatal("wrong stats", stats)
+	}
+
+	// DUMMY 没有 salt，不应触发重放检查
+	s3, port3 := newServer("DUMMY", 8)
+	defer s3.Close()
+	go func() {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port3))
+		common.Must(err)
+		conn.Write(util.GeneratePayload(1024))
+	}()
+	conn, err = s3.AcceptConn(nil)
+	common.Must(err)
+	conn.Close()
+	if stats := GetReplayStats(ctx); stats.Checked != 2 {
+		t.Fatal("DUMMY cipher is checked", stats)
+	}
+}
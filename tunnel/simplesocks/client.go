@@ -16,6 +16,7 @@ const (
 
 type Client struct {
 	underlay tunnel.Client
+	stats    *trojan.ClientStats // 按每个流的目标地址记录流量，没有 trojan 客户端时为空
 }
 
 func (c *Client) DialConn(addr *tunnel.Address, t tunnel.Tunnel) (tunnel.Conn, error) {
@@ -24,7 +25,7 @@ func (c *Client) DialConn(addr *tunnel.Address, t tunnel.Tunnel) (tunnel.Conn, e
 		return nil, common.NewError("simplesocks failed to dial using underlying tunnel").Base(err)
 	}
 	return &Conn{
-		Conn:       conn,
+		Conn:       c.stats.TrackStream(conn, addr.String()),
 		isOutbound: true,
 		metadata: &tunnel.Metadata{
 			Command: Connect,
@@ -50,7 +51,7 @@ func (c *Client) DialPacket(t tunnel.Tunnel) (tunnel.PacketConn, error) {
 	}
 	return &PacketConn{
 		PacketConn: trojan.PacketConn{
-			Conn: conn,
+			Conn: c.stats.TrackStream(conn, "udp"),
 		},
 	}, nil
 }
@@ -63,5 +64,6 @@ func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
 	log.Debug("simplesocks client created")
 	return &Client{
 		underlay: underlay,
+		stats:    trojan.SharedClientStats(ctx),
 	}, nil
 }
@@ -42,6 +42,10 @@ func (s *Server) acceptLoop() {
 			conn.Close()
 			continue
 		}
+		// the user is authenticated by the underlying trojan layer
+		if m := conn.Metadata(); m != nil {
+			metadata.User = m.User
+		}
 		switch metadata.Command {
 		case Connect:
 			s.connChan <- &Conn{
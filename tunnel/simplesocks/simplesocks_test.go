@@ -7,30 +7,22 @@ import (
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/statistic/memory"
 	"github.com/p4gefau1t/trojan-go/test/util"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
+	"github.com/p4gefau1t/trojan-go/tunnel/mux"
 	"github.com/p4gefau1t/trojan-go/tunnel/transport"
+	"github.com/p4gefau1t/trojan-go/tunnel/trojan"
 )
 
 func TestSimpleSocks(t *testing.T) {
-	port := common.PickPort("tcp", "127.0.0.1")
-	transportConfig := &transport.Config{
-		LocalHost:  "127.0.0.1",
-		LocalPort:  port,
-		RemoteHost: "127.0.0.1",
-		RemotePort: port,
-	}
-	ctx := config.WithConfig(context.Background(), transport.Name, transportConfig)
-	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
-	tcpClient, err := transport.NewClient(ctx, nil)
-	common.Must(err)
-	tcpServer, err := transport.NewServer(ctx, nil)
-	common.Must(err)
+	ctx := context.Background()
+	pipeClient, pipeServer := tunnel.NewPipe()
 
-	c, err := NewClient(ctx, tcpClient)
+	c, err := NewClient(ctx, pipeClient)
 	common.Must(err)
-	s, err := NewServer(ctx, tcpServer)
+	s, err := NewServer(ctx, pipeServer)
 	common.Must(err)
 
 	conn1, err := c.DialConn(&tunnel.Address{
@@ -73,3 +65,73 @@ func TestSimpleSocks(t *testing.T) {
 	s.Close()
 	c.Close()
 }
+
+func TestMuxStreamStats(t *testing.T) {
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = tunnel.WithScopedRegistry(ctx)
+	ctx = config.WithConfig(ctx, transport.Name, &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+	})
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	ctx = config.WithConfig(ctx, memory.Name, &memory.Config{Passwords: []string{"password"}})
+	ctx = config.WithConfig(ctx, trojan.Name, &trojan.Config{
+		RemoteHost: "127.0.0.1",
+		RemotePort: util.EchoPort,
+	})
+	ctx = config.WithConfig(ctx, mux.Name, &mux.Config{
+		Mux: mux.MuxConfig{Enabled: true, Concurrency: 8, IdleTimeout: 60},
+	})
+
+	tcpClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	trojanClient, err := trojan.NewClient(ctx, tcpClient)
+	common.Must(err)
+	trojanServer, err := trojan.NewServer(ctx, tcpServer)
+	common.Must(err)
+	muxClient, err := mux.NewClient(ctx, trojanClient)
+	common.Must(err)
+	muxServer, err := mux.NewServer(ctx, trojanServer)
+	common.Must(err)
+	c, err := NewClient(ctx, muxClient)
+	common.Must(err)
+	s, err := NewServer(ctx, muxServer)
+	common.Must(err)
+	defer c.Close()
+	defer s.Close()
+
+	// 同一个多路复用连接上的流按各自的目标地址记录
+	for _, host := range []string{"example.com", "example.org"} {
+		conn1, err := c.DialConn(&tunnel.Address{
+			DomainName:  host,
+			AddressType: tunnel.DomainName,
+			Port:        443,
+		}, nil)
+		common.Must(err)
+		common.Must2(conn1.Write([]byte("12345678")))
+		conn2, err := s.AcceptConn(nil)
+		common.Must(err)
+		buf := [8]byte{}
+		common.Must2(conn2.Read(buf[:]))
+		common.Must2(conn2.Write(buf[:]))
+		common.Must2(conn1.Read(buf[:]))
+		conn1.Close()
+		conn2.Close()
+	}
+
+	stats := trojan.SharedClientStats(ctx).Snapshot()
+	if stats.ActiveConnections != 0 || len(stats.Destinations) != 2 {
+		t.Fatal("wrong client stats", stats)
+	}
+	for _, d := range stats.Destinations {
+		if d.Destination != "example.com:443" && d.Destination != "example.org:443" || d.Connections != 1 || d.Sent == 0 || d.Recv != 8 {
+			t.Fatal("wrong destination stats", d)
+		}
+	}
+}
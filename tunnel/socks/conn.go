@@ -3,6 +3,8 @@ package socks
 import (
 	"context"
 	"net"
+	"os"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/tunnel"
@@ -24,11 +26,12 @@ type packetInfo struct {
 
 type PacketConn struct {
 	net.PacketConn
-	input  chan *packetInfo
-	output chan *packetInfo
-	src    net.Addr
-	ctx    context.Context
-	cancel context.CancelFunc
+	input    chan *packetInfo
+	output   chan *packetInfo
+	src      net.Addr
+	ctx      context.Context
+	cancel   context.CancelFunc
+	deadline tunnel.ReadDeadline
 }
 
 func (c *PacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
@@ -61,7 +64,23 @@ func (c *PacketConn) ReadWithMetadata(p []byte) (int, *tunnel.Metadata, error) {
 	case info := <-c.input:
 		n := copy(p, info.payload)
 		return n, info.metadata, nil
+	case <-c.deadline.Wait():
+		return 0, nil, os.ErrDeadlineExceeded
 	case <-c.ctx.Done():
 		return 0, nil, common.NewError("socks packet conn closed")
 	}
 }
+
+// SetReadDeadline doesn't touch the shared udp socket
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.deadline.Set(t)
+	return nil
+}
+
+func (c *PacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
@@ -21,10 +21,6 @@ const (
 	Associate tunnel.Command = 3
 )
 
-const (
-	MaxPacketSize = 1024 * 8
-)
-
 type Server struct {
 	connChan         chan tunnel.Conn
 	packetChan       chan tunnel.PacketConn
@@ -96,6 +92,7 @@ func (s *Server) handshake(conn net.Conn) (*Conn, error) {
 		metadata: &tunnel.Metadata{
 			Command: tunnel.Command(buf[1]),
 			Address: addr,
+			Inbound: Name,
 		},
 		Conn: conn,
 	}, nil
@@ -110,14 +107,28 @@ func (s *Server) connect(conn net.Conn) error {
 // socks5 UDP ASSOCIATE 命令回复
 func (s *Server) associate(conn net.Conn, addr *tunnel.Address) error {
 	buf := bytes.NewBuffer([]byte{0x05, 0x00, 0x00})
-	common.Must(addr.WriteTo(buf))
+	if err := addr.WriteTo(buf); err != nil {
+		return err
+	}
 	_, err := conn.Write(buf.Bytes())
 	return err
 }
 
+// associateAddr returns the udp address replied to the client. The local address of the connection is used when
+// the listening address is unspecified or a domain name, so that the ipv6 clients get an ipv6 address
+func (s *Server) associateAddr(conn net.Conn) *tunnel.Address {
+	if ip := net.ParseIP(s.localHost); ip != nil && !ip.IsUnspecified() {
+		return tunnel.NewAddressFromHostPort("udp", s.localHost, s.localPort)
+	}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return tunnel.NewAddressFromHostPort("udp", local.IP.String(), s.localPort)
+	}
+	return tunnel.NewAddressFromHostPort("udp", s.localHost, s.localPort)
+}
+
 func (s *Server) packetDispatchLoop() {
 	for {
-		buf := make([]byte, MaxPacketSize)
+		buf := make([]byte, common.PacketSize())
 		// ReadFrom 方法从连接中读取数据包，并将其存储在 buf 中。
 		// n 是读取的字节数，表示实际接收到的数据大小。
 		// src 是发送方的网络地址，通常是一个 net.Addr 类型的对象，包含源 IP 地址和端口号。
@@ -133,6 +144,14 @@ func (s *Server) packetDispatchLoop() {
 			}
 		}
 		log.Debug("socks recv udp packet from", src)
+		if n < 4 {
+			log.Warn("socks udp packet from", src, "is too short")
+			continue
+		}
+		if buf[2] != 0 { // FRAG
+			log.Warn("socks udp fragmentation is not supported, packet from", src, "dropped")
+			continue
+		}
 		s.mappingLock.RLock()
 		conn, found := s.mapping[src.String()]
 		s.mappingLock.RUnlock()
@@ -151,9 +170,12 @@ func (s *Server) packetDispatchLoop() {
 				for {
 					select {
 					case info := <-conn.output:
-						buf := bytes.NewBuffer(make([]byte, 0, MaxPacketSize))
+						buf := bytes.NewBuffer(make([]byte, 0, common.PacketSize()))
 						buf.Write([]byte{0, 0, 0}) // RSV, FRAG
-						common.Must(info.metadata.Address.WriteTo(buf))
+						if err := info.metadata.Address.WriteTo(buf); err != nil {
+							log.Error(common.NewError("socks failed to write packet addr").Base(err))
+							continue
+						}
 						buf.Write(info.payload)
 						_, err := s.listenPacketConn.WriteTo(buf.Bytes(), conn.src)
 						if err != nil {
@@ -187,12 +209,13 @@ func (s *Server) packetDispatchLoop() {
 			log.Error(common.NewError("socks failed to parse incoming packet").Base(err))
 			continue
 		}
-		payload := make([]byte, MaxPacketSize)
+		payload := make([]byte, common.PacketSize())
 		length, _ := r.Read(payload)
 		select {
 		case conn.input <- &packetInfo{
 			metadata: &tunnel.Metadata{
 				Address: address,
+				Inbound: Name,
 			},
 			payload: payload[:length],
 		}:
@@ -227,8 +250,7 @@ func (s *Server) acceptLoop() {
 				return
 			case Associate:
 				defer newConn.Close()
-				associateAddr := tunnel.NewAddressFromHostPort("udp", s.localHost, s.localPort)
-				if err := s.associate(newConn, associateAddr); err != nil {
+				if err := s.associate(newConn, s.associateAddr(conn)); err != nil {
 					log.Error(common.NewError("socks failed to respond to associate request").Base(err))
 					return
 				}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"sync"
@@ -143,3 +144,74 @@ func TestSocks(t *testing.T) {
 
 	s.Close()
 }
+
+func TestSocksIPv6(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("ipv6 is not available")
+	} else {
+		l.Close()
+	}
+	port := common.PickPort("tcp", "::1")
+	ctx := config.WithConfig(context.Background(), adapter.Name, &adapter.Config{
+		LocalHost: "::",
+		LocalPort: port,
+	})
+	ctx = config.WithConfig(ctx, socks.Name, &socks.Config{
+		LocalHost: "::",
+		LocalPort: port,
+	})
+	tcpServer, err := adapter.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := socks.NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("[::1]:%d", port))
+	common.Must(err)
+	defer conn.Close()
+	common.Must2(conn.Write([]byte{0x05, 0x01, 0x00}))
+	reply := [2]byte{}
+	common.Must2(io.ReadFull(conn, reply[:]))
+	request := bytes.NewBuffer([]byte{0x05, 0x03, 0x00})
+	common.Must(tunnel.NewAddressFromHostPort("udp", "::", 0).WriteTo(request))
+	common.Must2(conn.Write(request.Bytes()))
+
+	// the unspecified listening address is replaced by the address the client connected to
+	header := [3]byte{}
+	common.Must2(io.ReadFull(conn, header[:]))
+	associateAddr := new(tunnel.Address)
+	common.Must(associateAddr.ReadFrom(conn))
+	if associateAddr.AddressType != tunnel.IPv6 || !associateAddr.IP.Equal(net.ParseIP("::1")) || associateAddr.Port != port {
+		t.Fatal("wrong associate address", associateAddr)
+	}
+
+	udpConn, err := net.ListenPacket("udp", "[::1]:0")
+	common.Must(err)
+	defer udpConn.Close()
+	target := tunnel.NewAddressFromHostPort("udp", "2001:db8::1", 53)
+	payload := util.GeneratePayload(512)
+	buf := bytes.NewBuffer([]byte{0, 0, 0}) // RSV, FRAG
+	common.Must(target.WriteTo(buf))
+	buf.Write(payload)
+	common.Must2(udpConn.WriteTo(buf.Bytes(), &net.UDPAddr{IP: associateAddr.IP, Port: associateAddr.Port}))
+
+	packet, err := s.AcceptPacket(nil)
+	common.Must(err)
+	recvBuf := make([]byte, 4096)
+	n, m, err := packet.ReadWithMetadata(recvBuf)
+	common.Must(err)
+	if m.AddressType != tunnel.IPv6 || m.String() != "[2001:db8::1]:53" || !bytes.Equal(recvBuf[:n], payload) {
+		t.Fatal("wrong packet", m)
+	}
+
+	common.Must2(packet.WriteWithMetadata(payload, &tunnel.Metadata{Address: target}))
+	n, _, err = udpConn.ReadFrom(recvBuf)
+	common.Must(err)
+	r := bytes.NewReader(recvBuf[3:n])
+	from := new(tunnel.Address)
+	common.Must(from.ReadFrom(r))
+	if from.String() != "[2001:db8::1]:53" {
+		t.Fatal("wrong source address", from)
+	}
+	packet.Close()
+}
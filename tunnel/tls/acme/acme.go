@@ -0,0 +1,378 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+const (
+	ChallengeHTTP01 = "http-01"
+	ChallengeDNS01  = "dns-01"
+)
+
+// 续期检查的间隔，以及申请失败后重试的间隔
+const (
+	checkInterval = time.Hour * 12
+	retryInterval = time.Hour
+)
+
+type Config struct {
+	Enabled     bool     `json:"enabled" yaml:"enabled"`
+	Email       string   `json:"email" yaml:"email"`
+	Domains     []string `json:"domains" yaml:"domains"`
+	Directory   string   `json:"directory" yaml:"directory"`
+	Challenge   string   `json:"challenge" yaml:"challenge"`
+	HTTPAddr    string   `json:"http_addr" yaml:"http-addr"`
+	DNSExec     []string `json:"dns_exec" yaml:"dns-exec"`
+	DNSWait     int      `json:"dns_wait" yaml:"dns-wait"`
+	Storage     string   `json:"storage" yaml:"storage"`
+	RenewBefore int      `json:"renew_before" yaml:"renew-before"`
+}
+
+// Manager obtains the certificate from the ACME CA and renews it before it expires
+type Manager struct {
+	config   *Config
+	certPath string
+	keyPath  string
+	client   *acme.Client
+	// http-01 challenge 的 token 路径 -> 响应
+	tokensLock sync.Mutex
+	tokens     map[string]string
+}
+
+// load reads the key pair from the disk
+func (m *Manager) load() (*tls.Certificate, error) {
+	keyPair, err := tls.LoadX509KeyPair(m.certPath, m.keyPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPair.Leaf, err = x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair, nil
+}
+
+func (m *Manager) needsRenewal(cert *tls.Certificate) bool {
+	renewBefore := time.Duration(m.config.RenewBefore) * time.Hour * 24
+	if time.Until(cert.Leaf.NotAfter) < renewBefore {
+		return true
+	}
+	for _, domain := range m.config.Domains {
+		if cert.Leaf.VerifyHostname(domain) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// accountKey loads the account key from the storage, or generates a new one
+func (m *Manager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.config.Storage, "account.key")
+	if data, err := ioutil.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, common.NewError("invalid acme account key " + path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m *Manager) register(ctx context.Context) error {
+	if m.client != nil {
+		return nil
+	}
+	key, err := m.accountKey()
+	if err != nil {
+		return common.NewError("acme failed to load account key").Base(err)
+	}
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: m.config.Directory,
+	}
+	account := &acme.Account{}
+	if m.config.Email != "" {
+		account.Contact = []string{"mailto:" + m.config.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return common.NewError("acme failed to register account").Base(err)
+	}
+	m.client = client
+	return nil
+}
+
+// ServeHTTP responds to the http-01 challenges
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.tokensLock.Lock()
+	resp, found := m.tokens[r.URL.Path]
+	m.tokensLock.Unlock()
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write([]byte(resp))
+}
+
+// dnsRecord calls the dns_exec command to present or clean up the TXT record
+func (m *Manager) dnsRecord(ctx context.Context, action, domain, value string) error {
+	name := "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+	args := append(append([]string{}, m.config.DNSExec[1:]...), action, name, value)
+	cmd := exec.CommandContext(ctx, m.config.DNSExec[0], args...)
+	cmd.Env = append(os.Environ(),
+		"TROJAN_ACME_ACTION="+action,
+		"TROJAN_ACME_DOMAIN="+domain,
+		"TROJAN_ACME_RECORD="+name,
+		"TROJAN_ACME_VALUE="+value,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return common.NewError("dns exec " + action + " failed, output: " + string(output)).Base(err)
+	}
+	return nil
+}
+
+// authorize fulfills the challenge of an authorization, the returned function cleans up the challenge
+func (m *Manager) authorize(ctx context.Context, url string) (func(), error) {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if authz.Status == acme.StatusValid {
+		return func() {}, nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == m.config.Challenge {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return nil, common.NewError("acme server does not offer " + m.config.Challenge + " challenge for " + authz.Identifier.Value)
+	}
+	domain := authz.Identifier.Value
+	if authz.Wildcard {
+		domain = "*." + domain
+	}
+	cleanup := func() {}
+	switch m.config.Challenge {
+	case ChallengeHTTP01:
+		path := m.client.HTTP01ChallengePath(challenge.Token)
+		resp, err := m.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+		m.tokensLock.Lock()
+		m.tokens[path] = resp
+		m.tokensLock.Unlock()
+		cleanup = func() {
+			m.tokensLock.Lock()
+			delete(m.tokens, path)
+			m.tokensLock.Unlock()
+		}
+	case ChallengeDNS01:
+		value, err := m.client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.dnsRecord(ctx, "present", domain, value); err != nil {
+			return nil, err
+		}
+		cleanup = func() {
+			if err := m.dnsRecord(context.Background(), "cleanup", domain, value); err != nil {
+				log.Warn(err)
+			}
+		}
+		// 等待 TXT 记录生效
+		select {
+		case <-time.After(time.Duration(m.config.DNSWait) * time.Second):
+		case <-ctx.Done():
+			cleanup()
+			return nil, ctx.Err()
+		}
+	}
+	if _, err := m.client.Accept(ctx, challenge); err != nil {
+		cleanup()
+		return nil, err
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		cleanup()
+		return nil, err
+	}
+	log.Info("acme authorization of", domain, "is valid")
+	return cleanup, nil
+}
+
+// Obtain requests a new certificate from the ACME CA and saves it to the disk
+func (m *Manager) Obtain(ctx context.Context) (*tls.Certificate, error) {
+	if err := m.register(ctx); err != nil {
+		return nil, err
+	}
+	log.Info("acme requesting certificate for", m.config.Domains)
+	if m.config.Challenge == ChallengeHTTP01 {
+		listener, err := net.Listen("tcp", m.config.HTTPAddr)
+		if err != nil {
+			return nil, common.NewError("acme failed to listen on " + m.config.HTTPAddr).Base(err)
+		}
+		server := &http.Server{Handler: m}
+		go server.Serve(listener)
+		defer server.Close()
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.config.Domains...))
+	if err != nil {
+		return nil, common.NewError("acme failed to create order").Base(err)
+	}
+	for _, url := range order.AuthzURLs {
+		cleanup, err := m.authorize(ctx, url)
+		if err != nil {
+			return nil, common.NewError("acme authorization failed").Base(err)
+		}
+		defer cleanup()
+	}
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, common.NewError("acme order failed").Base(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.config.Domains[0]},
+		DNSNames: m.config.Domains,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, common.NewError("acme failed to finalize order").Base(err)
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := writeFile(m.keyPath, keyPEM); err != nil {
+		return nil, common.NewError("acme failed to save key").Base(err)
+	}
+	if err := writeFile(m.certPath, certPEM); err != nil {
+		return nil, common.NewError("acme failed to save cert").Base(err)
+	}
+	cert, err := m.load()
+	if err != nil {
+		return nil, common.NewError("acme obtained an invalid certificate").Base(err)
+	}
+	log.Info("acme certificate obtained, expires at", cert.Leaf.NotAfter)
+	return cert, nil
+}
+
+// Certificate returns the certificate on the disk, a new one is obtained if it is missing or about to expire
+func (m *Manager) Certificate(ctx context.Context) (*tls.Certificate, error) {
+	if cert, err := m.load(); err == nil && !m.needsRenewal(cert) {
+		log.Info("acme using existing certificate, expires at", cert.Leaf.NotAfter)
+		return cert, nil
+	}
+	return m.Obtain(ctx)
+}
+
+// Run renews the certificate periodically, and passes the new certificate to update
+func (m *Manager) Run(ctx context.Context, cert *tls.Certificate, update func(*tls.Certificate)) {
+	timer := time.NewTimer(checkInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+		timer.Reset(checkInterval)
+		if !m.needsRenewal(cert) {
+			continue
+		}
+		newCert, err := m.Obtain(ctx)
+		if err != nil {
+			log.Error(common.NewError("acme failed to renew certificate").Base(err))
+			timer.Reset(retryInterval)
+			continue
+		}
+		cert = newCert
+		update(cert)
+	}
+}
+
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0o600)
+}
+
+// NewManager creates an ACME manager, the certificate is saved to certPath and keyPath,
+// or to the storage directory if they are empty
+func NewManager(cfg *Config, certPath, keyPath string) (*Manager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, common.NewError("acme domains are unspecified")
+	}
+	switch cfg.Challenge {
+	case ChallengeHTTP01:
+	case ChallengeDNS01:
+		if len(cfg.DNSExec) == 0 {
+			return nil, common.NewError("acme dns-01 challenge requires dns_exec")
+		}
+	default:
+		return nil, common.NewError("invalid acme challenge " + cfg.Challenge)
+	}
+	name := strings.Replace(cfg.Domains[0], "*", "_", -1)
+	if certPath == "" {
+		certPath = filepath.Join(cfg.Storage, name+".crt")
+	}
+	if keyPath == "" {
+		keyPath = filepath.Join(cfg.Storage, name+".key")
+	}
+	return &Manager{
+		config:   cfg,
+		certPath: certPath,
+		keyPath:  keyPath,
+		tokens:   make(map[string]string),
+	}, nil
+}
@@ -0,0 +1,98 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+func writeCert(t *testing.T, m *Manager, domain string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	common.Must(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	common.Must(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	common.Must(err)
+	common.Must(writeFile(m.certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	common.Must(writeFile(m.keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+}
+
+func TestCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trojan-go-acme")
+	common.Must(err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewManager(&Config{
+		Domains:     []string{"example.com"},
+		Challenge:   ChallengeHTTP01,
+		Storage:     dir,
+		RenewBefore: 30,
+	}, "", "")
+	common.Must(err)
+	if m.certPath != filepath.Join(dir, "example.com.crt") {
+		t.Fatal("wrong cert path", m.certPath)
+	}
+
+	writeCert(t, m, "example.com", time.Now().Add(time.Hour*24*60))
+	cert, err := m.Certificate(context.Background())
+	common.Must(err)
+	if m.needsRenewal(cert) {
+		t.Fatal("valid certificate should not be renewed")
+	}
+
+	writeCert(t, m, "example.com", time.Now().Add(time.Hour*24*10))
+	cert, err = m.load()
+	common.Must(err)
+	if !m.needsRenewal(cert) {
+		t.Fatal("expiring certificate should be renewed")
+	}
+
+	writeCert(t, m, "example.org", time.Now().Add(time.Hour*24*60))
+	cert, err = m.load()
+	common.Must(err)
+	if !m.needsRenewal(cert) {
+		t.Fatal("certificate of other domains should be renewed")
+	}
+}
+
+func TestDNSExec(t *testing.T) {
+	if _, err := NewManager(&Config{Domains: []string{"example.com"}, Challenge: ChallengeDNS01}, "", ""); err == nil {
+		t.Fatal("dns-01 without dns_exec should be rejected")
+	}
+	dir, err := ioutil.TempDir("", "trojan-go-acme")
+	common.Must(err)
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output")
+	m, err := NewManager(&Config{
+		Domains:   []string{"*.example.com"},
+		Challenge: ChallengeDNS01,
+		DNSExec:   []string{"sh", "-c", "echo \"$0 $1 $2 $TROJAN_ACME_DOMAIN\" > " + output},
+	}, "", "")
+	common.Must(err)
+	common.Must(m.dnsRecord(context.Background(), "present", "*.example.com", "token"))
+	data, err := ioutil.ReadFile(output)
+	common.Must(err)
+	if strings.TrimSpace(string(data)) != "present _acme-challenge.example.com. token *.example.com" {
+		t.Fatal("wrong dns exec arguments", string(data))
+	}
+}
@@ -0,0 +1,115 @@
+package tls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// sniAllowlist is the list of the server names accepted by the server, loaded from a file which is reloaded when it changes.
+// A nil allowlist accepts all names
+type sniAllowlist struct {
+	sync.RWMutex
+	path     string
+	names    []string
+	lastData []byte
+}
+
+// parseSNIAllowlist reads a name per line, empty lines and the lines starting with # are ignored
+func parseSNIAllowlist(data []byte) []string {
+	names := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, strings.ToLower(line))
+	}
+	return names
+}
+
+// contains reports whether the server name matches any name in the list, wildcards are supported
+func (l *sniAllowlist) contains(serverName string) bool {
+	if l == nil {
+		return true
+	}
+	serverName = strings.ToLower(serverName)
+	l.RLock()
+	defer l.RUnlock()
+	for _, name := range l.names {
+		if isDomainNameMatched(name, serverName) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload reads the file again, the current list is kept if the file can not be read
+func (l *sniAllowlist) reload() error {
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return common.NewError("tls failed to load sni file " + l.path).Base(err)
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.lastData != nil && bytes.Equal(data, l.lastData) {
+		return nil
+	}
+	l.names = parseSNIAllowlist(data)
+	l.lastData = data
+	log.Info("tls loaded", len(l.names), "server names from", l.path)
+	return nil
+}
+
+// watchLoop reloads the file when it changes, the file is polled if the file system notification is unavailable
+func (l *sniAllowlist) watchLoop(ctx context.Context, checkRate time.Duration) {
+	var events <-chan struct{}
+	var poll <-chan time.Time
+	if watcher, err := newFileWatcher(l.path); err != nil {
+		log.Warn(common.NewError("tls sni file watcher is unavailable, checking every " + checkRate.String()).Base(err))
+		ticker := time.NewTicker(checkRate)
+		defer ticker.Stop()
+		poll = ticker.C
+	} else {
+		defer watcher.Close()
+		events = watcher.Events()
+	}
+	delay := time.NewTimer(certReloadDelay)
+	delay.Stop()
+	defer delay.Stop()
+
+	for {
+		select {
+		case <-events: // 合并短时间内的多次变化
+			delay.Reset(certReloadDelay)
+		case <-delay.C:
+			if err := l.reload(); err != nil {
+				log.Error(err)
+			}
+		case <-poll:
+			if err := l.reload(); err != nil {
+				log.Error(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func newSNIAllowlist(path string) (*sniAllowlist, error) {
+	l := &sniAllowlist{
+		path: path,
+	}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,69 @@
+package tls
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// appendCertsFromFile adds the pem certificates in the file to the pool, returns the number of the certificates added
+func appendCertsFromFile(pool *x509.CertPool, path string) (int, error) {
+	pemCerts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, common.NewError("failed to load ca file " + path).Base(err)
+	}
+	count := 0
+	for len(pemCerts) > 0 {
+		var block *pem.Block
+		block, pemCerts = pem.Decode(pemCerts)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Warn(common.NewError("invalid certificate in " + path).Base(err))
+			continue
+		}
+		pool.AddCert(cert)
+		count++
+		log.Trace("issuer:", cert.Issuer, "subject:", cert.Subject)
+	}
+	return count, nil
+}
+
+// appendCertsFromPath adds the certificates in the file, or in all the files of the directory, to the pool
+func appendCertsFromPath(pool *x509.CertPool, path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, common.NewError("failed to load ca path " + path).Base(err)
+	}
+	if !info.IsDir() {
+		return appendCertsFromFile(pool, path)
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return 0, common.NewError("failed to read ca directory " + path).Base(err)
+	}
+	count := 0
+	for _, entry := range entries {
+		// 跳过子目录，目录中的符号链接（如 openssl rehash 生成的哈希链接）会被跟随
+		file := filepath.Join(path, entry.Name())
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			continue
+		}
+		n, err := appendCertsFromFile(pool, file)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
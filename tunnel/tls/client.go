@@ -4,10 +4,9 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
 	"io"
-	"io/ioutil"
 	"strings"
+	"sync"
 
 	utls "github.com/refraction-networking/utls"
 
@@ -21,16 +20,25 @@ import (
 
 // Client is a tls client
 type Client struct {
-	verify        bool
-	sni           string
-	ca            *x509.CertPool
+	trust         *serverTrust // 服务端证书的校验方式，重新加载配置时替换
+	trustLock     sync.RWMutex
 	cipher        []uint16
+	minVersion    uint16 // 0 表示默认，使用指纹时从 Client Hello 的版本扩展中移除范围外的版本
+	maxVersion    uint16
 	sessionTicket bool
 	reuseSession  bool
 	fingerprint   string
 	helloID       utls.ClientHelloID
+	alpn          []string
+	overrideALPN  bool             // 使用配置的 alpn 替换指纹自带的 alpn
+	echConfig     string           // 加密 Client Hello 使用的 ECHConfigList
+	clientCert    *tls.Certificate // 双向认证时提供给服务端的证书
+	reality       *realityClient   // reality 模式，通过服务端签发的临时证书校验服务端
 	keyLogger     io.WriteCloser
 	underlay      tunnel.Client
+	conns         map[*trackedConn]struct{} // 与服务端之间已经建立的连接
+	connsLock     sync.Mutex
+	lastCert      *x509.Certificate // 最近一次握手时服务端的证书
 }
 
 func (c *Client) Close() error {
@@ -44,40 +52,124 @@ func (c *Client) DialPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
 	panic("not supported")
 }
 
+// filterVersions removes the versions out of the configured range from the supported versions of the fingerprint, GREASE values are kept
+func (c *Client) filterVersions(versions []uint16) []uint16 {
+	result := make([]uint16, 0, len(versions))
+	for _, v := range versions {
+		isGREASE := v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+		if isGREASE || (c.minVersion == 0 || v >= c.minVersion) && (c.maxVersion == 0 || v <= c.maxVersion) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
 func (c *Client) DialConn(_ *tunnel.Address, overlay tunnel.Tunnel) (tunnel.Conn, error) {
-	conn, err := c.underlay.DialConn(nil, &Tunnel{})
+	underlayConn, err := c.underlay.DialConn(nil, &Tunnel{})
 	if err != nil {
 		return nil, common.NewError("tls failed to dial conn").Base(err)
 	}
+	conn := &trackedConn{
+		Conn:   underlayConn,
+		client: c,
+	}
+	trust := c.getTrust()
 
 	if c.fingerprint != "" {
 		// utls fingerprint
-		tlsConn := utls.UClient(conn, &utls.Config{
-			RootCAs:            c.ca,
-			ServerName:         c.sni,
-			InsecureSkipVerify: !c.verify,
+		utlsConfig := &utls.Config{
+			RootCAs:            trust.ca,
+			ServerName:         trust.sni,
+			InsecureSkipVerify: !trust.verify,
 			KeyLogWriter:       c.keyLogger,
-		}, c.helloID)
+			MinVersion:         c.minVersion,
+			MaxVersion:         c.maxVersion,
+		}
+		if c.clientCert != nil {
+			utlsConfig.Certificates = []utls.Certificate{{
+				Certificate: c.clientCert.Certificate,
+				PrivateKey:  c.clientCert.PrivateKey,
+			}}
+		}
+		if trust.pins != nil {
+			utlsConfig.VerifyPeerCertificate = trust.pins.verify
+		}
+		var realityKey []byte
+		if c.reality != nil {
+			utlsConfig.InsecureSkipVerify = true
+			utlsConfig.MinVersion = utls.VersionTLS13
+			utlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyRealityCertificate(realityKey, rawCerts)
+			}
+		}
+		tlsConn := utls.UClient(conn, utlsConfig, c.helloID)
+		if c.overrideALPN || c.minVersion != 0 || c.maxVersion != 0 {
+			// 生成指纹的 Client Hello 后只替换 ALPN 和版本扩展的内容，保持扩展的顺序不变
+			if err := tlsConn.BuildHandshakeState(); err != nil {
+				return nil, common.NewError("tls failed to build client hello").Base(err)
+			}
+			for _, ext := range tlsConn.Extensions {
+				switch ext := ext.(type) {
+				case *utls.ALPNExtension:
+					if c.overrideALPN {
+						ext.AlpnProtocols = c.alpn
+					}
+				case *utls.SupportedVersionsExtension:
+					ext.Versions = c.filterVersions(ext.Versions)
+				}
+			}
+			if err := tlsConn.BuildHandshakeState(); err != nil {
+				return nil, common.NewError("tls failed to build client hello").Base(err)
+			}
+		}
+		if c.reality != nil {
+			if err := tlsConn.BuildHandshakeState(); err != nil {
+				return nil, common.NewError("tls failed to build client hello").Base(err)
+			}
+			if realityKey, err = c.reality.seal(tlsConn); err != nil {
+				return nil, common.NewError("tls failed to build reality client hello").Base(err)
+			}
+		}
 		if err := tlsConn.Handshake(); err != nil {
 			return nil, common.NewError("tls failed to handshake with remote server").Base(err)
 		}
+		if c.reality == nil {
+			c.track(conn, tlsConn.ConnectionState().PeerCertificates)
+		}
 		return &transport.Conn{
 			Conn: tlsConn,
 		}, nil
 	}
 	// golang default tls library
-	tlsConn := tls.Client(conn, &tls.Config{
-		InsecureSkipVerify:     !c.verify,
-		ServerName:             c.sni,
-		RootCAs:                c.ca,
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify:     !trust.verify,
+		ServerName:             trust.sni,
+		RootCAs:                trust.ca,
 		KeyLogWriter:           c.keyLogger,
 		CipherSuites:           c.cipher,
+		MinVersion:             c.minVersion,
+		MaxVersion:             c.maxVersion,
 		SessionTicketsDisabled: !c.sessionTicket,
-	})
+		NextProtos:             c.alpn,
+	}
+	if c.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*c.clientCert}
+	}
+	if trust.pins != nil {
+		tlsConfig.VerifyPeerCertificate = trust.pins.verify
+	}
+	if c.echConfig != "" {
+		common.Must(applyClientECH(tlsConfig, c.echConfig))
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
 	err = tlsConn.Handshake()
 	if err != nil {
+		if retry := echRetryConfigs(err); retry != "" {
+			log.Warn("ech is rejected by the server, the ech config suggested by the server is", retry)
+		}
 		return nil, common.NewError("tls failed to handshake with remote server").Base(err)
 	}
+	c.track(conn, tlsConn.ConnectionState().PeerCertificates)
 	return &transport.Conn{
 		Conn: tlsConn,
 	}, nil
@@ -94,8 +186,10 @@ func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
 			helloID = utls.HelloFirefox_Auto
 		case "chrome":
 			helloID = utls.HelloChrome_Auto
-		case "ios":
+		case "ios", "safari": // Safari 与 iOS 使用相同的 Client Hello
 			helloID = utls.HelloIOS_Auto
+		case "randomized":
+			helloID = utls.HelloRandomizedALPN
 		default:
 			return nil, common.NewError("invalid fingerprint " + cfg.TLS.Fingerprint)
 		}
@@ -107,51 +201,67 @@ func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
 		log.Warn("tls sni is unspecified")
 	}
 
+	minVersion, maxVersion, err := fingerprint.ParseVersionRange(cfg.TLS.MinVersion, cfg.TLS.MaxVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TLS.ECHConfig != "" {
+		if cfg.TLS.Fingerprint != "" {
+			return nil, common.NewError("ech can not be used with tls fingerprint")
+		}
+		if maxVersion != 0 && maxVersion < tls.VersionTLS13 {
+			return nil, common.NewError("ech requires tls 1.3")
+		}
+		if err := applyClientECH(&tls.Config{}, cfg.TLS.ECHConfig); err != nil {
+			return nil, err
+		}
+		log.Info("tls ech enabled, the real sni is encrypted")
+	}
+
 	client := &Client{
 		underlay:      underlay,
-		verify:        cfg.TLS.Verify,
-		sni:           cfg.TLS.SNI,
+		conns:         make(map[*trackedConn]struct{}),
 		cipher:        fingerprint.ParseCipher(strings.Split(cfg.TLS.Cipher, ":")),
+		minVersion:    minVersion,
+		maxVersion:    maxVersion,
 		sessionTicket: cfg.TLS.ReuseSession,
 		fingerprint:   cfg.TLS.Fingerprint,
 		helloID:       helloID,
+		alpn:          cfg.TLS.ALPN,
+		echConfig:     cfg.TLS.ECHConfig,
+		// 指纹默认协商 h2，经过 CDN 时会导致 websocket 无法使用
+		overrideALPN: cfg.Websocket.Enabled && len(cfg.TLS.ALPN) != 0,
 	}
 
-	if cfg.TLS.CertPath != "" {
-		caCertByte, err := ioutil.ReadFile(cfg.TLS.CertPath)
-		if err != nil {
-			return nil, common.NewError("failed to load cert file").Base(err)
-		}
-		client.ca = x509.NewCertPool()
-		ok := client.ca.AppendCertsFromPEM(caCertByte)
-		if !ok {
-			log.Warn("invalid cert list")
-		}
-		log.Info("using custom cert")
-
-		// print cert info
-		pemCerts := caCertByte
-		for len(pemCerts) > 0 {
-			var block *pem.Block
-			block, pemCerts = pem.Decode(pemCerts)
-			if block == nil {
-				break
-			}
-			if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
-				continue
-			}
-			cert, err := x509.ParseCertificate(block.Bytes)
-			if err != nil {
-				continue
-			}
-			log.Trace("issuer:", cert.Issuer, "subject:", cert.Subject)
+	if cfg.TLS.Reality.Enabled {
+		if cfg.TLS.Fingerprint == "" {
+			return nil, common.NewError("tls reality requires a fingerprint")
 		}
+		if client.reality, err = newRealityClient(&cfg.TLS.Reality); err != nil {
+			return nil, common.NewError("tls failed to init reality").Base(err)
+		}
+		log.Info("tls reality enabled")
+	}
+
+	if client.trust, err = loadServerTrust(cfg); err != nil {
+		return nil, err
 	}
 
-	if cfg.TLS.CertPath == "" {
-		log.Info("cert is unspecified, using default ca list")
+	if cfg.TLS.MutualTLS.Enabled {
+		keyPair, err := tls.LoadX509KeyPair(cfg.TLS.MutualTLS.CertPath, cfg.TLS.MutualTLS.KeyPath)
+		if err != nil {
+			return nil, common.NewError("tls failed to load client certificate").Base(err)
+		}
+		client.clientCert = &keyPair
+		log.Info("tls client certificate loaded")
 	}
 
+	// 重新加载配置时更新服务端证书的校验方式，关闭不再信任的连接
+	config.OnReload(ctx, func(data []byte, format string) error {
+		return client.reloadTrust(ctx, data, format)
+	})
+
 	log.Debug("tls client created")
 	return client, nil
 }
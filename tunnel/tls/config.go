@@ -1,7 +1,12 @@
 package tls
 
 import (
+	"strconv"
+
 	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/tunnel/tls/acme"
+	"github.com/p4gefau1t/trojan-go/tunnel/tls/fingerprint"
+	"github.com/p4gefau1t/trojan-go/tunnel/tls/parity"
 )
 
 type Config struct {
@@ -9,6 +14,32 @@ type Config struct {
 	RemotePort int             `json:"remote_port" yaml:"remote-port"`
 	TLS        TLSConfig       `json:"ssl" yaml:"ssl"`
 	Websocket  WebsocketConfig `json:"websocket" yaml:"websocket"`
+	// 以下与 trojan 层共用同一个配置项
+	ProbeResistance ProbeResistanceConfig `json:"probe_resistance" yaml:"probe-resistance"`
+	Capture         CaptureConfig         `json:"capture" yaml:"capture"`
+	AntiReplay      AntiReplayConfig      `json:"anti_replay" yaml:"anti-replay"`
+}
+
+// AntiReplayConfig 记录最近的 Client Hello，将重放的握手当作探测重定向到回落地址
+type AntiReplayConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	Window  int  `json:"window" yaml:"window"` // 秒
+	Size    int  `json:"size" yaml:"size"`     // 最多记录的握手数量
+}
+
+// ProbeResistanceConfig 握手失败的连接在随机延迟后再回落，并且畸形的 Client Hello 与非 TLS 流量的处理方式相同
+type ProbeResistanceConfig struct {
+	Enabled  bool `json:"enabled" yaml:"enabled"`
+	MinDelay int  `json:"min_delay" yaml:"min-delay"` // 毫秒
+	MaxDelay int  `json:"max_delay" yaml:"max-delay"` // 毫秒
+}
+
+// CaptureConfig 将被拒绝的连接的前若干字节记录到磁盘，用于排查探测者发送的内容
+type CaptureConfig struct {
+	Enabled    bool   `json:"enabled" yaml:"enabled"`
+	Path       string `json:"path" yaml:"path"`
+	MaxBytes   int    `json:"max_bytes" yaml:"max-bytes"`
+	MaxRecords int    `json:"max_records" yaml:"max-records"`
 }
 
 type WebsocketConfig struct {
@@ -16,33 +47,191 @@ type WebsocketConfig struct {
 }
 
 type TLSConfig struct {
-	Verify               bool     `json:"verify" yaml:"verify"`
-	VerifyHostName       bool     `json:"verify_hostname" yaml:"verify-hostname"`
-	CertPath             string   `json:"cert" yaml:"cert"`
-	KeyPath              string   `json:"key" yaml:"key"`
-	KeyPassword          string   `json:"key_password" yaml:"key-password"`
-	Cipher               string   `json:"cipher" yaml:"cipher"`
-	PreferServerCipher   bool     `json:"prefer_server_cipher" yaml:"prefer-server-cipher"`
-	SNI                  string   `json:"sni" yaml:"sni"`
-	HTTPResponseFileName string   `json:"plain_http_response" yaml:"plain-http-response"`
-	FallbackHost         string   `json:"fallback_addr" yaml:"fallback-addr"`
-	FallbackPort         int      `json:"fallback_port" yaml:"fallback-port"`
-	ReuseSession         bool     `json:"reuse_session" yaml:"reuse-session"`
-	ALPN                 []string `json:"alpn" yaml:"alpn"`
-	Curves               string   `json:"curves" yaml:"curves"`
-	Fingerprint          string   `json:"fingerprint" yaml:"fingerprint"`
-	KeyLogPath           string   `json:"key_log" yaml:"key-log"`
-	CertCheckRate        int      `json:"cert_check_rate" yaml:"cert-check-rate"`
+	Verify               bool                 `json:"verify" yaml:"verify"`
+	VerifyHostName       bool                 `json:"verify_hostname" yaml:"verify-hostname"`
+	CertPath             string               `json:"cert" yaml:"cert"`
+	KeyPath              string               `json:"key" yaml:"key"`
+	CAPath               string               `json:"ca_path" yaml:"ca-path"` // 客户端，校验服务端证书的 CA 文件或目录
+	KeyPassword          string               `json:"key_password" yaml:"key-password"`
+	Certificates         []CertificateConfig  `json:"certificates" yaml:"certificates"`
+	Cipher               string               `json:"cipher" yaml:"cipher"`
+	PreferServerCipher   bool                 `json:"prefer_server_cipher" yaml:"prefer-server-cipher"`
+	SNI                  string               `json:"sni" yaml:"sni"`
+	SNIList              []string             `json:"sni_list" yaml:"sni-list"`
+	SNIFile              string               `json:"sni_file" yaml:"sni-file"` // 服务端，接受的服务器名列表文件，变化后自动重新加载
+	HTTPResponseFileName string               `json:"plain_http_response" yaml:"plain-http-response"`
+	FallbackHost         string               `json:"fallback_addr" yaml:"fallback-addr"`
+	FallbackPort         int                  `json:"fallback_port" yaml:"fallback-port"`
+	SNIFallbacks         []SNIFallbackConfig  `json:"sni_fallbacks" yaml:"sni-fallbacks"`
+	ReuseSession         bool                 `json:"reuse_session" yaml:"reuse-session"`
+	ALPN                 []string             `json:"alpn" yaml:"alpn"`
+	Curves               string               `json:"curves" yaml:"curves"`
+	MinVersion           string               `json:"min_version" yaml:"min-version"`
+	MaxVersion           string               `json:"max_version" yaml:"max-version"`
+	Fingerprint          string               `json:"fingerprint" yaml:"fingerprint"`
+	Pins                 []string             `json:"pins" yaml:"pins"` // 客户端，服务端证书或公钥的 SHA-256 指纹
+	KeyLogPath           string               `json:"key_log" yaml:"key-log"`
+	CertCheckRate        int                  `json:"cert_check_rate" yaml:"cert-check-rate"`
+	SNIMismatch          string               `json:"sni_mismatch" yaml:"sni-mismatch"`
+	SNIMismatchCertPath  string               `json:"sni_mismatch_cert" yaml:"sni-mismatch-cert"`
+	SNIMismatchKeyPath   string               `json:"sni_mismatch_key" yaml:"sni-mismatch-key"`
+	ECHKeyPath           string               `json:"ech_key" yaml:"ech-key"`
+	ECHConfig            string               `json:"ech_config" yaml:"ech-config"`
+	ACME                 acme.Config          `json:"acme" yaml:"acme"`
+	SessionCache         SessionCacheConfig   `json:"session_cache" yaml:"session-cache"`
+	TicketRotation       TicketRotationConfig `json:"ticket_rotation" yaml:"ticket-rotation"`
+	MutualTLS            MutualTLSConfig      `json:"mtls" yaml:"mtls"`
+	Reality              RealityConfig        `json:"reality" yaml:"reality"`
+	Parity               parity.Config        `json:"parity" yaml:"parity"`
+}
+
+// CertificateConfig is an additional certificate selected by the SNI of the client
+type CertificateConfig struct {
+	CertPath    string `json:"cert" yaml:"cert"`
+	KeyPath     string `json:"key" yaml:"key"`
+	KeyPassword string `json:"key_password" yaml:"key-password"`
+}
+
+// SNIFallbackConfig redirects the connections with the SNI to a different fallback address, wildcards are supported
+type SNIFallbackConfig struct {
+	SNI          string `json:"sni" yaml:"sni"`
+	FallbackHost string `json:"fallback_addr" yaml:"fallback-addr"`
+	FallbackPort int    `json:"fallback_port" yaml:"fallback-port"`
+}
+
+// MutualTLSConfig 双向认证，服务端使用 CA 校验客户端证书，客户端在握手时提供证书
+type MutualTLSConfig struct {
+	Enabled  bool   `json:"enabled" yaml:"enabled"`
+	CAPath   string `json:"ca" yaml:"ca"`
+	CertPath string `json:"cert" yaml:"cert"`
+	KeyPath  string `json:"key" yaml:"key"`
+}
+
+// RealityConfig 服务端不持有证书，未认证的连接转发到目标网站，由真实网站完成握手
+type RealityConfig struct {
+	Enabled     bool     `json:"enabled" yaml:"enabled"`
+	DestHost    string   `json:"dest_addr" yaml:"dest-addr"`         // 服务端，目标网站的地址
+	DestPort    int      `json:"dest_port" yaml:"dest-port"`         // 服务端，目标网站的端口
+	ServerNames []string `json:"server_names" yaml:"server-names"`   // 服务端，允许的 SNI
+	PrivateKey  string   `json:"private_key" yaml:"private-key"`     // 服务端，X25519 私钥
+	ShortIDs    []string `json:"short_ids" yaml:"short-ids"`         // 服务端，允许的 short id
+	MaxTimeDiff int      `json:"max_time_diff" yaml:"max-time-diff"` // 服务端，允许的客户端时间误差(秒)，0 表示不检查
+	PublicKey   string   `json:"public_key" yaml:"public-key"`       // 客户端，服务端的 X25519 公钥
+	ShortID     string   `json:"short_id" yaml:"short-id"`           // 客户端使用的 short id
+}
+
+// SessionCacheConfig shares the session ticket keys among the server instances with redis
+type SessionCacheConfig struct {
+	Enabled    bool   `json:"enabled" yaml:"enabled"`
+	ServerHost string `json:"server_addr" yaml:"server-addr"`
+	ServerPort int    `json:"server_port" yaml:"server-port"`
+	Password   string `json:"password" yaml:"password"`
+	Database   int    `json:"database" yaml:"database"`
+	Key        string `json:"key" yaml:"key"`
+	CheckRate  int    `json:"check_rate" yaml:"check-rate"`
+}
+
+// TicketRotationConfig 定期轮换会话票据密钥，保留的旧密钥仍然可以解密之前签发的票据
+type TicketRotationConfig struct {
+	Interval int `json:"interval" yaml:"interval"` // 轮换间隔(小时)，0 表示不轮换
+	Keep     int `json:"keep" yaml:"keep"`         // 保留的密钥数量，包括当前使用的密钥
+}
+
+// Validate checks the fields shared by the client and the server
+func (c *Config) Validate() error {
+	var errs config.Errors
+	switch c.TLS.Fingerprint {
+	case "", "firefox", "chrome", "ios", "safari", "randomized":
+	default:
+		errs.Add("ssl.fingerprint", "unknown fingerprint "+strconv.Quote(c.TLS.Fingerprint))
+	}
+	if _, err := fingerprint.ParseVersion(c.TLS.MinVersion); err != nil {
+		errs.Add("ssl.min_version", err.Error())
+	} else if _, err := fingerprint.ParseVersion(c.TLS.MaxVersion); err != nil {
+		errs.Add("ssl.max_version", err.Error())
+	} else if _, _, err := fingerprint.ParseVersionRange(c.TLS.MinVersion, c.TLS.MaxVersion); err != nil {
+		errs.Add("ssl.min_version", err.Error())
+	}
+	switch c.TLS.SNIMismatch {
+	case "", sniMismatchReject, sniMismatchDefault, sniMismatchFallback:
+	default:
+		errs.Add("ssl.sni_mismatch", "must be reject, default or fallback")
+	}
+	if (c.TLS.SNIMismatchCertPath == "") != (c.TLS.SNIMismatchKeyPath == "") {
+		errs.Add("ssl.sni_mismatch_key", "sni_mismatch_cert and sni_mismatch_key must be set together")
+	}
+	if c.TLS.FallbackPort < 0 || c.TLS.FallbackPort > 65535 {
+		errs.Add("ssl.fallback_port", "invalid port "+strconv.Itoa(c.TLS.FallbackPort))
+	}
+	for i, fallback := range c.TLS.SNIFallbacks {
+		path := "ssl.sni_fallbacks[" + strconv.Itoa(i) + "]"
+		if fallback.SNI == "" {
+			errs.Add(path+".sni", "empty sni")
+		}
+		if fallback.FallbackPort < 0 || fallback.FallbackPort > 65535 {
+			errs.Add(path+".fallback_port", "invalid port "+strconv.Itoa(fallback.FallbackPort))
+		}
+	}
+	if c.TLS.TicketRotation.Interval < 0 {
+		errs.Add("ssl.ticket_rotation.interval", "must not be negative")
+	} else if c.TLS.TicketRotation.Interval > 0 && c.TLS.TicketRotation.Keep < 1 {
+		errs.Add("ssl.ticket_rotation.keep", "must be at least 1")
+	}
+	if c.ProbeResistance.Enabled && (c.ProbeResistance.MinDelay < 0 || c.ProbeResistance.MaxDelay < c.ProbeResistance.MinDelay) {
+		errs.Add("probe_resistance.max_delay", "invalid delay range, max_delay must not be less than min_delay")
+	}
+	if c.Capture.Enabled && c.Capture.MaxBytes <= 0 {
+		errs.Add("capture.max_bytes", "must be positive")
+	}
+	if c.Capture.Enabled && c.Capture.MaxRecords <= 0 {
+		errs.Add("capture.max_records", "must be positive")
+	}
+	return errs.Err()
 }
 
 func init() {
 	config.RegisterConfigCreator(Name, func() interface{} {
 		return &Config{
+			ProbeResistance: ProbeResistanceConfig{
+				MinDelay: 20,
+				MaxDelay: 200,
+			},
+			Capture: CaptureConfig{
+				Path:       "capture",
+				MaxBytes:   512,
+				MaxRecords: 256,
+			},
+			AntiReplay: AntiReplayConfig{
+				Window: 600,
+				Size:   65536,
+			},
 			TLS: TLSConfig{
 				Verify:         true,
 				VerifyHostName: true,
 				Fingerprint:    "",
 				ALPN:           []string{"http/1.1"},
+				SNIMismatch:    "reject",
+				ACME: acme.Config{
+					Directory:   "https://acme-v02.api.letsencrypt.org/directory",
+					Challenge:   acme.ChallengeHTTP01,
+					HTTPAddr:    ":80",
+					DNSWait:     60,
+					Storage:     "acme",
+					RenewBefore: 30,
+				},
+				SessionCache: SessionCacheConfig{
+					ServerHost: "127.0.0.1",
+					ServerPort: 6379,
+					Key:        "trojan-go:session-ticket-keys",
+					CheckRate:  60,
+				},
+				TicketRotation: TicketRotationConfig{
+					Keep: 3,
+				},
+				Reality: RealityConfig{
+					DestPort:    443,
+					MaxTimeDiff: 120,
+				},
 			},
 		}
 	})
@@ -0,0 +1,186 @@
+//go:build go1.24
+// +build go1.24
+
+package tls
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// ECH 使用的 HPKE 算法
+const (
+	echVersion       = 0xfe0d
+	hpkeX25519       = 0x0020 // DHKEM(X25519, HKDF-SHA256)
+	hpkeHKDFSHA256   = 0x0001
+	hpkeAES128GCM    = 0x0001
+	hpkeChaCha20     = 0x0003
+	echPEMConfigType = "ECHCONFIG"
+)
+
+// echKeySet holds the ECH keys of the server
+type echKeySet struct {
+	keys       []tls.EncryptedClientHelloKey
+	configList []byte // 发布给客户端的 ECHConfigList
+}
+
+func (e *echKeySet) apply(cfg *tls.Config) {
+	if e != nil {
+		cfg.EncryptedClientHelloKeys = e.keys
+	}
+}
+
+// ConfigList returns the ECHConfigList in base64, which is used as the ech_config of the clients
+func (e *echKeySet) ConfigList() string {
+	return base64.StdEncoding.EncodeToString(e.configList)
+}
+
+func appendUint16Prefixed(b []byte, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// marshalECHConfig builds the ECHConfig of the X25519 public key
+func marshalECHConfig(id uint8, publicKey []byte, publicName string) []byte {
+	contents := []byte{id}
+	contents = binary.BigEndian.AppendUint16(contents, hpkeX25519)
+	contents = appendUint16Prefixed(contents, publicKey)
+	suites := []byte{}
+	for _, aead := range []uint16{hpkeAES128GCM, hpkeChaCha20} {
+		suites = binary.BigEndian.AppendUint16(suites, hpkeHKDFSHA256)
+		suites = binary.BigEndian.AppendUint16(suites, aead)
+	}
+	contents = appendUint16Prefixed(contents, suites)
+	contents = append(contents, 0) // maximum_name_length
+	contents = append(contents, uint8(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0) // 无扩展
+
+	config := binary.BigEndian.AppendUint16(nil, echVersion)
+	return appendUint16Prefixed(config, contents)
+}
+
+// splitECHConfigList splits the ECHConfigList into ECHConfigs
+func splitECHConfigList(list []byte) ([][]byte, error) {
+	if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return nil, common.NewError("invalid ech config list length")
+	}
+	var configs [][]byte
+	for b := list[2:]; len(b) != 0; {
+		if len(b) < 4 {
+			return nil, common.NewError("invalid ech config")
+		}
+		length := 4 + int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < length {
+			return nil, common.NewError("invalid ech config length")
+		}
+		configs = append(configs, b[:length])
+		b = b[length:]
+	}
+	return configs, nil
+}
+
+// GenerateECHKey generates a X25519 ECH key with the public name, in the PEM format of the ech_key file
+func GenerateECHKey(publicName string) ([]byte, error) {
+	if publicName == "" || len(publicName) > 255 {
+		return nil, common.NewError("invalid ech public name " + publicName)
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 1)
+	common.Must2(rand.Read(id))
+	configList := appendUint16Prefixed(nil, marshalECHConfig(id[0], key.PublicKey().Bytes(), publicName))
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return append(data, pem.EncodeToMemory(&pem.Block{Type: echPEMConfigType, Bytes: configList})...), nil
+}
+
+// loadECHKeys loads the private key and the ECHConfigList from the PEM file
+func loadECHKeys(path string) (*echKeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, common.NewError("failed to read ech key file").Base(err)
+	}
+	return parseECHKeys(data)
+}
+
+func parseECHKeys(data []byte) (*echKeySet, error) {
+	var key *ecdh.PrivateKey
+	var configList []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, common.NewError("failed to parse ech private key").Base(err)
+			}
+			var ok bool
+			if key, ok = k.(*ecdh.PrivateKey); !ok || key.Curve() != ecdh.X25519() {
+				return nil, common.NewError("ech private key must be X25519")
+			}
+		case echPEMConfigType:
+			configList = block.Bytes
+		}
+	}
+	if key == nil || configList == nil {
+		return nil, common.NewError("ech key file must contain a PRIVATE KEY and an " + echPEMConfigType)
+	}
+	configs, err := splitECHConfigList(configList)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]tls.EncryptedClientHelloKey, 0, len(configs))
+	for _, config := range configs {
+		keys = append(keys, tls.EncryptedClientHelloKey{
+			Config:      config,
+			PrivateKey:  key.Bytes(),
+			SendAsRetry: true, // 拒绝过期配置时将当前的配置发给客户端
+		})
+	}
+	return &echKeySet{
+		keys:       keys,
+		configList: configList,
+	}, nil
+}
+
+// applyClientECH decodes the base64 ECHConfigList and enables ECH in the client config
+func applyClientECH(cfg *tls.Config, echConfig string) error {
+	list, err := base64.StdEncoding.DecodeString(echConfig)
+	if err != nil {
+		return common.NewError("invalid ech config").Base(err)
+	}
+	if _, err := splitECHConfigList(list); err != nil {
+		return err
+	}
+	cfg.EncryptedClientHelloConfigList = list
+	cfg.MinVersion = tls.VersionTLS13
+	return nil
+}
+
+// echRetryConfigs returns the ECHConfigList suggested by the server in base64 if ECH is rejected
+func echRetryConfigs(err error) string {
+	var rejection *tls.ECHRejectionError
+	if errors.As(err, &rejection) {
+		return base64.StdEncoding.EncodeToString(rejection.RetryConfigList)
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+//go:build !go1.24
+// +build !go1.24
+
+package tls
+
+import (
+	"crypto/tls"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+var errECHUnsupported = common.NewError("ech requires trojan-go built with go1.24 or later")
+
+type echKeySet struct{}
+
+func (e *echKeySet) apply(*tls.Config) {}
+
+func (e *echKeySet) ConfigList() string {
+	return ""
+}
+
+func GenerateECHKey(string) ([]byte, error) {
+	return nil, errECHUnsupported
+}
+
+func loadECHKeys(string) (*echKeySet, error) {
+	return nil, errECHUnsupported
+}
+
+func parseECHKeys([]byte) (*echKeySet, error) {
+	return nil, errECHUnsupported
+}
+
+func applyClientECH(*tls.Config, string) error {
+	return errECHUnsupported
+}
+
+func echRetryConfigs(error) string {
+	return ""
+}
@@ -0,0 +1,75 @@
+//go:build go1.24
+// +build go1.24
+
+package tls
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"testing"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
+	"github.com/p4gefau1t/trojan-go/tunnel/transport"
+)
+
+func TestECH(t *testing.T) {
+	os.WriteFile("server-ecc.crt", []byte(eccCert), 0o777)
+	os.WriteFile("server-ecc.key", []byte(eccKey), 0o777)
+	data, err := GenerateECHKey("public.example.com")
+	common.Must(err)
+	common.Must(os.WriteFile("server-ech.pem", data, 0o600))
+	defer os.Remove("server-ech.pem")
+	keys, err := loadECHKeys("server-ech.pem")
+	common.Must(err)
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+	})
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	sctx := config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			KeyPath:    "server-ecc.key",
+			CertPath:   "server-ecc.crt",
+			ECHKeyPath: "server-ech.pem",
+		},
+	})
+	cctx := config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			SNI:       "localhost",
+			ECHConfig: keys.ConfigList(),
+		},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	tcpClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(sctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+	c, err := NewClient(cctx, tcpClient)
+	common.Must(err)
+	defer c.Close()
+
+	conn, err := c.DialConn(nil, nil)
+	common.Must(err)
+	defer conn.Close()
+	if !conn.(*transport.Conn).Conn.(*tls.Conn).ConnectionState().ECHAccepted {
+		t.Fatal("ech is not accepted")
+	}
+
+	if _, err := NewClient(config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			ECHConfig:   keys.ConfigList(),
+			Fingerprint: "chrome",
+		},
+	}), tcpClient); err == nil {
+		t.Fatal("ech with fingerprint should be rejected")
+	}
+}
@@ -3,6 +3,7 @@ package fingerprint
 import (
 	"crypto/tls"
 
+	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/log"
 )
 
@@ -23,3 +24,36 @@ func ParseCipher(s []string) []uint16 {
 	}
 	return result
 }
+
+// ParseVersion parses the tls version such as "1.2" and "1.3", the default version 0 is returned for empty string
+func ParseVersion(s string) (uint16, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, common.NewError("invalid tls version " + s)
+}
+
+// ParseVersionRange parses the minimum and maximum tls versions and checks whether the range is valid
+func ParseVersionRange(min string, max string) (uint16, uint16, error) {
+	minVersion, err := ParseVersion(min)
+	if err != nil {
+		return 0, 0, err
+	}
+	maxVersion, err := ParseVersion(max)
+	if err != nil {
+		return 0, 0, err
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		return 0, 0, common.NewError("tls min_version " + min + " is greater than max_version " + max)
+	}
+	return minVersion, maxVersion, nil
+}
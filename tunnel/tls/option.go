@@ -0,0 +1,76 @@
+package tls
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/option"
+)
+
+// 生成 ECH 密钥的选项
+type echOption struct {
+	publicName *string
+}
+
+func (*echOption) Name() string {
+	return "ech"
+}
+
+func (*echOption) Priority() int {
+	return 10
+}
+
+// Handle prints the ech_key file of the server and the ech_config of the clients
+func (o *echOption) Handle() error {
+	if *o.publicName == "" {
+		return common.NewError("not set")
+	}
+	data, err := GenerateECHKey(*o.publicName)
+	if err != nil {
+		return err
+	}
+	keys, err := parseECHKeys(data)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(data))
+	fmt.Println("ech_config:", keys.ConfigList())
+	return nil
+}
+
+// 生成 reality 密钥的选项
+type realityOption struct {
+	gen *bool
+}
+
+func (*realityOption) Name() string {
+	return "reality"
+}
+
+func (*realityOption) Priority() int {
+	return 10
+}
+
+// Handle prints the private_key of the server and the public_key of the clients
+func (o *realityOption) Handle() error {
+	if !*o.gen {
+		return common.NewError("not set")
+	}
+	privateKey, publicKey, err := GenerateRealityKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println("private_key:", privateKey)
+	fmt.Println("public_key:", publicKey)
+	return nil
+}
+
+func init() {
+	option.RegisterHandler(&echOption{
+		publicName: flag.String("ech-gen", "", "Generate an ECH key with the public name, for the ech_key of the server"),
+	})
+	option.RegisterHandler(&realityOption{
+		gen: flag.Bool("reality-gen", false, "Generate an x25519 key pair for reality"),
+	})
+}
@@ -0,0 +1,35 @@
+package parity
+
+import (
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// Config 启动时探测回落网站的行为，使服务端的 ALPN、TLS 版本、会话票据和 HTTP 头部与之一致
+type Config struct {
+	Enabled bool   `json:"enabled" yaml:"enabled"`
+	Host    string `json:"addr" yaml:"addr"` // 为空时使用 fallback_addr
+	Port    int    `json:"port" yaml:"port"` // 为 0 时使用 fallback_port
+	SNI     string `json:"sni" yaml:"sni"`   // 为空时使用 sni
+}
+
+// Target returns the address and the server name of the website, the fallback address and the sni are used by default
+func (c *Config) Target(fallbackHost string, fallbackPort int, sni string) (string, string, error) {
+	host, port := c.Host, c.Port
+	if host == "" {
+		host = fallbackHost
+	}
+	if port == 0 {
+		port = fallbackPort
+	}
+	if host == "" || port == 0 {
+		return "", "", common.NewError("parity address is unspecified")
+	}
+	if c.SNI != "" {
+		sni = c.SNI
+	}
+	if sni == "" {
+		sni = host
+	}
+	return tunnel.NewAddressFromHostPort("tcp", host, port).String(), sni, nil
+}
@@ -0,0 +1,146 @@
+// Package parity measures the tls and http behavior of the fallback website,
+// so that the server can align its own behavior with the website it claims to be
+package parity
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// Timeout of each connection to the website
+var Timeout = time.Second * 10
+
+// candidateALPN are the protocols tested
+var candidateALPN = []string{"h2", "http/1.1"}
+
+// copiedHeaders are the static headers of the website copied to the responses of the server
+var copiedHeaders = []string{"Server", "Strict-Transport-Security", "Alt-Svc", "X-Powered-By", "Via"}
+
+// Profile is the behavior of the website
+type Profile struct {
+	ALPN          []string    // 支持的应用层协议，按服务端偏好排序，为空表示不协商
+	MaxVersion    uint16      // 协商的最高 TLS 版本
+	SessionTicket bool        // 是否签发会话票据
+	Header        http.Header // 从网站的响应中复制的头部
+}
+
+var (
+	lock     sync.Mutex
+	profiles = make(map[string]*Profile) // 同一个网站只探测一次，由 tls 和 websocket 共用
+)
+
+// ticketRecorder records whether the website issues session tickets
+type ticketRecorder struct {
+	issued bool
+}
+
+func (r *ticketRecorder) Get(string) (*tls.ClientSessionState, bool) {
+	return nil, false
+}
+
+func (r *ticketRecorder) Put(_ string, session *tls.ClientSessionState) {
+	if session != nil {
+		r.issued = true
+	}
+}
+
+func dial(addr string, sni string, alpn []string, cache tls.ClientSessionCache) (*tls.Conn, error) {
+	dialer := &net.Dialer{Timeout: Timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+		ServerName:         sni,
+		NextProtos:         alpn,
+		InsecureSkipVerify: true, // 只测量网站的行为
+		ClientSessionCache: cache,
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(Timeout))
+	return conn, nil
+}
+
+func probe(addr string, sni string) (*Profile, error) {
+	p := &Profile{
+		Header: make(http.Header),
+	}
+
+	// 同时提供所有协议，网站选择的即为其最偏好的协议
+	conn, err := dial(addr, sni, candidateALPN, nil)
+	if err != nil {
+		return nil, common.NewError("failed to handshake with " + addr).Base(err)
+	}
+	state := conn.ConnectionState()
+	conn.Close()
+	p.MaxVersion = state.Version
+	if state.NegotiatedProtocol != "" {
+		p.ALPN = append(p.ALPN, state.NegotiatedProtocol)
+	}
+	for _, proto := range candidateALPN {
+		if proto == state.NegotiatedProtocol {
+			continue
+		}
+		conn, err := dial(addr, sni, []string{proto}, nil)
+		if err != nil {
+			continue // 不支持该协议时握手可能失败
+		}
+		if conn.ConnectionState().NegotiatedProtocol == proto {
+			p.ALPN = append(p.ALPN, proto)
+		}
+		conn.Close()
+	}
+
+	// 请求首页，获取响应头部以及是否签发了会话票据
+	recorder := &ticketRecorder{}
+	conn, err = dial(addr, sni, []string{"http/1.1"}, recorder)
+	if err != nil {
+		return nil, common.NewError("failed to handshake with " + addr).Base(err)
+	}
+	defer conn.Close()
+	req, err := http.NewRequest(http.MethodGet, "https://"+sni+"/", nil)
+	if err != nil {
+		return nil, common.NewError("invalid sni " + sni).Base(err)
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return nil, common.NewError("failed to send request to " + addr).Base(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, common.NewError("failed to read response from " + addr).Base(err)
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1024*1024))
+	resp.Body.Close()
+	p.SessionTicket = recorder.issued
+	for _, name := range copiedHeaders {
+		if values := resp.Header.Values(name); len(values) != 0 {
+			p.Header[name] = values
+		}
+	}
+	return p, nil
+}
+
+// Probe returns the behavior of the website at addr with the server name, the result is cached
+func Probe(addr string, sni string) (*Profile, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	key := addr + "/" + sni
+	if p, found := profiles[key]; found {
+		return p, nil
+	}
+	p, err := probe(addr, sni)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("fallback website", addr, "alpn:", p.ALPN, "tls version:", p.MaxVersion, "session ticket:", p.SessionTicket)
+	profiles[key] = p
+	return p, nil
+}
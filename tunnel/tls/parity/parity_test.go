@@ -0,0 +1,98 @@
+package parity
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// website runs a https server with the tls config, the responses have the server header
+func website(t *testing.T, tlsConfig *tls.Config) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	common.Must(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	common.Must(err)
+	tlsConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	common.Must(err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				resp := &http.Response{
+					StatusCode:    http.StatusOK,
+					ProtoMajor:    1,
+					ProtoMinor:    1,
+					Header:        http.Header{"Server": {"nginx"}, "Set-Cookie": {"id=1"}},
+					ContentLength: 0,
+				}
+				resp.Write(conn)
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestProbe(t *testing.T) {
+	addr := website(t, &tls.Config{
+		NextProtos:             []string{"h2", "http/1.1"},
+		MaxVersion:             tls.VersionTLS13,
+		SessionTicketsDisabled: false,
+	})
+	p, err := Probe(addr, "example.com")
+	common.Must(err)
+	if !reflect.DeepEqual(p.ALPN, []string{"h2", "http/1.1"}) || p.MaxVersion != tls.VersionTLS13 || !p.SessionTicket {
+		t.Fatal("wrong profile", p.ALPN, p.MaxVersion, p.SessionTicket)
+	}
+	if p.Header.Get("Server") != "nginx" || p.Header.Get("Set-Cookie") != "" {
+		t.Fatal("wrong header", p.Header)
+	}
+	if cached, _ := Probe(addr, "example.com"); cached != p {
+		t.Fatal("profile is not cached")
+	}
+
+	addr = website(t, &tls.Config{
+		NextProtos:             []string{"http/1.1"},
+		MaxVersion:             tls.VersionTLS12,
+		SessionTicketsDisabled: true,
+	})
+	p, err = Probe(addr, "example.com")
+	common.Must(err)
+	if !reflect.DeepEqual(p.ALPN, []string{"http/1.1"}) || p.MaxVersion != tls.VersionTLS12 || p.SessionTicket {
+		t.Fatal("wrong profile", p.ALPN, p.MaxVersion, p.SessionTicket)
+	}
+
+	if _, _, err := (&Config{}).Target("", 0, ""); err == nil {
+		t.Fatal("empty address accepted")
+	}
+	target, sni, err := (&Config{Port: 8443}).Target("127.0.0.1", 443, "")
+	common.Must(err)
+	if target != "127.0.0.1:8443" || sni != "127.0.0.1" {
+		t.Fatal("wrong target", target, sni)
+	}
+}
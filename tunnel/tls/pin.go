@@ -0,0 +1,83 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+const spkiPinPrefix = "sha256/"
+
+// certPins are the sha256 fingerprints of the certificates or the public keys (spki) of the server
+type certPins struct {
+	certs [][]byte
+	spkis [][]byte
+}
+
+// parseCertPins parses the pins, "sha256/<base64>" is a spki pin and the hex string (colons are allowed) is a certificate fingerprint
+func parseCertPins(pins []string) (*certPins, error) {
+	p := &certPins{}
+	for _, pin := range pins {
+		if strings.HasPrefix(pin, spkiPinPrefix) {
+			digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, spkiPinPrefix))
+			if err != nil || len(digest) != sha256.Size {
+				return nil, common.NewError("invalid spki pin " + pin)
+			}
+			p.spkis = append(p.spkis, digest)
+			continue
+		}
+		digest, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(digest) != sha256.Size {
+			return nil, common.NewError("invalid certificate pin " + pin)
+		}
+		p.certs = append(p.certs, digest)
+	}
+	return p, nil
+}
+
+func (p *certPins) match(cert *x509.Certificate) bool {
+	certDigest := sha256.Sum256(cert.Raw)
+	for _, d := range p.certs {
+		if bytes.Equal(d, certDigest[:]) {
+			return true
+		}
+	}
+	spkiDigest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, d := range p.spkis {
+		if bytes.Equal(d, spkiDigest[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify is used as the VerifyPeerCertificate. Any certificate in the verified chains can be pinned,
+// only the leaf certificate is checked when the chain is not verified, since the other certificates sent by the server prove nothing
+func (p *certPins) verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return common.NewError("no certificate from the server")
+	}
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if p.match(cert) {
+				return nil
+			}
+		}
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return common.NewError("failed to parse the server certificate").Base(err)
+	}
+	if p.match(leaf) {
+		return nil
+	}
+	certDigest := sha256.Sum256(leaf.Raw)
+	spkiDigest := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	return common.NewError("server certificate does not match the pins, certificate: " + hex.EncodeToString(certDigest[:]) +
+		", spki: " + spkiPinPrefix + base64.StdEncoding.EncodeToString(spkiDigest[:]))
+}
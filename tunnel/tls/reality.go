@@ -0,0 +1,406 @@
+package tls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// reality 模式下服务端不持有 SNI 对应的证书：
+// 未通过认证的客户端被原样转发到目标网站，由真实的网站完成握手；
+// 通过认证的客户端与服务端完成 TLS 1.3 握手，临时证书中带有由共享密钥计算的 HMAC，客户端以此校验服务端。
+// 认证信息加密后放在 Client Hello 的 session id 中，密钥由客户端的 X25519 key share 与服务端的私钥协商得到
+
+const (
+	realityVersion        = 1
+	maxClientHelloSize    = 64 * 1024
+	sessionIDOffset       = 4 + 2 + 32 + 1 // 握手消息头，版本，随机数和 session id 的长度
+	realitySessionIDSize  = 32
+	realityShortIDSize    = 8
+	realityKeyShareX25519 = 0x001d
+)
+
+// 临时证书中保存 HMAC 的扩展
+var realityCertExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 54392, 5, 1}
+
+// clientHello holds the fields of the client hello used by reality
+type clientHello struct {
+	raw        []byte
+	random     []byte
+	sessionID  []byte
+	serverName string
+	keyShare   []byte // X25519 的公钥
+}
+
+// readClientHello reads the client hello handshake message, which may span multiple records
+func readClientHello(r io.Reader) ([]byte, error) {
+	var msg []byte
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		if header[0] != 22 { // handshake
+			return nil, common.NewError("not a tls handshake record")
+		}
+		record := make([]byte, binary.BigEndian.Uint16(header[3:]))
+		if _, err := io.ReadFull(r, record); err != nil {
+			return nil, err
+		}
+		msg = append(msg, record...)
+		if len(msg) < 4 {
+			continue
+		}
+		length := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+		if length > maxClientHelloSize {
+			return nil, common.NewError("client hello is too large")
+		}
+		if len(msg) >= length {
+			return msg[:length], nil
+		}
+	}
+}
+
+func parseClientHello(raw []byte) (*clientHello, error) {
+	invalid := common.NewError("invalid client hello")
+	hello := &clientHello{
+		raw: raw,
+	}
+	s := cryptobyte.String(raw)
+	var msgType uint8
+	var version uint16
+	var body, sessionID, cipherSuites, compression, extensions cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != 1 ||
+		!s.ReadUint24LengthPrefixed(&body) ||
+		!body.ReadUint16(&version) ||
+		!body.ReadBytes(&hello.random, 32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compression) ||
+		!body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, invalid
+	}
+	hello.sessionID = sessionID
+	for !extensions.Empty() {
+		var extType uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, invalid
+		}
+		switch extType {
+		case 0: // server_name
+			var names cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&names) {
+				return nil, invalid
+			}
+			for !names.Empty() {
+				var nameType uint8
+				var name cryptobyte.String
+				if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+					return nil, invalid
+				}
+				if nameType == 0 {
+					hello.serverName = string(name)
+				}
+			}
+		case 51: // key_share
+			var shares cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&shares) {
+				return nil, invalid
+			}
+			for !shares.Empty() {
+				var group uint16
+				var key cryptobyte.String
+				if !shares.ReadUint16(&group) || !shares.ReadUint16LengthPrefixed(&key) {
+					return nil, invalid
+				}
+				if group == realityKeyShareX25519 && len(key) == curve25519.PointSize {
+					hello.keyShare = key
+				}
+			}
+		}
+	}
+	return hello, nil
+}
+
+// realityAEAD derives the key of the connection from the x25519 shared secret and the client random
+func realityAEAD(shared, random []byte) ([]byte, cipher.AEAD, error) {
+	authKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, random[:20], []byte("REALITY")), authKey); err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(authKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return authKey, aead, nil
+}
+
+// realityCertMAC binds the certificate key to the connection
+func realityCertMAC(authKey []byte, publicKeyInfo []byte) []byte {
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write(publicKeyInfo)
+	return mac.Sum(nil)
+}
+
+func parseShortID(s string) ([realityShortIDSize]byte, error) {
+	var shortID [realityShortIDSize]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) > realityShortIDSize {
+		return shortID, common.NewError("invalid reality short id " + s)
+	}
+	copy(shortID[:], b)
+	return shortID, nil
+}
+
+func parseRealityKey(s string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != curve25519.ScalarSize {
+		return nil, common.NewError("invalid reality key " + s)
+	}
+	return key, nil
+}
+
+// GenerateRealityKey generates the x25519 private key of the server and the public key for the clients
+func GenerateRealityKey() (privateKey string, publicKey string, err error) {
+	key := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", err
+	}
+	pub, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), base64.RawURLEncoding.EncodeToString(pub), nil
+}
+
+type realityServer struct {
+	privateKey  []byte
+	dest        *tunnel.Address
+	serverNames []string
+	shortIDs    map[[realityShortIDSize]byte]bool
+	maxTimeDiff time.Duration
+	certKey     *ecdsa.PrivateKey // 签发临时证书的密钥
+}
+
+func newRealityServer(cfg *RealityConfig) (*realityServer, error) {
+	if cfg.DestHost == "" || cfg.DestPort == 0 {
+		return nil, common.NewError("empty reality dest address")
+	}
+	if len(cfg.ServerNames) == 0 {
+		return nil, common.NewError("empty reality server names")
+	}
+	privateKey, err := parseRealityKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	shortIDs := make(map[[realityShortIDSize]byte]bool)
+	for _, s := range cfg.ShortIDs {
+		shortID, err := parseShortID(s)
+		if err != nil {
+			return nil, err
+		}
+		shortIDs[shortID] = true
+	}
+	if len(shortIDs) == 0 {
+		shortIDs[[realityShortIDSize]byte{}] = true
+	}
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &realityServer{
+		privateKey:  privateKey,
+		dest:        tunnel.NewAddressFromHostPort("tcp", cfg.DestHost, cfg.DestPort),
+		serverNames: cfg.ServerNames,
+		shortIDs:    shortIDs,
+		maxTimeDiff: time.Duration(cfg.MaxTimeDiff) * time.Second,
+		certKey:     certKey,
+	}, nil
+}
+
+// authenticate returns the key of the connection if the client hello is sent by a reality client
+func (r *realityServer) authenticate(hello *clientHello) ([]byte, error) {
+	matched := false
+	for _, name := range r.serverNames {
+		if isDomainNameMatched(name, hello.serverName) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil, common.NewError("unexpected server name " + hello.serverName)
+	}
+	if len(hello.sessionID) != realitySessionIDSize || hello.keyShare == nil {
+		return nil, common.NewError("not a reality client")
+	}
+	shared, err := curve25519.X25519(r.privateKey, hello.keyShare)
+	if err != nil {
+		return nil, err
+	}
+	authKey, aead, err := realityAEAD(shared, hello.random)
+	if err != nil {
+		return nil, err
+	}
+	aad := make([]byte, len(hello.raw))
+	copy(aad, hello.raw)
+	copy(aad[sessionIDOffset:sessionIDOffset+realitySessionIDSize], make([]byte, realitySessionIDSize))
+	plaintext, err := aead.Open(nil, hello.random[20:], hello.sessionID, aad)
+	if err != nil || plaintext[0] != realityVersion {
+		return nil, common.NewError("not a reality client")
+	}
+	var shortID [realityShortIDSize]byte
+	copy(shortID[:], plaintext[8:])
+	if !r.shortIDs[shortID] {
+		return nil, common.NewError("unknown short id " + hex.EncodeToString(shortID[:]))
+	}
+	if r.maxTimeDiff > 0 {
+		diff := time.Since(time.Unix(int64(binary.BigEndian.Uint32(plaintext[4:])), 0))
+		if diff > r.maxTimeDiff || diff < -r.maxTimeDiff {
+			return nil, common.NewError("reality client time differs by " + diff.String())
+		}
+	}
+	return authKey, nil
+}
+
+// certificate issues a temporary certificate for the authenticated connection
+func (r *realityServer) certificate(authKey []byte, serverName string) (*tls.Certificate, error) {
+	publicKeyInfo, err := x509.MarshalPKIXPublicKey(&r.certKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24),
+		ExtraExtensions: []pkix.Extension{{
+			Id:    realityCertExtension,
+			Value: realityCertMAC(authKey, publicKeyInfo),
+		}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &r.certKey.PublicKey, r.certKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  r.certKey,
+	}, nil
+}
+
+// handshake reads the client hello from the conn and issues the certificate for the reality client
+func (r *realityServer) handshake(conn io.Reader) (*tls.Certificate, error) {
+	raw, err := readClientHello(conn)
+	if err != nil {
+		return nil, err
+	}
+	hello, err := parseClientHello(raw)
+	if err != nil {
+		return nil, err
+	}
+	authKey, err := r.authenticate(hello)
+	if err != nil {
+		return nil, err
+	}
+	return r.certificate(authKey, hello.serverName)
+}
+
+type realityClient struct {
+	publicKey []byte
+	shortID   [realityShortIDSize]byte
+}
+
+func newRealityClient(cfg *RealityConfig) (*realityClient, error) {
+	publicKey, err := parseRealityKey(cfg.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	shortID, err := parseShortID(cfg.ShortID)
+	if err != nil {
+		return nil, err
+	}
+	return &realityClient{
+		publicKey: publicKey,
+		shortID:   shortID,
+	}, nil
+}
+
+// seal puts the encrypted short id into the session id of the built client hello, and returns the key of the connection
+func (r *realityClient) seal(uconn *utls.UConn) ([]byte, error) {
+	hello := uconn.HandshakeState.Hello
+	params := uconn.HandshakeState.State13.EcdheParams
+	if params == nil || params.CurveID() != utls.X25519 {
+		return nil, common.NewError("reality requires a x25519 key share in the client hello")
+	}
+	shared := params.SharedKey(r.publicKey)
+	if shared == nil {
+		return nil, common.NewError("invalid reality public key")
+	}
+	authKey, aead, err := realityAEAD(shared, hello.Random)
+	if err != nil {
+		return nil, err
+	}
+	hello.SessionId = make([]byte, realitySessionIDSize)
+	if err := uconn.MarshalClientHello(); err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, 16)
+	plaintext[0] = realityVersion
+	binary.BigEndian.PutUint32(plaintext[4:], uint32(time.Now().Unix()))
+	copy(plaintext[8:], r.shortID[:])
+	hello.SessionId = aead.Seal(nil, hello.Random[20:], plaintext, hello.Raw)
+	if err := uconn.MarshalClientHello(); err != nil {
+		return nil, err
+	}
+	return authKey, nil
+}
+
+// verifyRealityCertificate checks the certificate is issued by the server for this connection,
+// the certificate of the real website is rejected
+func verifyRealityCertificate(authKey []byte, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return common.NewError("no reality certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(realityCertExtension) && hmac.Equal(ext.Value, realityCertMAC(authKey, cert.RawSubjectPublicKeyInfo)) {
+			return nil
+		}
+	}
+	return common.NewError("reality certificate verification failed, the server may not be a reality server")
+}
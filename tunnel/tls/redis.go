@@ -0,0 +1,93 @@
+package tls
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+const redisTimeout = time.Second * 5
+
+// redisClient is a minimal RESP client, each command is sent over a new connection
+type redisClient struct {
+	addr     string
+	password string
+	database int
+}
+
+func writeCommand(w io.Writer, args ...string) error {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readReply returns the reply of simple string, integer and bulk string, nil reply returns a nil slice
+func readReply(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, common.NewError("invalid redis reply " + line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, common.NewError("redis error: " + line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, common.NewError("invalid redis bulk length").Base(err)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:length], nil
+	default:
+		return nil, common.NewError("unsupported redis reply " + line)
+	}
+}
+
+// do runs the command after AUTH and SELECT
+func (c *redisClient) do(args ...string) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return nil, common.NewError("failed to connect to redis " + c.addr).Base(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	r := bufio.NewReader(conn)
+	var commands [][]string
+	if c.password != "" {
+		commands = append(commands, []string{"AUTH", c.password})
+	}
+	if c.database != 0 {
+		commands = append(commands, []string{"SELECT", strconv.Itoa(c.database)})
+	}
+	commands = append(commands, args)
+	var reply []byte
+	for _, command := range commands {
+		if err := writeCommand(conn, command...); err != nil {
+			return nil, common.NewError("failed to send redis command").Base(err)
+		}
+		reply, err = readReply(r)
+		if err != nil {
+			return nil, common.NewError("redis " + command[0] + " failed").Base(err)
+		}
+	}
+	return reply, nil
+}
@@ -18,26 +18,49 @@ import (
 	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/backoff"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
 	"github.com/p4gefau1t/trojan-go/redirector"
 	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/tls/acme"
 	"github.com/p4gefau1t/trojan-go/tunnel/tls/fingerprint"
+	"github.com/p4gefau1t/trojan-go/tunnel/tls/parity"
 	"github.com/p4gefau1t/trojan-go/tunnel/transport"
 	"github.com/p4gefau1t/trojan-go/tunnel/websocket"
 )
 
+// SNI 校验失败时的处理方式
+const (
+	sniMismatchReject   = "reject"   // 拒绝握手
+	sniMismatchDefault  = "default"  // 使用默认证书完成握手
+	sniMismatchFallback = "fallback" // 完成握手后将解密的连接转发到 remote_addr
+)
+
+// 连接在通道已满时等待的时间
+var (
+	connQueueWait = metrics.QueueWait("tls")
+	wsQueueWait   = metrics.QueueWait("tls_websocket")
+)
+
 // Server is a tls server
 type Server struct {
 	fallbackAddress    *tunnel.Address // 指服务端TLS握手失败时，trojan-go将该连接重定向到该地址
+	sniFallbacks       []sniFallback   // 按 SNI 选择的回落地址，优先于 fallbackAddress
 	verifySNI          bool            // 表示客户端(client/nat/forward)是否校验服务端提供的证书合法性
 	sni                string          // 指的是TLS客户端请求中的服务器名字段，一般和证书的Common Name相同
+	sniList            []string        // 额外接受的服务器名，支持通配符
+	sniAllowlist       *sniAllowlist   // 从文件加载的服务器名列表，为空时不限制
 	alpn               []string        // 为TLS的应用层协议协商指定协议
 	PreferServerCipher bool            // 客户端是否偏好选择服务端在协商中提供的密码学套件
 	keyPair            []tls.Certificate
-	keyPairLock        sync.RWMutex // 操作证书对的读写锁
-	httpResp           []byte       // 指服务端TLS握手失败时，明文发送的原始数据（原始TCP数据）
-	cipherSuite        []uint16     // TLS使用的密码学套件
+	keyPairFiles       []CertificateConfig // 与 keyPair 对应的文件，acme 管理的证书为空
+	keyPairLock        sync.RWMutex        // 操作证书对的读写锁
+	httpResp           []byte              // 指服务端TLS握手失败时，明文发送的原始数据（原始TCP数据）
+	cipherSuite        []uint16            // TLS使用的密码学套件
+	minVersion         uint16              // 接受的最低 TLS 版本，0 表示默认
+	maxVersion         uint16              // 接受的最高 TLS 版本，0 表示默认
 	sessionTicket      bool
 	curve              []tls.CurveID    // 指定TLS在ECDHE中偏好使用的椭圆曲线
 	keyLogger          io.WriteCloser   // TLS密钥日志的文件路径
@@ -49,6 +72,19 @@ type Server struct {
 	underlay           tunnel.Server // 底层服务
 	nextHTTP           int32         // 上一层协议是否支持 http
 	portOverrider      map[string]int
+	sniMismatch        string
+	defaultKeyPair     *tls.Certificate // SNI 校验失败时使用的证书
+	remoteAddress      *tunnel.Address
+	ticketKeys         [][32]byte    // 会话票据密钥，所有连接共用以支持会话恢复
+	ticketKeysLock     sync.RWMutex  // 操作会话票据密钥的读写锁
+	ticketRotation     time.Duration // 会话票据密钥的轮换间隔，0 表示不轮换
+	ticketKeysKeep     int           // 轮换后保留的密钥数量
+	ech                *echKeySet    // 加密 Client Hello 的密钥
+	clientCA           *x509.CertPool
+	reality            *realityServer         // reality 模式，未认证的连接转发到目标网站
+	normalizer         *redirector.Normalizer // 为空时不延迟回落
+	recorder           *redirector.Recorder   // 为空时不记录被拒绝的连接
+	replay             *redirector.ReplayFilter
 }
 
 func (s *Server) Close() error {
@@ -60,94 +96,348 @@ func (s *Server) Close() error {
 }
 
 func isDomainNameMatched(pattern string, domainName string) bool {
-	if strings.HasPrefix(pattern, "*.") {
-		suffix := pattern[2:]
-		domainPrefixLen := len(domainName) - len(suffix) - 1
-		return strings.HasSuffix(domainName, suffix) && domainPrefixLen > 0 && !strings.Contains(domainName[:domainPrefixLen], ".")
+	return common.IsDomainNameMatched(pattern, domainName)
+}
+
+type sniFallback struct {
+	name    string
+	address *tunnel.Address
+}
+
+// sniFallback returns the fallback address configured for the server name, exact names take precedence over wildcards
+func (s *Server) sniFallback(serverName string) *tunnel.Address {
+	var wildcard *tunnel.Address
+	for _, f := range s.sniFallbacks {
+		if !isDomainNameMatched(f.name, serverName) {
+			continue
+		}
+		if !strings.HasPrefix(f.name, "*.") {
+			return f.address
+		}
+		if wildcard == nil {
+			wildcard = f.address
+		}
+	}
+	return wildcard
+}
+
+// fallbackConn drops the tls alert after the connection is decided to be redirected to the sni fallback,
+// so that the client only sees the handshake of the real website
+type fallbackConn struct {
+	*common.RewindConn
+	fallbackTo *tunnel.Address // 未匹配的 SNI 配置了回落地址时，将原始连接转发到该地址
+	dropAlert  bool            // 丢弃发送任何数据之前的警报，握手失败时按非 TLS 流量处理
+	written    bool
+}
+
+func (c *fallbackConn) Write(p []byte) (int, error) {
+	if c.fallbackTo != nil {
+		return 0, io.ErrClosedPipe
+	}
+	if c.dropAlert && !c.written && len(p) > 0 && p[0] == 21 { // alert
+		return 0, io.ErrClosedPipe
+	}
+	c.written = true
+	return c.RewindConn.Write(p)
+}
+
+// rejectPlain handles the connections which are rejected before anything is sent to the client,
+// the non-tls traffic and the malformed client hello are treated in the same way
+func (s *Server) rejectPlain(conn *common.RewindConn, accepted time.Time, reason error) {
+	s.recorder.Record("tls", conn.RemoteAddr(), conn.Buffered(), reason)
+	conn.Rewind() // 重置缓冲区索引
+	s.normalizer.Delay(accepted)
+	switch {
+	case s.fallbackAddress != nil:
+		// 重定向
+		s.redir.Redirect(&redirector.Redirection{
+			InboundConn: conn,
+			RedirectTo:  s.fallbackAddress,
+		})
+	case s.httpResp != nil:
+		conn.Write(s.httpResp) // 使用默认响应文件内容
+		conn.Close()
+	default:
+		conn.Close()
+	}
+}
+
+// clientRandom returns the random of the client hello at the beginning of the handshake bytes, or nil if it is not found
+func clientRandom(b []byte) []byte {
+	// 记录头 5 字节，握手类型 1 字节，长度 3 字节，版本 2 字节，随后是 32 字节的随机数
+	if len(b) < 43 || b[0] != 22 || b[5] != 1 {
+		return nil
+	}
+	return b[11:43]
+}
+
+// fallbackFor returns the fallback address of the server name, the default one is returned if none matches
+func (s *Server) fallbackFor(serverName string) *tunnel.Address {
+	if address := s.sniFallback(serverName); address != nil {
+		return address
+	}
+	return s.fallbackAddress
+}
+
+// selectKeyPair returns the certificate whose names match the server name, exact names take precedence over wildcards.
+// The default certificate is returned if none matches
+func selectKeyPair(keyPairs []tls.Certificate, serverName string) (*tls.Certificate, bool) {
+	var wildcard *tls.Certificate
+	for i := range keyPairs {
+		names := append([]string{keyPairs[i].Leaf.Subject.CommonName}, keyPairs[i].Leaf.DNSNames...)
+		for _, name := range names {
+			if !isDomainNameMatched(name, serverName) {
+				continue
+			}
+			if !strings.HasPrefix(name, "*.") {
+				return &keyPairs[i], true
+			}
+			if wildcard == nil {
+				wildcard = &keyPairs[i]
+			}
+		}
+	}
+	if wildcard != nil {
+		return wildcard, true
+	}
+	return &keyPairs[0], false
+}
+
+// verifyClientCert verifies the certificate of the client against the client ca
+func (s *Server) verifyClientCert(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return common.NewError("no client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         s.clientCA,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// setKeyPair replaces the certificate at the index, the slice is copied since it may be in use by the handshakes
+func (s *Server) setKeyPair(index int, keyPair *tls.Certificate) {
+	s.keyPairLock.Lock()
+	defer s.keyPairLock.Unlock()
+	keyPairs := make([]tls.Certificate, len(s.keyPair))
+	copy(keyPairs, s.keyPair)
+	keyPairs[index] = *keyPair
+	s.keyPair = keyPairs
+}
+
+// reloadKeyPairs reloads all key pairs from the files, the current key pairs are kept if any of them fails
+func (s *Server) reloadKeyPairs() error {
+	keyPairs := make(map[int]*tls.Certificate)
+	for i, files := range s.keyPairFiles {
+		if files.CertPath == "" {
+			continue
+		}
+		keyPair, err := loadKeyPair(files.KeyPath, files.CertPath, files.KeyPassword)
+		if err != nil {
+			return common.NewError("tls failed to reload key pair " + files.CertPath).Base(err)
+		}
+		keyPairs[i] = keyPair
+	}
+	for i, keyPair := range keyPairs {
+		s.setKeyPair(i, keyPair)
 	}
-	return pattern == domainName
+	log.Info("tls reloaded", len(keyPairs), "key pairs")
+	return nil
 }
 
 func (s *Server) acceptLoop() {
+	b := backoff.NewAcceptBackoff("tls")
 	for {
 		conn, err := s.underlay.AcceptConn(&Tunnel{}) // 返回下一层协议的连接
 		if err != nil {
-			select {
-			case <-s.ctx.Done():
-			default:
-				log.Fatal(common.NewError("transport accept error" + err.Error()))
+			if !b.Wait(s.ctx, err) { // 关闭时结束循环，其他错误等待后继续
+				return
 			}
-			return // 出错结束循环
+			continue
 		}
+		b.Reset()
 		go func(conn net.Conn) {
+			accepted := tunnel.AcceptTimeOf(conn)
+			if accepted.IsZero() {
+				accepted = time.Now()
+			}
+			sniMismatched := false
+			var handshakeConn *fallbackConn
+			var realityKeyPair *tls.Certificate
 			tlsConfig := &tls.Config{
 				CipherSuites:             s.cipherSuite,
+				MinVersion:               s.minVersion,
+				MaxVersion:               s.maxVersion,
 				PreferServerCipherSuites: s.PreferServerCipher,
 				SessionTicketsDisabled:   !s.sessionTicket,
 				NextProtos:               s.alpn,
 				KeyLogWriter:             s.keyLogger,
 				GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+					// 重放的 Client Hello 来自探测者，在发送 Server Hello 之前交给回落地址上的真实网站
+					if s.replay.Check(clientRandom(handshakeConn.Buffered()), time.Now()) {
+						address := s.fallbackFor(hello.ServerName)
+						if s.reality != nil {
+							address = s.reality.dest
+						}
+						if address != nil {
+							handshakeConn.fallbackTo = address
+						}
+						return nil, common.NewError("replayed client hello from " + conn.RemoteAddr().String())
+					}
+					if realityKeyPair != nil {
+						return realityKeyPair, nil
+					}
+					if !s.sniAllowlist.contains(hello.ServerName) {
+						// 不在列表中的 SNI 在握手前交给回落地址上的真实网站，不经过 trojan 协议的解析
+						if address := s.fallbackFor(hello.ServerName); address != nil {
+							handshakeConn.fallbackTo = address
+							return nil, common.NewError("sni " + hello.ServerName + " is not allowed, redirected to " + address.String())
+						}
+						return nil, common.NewError("sni " + hello.ServerName + " is not allowed")
+					}
 					s.keyPairLock.RLock()
 					defer s.keyPairLock.RUnlock()
-					// 是TLS客户端请求中的服务器名字段，一般和证书的Common Name相同
-					sni := s.keyPair[0].Leaf.Subject.CommonName
-					// 证书支持的所有 DNS 名称。这些名称通常用于验证 TLS 连接中主机的合法性
-					dnsNames := s.keyPair[0].Leaf.DNSNames
-					if s.sni != "" {
-						sni = s.sni
+					// 按证书的 Common Name 和 DNS 名称选择证书，没有匹配时使用默认证书
+					keyPair, matched := selectKeyPair(s.keyPair, hello.ServerName)
+					if s.sniAllowlist != nil {
+						matched = true
+					}
+					if s.sni != "" && isDomainNameMatched(s.sni, hello.ServerName) {
+						matched = true
 					}
-					matched := isDomainNameMatched(sni, hello.ServerName)
-					for _, name := range dnsNames {
+					for _, name := range s.sniList {
 						if isDomainNameMatched(name, hello.ServerName) {
 							matched = true
 							break
 						}
 					}
+					if !matched {
+						// 尚未发送 Server Hello，由回落地址上的真实网站完成握手
+						if address := s.sniFallback(hello.ServerName); address != nil {
+							handshakeConn.fallbackTo = address
+							return nil, common.NewError("sni " + hello.ServerName + " is redirected to " + address.String())
+						}
+					}
 					// 表示客户端(client/nat/forward)是否校验服务端提供的证书合法性
 					if s.verifySNI && !matched {
-						return nil, common.NewError("sni mismatched: " + hello.ServerName + ", expected: " + s.sni)
+						// a hard tls alert is itself a fingerprint, so it can be configured
+						switch s.sniMismatch {
+						case sniMismatchDefault:
+							log.Warn("sni mismatched: " + hello.ServerName + ", serving the default certificate")
+							if s.defaultKeyPair != nil {
+								return s.defaultKeyPair, nil
+							}
+						case sniMismatchFallback:
+							log.Warn("sni mismatched: " + hello.ServerName + ", redirecting after handshake")
+							sniMismatched = true
+						default:
+							return nil, common.NewError("sni mismatched: " + hello.ServerName + ", expected: " + s.sni)
+						}
 					}
-					return &s.keyPair[0], nil
+					return keyPair, nil
 				},
 			}
+			if s.clientCA != nil {
+				// 握手时不校验客户端证书，校验失败的连接在握手后重定向，避免返回 TLS 警报
+				tlsConfig.ClientAuth = tls.RequestClientCert
+			}
+			if s.sessionTicket {
+				tlsConfig.SetSessionTicketKeys(s.getTicketKeys())
+			}
+			s.ech.apply(tlsConfig)
 
 			// ------------------------ WAR ZONE ----------------------------
 
 			handshakeRewindConn := common.NewRewindConn(conn)
 			handshakeRewindConn.SetBufferSize(2048)
 
+			if s.reality != nil {
+				keyPair, err := s.reality.handshake(handshakeRewindConn)
+				handshakeRewindConn.Rewind()
+				if err != nil {
+					// 由真实的网站完成握手，客户端看到的是目标网站的证书
+					handshakeRewindConn.StopBuffering()
+					log.Debug(common.NewError("reality authentication failed for " + conn.RemoteAddr().String() + ", redirecting to " + s.reality.dest.String()).Base(err))
+					s.recorder.Record("reality", conn.RemoteAddr(), handshakeRewindConn.Buffered(), err)
+					s.normalizer.Delay(accepted)
+					s.redir.Redirect(&redirector.Redirection{
+						InboundConn: handshakeRewindConn,
+						RedirectTo:  s.reality.dest,
+					})
+					return
+				}
+				realityKeyPair = keyPair
+				tlsConfig.MinVersion = tls.VersionTLS13
+				tlsConfig.MaxVersion = tls.VersionTLS13
+			}
+
 			// 使用 tls.Server 函数将 handshakeRewindConn 包装为一个 TLS 连接，并传入 TLS 配置 tlsConfig。这个配置包含证书、私钥和其他 TLS 参数
-			tlsConn := tls.Server(handshakeRewindConn, tlsConfig)
+			handshakeConn = &fallbackConn{
+				RewindConn: handshakeRewindConn,
+				dropAlert:  s.normalizer != nil,
+			}
+			tlsConn := tls.Server(handshakeConn, tlsConfig)
 			// 调用 tlsConn.Handshake() 方法执行 TLS 握手过程。这是建立安全连接的重要步骤，在此过程中，双方会协商加密算法、生成会话密钥等
+			handshakeStart := time.Now()
 			err = tlsConn.Handshake()
 			handshakeRewindConn.StopBuffering()
 
 			if err != nil {
+				if handshakeConn.fallbackTo != nil {
+					handshakeRewindConn.Rewind()
+					log.Info("redirecting tls connection from", conn.RemoteAddr(), "to", handshakeConn.fallbackTo)
+					s.redir.Redirect(&redirector.Redirection{
+						InboundConn: handshakeRewindConn,
+						RedirectTo:  handshakeConn.fallbackTo,
+					})
+					return
+				}
 				if strings.Contains(err.Error(), "first record does not look like a TLS handshake") {
 					// not a valid tls client hello
-					handshakeRewindConn.Rewind() // 重置缓冲区索引
 					log.Error(common.NewError("failed to perform tls handshake with " + tlsConn.RemoteAddr().String() + ", redirecting").Base(err))
-					switch {
-					case s.fallbackAddress != nil:
-						// 重定向
-						s.redir.Redirect(&redirector.Redirection{
-							InboundConn: handshakeRewindConn,
-							RedirectTo:  s.fallbackAddress,
-						})
-					case s.httpResp != nil:
-						handshakeRewindConn.Write(s.httpResp) // 使用默认响应文件内容
-						handshakeRewindConn.Close()
-					default:
-						handshakeRewindConn.Close()
-					}
+					s.rejectPlain(handshakeRewindConn, accepted, err)
+				} else if handshakeConn.dropAlert && !handshakeConn.written {
+					// 客户端没有收到任何数据，与非 TLS 流量的表现一致
+					log.Error(common.NewError("tls handshake with " + tlsConn.RemoteAddr().String() + " failed before server hello, redirecting").Base(err))
+					s.rejectPlain(handshakeRewindConn, accepted, err)
 				} else {
 					// in other cases, simply close it
+					s.recorder.Record("tls", conn.RemoteAddr(), handshakeRewindConn.Buffered(), err)
+					s.normalizer.Delay(accepted)
 					tlsConn.Close()
 					log.Error(common.NewError("tls handshake failed").Base(err))
 				}
 				return
 			}
 
+			handshaked := time.Now()
+			metrics.TLSHandshake.Observe(handshaked.Sub(handshakeStart))
+			random := clientRandom(handshakeRewindConn.Buffered())
+
+			if sniMismatched {
+				s.redir.Redirect(&redirector.Redirection{
+					InboundConn: tlsConn,
+					RedirectTo:  s.remoteAddress,
+				})
+				return
+			}
+
+			if s.clientCA != nil {
+				if err := s.verifyClientCert(tlsConn.ConnectionState()); err != nil {
+					log.Warn(common.NewError("invalid client certificate from " + conn.RemoteAddr().String() + ", redirecting").Base(err))
+					s.redir.Redirect(&redirector.Redirection{
+						InboundConn: tlsConn,
+						RedirectTo:  s.remoteAddress,
+					})
+					return
+				}
+			}
+
 			log.Info("tls connection from", conn.RemoteAddr())
 			state := tlsConn.ConnectionState() // 返回有关连接的基本 TLS 详细信息
 			log.Trace("tls handshake", tls.CipherSuiteName(state.CipherSuite), state.DidResume, state.NegotiatedProtocol)
@@ -162,9 +452,15 @@ func (s *Server) acceptLoop() {
 			rewindConn.StopBuffering()
 			if err != nil {
 				// this is not a http request. pass it to trojan protocol layer for further inspection
+				start := time.Now()
 				s.connChan <- &transport.Conn{
-					Conn: rewindConn,
+					Conn:       rewindConn,
+					Accepted:   tunnel.AcceptTimeOf(conn),
+					Handshaked: handshaked,
+					Wire:       conn,
+					Random:     random,
 				}
+				connQueueWait.ObserveSince(start)
 			} else {
 				// 如果 tls 的上一层协议是 websocket 则会设置 nextHTTP = 1
 				if atomic.LoadInt32(&s.nextHTTP) != 1 {
@@ -172,15 +468,21 @@ func (s *Server) acceptLoop() {
 					log.Error("incoming http request, but no websocket server is listening")
 					s.redir.Redirect(&redirector.Redirection{
 						InboundConn: rewindConn,
-						RedirectTo:  s.fallbackAddress,
+						RedirectTo:  s.fallbackFor(state.ServerName),
 					})
 					return
 				}
 				// this is a http request, pass it to websocket protocol layer
 				log.Debug("http req: ", httpReq)
+				start := time.Now()
 				s.wsChan <- &transport.Conn{
-					Conn: rewindConn,
+					Conn:       rewindConn,
+					Accepted:   tunnel.AcceptTimeOf(conn),
+					Handshaked: handshaked,
+					Wire:       conn,
+					Random:     random,
 				}
+				wsQueueWait.ObserveSince(start)
 			}
 		}(conn)
 	}
@@ -214,44 +516,64 @@ func (s *Server) AcceptPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
 	panic("not supported")
 }
 
-// 是一个用于监测 TLS 证书和私钥文件是否有变化的循环。这个函数会定期读取指定的密钥和证书文件，并检查它们的内容是否发生变化。如果发生变化，则加载新的密钥对
-func (s *Server) checkKeyPairLoop(checkRate time.Duration, keyPath string, certPath string, password string) {
-	var lastKeyBytes, lastCertBytes []byte
-	// 轮询检查的时间间隔
-	ticker := time.NewTicker(checkRate)
+// certReloadDelay 文件变化后等待一段时间再重新加载，证书和密钥通常先后被替换
+const certReloadDelay = time.Millisecond * 500
 
-	for {
+// 监测 TLS 证书和私钥文件是否有变化的循环。优先使用文件系统通知，在文件变化后立即重新加载密钥对，不支持时定期轮询。
+// 文件的内容没有变化时不会重新加载
+func (s *Server) checkKeyPairLoop(index int, checkRate time.Duration, keyPath string, certPath string, password string) {
+	var lastKeyBytes, lastCertBytes []byte
+	check := func() {
 		log.Debug("checking cert...")
 		keyBytes, err := ioutil.ReadFile(keyPath)
 		if err != nil {
 			log.Error(common.NewError("tls failed to check key").Base(err))
-			continue
+			return
 		}
 		certBytes, err := ioutil.ReadFile(certPath)
 		if err != nil {
 			log.Error(common.NewError("tls failed to check cert").Base(err))
-			continue
+			return
 		}
 		if !bytes.Equal(keyBytes, lastKeyBytes) || !bytes.Equal(lastCertBytes, certBytes) {
 			log.Info("new key pair detected")
 			keyPair, err := loadKeyPair(keyPath, certPath, password)
 			if err != nil {
 				log.Error(common.NewError("tls failed to load new key pair").Base(err))
-				continue
+				return
 			}
-			s.keyPairLock.Lock()
-			s.keyPair = []tls.Certificate{*keyPair}
-			s.keyPairLock.Unlock()
+			s.setKeyPair(index, keyPair)
 			lastKeyBytes = keyBytes
 			lastCertBytes = certBytes
 		}
+	}
+	check()
+
+	var events <-chan struct{}
+	var poll <-chan time.Time
+	if watcher, err := newFileWatcher(keyPath, certPath); err != nil {
+		log.Warn(common.NewError("tls cert watcher is unavailable, checking every " + checkRate.String()).Base(err))
+		ticker := time.NewTicker(checkRate)
+		defer ticker.Stop()
+		poll = ticker.C
+	} else {
+		defer watcher.Close()
+		events = watcher.Events()
+	}
+	delay := time.NewTimer(certReloadDelay)
+	delay.Stop()
+	defer delay.Stop()
 
+	for {
 		select {
-		case <-ticker.C: // 阻塞
-			continue
+		case <-events: // 合并短时间内的多次变化
+			delay.Reset(certReloadDelay)
+		case <-delay.C:
+			check()
+		case <-poll:
+			check()
 		case <-s.ctx.Done():
 			log.Debug("exiting")
-			ticker.Stop()
 			return
 		}
 	}
@@ -314,12 +636,6 @@ func NewServer(ctx context.Context, underlay tunnel.Server) (*Server, error) {
 		}
 		// 将这个TCP连接代理到本地 fallbackAddress 上运行的 HTTPS 服务
 		fallbackAddress = tunnel.NewAddressFromHostPort("tcp", cfg.TLS.FallbackHost, cfg.TLS.FallbackPort)
-		// 测试地址是否有效
-		fallbackConn, err := net.Dial("tcp", fallbackAddress.String())
-		if err != nil {
-			return nil, common.NewError("invalid fallback address").Base(err)
-		}
-		fallbackConn.Close()
 	} else {
 		log.Warn("empty tls fallback port")
 		// plain_http_response指服务端TLS握手失败时，明文发送的原始数据（原始TCP数据）。这个字段填入该文件路径。推荐使用fallback_port而不是该字段
@@ -334,10 +650,75 @@ func NewServer(ctx context.Context, underlay tunnel.Server) (*Server, error) {
 		}
 	}
 
-	// 加载证书
-	keyPair, err := loadKeyPair(cfg.TLS.KeyPath, cfg.TLS.CertPath, cfg.TLS.KeyPassword)
-	if err != nil {
-		return nil, common.NewError("tls failed to load key pair")
+	sniFallbacks := make([]sniFallback, 0, len(cfg.TLS.SNIFallbacks))
+	for _, f := range cfg.TLS.SNIFallbacks {
+		if f.SNI == "" || f.FallbackPort == 0 {
+			return nil, common.NewError("invalid sni fallback " + f.SNI)
+		}
+		if f.FallbackHost == "" {
+			f.FallbackHost = cfg.RemoteHost
+		}
+		address := tunnel.NewAddressFromHostPort("tcp", f.FallbackHost, f.FallbackPort)
+		sniFallbacks = append(sniFallbacks, sniFallback{
+			name:    f.SNI,
+			address: address,
+		})
+	}
+
+	var reality *realityServer
+	var err error
+	if cfg.TLS.Reality.Enabled {
+		if reality, err = newRealityServer(&cfg.TLS.Reality); err != nil {
+			return nil, common.NewError("tls failed to init reality").Base(err)
+		}
+		log.Info("tls reality enabled, unauthenticated connections are redirected to", reality.dest)
+	}
+
+	// 加载证书，开启 acme 时自动申请证书
+	var keyPair *tls.Certificate
+	var acmeManager *acme.Manager
+	if cfg.TLS.ACME.Enabled {
+		if len(cfg.TLS.ACME.Domains) == 0 && cfg.TLS.SNI != "" {
+			cfg.TLS.ACME.Domains = []string{cfg.TLS.SNI}
+		}
+		acmeManager, err = acme.NewManager(&cfg.TLS.ACME, cfg.TLS.CertPath, cfg.TLS.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		keyPair, err = acmeManager.Certificate(ctx)
+		if err != nil {
+			return nil, common.NewError("tls failed to obtain acme certificate").Base(err)
+		}
+	} else if reality == nil || cfg.TLS.CertPath != "" {
+		keyPair, err = loadKeyPair(cfg.TLS.KeyPath, cfg.TLS.CertPath, cfg.TLS.KeyPassword)
+		if err != nil {
+			return nil, common.NewError("tls failed to load key pair")
+		}
+	}
+
+	// 额外的证书，根据客户端的 SNI 选择，reality 模式下可以不使用证书
+	var keyPairs []tls.Certificate
+	var keyPairFiles []CertificateConfig
+	if keyPair != nil {
+		keyPairs = []tls.Certificate{*keyPair}
+		keyPairFiles = []CertificateConfig{{}}
+		if acmeManager == nil {
+			keyPairFiles[0] = CertificateConfig{
+				CertPath:    cfg.TLS.CertPath,
+				KeyPath:     cfg.TLS.KeyPath,
+				KeyPassword: cfg.TLS.KeyPassword,
+			}
+		}
+		keyPairFiles = append(keyPairFiles, cfg.TLS.Certificates...)
+	} else if len(cfg.TLS.Certificates) != 0 {
+		return nil, common.NewError("tls certificates require the default cert")
+	}
+	for _, certConfig := range cfg.TLS.Certificates {
+		extraKeyPair, err := loadKeyPair(certConfig.KeyPath, certConfig.CertPath, certConfig.KeyPassword)
+		if err != nil {
+			return nil, common.NewError("tls failed to load key pair " + certConfig.CertPath).Base(err)
+		}
+		keyPairs = append(keyPairs, *extraKeyPair)
 	}
 
 	var keyLogger io.WriteCloser
@@ -351,41 +732,237 @@ func NewServer(ctx context.Context, underlay tunnel.Server) (*Server, error) {
 		keyLogger = file
 	}
 
+	var defaultKeyPair *tls.Certificate
+	switch cfg.TLS.SNIMismatch {
+	case "", sniMismatchReject, sniMismatchFallback:
+	case sniMismatchDefault:
+		if cfg.TLS.SNIMismatchCertPath != "" {
+			defaultKeyPair, err = loadKeyPair(cfg.TLS.SNIMismatchKeyPath, cfg.TLS.SNIMismatchCertPath, "")
+			if err != nil {
+				return nil, common.NewError("tls failed to load default key pair").Base(err)
+			}
+		} else {
+			// 主证书暴露了服务器的真实域名，失去了使用默认证书的意义
+			log.Warn("sni_mismatch is default but sni_mismatch_cert is not set, the connections with mismatched sni are served with the main certificate")
+		}
+	default:
+		return nil, common.NewError("invalid sni mismatch behavior: " + cfg.TLS.SNIMismatch)
+	}
+
+	var allowlist *sniAllowlist
+	if cfg.TLS.SNIFile != "" {
+		if allowlist, err = newSNIAllowlist(cfg.TLS.SNIFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var ech *echKeySet
+	if cfg.TLS.ECHKeyPath != "" {
+		ech, err = loadECHKeys(cfg.TLS.ECHKeyPath)
+		if err != nil {
+			return nil, common.NewError("tls failed to load ech keys").Base(err)
+		}
+		// 客户端的 ech_config，也可以发布到域名的 HTTPS 记录中
+		log.Info("tls ech enabled, ech config:", ech.ConfigList())
+	}
+
+	var clientCA *x509.CertPool
+	if cfg.TLS.MutualTLS.Enabled {
+		caBytes, err := ioutil.ReadFile(cfg.TLS.MutualTLS.CAPath)
+		if err != nil {
+			return nil, common.NewError("tls failed to load client ca").Base(err)
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(caBytes) {
+			return nil, common.NewError("invalid client ca " + cfg.TLS.MutualTLS.CAPath)
+		}
+		log.Info("tls client certificate authentication enabled")
+	}
+
 	var cipherSuite []uint16
 	// cipherTLS使用的密码学套件
 	if len(cfg.TLS.Cipher) != 0 {
 		cipherSuite = fingerprint.ParseCipher(strings.Split(cfg.TLS.Cipher, ":"))
 	}
+	minVersion, maxVersion, err := fingerprint.ParseVersionRange(cfg.TLS.MinVersion, cfg.TLS.MaxVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// 与回落网站保持一致，减少主动探测可以观察到的差异
+	if cfg.TLS.Parity.Enabled {
+		addr, sni, err := cfg.TLS.Parity.Target(cfg.TLS.FallbackHost, cfg.TLS.FallbackPort, cfg.TLS.SNI)
+		if err != nil {
+			return nil, err
+		}
+		profile, err := parity.Probe(addr, sni)
+		if err != nil {
+			return nil, common.NewError("tls failed to probe the fallback website").Base(err)
+		}
+		cfg.TLS.ALPN = profile.ALPN
+		if maxVersion == 0 || profile.MaxVersion < maxVersion {
+			maxVersion = profile.MaxVersion
+		}
+		if minVersion > maxVersion {
+			return nil, common.NewError("min_version is higher than the tls version of the fallback website")
+		}
+		if cfg.TLS.ReuseSession != profile.SessionTicket {
+			log.Warn("reuse_session is set to", profile.SessionTicket, "to match the fallback website")
+			cfg.TLS.ReuseSession = profile.SessionTicket
+		}
+	}
+	if ech != nil && maxVersion != 0 && maxVersion < tls.VersionTLS13 {
+		return nil, common.NewError("ech requires tls 1.3")
+	}
+
+	var normalizer *redirector.Normalizer
+	if cfg.ProbeResistance.Enabled {
+		normalizer, err = redirector.NewNormalizer(time.Duration(cfg.ProbeResistance.MinDelay)*time.Millisecond,
+			time.Duration(cfg.ProbeResistance.MaxDelay)*time.Millisecond)
+		if err != nil {
+			return nil, common.NewError("tls failed to enable probe resistance").Base(err)
+		}
+	}
 
 	ctx, cancel := context.WithCancel(ctx)
 	server := &Server{
 		underlay:           underlay,
 		fallbackAddress:    fallbackAddress,
+		sniFallbacks:       sniFallbacks,
 		httpResp:           httpResp,
 		verifySNI:          cfg.TLS.VerifyHostName,
 		sni:                cfg.TLS.SNI,
+		sniList:            cfg.TLS.SNIList,
+		sniAllowlist:       allowlist,
 		alpn:               cfg.TLS.ALPN,
 		PreferServerCipher: cfg.TLS.PreferServerCipher,
 		sessionTicket:      cfg.TLS.ReuseSession,
 		connChan:           make(chan tunnel.Conn, 32),
 		wsChan:             make(chan tunnel.Conn, 32),
 		redir:              redirector.NewRedirector(ctx),
-		keyPair:            []tls.Certificate{*keyPair},
+		keyPair:            keyPairs,
+		keyPairFiles:       keyPairFiles,
 		keyLogger:          keyLogger,
 		cipherSuite:        cipherSuite,
+		minVersion:         minVersion,
+		maxVersion:         maxVersion,
+		sniMismatch:        cfg.TLS.SNIMismatch,
+		defaultKeyPair:     defaultKeyPair,
+		remoteAddress:      tunnel.NewAddressFromHostPort("tcp", cfg.RemoteHost, cfg.RemotePort),
+		ticketKeys:         [][32]byte{newTicketKey()},
+		ech:                ech,
+		clientCA:           clientCA,
+		reality:            reality,
+		normalizer:         normalizer,
 		ctx:                ctx,
 		cancel:             cancel,
 	}
 
+	if cfg.AntiReplay.Enabled {
+		server.replay = redirector.NewReplayFilter(time.Duration(cfg.AntiReplay.Window)*time.Second, cfg.AntiReplay.Size)
+	}
+
+	if cfg.Capture.Enabled {
+		if server.recorder, err = redirector.NewRecorder(ctx, Name, cfg.Capture.Path, cfg.Capture.MaxBytes, cfg.Capture.MaxRecords); err != nil {
+			cancel()
+			return nil, common.NewError("tls failed to enable capture").Base(err)
+		}
+	}
+
+	// 测试回落地址是否有效，并在后台持续检查
+	if fallbackAddress != nil {
+		if err := server.redir.Watch(fallbackAddress); err != nil {
+			cancel()
+			return nil, common.NewError("invalid fallback address").Base(err)
+		}
+	}
+	for _, f := range sniFallbacks {
+		if err := server.redir.Watch(f.address); err != nil {
+			cancel()
+			return nil, common.NewError("invalid fallback address of sni " + f.name).Base(err)
+		}
+	}
+
+	// 多个实例通过 redis 共享会话票据密钥，客户端连接到任一实例都可以恢复会话
+	var sessionCache *redisClient
+	if cfg.TLS.SessionCache.Enabled {
+		sessionCache = &redisClient{
+			addr:     tunnel.NewAddressFromHostPort("tcp", cfg.TLS.SessionCache.ServerHost, cfg.TLS.SessionCache.ServerPort).String(),
+			password: cfg.TLS.SessionCache.Password,
+			database: cfg.TLS.SessionCache.Database,
+		}
+		if err := server.syncTicketKeys(sessionCache, cfg.TLS.SessionCache.Key); err != nil {
+			log.Error(common.NewError("tls failed to sync session ticket keys, using local keys").Base(err))
+		}
+		checkRate := time.Second * time.Duration(cfg.TLS.SessionCache.CheckRate)
+		if checkRate <= 0 {
+			checkRate = time.Minute
+		}
+		go server.syncTicketKeysLoop(sessionCache, cfg.TLS.SessionCache.Key, checkRate)
+	}
+
+	// 定期轮换会话票据密钥，避免长期运行的服务端一直使用同一个密钥
+	if cfg.TLS.TicketRotation.Interval > 0 {
+		if !cfg.TLS.ReuseSession {
+			log.Warn("reuse_session is disabled, session ticket key rotation is ignored")
+		} else {
+			if cfg.TLS.TicketRotation.Keep < 1 {
+				cancel()
+				return nil, common.NewError("invalid number of session ticket keys to keep")
+			}
+			server.ticketRotation = time.Hour * time.Duration(cfg.TLS.TicketRotation.Interval)
+			server.ticketKeysKeep = cfg.TLS.TicketRotation.Keep
+			go server.rotateTicketKeysLoop(sessionCache, cfg.TLS.SessionCache.Key)
+			log.Info("tls session ticket keys are rotated every", cfg.TLS.TicketRotation.Interval, "hours")
+		}
+	}
+
+	// 收到 SIGHUP 时重新加载证书文件，不影响已经建立的连接
+	config.OnReload(ctx, func([]byte, string) error {
+		return server.reloadKeyPairs()
+	})
+
+	unregisterConn := metrics.RegisterQueue(ctx, "tls", func() int { return len(server.connChan) }, cap(server.connChan))
+	unregisterWS := metrics.RegisterQueue(ctx, "tls_websocket", func() int { return len(server.wsChan) }, cap(server.wsChan))
+	go func() {
+		<-ctx.Done()
+		unregisterConn()
+		unregisterWS()
+	}()
+
 	go server.acceptLoop()
-	if cfg.TLS.CertCheckRate > 0 {
+	if allowlist != nil {
+		checkRate := time.Second * time.Duration(cfg.TLS.CertCheckRate)
+		if checkRate <= 0 {
+			checkRate = time.Minute
+		}
+		go allowlist.watchLoop(ctx, checkRate)
+	}
+	if acmeManager != nil { // acme 自动续期，无需轮询证书文件
+		go acmeManager.Run(ctx, keyPair, func(keyPair *tls.Certificate) {
+			server.setKeyPair(0, keyPair)
+			log.Info("tls certificate renewed by acme")
+		})
+	} else if cfg.TLS.CertCheckRate > 0 && keyPair != nil {
 		go server.checkKeyPairLoop(
+			0,
 			time.Second*time.Duration(cfg.TLS.CertCheckRate),
 			cfg.TLS.KeyPath,
 			cfg.TLS.CertPath,
 			cfg.TLS.KeyPassword,
 		)
 	}
+	if cfg.TLS.CertCheckRate > 0 && keyPair != nil {
+		for i, certConfig := range cfg.TLS.Certificates {
+			go server.checkKeyPairLoop(
+				i+1,
+				time.Second*time.Duration(cfg.TLS.CertCheckRate),
+				certConfig.KeyPath,
+				certConfig.CertPath,
+				certConfig.KeyPassword,
+			)
+		}
+	}
 
 	log.Debug("tls server created")
 	return server, nil
@@ -0,0 +1,158 @@
+package tls
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+func newTicketKey() [32]byte {
+	var key [32]byte
+	common.Must2(rand.Read(key[:]))
+	return key
+}
+
+func encodeTicketKeys(keys [][32]byte) string {
+	buf := make([]byte, 0, len(keys)*32)
+	for _, key := range keys {
+		buf = append(buf, key[:]...)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func decodeTicketKeys(s string) ([][32]byte, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 || len(buf)%32 != 0 {
+		return nil, common.NewError("invalid ticket keys length")
+	}
+	keys := make([][32]byte, len(buf)/32)
+	for i := range keys {
+		copy(keys[i][:], buf[i*32:])
+	}
+	return keys, nil
+}
+
+func (s *Server) getTicketKeys() [][32]byte {
+	s.ticketKeysLock.RLock()
+	defer s.ticketKeysLock.RUnlock()
+	return s.ticketKeys
+}
+
+// syncTicketKeys fetches the session ticket keys shared by all instances from redis,
+// the local keys are stored if there is none yet
+func (s *Server) syncTicketKeys(client *redisClient, key string) error {
+	value, err := client.do("GET", key)
+	if err != nil {
+		return err
+	}
+	if value == nil { // 第一个启动的实例写入本地的密钥
+		if _, err := client.do("SET", key, encodeTicketKeys(s.getTicketKeys()), "NX"); err != nil {
+			return err
+		}
+		if value, err = client.do("GET", key); err != nil {
+			return err
+		}
+	}
+	keys, err := decodeTicketKeys(string(value))
+	if err != nil {
+		return common.NewError("invalid ticket keys in redis key " + key).Base(err)
+	}
+	s.ticketKeysLock.Lock()
+	defer s.ticketKeysLock.Unlock()
+	if encodeTicketKeys(keys) != encodeTicketKeys(s.ticketKeys) {
+		s.ticketKeys = keys
+		log.Info("tls session ticket keys updated from redis")
+	}
+	return nil
+}
+
+func (s *Server) syncTicketKeysLoop(client *redisClient, key string, checkRate time.Duration) {
+	ticker := time.NewTicker(checkRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.syncTicketKeys(client, key); err != nil {
+				log.Error(common.NewError("tls failed to sync session ticket keys").Base(err))
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// rotateKeys puts a new key in front of the keys, which encrypts the new tickets.
+// The old keys are only used to decrypt the tickets issued before
+func rotateKeys(keys [][32]byte, keep int) [][32]byte {
+	rotated := append([][32]byte{newTicketKey()}, keys...)
+	if len(rotated) > keep {
+		rotated = rotated[:keep]
+	}
+	return rotated
+}
+
+// rotateTicketKeys rotates the local keys, or the keys shared in redis if the client is not nil.
+// Only the instance which acquires the rotation lock rotates the shared keys, the others receive them by syncing
+func (s *Server) rotateTicketKeys(client *redisClient, key string) error {
+	if client == nil {
+		s.ticketKeysLock.Lock()
+		s.ticketKeys = rotateKeys(s.ticketKeys, s.ticketKeysKeep)
+		s.ticketKeysLock.Unlock()
+		log.Info("tls session ticket keys rotated")
+		return nil
+	}
+	// 锁在下一次轮换之前过期，避免计时误差导致跳过轮换
+	expire := int(s.ticketRotation.Seconds() * 0.9)
+	if expire < 1 {
+		expire = 1
+	}
+	locked, err := client.do("SET", key+":rotation", "1", "NX", "EX", strconv.Itoa(expire))
+	if err != nil {
+		return err
+	}
+	if locked == nil {
+		log.Debug("tls session ticket keys have been rotated by another instance")
+		return nil
+	}
+	keys := s.getTicketKeys()
+	value, err := client.do("GET", key)
+	if err != nil {
+		return err
+	}
+	if value != nil {
+		if keys, err = decodeTicketKeys(string(value)); err != nil {
+			return common.NewError("invalid ticket keys in redis key " + key).Base(err)
+		}
+	}
+	keys = rotateKeys(keys, s.ticketKeysKeep)
+	if _, err := client.do("SET", key, encodeTicketKeys(keys)); err != nil {
+		return err
+	}
+	s.ticketKeysLock.Lock()
+	s.ticketKeys = keys
+	s.ticketKeysLock.Unlock()
+	log.Info("tls session ticket keys rotated and shared through redis")
+	return nil
+}
+
+func (s *Server) rotateTicketKeysLoop(client *redisClient, key string) {
+	ticker := time.NewTicker(s.ticketRotation)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.rotateTicketKeys(client, key); err != nil {
+				log.Error(common.NewError("tls failed to rotate session ticket keys").Base(err))
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -1,15 +1,37 @@
 package tls
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/test/util"
+	"github.com/p4gefau1t/trojan-go/tunnel"
 	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
 	"github.com/p4gefau1t/trojan-go/tunnel/transport"
 )
@@ -212,6 +234,9 @@ func TestDefaultTLSECC(t *testing.T) {
 	if !util.CheckConn(conn1, conn2) {
 		t.Fail()
 	}
+	if random := tunnel.ClientRandomOf(conn2); len(random) != 32 {
+		t.Fatal("invalid client random", random)
+	}
 	conn1.Close()
 	conn2.Close()
 }
@@ -223,6 +248,8 @@ func TestUTLSRSA2048(t *testing.T) {
 		"chrome",
 		"firefox",
 		"ios",
+		"safari",
+		"randomized",
 	}
 	for _, s := range fingerprints {
 		serverCfg := &Config{
@@ -293,6 +320,8 @@ func TestUTLSECC(t *testing.T) {
 		"chrome",
 		"firefox",
 		"ios",
+		"safari",
+		"randomized",
 	}
 	for _, s := range fingerprints {
 		serverCfg := &Config{
@@ -356,6 +385,632 @@ func TestUTLSECC(t *testing.T) {
 	}
 }
 
+func TestUTLSALPN(t *testing.T) {
+	os.WriteFile("server-ecc.crt", []byte(eccCert), 0o777)
+	os.WriteFile("server-ecc.key", []byte(eccKey), 0o777)
+	for _, websocket := range []bool{false, true} {
+		port := common.PickPort("tcp", "127.0.0.1")
+		ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+			LocalHost:  "127.0.0.1",
+			LocalPort:  port,
+			RemoteHost: "127.0.0.1",
+			RemotePort: port,
+		})
+		ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+		sctx := config.WithConfig(ctx, Name, &Config{
+			TLS: TLSConfig{
+				KeyPath:  "server-ecc.key",
+				CertPath: "server-ecc.crt",
+				ALPN:     []string{"h2", "http/1.1"},
+			},
+		})
+		cctx := config.WithConfig(ctx, Name, &Config{
+			TLS: TLSConfig{
+				SNI:         "localhost",
+				Fingerprint: "chrome",
+				ALPN:        []string{"http/1.1"},
+			},
+			Websocket: WebsocketConfig{
+				Enabled: websocket,
+			},
+		})
+		tcpServer, err := transport.NewServer(ctx, nil)
+		common.Must(err)
+		tcpClient, err := transport.NewClient(ctx, nil)
+		common.Must(err)
+		s, err := NewServer(sctx, tcpServer)
+		common.Must(err)
+		c, err := NewClient(cctx, tcpClient)
+		common.Must(err)
+
+		conn, err := c.DialConn(nil, nil)
+		common.Must(err)
+		// 指纹默认协商 h2，开启 websocket 后只使用配置的 alpn
+		expected := "h2"
+		if websocket {
+			expected = "http/1.1"
+		}
+		protocol := conn.(*transport.Conn).Conn.(*utls.UConn).ConnectionState().NegotiatedProtocol
+		if protocol != expected {
+			t.Fatal("websocket", websocket, "negotiated", protocol)
+		}
+		conn.Close()
+		s.Close()
+		c.Close()
+	}
+}
+
+// fakeRedis serves GET and SET NX for the session cache tests
+func fakeRedis(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	lock := sync.Mutex{}
+	data := make(map[string]string)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					var n int
+					if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+						return
+					}
+					args := make([]string, n)
+					for i := range args {
+						var length int
+						if _, err := fmt.Fscanf(r, "$%d\r\n", &length); err != nil {
+							return
+						}
+						buf := make([]byte, length+2)
+						if _, err := io.ReadFull(r, buf); err != nil {
+							return
+						}
+						args[i] = string(buf[:length])
+					}
+					lock.Lock()
+					switch args[0] {
+					case "GET":
+						if value, found := data[args[1]]; found {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+						} else {
+							conn.Write([]byte("$-1\r\n"))
+						}
+					case "SET":
+						// 只支持 NX 选项，忽略过期时间
+						nx := false
+						for _, option := range args[3:] {
+							if option == "NX" {
+								nx = true
+							}
+						}
+						if _, found := data[args[1]]; found && nx {
+							conn.Write([]byte("$-1\r\n"))
+						} else {
+							data[args[1]] = args[2]
+							conn.Write([]byte("+OK\r\n"))
+						}
+					default:
+						conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+					lock.Unlock()
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// writeCert generates a self-signed certificate for the names
+func writeCert(certPath string, keyPath string, names ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	common.Must(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	common.Must(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	common.Must(err)
+	common.Must(os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o777))
+	common.Must(os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o777))
+}
+
+func TestSessionCache(t *testing.T) {
+	// 客户端不会恢复证书已过期的会话，因此使用新生成的证书
+	writeCert("server-session.crt", "server-session.key", "localhost")
+	defer os.Remove("server-session.crt")
+	defer os.Remove("server-session.key")
+
+	addr, stop := fakeRedis(t)
+	defer stop()
+	redisHost, redisPort, err := net.SplitHostPort(addr)
+	common.Must(err)
+	port, err := strconv.Atoi(redisPort)
+	common.Must(err)
+
+	var ports []int
+	for i := 0; i < 2; i++ {
+		serverPort := common.PickPort("tcp", "127.0.0.1")
+		ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+			LocalHost: "127.0.0.1",
+			LocalPort: serverPort,
+		})
+		ctx = config.WithConfig(ctx, Name, &Config{
+			TLS: TLSConfig{
+				KeyPath:      "server-session.key",
+				CertPath:     "server-session.crt",
+				ReuseSession: true,
+				SessionCache: SessionCacheConfig{
+					Enabled:    true,
+					ServerHost: redisHost,
+					ServerPort: port,
+					Key:        "test-keys",
+					CheckRate:  60,
+				},
+			},
+		})
+		tcpServer, err := transport.NewServer(ctx, nil)
+		common.Must(err)
+		s, err := NewServer(ctx, tcpServer)
+		common.Must(err)
+		defer s.Close()
+		ports = append(ports, serverPort)
+	}
+
+	// 在第一个实例获得的会话可以在第二个实例上恢复
+	cache := tls.NewLRUClientSessionCache(4)
+	for i, serverPort := range ports {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", serverPort), &tls.Config{
+			ServerName:         "localhost",
+			InsecureSkipVerify: true,
+			ClientSessionCache: cache,
+			MaxVersion:         tls.VersionTLS12,
+		})
+		common.Must(err)
+		if resumed := conn.ConnectionState().DidResume; resumed != (i == 1) {
+			t.Fatal("instance", i, "resumed:", resumed)
+		}
+		conn.Close()
+	}
+}
+
+func TestTicketRotation(t *testing.T) {
+	writeCert("server-rotation.crt", "server-rotation.key", "localhost")
+	defer os.Remove("server-rotation.crt")
+	defer os.Remove("server-rotation.key")
+
+	addr, stop := fakeRedis(t)
+	defer stop()
+	redisHost, redisPort, err := net.SplitHostPort(addr)
+	common.Must(err)
+	port, err := strconv.Atoi(redisPort)
+	common.Must(err)
+
+	var servers []*Server
+	var ports []int
+	for i := 0; i < 2; i++ {
+		serverPort := common.PickPort("tcp", "127.0.0.1")
+		ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+			LocalHost: "127.0.0.1",
+			LocalPort: serverPort,
+		})
+		ctx = config.WithConfig(ctx, Name, &Config{
+			TLS: TLSConfig{
+				KeyPath:      "server-rotation.key",
+				CertPath:     "server-rotation.crt",
+				ReuseSession: true,
+				SessionCache: SessionCacheConfig{
+					Enabled:    true,
+					ServerHost: redisHost,
+					ServerPort: port,
+					Key:        "test-keys",
+					CheckRate:  60,
+				},
+				TicketRotation: TicketRotationConfig{
+					Interval: 1,
+					Keep:     2,
+				},
+			},
+		})
+		tcpServer, err := transport.NewServer(ctx, nil)
+		common.Must(err)
+		s, err := NewServer(ctx, tcpServer)
+		common.Must(err)
+		defer s.Close()
+		servers = append(servers, s)
+		ports = append(ports, serverPort)
+	}
+
+	cache := tls.NewLRUClientSessionCache(4)
+	dial := func(i int) bool {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]), &tls.Config{
+			ServerName:         "localhost",
+			InsecureSkipVerify: true,
+			ClientSessionCache: cache,
+			MaxVersion:         tls.VersionTLS12,
+		})
+		common.Must(err)
+		defer conn.Close()
+		return conn.ConnectionState().DidResume
+	}
+	dial(0)
+
+	// 只有获得锁的实例轮换共享的密钥，其他实例通过同步获得新的密钥
+	client := &redisClient{addr: addr}
+	common.Must(servers[0].rotateTicketKeys(client, "test-keys"))
+	common.Must(servers[1].rotateTicketKeys(client, "test-keys"))
+	if keys := servers[1].getTicketKeys(); len(keys) != 1 {
+		t.Fatal("keys rotated without the lock:", len(keys))
+	}
+	common.Must(servers[1].syncTicketKeys(client, "test-keys"))
+	keys := servers[1].getTicketKeys()
+	if len(keys) != 2 || keys[0] != servers[0].getTicketKeys()[0] {
+		t.Fatal("rotated keys are not synced")
+	}
+
+	// 旧的密钥在保留期间仍然可以恢复会话
+	if !dial(1) {
+		t.Fatal("session encrypted with the old key is not resumed")
+	}
+	common.Must(servers[1].rotateTicketKeys(nil, ""))
+	common.Must(servers[1].rotateTicketKeys(nil, ""))
+	if len(servers[1].getTicketKeys()) != 2 {
+		t.Fatal("old keys are not dropped")
+	}
+	if dial(1) {
+		t.Fatal("session encrypted with a dropped key is resumed")
+	}
+}
+
+func TestSNIMismatch(t *testing.T) {
+	os.WriteFile("server-rsa2048.crt", []byte(rsa2048Cert), 0o777)
+	os.WriteFile("server-rsa2048.key", []byte(rsa2048Key), 0o777)
+	for _, behavior := range []string{sniMismatchReject, sniMismatchDefault, sniMismatchFallback} {
+		port := common.PickPort("tcp", "127.0.0.1")
+		ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+			LocalHost: "127.0.0.1",
+			LocalPort: port,
+		})
+		ctx = config.WithConfig(ctx, Name, &Config{
+			RemoteHost: "127.0.0.1",
+			RemotePort: util.EchoPort,
+			TLS: TLSConfig{
+				VerifyHostName: true,
+				KeyPath:        "server-rsa2048.key",
+				CertPath:       "server-rsa2048.crt",
+				SNIMismatch:    behavior,
+			},
+		})
+		tcpServer, err := transport.NewServer(ctx, nil)
+		common.Must(err)
+		s, err := NewServer(ctx, tcpServer)
+		common.Must(err)
+
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+			ServerName:         "example.com",
+			InsecureSkipVerify: true,
+		})
+		if behavior == sniMismatchReject {
+			if err == nil {
+				t.Fatal("handshake with mismatched sni should be rejected")
+			}
+		} else {
+			common.Must(err)
+		}
+		if behavior == sniMismatchFallback {
+			// the decrypted connection is redirected to the echo server
+			common.Must2(conn.Write([]byte("12345678")))
+			buf := [8]byte{}
+			common.Must2(io.ReadFull(conn, buf[:]))
+			if string(buf[:]) != "12345678" {
+				t.Fatal("not redirected")
+			}
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		s.Close()
+	}
+}
+
+func TestMultipleCertificates(t *testing.T) {
+	writeCert("server-default.crt", "server-default.key", "localhost")
+	writeCert("server-wildcard.crt", "server-wildcard.key", "*.example.com")
+	writeCert("server-www.crt", "server-www.key", "www.example.com")
+	for _, name := range []string{"default", "wildcard", "www"} {
+		defer os.Remove("server-" + name + ".crt")
+		defer os.Remove("server-" + name + ".key")
+	}
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+	})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			VerifyHostName: true,
+			KeyPath:        "server-default.key",
+			CertPath:       "server-default.crt",
+			Certificates: []CertificateConfig{
+				{CertPath: "server-wildcard.crt", KeyPath: "server-wildcard.key"},
+				{CertPath: "server-www.crt", KeyPath: "server-www.key"},
+			},
+			SNIMismatch: sniMismatchDefault,
+		},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	for serverName, expected := range map[string]string{
+		"localhost":       "localhost",
+		"a.example.com":   "*.example.com",
+		"www.example.com": "www.example.com", // 精确匹配优先于通配符
+		"example.org":     "localhost",
+	} {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		common.Must(err)
+		if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != expected {
+			t.Fatal("wrong certificate for", serverName, name)
+		}
+		conn.Close()
+	}
+}
+
+// writeClientCert generates a ca and a client certificate signed by it
+func writeClientCert(caPath string, certPath string, keyPath string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	common.Must(err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "trojan-go test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	common.Must(err)
+	caCert, err := x509.ParseCertificate(caDER)
+	common.Must(err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	common.Must(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	common.Must(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	common.Must(err)
+	common.Must(os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o777))
+	common.Must(os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o777))
+	common.Must(os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o777))
+}
+
+func TestMutualTLS(t *testing.T) {
+	writeCert("server-mtls.crt", "server-mtls.key", "localhost")
+	writeClientCert("client-ca.crt", "client-mtls.crt", "client-mtls.key")
+	writeClientCert("other-ca.crt", "client-other.crt", "client-other.key")
+	for _, name := range []string{"server-mtls.crt", "server-mtls.key", "client-ca.crt", "client-mtls.crt", "client-mtls.key", "other-ca.crt", "client-other.crt", "client-other.key"} {
+		defer os.Remove(name)
+	}
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+	})
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	sctx := config.WithConfig(ctx, Name, &Config{
+		RemoteHost: "127.0.0.1",
+		RemotePort: util.EchoPort,
+		TLS: TLSConfig{
+			KeyPath:  "server-mtls.key",
+			CertPath: "server-mtls.crt",
+			MutualTLS: MutualTLSConfig{
+				Enabled: true,
+				CAPath:  "client-ca.crt",
+			},
+		},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(sctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	for _, fingerprint := range []string{"", "chrome"} {
+		tcpClient, err := transport.NewClient(ctx, nil)
+		common.Must(err)
+		c, err := NewClient(config.WithConfig(ctx, Name, &Config{
+			TLS: TLSConfig{
+				SNI:         "localhost",
+				Fingerprint: fingerprint,
+				MutualTLS: MutualTLSConfig{
+					Enabled:  true,
+					CertPath: "client-mtls.crt",
+					KeyPath:  "client-mtls.key",
+				},
+			},
+		}), tcpClient)
+		common.Must(err)
+		connChan := make(chan net.Conn, 1)
+		go func() {
+			conn, err := s.AcceptConn(nil)
+			common.Must(err)
+			connChan <- conn
+		}()
+		conn1, err := c.DialConn(nil, nil)
+		common.Must(err)
+		common.Must2(conn1.Write([]byte("12345678\r\n")))
+		conn2 := <-connChan
+		buf := [10]byte{}
+		common.Must2(io.ReadFull(conn2, buf[:]))
+		if !util.CheckConn(conn1, conn2) {
+			t.Fatal("client with valid certificate failed, fingerprint:", fingerprint)
+		}
+		conn1.Close()
+		conn2.Close()
+		c.Close()
+	}
+
+	// 没有证书或证书无效的连接被重定向到 remote_addr
+	for _, certs := range [][]tls.Certificate{nil, {loadTestKeyPair("client-other.crt", "client-other.key")}} {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+			ServerName:         "localhost",
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		})
+		common.Must(err)
+		common.Must2(conn.Write([]byte("12345678")))
+		buf := [8]byte{}
+		common.Must2(io.ReadFull(conn, buf[:]))
+		if string(buf[:]) != "12345678" {
+			t.Fatal("not redirected")
+		}
+		conn.Close()
+	}
+}
+
+func loadTestKeyPair(certPath string, keyPath string) tls.Certificate {
+	keyPair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	common.Must(err)
+	return keyPair
+}
+
+func TestCertWatch(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeCert(certPath, keyPath, "old.example.com")
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+	})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			KeyPath:       keyPath,
+			CertPath:      certPath,
+			CertCheckRate: 3600, // 只有文件系统通知能够及时发现变化
+		},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	commonName := func() string {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+			InsecureSkipVerify: true,
+		})
+		common.Must(err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if name := commonName(); name != "old.example.com" {
+		t.Fatal("initial certificate", name)
+	}
+
+	// 与证书续期工具一样，写入临时文件后替换
+	writeCert(certPath+".tmp", keyPath+".tmp", "new.example.com")
+	common.Must(os.Rename(keyPath+".tmp", keyPath))
+	common.Must(os.Rename(certPath+".tmp", certPath))
+	for i := 0; ; i++ {
+		if commonName() == "new.example.com" {
+			break
+		}
+		if i == 50 {
+			t.Fatal("certificate not reloaded")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func TestReloadKeyPairs(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	extraCertPath, extraKeyPath := filepath.Join(dir, "extra.crt"), filepath.Join(dir, "extra.key")
+	writeCert(certPath, keyPath, "old.example.com")
+	writeCert(extraCertPath, extraKeyPath, "old.example.org")
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(config.WithScopedRegistry(context.Background()), transport.Name, &transport.Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+	})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			KeyPath:  keyPath,
+			CertPath: certPath,
+			Certificates: []CertificateConfig{
+				{CertPath: extraCertPath, KeyPath: extraKeyPath},
+			},
+		},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	commonName := func(serverName string) string {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		common.Must(err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	writeCert(certPath, keyPath, "new.example.com")
+	writeCert(extraCertPath, extraKeyPath, "old.example.org", "new.example.org")
+	if name := commonName("new.example.com"); name != "old.example.com" {
+		t.Fatal("reloaded without SIGHUP", name)
+	}
+	config.Reload(ctx, nil, "json")
+	if name := commonName("new.example.com"); name != "new.example.com" {
+		t.Fatal("default certificate not reloaded", name)
+	}
+	if name := commonName("new.example.org"); name != "old.example.org" {
+		t.Fatal("extra certificate not reloaded", name)
+	}
+
+	// 加载失败时保留原来的证书
+	common.Must(os.WriteFile(certPath, []byte("invalid"), 0o777))
+	if err := s.reloadKeyPairs(); err == nil {
+		t.Fatal("invalid certificate")
+	}
+	if name := commonName("new.example.com"); name != "new.example.com" {
+		t.Fatal("certificate should be kept", name)
+	}
+}
+
 func TestMatch(t *testing.T) {
 	if !isDomainNameMatched("*.google.com", "www.google.com") {
 		t.Fail()
@@ -368,4 +1023,748 @@ func TestMatch(t *testing.T) {
 	if !isDomainNameMatched("localhost", "localhost") {
 		t.Fail()
 	}
+
+	if !isDomainNameMatched("*.Example.com", "www.example.COM") {
+		t.Fail()
+	}
+}
+
+func TestSNIFallback(t *testing.T) {
+	writeCert("server-trojan.crt", "server-trojan.key", "trojan.example.com")
+	writeCert("server-site.crt", "server-site.key", "site.example.com")
+	for _, name := range []string{"trojan", "site"} {
+		defer os.Remove("server-" + name + ".crt")
+		defer os.Remove("server-" + name + ".key")
+	}
+
+	// the real website behind the camouflage domain
+	siteKeyPair, err := tls.LoadX509KeyPair("server-site.crt", "server-site.key")
+	common.Must(err)
+	site, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{siteKeyPair},
+	})
+	common.Must(err)
+	defer site.Close()
+	go func() {
+		for {
+			conn, err := site.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	sitePort := site.Addr().(*net.TCPAddr).Port
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+	})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			VerifyHostName: true,
+			KeyPath:        "server-trojan.key",
+			CertPath:       "server-trojan.crt",
+			SNIMismatch:    sniMismatchReject,
+			SNIFallbacks: []SNIFallbackConfig{
+				{SNI: "*.site.example.com", FallbackHost: "127.0.0.1", FallbackPort: sitePort},
+				{SNI: "site.example.com", FallbackHost: "127.0.0.1", FallbackPort: sitePort},
+			},
+		},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	for serverName, expected := range map[string]string{
+		"trojan.example.com":   "trojan.example.com",
+		"site.example.com":     "site.example.com",
+		"www.site.example.com": "site.example.com",
+	} {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		common.Must(err)
+		if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != expected {
+			t.Fatal("wrong certificate for", serverName, name)
+		}
+		conn.Close()
+	}
+
+	// the names without fallback are still rejected
+	if _, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+		ServerName:         "other.example.com",
+		InsecureSkipVerify: true,
+	}); err == nil {
+		t.Fatal("handshake with mismatched sni should be rejected")
+	}
+
+	// the handshake is completed by the website
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+		ServerName:         "site.example.com",
+		InsecureSkipVerify: true,
+	})
+	common.Must(err)
+	defer conn.Close()
+	common.Must2(conn.Write([]byte("12345678")))
+	buf := [8]byte{}
+	common.Must2(io.ReadFull(conn, buf[:]))
+	if string(buf[:]) != "12345678" {
+		t.Fatal("not redirected")
+	}
+}
+
+func TestSNIAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeCert(certPath, keyPath, "trojan.example.com")
+	writeCert(filepath.Join(dir, "site.crt"), filepath.Join(dir, "site.key"), "site.example.com")
+	sniFile := filepath.Join(dir, "sni.txt")
+	common.Must(os.WriteFile(sniFile, []byte("# allowed names\ntrojan.example.com\n\n*.cdn.example.com\n"), 0o600))
+
+	siteKeyPair, err := tls.LoadX509KeyPair(filepath.Join(dir, "site.crt"), filepath.Join(dir, "site.key"))
+	common.Must(err)
+	site, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{siteKeyPair},
+	})
+	common.Must(err)
+	defer site.Close()
+	go func() {
+		for {
+			conn, err := site.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+	})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			VerifyHostName: true,
+			KeyPath:        keyPath,
+			CertPath:       certPath,
+			SNIFile:        sniFile,
+			FallbackHost:   "127.0.0.1",
+			FallbackPort:   site.Addr().(*net.TCPAddr).Port,
+		},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	check := func(serverName string, expected string) {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		common.Must(err)
+		defer conn.Close()
+		if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != expected {
+			t.Fatal("wrong certificate for", serverName, name)
+		}
+	}
+	check("trojan.example.com", "trojan.example.com")
+	check("a.cdn.example.com", "trojan.example.com")
+	// 不在列表中的 SNI 由回落网站完成握手
+	check("other.example.com", "site.example.com")
+
+	common.Must(os.WriteFile(sniFile, []byte("other.example.com\n"), 0o600))
+	time.Sleep(certReloadDelay + time.Second)
+	check("other.example.com", "trojan.example.com")
+	check("trojan.example.com", "site.example.com")
+}
+
+func TestProbeResistance(t *testing.T) {
+	writeCert("server-probe.crt", "server-probe.key", "localhost")
+	defer os.Remove("server-probe.crt")
+	defer os.Remove("server-probe.key")
+
+	// the camouflage website answers any request with the same response
+	site, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer site.Close()
+	go func() {
+		for {
+			conn, err := site.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.Read(make([]byte, 1024))
+				conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			}(conn)
+		}
+	}()
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+	})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		ProbeResistance: ProbeResistanceConfig{
+			Enabled:  true,
+			MinDelay: 50,
+			MaxDelay: 100,
+		},
+		TLS: TLSConfig{
+			KeyPath:      "server-probe.key",
+			CertPath:     "server-probe.crt",
+			FallbackHost: "127.0.0.1",
+			FallbackPort: site.Addr().(*net.TCPAddr).Port,
+		},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	probe := func(payload []byte) string {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		common.Must(err)
+		defer conn.Close()
+		start := time.Now()
+		common.Must2(conn.Write(payload))
+		resp, _ := io.ReadAll(conn)
+		if time.Since(start) < time.Millisecond*50 {
+			t.Fatal("rejection is not delayed")
+		}
+		return string(resp)
+	}
+	plain := probe([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	// a client hello which can not be parsed, the alert is dropped and the website answers it instead
+	malformed := probe([]byte{0x16, 0x03, 0x01, 0x00, 0x08, 0x01, 0x00, 0x00, 0x04, 0xde, 0xad, 0xbe, 0xef})
+	if plain != "HTTP/1.1 400 Bad Request\r\n\r\n" || malformed != plain {
+		t.Fatal("different responses", plain, malformed)
+	}
+}
+
+// captureConn keeps the first bytes written by the client, i.e. the client hello
+type captureConn struct {
+	net.Conn
+	first []byte
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	if c.first == nil {
+		c.first = append([]byte(nil), p...)
+	}
+	return c.Conn.Write(p)
+}
+
+func TestAntiReplay(t *testing.T) {
+	writeCert("server-replay.crt", "server-replay.key", "localhost")
+	defer os.Remove("server-replay.crt")
+	defer os.Remove("server-replay.key")
+
+	redirected := make(chan []byte, 4)
+	site, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer site.Close()
+	go func() {
+		for {
+			conn, err := site.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				n, _ := conn.Read(buf)
+				if n > 0 {
+					redirected <- buf[:n]
+				}
+			}(conn)
+		}
+	}()
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+	})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		AntiReplay: AntiReplayConfig{Enabled: true, Window: 60, Size: 16},
+		TLS: TLSConfig{
+			KeyPath:      "server-replay.key",
+			CertPath:     "server-replay.crt",
+			FallbackHost: "127.0.0.1",
+			FallbackPort: site.Addr().(*net.TCPAddr).Port,
+		},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	// 捕获一次正常握手的 Client Hello
+	raw, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	common.Must(err)
+	captured := &captureConn{Conn: raw}
+	client := tls.Client(captured, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	common.Must(client.Handshake())
+	client.Close()
+
+	// 重放的 Client Hello 原样交给回落地址上的网站
+	replay, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	common.Must(err)
+	defer replay.Close()
+	common.Must2(replay.Write(captured.first))
+	select {
+	case got := <-redirected:
+		if !bytes.Equal(got, captured.first) {
+			t.Fatal("wrong data redirected")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("replayed client hello is not redirected")
+	}
+
+	// 新的握手不受影响
+	client, err = tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	common.Must(err)
+	client.Close()
+}
+
+func TestCertPinning(t *testing.T) {
+	writeCert("server-pin.crt", "server-pin.key", "localhost")
+	defer os.Remove("server-pin.crt")
+	defer os.Remove("server-pin.key")
+	keyPair, err := tls.LoadX509KeyPair("server-pin.crt", "server-pin.key")
+	common.Must(err)
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	common.Must(err)
+	certDigest := sha256.Sum256(leaf.Raw)
+	spkiDigest := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	certPin := strings.ToUpper(hex.EncodeToString(certDigest[:2])) + ":" + hex.EncodeToString(certDigest[2:])
+	spkiPin := "sha256/" + base64.StdEncoding.EncodeToString(spkiDigest[:])
+	wrongPin := hex.EncodeToString(make([]byte, 32))
+
+	if _, err := parseCertPins([]string{"sha256/invalid"}); err == nil {
+		t.Fatal("invalid pin accepted")
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{keyPair}})
+	common.Must(err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}(conn)
+		}
+	}()
+
+	for _, c := range []struct {
+		pins        []string
+		fingerprint string
+		ok          bool
+	}{
+		{[]string{certPin}, "", true},
+		{[]string{wrongPin, spkiPin}, "", true},
+		{[]string{wrongPin}, "", false},
+		{[]string{spkiPin}, "firefox", true},
+		{[]string{wrongPin}, "firefox", false},
+	} {
+		ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+			RemoteHost: "127.0.0.1",
+			RemotePort: l.Addr().(*net.TCPAddr).Port,
+		})
+		ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+		ctx = config.WithConfig(ctx, Name, &Config{
+			TLS: TLSConfig{
+				SNI:         "localhost",
+				Fingerprint: c.fingerprint,
+				Pins:        c.pins,
+			},
+		})
+		tcpClient, err := transport.NewClient(ctx, nil)
+		common.Must(err)
+		client, err := NewClient(ctx, tcpClient)
+		common.Must(err)
+		conn, err := client.DialConn(nil, nil)
+		if (err == nil) != c.ok {
+			t.Fatal("wrong result with pins", c.pins, c.fingerprint, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		client.Close()
+	}
+}
+
+func TestTrustReload(t *testing.T) {
+	writeCert("server-trust.crt", "server-trust.key", "localhost")
+	defer os.Remove("server-trust.crt")
+	defer os.Remove("server-trust.key")
+	keyPair, err := tls.LoadX509KeyPair("server-trust.crt", "server-trust.key")
+	common.Must(err)
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	common.Must(err)
+	certDigest := sha256.Sum256(leaf.Raw)
+	certPin := hex.EncodeToString(certDigest[:])
+	wrongPin := hex.EncodeToString(make([]byte, 32))
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{keyPair}})
+	common.Must(err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}(conn)
+		}
+	}()
+
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		RemoteHost: "127.0.0.1",
+		RemotePort: l.Addr().(*net.TCPAddr).Port,
+	})
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			SNI:  "localhost",
+			Pins: []string{certPin},
+		},
+	})
+	tcpClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	client, err := NewClient(ctx, tcpClient)
+	common.Must(err)
+	defer client.Close()
+
+	conn, err := client.DialConn(nil, nil)
+	common.Must(err)
+	defer conn.Close()
+	common.Must2(conn.Write([]byte("ping")))
+	buf := make([]byte, 4)
+	common.Must2(io.ReadFull(conn, buf))
+
+	// 指纹不变时保留已经建立的连接
+	common.Must(client.reloadTrust(ctx, []byte(`{"ssl": {"verify": false, "sni": "localhost", "pins": ["`+certPin+`"]}}`), "json"))
+	common.Must2(conn.Write([]byte("ping")))
+	common.Must2(io.ReadFull(conn, buf))
+
+	// 指纹更新后关闭不再信任的连接，新的连接使用新的指纹
+	common.Must(client.reloadTrust(ctx, []byte(`{"ssl": {"verify": false, "sni": "localhost", "pins": ["`+wrongPin+`"]}}`), "json"))
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatal("untrusted connection is not closed")
+	}
+	if _, err := client.DialConn(nil, nil); err == nil {
+		t.Fatal("new connection uses the stale pins")
+	}
+
+	if err := client.reloadTrust(ctx, []byte(`{"ssl": {"pins": ["invalid"]}}`), "json"); err == nil {
+		t.Fatal("invalid pins are accepted")
+	}
+}
+
+func TestTLSVersion(t *testing.T) {
+	os.WriteFile("server-ecc.crt", []byte(eccCert), 0o777)
+	os.WriteFile("server-ecc.key", []byte(eccKey), 0o777)
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+	})
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	sctx := config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			VerifyHostName: true,
+			KeyPath:        "server-ecc.key",
+			CertPath:       "server-ecc.crt",
+			MinVersion:     "1.3",
+		},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(sctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+	go func() {
+		for {
+			conn, err := s.AcceptConn(nil)
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	for _, name := range []string{"", "chrome"} {
+		for maxVersion, ok := range map[string]bool{"": true, "1.3": true, "1.2": false} {
+			tcpClient, err := transport.NewClient(ctx, nil)
+			common.Must(err)
+			c, err := NewClient(config.WithConfig(ctx, Name, &Config{
+				TLS: TLSConfig{
+					SNI:         "localhost",
+					Fingerprint: name,
+					MaxVersion:  maxVersion,
+				},
+			}), tcpClient)
+			common.Must(err)
+			conn, err := c.DialConn(nil, nil)
+			if (err == nil) != ok {
+				t.Fatal("fingerprint", name, "max version", maxVersion, err)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			c.Close()
+		}
+	}
+
+	tcpClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	defer tcpClient.Close()
+	if _, err := NewClient(config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			MinVersion: "1.3",
+			MaxVersion: "1.2",
+		},
+	}), tcpClient); err == nil {
+		t.Fatal("invalid version range should be rejected")
+	}
+}
+
+func TestReality(t *testing.T) {
+	// 目标网站
+	writeCert("reality-dest.crt", "reality-dest.key", "example.com")
+	defer os.Remove("reality-dest.crt")
+	defer os.Remove("reality-dest.key")
+	destKeyPair, err := tls.LoadX509KeyPair("reality-dest.crt", "reality-dest.key")
+	common.Must(err)
+	dest, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{destKeyPair},
+	})
+	common.Must(err)
+	defer dest.Close()
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	privateKey, publicKey, err := GenerateRealityKey()
+	common.Must(err)
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+	})
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	sctx := config.WithConfig(ctx, Name, &Config{
+		TLS: TLSConfig{
+			Reality: RealityConfig{
+				Enabled:     true,
+				DestHost:    "127.0.0.1",
+				DestPort:    dest.Addr().(*net.TCPAddr).Port,
+				ServerNames: []string{"example.com"},
+				PrivateKey:  privateKey,
+				ShortIDs:    []string{"abcd"},
+				MaxTimeDiff: 60,
+			},
+		},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(sctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	// 普通的客户端由目标网站完成握手
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+	})
+	common.Must(err)
+	if !bytes.Equal(conn.ConnectionState().PeerCertificates[0].Raw, destKeyPair.Certificate[0]) {
+		t.Fatal("unauthenticated client is not redirected to the dest")
+	}
+	conn.Close()
+
+	dial := func(publicKey string, shortID string) (tunnel.Conn, error) {
+		tcpClient, err := transport.NewClient(ctx, nil)
+		common.Must(err)
+		c, err := NewClient(config.WithConfig(ctx, Name, &Config{
+			TLS: TLSConfig{
+				SNI:         "example.com",
+				Fingerprint: "chrome",
+				Reality: RealityConfig{
+					Enabled:   true,
+					PublicKey: publicKey,
+					ShortID:   shortID,
+				},
+			},
+		}), tcpClient)
+		common.Must(err)
+		defer c.Close()
+		return c.DialConn(nil, nil)
+	}
+
+	// 认证的客户端由服务端完成握手
+	go func() {
+		conn, err := dial(publicKey, "abcd")
+		common.Must(err)
+		conn.Write([]byte("reality"))
+		conn.Close()
+	}()
+	serverConn, err := s.AcceptConn(nil)
+	common.Must(err)
+	buf := make([]byte, 7)
+	common.Must2(io.ReadFull(serverConn, buf))
+	if string(buf) != "reality" {
+		t.Fatal("wrong payload", string(buf))
+	}
+	serverConn.Close()
+
+	// 错误的公钥或 short id 无法认证，目标网站的证书不能通过客户端的校验
+	_, otherKey, err := GenerateRealityKey()
+	common.Must(err)
+	if _, err := dial(otherKey, "abcd"); err == nil {
+		t.Fatal("client with a wrong public key should fail")
+	}
+	if _, err := dial(publicKey, "1234"); err == nil {
+		t.Fatal("client with a wrong short id should fail")
+	}
+}
+
+func TestCAPath(t *testing.T) {
+	dir := t.TempDir()
+	caDir := filepath.Join(dir, "ca")
+	emptyDir := filepath.Join(dir, "empty")
+	common.Must(os.Mkdir(caDir, 0o700))
+	common.Must(os.Mkdir(emptyDir, 0o700))
+	writeCert(filepath.Join(caDir, "server.crt"), filepath.Join(dir, "server.key"), "localhost")
+	writeCert(filepath.Join(dir, "other.crt"), filepath.Join(dir, "other.key"), "localhost")
+	keyPair, err := tls.LoadX509KeyPair(filepath.Join(caDir, "server.crt"), filepath.Join(dir, "server.key"))
+	common.Must(err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{keyPair}})
+	common.Must(err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}(conn)
+		}
+	}()
+
+	for _, c := range []struct {
+		certPath string
+		caPath   string
+		ok       bool
+	}{
+		{"", caDir, true},
+		{"", filepath.Join(caDir, "server.crt"), true},
+		{filepath.Join(dir, "other.crt"), caDir, true},
+		{"", filepath.Join(dir, "other.crt"), false},
+	} {
+		ctx := config.WithConfig(context.Background(), transport.Name, &transport.Config{
+			RemoteHost: "127.0.0.1",
+			RemotePort: l.Addr().(*net.TCPAddr).Port,
+		})
+		ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+		ctx = config.WithConfig(ctx, Name, &Config{
+			TLS: TLSConfig{
+				Verify:         true,
+				VerifyHostName: true,
+				SNI:            "localhost",
+				CertPath:       c.certPath,
+				CAPath:         c.caPath,
+			},
+		})
+		tcpClient, err := transport.NewClient(ctx, nil)
+		common.Must(err)
+		client, err := NewClient(ctx, tcpClient)
+		common.Must(err)
+		conn, err := client.DialConn(nil, nil)
+		if (err == nil) != c.ok {
+			t.Fatal("wrong result with ca", c.certPath, c.caPath, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		client.Close()
+	}
+
+	// 目录中没有证书
+	ctx := config.WithConfig(context.Background(), Name, &Config{
+		TLS: TLSConfig{
+			Verify: true,
+			CAPath: emptyDir,
+		},
+	})
+	if _, err := NewClient(ctx, nil); err == nil {
+		t.Fatal("empty ca_path accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ctx, err := config.WithYAMLConfig(context.Background(), []byte(`
+ssl:
+  fingerprint: netscape
+  min-version: "1.3"
+  max-version: "1.2"
+  sni-mismatch-cert: default.crt
+  sni-fallbacks:
+    - fallback-port: 80
+`))
+	common.Must(err)
+	err = config.Validate(ctx, "yaml")
+	if err == nil {
+		t.Fatal("invalid tls config is accepted")
+	}
+	for _, path := range []string{"ssl.fingerprint", "ssl.min-version", "ssl.sni-mismatch-key", "ssl.sni-fallbacks[0].sni"} {
+		if !strings.Contains(err.Error(), "invalid config "+path+":") {
+			t.Fatal("missing error of", path, "in", err)
+		}
+	}
+
+	ctx, err = config.WithJSONConfig(context.Background(), []byte(`{"ssl": {"fingerprint": "chrome", "min_version": "1.2"}}`))
+	common.Must(err)
+	common.Must(config.Validate(ctx, "json"))
 }
@@ -0,0 +1,192 @@
+package tls
+
+import (
+	"context"
+	"crypto/x509"
+	"sync"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/transport"
+)
+
+// serverTrust is what the client expects of the server certificate, it can be replaced when the config is reloaded
+type serverTrust struct {
+	verify bool
+	sni    string
+	ca     *x509.CertPool // 为空时使用系统的根证书
+	pins   *certPins      // 为空时不校验服务端证书的指纹
+}
+
+// check verifies the certificates of an established connection against the trust
+func (t *serverTrust) check(certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return common.NewError("no certificate from the server")
+	}
+	var chains [][]*x509.Certificate
+	if t.verify {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		var err error
+		chains, err = certs[0].Verify(x509.VerifyOptions{
+			Roots:         t.ca,
+			DNSName:       t.sni,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if t.pins != nil {
+		rawCerts := make([][]byte, 0, len(certs))
+		for _, cert := range certs {
+			rawCerts = append(rawCerts, cert.Raw)
+		}
+		return t.pins.verify(rawCerts, chains)
+	}
+	return nil
+}
+
+// loadServerTrust reads the sni, the ca certificates and the pins from the config
+func loadServerTrust(cfg *Config) (*serverTrust, error) {
+	t := &serverTrust{
+		verify: cfg.TLS.Verify,
+		sni:    cfg.TLS.SNI,
+	}
+	if t.sni == "" {
+		t.sni = cfg.RemoteHost
+		log.Warn("tls sni is unspecified")
+	}
+
+	if len(cfg.TLS.Pins) != 0 {
+		if cfg.TLS.Reality.Enabled {
+			return nil, common.NewError("tls pins can not be used with reality")
+		}
+		var err error
+		if t.pins, err = parseCertPins(cfg.TLS.Pins); err != nil {
+			return nil, err
+		}
+		// 即使关闭了 verify，也只接受指纹匹配的证书
+		log.Info("tls certificate pinning enabled with", len(cfg.TLS.Pins), "pins")
+	}
+
+	// cert 和 ca_path 中的证书共同组成校验服务端证书的 CA 列表，代替系统的根证书
+	if cfg.TLS.CertPath != "" || cfg.TLS.CAPath != "" {
+		t.ca = x509.NewCertPool()
+		if cfg.TLS.CertPath != "" {
+			count, err := appendCertsFromPath(t.ca, cfg.TLS.CertPath)
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				log.Warn("invalid cert list")
+			}
+			log.Info("using custom cert")
+		}
+		if cfg.TLS.CAPath != "" {
+			count, err := appendCertsFromPath(t.ca, cfg.TLS.CAPath)
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				return nil, common.NewError("no certificate found in ca_path " + cfg.TLS.CAPath)
+			}
+			log.Info("using", count, "ca certificates from", cfg.TLS.CAPath)
+		}
+	} else {
+		log.Info("cert is unspecified, using default ca list")
+	}
+	return t, nil
+}
+
+// trackedConn is the connection under a tls connection to the server, it is closed when the server certificate
+// no longer meets the expectations
+type trackedConn struct {
+	tunnel.Conn
+	client *Client
+	certs  []*x509.Certificate
+	once   sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.client.connsLock.Lock()
+		delete(c.client.conns, c)
+		c.client.connsLock.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (c *Client) getTrust() *serverTrust {
+	c.trustLock.RLock()
+	defer c.trustLock.RUnlock()
+	return c.trust
+}
+
+// track records the certificates of an established connection
+func (c *Client) track(conn *trackedConn, certs []*x509.Certificate) {
+	conn.certs = certs
+	c.connsLock.Lock()
+	defer c.connsLock.Unlock()
+	if len(certs) != 0 {
+		if c.lastCert != nil && !c.lastCert.Equal(certs[0]) {
+			log.Info("the server certificate has changed, new connections use the certificate for", certs[0].Subject.CommonName)
+		}
+		c.lastCert = certs[0]
+	}
+	c.conns[conn] = struct{}{}
+}
+
+// drain closes the connections whose server certificates are rejected by the trust, so that the upper layers
+// redial with the new expectations instead of failing on the stale connections
+func (c *Client) drain(trust *serverTrust) int {
+	c.connsLock.Lock()
+	var stale []*trackedConn
+	for conn := range c.conns {
+		if err := trust.check(conn.certs); err != nil {
+			log.Debug("tls connection to", conn.RemoteAddr(), "no longer trusted:", err)
+			stale = append(stale, conn)
+		}
+	}
+	c.connsLock.Unlock()
+	for _, conn := range stale {
+		conn.Close()
+	}
+	return len(stale)
+}
+
+// reloadTrust updates the expectations of the server certificate from the reloaded config
+func (c *Client) reloadTrust(ctx context.Context, data []byte, format string) error {
+	if c.reality != nil { // reality 使用临时证书，与 CA 和指纹无关
+		return nil
+	}
+	var err error
+	switch format {
+	case "", "json":
+		ctx, err = config.WithJSONConfig(ctx, data)
+	case "yaml":
+		ctx, err = config.WithYAMLConfig(ctx, data)
+	default:
+		err = common.NewError("unknown config format: " + format)
+	}
+	if err != nil {
+		return common.NewError("invalid tls config").Base(err)
+	}
+	trust, err := loadServerTrust(config.FromContext(ctx, Name).(*Config))
+	if err != nil {
+		return common.NewError("tls failed to reload the server certificate expectations").Base(err)
+	}
+	c.trustLock.Lock()
+	c.trust = trust
+	c.trustLock.Unlock()
+
+	if count := c.drain(trust); count != 0 {
+		log.Info("tls server certificate expectations changed,", count, "connections closed")
+		transport.NotifyCarriersReset(ctx)
+	}
+	return nil
+}
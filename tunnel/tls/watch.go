@@ -0,0 +1,68 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly || windows
+// +build linux darwin freebsd openbsd netbsd dragonfly windows
+
+package tls
+
+import (
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// fileWatcher notifies the changes in the directories of the files
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	events  chan struct{}
+}
+
+func (w *fileWatcher) Events() <-chan struct{} {
+	return w.events
+}
+
+func (w *fileWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *fileWatcher) loop() {
+	for {
+		select {
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			select {
+			case w.events <- struct{}{}:
+			default:
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warn(common.NewError("tls cert watcher error").Base(err))
+		}
+	}
+}
+
+// newFileWatcher watches the directories instead of the files,
+// since the files are usually replaced by renaming or updating symlinks when the certificate is renewed
+func newFileWatcher(paths ...string) (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	w := &fileWatcher{
+		watcher: watcher,
+		events:  make(chan struct{}, 1),
+	}
+	go w.loop()
+	return w, nil
+}
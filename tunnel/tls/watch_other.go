@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly,!windows
+
+package tls
+
+import "github.com/p4gefau1t/trojan-go/common"
+
+type fileWatcher struct{}
+
+func (w *fileWatcher) Events() <-chan struct{} {
+	return nil
+}
+
+func (w *fileWatcher) Close() error {
+	return nil
+}
+
+func newFileWatcher(...string) (*fileWatcher, error) {
+	return nil, common.NewError("file system notification is not supported on this platform")
+}
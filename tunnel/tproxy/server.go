@@ -11,15 +11,15 @@ import (
 	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/backoff"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
 
-const MaxPacketSize = 1024 * 8
-
 type Server struct {
 	tcpListener net.Listener
+	port        int // 监听的端口，用于区分 TPROXY 和 REDIRECT 转发的连接
 	udpListener *net.UDPConn
 	packetChan  chan tunnel.PacketConn
 	timeout     time.Duration
@@ -39,17 +39,10 @@ func (s *Server) Close() error {
 func (s *Server) AcceptConn(tunnel.Tunnel) (tunnel.Conn, error) {
 	conn, err := s.tcpListener.Accept()
 	if err != nil {
-		select {
-		case <-s.ctx.Done():
-		default:
-			log.Fatal(common.NewError("tproxy failed to accept connection").Base(err))
-		}
-		return nil, common.NewError("tproxy failed to accept conn")
-	}
-	dst, err := getOriginalTCPDest(conn.(*net.TCPConn))
-	if err != nil {
-		return nil, common.NewError("tproxy failed to obtain original address of tcp socket").Base(err)
+		// 由上层的接收循环等待后重试
+		return nil, common.NewError("tproxy failed to accept conn").Base(err)
 	}
+	dst := originalTCPDest(conn.(*net.TCPConn), s.port)
 	address, err := tunnel.NewAddressFromAddr("tcp", dst.String())
 	common.Must(err)
 	log.Info("tproxy connection from", conn.RemoteAddr().String(), "metadata", dst.String())
@@ -70,18 +63,19 @@ func (s *Server) packetDispatchLoop() {
 	packetQueue := make(chan *tproxyPacketInfo, 1024)
 
 	go func() {
+		b := backoff.NewAcceptBackoff("tproxy_udp")
 		for {
-			buf := make([]byte, MaxPacketSize)
+			buf := make([]byte, common.PacketSize())
 			n, src, dst, err := ReadFromUDP(s.udpListener, buf)
 			if err != nil {
-				select {
-				case <-s.ctx.Done():
-				default:
-					log.Fatal(common.NewError("tproxy failed to read from udp socket").Base(err))
+				// 仅在关闭时退出，其他错误等待后继续读取
+				if !b.Wait(s.ctx, err) {
+					s.Close()
+					return
 				}
-				s.Close()
-				return
+				continue
 			}
+			b.Reset()
 			log.Debug("udp packet from", src, "metadata", dst, "size", n)
 			packetQueue <- &tproxyPacketInfo{
 				src:     src,
@@ -218,11 +212,13 @@ func NewServer(ctx context.Context, _ tunnel.Server) (*Server, error) {
 	})
 	if err != nil {
 		cancel()
+		tcpListener.Close()
 		return nil, common.NewError("tproxy failed to listen udp").Base(err)
 	}
 
 	server := &Server{
 		tcpListener: tcpListener,
+		port:        cfg.LocalPort,
 		udpListener: udpListener,
 		ctx:         ctx,
 		cancel:      cancel,
@@ -9,6 +9,8 @@ import (
 	"os"
 	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 // Listener describes a TCP Listener
@@ -46,6 +48,26 @@ func (listener *Listener) Close() error {
 	return listener.base.Close()
 }
 
+// isIPv6Socket reports whether the socket is an ipv6 or dual-stack socket
+func isIPv6Socket(fd int) bool {
+	domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	return err == nil && domain == unix.AF_INET6
+}
+
+// setTransparent sets IP_TRANSPARENT on the socket, and IPV6_TRANSPARENT as well if it is an ipv6 socket,
+// so that the socket can accept the connections to and send the packets from the non-local addresses
+func setTransparent(fd int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+		return fmt.Errorf("set socket option: IP_TRANSPARENT: %s", err)
+	}
+	if isIPv6Socket(fd) {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+			return fmt.Errorf("set socket option: IPV6_TRANSPARENT: %s", err)
+		}
+	}
+	return nil
+}
+
 // ListenTCP will construct a new TCP listener
 // socket with the Linux IP_TRANSPARENT option
 // set on the underlying socket
@@ -57,17 +79,35 @@ func ListenTCP(network string, laddr *net.TCPAddr) (net.Listener, error) {
 
 	fileDescriptorSource, err := listener.File()
 	if err != nil {
+		listener.Close()
 		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: laddr, Err: fmt.Errorf("get file descriptor: %s", err)}
 	}
 	defer fileDescriptorSource.Close()
 
-	if err = syscall.SetsockoptInt(int(fileDescriptorSource.Fd()), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
-		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: laddr, Err: fmt.Errorf("set socket option: IP_TRANSPARENT: %s", err)}
+	if err = setTransparent(int(fileDescriptorSource.Fd())); err != nil {
+		listener.Close()
+		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: laddr, Err: err}
 	}
 
 	return &Listener{listener}, nil
 }
 
+// originalTCPDest returns the original destination of the connection. The connections redirected by TPROXY
+// keep the original destination as the local address, while those redirected by REDIRECT or DNAT
+// are addressed to the listener and the original destination is recovered from the conntrack
+func originalTCPDest(conn *net.TCPConn, listenPort int) *net.TCPAddr {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if local.Port != listenPort {
+		return local
+	}
+	dst, err := getOriginalTCPDest(conn)
+	if err != nil {
+		// 未加载 conntrack 时，TPROXY 的目标端口恰好与监听端口相同
+		return local
+	}
+	return dst
+}
+
 const (
 	IP6T_SO_ORIGINAL_DST = 80
 	SO_ORIGINAL_DST      = 80
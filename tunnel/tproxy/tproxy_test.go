@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package tproxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+func TestOriginalDestination(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		ip := net.ParseIP(host)
+		port := common.PickPort("tcp", host)
+		tcpListener, err := ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		if err != nil {
+			t.Skip("tproxy is unavailable:", err)
+		}
+		udpListener, err := ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+		common.Must(err)
+
+		// 未经 TPROXY 转发的连接，原始目标即为监听地址
+		conn, err := net.Dial("tcp", tcpListener.Addr().String())
+		common.Must(err)
+		accepted, err := tcpListener.Accept()
+		common.Must(err)
+		if dst := originalTCPDest(accepted.(*net.TCPConn), port); !dst.IP.Equal(ip) || dst.Port != port {
+			t.Fatal("unexpected tcp original destination", dst)
+		}
+		conn.Close()
+		accepted.Close()
+
+		client, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		common.Must(err)
+		client.WriteTo([]byte("hello"), udpListener.LocalAddr())
+		buf := make([]byte, 16)
+		n, src, dst, err := ReadFromUDP(udpListener, buf)
+		common.Must(err)
+		if string(buf[:n]) != "hello" || !dst.IP.Equal(ip) || dst.Port != port {
+			t.Fatal("unexpected udp packet", string(buf[:n]), dst)
+		}
+
+		// 以其他目标的地址回复，透明代理时该地址不属于本机
+		from := &net.UDPAddr{IP: ip, Port: common.PickPort("udp", host)}
+		back, err := DialUDP("udp", from, src)
+		common.Must(err)
+		back.Write([]byte("world"))
+		n, addr, err := client.ReadFrom(buf)
+		common.Must(err)
+		if string(buf[:n]) != "world" || addr.String() != from.String() {
+			t.Fatal("unexpected udp reply", string(buf[:n]), addr)
+		}
+		back.Close()
+		client.Close()
+		tcpListener.Close()
+		udpListener.Close()
+	}
+}
@@ -4,14 +4,14 @@
 package tproxy
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 // ListenUDP will construct a new UDP listener
@@ -25,22 +25,63 @@ func ListenUDP(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
 
 	fileDescriptorSource, err := listener.File()
 	if err != nil {
+		listener.Close()
 		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: laddr, Err: fmt.Errorf("get file descriptor: %s", err)}
 	}
 	defer fileDescriptorSource.Close()
 
 	fileDescriptor := int(fileDescriptorSource.Fd())
-	if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
-		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: laddr, Err: fmt.Errorf("set socket option: IP_TRANSPARENT: %s", err)}
+	if err = setTransparent(fileDescriptor); err != nil {
+		listener.Close()
+		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: laddr, Err: err}
 	}
 
 	if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
+		listener.Close()
 		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: laddr, Err: fmt.Errorf("set socket option: IP_RECVORIGDSTADDR: %s", err)}
 	}
+	if isIPv6Socket(fileDescriptor) {
+		if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+			listener.Close()
+			return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: laddr, Err: fmt.Errorf("set socket option: IPV6_RECVORIGDSTADDR: %s", err)}
+		}
+	}
 
 	return listener, nil
 }
 
+// parseOriginalDst parses the original destination address in the socket control message,
+// nil is returned if the message is not about the original destination
+func parseOriginalDst(msg *syscall.SocketControlMessage) (*net.UDPAddr, error) {
+	switch {
+	case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_RECVORIGDSTADDR:
+		if len(msg.Data) < syscall.SizeofSockaddrInet4 {
+			return nil, fmt.Errorf("invalid ipv4 original destination address")
+		}
+		pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&msg.Data[0]))
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		return &net.UDPAddr{
+			IP:   net.IPv4(pp.Addr[0], pp.Addr[1], pp.Addr[2], pp.Addr[3]),
+			Port: int(p[0])<<8 + int(p[1]),
+		}, nil
+	case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == unix.IPV6_RECVORIGDSTADDR:
+		if len(msg.Data) < syscall.SizeofSockaddrInet6 {
+			return nil, fmt.Errorf("invalid ipv6 original destination address")
+		}
+		pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&msg.Data[0]))
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		addr := &net.UDPAddr{
+			IP:   append(net.IP(nil), pp.Addr[:]...),
+			Port: int(p[0])<<8 + int(p[1]),
+		}
+		if pp.Scope_id != 0 {
+			addr.Zone = strconv.Itoa(int(pp.Scope_id))
+		}
+		return addr, nil
+	}
+	return nil, nil
+}
+
 // ReadFromUDP reads a UDP packet from c, copying the payload into b.
 // It returns the number of bytes copied into b and the return address
 // that was on the packet.
@@ -60,39 +101,18 @@ func ReadFromUDP(conn *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr,
 	}
 
 	var originalDst *net.UDPAddr
-	for _, msg := range msgs {
-		if (msg.Header.Level == syscall.SOL_IP || msg.Header.Level == syscall.SOL_IPV6) && msg.Header.Type == syscall.IP_RECVORIGDSTADDR {
-			originalDstRaw := &syscall.RawSockaddrInet4{}
-			if err = binary.Read(bytes.NewReader(msg.Data), binary.LittleEndian, originalDstRaw); err != nil {
-				return 0, nil, nil, fmt.Errorf("reading original destination address: %s", err)
-			}
-
-			switch originalDstRaw.Family {
-			case syscall.AF_INET:
-				pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(originalDstRaw))
-				p := (*[2]byte)(unsafe.Pointer(&pp.Port))
-				originalDst = &net.UDPAddr{
-					IP:   net.IPv4(pp.Addr[0], pp.Addr[1], pp.Addr[2], pp.Addr[3]),
-					Port: int(p[0])<<8 + int(p[1]),
-				}
-
-			case syscall.AF_INET6:
-				pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(originalDstRaw))
-				p := (*[2]byte)(unsafe.Pointer(&pp.Port))
-				originalDst = &net.UDPAddr{
-					IP:   net.IP(pp.Addr[:]),
-					Port: int(p[0])<<8 + int(p[1]),
-					Zone: strconv.Itoa(int(pp.Scope_id)),
-				}
-
-			default:
-				return 0, nil, nil, fmt.Errorf("original destination is an unsupported network family")
-			}
+	for i := range msgs {
+		dst, err := parseOriginalDst(&msgs[i])
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if dst != nil {
+			originalDst = dst
 		}
 	}
 
 	if originalDst == nil {
-		return 0, nil, nil, fmt.Errorf("unable to obtain original destination: %s", err)
+		return 0, nil, nil, fmt.Errorf("unable to obtain original destination")
 	}
 
 	return n, addr, originalDst, nil
@@ -122,9 +142,9 @@ func DialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (*net.UDPCo
 		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("set socket option: SO_REUSEADDR: %s", err)}
 	}
 
-	if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+	if err = setTransparent(fileDescriptor); err != nil {
 		syscall.Close(fileDescriptor)
-		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("set socket option: IP_TRANSPARENT: %s", err)}
+		return nil, &net.OpError{Op: "dial", Err: err}
 	}
 
 	if err = syscall.Bind(fileDescriptor, localSocketAddress); err != nil {
@@ -164,9 +184,12 @@ func udpAddrToSocketAddr(addr *net.UDPAddr) (syscall.Sockaddr, error) {
 		ip := [16]byte{}
 		copy(ip[:], addr.IP.To16())
 
-		zoneID, err := strconv.ParseUint(addr.Zone, 10, 32)
-		if err != nil {
-			return nil, err
+		var zoneID uint64
+		if addr.Zone != "" {
+			var err error
+			if zoneID, err = strconv.ParseUint(addr.Zone, 10, 32); err != nil {
+				return nil, err
+			}
 		}
 
 		return &syscall.SockaddrInet6{Addr: ip, Port: addr.Port, ZoneId: uint32(zoneID)}, nil
@@ -185,7 +208,7 @@ func udpAddrFamily(net string, laddr, raddr *net.UDPAddr) int {
 	}
 
 	if (laddr == nil || laddr.IP.To4() != nil) &&
-		(raddr == nil || laddr.IP.To4() != nil) {
+		(raddr == nil || raddr.IP.To4() != nil) {
 		return syscall.AF_INET
 	}
 	return syscall.AF_INET6
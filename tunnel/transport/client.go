@@ -2,11 +2,14 @@ package transport
 
 import (
 	"context"
-	"os"
-	"os/exec"
+	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/backoff"
+	"github.com/p4gefau1t/trojan-go/common/sockopt"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/tunnel"
@@ -15,17 +18,46 @@ import (
 
 // Client implements tunnel.Client
 type Client struct {
-	serverAddress *tunnel.Address
-	cmd           *exec.Cmd
-	ctx           context.Context
-	cancel        context.CancelFunc
-	direct        *freedom.Client
+	serverAddress     *tunnel.Address
+	serverAddressLock sync.RWMutex // 运行时可以切换服务器
+	plugin            *pluginSupervisor
+	datagram          bool       // 插件同时转发 UDP
+	pt                *ptManager // 通过托管的 pluggable transport 连接服务端
+	ctx               context.Context
+	cancel            context.CancelFunc
+	direct            *freedom.Client
+	retry             *backoff.Policy           // 连接服务器失败时重试
+	schedule          *portSchedule             // 开启端口跳跃时连接服务端当前监听的端口
+	unixPath          string                    // 通过 unix socket 连接服务端
+	conns             map[*carrierConn]struct{} // 开启网络监测时记录与服务器的连接
+	connsLock         sync.Mutex
+	unregister        func() // 可以切换服务器时从注册表中移除
+}
+
+func (c *Client) getServerAddress() *tunnel.Address {
+	c.serverAddressLock.RLock()
+	defer c.serverAddressLock.RUnlock()
+	return c.serverAddress
+}
+
+// dialAddress returns the address of the server to dial now
+func (c *Client) dialAddress() *tunnel.Address {
+	address := c.getServerAddress()
+	if c.schedule == nil {
+		return address
+	}
+	hopped := *address
+	hopped.Port = c.schedule.port(c.schedule.slot(time.Now()))
+	return &hopped
 }
 
 func (c *Client) Close() error {
+	if c.unregister != nil {
+		c.unregister()
+	}
 	c.cancel()
-	if c.cmd != nil && c.cmd.Process != nil {
-		c.cmd.Process.Kill()
+	if c.plugin != nil {
+		c.plugin.close()
 	}
 	return nil
 }
@@ -34,23 +66,71 @@ func (c *Client) DialPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
 	panic("not supported")
 }
 
+// DatagramEnabled reports whether the plugin relays udp
+func (c *Client) DatagramEnabled() bool {
+	return c.datagram
+}
+
+// DialDatagram opens a udp socket to the plugin, each socket has its own source port so the server can tell them apart
+func (c *Client) DialDatagram() (net.Conn, error) {
+	if !c.datagram {
+		return nil, common.NewError("transport plugin doesn't relay udp")
+	}
+	conn, err := net.Dial("udp", c.getServerAddress().String())
+	if err != nil {
+		return nil, common.NewError("transport failed to dial udp to plugin").Base(err)
+	}
+	return conn, nil
+}
+
 // DialConn implements tunnel.Client. It will ignore the params and directly dial to the remote server
 func (c *Client) DialConn(*tunnel.Address, tunnel.Tunnel) (tunnel.Conn, error) {
-	conn, err := c.direct.DialConn(c.serverAddress, nil)
+	var conn tunnel.Conn
+	err := c.retry.Retry(c.ctx, func() error {
+		var err error
+		if c.pt != nil {
+			var ptConn net.Conn
+			ptConn, err = c.pt.dial(c.ctx, c.getServerAddress().String())
+			if err == nil {
+				conn = &Conn{Conn: ptConn}
+			}
+			return err
+		}
+		if c.unixPath != "" {
+			var unixConn net.Conn
+			unixConn, err = net.Dial("unix", c.unixPath)
+			if err == nil {
+				conn = &Conn{Conn: unixConn}
+			}
+			return err
+		}
+		conn, err = c.direct.DialConn(c.dialAddress(), nil)
+		return err
+	})
 	if err != nil {
 		return nil, common.NewError("transport failed to connect to remote server").Base(err)
 	}
-	return &Conn{
-		Conn: conn,
-	}, nil
+	if c.conns == nil {
+		return &Conn{
+			Conn: conn,
+		}, nil
+	}
+	carrier := &carrierConn{
+		Conn:   conn,
+		client: c,
+	}
+	c.connsLock.Lock()
+	c.conns[carrier] = struct{}{}
+	c.connsLock.Unlock()
+	return carrier, nil
 }
 
 // NewClient creates a transport layer client
 func NewClient(ctx context.Context, _ tunnel.Client) (*Client, error) {
 	cfg := config.FromContext(ctx, Name).(*Config)
 
-	var cmd *exec.Cmd
 	serverAddress := tunnel.NewAddressFromHostPort("tcp", cfg.RemoteHost, cfg.RemotePort)
+	var pt *ptManager
 
 	if cfg.TransportPlugin.Enabled {
 		log.Warn("trojan-go will use transport plugin and work in plain text mode")
@@ -71,34 +151,111 @@ func NewClient(ctx context.Context, _ tunnel.Client) (*Client, error) {
 			serverAddress = tunnel.NewAddressFromHostPort("tcp", cfg.RemoteHost, cfg.RemotePort)
 			log.Debug("plugin address", serverAddress.String())
 			log.Debug("plugin env", cfg.TransportPlugin.Env)
-
-			cmd = exec.Command(cfg.TransportPlugin.Command, cfg.TransportPlugin.Arg...)
-			cmd.Env = append(cmd.Env, cfg.TransportPlugin.Env...)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stdout
-			cmd.Start()
+		case "pt": // 托管的 pluggable transport，如 obfs4proxy，通过插件提供的 SOCKS5 代理连接服务端
+			if cfg.TransportPlugin.Transport == "" {
+				return nil, common.NewError("transport plugin transport is required for pluggable transport")
+			}
+			pt = &ptManager{
+				transport: cfg.TransportPlugin.Transport,
+				options:   cfg.TransportPlugin.Option,
+			}
+			cfg.TransportPlugin.Env = append(cfg.TransportPlugin.Env, pt.env(cfg.TransportPlugin.StateDir, "", "")...)
+			log.Debug("plugin env", cfg.TransportPlugin.Env)
 		case "other":
-			cmd = exec.Command(cfg.TransportPlugin.Command, cfg.TransportPlugin.Arg...)
-			cmd.Env = append(cmd.Env, cfg.TransportPlugin.Env...)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stdout
-			cmd.Start()
 		case "plaintext":
 			// do nothing
 		default:
 			return nil, common.NewError("invalid plugin type: " + cfg.TransportPlugin.Type)
 		}
+		if cfg.TransportPlugin.UDP && cfg.TransportPlugin.Type != "shadowsocks" {
+			return nil, common.NewError("transport plugin udp is only supported by the shadowsocks plugins")
+		}
+	}
+
+	var retry *backoff.Policy
+	if cfg.DialRetry.MaxAttempts > 1 {
+		var err error
+		retry, err = backoff.New("transport", &cfg.DialRetry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var schedule *portSchedule
+	if cfg.PortHopping.Enabled {
+		if cfg.TransportPlugin.Enabled && cfg.TransportPlugin.Type != "plaintext" { // 连接的是本地的插件
+			log.Warn("port_hopping is ignored when the transport plugin is used")
+		} else {
+			var err error
+			if schedule, err = newPortSchedule(&cfg.PortHopping); err != nil {
+				return nil, err
+			}
+			log.Info("transport client is following the port hopping of the server")
+		}
+	}
+
+	var plugin *pluginSupervisor
+	if cfg.TransportPlugin.Enabled && cfg.TransportPlugin.Type != "plaintext" {
+		// 插件退出后自动重新启动
+		var err error
+		if plugin, err = newPluginSupervisor(ctx, &cfg.TransportPlugin, pt); err != nil {
+			return nil, err
+		}
 	}
 
 	direct, err := freedom.NewClient(ctx, nil)
 	common.Must(err)
+	if !cfg.TransportPlugin.Enabled || cfg.TransportPlugin.Type == "plaintext" { // 连接本地的插件时没有意义
+		var fastOpen sockopt.Control
+		if cfg.TCPFastOpen && !cfg.TransportPlugin.Enabled {
+			fastOpen = fastOpenControl(true)
+		}
+		// 在出站接口之后绑定，连接服务端时优先使用 interface
+		direct.Control = sockopt.Chain(fastOpen, sockopt.BindToInterface(cfg.Interface))
+		if cfg.Interface != "" {
+			log.Info("transport client is connecting to the server through interface", cfg.Interface)
+		}
+		// 服务端或内核不支持时自动使用普通的 TCP
+		direct.MultipathTCP = cfg.MPTCP
+		if cfg.HappyEyeballs.Enabled {
+			direct.HappyEyeballs = &freedom.HappyEyeballs{
+				PreferIPv4: cfg.HappyEyeballs.Prefer == "ipv4",
+				Delay:      time.Duration(cfg.HappyEyeballs.Delay) * time.Millisecond,
+			}
+		}
+	} else {
+		if cfg.Interface != "" || cfg.MPTCP {
+			log.Warn("interface and mptcp are ignored when the transport plugin is used")
+		}
+		// 连接的是本地的插件，前置代理需要在插件中配置
+		direct.NoForwardProxy = true
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	client := &Client{
 		serverAddress: serverAddress,
-		cmd:           cmd,
+		plugin:        plugin,
+		pt:            pt,
+		datagram:      cfg.TransportPlugin.Enabled && cfg.TransportPlugin.UDP,
 		ctx:           ctx,
 		cancel:        cancel,
 		direct:        direct,
+		retry:         retry,
+		schedule:      schedule,
+	}
+	if path, ok := unixSocketPath(cfg.RemoteHost); ok && (!cfg.TransportPlugin.Enabled || cfg.TransportPlugin.Type == "plaintext") {
+		client.unixPath = path
+		log.Info("transport client is connecting to unix socket", path)
+	}
+	if !cfg.TransportPlugin.Enabled { // 使用插件时连接的是本地的插件，不能切换
+		client.unregister = tunnel.RegistryFromContext(ctx).AddInstance(instanceKind, client)
+	}
+	if cfg.NetworkMonitor.Enabled { // 网络变化时重新连接服务器
+		client.conns = make(map[*carrierConn]struct{})
+		checkRate := time.Second * time.Duration(cfg.NetworkMonitor.CheckRate)
+		if checkRate <= 0 {
+			checkRate = time.Second * 2
+		}
+		go client.monitorNetwork(checkRate)
 	}
 	return client, nil
 }
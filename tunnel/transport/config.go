@@ -1,28 +1,129 @@
 package transport
 
 import (
+	"github.com/p4gefau1t/trojan-go/common/backoff"
 	"github.com/p4gefau1t/trojan-go/config"
 )
 
 type Config struct {
 	LocalHost       string                `json:"local_addr" yaml:"local-addr"`
 	LocalPort       int                   `json:"local_port" yaml:"local-port"`
+	LocalPorts      string                `json:"local_ports" yaml:"local-ports"` // 额外监听的端口，如 "8443,20000-21000"
 	RemoteHost      string                `json:"remote_addr" yaml:"remote-addr"`
 	RemotePort      int                   `json:"remote_port" yaml:"remote-port"`
+	ListenFamily    string                `json:"listen_family" yaml:"listen-family"`
+	Interface       string                `json:"interface" yaml:"interface"` // 监听和连接服务端使用的网络接口，如 eth0
+	TCPFastOpen     bool                  `json:"tcp_fast_open" yaml:"tcp-fast-open"`
+	TCP             TCPConfig             `json:"tcp" yaml:"tcp"`             // 与 freedom 共用同一个配置项
+	MPTCP           bool                  `json:"mptcp" yaml:"mptcp"`         // 客户端与服务端之间使用 Multipath TCP
+	Listeners       int                   `json:"listeners" yaml:"listeners"` // 使用 SO_REUSEPORT 监听同一端口的监听器数量
+	DialRetry       backoff.Config        `json:"dial_retry" yaml:"dial-retry"`
+	HappyEyeballs   HappyEyeballsConfig   `json:"happy_eyeballs" yaml:"happy-eyeballs"`
+	PortHopping     PortHoppingConfig     `json:"port_hopping" yaml:"port-hopping"`
+	ProxyProtocol   ProxyProtocolConfig   `json:"proxy_protocol" yaml:"proxy-protocol"`
 	TransportPlugin TransportPluginConfig `json:"transport_plugin" yaml:"transport-plugin"`
+	NetworkMonitor  NetworkMonitorConfig  `json:"network_monitor" yaml:"network-monitor"`
+}
+
+// TCPConfig 接受的 TCP 连接的选项，发起的连接由 freedom 设置
+type TCPConfig struct {
+	KeepAlive         bool `json:"keep_alive" yaml:"keep-alive"`
+	KeepAliveInterval int  `json:"keep_alive_interval" yaml:"keep-alive-interval"`
+	NoDelay           bool `json:"no_delay" yaml:"no-delay"`
+	UserTimeout       int  `json:"user_timeout" yaml:"user-timeout"`
+}
+
+// HappyEyeballsConfig 服务端域名同时有 IPv6 和 IPv4 地址时交替尝试两种地址，使用最先建立的连接
+type HappyEyeballsConfig struct {
+	Enabled bool   `json:"enabled" yaml:"enabled"`
+	Prefer  string `json:"prefer" yaml:"prefer"` // 首先尝试的地址，ipv6 或 ipv4
+	Delay   int    `json:"delay" yaml:"delay"`   // 开始下一次尝试前等待的毫秒数
+}
+
+// NetworkMonitorConfig 客户端监测网络变化，网络切换后立即重新连接服务器
+type NetworkMonitorConfig struct {
+	Enabled   bool `json:"enabled" yaml:"enabled"`
+	CheckRate int  `json:"check_rate" yaml:"check-rate"`
+}
+
+// PortHoppingConfig 服务端按时间轮换监听的端口，客户端根据相同的密钥计算当前的端口
+type PortHoppingConfig struct {
+	Enabled  bool   `json:"enabled" yaml:"enabled"`
+	Ports    string `json:"ports" yaml:"ports"`       // 轮换的端口范围，如 "20000-21000"
+	Interval int    `json:"interval" yaml:"interval"` // 轮换的间隔秒数
+	Secret   string `json:"secret" yaml:"secret"`
+}
+
+// ProxyProtocolConfig 服务端位于 haproxy 等代理之后时，从 PROXY 协议头部获取客户端的真实地址
+type ProxyProtocolConfig struct {
+	Enabled        bool     `json:"enabled" yaml:"enabled"`
+	TrustedProxies []string `json:"trusted_proxies" yaml:"trusted-proxies"` // 只读取这些地址发送的头部
 }
 
 type TransportPluginConfig struct {
-	Enabled bool     `json:"enabled" yaml:"enabled"`
-	Type    string   `json:"type" yaml:"type"`
-	Command string   `json:"command" yaml:"command"`
-	Option  string   `json:"option" yaml:"option"`
-	Arg     []string `json:"arg" yaml:"arg"`
-	Env     []string `json:"env" yaml:"env"`
+	Enabled     bool           `json:"enabled" yaml:"enabled"`
+	Type        string         `json:"type" yaml:"type"`
+	Command     string         `json:"command" yaml:"command"`
+	Option      string         `json:"option" yaml:"option"`
+	Arg         []string       `json:"arg" yaml:"arg"`
+	Env         []string       `json:"env" yaml:"env"`
+	Restart     backoff.Config `json:"restart" yaml:"restart"`           // 插件退出后重新启动的等待时间，max_attempts 不生效
+	MaxFailures int            `json:"max_failures" yaml:"max-failures"` // 连续失败达到该次数后健康检查失败
+	UDP         bool           `json:"udp" yaml:"udp"`                   // 插件同时转发 UDP（SIP003u），只支持 shadowsocks 类型
+	Transport   string         `json:"transport" yaml:"transport"`       // pt 类型使用的传输方式，如 obfs4
+	StateDir    string         `json:"state_dir" yaml:"state-dir"`       // pt 类型插件保存状态（如密钥）的目录
+}
+
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if c.HappyEyeballs.Enabled {
+		if c.HappyEyeballs.Prefer != "ipv6" && c.HappyEyeballs.Prefer != "ipv4" {
+			errs.Add("happy_eyeballs.prefer", "must be ipv6 or ipv4")
+		}
+		// RFC 8305 建议的范围
+		if c.HappyEyeballs.Delay < 10 || c.HappyEyeballs.Delay > 2000 {
+			errs.Add("happy_eyeballs.delay", "must be in [10, 2000] milliseconds")
+		}
+	}
+	return errs.Err()
 }
 
 func init() {
 	config.RegisterConfigCreator(Name, func() interface{} {
-		return new(Config)
+		return &Config{
+			Listeners: 1,
+			TCP: TCPConfig{
+				KeepAlive: true,
+				NoDelay:   true,
+			},
+			HappyEyeballs: HappyEyeballsConfig{
+				Enabled: true,
+				Prefer:  "ipv6",
+				Delay:   250,
+			},
+			NetworkMonitor: NetworkMonitorConfig{
+				CheckRate: 2,
+			},
+			PortHopping: PortHoppingConfig{
+				Interval: 60,
+			},
+			TransportPlugin: TransportPluginConfig{
+				Restart: backoff.Config{
+					InitialDelay: 1000,
+					MaxDelay:     30000,
+					Multiplier:   2,
+					Jitter:       0.2,
+				},
+				MaxFailures: 5,
+				StateDir:    "pt_state",
+			},
+			DialRetry: backoff.Config{
+				MaxAttempts:  3,
+				InitialDelay: 200,
+				MaxDelay:     2000,
+				Multiplier:   2,
+				Jitter:       0.2,
+			},
+		}
 	})
 }
@@ -2,14 +2,75 @@ package transport
 
 import (
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
 
 type Conn struct {
 	net.Conn
+	Accepted   time.Time // 接受 TCP 连接的时间，未知时为零值
+	Handshaked time.Time // 完成 TLS 握手的时间，未知时为零值
+	Wire       net.Conn  // 统计流量的底层连接，为空时未知
+	Random     []byte    // TLS ClientHello 中的随机数，为空时未知
+}
+
+func (c *Conn) AcceptTime() time.Time {
+	return c.Accepted
+}
+
+func (c *Conn) HandshakeTime() time.Time {
+	return c.Handshaked
+}
+
+func (c *Conn) ClientRandom() []byte {
+	return c.Random
+}
+
+func (c *Conn) WireTraffic() (uint64, uint64, bool) {
+	if c.Wire == nil {
+		return 0, 0, false
+	}
+	return tunnel.WireTrafficOf(c.Wire)
 }
 
 func (c *Conn) Metadata() *tunnel.Metadata {
 	return nil
 }
+
+// wireConn counts the bytes on the accepted tcp connection
+type wireConn struct {
+	// WARNING: 64-bit fields that use `sync/atomic` package functions
+	// must be 64-bit aligned on 32-bit systems.
+	sent uint64
+	recv uint64
+	net.Conn
+}
+
+func (c *wireConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.recv, uint64(n))
+	return n, err
+}
+
+func (c *wireConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.sent, uint64(n))
+	return n, err
+}
+
+func (c *wireConn) WireTraffic() (uint64, uint64, bool) {
+	return atomic.LoadUint64(&c.sent), atomic.LoadUint64(&c.recv), true
+}
+
+// admittedConn releases its slot of the overload limiter after it is closed
+type admittedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *admittedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
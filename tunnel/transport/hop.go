@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// portSchedule maps the time to a port in the range, the server and the client derive the same port from the secret
+type portSchedule struct {
+	ports    []int
+	interval int64 // 秒
+	secret   []byte
+}
+
+// slot returns the index of the interval containing t
+func (s *portSchedule) slot(t time.Time) int64 {
+	return t.Unix() / s.interval
+}
+
+// port returns the active port of the slot
+func (s *portSchedule) port(slot int64) int {
+	mac := hmac.New(sha256.New, s.secret)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(slot))
+	mac.Write(buf[:])
+	sum := mac.Sum(nil)
+	return s.ports[binary.BigEndian.Uint64(sum[:8])%uint64(len(s.ports))]
+}
+
+// next returns the time when the slot after t begins
+func (s *portSchedule) next(t time.Time) time.Time {
+	return time.Unix((s.slot(t)+1)*s.interval, 0)
+}
+
+func newPortSchedule(cfg *PortHoppingConfig) (*portSchedule, error) {
+	ports, err := parsePorts(cfg.Ports)
+	if err != nil {
+		return nil, common.NewError("invalid port_hopping ports").Base(err)
+	}
+	if len(ports) == 0 {
+		return nil, common.NewError("port_hopping ports is empty")
+	}
+	if cfg.Interval <= 0 {
+		return nil, common.NewError("invalid port_hopping interval")
+	}
+	if cfg.Secret == "" {
+		return nil, common.NewError("port_hopping secret is empty")
+	}
+	return &portSchedule{
+		ports:    ports,
+		interval: int64(cfg.Interval),
+		secret:   []byte(cfg.Secret),
+	}, nil
+}
+
+// portHopper rotates the listening port of the server according to the schedule.
+// Closing a listener does not affect the connections already accepted from it
+type portHopper struct {
+	schedule  *portSchedule
+	server    *Server
+	listen    func(port int) ([]net.Listener, error)
+	listeners map[int][]net.Listener
+	closed    bool
+	lock      sync.Mutex
+}
+
+// update listens on the ports of the previous, the current and the next slot, so that the clients with
+// a clock skew up to one interval can still connect. The other ports are closed
+func (h *portHopper) update(now time.Time) {
+	slot := h.schedule.slot(now)
+	active := map[int]bool{
+		h.schedule.port(slot - 1): true,
+		h.schedule.port(slot):     true,
+		h.schedule.port(slot + 1): true,
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return
+	}
+	for port, listeners := range h.listeners {
+		if !active[port] {
+			for _, l := range listeners {
+				l.Close()
+			}
+			delete(h.listeners, port)
+			log.Debug("port hopping stopped listening on", port)
+		}
+	}
+	for port := range active {
+		if _, found := h.listeners[port]; found {
+			continue
+		}
+		listeners, err := h.listen(port)
+		if err != nil {
+			log.Error(common.NewError("port hopping failed to listen").Base(err))
+			continue
+		}
+		h.listeners[port] = listeners
+		for _, l := range listeners {
+			go h.server.acceptLoop(l)
+		}
+		log.Debug("port hopping started listening on", port)
+	}
+}
+
+// ports returns the ports being listened on
+func (h *portHopper) ports() []int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ports := make([]int, 0, len(h.listeners))
+	for port := range h.listeners {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+func (h *portHopper) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	for port, listeners := range h.listeners {
+		for _, l := range listeners {
+			l.Close()
+		}
+		delete(h.listeners, port)
+	}
+}
+
+// run updates the listeners at the beginning of each slot
+func (h *portHopper) run(ctx context.Context) {
+	for {
+		now := time.Now()
+		select {
+		case <-time.After(h.schedule.next(now).Sub(now)):
+			h.update(time.Now())
+		case <-ctx.Done():
+			h.close()
+			return
+		}
+	}
+}
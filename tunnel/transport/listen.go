@@ -0,0 +1,243 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/sockopt"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// 监听的地址族
+const (
+	familyDefault = ""     // 使用操作系统的默认行为
+	familyIPv4    = "ipv4" // 仅监听 IPv4
+	familyIPv6    = "ipv6" // 仅监听 IPv6 (IPV6_V6ONLY=1)
+	familyDual    = "dual" // 同时监听 IPv4 和 IPv6 (IPV6_V6ONLY=0)
+)
+
+// unixPrefix marks a unix domain socket in local_addr and remote_addr, e.g. unix:///run/trojan-go.sock
+const unixPrefix = "unix://"
+
+// unixSocketPath returns the path of the unix socket if the host is one
+func unixSocketPath(host string) (string, bool) {
+	if !strings.HasPrefix(host, unixPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(host, unixPrefix), true
+}
+
+// listenUnix listens on the unix socket, the stale socket left by the last run is removed
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, common.NewError("failed to remove the stale unix socket " + path).Base(err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// 与监听回环地址相同，本机的其他用户（如 nginx 的工作进程）都可以连接
+	if err := os.Chmod(path, 0o666); err != nil {
+		log.Warn(common.NewError("failed to change the mode of the unix socket " + path).Base(err))
+	}
+	return l, nil
+}
+
+// unixConn is a connection accepted from the unix socket, it has no peer address, so it is regarded as
+// a connection from the loopback address, like the reverse proxy connecting through the loopback tcp
+type unixConn struct {
+	net.Conn
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// listenNetwork validates the local address against the family, and returns the network and the address to listen on
+func listenNetwork(family string, host string, port int) (string, string, error) {
+	ip := net.ParseIP(host)
+	isV4 := ip != nil && ip.To4() != nil
+	isV6 := ip != nil && ip.To4() == nil
+	switch family {
+	case familyDefault:
+		return "tcp", net.JoinHostPort(host, strconv.Itoa(port)), nil
+	case familyIPv4:
+		if isV6 {
+			return "", "", common.NewError("local_addr " + host + " is an ipv6 address, but listen_family is ipv4")
+		}
+		return "tcp4", net.JoinHostPort(host, strconv.Itoa(port)), nil
+	case familyIPv6:
+		if isV4 {
+			return "", "", common.NewError("local_addr " + host + " is an ipv4 address, but listen_family is ipv6")
+		}
+		return "tcp6", net.JoinHostPort(host, strconv.Itoa(port)), nil
+	case familyDual:
+		// only the any-address of ipv6 can accept both ipv4 and ipv6 connections
+		if host != "" && !(isV6 && ip.IsUnspecified()) {
+			return "", "", common.NewError("listen_family dual requires an empty local_addr or \"::\", got " + host)
+		}
+		return "tcp6", net.JoinHostPort("::", strconv.Itoa(port)), nil
+	default:
+		return "", "", common.NewError("invalid listen_family: " + family)
+	}
+}
+
+// fastOpenControl enables tcp fast open on the socket, the connection still works without it so only a warning is logged
+func fastOpenControl(client bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if client {
+				sockErr = setFastOpenConnect(fd)
+			} else {
+				sockErr = setFastOpen(fd)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			log.Warn(common.NewError("failed to enable tcp fast open").Base(sockErr))
+		}
+		return nil
+	}
+}
+
+// listen creates a tcp listener of the family, bind is applied to the socket if it is not nil
+func listen(ctx context.Context, family string, host string, port int, fastOpen bool, bind sockopt.Control, mptcp bool, reusePort bool) (net.Listener, error) {
+	network, address, err := listenNetwork(family, host, port)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{}
+	sockopt.SetListenerMultipath(&lc, mptcp)
+	var controls []func(network, address string, c syscall.RawConn) error
+	if family == familyIPv6 || family == familyDual {
+		v6only := family == familyIPv6
+		controls = append(controls, func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setV6Only(fd, v6only)
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return common.NewError("failed to set IPV6_V6ONLY").Base(sockErr)
+			}
+			return nil
+		})
+	}
+	if fastOpen {
+		controls = append(controls, fastOpenControl(false))
+	}
+	if bind != nil {
+		controls = append(controls, bind)
+	}
+	if reusePort {
+		controls = append(controls, func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setReusePort(fd)
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return common.NewError("failed to set SO_REUSEPORT").Base(sockErr)
+			}
+			return nil
+		})
+	}
+	if len(controls) != 0 {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			for _, control := range controls {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return lc.Listen(ctx, network, address)
+}
+
+// listenMulti creates n listeners on the same port with SO_REUSEPORT, the kernel distributes the connections among them
+func listenMulti(ctx context.Context, family string, host string, port int, fastOpen bool, bind sockopt.Control, mptcp bool, n int) ([]net.Listener, error) {
+	if n <= 1 {
+		l, err := listen(ctx, family, host, port, fastOpen, bind, mptcp, false)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := listen(ctx, family, host, port, fastOpen, bind, mptcp, true)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		// 端口为 0 时其余的监听器使用第一个监听器分配到的端口
+		port = l.Addr().(*net.TCPAddr).Port
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// parsePorts parses the comma separated ports and port ranges, e.g. "443,8443,20000-21000"
+func parsePorts(s string) ([]int, error) {
+	var ports []int
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		first, last := item, item
+		if i := strings.Index(item, "-"); i != -1 {
+			first, last = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+		from, err1 := strconv.Atoi(first)
+		to, err2 := strconv.Atoi(last)
+		if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+			return nil, common.NewError("invalid port or port range " + item)
+		}
+		for port := from; port <= to; port++ {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// listenPorts creates the listeners of all the ports, the connections of them are handled in the same way
+func listenPorts(ctx context.Context, family string, host string, ports []int, fastOpen bool, bind sockopt.Control, mptcp bool, n int) ([]net.Listener, error) {
+	var listeners []net.Listener
+	listened := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		if listened[port] {
+			continue
+		}
+		l, err := listenMulti(ctx, family, host, port, fastOpen, bind, mptcp, n)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, common.NewError("failed to listen on port " + strconv.Itoa(port)).Base(err)
+		}
+		listened[port] = true
+		listeners = append(listeners, l...)
+	}
+	if len(listened) > 1 {
+		log.Info("transport server is listening on", len(listened), "ports")
+	}
+	return listeners, nil
+}
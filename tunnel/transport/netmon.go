@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// carrierConn is a connection to the remote server, which is closed when the network changes
+type carrierConn struct {
+	net.Conn
+	client *Client
+	once   sync.Once
+}
+
+func (c *carrierConn) Metadata() *tunnel.Metadata {
+	return nil
+}
+
+func (c *carrierConn) Close() error {
+	c.once.Do(func() {
+		c.client.connsLock.Lock()
+		delete(c.client.conns, c)
+		c.client.connsLock.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// networkState describes the interfaces and the default routes, it changes when the client moves to another network.
+// IPv6 addresses are ignored since the temporary addresses rotate periodically
+func networkState() string {
+	var state []string
+	ifaces, err := net.Interfaces()
+	if err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			state = append(state, iface.Name)
+			addrs, _ := iface.Addrs()
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+					state = append(state, iface.Name+" "+ipNet.String())
+				}
+			}
+		}
+	}
+	// UDP 连接不会发送数据，只用于获取默认路由的出口地址
+	if conn, err := net.Dial("udp4", "8.8.8.8:53"); err == nil {
+		state = append(state, "route4 "+conn.LocalAddr().(*net.UDPAddr).IP.String())
+		conn.Close()
+	}
+	if conn, err := net.Dial("udp6", "[2001:4860:4860::8888]:53"); err == nil {
+		state = append(state, "route6")
+		conn.Close()
+	}
+	sort.Strings(state)
+	return strings.Join(state, ",")
+}
+
+var getNetworkState = networkState
+
+// watcherKind 在注册表中记录等待网络变化通知的通道
+const watcherKind = "transport.network_watcher"
+
+// WatchNetworkChange returns a channel notified after the carrier connections in the registry of ctx are closed
+// due to a network change or NotifyCarriersReset. The channel is removed when the context is done
+func WatchNetworkChange(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	remove := tunnel.RegistryFromContext(ctx).AddInstance(watcherKind, ch)
+	go func() {
+		<-ctx.Done()
+		remove()
+	}()
+	return ch
+}
+
+func notifyNetworkChange(ctx context.Context) {
+	for _, instance := range tunnel.RegistryFromContext(ctx).Instances(watcherKind) {
+		select {
+		case instance.(chan struct{}) <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// NotifyCarriersReset notifies the watchers in the registry of ctx after the carrier connections are closed by an upper layer,
+// e.g. the tls client closes the connections after the expectations of the server certificate change
+func NotifyCarriersReset(ctx context.Context) {
+	notifyNetworkChange(ctx)
+}
+
+// resetCarriers closes all connections to the remote server, the connections over the previous network may hang for minutes
+func (c *Client) resetCarriers() int {
+	c.connsLock.Lock()
+	conns := c.conns
+	c.conns = make(map[*carrierConn]struct{})
+	c.connsLock.Unlock()
+	for conn := range conns {
+		conn.Conn.Close()
+	}
+	return len(conns)
+}
+
+func (c *Client) monitorNetwork(checkRate time.Duration) {
+	last := getNetworkState()
+	ticker := time.NewTicker(checkRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			state := getNetworkState()
+			if state == last {
+				continue
+			}
+			last = state
+			log.Info("network changed, reconnecting to the remote server,", c.resetCarriers(), "connections closed")
+			notifyNetworkChange(c.ctx)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
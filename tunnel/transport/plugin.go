@@ -0,0 +1,206 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/backoff"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
+)
+
+// 插件运行超过该时间后退出，不再计入连续失败的次数
+const pluginStableTime = time.Minute
+
+var pluginRestarts = metrics.NewCounter("trojan_go_plugin_restarts_total", "Number of the transport plugin restarts.")
+
+// pluginSupervisor runs the transport plugin and restarts it with backoff after it exits.
+// The plugin is unhealthy if it keeps dying
+type pluginSupervisor struct {
+	sync.Mutex
+	command     string
+	args        []string
+	env         []string
+	pt          *ptManager // 为空时是 SIP003 插件
+	cmd         *exec.Cmd  // 正在运行的插件进程，退出后为空
+	started     time.Time  // 插件进程启动的时间
+	failures    int        // 连续失败的次数
+	maxFailures int
+	backoff     *backoff.Backoff
+	ctx         context.Context
+	cancel      context.CancelFunc
+	done        chan struct{}
+	unregister  func()
+}
+
+func (p *pluginSupervisor) start() error {
+	cmd := exec.Command(p.command, p.args...)
+	cmd.Env = append(cmd.Env, p.env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stdout
+	var stdout io.Reader
+	if p.pt != nil {
+		// 标准输入保持打开，trojan-go 退出后插件随之退出
+		if _, err := cmd.StdinPipe(); err != nil {
+			return common.NewError("failed to create transport plugin stdin").Base(err)
+		}
+		cmd.Stdout = nil
+		var err error
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return common.NewError("failed to create transport plugin stdout").Base(err)
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return common.NewError("failed to start transport plugin " + p.command).Base(err)
+	}
+	if p.pt != nil {
+		result := make(chan error, 1)
+		go func() {
+			result <- p.pt.negotiate(stdout)
+		}()
+		var err error
+		select {
+		case err = <-result:
+		case <-time.After(ptHandshakeTimeout):
+			err = common.NewError("pluggable transport handshake timed out")
+		}
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return common.NewError("failed to start transport plugin " + p.command).Base(err)
+		}
+	}
+	p.Lock()
+	defer p.Unlock()
+	select {
+	case <-p.ctx.Done(): // 启动时已经被关闭
+		cmd.Process.Kill()
+	default:
+	}
+	p.cmd = cmd
+	p.started = time.Now()
+	log.Info("transport plugin", p.command, "started, pid", cmd.Process.Pid)
+	return nil
+}
+
+func (p *pluginSupervisor) run() {
+	defer close(p.done)
+	for {
+		p.Lock()
+		cmd, started := p.cmd, p.started
+		p.Unlock()
+		if cmd != nil {
+			err := cmd.Wait()
+			p.Lock()
+			p.cmd = nil
+			p.Unlock()
+			select {
+			case <-p.ctx.Done():
+				return
+			default:
+			}
+			uptime := time.Since(started).Round(time.Millisecond)
+			if err != nil {
+				log.Error(common.NewError("transport plugin exited after " + uptime.String()).Base(err))
+			} else {
+				log.Error("transport plugin exited after", uptime)
+			}
+			if uptime >= pluginStableTime {
+				p.backoff.Reset()
+				p.Lock()
+				p.failures = 0
+				p.Unlock()
+			}
+		}
+		p.Lock()
+		p.failures++
+		if p.failures == p.maxFailures {
+			log.Error("transport plugin has failed", p.failures, "times in a row, it is unhealthy")
+		}
+		p.Unlock()
+
+		d := p.backoff.Next()
+		log.Info("restarting transport plugin in", d)
+		select {
+		case <-time.After(d):
+		case <-p.ctx.Done():
+			return
+		}
+		pluginRestarts.Inc()
+		if err := p.start(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// health fails if the plugin has failed too many times in a row and has not been running stably since then
+func (p *pluginSupervisor) health() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.failures < p.maxFailures {
+		return nil
+	}
+	if p.cmd != nil && time.Since(p.started) >= pluginStableTime {
+		return nil
+	}
+	return common.NewError("transport plugin keeps dying")
+}
+
+func (p *pluginSupervisor) close() {
+	p.cancel()
+	p.Lock()
+	if p.cmd != nil && p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+	p.Unlock()
+	<-p.done
+	p.unregister()
+}
+
+// newPluginSupervisor starts the plugin, an error is returned if it can't be started at all
+// The managed pluggable transport reports its address during the start if pt is not nil
+func newPluginSupervisor(ctx context.Context, cfg *TransportPluginConfig, pt *ptManager) (*pluginSupervisor, error) {
+	policy, err := backoff.New("transport_plugin", &cfg.Restart)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxFailures <= 0 {
+		return nil, common.NewError("invalid transport plugin max_failures, it must be positive")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p := &pluginSupervisor{
+		command:     cfg.Command,
+		args:        cfg.Arg,
+		env:         cfg.Env,
+		pt:          pt,
+		maxFailures: cfg.MaxFailures,
+		backoff:     policy.NewBackoff(),
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	if err := p.start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	unregisterCheck := metrics.RegisterHealthCheck("transport_plugin", p.health)
+	unregisterGauge := metrics.RegisterGauge(ctx, "trojan_go_plugin_up", "Whether the transport plugin is running.", func() float64 {
+		p.Lock()
+		defer p.Unlock()
+		if p.cmd != nil {
+			return 1
+		}
+		return 0
+	})
+	p.unregister = func() {
+		unregisterCheck()
+		unregisterGauge()
+	}
+	go p.run()
+	return p, nil
+}
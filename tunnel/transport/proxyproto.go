@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// 读取 PROXY 协议头部的超时时间
+const proxyHeaderTimeout = time.Second * 5
+
+// proxyConn is a connection with the client address from the PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// proxyProtocol reads the PROXY protocol headers sent by the trusted proxies
+type proxyProtocol struct {
+	trusted []*net.IPNet
+}
+
+func (p *proxyProtocol) trusts(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept reads the header of the connection from a trusted proxy, the connections from the other peers are unchanged
+func (p *proxyProtocol) accept(conn net.Conn) (net.Conn, error) {
+	if !p.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	// v1 头部至少有 15 字节，因此可以先读取 v2 签名的长度
+	buf := make([]byte, len(common.ProxyV2Signature))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, common.NewError("failed to read proxy protocol header").Base(err)
+	}
+	var remote net.Addr
+	var err error
+	switch {
+	case bytes.Equal(buf, common.ProxyV2Signature):
+		remote, err = readProxyV2(conn)
+	case bytes.HasPrefix(buf, []byte("PROXY ")):
+		remote, err = readProxyV1(conn, buf)
+	default:
+		err = common.NewError("no proxy protocol header")
+	}
+	if err != nil {
+		return nil, common.NewError("invalid proxy protocol header from " + conn.RemoteAddr().String()).Base(err)
+	}
+	if remote == nil { // 代理自身的连接，如健康检查
+		return conn, nil
+	}
+	return &proxyConn{
+		Conn:   conn,
+		remote: remote,
+	}, nil
+}
+
+// readProxyV1 reads the rest of the text header, e.g. "PROXY TCP4 1.2.3.4 5.6.7.8 1111 443\r\n"
+func readProxyV1(conn net.Conn, buf []byte) (net.Addr, error) {
+	line := append([]byte(nil), buf...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 { // 协议规定的最大长度
+			return nil, common.NewError("header too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, common.NewError("invalid header " + strconv.Quote(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, common.NewError("invalid source address in " + strconv.Quote(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads the rest of the binary header after the signature
+func readProxyV2(conn net.Conn) (net.Addr, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0]>>4 != 2 {
+		return nil, common.NewError("unsupported version")
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	switch header[0] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, common.NewError("unsupported command")
+	}
+	// 只关心 TCP 的源地址，其余的地址族和 TLV 忽略
+	switch header[1] {
+	case 0x11:
+		if len(data) < 12 {
+			return nil, common.NewError("invalid ipv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(data[:4]), Port: int(binary.BigEndian.Uint16(data[8:]))}, nil
+	case 0x21:
+		if len(data) < 36 {
+			return nil, common.NewError("invalid ipv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(data[:16]), Port: int(binary.BigEndian.Uint16(data[32:]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func newProxyProtocol(cfg *ProxyProtocolConfig) (*proxyProtocol, error) {
+	if len(cfg.TrustedProxies) == 0 {
+		return nil, common.NewError("proxy_protocol requires trusted_proxies")
+	}
+	trusted, err := common.ParseIPNets(cfg.TrustedProxies)
+	if err != nil {
+		return nil, common.NewError("invalid proxy_protocol trusted_proxies").Base(err)
+	}
+	return &proxyProtocol{
+		trusted: trusted,
+	}, nil
+}
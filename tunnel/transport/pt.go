@@ -0,0 +1,201 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+// 托管的 pluggable transport（Tor PT 的 managed 模式，如 obfs4proxy）：插件从环境变量读取配置，
+// 在标准输出报告监听的地址，标准输入关闭后退出。客户端插件提供 SOCKS5 代理，参数放在用户名和密码中
+
+// 等待插件报告监听地址的时间
+const ptHandshakeTimeout = time.Second * 30
+
+// ptManager speaks the managed proxy protocol with the plugin
+type ptManager struct {
+	sync.RWMutex
+	transport string
+	server    bool
+	options   string // k=v;k=v 形式的参数
+	addr      string // 插件报告的监听地址，每次重新启动后更新
+}
+
+// splitPTArgs splits the k=v;k=v args, the escaped semicolons are kept
+func splitPTArgs(args string) []string {
+	var result []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range args {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			current.WriteRune(r)
+			escaped = true
+		case r == ';':
+			result = append(result, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() != 0 {
+		result = append(result, current.String())
+	}
+	return result
+}
+
+// env returns the environment variables of the plugin. The server plugin listens on bindAddr
+// and forwards to orPort, the client plugin listens on a port chosen by itself
+func (m *ptManager) env(stateDir, bindAddr, orPort string) []string {
+	if abs, err := filepath.Abs(stateDir); err == nil {
+		stateDir = abs
+	}
+	env := []string{
+		"TOR_PT_MANAGED_TRANSPORT_VER=1",
+		"TOR_PT_STATE_LOCATION=" + stateDir,
+		"TOR_PT_EXIT_ON_STDIN_CLOSE=1",
+	}
+	if !m.server {
+		return append(env, "TOR_PT_CLIENT_TRANSPORTS="+m.transport)
+	}
+	env = append(env,
+		"TOR_PT_SERVER_TRANSPORTS="+m.transport,
+		"TOR_PT_SERVER_BINDADDR="+m.transport+"-"+bindAddr,
+		"TOR_PT_ORPORT="+orPort,
+	)
+	if args := splitPTArgs(m.options); len(args) != 0 {
+		for i := range args {
+			args[i] = m.transport + ":" + args[i]
+		}
+		env = append(env, "TOR_PT_SERVER_TRANSPORT_OPTIONS="+strings.Join(args, ";"))
+	}
+	return env
+}
+
+// parse handles a line of the handshake, done is true after the methods are all reported
+func (m *ptManager) parse(line string) (done bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+	switch fields[0] {
+	case "VERSION":
+		if len(fields) < 2 || fields[1] != "1" {
+			return false, common.NewError("unsupported pluggable transport version: " + line)
+		}
+	case "VERSION-ERROR", "ENV-ERROR", "PROXY-ERROR", "CMETHOD-ERROR", "SMETHOD-ERROR":
+		return false, common.NewError("pluggable transport error: " + line)
+	case "CMETHOD": // CMETHOD <transport> <socks4|socks5> <address>
+		if len(fields) < 4 || fields[1] != m.transport {
+			break
+		}
+		if fields[2] != "socks5" {
+			return false, common.NewError("unsupported pluggable transport proxy type: " + fields[2])
+		}
+		m.setAddress(fields[3])
+	case "SMETHOD": // SMETHOD <transport> <address> [ARGS:k=v,k=v]
+		if len(fields) < 3 || fields[1] != m.transport {
+			break
+		}
+		m.setAddress(fields[2])
+		for _, option := range fields[3:] {
+			if strings.HasPrefix(option, "ARGS:") {
+				// 客户端需要使用这些参数，例如 obfs4 的 cert
+				log.Info("pluggable transport", m.transport, "client options:", strings.ReplaceAll(strings.TrimPrefix(option, "ARGS:"), ",", ";"))
+			}
+		}
+	case "CMETHODS", "SMETHODS":
+		if len(fields) < 2 || fields[1] != "DONE" {
+			break
+		}
+		if m.address() == "" {
+			return false, common.NewError("pluggable transport " + m.transport + " is not provided by the plugin")
+		}
+		return true, nil
+	default:
+		log.Debug("pluggable transport:", line)
+	}
+	return false, nil
+}
+
+// negotiate reads the handshake from the output of the plugin, the rest of the output is copied to stdout
+func (m *ptManager) negotiate(r io.Reader) error {
+	m.setAddress("")
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			done, parseErr := m.parse(strings.TrimSpace(line))
+			if parseErr != nil {
+				return parseErr
+			}
+			if done {
+				go io.Copy(os.Stdout, reader)
+				log.Info("pluggable transport", m.transport, "is listening on", m.address())
+				return nil
+			}
+		}
+		if err != nil {
+			return common.NewError("pluggable transport exited during the handshake").Base(err)
+		}
+	}
+}
+
+func (m *ptManager) setAddress(addr string) {
+	m.Lock()
+	defer m.Unlock()
+	m.addr = addr
+}
+
+func (m *ptManager) address() string {
+	m.RLock()
+	defer m.RUnlock()
+	return m.addr
+}
+
+// ptAuth encodes the args into the username and password of socks5, the password can't be empty
+func ptAuth(args string) *proxy.Auth {
+	if args == "" {
+		return nil
+	}
+	if len(args) <= 255 {
+		return &proxy.Auth{
+			User:     args,
+			Password: "\x00",
+		}
+	}
+	return &proxy.Auth{
+		User:     args[:255],
+		Password: args[255:],
+	}
+}
+
+// dial connects to the target through the socks5 proxy of the client plugin
+func (m *ptManager) dial(ctx context.Context, target string) (net.Conn, error) {
+	addr := m.address()
+	if addr == "" {
+		return nil, common.NewError("pluggable transport is not running")
+	}
+	dialer, err := proxy.SOCKS5("tcp", addr, ptAuth(m.options), proxy.Direct)
+	if err != nil {
+		return nil, common.NewError("failed to init pluggable transport socks dialer").Base(err)
+	}
+	if d, ok := dialer.(proxy.ContextDialer); ok {
+		return d.DialContext(ctx, "tcp", target)
+	}
+	return dialer.Dial("tcp", target)
+}
@@ -5,53 +5,102 @@ import (
 	"context"
 	"net"
 	"net/http"
-	"os"
-	"os/exec"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/backoff"
+	"github.com/p4gefau1t/trojan-go/common/overload"
+	"github.com/p4gefau1t/trojan-go/common/sockopt"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
+	"github.com/p4gefau1t/trojan-go/statistic"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
 
+// 连接在通道已满时等待的时间
+var (
+	connQueueWait = metrics.QueueWait("transport")
+	wsQueueWait   = metrics.QueueWait("transport_websocket")
+)
+
 // Server is a server of transport layer
 type Server struct {
-	tcpListener net.Listener
-	cmd         *exec.Cmd
-	connChan    chan tunnel.Conn // 传递连接给上层 trojan 协议的通道
-	wsChan      chan tunnel.Conn // 传递连接给上层 websocket 协议的通道
-	httpLock    sync.RWMutex     // 读写锁，用来锁定 nextHTTP 操作
-	nextHTTP    bool             // 判断是否启用明文 HTTP 模式，默认为false
-	ctx         context.Context
-	cancel      context.CancelFunc
+	tcpListeners []net.Listener      // 开启 SO_REUSEPORT 时有多个监听器，各自独立地接受连接
+	hopper       *portHopper         // 开启端口跳跃时动态地创建和关闭监听器
+	proxyProto   *proxyProtocol      // 为空时不读取 PROXY 协议头部
+	plugin       *pluginSupervisor   // 为空时没有运行插件
+	udpConn      net.PacketConn      // 插件转发 UDP 时接收数据报，否则为空
+	connChan     chan tunnel.Conn    // 传递连接给上层 trojan 协议的通道
+	wsChan       chan tunnel.Conn    // 传递连接给上层 websocket 协议的通道
+	httpLock     sync.RWMutex        // 读写锁，用来锁定 nextHTTP 操作
+	nextHTTP     bool                // 判断是否启用明文 HTTP 模式，默认为false
+	accounting   bool                // 统计 TCP 连接上的字节
+	limiter      *overload.Limiter   // 过载时拒绝新的连接，为空时不限制
+	tcp          *sockopt.TCPOptions // 接受的 TCP 连接的选项，插件模式下为空
+	ctx          context.Context
+	cancel       context.CancelFunc
 }
 
 func (s *Server) Close() error {
 	s.cancel()
-	if s.cmd != nil && s.cmd.Process != nil {
-		s.cmd.Process.Kill()
+	if s.plugin != nil {
+		s.plugin.close()
+	}
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	if s.hopper != nil {
+		s.hopper.close()
+	}
+	var err error
+	for _, l := range s.tcpListeners {
+		if closeErr := l.Close(); closeErr != nil {
+			err = closeErr
+		}
 	}
-	return s.tcpListener.Close()
+	return err
 }
 
-func (s *Server) acceptLoop() {
+func (s *Server) acceptLoop(tcpListener net.Listener) {
+	b := backoff.NewAcceptBackoff("transport")
 	for {
 		// 循环接收连接
-		tcpConn, err := s.tcpListener.Accept()
+		tcpConn, err := tcpListener.Accept()
 		if err != nil {
-			select {
-			case <-s.ctx.Done(): // cancel() 取消协程
-			default:
-				log.Error(common.NewError("transport accept error").Base(err))
-				time.Sleep(time.Millisecond * 100)
+			// 关闭或端口跳跃关闭了不再使用的监听器时退出，其他错误（如 EMFILE）等待后继续接收
+			if !b.Wait(s.ctx, err) {
+				return
 			}
-			return // 在接受连接出错后终止循环，意味着服务器不再接受新的连接
+			continue
 		}
+		b.Reset()
 
-		go func(tcpConn net.Conn) {
+		s.tcp.Apply(tcpConn)
+		if _, ok := tcpConn.(*net.UnixConn); ok {
+			tcpConn = &unixConn{Conn: tcpConn}
+		}
+		release, ok := s.limiter.Admit()
+		if !ok { // 在 TLS 握手之前关闭，节省资源
+			tcpConn.Close()
+			continue
+		}
+		tcpConn = &admittedConn{Conn: tcpConn, release: release}
+		if s.accounting {
+			tcpConn = &wireConn{Conn: tcpConn}
+		}
+		go func(tcpConn net.Conn, accepted time.Time) {
+			if s.proxyProto != nil {
+				conn, err := s.proxyProto.accept(tcpConn)
+				if err != nil {
+					log.Error(common.NewError("transport failed to accept proxy protocol connection").Base(err))
+					tcpConn.Close()
+					return
+				}
+				tcpConn = conn
+			}
 			log.Info("tcp connection from", tcpConn.RemoteAddr())
 			s.httpLock.RLock() // 获取读锁，确保在检查 s.nextHTTP 时其他协程不会修改共享状态
 			if s.nextHTTP {    // plaintext mode enabled
@@ -70,24 +119,36 @@ func (s *Server) acceptLoop() {
 				if err != nil {
 					// this is not a http request, pass it to trojan protocol layer for further inspection
 					// 这不是一个http请求，将其传递给木马协议层进行进一步检查
+					start := time.Now()
 					s.connChan <- &Conn{
-						Conn: rewindConn,
+						Conn:     rewindConn,
+						Accepted: accepted,
+						Wire:     tcpConn,
 					}
+					connQueueWait.ObserveSince(start)
 				} else {
 					// this is a http request, pass it to websocket protocol layer
 					// 这是一个http请求，将其传递给websocket协议层
 					log.Debug("plaintext http request: ", httpReq)
+					start := time.Now()
 					s.wsChan <- &Conn{
-						Conn: rewindConn,
+						Conn:     rewindConn,
+						Accepted: accepted,
+						Wire:     tcpConn,
 					}
+					wsQueueWait.ObserveSince(start)
 				}
 			} else {
 				s.httpLock.RUnlock()
+				start := time.Now()
 				s.connChan <- &Conn{
-					Conn: tcpConn,
+					Conn:     tcpConn,
+					Accepted: accepted,
+					Wire:     tcpConn,
 				}
+				connQueueWait.ObserveSince(start)
 			}
-		}(tcpConn)
+		}(tcpConn, time.Now())
 	}
 }
 
@@ -120,12 +181,17 @@ func (s *Server) AcceptPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
 	panic("not supported")
 }
 
+// DatagramConn returns the udp socket receiving the datagrams relayed by the plugin, or nil if the plugin doesn't relay udp
+func (s *Server) DatagramConn() net.PacketConn {
+	return s.udpConn
+}
+
 // NewServer creates a transport layer server
 func NewServer(ctx context.Context, _ tunnel.Server) (*Server, error) {
 	cfg := config.FromContext(ctx, Name).(*Config)
 	listenAddress := tunnel.NewAddressFromHostPort("tcp", cfg.LocalHost, cfg.LocalPort)
+	var pt *ptManager
 
-	var cmd *exec.Cmd
 	if cfg.TransportPlugin.Enabled { // 是否开启传输层插件
 		log.Warn("transport server will use plugin and work in plain text mode")
 		switch cfg.TransportPlugin.Type {
@@ -147,39 +213,163 @@ func NewServer(ctx context.Context, _ tunnel.Server) (*Server, error) {
 			listenAddress = tunnel.NewAddressFromHostPort("tcp", cfg.LocalHost, cfg.LocalPort)
 			log.Debug("new listen address", listenAddress)
 			log.Debug("plugin env", cfg.TransportPlugin.Env)
-
-			// 执行对应插件命令
-			cmd = exec.Command(cfg.TransportPlugin.Command, cfg.TransportPlugin.Arg...)
-			cmd.Env = append(cmd.Env, cfg.TransportPlugin.Env...)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stdout
-			cmd.Start()
+		case "pt": // 托管的 pluggable transport，如 obfs4proxy，插件监听 local_addr:local_port
+			if cfg.TransportPlugin.Transport == "" {
+				return nil, common.NewError("transport plugin transport is required for pluggable transport")
+			}
+			trojanHost := "127.0.0.1"
+			trojanPort := common.PickPort("tcp", trojanHost)
+			pt = &ptManager{
+				transport: cfg.TransportPlugin.Transport,
+				server:    true,
+				options:   cfg.TransportPlugin.Option,
+			}
+			cfg.TransportPlugin.Env = append(cfg.TransportPlugin.Env, pt.env(
+				cfg.TransportPlugin.StateDir,
+				net.JoinHostPort(cfg.LocalHost, strconv.Itoa(cfg.LocalPort)),
+				net.JoinHostPort(trojanHost, strconv.Itoa(trojanPort)),
+			)...)
+			cfg.LocalHost = trojanHost
+			cfg.LocalPort = trojanPort
+			listenAddress = tunnel.NewAddressFromHostPort("tcp", cfg.LocalHost, cfg.LocalPort)
+			log.Debug("plugin env", cfg.TransportPlugin.Env)
 		case "other": // 非SIP003标准的插件
-			cmd = exec.Command(cfg.TransportPlugin.Command, cfg.TransportPlugin.Arg...)
-			cmd.Env = append(cmd.Env, cfg.TransportPlugin.Env...)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stdout
-			cmd.Start()
 		case "plaintext":
 			// do nothing
 		default:
 			return nil, common.NewError("invalid plugin type: " + cfg.TransportPlugin.Type)
 		}
+		if cfg.TransportPlugin.UDP && cfg.TransportPlugin.Type != "shadowsocks" {
+			return nil, common.NewError("transport plugin udp is only supported by the shadowsocks plugins")
+		}
 	}
-	tcpListener, err := net.Listen("tcp", listenAddress.String())
+	extraPorts, err := parsePorts(cfg.LocalPorts)
 	if err != nil {
-		return nil, err
+		return nil, common.NewError("invalid local_ports").Base(err)
+	}
+	var proxyProto *proxyProtocol
+	if cfg.ProxyProtocol.Enabled {
+		if proxyProto, err = newProxyProtocol(&cfg.ProxyProtocol); err != nil {
+			return nil, err
+		}
+		log.Info("transport server reads proxy protocol headers from", cfg.ProxyProtocol.TrustedProxies)
+	}
+	var schedule *portSchedule
+	if cfg.PortHopping.Enabled {
+		if schedule, err = newPortSchedule(&cfg.PortHopping); err != nil {
+			return nil, err
+		}
+	}
+	// 插件监听公开的地址，trojan-go 只监听本地回环地址
+	pluginListening := cfg.TransportPlugin.Enabled && (cfg.TransportPlugin.Type == "shadowsocks" || cfg.TransportPlugin.Type == "pt")
+	var bind sockopt.Control
+	if cfg.Interface != "" {
+		if cfg.TransportPlugin.Enabled && cfg.TransportPlugin.Type != "plaintext" {
+			log.Warn("interface is ignored when the transport plugin is used")
+		} else {
+			bind = sockopt.BindToInterface(cfg.Interface)
+			log.Info("transport server is listening on interface", cfg.Interface)
+		}
+	}
+	mptcp := cfg.MPTCP
+	if mptcp && (pluginListening || !sockopt.MultipathSupported) {
+		log.Warn("mptcp is ignored when the shadowsocks plugin or pluggable transport is used, or the binary is built with go older than 1.21")
+		mptcp = false
+	}
+	var tcpListeners []net.Listener
+	var udpConn net.PacketConn
+	if path, ok := unixSocketPath(cfg.LocalHost); ok && !pluginListening {
+		if len(extraPorts) != 0 || schedule != nil || cfg.Listeners > 1 {
+			log.Warn("local_ports, listeners and port_hopping are ignored when listening on a unix socket")
+			schedule = nil
+		}
+		var unixListener net.Listener
+		unixListener, err = listenUnix(path)
+		tcpListeners = []net.Listener{unixListener}
+		if err == nil {
+			log.Info("transport server is listening on unix socket", path)
+		}
+	} else if pluginListening {
+		// 插件模式下只监听插件转发的本地回环地址
+		if len(extraPorts) != 0 || schedule != nil {
+			log.Warn("local_ports and port_hopping are ignored when the shadowsocks plugin or pluggable transport is used")
+			schedule = nil
+		}
+		var tcpListener net.Listener
+		tcpListener, err = net.Listen("tcp", listenAddress.String())
+		tcpListeners = []net.Listener{tcpListener}
+		if err == nil && cfg.TransportPlugin.UDP {
+			// 插件把 UDP 数据报转发到同一个地址
+			if udpConn, err = net.ListenPacket("udp", listenAddress.String()); err != nil {
+				tcpListener.Close()
+			}
+		}
+	} else if schedule == nil {
+		// 所有端口的连接都交给同一个通道
+		ports := append([]int{cfg.LocalPort}, extraPorts...)
+		tcpListeners, err = listenPorts(ctx, cfg.ListenFamily, cfg.LocalHost, ports, cfg.TCPFastOpen, bind, mptcp, cfg.Listeners)
+	}
+	if err != nil {
+		return nil, common.NewError("transport server failed to listen").Base(err)
+	}
+	var plugin *pluginSupervisor
+	if cfg.TransportPlugin.Enabled && cfg.TransportPlugin.Type != "plaintext" {
+		// 监听之后再启动插件，插件退出后自动重新启动
+		if plugin, err = newPluginSupervisor(ctx, &cfg.TransportPlugin, pt); err != nil {
+			for _, l := range tcpListeners {
+				l.Close()
+			}
+			if udpConn != nil {
+				udpConn.Close()
+			}
+			return nil, err
+		}
 	}
 
+	var tcp *sockopt.TCPOptions
+	if !pluginListening { // 插件转发的连接来自本机
+		tcp = sockopt.NewTCPOptions(cfg.TCP.NoDelay, cfg.TCP.KeepAlive, cfg.TCP.KeepAliveInterval, cfg.TCP.UserTimeout)
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	server := &Server{
-		tcpListener: tcpListener,
-		cmd:         cmd,
-		ctx:         ctx,
-		cancel:      cancel,
-		connChan:    make(chan tunnel.Conn, 32),
-		wsChan:      make(chan tunnel.Conn, 32),
-	}
-	go server.acceptLoop()
+		tcpListeners: tcpListeners,
+		proxyProto:   proxyProto,
+		plugin:       plugin,
+		udpConn:      udpConn,
+		accounting:   statistic.AccountingFromContext(ctx) != nil,
+		limiter:      overload.LimiterFromContext(ctx),
+		tcp:          tcp,
+		ctx:          ctx,
+		cancel:       cancel,
+		connChan:     make(chan tunnel.Conn, 32),
+		wsChan:       make(chan tunnel.Conn, 32),
+	}
+	unregisterConn := metrics.RegisterQueue(ctx, "transport", func() int { return len(server.connChan) }, cap(server.connChan))
+	unregisterWS := metrics.RegisterQueue(ctx, "transport_websocket", func() int { return len(server.wsChan) }, cap(server.wsChan))
+	go func() {
+		<-ctx.Done()
+		unregisterConn()
+		unregisterWS()
+	}()
+	for _, l := range tcpListeners {
+		go server.acceptLoop(l)
+	}
+	if schedule != nil {
+		// 端口跳跃代替 local_port 和 local_ports 的监听器
+		server.hopper = &portHopper{
+			schedule: schedule,
+			server:   server,
+			listen: func(port int) ([]net.Listener, error) {
+				return listenMulti(ctx, cfg.ListenFamily, cfg.LocalHost, port, cfg.TCPFastOpen, bind, mptcp, cfg.Listeners)
+			},
+			listeners: make(map[int][]net.Listener),
+		}
+		server.hopper.update(time.Now())
+		go server.hopper.run(ctx)
+		log.Info("transport server is hopping among", len(schedule.ports), "ports every", cfg.PortHopping.Interval, "seconds")
+	}
+	if len(tcpListeners) > 1 {
+		log.Info("transport server is listening with", len(tcpListeners), "listeners")
+	}
 	return server, nil
 }
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly,!windows
+
+package transport
+
+import "github.com/p4gefau1t/trojan-go/common"
+
+func setV6Only(fd uintptr, v6only bool) error {
+	return common.NewError("IPV6_V6ONLY is not supported on this platform")
+}
+
+func setReusePort(fd uintptr) error {
+	return common.NewError("SO_REUSEPORT is not supported on this platform")
+}
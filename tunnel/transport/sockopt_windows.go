@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package transport
+
+import (
+	"syscall"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+func setV6Only(fd uintptr, v6only bool) error {
+	value := 0
+	if v6only {
+		value = 1
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, value)
+}
+
+// SO_REUSEADDR 在 Windows 上允许抢占端口，不能用于负载均衡
+func setReusePort(fd uintptr) error {
+	return common.NewError("SO_REUSEPORT is not supported on windows")
+}
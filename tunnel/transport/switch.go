@@ -0,0 +1,45 @@
+package transport
+
+import (
+	"context"
+
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// instanceKind 在注册表中记录可以切换服务器的客户端
+const instanceKind = "transport.client"
+
+func switchableClients(ctx context.Context) []*Client {
+	instances := tunnel.RegistryFromContext(ctx).Instances(instanceKind)
+	clients := make([]*Client, 0, len(instances))
+	for _, instance := range instances {
+		clients = append(clients, instance.(*Client))
+	}
+	return clients
+}
+
+// SwitchServer changes the remote server of the running transport clients in the registry of ctx.
+// Established connections are not affected. It returns the number of clients updated
+func SwitchServer(ctx context.Context, address *tunnel.Address) int {
+	clients := switchableClients(ctx)
+	for _, c := range clients {
+		c.serverAddressLock.Lock()
+		c.serverAddress = address
+		c.serverAddressLock.Unlock()
+	}
+	if len(clients) != 0 {
+		log.Info("remote server switched to", address)
+	}
+	return len(clients)
+}
+
+// CurrentServers returns the remote servers of the running transport clients in the registry of ctx
+func CurrentServers(ctx context.Context) []*tunnel.Address {
+	clients := switchableClients(ctx)
+	result := make([]*tunnel.Address, 0, len(clients))
+	for _, c := range clients {
+		result = append(result, c.getServerAddress())
+	}
+	return result
+}
@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import "syscall"
+
+const (
+	tcpFastOpen        = 0x17 // TCP_FASTOPEN
+	tcpFastOpenConnect = 0x1e // TCP_FASTOPEN_CONNECT，内核 4.11 起支持
+	fastOpenQueueLen   = 256  // 等待完成握手的 TFO 连接队列长度
+)
+
+func setFastOpen(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, fastOpenQueueLen)
+}
+
+func setFastOpenConnect(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package transport
+
+import "github.com/p4gefau1t/trojan-go/common"
+
+func setFastOpen(fd uintptr) error {
+	return common.NewError("tcp fast open is not supported on this platform")
+}
+
+func setFastOpenConnect(fd uintptr) error {
+	return common.NewError("tcp fast open is not supported on this platform")
+}
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package transport
+
+import (
+	"syscall"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+const tcpFastOpen = 15 // TCP_FASTOPEN
+
+func setFastOpen(fd uintptr) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_TCP, tcpFastOpen, 1)
+}
+
+// 客户端的 TFO 需要使用 ConnectEx，标准库的拨号器无法使用
+func setFastOpenConnect(fd uintptr) error {
+	return common.NewError("tcp fast open of the client is not supported on windows")
+}
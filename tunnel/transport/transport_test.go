@@ -2,12 +2,23 @@ package transport
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/backoff"
 	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/metrics"
 	"github.com/p4gefau1t/trojan-go/test/util"
 	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
 )
@@ -57,6 +68,12 @@ func TestTransport(t *testing.T) {
 	c.Close()
 }
 
+var testPluginRestart = backoff.Config{
+	InitialDelay: 10,
+	MaxDelay:     20,
+	Multiplier:   2,
+}
+
 func TestClientPlugin(t *testing.T) {
 	clientCfg := &Config{
 		LocalHost:  "127.0.0.1",
@@ -64,12 +81,12 @@ func TestClientPlugin(t *testing.T) {
 		RemoteHost: "127.0.0.1",
 		RemotePort: 12345,
 		TransportPlugin: TransportPluginConfig{
-			Enabled: true,
-			Type:    "shadowsocks",
-			Command: "echo $SS_REMOTE_PORT",
-			Option:  "",
-			Arg:     nil,
-			Env:     nil,
+			Enabled:     true,
+			Type:        "shadowsocks",
+			Command:     "sh",
+			Arg:         []string{"-c", "echo $SS_REMOTE_PORT"},
+			Restart:     testPluginRestart,
+			MaxFailures: 5,
 		},
 	}
 	ctx := config.WithConfig(context.Background(), Name, clientCfg)
@@ -87,12 +104,12 @@ func TestServerPlugin(t *testing.T) {
 		RemoteHost: "127.0.0.1",
 		RemotePort: 12345,
 		TransportPlugin: TransportPluginConfig{
-			Enabled: true,
-			Type:    "shadowsocks",
-			Command: "echo $SS_REMOTE_PORT",
-			Option:  "",
-			Arg:     nil,
-			Env:     nil,
+			Enabled:     true,
+			Type:        "shadowsocks",
+			Command:     "sh",
+			Arg:         []string{"-c", "echo $SS_REMOTE_PORT"},
+			Restart:     testPluginRestart,
+			MaxFailures: 5,
 		},
 	}
 	ctx := config.WithConfig(context.Background(), Name, cfg)
@@ -102,3 +119,586 @@ func TestServerPlugin(t *testing.T) {
 	common.Must(err)
 	s.Close()
 }
+
+func TestPluginSupervisor(t *testing.T) {
+	restarts := pluginRestarts.Value()
+	p, err := newPluginSupervisor(context.Background(), &TransportPluginConfig{
+		Command:     "sh",
+		Arg:         []string{"-c", "exit 1"},
+		Restart:     testPluginRestart,
+		MaxFailures: 3,
+	}, nil)
+	common.Must(err)
+	deadline := time.Now().Add(time.Second * 5)
+	for p.health() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("dying plugin is still healthy")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if pluginRestarts.Value()-restarts < 2 {
+		t.Fatal("plugin is not restarted", pluginRestarts.Value()-restarts)
+	}
+	if _, found := metrics.CheckHealth()["transport_plugin"]; !found {
+		t.Fatal("health check does not report the plugin")
+	}
+	p.close()
+	if _, found := metrics.CheckHealth()["transport_plugin"]; found {
+		t.Fatal("health check is not unregistered")
+	}
+
+	// 一直运行的插件是健康的，关闭时被终止
+	p, err = newPluginSupervisor(context.Background(), &TransportPluginConfig{
+		Command:     "sleep",
+		Arg:         []string{"10"},
+		Restart:     testPluginRestart,
+		MaxFailures: 3,
+	}, nil)
+	common.Must(err)
+	time.Sleep(time.Millisecond * 100)
+	if err := p.health(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	p.close()
+	if time.Since(start) > time.Second {
+		t.Fatal("plugin is not killed")
+	}
+
+	if _, err := newPluginSupervisor(context.Background(), &TransportPluginConfig{
+		Command:     "/nonexistent/plugin",
+		Restart:     testPluginRestart,
+		MaxFailures: 3,
+	}, nil); err == nil {
+		t.Fatal("started a nonexistent plugin")
+	}
+}
+
+func TestListenFamily(t *testing.T) {
+	for _, c := range []struct {
+		family  string
+		host    string
+		network string
+		ok      bool
+	}{
+		{familyDefault, "127.0.0.1", "tcp", true},
+		{familyIPv4, "0.0.0.0", "tcp4", true},
+		{familyIPv4, "::", "", false},
+		{familyIPv6, "::", "tcp6", true},
+		{familyIPv6, "127.0.0.1", "", false},
+		{familyDual, "", "tcp6", true},
+		{familyDual, "::", "tcp6", true},
+		{familyDual, "0.0.0.0", "", false},
+		{familyDual, "::1", "", false},
+		{"ipv5", "", "", false},
+	} {
+		network, _, err := listenNetwork(c.family, c.host, 443)
+		if (err == nil) != c.ok || network != c.network {
+			t.Fatal("unexpected result", c.family, c.host, network, err)
+		}
+	}
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	l, err := listen(context.Background(), familyIPv4, "127.0.0.1", port, false, nil, false, false)
+	common.Must(err)
+	if l.Addr().(*net.TCPAddr).IP.To4() == nil {
+		t.Fatal("not an ipv4 listener")
+	}
+	l.Close()
+}
+
+func TestTCPFastOpen(t *testing.T) {
+	serverCfg := &Config{
+		LocalHost:   "127.0.0.1",
+		LocalPort:   common.PickPort("tcp", "127.0.0.1"),
+		TCPFastOpen: true,
+	}
+	clientCfg := &Config{
+		RemoteHost:  "127.0.0.1",
+		RemotePort:  serverCfg.LocalPort,
+		TCPFastOpen: true,
+	}
+	sctx := config.WithConfig(context.Background(), Name, serverCfg)
+	cctx := config.WithConfig(context.Background(), Name, clientCfg)
+	cctx = config.WithConfig(cctx, freedom.Name, &freedom.Config{})
+
+	// 不支持 TFO 的平台上也能正常连接
+	s, err := NewServer(sctx, nil)
+	common.Must(err)
+	defer s.Close()
+	c, err := NewClient(cctx, nil)
+	common.Must(err)
+	defer c.Close()
+
+	var conn2 net.Conn
+	done := make(chan struct{})
+	go func() {
+		conn2, err = s.AcceptConn(nil)
+		common.Must(err)
+		close(done)
+	}()
+	conn1, err := c.DialConn(nil, nil)
+	common.Must(err)
+	<-done
+	if !util.CheckConn(conn1, conn2) {
+		t.Fail()
+	}
+	conn1.Close()
+	conn2.Close()
+}
+
+func TestMPTCP(t *testing.T) {
+	serverCfg := &Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: common.PickPort("tcp", "127.0.0.1"),
+		MPTCP:     true,
+	}
+	clientCfg := &Config{
+		RemoteHost: "127.0.0.1",
+		RemotePort: serverCfg.LocalPort,
+		MPTCP:      true,
+	}
+	sctx := config.WithConfig(context.Background(), Name, serverCfg)
+	cctx := config.WithConfig(context.Background(), Name, clientCfg)
+	cctx = config.WithConfig(cctx, freedom.Name, &freedom.Config{})
+
+	// 内核不支持 MPTCP 时使用普通的 TCP
+	s, err := NewServer(sctx, nil)
+	common.Must(err)
+	defer s.Close()
+	c, err := NewClient(cctx, nil)
+	common.Must(err)
+	defer c.Close()
+	if !c.direct.MultipathTCP {
+		t.Fatal("mptcp is not enabled on the client")
+	}
+
+	var conn2 net.Conn
+	done := make(chan struct{})
+	go func() {
+		conn2, err = s.AcceptConn(nil)
+		common.Must(err)
+		close(done)
+	}()
+	conn1, err := c.DialConn(nil, nil)
+	common.Must(err)
+	<-done
+	if !util.CheckConn(conn1, conn2) {
+		t.Fail()
+	}
+	conn1.Close()
+	conn2.Close()
+}
+
+func TestListeners(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	serverCfg := &Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: common.PickPort("tcp", "127.0.0.1"),
+		Listeners: 4,
+	}
+	clientCfg := &Config{
+		RemoteHost: "127.0.0.1",
+		RemotePort: serverCfg.LocalPort,
+	}
+	sctx := config.WithConfig(context.Background(), Name, serverCfg)
+	cctx := config.WithConfig(context.Background(), Name, clientCfg)
+	cctx = config.WithConfig(cctx, freedom.Name, &freedom.Config{})
+
+	s, err := NewServer(sctx, nil)
+	common.Must(err)
+	if len(s.tcpListeners) != 4 {
+		t.Fatal("unexpected listeners", len(s.tcpListeners))
+	}
+	c, err := NewClient(cctx, nil)
+	common.Must(err)
+	defer c.Close()
+
+	for i := 0; i < 16; i++ {
+		conn1, err := c.DialConn(nil, nil)
+		common.Must(err)
+		conn2, err := s.AcceptConn(nil)
+		common.Must(err)
+		if !util.CheckConn(conn1, conn2) {
+			t.Fail()
+		}
+		conn1.Close()
+		conn2.Close()
+	}
+
+	// 关闭后所有监听器都不再接受连接
+	s.Close()
+	if _, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(serverCfg.LocalPort))); err == nil {
+		t.Fatal("listeners are not closed")
+	}
+}
+
+func TestLocalPorts(t *testing.T) {
+	ports, err := parsePorts(" 443, 8443,20000-20002,")
+	common.Must(err)
+	if fmt.Sprint(ports) != "[443 8443 20000 20001 20002]" {
+		t.Fatal("unexpected ports", ports)
+	}
+	for _, s := range []string{"0", "abc", "3-1", "1-70000", "443-"} {
+		if _, err := parsePorts(s); err == nil {
+			t.Fatal("invalid ports accepted", s)
+		}
+	}
+
+	port1 := common.PickPort("tcp", "127.0.0.1")
+	port2 := common.PickPort("tcp", "127.0.0.1")
+	serverCfg := &Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port1,
+		LocalPorts: fmt.Sprintf("%d,%d-%d", port1, port2, port2), // 重复的端口只监听一次
+	}
+	s, err := NewServer(config.WithConfig(context.Background(), Name, serverCfg), nil)
+	common.Must(err)
+	defer s.Close()
+	if len(s.tcpListeners) != 2 {
+		t.Fatal("unexpected listeners", len(s.tcpListeners))
+	}
+	for _, port := range []int{port1, port2} {
+		conn1, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		common.Must(err)
+		conn2, err := s.AcceptConn(nil)
+		common.Must(err)
+		if !util.CheckConn(conn1, conn2) {
+			t.Fail()
+		}
+		conn1.Close()
+		conn2.Close()
+	}
+}
+
+func TestPortHopping(t *testing.T) {
+	ports := ""
+	for i := 0; i < 5; i++ {
+		ports += strconv.Itoa(common.PickPort("tcp", "127.0.0.1")) + ","
+	}
+	hopping := PortHoppingConfig{
+		Enabled:  true,
+		Ports:    ports,
+		Interval: 60,
+		Secret:   "secret",
+	}
+	serverCfg := &Config{
+		LocalHost:   "127.0.0.1",
+		PortHopping: hopping,
+	}
+	clientCfg := &Config{
+		RemoteHost:  "127.0.0.1",
+		PortHopping: hopping,
+	}
+	sctx := config.WithConfig(context.Background(), Name, serverCfg)
+	cctx := config.WithConfig(context.Background(), Name, clientCfg)
+	cctx = config.WithConfig(cctx, freedom.Name, &freedom.Config{})
+
+	s, err := NewServer(sctx, nil)
+	common.Must(err)
+	defer s.Close()
+	c, err := NewClient(cctx, nil)
+	common.Must(err)
+	defer c.Close()
+
+	conn1, err := c.DialConn(nil, nil)
+	common.Must(err)
+	conn2, err := s.AcceptConn(nil)
+	common.Must(err)
+	if !util.CheckConn(conn1, conn2) {
+		t.Fail()
+	}
+
+	// 只监听相邻三个时间段的端口，已经建立的连接不受轮换的影响
+	schedule := s.hopper.schedule
+	now := time.Now()
+	for i := 1; i <= 10; i++ {
+		later := now.Add(time.Duration(i) * time.Minute)
+		s.hopper.update(later)
+		slot := schedule.slot(later)
+		expected := map[int]bool{
+			schedule.port(slot - 1): true,
+			schedule.port(slot):     true,
+			schedule.port(slot + 1): true,
+		}
+		listened := s.hopper.ports()
+		if len(listened) != len(expected) {
+			t.Fatal("unexpected ports", listened)
+		}
+		for _, port := range listened {
+			if !expected[port] {
+				t.Fatal("unexpected port", port)
+			}
+		}
+	}
+	if !util.CheckConn(conn1, conn2) {
+		t.Fail()
+	}
+	conn1.Close()
+	conn2.Close()
+
+	// 不同的密钥得到不同的端口序列
+	other, err := newPortSchedule(&PortHoppingConfig{Ports: "1-65535", Interval: 60, Secret: "other"})
+	common.Must(err)
+	same, err := newPortSchedule(&PortHoppingConfig{Ports: "1-65535", Interval: 60, Secret: "secret"})
+	common.Must(err)
+	differs := false
+	for slot := int64(0); slot < 10; slot++ {
+		if other.port(slot) != same.port(slot) {
+			differs = true
+		}
+	}
+	if !differs {
+		t.Fatal("the schedule does not depend on the secret")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket is not supported")
+	}
+	path := filepath.Join(t.TempDir(), "trojan-go.sock")
+	// 上次运行残留的 socket 文件
+	stale, err := net.Listen("unix", path)
+	common.Must(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	serverCfg := &Config{
+		LocalHost: "unix://" + path,
+	}
+	clientCfg := &Config{
+		RemoteHost: "unix://" + path,
+	}
+	sctx := config.WithConfig(context.Background(), Name, serverCfg)
+	cctx := config.WithConfig(context.Background(), Name, clientCfg)
+	cctx = config.WithConfig(cctx, freedom.Name, &freedom.Config{})
+
+	s, err := NewServer(sctx, nil)
+	common.Must(err)
+	c, err := NewClient(cctx, nil)
+	common.Must(err)
+	defer c.Close()
+
+	conn1, err := c.DialConn(nil, nil)
+	common.Must(err)
+	conn2, err := s.AcceptConn(nil)
+	common.Must(err)
+	if !util.CheckConn(conn1, conn2) {
+		t.Fail()
+	}
+	// 上层按照 TCP 地址解析对端地址
+	if host, _, err := net.SplitHostPort(conn2.RemoteAddr().String()); err != nil || host != "127.0.0.1" {
+		t.Fatal("unexpected remote address", conn2.RemoteAddr())
+	}
+	conn1.Close()
+	conn2.Close()
+
+	s.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("unix socket is not removed")
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	serverCfg := &Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: common.PickPort("tcp", "127.0.0.1"),
+		ProxyProtocol: ProxyProtocolConfig{
+			Enabled:        true,
+			TrustedProxies: []string{"127.0.0.0/8"},
+		},
+	}
+	s, err := NewServer(config.WithConfig(context.Background(), Name, serverCfg), nil)
+	common.Must(err)
+	defer s.Close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(serverCfg.LocalPort))
+
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+	v2 = append(v2, 10, 0, 0, 2, 127, 0, 0, 1, 0x30, 0x39, 0x01, 0xbb)
+	testCases := []struct {
+		header []byte
+		remote string
+	}{
+		{[]byte("PROXY TCP4 1.2.3.4 127.0.0.1 1111 443\r\n"), "1.2.3.4:1111"},
+		{[]byte("PROXY TCP6 2001:db8::1 ::1 2222 443\r\n"), "[2001:db8::1]:2222"},
+		{v2, "10.0.0.2:12345"},
+	}
+	for _, tc := range testCases {
+		conn, err := net.Dial("tcp", addr)
+		common.Must(err)
+		conn.Write(append(tc.header, []byte("hello")...))
+		accepted, err := s.AcceptConn(nil)
+		common.Must(err)
+		if accepted.RemoteAddr().String() != tc.remote {
+			t.Fatal("unexpected remote address", accepted.RemoteAddr(), "expected", tc.remote)
+		}
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(accepted, buf)
+		common.Must(err)
+		if string(buf) != "hello" {
+			t.Fatal("unexpected payload", string(buf))
+		}
+		conn.Close()
+		accepted.Close()
+	}
+
+	// 可信代理的连接缺少头部时被拒绝
+	conn, err := net.Dial("tcp", addr)
+	common.Must(err)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection without header is accepted")
+	}
+	conn.Close()
+
+	proto, err := newProxyProtocol(&ProxyProtocolConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+	common.Must(err)
+	if proto.trusts(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}) || !proto.trusts(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Fatal("unexpected trusted proxies")
+	}
+	if _, err := newProxyProtocol(&ProxyProtocolConfig{}); err == nil {
+		t.Fatal("empty trusted proxies is accepted")
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	port := common.PickPort("tcp", "127.0.0.1")
+	clientCfg := &Config{
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+		DialRetry: backoff.Config{
+			MaxAttempts:  10,
+			InitialDelay: 50,
+			MaxDelay:     200,
+			Multiplier:   2,
+		},
+	}
+	cctx := config.WithConfig(context.Background(), Name, clientCfg)
+	cctx = config.WithConfig(cctx, freedom.Name, &freedom.Config{})
+	c, err := NewClient(cctx, nil)
+	common.Must(err)
+	defer c.Close()
+
+	// 服务器稍后才开始监听
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		common.Must(err)
+		conn, err := l.Accept()
+		common.Must(err)
+		conn.Close()
+		l.Close()
+	}()
+	conn, err := c.DialConn(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	clientCfg.DialRetry.Multiplier = 0
+	_, err = NewClient(cctx, nil)
+	if err == nil {
+		t.Fatal("invalid retry config is accepted")
+	}
+}
+
+func TestNetworkMonitor(t *testing.T) {
+	var state atomic.Value
+	state.Store("wifi1")
+	getNetworkState = func() string {
+		return state.Load().(string)
+	}
+	defer func() {
+		getNetworkState = networkState
+	}()
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	cfg := &Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+		NetworkMonitor: NetworkMonitorConfig{
+			Enabled:   true,
+			CheckRate: 1,
+		},
+	}
+	ctx := config.WithConfig(context.Background(), Name, cfg)
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	s, err := NewServer(ctx, nil)
+	common.Must(err)
+	defer s.Close()
+	c, err := NewClient(ctx, nil)
+	common.Must(err)
+	defer c.Close()
+
+	conn, err := c.DialConn(nil, nil)
+	common.Must(err)
+	defer conn.Close()
+	watchCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := WatchNetworkChange(watchCtx)
+
+	state.Store("wifi2")
+	select {
+	case <-changed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("network change is not detected")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("carrier connection is not closed")
+	}
+	conn, err = c.DialConn(nil, nil)
+	common.Must(err)
+	conn.Close()
+}
+
+func TestPluggableTransport(t *testing.T) {
+	pt := &ptManager{
+		transport: "obfs4",
+		server:    true,
+		options:   "cert=abc;iat-mode=0",
+	}
+	env := strings.Join(pt.env("state", "0.0.0.0:443", "127.0.0.1:1234"), "\n")
+	for _, expected := range []string{
+		"TOR_PT_SERVER_TRANSPORTS=obfs4",
+		"TOR_PT_SERVER_BINDADDR=obfs4-0.0.0.0:443",
+		"TOR_PT_ORPORT=127.0.0.1:1234",
+		"TOR_PT_SERVER_TRANSPORT_OPTIONS=obfs4:cert=abc;obfs4:iat-mode=0",
+	} {
+		if !strings.Contains(env, expected) {
+			t.Fatal("missing", expected, "in", env)
+		}
+	}
+	if auth := ptAuth(strings.Repeat("a", 300)); len(auth.User) != 255 || len(auth.Password) != 45 {
+		t.Fatal("wrong socks args", auth)
+	}
+
+	// 插件报告的地址在启动时读取，其余输出不影响握手
+	client := &ptManager{transport: "obfs4"}
+	p, err := newPluginSupervisor(context.Background(), &TransportPluginConfig{
+		Command: "sh",
+		Arg: []string{"-c", "echo VERSION 1; echo CMETHOD meek socks5 127.0.0.1:1; " +
+			"echo CMETHOD obfs4 socks5 127.0.0.1:2; echo CMETHODS DONE; echo hello; sleep 10"},
+		Restart:     testPluginRestart,
+		MaxFailures: 3,
+	}, client)
+	common.Must(err)
+	if client.address() != "127.0.0.1:2" {
+		t.Fatal("wrong transport address", client.address())
+	}
+	p.close()
+
+	if _, err := newPluginSupervisor(context.Background(), &TransportPluginConfig{
+		Command:     "sh",
+		Arg:         []string{"-c", "echo VERSION 1; echo CMETHOD-ERROR obfs4 broken; sleep 10"},
+		Restart:     testPluginRestart,
+		MaxFailures: 3,
+	}, &ptManager{transport: "obfs4"}); err == nil {
+		t.Fatal("started a broken pluggable transport")
+	}
+}
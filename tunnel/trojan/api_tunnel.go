@@ -0,0 +1,137 @@
+package trojan
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/common/backoff"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// APIConnDomain is the reserved destination for the API requests through the trojan tunnel
+const APIConnDomain = "API_CONN"
+
+type apiListenerKey struct{}
+
+// TunnelAddr is the remote address of the API connections through the trojan tunnel,
+// the API service uses it to identify the user
+type TunnelAddr struct {
+	net.Addr
+	Hash string // 用户 hash
+}
+
+type apiConn struct {
+	net.Conn
+	addr *TunnelAddr
+}
+
+func (c *apiConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// APIListener accepts the API connections through the trojan tunnel
+type APIListener struct {
+	connChan chan net.Conn
+	addr     net.Addr
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func (l *APIListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connChan:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, common.NewError("api listener closed")
+	}
+}
+
+func (l *APIListener) Close() error {
+	l.cancel()
+	return nil
+}
+
+func (l *APIListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *APIListener) add(conn *InboundConn) {
+	select {
+	case l.connChan <- &apiConn{
+		Conn: conn,
+		addr: &TunnelAddr{
+			Addr: conn.RemoteAddr(),
+			Hash: conn.hash,
+		},
+	}:
+	case <-l.ctx.Done():
+		conn.Close()
+	}
+}
+
+func NewAPIListener(ctx context.Context, addr net.Addr) *APIListener {
+	ctx, cancel := context.WithCancel(ctx)
+	return &APIListener{
+		connChan: make(chan net.Conn, 16),
+		addr:     addr,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// WithAPIListener stores the listener into the context, so that the API service can serve on it
+func WithAPIListener(ctx context.Context, l *APIListener) context.Context {
+	return context.WithValue(ctx, apiListenerKey{}, l)
+}
+
+// APIListenerFromContext extracts the listener from a context
+func APIListenerFromContext(ctx context.Context) *APIListener {
+	l, _ := ctx.Value(apiListenerKey{}).(*APIListener)
+	return l
+}
+
+// forwardAPI listens locally and forwards the connections to the API service of the server through the tunnel
+func (c *Client) forwardAPI(listener net.Listener) {
+	defer listener.Close()
+	go func() {
+		<-c.ctx.Done()
+		listener.Close()
+	}()
+	b := backoff.NewAcceptBackoff("api_forwarder")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !b.Wait(c.ctx, err) {
+				return
+			}
+			continue
+		}
+		b.Reset()
+		go func(conn net.Conn) {
+			defer conn.Close()
+			remote, err := c.DialConn(&tunnel.Address{
+				DomainName:  APIConnDomain,
+				AddressType: tunnel.DomainName,
+			}, nil)
+			if err != nil {
+				log.Error(common.NewError("failed to dial server api").Base(err))
+				return
+			}
+			defer remote.Close()
+			errChan := make(chan error, 2)
+			copyConn := func(a, b net.Conn) {
+				_, err := io.Copy(a, b)
+				errChan <- err
+			}
+			go copyConn(conn, remote)
+			go copyConn(remote, conn)
+			select {
+			case <-errChan:
+			case <-c.ctx.Done():
+			}
+		}(conn)
+	}
+}
@@ -18,10 +18,6 @@ import (
 	"github.com/p4gefau1t/trojan-go/tunnel/mux"
 )
 
-const (
-	MaxPacketSize = 1024 * 8
-)
-
 const (
 	Connect   tunnel.Command = 1
 	Associate tunnel.Command = 3
@@ -40,6 +36,10 @@ type OutboundConn struct {
 	metadata          *tunnel.Metadata
 	user              statistic.User
 	headerWrittenOnce sync.Once
+	stats             *ClientStats
+	destination       *DestinationStats
+	jitter            *Jitter // 为空时不延迟
+	closeOnce         sync.Once
 	net.Conn
 }
 
@@ -52,7 +52,7 @@ func (c *OutboundConn) WriteHeader(payload []byte) (bool, error) {
 	written := false
 	c.headerWrittenOnce.Do(func() {
 		hash := c.user.Hash()
-		buf := bytes.NewBuffer(make([]byte, 0, MaxPacketSize))
+		buf := bytes.NewBuffer(make([]byte, 0, common.PacketSize()))
 		crlf := []byte{0x0d, 0x0a}
 		buf.Write([]byte(hash))
 		buf.Write(crlf)
@@ -77,9 +77,15 @@ func (c *OutboundConn) Write(p []byte) (int, error) {
 	if written {
 		return len(p), nil
 	}
+	if c.jitter != nil {
+		c.jitter.wait()
+	}
 	n, err := c.Conn.Write(p)
 	c.user.AddTraffic(n, 0)
 	atomic.AddUint64(&c.sent, uint64(n))
+	if c.destination != nil {
+		c.destination.onSent(n)
+	}
 	return n, err
 }
 
@@ -87,17 +93,31 @@ func (c *OutboundConn) Read(p []byte) (int, error) {
 	n, err := c.Conn.Read(p)
 	c.user.AddTraffic(0, n)
 	atomic.AddUint64(&c.recv, uint64(n))
+	if c.destination != nil {
+		c.destination.onRecv(n)
+	}
 	return n, err
 }
 
 func (c *OutboundConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.destination != nil {
+			c.stats.onClose(c.destination)
+		}
+	})
 	log.Info("connection to", c.metadata, "closed", "sent:", common.HumanFriendlyTraffic(atomic.LoadUint64(&c.sent)), "recv:", common.HumanFriendlyTraffic(atomic.LoadUint64(&c.recv)))
 	return c.Conn.Close()
 }
 
 type Client struct {
 	underlay tunnel.Client
+	datagram tunnel.DatagramDialer // 传输层插件转发 UDP 时为非空
 	user     statistic.User
+	stats    *ClientStats
+	prober   *Prober
+	jitter   *Jitter
+	muxHead  *tunnel.Metadata // 多路复用连接的请求
+	fragment int              // 插件转发的数据报的最大长度，0 表示不分片
 	ctx      context.Context
 	cancel   context.CancelFunc
 }
@@ -107,21 +127,56 @@ func (c *Client) Close() error {
 	return c.underlay.Close()
 }
 
-func (c *Client) DialConn(addr *tunnel.Address, overlay tunnel.Tunnel) (tunnel.Conn, error) {
+// dial connects to the server and records the statistics
+func (c *Client) dial(addr *tunnel.Address) (tunnel.Conn, error) {
+	start := time.Now()
 	conn, err := c.underlay.DialConn(addr, &Tunnel{})
+	c.stats.onDial(time.Since(start), err)
+	return conn, err
+}
+
+// muxHead returns the request of the mux connections. Without the identifier the address is 0.0.0.0:0,
+// which is ignored by the server as the command is checked first
+func muxHead(cfg *MuxConfig) *tunnel.Metadata {
+	address := &tunnel.Address{
+		AddressType: tunnel.IPv4,
+		IP:          net.IPv4zero,
+	}
+	if cfg.Identifier != "" {
+		address = &tunnel.Address{
+			AddressType: tunnel.DomainName,
+			DomainName:  cfg.Identifier,
+		}
+	}
+	return &tunnel.Metadata{
+		Command: cfg.command(),
+		Address: address,
+	}
+}
+
+func (c *Client) DialConn(addr *tunnel.Address, overlay tunnel.Tunnel) (tunnel.Conn, error) {
+	conn, err := c.dial(addr)
 	if err != nil {
 		return nil, err
 	}
 	newConn := &OutboundConn{
-		Conn: conn,
-		user: c.user,
+		Conn:   conn,
+		user:   c.user,
+		stats:  c.stats,
+		jitter: c.jitter,
 		metadata: &tunnel.Metadata{
 			Command: Connect,
 			Address: addr,
 		},
 	}
 	if _, ok := overlay.(*mux.Tunnel); ok {
-		newConn.metadata.Command = Mux
+		// 多路复用连接的目标地址对客户端不可见，由上层按每个流的目标地址记录
+		newConn.metadata = &tunnel.Metadata{
+			Command: c.muxHead.Command,
+			Address: c.muxHead.Address,
+		}
+	} else {
+		newConn.destination = c.stats.onOpen(addr.String())
 	}
 
 	go func(newConn *OutboundConn) {
@@ -134,18 +189,34 @@ func (c *Client) DialConn(addr *tunnel.Address, overlay tunnel.Tunnel) (tunnel.C
 }
 
 func (c *Client) DialPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
+	if c.datagram != nil { // UDP 包直接通过插件转发，不建立 TCP 连接
+		conn, err := c.datagram.DialDatagram()
+		if err != nil {
+			return nil, err
+		}
+		return &datagramConn{
+			Conn:     conn,
+			hash:     c.user.Hash(),
+			user:     c.user,
+			fragment: c.fragment,
+			partials: newReassembler(),
+		}, nil
+	}
 	fakeAddr := &tunnel.Address{
 		DomainName:  "UDP_CONN",
 		AddressType: tunnel.DomainName,
 	}
-	conn, err := c.underlay.DialConn(fakeAddr, &Tunnel{})
+	conn, err := c.dial(fakeAddr)
 	if err != nil {
 		return nil, err
 	}
 	return &PacketConn{
 		Conn: &OutboundConn{
-			Conn: conn,
-			user: c.user,
+			Conn:        conn,
+			user:        c.user,
+			stats:       c.stats,
+			destination: c.stats.onOpen("udp"),
+			jitter:      c.jitter,
 			metadata: &tunnel.Metadata{
 				Command: Associate,
 				Address: fakeAddr,
@@ -162,10 +233,11 @@ func NewClient(ctx context.Context, client tunnel.Client) (*Client, error) {
 		return nil, err
 	}
 
-	cfg := config.FromContext(ctx, Name).(*Config)
-	if cfg.API.Enabled {
-		go api.RunService(ctx, Name+"_CLIENT", auth)
-	}
+	// 同一个代理中的 trojan 客户端共用统计，多路复用之上的流也记录在其中
+	stats := tunnel.RegistryFromContext(ctx).Shared(clientStatsKind, func() interface{} {
+		return NewClientStats()
+	}).(*ClientStats)
+	ctx = WithClientStats(ctx, stats)
 
 	var user statistic.User
 	for _, u := range auth.ListUsers() {
@@ -177,11 +249,64 @@ func NewClient(ctx context.Context, client tunnel.Client) (*Client, error) {
 		return nil, common.NewError("no valid user found")
 	}
 
-	log.Debug("trojan client created")
-	return &Client{
+	c := &Client{
 		underlay: client,
 		ctx:      ctx,
 		user:     user,
+		stats:    stats,
 		cancel:   cancel,
-	}, nil
+	}
+
+	if d, ok := client.(tunnel.DatagramDialer); ok && d.DatagramEnabled() {
+		c.datagram = d
+		log.Info("udp packets are relayed by the transport plugin in datagrams")
+	}
+
+	cfg := config.FromContext(ctx, Name).(*Config)
+	c.muxHead = muxHead(&cfg.Mux)
+	c.fragment = cfg.UDP.FragmentSize
+	if cfg.Jitter.Enabled {
+		jitter, err := NewJitter(&cfg.Jitter)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		c.jitter = jitter
+		log.Info("write jitter enabled, it increases the latency")
+	}
+	if cfg.Probe.Enabled { // 后台探测服务器的延迟和可用性
+		prober, err := NewProber(c, &cfg.Probe)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		c.prober = prober
+		ctx = WithProber(ctx, prober)
+		go prober.run(ctx)
+	}
+	if cfg.Cover.Enabled { // 空闲时访问伪装站点
+		cover, err := NewCover(c, &cfg.Cover, cfg.RemoteHost)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		go cover.run(ctx)
+		log.Info("cover traffic enabled")
+	}
+	if cfg.API.Enabled {
+		go api.RunService(ctx, Name+"_CLIENT", auth)
+	}
+	if cfg.API.Tunnel.Enabled { // 在本地转发服务端的 API
+		addr := tunnel.NewAddressFromHostPort("tcp", cfg.API.Tunnel.LocalHost, cfg.API.Tunnel.LocalPort)
+		listener, err := net.Listen("tcp", addr.String())
+		if err != nil {
+			cancel()
+			return nil, common.NewError("failed to listen for server api forwarding").Base(err)
+		}
+		log.Info("server api is forwarded to", listener.Addr().String())
+		go c.forwardAPI(listener)
+	}
+
+	log.Debug("trojan client created")
+	return c, nil
 }
@@ -1,15 +1,36 @@
 package trojan
 
-import "github.com/p4gefau1t/trojan-go/config"
+import (
+	"strconv"
+
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/statistic"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
 
 type Config struct {
-	LocalHost        string      `json:"local_addr" yaml:"local-addr"`
-	LocalPort        int         `json:"local_port" yaml:"local-port"`
-	RemoteHost       string      `json:"remote_addr" yaml:"remote-addr"`
-	RemotePort       int         `json:"remote_port" yaml:"remote-port"`
-	DisableHTTPCheck bool        `json:"disable_http_check" yaml:"disable-http-check"`
-	MySQL            MySQLConfig `json:"mysql" yaml:"mysql"`
-	API              APIConfig   `json:"api" yaml:"api"`
+	LocalHost        string                `json:"local_addr" yaml:"local-addr"`
+	LocalPort        int                   `json:"local_port" yaml:"local-port"`
+	RemoteHost       string                `json:"remote_addr" yaml:"remote-addr"`
+	RemotePort       int                   `json:"remote_port" yaml:"remote-port"`
+	DisableHTTPCheck bool                  `json:"disable_http_check" yaml:"disable-http-check"`
+	MySQL            MySQLConfig           `json:"mysql" yaml:"mysql"`
+	API              APIConfig             `json:"api" yaml:"api"`
+	UDP              UDPConfig             `json:"udp" yaml:"udp"`
+	Probe            ProbeConfig           `json:"probe" yaml:"probe"`
+	Hooks            HooksConfig           `json:"hooks" yaml:"hooks"`
+	Events           EventsConfig          `json:"events" yaml:"events"`
+	Tarpit           TarpitConfig          `json:"tarpit" yaml:"tarpit"`
+	ProbeResistance  ProbeResistanceConfig `json:"probe_resistance" yaml:"probe-resistance"`
+	Capture          CaptureConfig         `json:"capture" yaml:"capture"`
+	Jitter           JitterConfig          `json:"jitter" yaml:"jitter"`
+	Cover            CoverConfig           `json:"cover" yaml:"cover"`
+	Usage            statistic.UsageConfig `json:"usage" yaml:"usage"`
+	SlowHandshake    SlowHandshakeConfig   `json:"slow_handshake" yaml:"slow-handshake"`
+	AuthTimeout      int                   `json:"auth_timeout" yaml:"auth-timeout"` // 秒，0 表示不限制
+	AntiReplay       AntiReplayConfig      `json:"anti_replay" yaml:"anti-replay"`
+	Mux              MuxConfig             `json:"mux" yaml:"mux"` // 与 mux 共用同一个配置项
+	UserFallbacks    []UserFallbackConfig  `json:"user_fallbacks" yaml:"user-fallbacks"`
 }
 
 type MySQLConfig struct {
@@ -17,11 +38,234 @@ type MySQLConfig struct {
 }
 
 type APIConfig struct {
+	Enabled bool            `json:"enabled" yaml:"enabled"`
+	Tunnel  APITunnelConfig `json:"tunnel" yaml:"tunnel"`
+}
+
+// APITunnelConfig 通过 trojan 隧道访问服务端 API，客户端在本地监听并转发到服务端
+type APITunnelConfig struct {
+	Enabled   bool   `json:"enabled" yaml:"enabled"`
+	LocalHost string `json:"local_addr" yaml:"local-addr"`
+	LocalPort int    `json:"local_port" yaml:"local-port"`
+}
+
+type UDPConfig struct {
+	MaxSessions        int `json:"max_sessions" yaml:"max-sessions"`
+	MaxSessionsPerUser int `json:"max_sessions_per_user" yaml:"max-sessions-per-user"`
+	FragmentSize       int `json:"fragment_size" yaml:"fragment-size"` // 插件转发的数据报的最大长度，0 表示不分片
+}
+
+// ProbeConfig 客户端对服务器的延迟和可用性探测
+type ProbeConfig struct {
+	Enabled   bool   `json:"enabled" yaml:"enabled"`
+	Interval  int    `json:"interval" yaml:"interval"`
+	Timeout   int    `json:"timeout" yaml:"timeout"`
+	Target    string `json:"target" yaml:"target"`
+	Threshold int    `json:"threshold" yaml:"threshold"`
+	History   int    `json:"history" yaml:"history"`
+}
+
+// HooksConfig 用户连接和断开时执行的外部命令或 webhook
+type HooksConfig struct {
+	OnConnect     HookConfig `json:"on_connect" yaml:"on-connect"`
+	OnDisconnect  HookConfig `json:"on_disconnect" yaml:"on-disconnect"`
+	Timeout       int        `json:"timeout" yaml:"timeout"`
+	MaxConcurrent int        `json:"max_concurrent" yaml:"max-concurrent"`
+}
+
+type HookConfig struct {
+	Exec    []string `json:"exec" yaml:"exec"`
+	Webhook string   `json:"webhook" yaml:"webhook"`
+}
+
+// EventsConfig 连接建立和关闭的事件流，写入文件或批量发送到 webhook
+type EventsConfig struct {
+	File    string `json:"file" yaml:"file"`
+	Webhook string `json:"webhook" yaml:"webhook"`
+	Buffer  int    `json:"buffer" yaml:"buffer"` // 等待发送到 webhook 的事件数量上限
+}
+
+// TarpitConfig 拖住认证失败的探测连接，而不是重定向到伪装服务器
+type TarpitConfig struct {
+	Enabled  bool `json:"enabled" yaml:"enabled"`
+	MaxConns int  `json:"max_conns" yaml:"max-conns"`
+	Interval int  `json:"interval" yaml:"interval"`
+	Duration int  `json:"duration" yaml:"duration"`
+}
+
+// ProbeResistanceConfig 认证失败的连接在随机延迟后再重定向，使主动探测无法通过时序区分失败的阶段
+type ProbeResistanceConfig struct {
+	Enabled  bool `json:"enabled" yaml:"enabled"`
+	MinDelay int  `json:"min_delay" yaml:"min-delay"` // 毫秒
+	MaxDelay int  `json:"max_delay" yaml:"max-delay"` // 毫秒
+}
+
+// CaptureConfig 将被拒绝的连接的前若干字节记录到磁盘，用于排查探测者发送的内容
+type CaptureConfig struct {
+	Enabled    bool   `json:"enabled" yaml:"enabled"`
+	Path       string `json:"path" yaml:"path"`
+	MaxBytes   int    `json:"max_bytes" yaml:"max-bytes"`
+	MaxRecords int    `json:"max_records" yaml:"max-records"`
+}
+
+// JitterConfig 客户端每次写入前的随机延迟，用于模糊流量的时序特征
+type JitterConfig struct {
+	Enabled      bool   `json:"enabled" yaml:"enabled"`
+	Min          int    `json:"min" yaml:"min"`
+	Max          int    `json:"max" yaml:"max"`
+	Distribution string `json:"distribution" yaml:"distribution"`
+}
+
+// CoverConfig 客户端空闲时向伪装站点发送低频的 HTTPS 请求，使长期的流量特征更接近正常浏览
+type CoverConfig struct {
+	Enabled  bool     `json:"enabled" yaml:"enabled"`
+	Host     string   `json:"host" yaml:"host"`
+	Paths    []string `json:"paths" yaml:"paths"`
+	Idle     int      `json:"idle" yaml:"idle"`
+	Interval int      `json:"interval" yaml:"interval"`
+	MaxSize  int      `json:"max_size" yaml:"max-size"`
+}
+
+// SlowHandshakeConfig 服务端记录耗时超过阈值的握手及各阶段的耗时
+type SlowHandshakeConfig struct {
+	Threshold int                    `json:"threshold" yaml:"threshold"` // 毫秒，0 表示不记录
+	Profile   HandshakeProfileConfig `json:"profile" yaml:"profile"`
+}
+
+// HandshakeProfileConfig 慢握手持续出现时自动采集 CPU profile
+type HandshakeProfileConfig struct {
+	Enabled  bool   `json:"enabled" yaml:"enabled"`
+	Path     string `json:"path" yaml:"path"`         // 保存 profile 的目录
+	Count    int    `json:"count" yaml:"count"`       // window 秒内出现 count 次慢握手时开始采集
+	Window   int    `json:"window" yaml:"window"`     // 秒
+	Duration int    `json:"duration" yaml:"duration"` // 每次采集的秒数
+	Cooldown int    `json:"cooldown" yaml:"cooldown"` // 两次采集之间至少间隔的秒数
+}
+
+// AntiReplayConfig 记录最近的握手，将重放的握手当作探测重定向到伪装服务器
+type AntiReplayConfig struct {
 	Enabled bool `json:"enabled" yaml:"enabled"`
+	Window  int  `json:"window" yaml:"window"` // 秒
+	Size    int  `json:"size" yaml:"size"`     // 最多记录的握手数量
+}
+
+// MuxConfig 多路复用连接在 trojan 请求中的标识，客户端和服务端需要一致
+type MuxConfig struct {
+	Command    int    `json:"command" yaml:"command"`       // 多路复用连接的命令字节，0 时使用 0x7f
+	Identifier string `json:"identifier" yaml:"identifier"` // 多路复用连接的目标域名，服务端将连接到该域名的请求也当作多路复用，为空时不识别
+}
+
+// UserFallbackConfig redirects the failed connections of the user to a different address. The hash "*" matches
+// all the other users, i.e. the connections starting with a well-formed hash which is not accepted
+type UserFallbackConfig struct {
+	Password   string `json:"password" yaml:"password"`
+	Hash       string `json:"hash" yaml:"hash"`
+	RemoteHost string `json:"remote_addr" yaml:"remote-addr"`
+	RemotePort int    `json:"remote_port" yaml:"remote-port"`
+}
+
+// command returns the command byte of the mux connections
+func (c *MuxConfig) command() tunnel.Command {
+	if c.Command == 0 {
+		return Mux
+	}
+	return tunnel.Command(c.Command)
+}
+
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if c.AuthTimeout < 0 {
+		errs.Add("auth_timeout", "must not be negative")
+	}
+	if c.Mux.Command < 0 || c.Mux.Command > 0xff {
+		errs.Add("mux.command", "must be a byte")
+	} else if cmd := c.Mux.command(); cmd == Connect || cmd == Associate {
+		errs.Add("mux.command", "conflicts with the connect or associate command")
+	}
+	if len(c.Mux.Identifier) > 255 {
+		errs.Add("mux.identifier", "is too long")
+	}
+	if c.Events.Webhook != "" && c.Events.Buffer <= 0 {
+		errs.Add("events.buffer", "must be positive")
+	}
+	if c.UDP.FragmentSize != 0 && (c.UDP.FragmentSize < 128 || c.UDP.FragmentSize > maxDatagramSize) {
+		errs.Add("udp.fragment_size", "must be 0 or between 128 and "+strconv.Itoa(maxDatagramSize))
+	}
+	for i, fallback := range c.UserFallbacks {
+		path := "user_fallbacks[" + strconv.Itoa(i) + "]"
+		if (fallback.Password == "") == (fallback.Hash == "") {
+			errs.Add(path, "either password or hash is required")
+		} else if fallback.Hash != "" && fallback.Hash != "*" && !isHash(fallback.Hash) {
+			errs.Add(path+".hash", "invalid hash")
+		}
+		if fallback.RemotePort <= 0 || fallback.RemotePort > 65535 {
+			errs.Add(path+".remote_port", "invalid port "+strconv.Itoa(fallback.RemotePort))
+		}
+	}
+	if c.AntiReplay.Enabled {
+		if c.AntiReplay.Window <= 0 {
+			errs.Add("anti_replay.window", "must be positive")
+		}
+		if c.AntiReplay.Size <= 0 {
+			errs.Add("anti_replay.size", "must be positive")
+		}
+	}
+	return errs.Err()
 }
 
 func init() {
 	config.RegisterConfigCreator(Name, func() interface{} {
-		return &Config{}
+		return &Config{
+			AuthTimeout: 10,
+			Mux: MuxConfig{
+				Command:    int(Mux),
+				Identifier: "MUX_CONN",
+			},
+			Events: EventsConfig{
+				Buffer: 1024,
+			},
+			AntiReplay: AntiReplayConfig{
+				Window: 600,
+				Size:   65536,
+			},
+			Probe: ProbeConfig{
+				Interval:  30,
+				Timeout:   5,
+				Threshold: 1000,
+				History:   60,
+			},
+			Jitter: JitterConfig{
+				Max:          20,
+				Distribution: "uniform",
+			},
+			Cover: CoverConfig{
+				Idle:     30,
+				Interval: 20,
+				MaxSize:  1024 * 1024,
+			},
+			Tarpit: TarpitConfig{
+				MaxConns: 64,
+				Interval: 1000,
+				Duration: 600,
+			},
+			ProbeResistance: ProbeResistanceConfig{
+				MinDelay: 20,
+				MaxDelay: 200,
+			},
+			Capture: CaptureConfig{
+				Path:       "capture",
+				MaxBytes:   512,
+				MaxRecords: 256,
+			},
+			SlowHandshake: SlowHandshakeConfig{
+				Profile: HandshakeProfileConfig{
+					Path:     "profile",
+					Count:    20,
+					Window:   60,
+					Duration: 30,
+					Cooldown: 600,
+				},
+			},
+		}
 	})
 }
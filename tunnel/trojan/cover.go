@@ -0,0 +1,152 @@
+package trojan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+const (
+	coverTimeout  = time.Second * 30
+	coverMaxPaths = 32 // 从页面中发现的路径数量上限
+	coverUA       = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+)
+
+var coverLinkRegexp = regexp.MustCompile(`href="(/[^"#?]*)"`)
+
+// Cover sends low-rate HTTPS requests to the camouflage website through the server when the client is idle.
+// The requests are not authenticated, so the server redirects them to its remote_addr like a browser visiting the website
+type Cover struct {
+	client   *Client
+	host     string
+	paths    []string
+	idle     time.Duration
+	interval time.Duration
+	maxSize  int64
+}
+
+// request fetches the path and discovers the links in the page
+func (c *Cover) request(path string) error {
+	conn, err := c.client.underlay.DialConn(nil, &Tunnel{})
+	if err != nil {
+		return common.NewError("cover failed to connect to the server").Base(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(coverTimeout))
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\n"+
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\nAccept-Language: en-US,en;q=0.9\r\nConnection: close\r\n\r\n",
+		path, c.host, coverUA)
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return common.NewError("cover failed to send request").Base(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return common.NewError("cover failed to read response").Base(err)
+	}
+	defer resp.Body.Close()
+	body := bytes.NewBuffer(nil)
+	if _, err := io.Copy(body, io.LimitReader(resp.Body, c.maxSize)); err != nil {
+		return common.NewError("cover failed to read body").Base(err)
+	}
+	log.Debug("cover request", path, "status:", resp.StatusCode, "size:", body.Len())
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		c.discover(body.Bytes())
+	}
+	return nil
+}
+
+func (c *Cover) discover(page []byte) {
+	for _, match := range coverLinkRegexp.FindAllSubmatch(page, -1) {
+		if len(c.paths) >= coverMaxPaths {
+			return
+		}
+		path := string(match[1])
+		found := false
+		for _, p := range c.paths {
+			if p == path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.paths = append(c.paths, path)
+		}
+	}
+}
+
+// wait returns a random duration whose mean is the interval, so that the requests do not appear periodically
+func (c *Cover) wait() time.Duration {
+	d := time.Duration(rand.ExpFloat64() * float64(c.interval))
+	if d < time.Second {
+		d = time.Second
+	}
+	if d > c.interval*4 {
+		d = c.interval * 4
+	}
+	return d
+}
+
+func (c *Cover) traffic() uint64 {
+	sent, recv := c.client.user.GetTraffic()
+	return sent + recv
+}
+
+func (c *Cover) run(ctx context.Context) {
+	lastTraffic := c.traffic()
+	idleSince := time.Now()
+	for {
+		select {
+		case <-time.After(c.wait()):
+		case <-ctx.Done():
+			return
+		}
+		// 隧道中有流量或者活跃的连接时不发送
+		if traffic := c.traffic(); traffic != lastTraffic || c.client.stats.Snapshot().ActiveConnections != 0 {
+			lastTraffic = traffic
+			idleSince = time.Now()
+			continue
+		}
+		if time.Since(idleSince) < c.idle {
+			continue
+		}
+		if err := c.request(c.paths[rand.Intn(len(c.paths))]); err != nil {
+			log.Debug(err)
+		}
+	}
+}
+
+func NewCover(client *Client, cfg *CoverConfig, remoteHost string) (*Cover, error) {
+	c := &Cover{
+		client:   client,
+		host:     cfg.Host,
+		paths:    append([]string(nil), cfg.Paths...),
+		idle:     time.Duration(cfg.Idle) * time.Second,
+		interval: time.Duration(cfg.Interval) * time.Second,
+		maxSize:  int64(cfg.MaxSize),
+	}
+	if c.host == "" {
+		c.host = remoteHost
+	}
+	if len(c.paths) == 0 {
+		c.paths = []string{"/"}
+	}
+	for _, path := range c.paths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, common.NewError("invalid cover path " + path)
+		}
+	}
+	if c.idle < 0 || c.interval <= 0 || c.maxSize <= 0 {
+		return nil, common.NewError("invalid cover idle, interval or max size")
+	}
+	return c, nil
+}
@@ -0,0 +1,384 @@
+package trojan
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/statistic"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// 传输层插件转发 UDP 时（SIP003u），UDP 包不经过 trojan 的 TCP 连接，每个 trojan UDP 包单独作为一个数据报：
+// 客户端发出的数据报为 hex(SHA224(password)) CRLF 和 trojan UDP 包，服务端发出的数据报只有 trojan UDP 包。
+// 服务端根据数据报的来源地址区分会话
+
+const (
+	datagramHashLen = 56
+	maxDatagramSize = 65535
+)
+
+// 每个会话最多排队的数据报，读取不及时的数据报被丢弃
+const datagramBacklog = 64
+
+// writeDatagramPacket encodes a trojan udp packet without the stream framing
+func writeDatagramPacket(w *bytes.Buffer, payload []byte, m *tunnel.Metadata) error {
+	if err := m.Address.WriteTo(w); err != nil {
+		return common.NewError("failed to write udp packet addr").Base(err)
+	}
+	lengthBuf := [2]byte{}
+	binary.BigEndian.PutUint16(lengthBuf[:], uint16(len(payload)))
+	w.Write(lengthBuf[:])
+	w.Write([]byte{0x0d, 0x0a})
+	w.Write(payload)
+	return nil
+}
+
+// readDatagramPacket decodes a trojan udp packet, the length must match the rest of the datagram
+func readDatagramPacket(b []byte) (*tunnel.Address, []byte, error) {
+	r := bytes.NewReader(b)
+	addr := &tunnel.Address{
+		NetworkType: "udp",
+	}
+	if err := addr.ReadFrom(r); err != nil {
+		return nil, nil, common.NewError("failed to parse udp packet addr").Base(err)
+	}
+	header := [4]byte{} // 长度和 CRLF
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, common.NewError("failed to read length")
+	}
+	payload := b[len(b)-r.Len():]
+	if int(binary.BigEndian.Uint16(header[:2])) != len(payload) {
+		return nil, nil, common.NewError("udp packet length mismatch")
+	}
+	return addr, payload, nil
+}
+
+// datagramConn is the client side of the udp packets relayed by the plugin, one socket per association
+type datagramConn struct {
+	net.Conn
+	hash     string
+	user     statistic.User
+	fragment int // 数据报的最大长度，0 表示不分片
+	nextID   uint32
+	partials *reassembler
+}
+
+func (c *datagramConn) WriteWithMetadata(payload []byte, m *tunnel.Metadata) (int, error) {
+	w := bytes.NewBuffer(make([]byte, 0, common.PacketSize()))
+	w.WriteString(c.hash)
+	w.Write([]byte{0x0d, 0x0a})
+	if err := writeDatagramPacket(w, payload, m); err != nil {
+		return 0, err
+	}
+	send := func(b []byte) error {
+		_, err := c.Conn.Write(b)
+		return err
+	}
+	if err := sendDatagram(send, w.Bytes(), datagramHashLen+2, c.fragment, &c.nextID); err != nil {
+		return 0, err
+	}
+	c.user.AddTraffic(len(payload), 0)
+	log.Debug("udp datagram to", c.RemoteAddr(), "metadata", m, "size", len(payload))
+	return len(payload), nil
+}
+
+func (c *datagramConn) ReadWithMetadata(payload []byte) (int, *tunnel.Metadata, error) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		b := buf[:n]
+		if n > 0 && b[0] == fragmentMarker {
+			if b, err = c.partials.add("", b, time.Now()); err != nil || b == nil {
+				if err != nil {
+					log.Debug(common.NewError("invalid udp fragment from " + c.RemoteAddr().String()).Base(err))
+				}
+				continue
+			}
+		}
+		addr, p, err := readDatagramPacket(b)
+		if err != nil {
+			log.Debug(common.NewError("invalid udp datagram from " + c.RemoteAddr().String()).Base(err))
+			continue
+		}
+		if len(p) > len(payload) {
+			oversizedPackets.Inc()
+			log.Warn("udp datagram from", c.RemoteAddr(), "is larger than", len(payload), "bytes, dropped")
+			continue
+		}
+		c.user.AddTraffic(0, len(p))
+		return copy(payload, p), &tunnel.Metadata{
+			Address: addr,
+		}, nil
+	}
+}
+
+func (c *datagramConn) ReadFrom(payload []byte) (int, net.Addr, error) {
+	return c.ReadWithMetadata(payload)
+}
+
+func (c *datagramConn) WriteTo(payload []byte, addr net.Addr) (int, error) {
+	address, err := tunnel.NewAddressFromAddr("udp", addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return c.WriteWithMetadata(payload, &tunnel.Metadata{
+		Address: address,
+	})
+}
+
+type datagramPacket struct {
+	metadata *tunnel.Metadata
+	payload  []byte
+}
+
+// datagramServer receives the datagrams relayed by the plugin and dispatches them to the sessions by the source address
+type datagramServer struct {
+	sync.Mutex
+	conn       net.PacketConn
+	auth       statistic.Authenticator
+	sessions   *SessionTable
+	account    *statistic.Accounting
+	conns      map[string]*datagramSession // 来源地址 -> 会话
+	packetChan chan tunnel.PacketConn
+	fragment   int // 数据报的最大长度，0 表示不分片
+	nextID     uint32
+	partials   *reassembler
+	ctx        context.Context
+}
+
+func (s *datagramServer) loop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, src, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Error(common.NewError("trojan failed to receive datagram").Base(err))
+			continue
+		}
+		s.dispatch(buf[:n], src)
+	}
+}
+
+// dispatch authenticates the datagram and delivers the packet to the session of its source, invalid datagrams are dropped
+func (s *datagramServer) dispatch(b []byte, src net.Addr) {
+	if len(b) < datagramHashLen+2 || b[datagramHashLen] != 0x0d || b[datagramHashLen+1] != 0x0a {
+		log.Debug("malformed udp datagram from", src)
+		return
+	}
+	hash := string(b[:datagramHashLen])
+	valid, user := s.auth.AuthUser(hash)
+	if !valid {
+		log.Debug("invalid hash in udp datagram from", src)
+		return
+	}
+	b = b[datagramHashLen+2:]
+	if len(b) > 0 && b[0] == fragmentMarker {
+		var err error
+		if b, err = s.partials.add(src.String(), b, time.Now()); err != nil || b == nil {
+			if err != nil {
+				log.Debug(common.NewError("invalid udp fragment from " + src.String()).Base(err))
+			}
+			return
+		}
+	}
+	addr, payload, err := readDatagramPacket(b)
+	if err != nil {
+		log.Debug(common.NewError("invalid udp datagram from " + src.String()).Base(err))
+		return
+	}
+
+	key := src.String()
+	s.Lock()
+	c, found := s.conns[key]
+	s.Unlock()
+	if found && c.user.Hash() != hash {
+		log.Debug("udp datagram from", src, "has a different user, dropped")
+		return
+	}
+	if !found {
+		// 只有这个协程创建会话，登记时可能淘汰旧会话，因此不持有锁
+		c = &datagramSession{
+			server: s,
+			source: src,
+			user:   user,
+			input:  make(chan *datagramPacket, datagramBacklog),
+			done:   make(chan struct{}),
+		}
+		c.session = s.sessions.Add(user, src, c.Close)
+		s.Lock()
+		s.conns[key] = c
+		s.Unlock()
+		select {
+		case s.packetChan <- c:
+		case <-s.ctx.Done():
+			c.Close()
+			return
+		}
+		log.Info("udp session from", src, "through the transport plugin")
+	}
+	c.deliver(&datagramPacket{
+		metadata: &tunnel.Metadata{
+			Address: addr,
+			User:    user,
+		},
+		payload: append([]byte(nil), payload...),
+	})
+}
+
+func (s *datagramServer) remove(c *datagramSession) {
+	s.Lock()
+	defer s.Unlock()
+	if s.conns[c.source.String()] == c {
+		delete(s.conns, c.source.String())
+	}
+}
+
+func newDatagramServer(ctx context.Context, conn net.PacketConn, auth statistic.Authenticator, sessions *SessionTable,
+	account *statistic.Accounting, packetChan chan tunnel.PacketConn, fragment int) *datagramServer {
+	return &datagramServer{
+		conn:       conn,
+		auth:       auth,
+		sessions:   sessions,
+		account:    account,
+		conns:      make(map[string]*datagramSession),
+		packetChan: packetChan,
+		fragment:   fragment,
+		partials:   newReassembler(),
+		ctx:        ctx,
+	}
+}
+
+// datagramSession is the server side of the udp packets from a source address, it implements tunnel.PacketConn
+type datagramSession struct {
+	server   *datagramServer
+	source   net.Addr
+	user     statistic.User
+	session  *Session
+	input    chan *datagramPacket
+	done     chan struct{}
+	once     sync.Once
+	deadline tunnel.ReadDeadline
+}
+
+// addTraffic counts the datagrams as the wire traffic if the accounting is enabled
+func (c *datagramSession) addTraffic(sent, recv int) {
+	if c.server.account != nil {
+		c.server.account.AddWire(c.user, sent, recv)
+		return
+	}
+	c.user.AddTraffic(sent, recv)
+}
+
+func (c *datagramSession) deliver(packet *datagramPacket) {
+	select {
+	case c.input <- packet:
+	case <-c.done:
+	default:
+		log.Debug("udp session from", c.source, "is full, datagram dropped")
+	}
+}
+
+func (c *datagramSession) ReadWithMetadata(payload []byte) (int, *tunnel.Metadata, error) {
+	for {
+		select {
+		case packet := <-c.input:
+			if len(packet.payload) > len(payload) {
+				oversizedPackets.Inc()
+				log.Warn("udp datagram from", c.source, "is larger than", len(payload), "bytes, dropped")
+				continue
+			}
+			n := copy(payload, packet.payload)
+			statistic.WaitRecv(c.user, n)
+			c.addTraffic(0, n)
+			c.session.onRecv(n, packet.metadata)
+			return n, packet.metadata, nil
+		case <-c.deadline.Wait():
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, nil, io.EOF
+		}
+	}
+}
+
+func (c *datagramSession) WriteWithMetadata(payload []byte, m *tunnel.Metadata) (int, error) {
+	select {
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	statistic.WaitSent(c.user, len(payload))
+	w := bytes.NewBuffer(make([]byte, 0, common.PacketSize()))
+	if err := writeDatagramPacket(w, payload, m); err != nil {
+		return 0, err
+	}
+	send := func(b []byte) error {
+		_, err := c.server.conn.WriteTo(b, c.source)
+		return err
+	}
+	if err := sendDatagram(send, w.Bytes(), 0, c.server.fragment, &c.server.nextID); err != nil {
+		return 0, err
+	}
+	c.addTraffic(len(payload), 0)
+	c.session.onSent(len(payload))
+	return len(payload), nil
+}
+
+func (c *datagramSession) ReadFrom(payload []byte) (int, net.Addr, error) {
+	return c.ReadWithMetadata(payload)
+}
+
+func (c *datagramSession) WriteTo(payload []byte, addr net.Addr) (int, error) {
+	address, err := tunnel.NewAddressFromAddr("udp", addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return c.WriteWithMetadata(payload, &tunnel.Metadata{
+		Address: address,
+	})
+}
+
+// Close ends the session, the shared socket stays open
+func (c *datagramSession) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.server.remove(c)
+		c.server.sessions.Remove(c.session)
+	})
+	return nil
+}
+
+func (c *datagramSession) LocalAddr() net.Addr {
+	return c.server.conn.LocalAddr()
+}
+
+func (c *datagramSession) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *datagramSession) SetReadDeadline(t time.Time) error {
+	c.deadline.Set(t)
+	return nil
+}
+
+func (c *datagramSession) SetWriteDeadline(time.Time) error {
+	return nil
+}
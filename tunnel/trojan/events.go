@@ -0,0 +1,167 @@
+package trojan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
+)
+
+var droppedEvents = metrics.NewCounter("trojan_go_dropped_events_total", "Number of the connection events dropped because the sink is full.")
+
+const (
+	webhookBatchSize = 100             // 每次 POST 的事件数量上限
+	webhookFlush     = time.Second     // 未满一批的事件等待的时间
+	webhookTimeout   = time.Second * 5 // 每次 POST 的超时时间
+)
+
+// EventSink receives the connection open and close events. Send is called in the connection goroutines and must not block
+type EventSink interface {
+	Send(event *HookEvent)
+}
+
+var (
+	sinksLock  sync.Mutex
+	extraSinks []EventSink
+)
+
+// RegisterEventSink adds the sink to the trojan servers created after, so that the programs embedding trojan-go
+// can consume the events, e.g. with a ChannelSink
+func RegisterEventSink(sink EventSink) {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	extraSinks = append(extraSinks, sink)
+}
+
+// ChannelSink sends the events to the channel, the events are dropped if the channel is full
+type ChannelSink chan *HookEvent
+
+func (s ChannelSink) Send(event *HookEvent) {
+	select {
+	case s <- event:
+	default:
+		droppedEvents.Inc()
+	}
+}
+
+// fileSink appends the events to the file, one JSON object per line
+type fileSink struct {
+	sync.Mutex
+	file *os.File
+}
+
+func (s *fileSink) Send(event *HookEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Error(common.NewError("failed to encode event").Base(err))
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		log.Warn(common.NewError("failed to write event to " + s.file.Name()).Base(err))
+	}
+}
+
+// webhookSink posts the events to the url in batches as JSON arrays
+type webhookSink struct {
+	url    string
+	client *http.Client
+	queue  chan *HookEvent
+}
+
+func (s *webhookSink) Send(event *HookEvent) {
+	select {
+	case s.queue <- event:
+	default:
+		droppedEvents.Inc()
+	}
+}
+
+func (s *webhookSink) post(batch []*HookEvent) {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		log.Error(common.NewError("failed to encode events").Base(err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		log.Warn(common.NewError("invalid event webhook " + s.url).Base(err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Warn(common.NewError("event webhook " + s.url + " failed, " + strconv.Itoa(len(batch)) + " events dropped").Base(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Warn("event webhook", s.url, "returned", resp.Status)
+	}
+}
+
+func (s *webhookSink) run(ctx context.Context) {
+	ticker := time.NewTicker(webhookFlush)
+	defer ticker.Stop()
+	batch := make([]*HookEvent, 0, webhookBatchSize)
+	for {
+		select {
+		case event := <-s.queue:
+			batch = append(batch, event)
+			if len(batch) < webhookBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-ctx.Done():
+			if len(batch) != 0 {
+				s.post(batch)
+			}
+			return
+		}
+		s.post(batch)
+		batch = make([]*HookEvent, 0, webhookBatchSize)
+	}
+}
+
+// newEventSinks creates the configured sinks and appends the registered ones
+func newEventSinks(ctx context.Context, cfg *EventsConfig) ([]EventSink, error) {
+	var sinks []EventSink
+	if cfg.File != "" {
+		file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, common.NewError("failed to open event file " + cfg.File).Base(err)
+		}
+		go func() {
+			<-ctx.Done()
+			file.Close()
+		}()
+		sinks = append(sinks, &fileSink{file: file})
+	}
+	if cfg.Webhook != "" {
+		sink := &webhookSink{
+			url:    cfg.Webhook,
+			client: &http.Client{},
+			queue:  make(chan *HookEvent, cfg.Buffer),
+		}
+		go sink.run(ctx)
+		sinks = append(sinks, sink)
+	}
+	sinksLock.Lock()
+	sinks = append(sinks, extraSinks...)
+	sinksLock.Unlock()
+	return sinks, nil
+}
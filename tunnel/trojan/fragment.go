@@ -0,0 +1,138 @@
+package trojan
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// 数据报超过插件的 MTU 时，编码后的 trojan UDP 包被拆分为多个分片，每个分片单独作为一个数据报：
+// 0xff | 包 id (2 字节) | 分片序号 (1 字节) | 分片数量 (1 字节) | 分片数据
+// 0xff 不是合法的地址类型，因此不会与未分片的包混淆。客户端发出的分片同样以密码 hash 和 CRLF 开头
+
+const (
+	fragmentMarker    = 0xff
+	fragmentHeaderLen = 5
+	maxFragments      = 255
+)
+
+const (
+	fragmentTimeout = time.Second * 10 // 未收齐分片的包被丢弃的时间
+	maxPartials     = 256              // 同时重组的包的数量上限
+)
+
+// fragmentPacket splits the encoded packet into the fragments, each datagram including the prefix is no larger than size
+func fragmentPacket(prefix, packet []byte, size int, id uint16) ([][]byte, error) {
+	chunk := size - len(prefix) - fragmentHeaderLen
+	if chunk <= 0 {
+		return nil, common.NewError("fragment size " + strconv.Itoa(size) + " is too small")
+	}
+	count := (len(packet) + chunk - 1) / chunk
+	if count > maxFragments {
+		return nil, common.NewError("too many fragments for packet of " + strconv.Itoa(len(packet)) + " bytes")
+	}
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunk
+		if end > len(packet) {
+			end = len(packet)
+		}
+		b := make([]byte, 0, len(prefix)+fragmentHeaderLen+end-i*chunk)
+		b = append(b, prefix...)
+		b = append(b, fragmentMarker, byte(id>>8), byte(id), byte(i), byte(count))
+		b = append(b, packet[i*chunk:end]...)
+		fragments = append(fragments, b)
+	}
+	return fragments, nil
+}
+
+type partialPacket struct {
+	parts    [][]byte
+	received int
+	started  time.Time
+}
+
+// reassembler collects the fragments until all of them of a packet are received
+type reassembler struct {
+	sync.Mutex
+	partials map[string]*partialPacket
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{
+		partials: make(map[string]*partialPacket),
+	}
+}
+
+// add adds the fragment from the source, the encoded packet is returned after the last fragment is received
+func (r *reassembler) add(source string, b []byte, now time.Time) ([]byte, error) {
+	if len(b) < fragmentHeaderLen || b[0] != fragmentMarker {
+		return nil, common.NewError("invalid fragment")
+	}
+	id := binary.BigEndian.Uint16(b[1:3])
+	index, count := int(b[3]), int(b[4])
+	if count == 0 || index >= count {
+		return nil, common.NewError("invalid fragment index")
+	}
+	key := source + "/" + strconv.Itoa(int(id))
+
+	r.Lock()
+	defer r.Unlock()
+	p, found := r.partials[key]
+	if found && (len(p.parts) != count || now.Sub(p.started) > fragmentTimeout) {
+		delete(r.partials, key) // 过期或不一致的分片，重新开始
+		found = false
+	}
+	if !found {
+		if len(r.partials) >= maxPartials {
+			for k, p := range r.partials {
+				if now.Sub(p.started) > fragmentTimeout {
+					delete(r.partials, k)
+				}
+			}
+			if len(r.partials) >= maxPartials {
+				return nil, common.NewError("too many partial packets")
+			}
+		}
+		p = &partialPacket{
+			parts:   make([][]byte, count),
+			started: now,
+		}
+		r.partials[key] = p
+	}
+	if p.parts[index] == nil {
+		p.parts[index] = append([]byte(nil), b[fragmentHeaderLen:]...)
+		p.received++
+	}
+	if p.received < count {
+		return nil, nil
+	}
+	delete(r.partials, key)
+	var packet []byte
+	for _, part := range p.parts {
+		packet = append(packet, part...)
+	}
+	return packet, nil
+}
+
+// sendDatagram sends the prefix and the encoded packet in b as one datagram, or as the fragments
+// if it is larger than size. size 0 means no fragmentation
+func sendDatagram(send func([]byte) error, b []byte, prefixLen, size int, id *uint32) error {
+	if size <= 0 || len(b) <= size {
+		return send(b)
+	}
+	fragments, err := fragmentPacket(b[:prefixLen], b[prefixLen:], size, uint16(atomic.AddUint32(id, 1)))
+	if err != nil {
+		return err
+	}
+	for _, f := range fragments {
+		if err := send(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package trojan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+)
+
+const (
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+)
+
+// HookEvent is passed to the hooks as environment variables and JSON
+type HookEvent struct {
+	Event       string `json:"event"`
+	User        string `json:"user"` // 用户 hash
+	IP          string `json:"ip"`
+	Destination string `json:"destination"`
+	Sent        uint64 `json:"sent"`
+	Recv        uint64 `json:"recv"`
+	Duration    int64  `json:"duration"` // 连接持续的毫秒数，仅 disconnect 事件有效
+	Time        int64  `json:"time"`     // 事件发生的 unix 时间戳
+}
+
+func (e *HookEvent) env() []string {
+	return append(os.Environ(),
+		"TROJAN_EVENT="+e.Event,
+		"TROJAN_USER="+e.User,
+		"TROJAN_IP="+e.IP,
+		"TROJAN_DESTINATION="+e.Destination,
+		"TROJAN_SENT="+strconv.FormatUint(e.Sent, 10),
+		"TROJAN_RECV="+strconv.FormatUint(e.Recv, 10),
+		"TROJAN_DURATION="+strconv.FormatInt(e.Duration, 10),
+		"TROJAN_TIME="+strconv.FormatInt(e.Time, 10),
+	)
+}
+
+// Hooks runs external commands and webhooks on user connect and disconnect
+type Hooks struct {
+	ctx          context.Context
+	onConnect    HookConfig
+	onDisconnect HookConfig
+	timeout      time.Duration
+	client       *http.Client
+	sem          chan struct{} // 限制同时运行的钩子数量
+	sinks        []EventSink   // 接收所有事件
+}
+
+func (h *Hooks) run(cfg *HookConfig, event *HookEvent) {
+	ctx, cancel := context.WithTimeout(h.ctx, h.timeout)
+	defer cancel()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Error(common.NewError("failed to encode hook event").Base(err))
+		return
+	}
+	if len(cfg.Exec) != 0 {
+		cmd := exec.CommandContext(ctx, cfg.Exec[0], cfg.Exec[1:]...)
+		cmd.Env = event.env()
+		cmd.Stdin = bytes.NewReader(payload)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			log.Warn(common.NewError("hook " + cfg.Exec[0] + " failed, output: " + string(output)).Base(err))
+		}
+	}
+	if cfg.Webhook != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Webhook, bytes.NewReader(payload))
+		if err != nil {
+			log.Warn(common.NewError("invalid webhook " + cfg.Webhook).Base(err))
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := h.client.Do(req)
+		if err != nil {
+			log.Warn(common.NewError("webhook " + cfg.Webhook + " failed").Base(err))
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Warn("webhook", cfg.Webhook, "returned", resp.Status)
+		}
+	}
+}
+
+// Fire sends the event to the sinks and runs the hooks of the event asynchronously,
+// the hooks are skipped if too many hooks are running
+func (h *Hooks) Fire(event *HookEvent) {
+	event.Time = time.Now().Unix()
+	for _, sink := range h.sinks {
+		sink.Send(event)
+	}
+	var cfg *HookConfig
+	switch event.Event {
+	case EventConnect:
+		cfg = &h.onConnect
+	case EventDisconnect:
+		cfg = &h.onDisconnect
+	}
+	if cfg == nil || (len(cfg.Exec) == 0 && cfg.Webhook == "") {
+		return
+	}
+	select {
+	case h.sem <- struct{}{}:
+	default:
+		log.Warn("too many running hooks,", event.Event, "event of user", event.User, "dropped")
+		return
+	}
+	go func() {
+		defer func() { <-h.sem }()
+		h.run(cfg, event)
+	}()
+}
+
+// NewHooks returns nil if neither hook nor sink is configured
+func NewHooks(ctx context.Context, cfg *HooksConfig, sinks ...EventSink) *Hooks {
+	if len(cfg.OnConnect.Exec) == 0 && cfg.OnConnect.Webhook == "" &&
+		len(cfg.OnDisconnect.Exec) == 0 && cfg.OnDisconnect.Webhook == "" && len(sinks) == 0 {
+		return nil
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	concurrency := cfg.MaxConcurrent
+	if concurrency <= 0 {
+		concurrency = 16
+	}
+	return &Hooks{
+		ctx:          ctx,
+		onConnect:    cfg.OnConnect,
+		onDisconnect: cfg.OnDisconnect,
+		timeout:      timeout,
+		client:       &http.Client{},
+		sem:          make(chan struct{}, concurrency),
+		sinks:        sinks,
+	}
+}
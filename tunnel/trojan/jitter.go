@@ -0,0 +1,58 @@
+package trojan
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// Jitter delays each write by a random duration between min and max, to blur the timing signature of the traffic
+type Jitter struct {
+	min          time.Duration
+	max          time.Duration
+	distribution string
+}
+
+// Delay returns a random delay within [min, max]
+func (j *Jitter) Delay() time.Duration {
+	span := j.max - j.min
+	if span <= 0 {
+		return j.min
+	}
+	var d time.Duration
+	switch j.distribution {
+	case "exponential":
+		// 大多数延迟接近 min，少量延迟接近 max
+		d = time.Duration(rand.ExpFloat64() * float64(span) / 4)
+		if d > span {
+			d = span
+		}
+	default:
+		d = time.Duration(rand.Int63n(int64(span) + 1))
+	}
+	return j.min + d
+}
+
+func (j *Jitter) wait() {
+	if d := j.Delay(); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func NewJitter(cfg *JitterConfig) (*Jitter, error) {
+	j := &Jitter{
+		min:          time.Duration(cfg.Min) * time.Millisecond,
+		max:          time.Duration(cfg.Max) * time.Millisecond,
+		distribution: cfg.Distribution,
+	}
+	if j.min < 0 || j.max < j.min {
+		return nil, common.NewError("invalid jitter min or max")
+	}
+	switch j.distribution {
+	case "", "uniform", "exponential":
+	default:
+		return nil, common.NewError("unknown jitter distribution: " + j.distribution)
+	}
+	return j, nil
+}
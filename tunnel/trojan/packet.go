@@ -9,11 +9,26 @@ import (
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 )
 
+var errPacketTooLarge = common.NewError("incoming packet size is too large")
+
+// 因超过包大小被丢弃的 UDP 包
+var oversizedPackets = metrics.NewCounter("trojan_go_udp_oversized_packets_total", "Number of the udp packets dropped for exceeding the packet size.")
+
 type PacketConn struct {
 	tunnel.Conn
+	session  *Session // 服务端 UDP 会话，客户端为 nil
+	sessions *SessionTable
+}
+
+func (c *PacketConn) Close() error {
+	if c.session != nil {
+		c.sessions.Remove(c.session)
+	}
+	return c.Conn.Close()
 }
 
 func (c *PacketConn) ReadFrom(payload []byte) (int, net.Addr, error) {
@@ -32,9 +47,15 @@ func (c *PacketConn) WriteTo(payload []byte, addr net.Addr) (int, error) {
 }
 
 func (c *PacketConn) WriteWithMetadata(payload []byte, metadata *tunnel.Metadata) (int, error) {
-	packet := make([]byte, 0, MaxPacketSize)
-	w := bytes.NewBuffer(packet)
-	metadata.Address.WriteTo(w)
+	if len(payload) > common.MaxPacketSize {
+		return 0, common.NewError("outgoing packet size is too large")
+	}
+	packet := common.GetPacketBuffer()
+	defer common.PutPacketBuffer(packet)
+	w := bytes.NewBuffer(packet[:0])
+	if err := metadata.Address.WriteTo(w); err != nil {
+		return 0, common.NewError("failed to write udp packet addr").Base(err)
+	}
 
 	length := len(payload)
 	lengthBuf := [2]byte{}
@@ -46,12 +67,27 @@ func (c *PacketConn) WriteWithMetadata(payload []byte, metadata *tunnel.Metadata
 	w.Write(payload)
 
 	_, err := c.Conn.Write(w.Bytes())
+	if c.session != nil && err == nil {
+		c.session.onSent(length)
+	}
 
 	log.Debug("udp packet remote", c.RemoteAddr(), "metadata", metadata, "size", length)
 	return len(payload), err
 }
 
 func (c *PacketConn) ReadWithMetadata(payload []byte) (int, *tunnel.Metadata, error) {
+	for {
+		n, metadata, err := c.readPacket(payload)
+		if err != errPacketTooLarge {
+			return n, metadata, err
+		}
+		// 丢弃过大的包，继续读取后面的包，而不是中断整个 UDP 会话
+		oversizedPackets.Inc()
+		log.Warn("udp packet from", c.RemoteAddr(), "is larger than", len(payload), "bytes, dropped")
+	}
+}
+
+func (c *PacketConn) readPacket(payload []byte) (int, *tunnel.Metadata, error) {
 	addr := &tunnel.Address{
 		NetworkType: "udp",
 	}
@@ -69,9 +105,12 @@ func (c *PacketConn) ReadWithMetadata(payload []byte) (int, *tunnel.Metadata, er
 		return 0, nil, common.NewError("failed to read crlf")
 	}
 
-	if len(payload) < length || length > MaxPacketSize {
-		io.CopyN(ioutil.Discard, c.Conn, int64(length)) // drain the rest of the packet
-		return 0, nil, common.NewError("incoming packet size is too large")
+	if len(payload) < length || length > common.PacketSize() {
+		// drain the rest of the packet
+		if _, err := io.CopyN(ioutil.Discard, c.Conn, int64(length)); err != nil {
+			return 0, nil, common.NewError("failed to drain payload").Base(err)
+		}
+		return 0, nil, errPacketTooLarge
 	}
 
 	if _, err := io.ReadFull(c.Conn, payload[:length]); err != nil {
@@ -79,7 +118,14 @@ func (c *PacketConn) ReadWithMetadata(payload []byte) (int, *tunnel.Metadata, er
 	}
 
 	log.Debug("udp packet from", c.RemoteAddr(), "metadata", addr.String(), "size", length)
-	return length, &tunnel.Metadata{
+	metadata := &tunnel.Metadata{
 		Address: addr,
-	}, nil
+	}
+	if m := c.Conn.Metadata(); m != nil {
+		metadata.User = m.User
+	}
+	if c.session != nil {
+		c.session.onRecv(length, metadata)
+	}
+	return length, metadata, nil
 }
@@ -0,0 +1,213 @@
+package trojan
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// ProbeConnDomain is the reserved destination of the probes without a target,
+// the server answers the authenticated request with probeResponse without connecting anywhere
+const ProbeConnDomain = "PROBE_CONN"
+
+var probeResponse = []byte{0}
+
+type proberKey struct{}
+
+// ProbeResult is the result of a single probe
+type ProbeResult struct {
+	Time      time.Time
+	Handshake time.Duration // TCP 和 TLS 握手耗时
+	RTT       time.Duration // 从开始连接到收到首个响应的耗时，未配置探测目标时为服务器认证后的响应
+	Err       error
+}
+
+// Prober periodically measures the latency and the availability of the server
+type Prober struct {
+	sync.Mutex
+	client    *Client
+	target    *tunnel.Address
+	interval  time.Duration
+	timeout   time.Duration
+	threshold time.Duration
+	history   []*ProbeResult
+	size      int
+	degraded  bool
+}
+
+// dial connects to the server, the dial is abandoned after the timeout
+func (p *Prober) dial(start time.Time) (tunnel.Conn, error) {
+	type dialResult struct {
+		conn tunnel.Conn
+		err  error
+	}
+	ch := make(chan dialResult, 1)
+	go func() {
+		conn, err := p.client.underlay.DialConn(nil, &Tunnel{})
+		ch <- dialResult{conn: conn, err: err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-time.After(time.Until(start.Add(p.timeout))):
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, common.NewError("timeout")
+	}
+}
+
+func (p *Prober) probe() *ProbeResult {
+	result := &ProbeResult{
+		Time: time.Now(),
+	}
+	conn, err := p.dial(result.Time)
+	result.Handshake = time.Since(result.Time)
+	if err != nil {
+		result.Err = common.NewError("failed to connect to the server").Base(err)
+		return result
+	}
+	defer conn.Close()
+
+	// 收到响应说明认证成功，未配置探测目标时由服务器直接响应，配置了目标时说明服务器可以正常转发
+	target := p.target
+	var request []byte
+	if target == nil {
+		target = &tunnel.Address{
+			DomainName:  ProbeConnDomain,
+			AddressType: tunnel.DomainName,
+		}
+	} else {
+		request = []byte(fmt.Sprintf("HEAD / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target.String()))
+	}
+	probeConn := &OutboundConn{
+		Conn: conn,
+		user: p.client.user,
+		metadata: &tunnel.Metadata{
+			Command: Connect,
+			Address: target,
+		},
+	}
+	conn.SetDeadline(result.Time.Add(p.timeout))
+	if _, err := probeConn.WriteHeader(request); err != nil {
+		result.Err = common.NewError("failed to send probe request").Base(err)
+		return result
+	}
+	buf := [1]byte{}
+	if _, err := conn.Read(buf[:]); err != nil {
+		result.Err = common.NewError("no response from probe target " + target.String()).Base(err)
+		return result
+	}
+	if p.target == nil && buf[0] != probeResponse[0] {
+		// 认证失败的连接被重定向到伪装网站，响应来自该网站
+		result.Err = common.NewError("unexpected probe response, the server may have rejected the password")
+		return result
+	}
+	result.RTT = time.Since(result.Time)
+	return result
+}
+
+func (p *Prober) record(result *ProbeResult) {
+	p.Lock()
+	defer p.Unlock()
+	p.history = append(p.history, result)
+	if len(p.history) > p.size {
+		p.history = p.history[len(p.history)-p.size:]
+	}
+	degraded := result.Err != nil || (p.threshold > 0 && result.RTT > p.threshold)
+	switch {
+	case degraded && !p.degraded:
+		if result.Err != nil {
+			log.Warn(common.NewError("server probe failed").Base(result.Err))
+		} else {
+			log.Warn("server latency degraded:", result.RTT)
+		}
+	case !degraded && p.degraded:
+		log.Info("server latency recovered:", result.RTT)
+	default:
+		log.Debug("server probe handshake:", result.Handshake, "rtt:", result.RTT, "error:", result.Err)
+	}
+	p.degraded = degraded
+}
+
+func (p *Prober) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.record(p.probe())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// History returns the recent probe results, from the oldest to the latest
+func (p *Prober) History() []ProbeResult {
+	p.Lock()
+	defer p.Unlock()
+	result := make([]ProbeResult, 0, len(p.history))
+	for _, r := range p.history {
+		result = append(result, *r)
+	}
+	return result
+}
+
+// Healthy reports whether the latest probe succeeded within the latency threshold
+func (p *Prober) Healthy() bool {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.history) != 0 && !p.degraded
+}
+
+// Latency returns the RTT of the latest successful probe
+func (p *Prober) Latency() (time.Duration, bool) {
+	p.Lock()
+	defer p.Unlock()
+	for i := len(p.history) - 1; i >= 0; i-- {
+		if p.history[i].Err == nil {
+			return p.history[i].RTT, true
+		}
+	}
+	return 0, false
+}
+
+func NewProber(client *Client, cfg *ProbeConfig) (*Prober, error) {
+	p := &Prober{
+		client:    client,
+		interval:  time.Duration(cfg.Interval) * time.Second,
+		timeout:   time.Duration(cfg.Timeout) * time.Second,
+		threshold: time.Duration(cfg.Threshold) * time.Millisecond,
+		size:      cfg.History,
+	}
+	if cfg.Target != "" {
+		target, err := tunnel.NewAddressFromAddr("tcp", cfg.Target)
+		if err != nil {
+			return nil, common.NewError("invalid probe target " + cfg.Target).Base(err)
+		}
+		p.target = target
+	}
+	if p.interval <= 0 || p.timeout <= 0 || p.size <= 0 {
+		return nil, common.NewError("invalid probe interval, timeout or history size")
+	}
+	return p, nil
+}
+
+// WithProber stores the prober into the context, so that the API service can access it
+func WithProber(ctx context.Context, p *Prober) context.Context {
+	return context.WithValue(ctx, proberKey{}, p)
+}
+
+// ProberFromContext extracts the prober from a context
+func ProberFromContext(ctx context.Context) *Prober {
+	p, _ := ctx.Value(proberKey{}).(*Prober)
+	return p
+}
@@ -5,12 +5,15 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/api"
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
 	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
 	"github.com/p4gefau1t/trojan-go/redirector"
 	"github.com/p4gefau1t/trojan-go/statistic"
 	"github.com/p4gefau1t/trojan-go/statistic/memory"
@@ -26,8 +29,10 @@ type InboundConn struct {
 	// must be 64-bit aligned on 32-bit systems.
 	// Reference: https://github.com/golang/go/issues/599
 	// Solution: https://github.com/golang/go/issues/11891#issuecomment-433623786
-	sent uint64 // 发送的数据包字节累计
-	recv uint64 // 接收的数据包字节累计
+	sent     uint64 // 发送的数据包字节累计
+	recv     uint64 // 接收的数据包字节累计
+	wireSent uint64 // 已经统计的 TCP 连接上发送的字节
+	wireRecv uint64 // 已经统计的 TCP 连接上接收的字节
 
 	net.Conn                         // 下一层连接
 	auth     statistic.Authenticator // 用来认证用户
@@ -35,6 +40,28 @@ type InboundConn struct {
 	hash     string                  // 数据包 hash
 	metadata *tunnel.Metadata        // 请求目标地址信息
 	ip       string                  // 客户端连接 ip
+	hooks    *Hooks                  // 连接和断开时的外部钩子
+	wire     net.Conn                // 统计 TCP 连接上字节的连接
+	account  *statistic.Accounting   // 为空时按 trojan 层的字节统计用户流量
+	start    time.Time
+	once     sync.Once
+}
+
+func (c *InboundConn) hookEvent(event string) *HookEvent {
+	e := &HookEvent{
+		Event: event,
+		User:  c.hash,
+		IP:    c.ip,
+		Sent:  atomic.LoadUint64(&c.sent),
+		Recv:  atomic.LoadUint64(&c.recv),
+	}
+	if c.metadata != nil && c.metadata.Address != nil {
+		e.Destination = c.metadata.Address.String()
+	}
+	if event == EventDisconnect {
+		e.Duration = time.Since(c.start).Milliseconds()
+	}
+	return e
 }
 
 func (c *InboundConn) Metadata() *tunnel.Metadata {
@@ -42,23 +69,60 @@ func (c *InboundConn) Metadata() *tunnel.Metadata {
 }
 
 func (c *InboundConn) Write(p []byte) (int, error) {
+	statistic.WaitSent(c.user, len(p)) // 按用户的下载限速等待
 	n, err := c.Conn.Write(p)
 	atomic.AddUint64(&c.sent, uint64(n))
+	if c.account != nil { // 有底层连接的统计时按 TCP 连接上的字节统计
+		delta := n
+		if sent, _, ok := tunnel.WireTrafficOf(c.wire); ok {
+			delta = advanceWire(&c.wireSent, sent)
+		}
+		c.account.AddWire(c.user, delta, 0)
+		return n, err
+	}
 	c.user.AddTraffic(n, 0) // 记录该用户写入的流量
 	return n, err
 }
 
 func (c *InboundConn) Read(p []byte) (int, error) {
 	n, err := c.Conn.Read(p)
+	statistic.WaitRecv(c.user, n) // 按用户的上传限速等待，推迟下一次读取
 	atomic.AddUint64(&c.recv, uint64(n))
+	if c.account != nil {
+		delta := n
+		if _, recv, ok := tunnel.WireTrafficOf(c.wire); ok {
+			delta = advanceWire(&c.wireRecv, recv)
+		}
+		c.account.AddWire(c.user, 0, delta)
+		return n, err
+	}
 	c.user.AddTraffic(0, n) // 记录该用户读取的流量
 	return n, err
 }
 
+// advanceWire moves the counted bytes to the current bytes on the connection and returns the increment.
+// 读写可能并发，较旧的值不会使计数倒退
+func advanceWire(counted *uint64, current uint64) int {
+	for {
+		last := atomic.LoadUint64(counted)
+		if current <= last {
+			return 0
+		}
+		if atomic.CompareAndSwapUint64(counted, last, current) {
+			return int(current - last)
+		}
+	}
+}
+
 func (c *InboundConn) Close() error {
 	log.Info("user", c.hash, "from", c.Conn.RemoteAddr(), "tunneling to", c.metadata.Address, "closed",
 		"sent:", common.HumanFriendlyTraffic(atomic.LoadUint64(&c.sent)), "recv:", common.HumanFriendlyTraffic(atomic.LoadUint64(&c.recv)))
 	c.user.DelIP(c.ip)
+	if c.hooks != nil {
+		c.once.Do(func() {
+			c.hooks.Fire(c.hookEvent(EventDisconnect))
+		})
+	}
 	return c.Conn.Close()
 }
 
@@ -107,6 +171,7 @@ func (c *InboundConn) Auth() error {
 	if err := c.metadata.ReadFrom(c.Conn); err != nil {
 		return err
 	}
+	c.metadata.User = user
 
 	_, err = io.ReadFull(c.Conn, crlf[:]) // 读取 CRLF 占用2个字节，后面的数据就是请求负载了
 	if err != nil {
@@ -115,6 +180,16 @@ func (c *InboundConn) Auth() error {
 	return nil
 }
 
+// 连接在通道已满时等待的时间
+var (
+	connQueueWait   = metrics.QueueWait("trojan")
+	muxQueueWait    = metrics.QueueWait("trojan_mux")
+	packetQueueWait = metrics.QueueWait("trojan_packet")
+)
+
+// firstBytesSize is the size of the first bytes checked for replays, i.e. the header and the beginning of the payload
+const firstBytesSize = 512
+
 // Server is a trojan tunnel server
 type Server struct {
 	auth       statistic.Authenticator // 身份认证
@@ -124,6 +199,20 @@ type Server struct {
 	connChan   chan tunnel.Conn       // trojan TCP连接通道
 	muxChan    chan tunnel.Conn       // 多路复用连接通道
 	packetChan chan tunnel.PacketConn // trojan UDP连接通道
+	sessions   *SessionTable          // 活跃的 UDP 会话表
+	hooks      *Hooks
+	tarpit     *redirector.Tarpit     // 为空时不拖住探测连接
+	normalizer *redirector.Normalizer // 为空时不延迟重定向
+	recorder   *redirector.Recorder   // 为空时不记录认证失败的连接
+	slowLog    *slowHandshakeLog      // 为空时不记录慢握手
+	api        *APIListener           // 通过隧道访问 API 的连接
+	account    *statistic.Accounting  // 为空时不区分连接和应用层的流量
+	timeout    time.Duration          // 读取 trojan 头部的最长时间，0 表示不限制
+	muxCommand tunnel.Command         // 多路复用连接的命令字节
+	muxDomain  string                 // 连接到该域名的请求也当作多路复用，为空时不识别
+	fallbacks  userFallbacks          // 为空时所有认证失败的连接都重定向到 redirAddr
+	known      *knownHashes           // 最近认证成功的用户，仅在设置了 "*" 回落时记录
+	replay     *redirector.ReplayFilter
 	ctx        context.Context
 	cancel     context.CancelFunc
 }
@@ -133,6 +222,88 @@ func (s *Server) Close() error {
 	return s.underlay.Close()
 }
 
+// isHash reports whether s looks like the hash of a password, i.e. 56 hex characters
+func isHash(s string) bool {
+	if len(s) != 56 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// userFallbacks are the redirect addresses of the user hashes, "*" is the address of the other known users
+type userFallbacks map[string]*tunnel.Address
+
+const (
+	knownHashTTL   = time.Hour * 24 * 7 // 被删除或封禁的用户在此期间仍使用 "*" 回落
+	maxKnownHashes = 65536
+)
+
+// knownHashes remembers the users authenticated recently
+type knownHashes struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+func (k *knownHashes) add(hash string, now time.Time) {
+	k.Lock()
+	defer k.Unlock()
+	if _, found := k.seen[hash]; !found && len(k.seen) >= maxKnownHashes {
+		for h, t := range k.seen {
+			if now.Sub(t) > knownHashTTL {
+				delete(k.seen, h)
+			}
+		}
+		if len(k.seen) >= maxKnownHashes {
+			return
+		}
+	}
+	k.seen[hash] = now
+}
+
+func (k *knownHashes) contains(hash string, now time.Time) bool {
+	k.Lock()
+	defer k.Unlock()
+	t, found := k.seen[hash]
+	return found && now.Sub(t) <= knownHashTTL
+}
+
+// isKnown reports whether the hash belongs to a user of the server or a user authenticated recently,
+// a random hash sent by a probe is unknown
+func (s *Server) isKnown(hash string) bool {
+	if valid, _ := s.auth.AuthUser(hash); valid {
+		return true
+	}
+	return s.known != nil && s.known.contains(hash, time.Now())
+}
+
+// fallbackFor returns the redirect address of the failed connection starting with the bytes,
+// the unauthenticated probes are redirected to the remote address
+func (s *Server) fallbackFor(b []byte) *tunnel.Address {
+	if len(b) < 56 || len(s.fallbacks) == 0 {
+		return s.redirAddr
+	}
+	hash := string(b[:56])
+	if address, found := s.fallbacks[hash]; found {
+		return address
+	}
+	// 只用于已知的用户，否则探测者发送随机的哈希即可与伪装网站区分
+	if address, found := s.fallbacks["*"]; found && s.isKnown(hash) {
+		return address
+	}
+	return s.redirAddr
+}
+
+// isMux reports whether the request starts a mux connection. Its first bytes are the same for all the
+// connections of the user, so they are not checked for replays
+func (s *Server) isMux(metadata *tunnel.Metadata) bool {
+	return metadata.Command == s.muxCommand || metadata.Command == Connect && s.muxDomain != "" && metadata.DomainName == s.muxDomain
+}
+
 func (s *Server) acceptLoop() {
 	for {
 		conn, err := s.underlay.AcceptConn(&Tunnel{})
@@ -146,45 +317,119 @@ func (s *Server) acceptLoop() {
 			continue
 		}
 		go func(conn tunnel.Conn) {
+			// TLS 层已经检测了重放的 Client Hello，其他底层协议上检测开头的字节
+			checkReplay := s.replay != nil && tunnel.ClientRandomOf(conn) == nil
 			rewindConn := common.NewRewindConn(conn)
-			rewindConn.SetBufferSize(128)
+			if checkReplay {
+				rewindConn.SetBufferSize(firstBytesSize)
+			} else {
+				rewindConn.SetBufferSize(128)
+			}
 			defer rewindConn.StopBuffering()
 
 			inboundConn := &InboundConn{
-				Conn: rewindConn,
-				auth: s.auth,
+				Conn:    rewindConn,
+				auth:    s.auth,
+				hooks:   s.hooks,
+				wire:    conn,
+				account: s.account,
+				start:   time.Now(),
 			}
 
-			// auth() 方法解析 trojan 协议
-			if err := inboundConn.Auth(); err != nil {
+			// auth() 方法解析 trojan 协议，超时未发送完头部的连接与认证失败的连接一样被重定向，避免一直占用连接
+			if s.timeout > 0 {
+				rewindConn.SetReadDeadline(time.Now().Add(s.timeout))
+			}
+			var first []byte
+			if checkReplay {
+				// 客户端将头部和第一段数据一起发送，一次读取得到二者
+				buf := make([]byte, firstBytesSize)
+				n, _ := rewindConn.Read(buf)
+				first = buf[:n]
+				rewindConn.Rewind()
+			}
+			err := inboundConn.Auth()
+			if s.timeout > 0 {
+				rewindConn.SetReadDeadline(time.Time{})
+			}
+			if err == nil && checkReplay && !s.isMux(inboundConn.metadata) && s.replay.Check(first, time.Now()) {
+				// 重放的握手来自探测者，与认证失败的连接一样处理
+				inboundConn.user.DelIP(inboundConn.ip)
+				err = common.NewError("replayed handshake of user " + inboundConn.hash)
+			}
+			if err != nil {
 				rewindConn.Rewind()
 				rewindConn.StopBuffering()
 				log.Warn(common.NewError("connection with invalid trojan header from " + rewindConn.RemoteAddr().String()).Base(err))
+				s.recorder.RecordDecrypted("trojan", rewindConn.RemoteAddr(), rewindConn.Buffered())
+				if s.tarpit != nil && s.tarpit.Hold(rewindConn) {
+					return
+				}
+				accepted := tunnel.AcceptTimeOf(conn)
+				if accepted.IsZero() {
+					accepted = inboundConn.start
+				}
+				s.normalizer.Delay(accepted)
 				s.redir.Redirect(&redirector.Redirection{
-					RedirectTo:  s.redirAddr,
+					RedirectTo:  s.fallbackFor(rewindConn.Buffered()),
 					InboundConn: rewindConn,
 				})
 				return
 			}
 
 			rewindConn.StopBuffering()
+			if s.known != nil {
+				s.known.add(inboundConn.hash, time.Now())
+			}
+			metrics.TrojanAuth.ObserveSince(inboundConn.start)
+			accepted := tunnel.AcceptTimeOf(conn)
+			if !accepted.IsZero() {
+				metrics.AcceptToAuth.ObserveSince(accepted)
+			}
+			s.slowLog.observe(conn.RemoteAddr(), accepted, tunnel.HandshakeTimeOf(conn), inboundConn.start)
+			if s.hooks != nil {
+				s.hooks.Fire(inboundConn.hookEvent(EventConnect))
+			}
 			switch inboundConn.metadata.Command {
 			case Connect:
-				if inboundConn.metadata.DomainName == "MUX_CONN" { // 多路复用
+				if s.muxDomain != "" && inboundConn.metadata.DomainName == s.muxDomain { // 旧版本客户端的多路复用
+					start := time.Now()
 					s.muxChan <- inboundConn
+					muxQueueWait.ObserveSince(start)
 					log.Debug("mux(r) connection")
+				} else if inboundConn.metadata.DomainName == ProbeConnDomain { // 客户端的探测，不连接任何目标
+					inboundConn.Write(probeResponse)
+					inboundConn.Close()
+					log.Debug("probe from user", inboundConn.hash)
+				} else if inboundConn.metadata.DomainName == APIConnDomain {
+					if s.api == nil {
+						log.Warn("user", inboundConn.hash, "requested api through the tunnel, but it is disabled")
+						inboundConn.Close()
+						return
+					}
+					s.api.add(inboundConn)
+					log.Debug("api connection through the tunnel")
 				} else {
+					start := time.Now()
 					s.connChan <- inboundConn
+					connQueueWait.ObserveSince(start)
 					log.Debug("normal trojan connection")
 				}
 
 			case Associate:
-				s.packetChan <- &PacketConn{
-					Conn: inboundConn,
+				packetConn := &PacketConn{
+					Conn:     inboundConn,
+					sessions: s.sessions,
 				}
+				packetConn.session = s.sessions.Add(inboundConn.user, inboundConn.RemoteAddr(), packetConn.Close)
+				start := time.Now()
+				s.packetChan <- packetConn
+				packetQueueWait.ObserveSince(start)
 				log.Debug("trojan udp connection")
-			case Mux:
+			case s.muxCommand:
+				start := time.Now()
 				s.muxChan <- inboundConn
+				muxQueueWait.ObserveSince(start)
 				log.Debug("mux connection")
 			default:
 				log.Error(common.NewError(fmt.Sprintf("unknown trojan command %d", inboundConn.metadata.Command)))
@@ -223,29 +468,63 @@ func (s *Server) AcceptPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
 	}
 }
 
+// newAuthenticator creates the authenticator backend according to the config in ctx
+func newAuthenticator(ctx context.Context) (statistic.Authenticator, error) {
+	// TODO replace this dirty code
+	cfg := config.FromContext(ctx, Name).(*Config)
+	if cfg.MySQL.Enabled {
+		log.Debug("mysql enabled")
+		return statistic.NewAuthenticator(ctx, mysql.Name)
+	}
+	log.Debug("auth by config file")
+	return statistic.NewAuthenticator(ctx, memory.Name)
+}
+
 func NewServer(ctx context.Context, underlay tunnel.Server) (*Server, error) {
 	cfg := config.FromContext(ctx, Name).(*Config)
 	ctx, cancel := context.WithCancel(ctx)
 
-	// TODO replace this dirty code
-	var auth statistic.Authenticator
-	var err error
-	if cfg.MySQL.Enabled {
-		log.Debug("mysql enabled")
-		auth, err = statistic.NewAuthenticator(ctx, mysql.Name)
-	} else {
-		log.Debug("auth by config file")
-		auth, err = statistic.NewAuthenticator(ctx, memory.Name)
+	if cfg.Usage.Enabled { // 月度流量统计在认证模块重新加载后保留
+		usage, err := statistic.NewUsageTracker(ctx, &cfg.Usage)
+		if err != nil {
+			cancel()
+			return nil, common.NewError("trojan failed to create usage tracker").Base(err)
+		}
+		ctx = statistic.WithUsageTracker(ctx, usage)
 	}
+
+	// 认证模块可以在运行时通过 API 重新加载或者切换
+	auth, err := statistic.NewSwappableAuthenticator(ctx, newAuthenticator)
 	if err != nil {
 		cancel()
-		return nil, common.NewError("trojan failed to create authenticator")
+		return nil, common.NewError("trojan failed to create authenticator").Base(err)
+	}
+	// 收到 SIGHUP 时从配置文件重新加载用户，在线用户的统计迁移到新的认证模块
+	config.OnReload(ctx, auth.Reload)
+
+	sessions := NewSessionTable(cfg.UDP.MaxSessions, cfg.UDP.MaxSessionsPerUser)
+	ctx = WithSessionTable(ctx, sessions)
+
+	var apiListener *APIListener
+	if cfg.API.Tunnel.Enabled {
+		if !cfg.API.Enabled {
+			log.Warn("api is disabled, api through the tunnel is unavailable")
+		} else {
+			apiListener = NewAPIListener(ctx, tunnel.NewAddressFromHostPort("tcp", cfg.LocalHost, cfg.LocalPort))
+			ctx = WithAPIListener(ctx, apiListener)
+		}
 	}
 
 	if cfg.API.Enabled {
 		go api.RunService(ctx, Name+"_SERVER", auth)
 	}
 
+	sinks, err := newEventSinks(ctx, &cfg.Events)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
 	redirAddr := tunnel.NewAddressFromHostPort("tcp", cfg.RemoteHost, cfg.RemotePort)
 	s := &Server{
 		underlay:   underlay,
@@ -254,18 +533,102 @@ func NewServer(ctx context.Context, underlay tunnel.Server) (*Server, error) {
 		connChan:   make(chan tunnel.Conn, 32),
 		muxChan:    make(chan tunnel.Conn, 32),
 		packetChan: make(chan tunnel.PacketConn, 32),
+		sessions:   sessions,
+		hooks:      NewHooks(ctx, &cfg.Hooks, sinks...),
+		api:        apiListener,
 		ctx:        ctx,
 		cancel:     cancel,
 		redir:      redirector.NewRedirector(ctx),
+		account:    statistic.AccountingFromContext(ctx),
+		timeout:    time.Duration(cfg.AuthTimeout) * time.Second,
+		muxCommand: cfg.Mux.command(),
+		muxDomain:  cfg.Mux.Identifier,
 	}
 
-	if !cfg.DisableHTTPCheck { // HTTP 重定向地址
-		redirConn, err := net.Dial("tcp", redirAddr.String())
+	if cfg.AntiReplay.Enabled {
+		s.replay = redirector.NewReplayFilter(time.Duration(cfg.AntiReplay.Window)*time.Second, cfg.AntiReplay.Size)
+		log.Info("anti-replay enabled, window:", cfg.AntiReplay.Window, "seconds")
+	}
+
+	if cfg.Tarpit.Enabled {
+		if cfg.Tarpit.MaxConns <= 0 || cfg.Tarpit.Interval <= 0 || cfg.Tarpit.Duration <= 0 {
+			cancel()
+			return nil, common.NewError("invalid tarpit max_conns, interval or duration")
+		}
+		s.tarpit = redirector.NewTarpit(ctx, cfg.Tarpit.MaxConns,
+			time.Duration(cfg.Tarpit.Interval)*time.Millisecond, time.Duration(cfg.Tarpit.Duration)*time.Second)
+		log.Info("tarpit enabled, max connections:", cfg.Tarpit.MaxConns)
+	}
+
+	if cfg.ProbeResistance.Enabled {
+		normalizer, err := redirector.NewNormalizer(time.Duration(cfg.ProbeResistance.MinDelay)*time.Millisecond,
+			time.Duration(cfg.ProbeResistance.MaxDelay)*time.Millisecond)
+		if err != nil {
+			cancel()
+			return nil, common.NewError("trojan failed to enable probe resistance").Base(err)
+		}
+		s.normalizer = normalizer
+	}
+
+	if cfg.Capture.Enabled {
+		recorder, err := redirector.NewRecorder(ctx, Name, cfg.Capture.Path, cfg.Capture.MaxBytes, cfg.Capture.MaxRecords)
 		if err != nil {
+			cancel()
+			return nil, common.NewError("trojan failed to enable capture").Base(err)
+		}
+		s.recorder = recorder
+	}
+
+	if s.slowLog, err = newSlowHandshakeLog(ctx, &cfg.SlowHandshake); err != nil {
+		cancel()
+		return nil, common.NewError("trojan failed to enable slow handshake log").Base(err)
+	}
+
+	if len(cfg.UserFallbacks) > 0 {
+		s.fallbacks = make(userFallbacks, len(cfg.UserFallbacks))
+		for _, f := range cfg.UserFallbacks {
+			hash := f.Hash
+			if f.Password != "" {
+				hash = common.SHA224String(f.Password)
+			}
+			if f.RemoteHost == "" {
+				f.RemoteHost = cfg.RemoteHost
+			}
+			s.fallbacks[hash] = tunnel.NewAddressFromHostPort("tcp", f.RemoteHost, f.RemotePort)
+		}
+		if _, found := s.fallbacks["*"]; found {
+			s.known = &knownHashes{seen: make(map[string]time.Time)}
+		}
+	}
+
+	if !cfg.DisableHTTPCheck { // HTTP 重定向地址
+		if err := s.redir.Watch(redirAddr); err != nil {
 			cancel()
 			return nil, common.NewError("invalid redirect address. check your http server: " + redirAddr.String()).Base(err)
 		}
-		redirConn.Close()
+		for hash, address := range s.fallbacks {
+			if err := s.redir.Watch(address); err != nil {
+				cancel()
+				return nil, common.NewError("invalid redirect address of user " + hash + ": " + address.String()).Base(err)
+			}
+		}
+	}
+
+	unregisterConn := metrics.RegisterQueue(ctx, "trojan", func() int { return len(s.connChan) }, cap(s.connChan))
+	unregisterMux := metrics.RegisterQueue(ctx, "trojan_mux", func() int { return len(s.muxChan) }, cap(s.muxChan))
+	unregisterPacket := metrics.RegisterQueue(ctx, "trojan_packet", func() int { return len(s.packetChan) }, cap(s.packetChan))
+	go func() {
+		<-ctx.Done()
+		unregisterConn()
+		unregisterMux()
+		unregisterPacket()
+	}()
+
+	if l, ok := underlay.(tunnel.DatagramListener); ok {
+		if conn := l.DatagramConn(); conn != nil {
+			go newDatagramServer(ctx, conn, auth, sessions, s.account, s.packetChan, cfg.UDP.FragmentSize).loop()
+			log.Info("trojan server is receiving udp datagrams relayed by the transport plugin")
+		}
 	}
 
 	go s.acceptLoop()
@@ -0,0 +1,187 @@
+package trojan
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/statistic"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+type sessionTableKey struct{}
+
+// Session is an active UDP association relayed by the trojan server
+type Session struct {
+	// WARNING: do not change the order of these fields.
+	// 64-bit fields that use `sync/atomic` package functions
+	// must be 64-bit aligned on 32-bit systems.
+	sent       uint64 // 发送给客户端的字节累计
+	recv       uint64 // 从客户端接收的字节累计
+	lastActive int64  // 最近一次收发数据包的时间(UnixNano)
+
+	id          uint64
+	user        statistic.User
+	source      net.Addr
+	destination atomic.Value // 最近一次请求的目标地址
+	createdTime time.Time
+	closer      func() error
+}
+
+// SessionInfo is a snapshot of a Session
+type SessionInfo struct {
+	ID          uint64
+	Hash        string
+	Source      string
+	Destination string
+	Sent        uint64
+	Recv        uint64
+	Age         time.Duration
+	Idle        time.Duration
+}
+
+func (s *Session) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *Session) onRecv(n int, m *tunnel.Metadata) {
+	atomic.AddUint64(&s.recv, uint64(n))
+	if m != nil && m.Address != nil {
+		s.destination.Store(m.Address.String())
+	}
+	s.touch()
+}
+
+func (s *Session) onSent(n int) {
+	atomic.AddUint64(&s.sent, uint64(n))
+	s.touch()
+}
+
+func (s *Session) info(now time.Time) *SessionInfo {
+	dst, _ := s.destination.Load().(string)
+	return &SessionInfo{
+		ID:          s.id,
+		Hash:        s.user.Hash(),
+		Source:      s.source.String(),
+		Destination: dst,
+		Sent:        atomic.LoadUint64(&s.sent),
+		Recv:        atomic.LoadUint64(&s.recv),
+		Age:         now.Sub(s.createdTime),
+		Idle:        now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastActive))),
+	}
+}
+
+// SessionTable tracks all active UDP sessions of a trojan server.
+// When the global or per-user cap is reached, the least recently used session is evicted
+type SessionTable struct {
+	sync.Mutex
+	sessions           map[uint64]*Session
+	nextID             uint64
+	maxSessions        int
+	maxSessionsPerUser int
+}
+
+// leastRecentlyUsed returns the idlest session which satisfies the filter.
+// The mutex should be locked when this function is called
+func (t *SessionTable) leastRecentlyUsed(filter func(*Session) bool) *Session {
+	var lru *Session
+	for _, s := range t.sessions {
+		if !filter(s) {
+			continue
+		}
+		if lru == nil || atomic.LoadInt64(&s.lastActive) < atomic.LoadInt64(&lru.lastActive) {
+			lru = s
+		}
+	}
+	return lru
+}
+
+// Add registers a new session, evicting old sessions if the caps are exceeded
+func (t *SessionTable) Add(user statistic.User, source net.Addr, closer func() error) *Session {
+	s := &Session{
+		user:        user,
+		source:      source,
+		createdTime: time.Now(),
+		closer:      closer,
+	}
+	s.touch()
+
+	evicted := make([]*Session, 0, 2)
+	t.Lock()
+	t.nextID++
+	s.id = t.nextID
+	if t.maxSessionsPerUser > 0 {
+		count := 0
+		for _, other := range t.sessions {
+			if other.user.Hash() == user.Hash() {
+				count++
+			}
+		}
+		if count >= t.maxSessionsPerUser {
+			lru := t.leastRecentlyUsed(func(other *Session) bool {
+				return other.user.Hash() == user.Hash()
+			})
+			delete(t.sessions, lru.id)
+			evicted = append(evicted, lru)
+		}
+	}
+	if t.maxSessions > 0 && len(t.sessions) >= t.maxSessions {
+		lru := t.leastRecentlyUsed(func(*Session) bool { return true })
+		delete(t.sessions, lru.id)
+		evicted = append(evicted, lru)
+	}
+	t.sessions[s.id] = s
+	t.Unlock()
+
+	// close the evicted sessions without holding the lock, since Close will call Remove
+	for _, lru := range evicted {
+		log.Info("udp session", lru.id, "of user", lru.user.Hash(), "from", lru.source, "evicted")
+		lru.closer()
+	}
+	return s
+}
+
+// Remove unregisters a session
+func (t *SessionTable) Remove(s *Session) {
+	t.Lock()
+	delete(t.sessions, s.id)
+	t.Unlock()
+}
+
+// List returns snapshots of all active sessions, sorted by id
+func (t *SessionTable) List() []*SessionInfo {
+	now := time.Now()
+	t.Lock()
+	result := make([]*SessionInfo, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		result = append(result, s.info(now))
+	}
+	t.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func NewSessionTable(maxSessions, maxSessionsPerUser int) *SessionTable {
+	return &SessionTable{
+		sessions:           make(map[uint64]*Session),
+		maxSessions:        maxSessions,
+		maxSessionsPerUser: maxSessionsPerUser,
+	}
+}
+
+// WithSessionTable stores the session table into the context, so that the API service can access it
+func WithSessionTable(ctx context.Context, t *SessionTable) context.Context {
+	return context.WithValue(ctx, sessionTableKey{}, t)
+}
+
+// SessionTableFromContext extracts the session table from a context
+func SessionTableFromContext(ctx context.Context) *SessionTable {
+	t, _ := ctx.Value(sessionTableKey{}).(*SessionTable)
+	return t
+}
@@ -0,0 +1,138 @@
+package trojan
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/metrics"
+)
+
+// handshakeProfiler captures a cpu profile when the slow handshakes keep happening
+type handshakeProfiler struct {
+	sync.Mutex
+	ctx      context.Context
+	path     string
+	count    int
+	window   time.Duration
+	duration time.Duration
+	cooldown time.Duration
+	recent   []time.Time // 窗口内慢握手的时间
+	last     time.Time   // 上次开始采集的时间
+}
+
+// record counts a slow handshake, the profiling starts if there are enough of them in the window
+func (p *handshakeProfiler) record(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	i := 0
+	for i < len(p.recent) && now.Sub(p.recent[i]) > p.window {
+		i++
+	}
+	p.recent = append(p.recent[i:], now)
+	if len(p.recent) < p.count || (!p.last.IsZero() && now.Sub(p.last) < p.cooldown) {
+		return
+	}
+	p.last = now
+	p.recent = nil
+	go p.capture(now)
+}
+
+func (p *handshakeProfiler) capture(now time.Time) {
+	if err := os.MkdirAll(p.path, 0o700); err != nil {
+		log.Error(common.NewError("failed to create profile path").Base(err))
+		return
+	}
+	path := filepath.Join(p.path, "handshake-"+now.Format("20060102-150405")+".pprof")
+	file, err := os.Create(path)
+	if err != nil {
+		log.Error(common.NewError("failed to create profile").Base(err))
+		return
+	}
+	defer file.Close()
+	// 同一时间只能有一个 CPU profile
+	if err := pprof.StartCPUProfile(file); err != nil {
+		log.Error(common.NewError("failed to start cpu profile").Base(err))
+		os.Remove(path)
+		return
+	}
+	log.Warn("sustained slow handshakes, capturing cpu profile to", path)
+	select {
+	case <-time.After(p.duration):
+	case <-p.ctx.Done():
+	}
+	pprof.StopCPUProfile()
+	metrics.HandshakeProfiles.Inc()
+	log.Info("cpu profile saved to", path)
+}
+
+// slowHandshakeLog logs the handshakes exceeding the threshold with the time spent on each stage.
+// A nil slowHandshakeLog logs nothing
+type slowHandshakeLog struct {
+	threshold time.Duration
+	profiler  *handshakeProfiler // 为空时不采集 CPU profile
+}
+
+// observe checks the handshake of the connection, the authentication started at authStart has just completed
+func (l *slowHandshakeLog) observe(addr net.Addr, accepted, handshaked, authStart time.Time) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	start := accepted
+	if start.IsZero() {
+		start = authStart
+	}
+	total := now.Sub(start)
+	if total < l.threshold {
+		return
+	}
+	metrics.SlowHandshakes.Inc()
+	// 各阶段：接受 TCP 连接 -> TLS 握手完成 -> 开始读取 trojan 请求 -> 认证完成
+	stages := []string{"total " + total.String()}
+	if !accepted.IsZero() && !handshaked.IsZero() {
+		stages = append(stages, "accept->tls "+handshaked.Sub(accepted).String(), "tls->trojan "+authStart.Sub(handshaked).String())
+	} else if !accepted.IsZero() {
+		stages = append(stages, "accept->trojan "+authStart.Sub(accepted).String())
+	}
+	stages = append(stages, "auth "+now.Sub(authStart).String())
+	log.Warn("slow handshake from", addr, strings.Join(stages, ", "))
+	if l.profiler != nil {
+		l.profiler.record(now)
+	}
+}
+
+func newSlowHandshakeLog(ctx context.Context, cfg *SlowHandshakeConfig) (*slowHandshakeLog, error) {
+	if cfg.Threshold <= 0 {
+		return nil, nil
+	}
+	l := &slowHandshakeLog{
+		threshold: time.Duration(cfg.Threshold) * time.Millisecond,
+	}
+	if cfg.Profile.Enabled {
+		if cfg.Profile.Count <= 0 || cfg.Profile.Window <= 0 || cfg.Profile.Duration <= 0 || cfg.Profile.Cooldown < 0 {
+			return nil, common.NewError("invalid slow handshake profile count, window, duration or cooldown")
+		}
+		path, err := filepath.Abs(cfg.Profile.Path)
+		if err != nil {
+			return nil, common.NewError("invalid slow handshake profile path").Base(err)
+		}
+		l.profiler = &handshakeProfiler{
+			ctx:      ctx,
+			path:     path,
+			count:    cfg.Profile.Count,
+			window:   time.Duration(cfg.Profile.Window) * time.Second,
+			duration: time.Duration(cfg.Profile.Duration) * time.Second,
+			cooldown: time.Duration(cfg.Profile.Cooldown) * time.Second,
+		}
+	}
+	log.Info("logging handshakes slower than", l.threshold)
+	return l, nil
+}
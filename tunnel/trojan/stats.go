@@ -0,0 +1,218 @@
+package trojan
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// maxDestinations limits the number of destinations tracked by the client
+const maxDestinations = 512
+
+type clientStatsKey struct{}
+
+// clientStatsKind is the kind of the statistics shared by the trojan clients of a proxy and the overlays above them in the registry
+const clientStatsKind = "trojan.client_stats"
+
+// DestinationStats is the traffic of a destination relayed by the trojan client
+type DestinationStats struct {
+	// WARNING: do not change the order of these fields.
+	// 64-bit fields that use `sync/atomic` package functions
+	// must be 64-bit aligned on 32-bit systems.
+	sent        uint64
+	recv        uint64
+	connections uint64 // 累计连接数
+	active      int64  // 当前活跃连接数
+	lastActive  int64
+
+	Destination string
+}
+
+func (d *DestinationStats) onSent(n int) {
+	atomic.AddUint64(&d.sent, uint64(n))
+}
+
+func (d *DestinationStats) onRecv(n int) {
+	atomic.AddUint64(&d.recv, uint64(n))
+}
+
+func (d *DestinationStats) onClose() {
+	atomic.AddInt64(&d.active, -1)
+	atomic.StoreInt64(&d.lastActive, time.Now().UnixNano())
+}
+
+// DestinationInfo is a snapshot of DestinationStats
+type DestinationInfo struct {
+	Destination string
+	Sent        uint64
+	Recv        uint64
+	Connections uint64
+	Active      int64
+}
+
+// ClientInfo is a snapshot of ClientStats
+type ClientInfo struct {
+	ActiveConnections int64
+	RTT               time.Duration
+	Dials             uint64
+	DialFailures      uint64
+	Destinations      []*DestinationInfo
+}
+
+// ClientStats collects connection statistics of a trojan client for the local API
+type ClientStats struct {
+	dials        uint64
+	dialFailures uint64
+	active       int64
+	rtt          int64 // 最近一次与服务器建立连接（含 TLS 握手）的耗时
+
+	sync.Mutex
+	destinations map[string]*DestinationStats
+}
+
+func (s *ClientStats) onDial(elapsed time.Duration, err error) {
+	if err != nil {
+		atomic.AddUint64(&s.dialFailures, 1)
+		return
+	}
+	atomic.AddUint64(&s.dials, 1)
+	atomic.StoreInt64(&s.rtt, int64(elapsed))
+}
+
+// evict removes the idlest destination without active connections.
+// The mutex should be locked when this function is called
+func (s *ClientStats) evict() {
+	var idlest *DestinationStats
+	for _, d := range s.destinations {
+		if atomic.LoadInt64(&d.active) > 0 {
+			continue
+		}
+		if idlest == nil || atomic.LoadInt64(&d.lastActive) < atomic.LoadInt64(&idlest.lastActive) {
+			idlest = d
+		}
+	}
+	if idlest != nil {
+		delete(s.destinations, idlest.Destination)
+	}
+}
+
+// onOpen registers a new connection to the destination
+func (s *ClientStats) onOpen(destination string) *DestinationStats {
+	atomic.AddInt64(&s.active, 1)
+	s.Lock()
+	defer s.Unlock()
+	d, found := s.destinations[destination]
+	if !found {
+		if len(s.destinations) >= maxDestinations {
+			s.evict()
+		}
+		d = &DestinationStats{
+			Destination: destination,
+		}
+		s.destinations[destination] = d
+	}
+	atomic.AddUint64(&d.connections, 1)
+	atomic.AddInt64(&d.active, 1)
+	atomic.StoreInt64(&d.lastActive, time.Now().UnixNano())
+	return d
+}
+
+func (s *ClientStats) onClose(d *DestinationStats) {
+	atomic.AddInt64(&s.active, -1)
+	d.onClose()
+}
+
+// Snapshot returns the current statistics, destinations are sorted by total traffic
+func (s *ClientStats) Snapshot() *ClientInfo {
+	info := &ClientInfo{
+		ActiveConnections: atomic.LoadInt64(&s.active),
+		RTT:               time.Duration(atomic.LoadInt64(&s.rtt)),
+		Dials:             atomic.LoadUint64(&s.dials),
+		DialFailures:      atomic.LoadUint64(&s.dialFailures),
+	}
+	s.Lock()
+	info.Destinations = make([]*DestinationInfo, 0, len(s.destinations))
+	for _, d := range s.destinations {
+		info.Destinations = append(info.Destinations, &DestinationInfo{
+			Destination: d.Destination,
+			Sent:        atomic.LoadUint64(&d.sent),
+			Recv:        atomic.LoadUint64(&d.recv),
+			Connections: atomic.LoadUint64(&d.connections),
+			Active:      atomic.LoadInt64(&d.active),
+		})
+	}
+	s.Unlock()
+	sort.Slice(info.Destinations, func(i, j int) bool {
+		a, b := info.Destinations[i], info.Destinations[j]
+		return a.Sent+a.Recv > b.Sent+b.Recv
+	})
+	return info
+}
+
+func NewClientStats() *ClientStats {
+	return &ClientStats{
+		destinations: make(map[string]*DestinationStats),
+	}
+}
+
+// StreamConn records the traffic of a stream relayed over a trojan mux connection under the destination of the stream,
+// the destinations of the streams are invisible to the trojan client
+type StreamConn struct {
+	tunnel.Conn
+	stats       *ClientStats
+	destination *DestinationStats
+	closeOnce   sync.Once
+}
+
+func (c *StreamConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.destination.onSent(n)
+	return n, err
+}
+
+func (c *StreamConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.destination.onRecv(n)
+	return n, err
+}
+
+func (c *StreamConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stats.onClose(c.destination)
+	})
+	return c.Conn.Close()
+}
+
+// TrackStream registers a stream to the destination, the returned conn records its traffic.
+// The conn is returned as is if s is nil
+func (s *ClientStats) TrackStream(conn tunnel.Conn, destination string) tunnel.Conn {
+	if s == nil {
+		return conn
+	}
+	return &StreamConn{
+		Conn:        conn,
+		stats:       s,
+		destination: s.onOpen(destination),
+	}
+}
+
+// SharedClientStats returns the statistics of the trojan clients in the registry of ctx, or nil if there is none
+func SharedClientStats(ctx context.Context) *ClientStats {
+	s, _ := tunnel.RegistryFromContext(ctx).Shared(clientStatsKind, nil).(*ClientStats)
+	return s
+}
+
+// WithClientStats stores the client statistics into the context, so that the API service can access it
+func WithClientStats(ctx context.Context, s *ClientStats) context.Context {
+	return context.WithValue(ctx, clientStatsKey{}, s)
+}
+
+// ClientStatsFromContext extracts the client statistics from a context
+func ClientStatsFromContext(ctx context.Context) *ClientStats {
+	s, _ := ctx.Value(clientStatsKey{}).(*ClientStats)
+	return s
+}
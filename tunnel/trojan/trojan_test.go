@@ -3,17 +3,28 @@ package trojan
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
 	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/metrics"
+	"github.com/p4gefau1t/trojan-go/statistic"
 	"github.com/p4gefau1t/trojan-go/statistic/memory"
 	"github.com/p4gefau1t/trojan-go/test/util"
 	"github.com/p4gefau1t/trojan-go/tunnel"
 	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
+	"github.com/p4gefau1t/trojan-go/tunnel/mux"
 	"github.com/p4gefau1t/trojan-go/tunnel/transport"
 )
 
@@ -26,6 +37,7 @@ func TestTrojan(t *testing.T) {
 		RemotePort: port,
 	}
 	ctx, cancel := context.WithCancel(context.Background())
+	ctx = tunnel.WithScopedRegistry(ctx) // 客户端统计不与其他测试共用
 	ctx = config.WithConfig(ctx, transport.Name, transportConfig)
 	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
 	tcpClient, err := transport.NewClient(ctx, nil)
@@ -84,10 +96,55 @@ func TestTrojan(t *testing.T) {
 
 	fmt.Println(m)
 
+	sessions := s.sessions.List()
+	if len(sessions) != 1 || sessions[0].Destination != "example.com:80" || sessions[0].Recv != 8 {
+		t.Fatal("wrong udp session", sessions)
+	}
+
 	if !util.CheckPacketOverConn(packet1, packet2) {
 		t.Fail()
 	}
 
+	prober, err := NewProber(c, &ProbeConfig{
+		Interval:  1,
+		Timeout:   3,
+		Target:    "example.com:80",
+		Threshold: 1000,
+		History:   2,
+	})
+	common.Must(err)
+	go func() {
+		probeConn, err := s.AcceptConn(nil)
+		common.Must(err)
+		probeBuf := [64]byte{}
+		probeConn.Read(probeBuf[:])
+		probeConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		probeConn.Close()
+	}()
+	prober.record(prober.probe())
+	if latency, ok := prober.Latency(); !ok || !prober.Healthy() || latency < prober.History()[0].Handshake {
+		t.Fatal("probe failed", prober.History()[0].Err)
+	}
+	// 未配置探测目标时由服务器直接响应
+	prober, err = NewProber(c, &ProbeConfig{Interval: 1, Timeout: 3, Threshold: 1000, History: 2})
+	common.Must(err)
+	if result := prober.probe(); result.Err != nil || result.RTT < result.Handshake {
+		t.Fatal("probe without target failed", result.Err)
+	}
+	// 密码错误时响应来自回落地址
+	wrongClient, err := NewClient(config.WithConfig(clientCtx, memory.Name, &memory.Config{Passwords: []string{"wrong"}}), tcpClient)
+	common.Must(err)
+	prober, err = NewProber(wrongClient, &ProbeConfig{Interval: 1, Timeout: 3, Threshold: 1000, History: 2})
+	common.Must(err)
+	if result := prober.probe(); result.Err == nil {
+		t.Fatal("probe with wrong password succeeded")
+	}
+
+	stats := c.stats.Snapshot()
+	if stats.ActiveConnections != 2 || stats.Dials != 2 || len(stats.Destinations) != 2 {
+		t.Fatal("wrong client stats", stats)
+	}
+
 	// redirecting
 	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	common.Must(err)
@@ -104,8 +161,687 @@ func TestTrojan(t *testing.T) {
 	conn2.Close()
 	packet1.Close()
 	packet2.Close()
+	if len(s.sessions.List()) != 0 {
+		t.Fatal("udp session is not removed")
+	}
+	stats = c.stats.Snapshot()
+	if stats.ActiveConnections != 0 {
+		t.Fatal("active connections are not released", stats.ActiveConnections)
+	}
+	for _, d := range stats.Destinations {
+		if d.Connections != 1 || d.Active != 0 || d.Sent == 0 {
+			t.Fatal("wrong destination stats", d)
+		}
+	}
 	conn.Close()
 	c.Close()
 	s.Close()
 	cancel()
 }
+
+func TestSessionTable(t *testing.T) {
+	ctx := config.WithConfig(context.Background(), memory.Name, &memory.Config{Passwords: []string{"user1", "user2"}})
+	auth, err := memory.NewAuthenticator(ctx)
+	common.Must(err)
+	_, user1 := auth.AuthUser(common.SHA224String("user1"))
+	_, user2 := auth.AuthUser(common.SHA224String("user2"))
+
+	closed := make(map[uint64]bool)
+	table := NewSessionTable(3, 2)
+	add := func(user statistic.User) *Session {
+		var s *Session
+		s = table.Add(user, &net.UDPAddr{}, func() error {
+			closed[s.id] = true
+			table.Remove(s)
+			return nil
+		})
+		return s
+	}
+
+	s1 := add(user1)
+	s2 := add(user1)
+	s1.touch() // s2 becomes the least recently used one
+	s3 := add(user1)
+	if !closed[s2.id] || closed[s1.id] || len(table.List()) != 2 {
+		t.Fatal("per-user cap is not applied")
+	}
+	add(user2)
+	s5 := add(user2)
+	if !closed[s1.id] || closed[s3.id] || closed[s5.id] || len(table.List()) != 3 {
+		t.Fatal("global cap is not applied")
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = config.WithConfig(ctx, memory.Name, &memory.Config{Passwords: []string{"password"}})
+	auth, err := memory.NewAuthenticator(ctx)
+	common.Must(err)
+	_, user := auth.AuthUser(common.SHA224String("password"))
+
+	// 由测试充当插件，直接把数据报发给服务端的 UDP 端口
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	common.Must(err)
+	defer serverConn.Close()
+	packetChan := make(chan tunnel.PacketConn, 1)
+	go newDatagramServer(ctx, serverConn, auth, NewSessionTable(0, 0), nil, packetChan, 0).loop()
+
+	conn, err := net.Dial("udp", serverConn.LocalAddr().String())
+	common.Must(err)
+	// 无效的用户被丢弃
+	invalid := &datagramConn{Conn: conn, hash: common.SHA224String("invalid"), user: user}
+	target := &tunnel.Metadata{Address: tunnel.NewAddressFromHostPort("udp", "example.com", 53)}
+	common.Must2(invalid.WriteWithMetadata([]byte("invalid"), target))
+
+	client := &datagramConn{Conn: conn, hash: common.SHA224String("password"), user: user}
+	defer client.Close()
+	common.Must2(client.WriteWithMetadata([]byte("hello"), target))
+
+	var server tunnel.PacketConn
+	select {
+	case server = <-packetChan:
+	case <-time.After(time.Second * 3):
+		t.Fatal("no session is accepted")
+	}
+	buf := make([]byte, common.PacketSize())
+	n, m, err := server.ReadWithMetadata(buf)
+	common.Must(err)
+	if string(buf[:n]) != "hello" || m.Address.String() != target.Address.String() || m.User == nil {
+		t.Fatal("wrong packet", string(buf[:n]), m)
+	}
+
+	common.Must2(server.WriteWithMetadata([]byte("world"), target))
+	client.SetReadDeadline(time.Now().Add(time.Second * 3))
+	n, m, err = client.ReadWithMetadata(buf)
+	common.Must(err)
+	if string(buf[:n]) != "world" || m.Address.String() != target.Address.String() {
+		t.Fatal("wrong reply", string(buf[:n]), m)
+	}
+
+	// 超过数据报最大长度的包被分片发送，对端重组
+	large := util.GeneratePayload(3000)
+	client.fragment = 200
+	client.partials = newReassembler()
+	common.Must2(client.WriteWithMetadata(large, target))
+	n, _, err = server.ReadWithMetadata(buf)
+	common.Must(err)
+	if !bytes.Equal(buf[:n], large) {
+		t.Fatal("wrong reassembled packet", n)
+	}
+	server.(*datagramSession).server.fragment = 200
+	common.Must2(server.WriteWithMetadata(large, target))
+	n, _, err = client.ReadWithMetadata(buf)
+	common.Must(err)
+	if !bytes.Equal(buf[:n], large) {
+		t.Fatal("wrong reassembled reply", n)
+	}
+
+	// 过大的包被丢弃，不影响后面的包
+	oversized := oversizedPackets.Value()
+	common.Must2(server.WriteWithMetadata(large, target))
+	common.Must2(server.WriteWithMetadata([]byte("world"), target))
+	n, _, err = client.ReadWithMetadata(buf[:1000])
+	common.Must(err)
+	if string(buf[:n]) != "world" || oversizedPackets.Value() != oversized+1 {
+		t.Fatal("oversized packet is not dropped", n)
+	}
+	server.Close()
+}
+
+func TestFragment(t *testing.T) {
+	prefix := []byte("prefix")
+	packet := util.GeneratePayload(1000)
+	fragments, err := fragmentPacket(prefix, packet, 106, 1)
+	common.Must(err)
+	if len(fragments) != 11 {
+		t.Fatal("wrong fragments", len(fragments))
+	}
+	for _, f := range fragments {
+		if len(f) > 106 || !bytes.HasPrefix(f, prefix) {
+			t.Fatal("wrong fragment", len(f))
+		}
+	}
+	r := newReassembler()
+	now := time.Now()
+	add := func(source string, i int, now time.Time) []byte {
+		b, err := r.add(source, fragments[i][len(prefix):], now)
+		common.Must(err)
+		return b
+	}
+
+	// 乱序和重复的分片，其他来源的相同 id 不混淆
+	for i := len(fragments) - 1; i > 0; i-- {
+		if add("a", i, now) != nil || add("a", i, now) != nil {
+			t.Fatal("packet is reassembled early")
+		}
+	}
+	if add("b", 0, now) != nil {
+		t.Fatal("fragments of different sources are mixed")
+	}
+	if !bytes.Equal(add("a", 0, now), packet) {
+		t.Fatal("wrong reassembled packet")
+	}
+
+	// 过期的分片被丢弃
+	for i := 1; i < len(fragments); i++ {
+		if add("b", i, now.Add(fragmentTimeout*2)) != nil {
+			t.Fatal("expired fragment is reassembled")
+		}
+	}
+	if _, err := r.add("a", []byte{fragmentMarker, 0, 1, 2, 2}, now); err == nil {
+		t.Fatal("invalid fragment accepted")
+	}
+	if _, err := fragmentPacket(prefix, util.GeneratePayload(65535), 128, 1); err == nil {
+		t.Fatal("too many fragments accepted")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	events := make(chan *HookEvent, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &HookEvent{}
+		common.Must(json.NewDecoder(r.Body).Decode(event))
+		events <- event
+	}))
+	defer server.Close()
+
+	if NewHooks(context.Background(), &HooksConfig{}) != nil {
+		t.Fatal("hooks should be disabled")
+	}
+	hooks := NewHooks(context.Background(), &HooksConfig{
+		OnDisconnect: HookConfig{Webhook: server.URL},
+	})
+	hooks.Fire(&HookEvent{Event: EventConnect, User: "user"})
+	hooks.Fire(&HookEvent{Event: EventDisconnect, User: "user", IP: "127.0.0.1", Sent: 10, Recv: 20})
+	select {
+	case e := <-events:
+		if e.Event != EventDisconnect || e.User != "user" || e.IP != "127.0.0.1" || e.Sent != 10 || e.Recv != 20 || e.Time == 0 {
+			t.Fatal("wrong event", e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	select {
+	case e := <-events:
+		t.Fatal("unexpected event", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestEvents(t *testing.T) {
+	batches := make(chan []*HookEvent, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []*HookEvent
+		common.Must(json.NewDecoder(r.Body).Decode(&batch))
+		batches <- batch
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "events.log")
+	sinks, err := newEventSinks(ctx, &EventsConfig{
+		File:    path,
+		Webhook: server.URL,
+		Buffer:  16,
+	})
+	common.Must(err)
+	events := make(ChannelSink, 1)
+	hooks := NewHooks(ctx, &HooksConfig{}, append(sinks, events)...)
+	hooks.Fire(&HookEvent{Event: EventConnect, User: "user", IP: "127.0.0.1", Destination: "example.com:443"})
+	hooks.Fire(&HookEvent{Event: EventDisconnect, User: "user", IP: "127.0.0.1", Sent: 10, Recv: 20, Duration: 1000})
+
+	// 通道满时丢弃事件
+	if e := <-events; e.Event != EventConnect || e.Time == 0 {
+		t.Fatal("wrong event", e)
+	}
+	select {
+	case e := <-events:
+		t.Fatal("unexpected event", e)
+	default:
+	}
+
+	var posted []*HookEvent
+	for len(posted) < 2 {
+		select {
+		case batch := <-batches:
+			posted = append(posted, batch...)
+		case <-time.After(3 * time.Second):
+			t.Fatal("event webhook not called")
+		}
+	}
+	if len(posted) != 2 || posted[1].Event != EventDisconnect || posted[1].Sent != 10 || posted[1].Duration != 1000 {
+		t.Fatal("wrong events posted", posted)
+	}
+
+	data, err := os.ReadFile(path)
+	common.Must(err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatal("wrong event file", string(data))
+	}
+	e := &HookEvent{}
+	common.Must(json.Unmarshal([]byte(lines[0]), e))
+	if e.Event != EventConnect || e.Destination != "example.com:443" {
+		t.Fatal("wrong event in file", e)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for _, distribution := range []string{"uniform", "exponential"} {
+		jitter, err := NewJitter(&JitterConfig{Min: 5, Max: 20, Distribution: distribution})
+		common.Must(err)
+		for i := 0; i < 1000; i++ {
+			if d := jitter.Delay(); d < 5*time.Millisecond || d > 20*time.Millisecond {
+				t.Fatal("delay out of bounds", distribution, d)
+			}
+		}
+	}
+	if _, err := NewJitter(&JitterConfig{Min: 20, Max: 5}); err == nil {
+		t.Fatal("invalid bounds accepted")
+	}
+	if _, err := NewJitter(&JitterConfig{Max: 5, Distribution: "normal"}); err == nil {
+		t.Fatal("unknown distribution accepted")
+	}
+}
+
+func TestCover(t *testing.T) {
+	requests := make(chan *http.Request, 4)
+	website := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/about">about</a><a href="https://example.org/">external</a>`))
+	}))
+	defer website.Close()
+	websiteHost, websitePort, err := net.SplitHostPort(website.Listener.Addr().String())
+	common.Must(err)
+	redirPort, err := strconv.Atoi(websitePort)
+	common.Must(err)
+
+	serverPort := common.PickPort("tcp", "127.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = config.WithConfig(ctx, transport.Name, &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  serverPort,
+		RemoteHost: "127.0.0.1",
+		RemotePort: serverPort,
+	})
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	ctx = config.WithConfig(ctx, memory.Name, &memory.Config{Passwords: []string{"password"}})
+	tcpClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(config.WithConfig(ctx, Name, &Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  serverPort,
+		RemoteHost: websiteHost,
+		RemotePort: redirPort,
+	}), tcpServer)
+	common.Must(err)
+	defer s.Close()
+	c, err := NewClient(config.WithConfig(ctx, Name, &Config{
+		RemoteHost: "127.0.0.1",
+		RemotePort: serverPort,
+	}), tcpClient)
+	common.Must(err)
+	defer c.Close()
+
+	cover, err := NewCover(c, &CoverConfig{Host: "www.example.com", Interval: 20, MaxSize: 1024}, "127.0.0.1")
+	common.Must(err)
+	// 未认证的请求被服务端转发到伪装站点
+	common.Must(cover.request("/"))
+	r := <-requests
+	if r.URL.Path != "/" || r.Host != "www.example.com" || r.UserAgent() != coverUA {
+		t.Fatal("wrong cover request", r.URL.Path, r.Host, r.UserAgent())
+	}
+	if len(cover.paths) != 2 || cover.paths[1] != "/about" {
+		t.Fatal("links not discovered", cover.paths)
+	}
+	if sent, recv := c.user.GetTraffic(); sent != 0 || recv != 0 {
+		t.Fatal("cover traffic should not be counted", sent, recv)
+	}
+
+	if _, err := NewCover(c, &CoverConfig{Paths: []string{"about"}, Interval: 20, MaxSize: 1024}, ""); err == nil {
+		t.Fatal("invalid path accepted")
+	}
+}
+
+func TestSlowHandshakeLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	l, err := newSlowHandshakeLog(ctx, &SlowHandshakeConfig{
+		Threshold: 50,
+		Profile: HandshakeProfileConfig{
+			Enabled:  true,
+			Path:     dir,
+			Count:    2,
+			Window:   60,
+			Duration: 1,
+			Cooldown: 600,
+		},
+	})
+	common.Must(err)
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	slow := metrics.SlowHandshakes.Value()
+	now := time.Now()
+	l.observe(addr, now.Add(-time.Millisecond*10), now.Add(-time.Millisecond*5), now)
+	if metrics.SlowHandshakes.Value() != slow {
+		t.Fatal("fast handshake is logged")
+	}
+	for i := 0; i < 3; i++ {
+		now = time.Now()
+		l.observe(addr, now.Add(-time.Millisecond*300), now.Add(-time.Millisecond*200), now.Add(-time.Millisecond*10))
+	}
+	if metrics.SlowHandshakes.Value() != slow+3 {
+		t.Fatal("slow handshakes are not counted")
+	}
+
+	// 第二次慢握手触发采集，冷却时间内不再采集
+	time.Sleep(time.Millisecond * 1500)
+	files, err := filepath.Glob(filepath.Join(dir, "handshake-*.pprof"))
+	common.Must(err)
+	if len(files) != 1 {
+		t.Fatal("unexpected profiles", files)
+	}
+	if info, err := os.Stat(files[0]); err != nil || info.Size() == 0 {
+		t.Fatal("empty profile")
+	}
+
+	var nilLog *slowHandshakeLog
+	nilLog.observe(addr, time.Time{}, time.Time{}, time.Now())
+	if l, err := newSlowHandshakeLog(ctx, &SlowHandshakeConfig{}); err != nil || l != nil {
+		t.Fatal("slow handshake log should be disabled")
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	fallback, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer fallback.Close()
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = config.WithConfig(ctx, transport.Name, &transport.Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+	})
+	ctx = config.WithConfig(ctx, memory.Name, &memory.Config{Passwords: []string{"password"}})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		RemoteHost:  "127.0.0.1",
+		RemotePort:  fallback.Addr().(*net.TCPAddr).Port,
+		AuthTimeout: 1,
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	// 连接后不发送任何数据
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	common.Must(err)
+	defer conn.Close()
+	start := time.Now()
+
+	// 重定向之后不再有超时，数据照常转发
+	go func() {
+		time.Sleep(time.Millisecond * 1500)
+		conn.Write([]byte("GET / HTTP/1.1\r\n"))
+	}()
+	for {
+		redirected, err := fallback.Accept()
+		common.Must(err)
+		accepted := time.Since(start)
+		buf := [16]byte{}
+		redirected.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := io.ReadFull(redirected, buf[:]); err == io.EOF { // 回落地址的健康检查
+			redirected.Close()
+			continue
+		}
+		redirected.Close()
+		if string(buf[:]) != "GET / HTTP/1.1\r\n" {
+			t.Fatal("data is not redirected", string(buf[:]))
+		}
+		// 在客户端发送数据之前因超时被重定向
+		if accepted < time.Millisecond*900 || accepted > time.Millisecond*1400 {
+			t.Fatal("unexpected auth timeout", accepted)
+		}
+		break
+	}
+}
+
+func TestAntiReplay(t *testing.T) {
+	redirected := make(chan string, 4)
+	fallback, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer fallback.Close()
+	go func() {
+		for {
+			conn, err := fallback.Accept()
+			if err != nil {
+				return
+			}
+			buf := [56]byte{}
+			io.ReadFull(conn, buf[:])
+			conn.Close()
+			redirected <- string(buf[:])
+		}
+	}()
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = config.WithConfig(ctx, transport.Name, &transport.Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+	})
+	ctx = config.WithConfig(ctx, memory.Name, &memory.Config{Passwords: []string{"password"}})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		RemoteHost:       "127.0.0.1",
+		RemotePort:       fallback.Addr().(*net.TCPAddr).Port,
+		DisableHTTPCheck: true,
+		AntiReplay:       AntiReplayConfig{Enabled: true, Window: 60, Size: 16},
+		Mux:              MuxConfig{Identifier: "MUX_CONN"},
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	hash := common.SHA224String("password")
+	send := func(data string) net.Conn {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		common.Must(err)
+		t.Cleanup(func() { conn.Close() })
+		common.Must2(conn.Write([]byte(data)))
+		return conn
+	}
+	accept := func() {
+		inbound, err := s.AcceptConn(nil)
+		common.Must(err)
+		inbound.Close()
+	}
+	// 捕获的请求：头部和随后的数据
+	captured := hash + "\r\n\x01\x01\x7f\x00\x00\x01\x00\x50\r\nGET / HTTP/1.1\r\n\r\n"
+	send(captured)
+	accept()
+
+	// 重放的请求与认证失败的连接一样被重定向
+	send(captured)
+	select {
+	case got := <-redirected:
+		if got != hash {
+			t.Fatal("wrong data redirected", got)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("replayed request is not redirected")
+	}
+
+	// 数据不同的请求不是重放
+	send(hash + "\r\n\x01\x01\x7f\x00\x00\x01\x00\x50\r\nGET /other HTTP/1.1\r\n\r\n")
+	accept()
+
+	// 多路复用连接的开头总是相同的，不检测
+	muxRequest := hash + "\r\n\x01\x03\x08MUX_CONN\x00\x50\r\n"
+	for i := 0; i < 2; i++ {
+		send(muxRequest)
+		inbound, err := s.AcceptConn(&mux.Tunnel{})
+		common.Must(err)
+		inbound.Close()
+	}
+	select {
+	case got := <-redirected:
+		t.Fatal("unexpected redirection", got)
+	default:
+	}
+}
+
+func TestMuxSignal(t *testing.T) {
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = config.WithConfig(ctx, transport.Name, &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+	})
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	ctx = config.WithConfig(ctx, memory.Name, &memory.Config{Passwords: []string{"password"}})
+	tcpClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+
+	// 服务端不再识别 MUX_CONN，使用自定义的命令字节
+	muxConfig := MuxConfig{Command: 0x42}
+	c, err := NewClient(config.WithConfig(ctx, Name, &Config{Mux: muxConfig}), tcpClient)
+	common.Must(err)
+	s, err := NewServer(config.WithConfig(ctx, Name, &Config{
+		RemoteHost:       "127.0.0.1",
+		RemotePort:       util.EchoPort,
+		DisableHTTPCheck: true,
+		Mux:              muxConfig,
+	}), tcpServer)
+	common.Must(err)
+	defer c.Close()
+	defer s.Close()
+
+	conn1, err := c.DialConn(&tunnel.Address{DomainName: "MUX_CONN", AddressType: tunnel.DomainName}, &mux.Tunnel{})
+	common.Must(err)
+	common.Must2(conn1.Write([]byte("12345678")))
+	conn2, err := s.AcceptConn(&mux.Tunnel{})
+	common.Must(err)
+	buf := [8]byte{}
+	common.Must2(io.ReadFull(conn2, buf[:]))
+	if string(buf[:]) != "12345678" {
+		t.Fatal("wrong mux payload", buf)
+	}
+	conn1.Close()
+	conn2.Close()
+
+	conn1, err = c.DialConn(&tunnel.Address{DomainName: "MUX_CONN", AddressType: tunnel.DomainName, Port: 80}, nil)
+	common.Must(err)
+	common.Must2(conn1.Write([]byte("12345678")))
+	conn2, err = s.AcceptConn(nil)
+	common.Must(err)
+	if conn2.Metadata().DomainName != "MUX_CONN" {
+		t.Fatal("connection to MUX_CONN is not relayed", conn2.Metadata())
+	}
+	conn1.Close()
+	conn2.Close()
+
+	if err := (&Config{Mux: MuxConfig{Command: int(Connect)}}).Validate(); err == nil {
+		t.Fatal("conflicting mux command accepted")
+	}
+}
+
+func TestUserFallbacks(t *testing.T) {
+	accepted := make(chan string, 3)
+	listen := func(name string) int {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		common.Must(err)
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				buf := [56]byte{}
+				io.ReadFull(conn, buf[:])
+				conn.Close()
+				accepted <- name + ":" + string(buf[:])
+			}
+		}()
+		return l.Addr().(*net.TCPAddr).Port
+	}
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = config.WithConfig(ctx, transport.Name, &transport.Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+	})
+	ctx = config.WithConfig(ctx, memory.Name, &memory.Config{Passwords: []string{"password"}})
+	cfg := &Config{
+		RemoteHost:       "127.0.0.1",
+		RemotePort:       listen("main"),
+		DisableHTTPCheck: true,
+		UserFallbacks: []UserFallbackConfig{
+			{Password: "banned", RemotePort: listen("banned")},
+			{Hash: "*", RemotePort: listen("others")},
+		},
+	}
+	common.Must(cfg.Validate())
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(config.WithConfig(ctx, Name, cfg), tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	redirect := func(data, fallback string) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		common.Must(err)
+		defer conn.Close()
+		common.Must2(conn.Write([]byte(data)))
+		select {
+		case got := <-accepted:
+			if got != fallback+":"+data[:56] {
+				t.Fatal("wrong fallback", got, "expected", fallback)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("not redirected to", fallback)
+		}
+	}
+	hash := common.SHA224String("password")
+	redirect(common.SHA224String("banned")+"\r\n", "banned")
+	// 随机的哈希来自探测者，与其他数据一样看到伪装网站
+	redirect(common.SHA224String("unknown")+"\r\n", "main")
+	redirect(strings.Repeat("GET / HTTP/1.1\r\n", 4), "main")
+	// 已有用户的请求无效
+	redirect(hash+"\r\n\xff\r\n", "others")
+
+	// 认证成功过的用户被删除后仍然是已知的
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	common.Must(err)
+	common.Must2(conn.Write([]byte(hash + "\r\n\x01\x01\x7f\x00\x00\x01\x00\x50\r\n")))
+	inbound, err := s.AcceptConn(nil)
+	common.Must(err)
+	inbound.Close()
+	conn.Close()
+	common.Must(s.auth.(interface{ DelUser(string) error }).DelUser(hash))
+	redirect(hash+"\r\n", "others")
+
+	if err := (&Config{UserFallbacks: []UserFallbackConfig{{Hash: "abc", RemotePort: 80}}}).Validate(); err == nil {
+		t.Fatal("invalid hash accepted")
+	}
+}
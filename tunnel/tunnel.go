@@ -4,6 +4,8 @@ import (
 	"context"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/p4gefau1t/trojan-go/common"
 )
@@ -26,11 +28,23 @@ type ConnDialer interface {
 	DialConn(*Address, Tunnel) (Conn, error)
 }
 
+// MetadataDialer creates TCP connections with the whole metadata of the request,
+// so that the dialer can make decisions on fields other than the address, e.g. the inbound
+type MetadataDialer interface {
+	DialConnWithMetadata(*Metadata, Tunnel) (Conn, error)
+}
+
 // PacketDialer creates UDP packet stream from the tunnel
 type PacketDialer interface {
 	DialPacket(Tunnel) (PacketConn, error)
 }
 
+// MetadataPacketDialer creates UDP packet streams with the metadata of the inbound packet stream,
+// e.g. the user of the stream. The address in the metadata is not used
+type MetadataPacketDialer interface {
+	DialPacketWithMetadata(*Metadata, Tunnel) (PacketConn, error)
+}
+
 // ConnListener accept TCP connections
 type ConnListener interface {
 	AcceptConn(Tunnel) (Conn, error) // 获取下一层协议的连接
@@ -66,6 +80,72 @@ type Server interface {
 	io.Closer
 }
 
+// AcceptTimer is implemented by the conns which know when the tcp connection under them was accepted
+type AcceptTimer interface {
+	AcceptTime() time.Time
+}
+
+// AcceptTimeOf returns the time when the tcp connection under the conn was accepted, or the zero time if it is unknown
+func AcceptTimeOf(conn net.Conn) time.Time {
+	if t, ok := conn.(AcceptTimer); ok {
+		return t.AcceptTime()
+	}
+	return time.Time{}
+}
+
+// HandshakeTimer is implemented by the conns which know when the tls handshake under them was completed
+type HandshakeTimer interface {
+	HandshakeTime() time.Time
+}
+
+// HandshakeTimeOf returns the time when the tls handshake under the conn was completed, or the zero time if it is unknown
+func HandshakeTimeOf(conn net.Conn) time.Time {
+	if t, ok := conn.(HandshakeTimer); ok {
+		return t.HandshakeTime()
+	}
+	return time.Time{}
+}
+
+// ClientRandomer is implemented by the conns which know the random of the tls client hello under them
+type ClientRandomer interface {
+	ClientRandom() []byte
+}
+
+// ClientRandomOf returns the random of the tls client hello under the conn, or nil if it is unknown
+func ClientRandomOf(conn net.Conn) []byte {
+	if r, ok := conn.(ClientRandomer); ok {
+		return r.ClientRandom()
+	}
+	return nil
+}
+
+// WireMeter is implemented by the conns which know the bytes on the tcp connection under them,
+// including the overhead of all the layers. ok is false if it is unknown
+type WireMeter interface {
+	WireTraffic() (sent, recv uint64, ok bool)
+}
+
+// WireTrafficOf returns the bytes sent and received on the tcp connection under the conn
+func WireTrafficOf(conn net.Conn) (sent, recv uint64, ok bool) {
+	if m, ok := conn.(WireMeter); ok {
+		return m.WireTraffic()
+	}
+	return 0, 0, false
+}
+
+// DatagramDialer is implemented by the clients which can also relay udp datagrams to the server besides the streams,
+// e.g. through a transport plugin supporting udp
+type DatagramDialer interface {
+	DatagramEnabled() bool
+	DialDatagram() (net.Conn, error)
+}
+
+// DatagramListener is implemented by the servers which can also receive udp datagrams from the clients.
+// DatagramConn returns nil if it is not enabled
+type DatagramListener interface {
+	DatagramConn() net.PacketConn
+}
+
 // Tunnel describes a tunnel, allowing creating a tunnel from another tunnel
 // We assume that the lower tunnels know exatly how upper tunnels work, and lower tunnels is transparent for the upper tunnels
 type Tunnel interface {
@@ -74,16 +154,122 @@ type Tunnel interface {
 	NewServer(context.Context, Server) (Server, error)
 }
 
-var tunnels = make(map[string]Tunnel)
+// Registry holds the tunnels which can be used to build the protocol stacks, and the running instances of them.
+// Each proxy instance can use its own registry, without affecting the others in the same process
+type Registry struct {
+	tunnels   map[string]Tunnel
+	lock      sync.Mutex
+	instances map[string]map[interface{}]struct{} // 运行中的实例，按种类保存
+	shared    map[string]interface{}              // 同一代理实例内共享的状态，如重放过滤器
+}
 
-// RegisterTunnel register a tunnel by tunnel name
-func RegisterTunnel(name string, tunnel Tunnel) {
-	tunnels[name] = tunnel
+// 各协议在 init 中注册到默认的注册表
+var defaultRegistry = &Registry{
+	tunnels:   make(map[string]Tunnel),
+	instances: make(map[string]map[interface{}]struct{}),
+	shared:    make(map[string]interface{}),
 }
 
-func GetTunnel(name string) (Tunnel, error) {
-	if t, ok := tunnels[name]; ok {
+// NewRegistry creates a registry containing all the tunnels registered to the default registry so far
+func NewRegistry() *Registry {
+	r := &Registry{
+		tunnels:   make(map[string]Tunnel, len(defaultRegistry.tunnels)),
+		instances: make(map[string]map[interface{}]struct{}),
+		shared:    make(map[string]interface{}),
+	}
+	for name, t := range defaultRegistry.tunnels {
+		r.tunnels[name] = t
+	}
+	return r
+}
+
+// AddInstance records a running instance of the kind, e.g. a router client controlled by the API.
+// The instance must be comparable, the returned function removes it
+func (r *Registry) AddInstance(kind string, instance interface{}) func() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	set, found := r.instances[kind]
+	if !found {
+		set = make(map[interface{}]struct{})
+		r.instances[kind] = set
+	}
+	set[instance] = struct{}{}
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		delete(r.instances[kind], instance)
+	}
+}
+
+// Instances returns the running instances of the kind
+func (r *Registry) Instances(kind string) []interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := make([]interface{}, 0, len(r.instances[kind]))
+	for instance := range r.instances[kind] {
+		result = append(result, instance)
+	}
+	return result
+}
+
+// Shared returns the state shared by all the instances of the kind, e.g. the replay filter of the listeners
+// of a proxy. It is created by create on the first call, if create is nil, nil is returned when there is none
+func (r *Registry) Shared(kind string, create func() interface{}) interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if v, found := r.shared[kind]; found {
+		return v
+	}
+	if create == nil {
+		return nil
+	}
+	v := create()
+	r.shared[kind] = v
+	return v
+}
+
+// RegisterTunnel register a tunnel by tunnel name to the registry
+func (r *Registry) RegisterTunnel(name string, tunnel Tunnel) {
+	r.tunnels[name] = tunnel
+}
+
+func (r *Registry) GetTunnel(name string) (Tunnel, error) {
+	if t, ok := r.tunnels[name]; ok {
 		return t, nil
 	}
 	return nil, common.NewError("unknown tunnel name " + name)
 }
+
+// RegisterTunnel register a tunnel by tunnel name to the default registry
+func RegisterTunnel(name string, tunnel Tunnel) {
+	defaultRegistry.RegisterTunnel(name, tunnel)
+}
+
+// GetTunnel finds the tunnel in the default registry
+func GetTunnel(name string) (Tunnel, error) {
+	return defaultRegistry.GetTunnel(name)
+}
+
+type registryKey struct{}
+
+// WithRegistry makes the protocol stacks built with the context use the tunnels in the registry
+func WithRegistry(ctx context.Context, r *Registry) context.Context {
+	return context.WithValue(ctx, registryKey{}, r)
+}
+
+// RegistryFromContext returns the registry in the context, or the default registry if there is none
+func RegistryFromContext(ctx context.Context) *Registry {
+	if r, ok := ctx.Value(registryKey{}).(*Registry); ok {
+		return r
+	}
+	return defaultRegistry
+}
+
+// WithScopedRegistry returns ctx if it has a registry, otherwise a context with a new registry,
+// so that the running instances of a proxy are kept apart from the other proxies in the process
+func WithScopedRegistry(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(registryKey{}).(*Registry); ok {
+		return ctx
+	}
+	return WithRegistry(ctx, NewRegistry())
+}
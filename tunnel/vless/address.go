@@ -0,0 +1,101 @@
+package vless
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// V2Ray 的地址类型编号与 socks5 不同
+const (
+	atypIPv4   byte = 1
+	atypDomain byte = 2
+	atypIPv6   byte = 3
+)
+
+// ParseUUID parses the user id in the form of xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx
+func ParseUUID(s string) ([16]byte, error) {
+	var id [16]byte
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != len(id) {
+		return id, common.NewError("invalid uuid " + s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// WriteAddress writes the port and then the address, which is the layout used by VLESS and VMess
+func WriteAddress(w io.Writer, addr *tunnel.Address) error {
+	buf := make([]byte, 2, 3+255)
+	binary.BigEndian.PutUint16(buf, uint16(addr.Port))
+	switch addr.AddressType {
+	case tunnel.IPv4:
+		ip := addr.IP.To4()
+		if ip == nil {
+			return common.NewError("invalid IPv4 address " + addr.IP.String())
+		}
+		buf = append(buf, atypIPv4)
+		buf = append(buf, ip...)
+	case tunnel.DomainName:
+		if len(addr.DomainName) > 255 {
+			return common.NewError("domain name too long " + addr.DomainName)
+		}
+		buf = append(buf, atypDomain, byte(len(addr.DomainName)))
+		buf = append(buf, addr.DomainName...)
+	case tunnel.IPv6:
+		ip := addr.IP.To16()
+		if ip == nil {
+			return common.NewError("invalid IPv6 address " + addr.IP.String())
+		}
+		buf = append(buf, atypIPv6)
+		buf = append(buf, ip...)
+	default:
+		return common.NewError("invalid ATYP " + strconv.FormatInt(int64(addr.AddressType), 10))
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadAddress reads the address written by WriteAddress
+func ReadAddress(r io.Reader) (*tunnel.Address, error) {
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, common.NewError("failed to read address").Base(err)
+	}
+	addr := &tunnel.Address{
+		Port: int(binary.BigEndian.Uint16(buf)),
+	}
+	switch buf[2] {
+	case atypIPv4:
+		addr.AddressType = tunnel.IPv4
+		addr.IP = make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, addr.IP); err != nil {
+			return nil, common.NewError("failed to read IPv4 address").Base(err)
+		}
+	case atypDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return nil, common.NewError("failed to read domain name length").Base(err)
+		}
+		domain := make([]byte, buf[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return nil, common.NewError("failed to read domain name").Base(err)
+		}
+		addr.AddressType = tunnel.DomainName
+		addr.DomainName = string(domain)
+	case atypIPv6:
+		addr.AddressType = tunnel.IPv6
+		addr.IP = make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, addr.IP); err != nil {
+			return nil, common.NewError("failed to read IPv6 address").Base(err)
+		}
+	default:
+		return nil, common.NewError("invalid ATYP " + strconv.FormatInt(int64(buf[2]), 10))
+	}
+	return addr, nil
+}
@@ -0,0 +1,55 @@
+package vless
+
+import (
+	"context"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+const (
+	Version byte = 0
+	Connect byte = 1
+)
+
+type Client struct {
+	underlay tunnel.Client
+	id       [16]byte
+}
+
+func (c *Client) DialConn(addr *tunnel.Address, t tunnel.Tunnel) (tunnel.Conn, error) {
+	conn, err := c.underlay.DialConn(addr, &Tunnel{})
+	if err != nil {
+		return nil, common.NewError("vless failed to dial using underlying tunnel").Base(err)
+	}
+	return &Conn{
+		Conn: conn,
+		id:   c.id,
+		metadata: &tunnel.Metadata{
+			Address: addr,
+		},
+	}, nil
+}
+
+func (c *Client) DialPacket(t tunnel.Tunnel) (tunnel.PacketConn, error) {
+	return nil, common.NewError("vless udp is not supported")
+}
+
+func (c *Client) Close() error {
+	return c.underlay.Close()
+}
+
+func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
+	cfg := config.FromContext(ctx, Name).(*Config)
+	id, err := ParseUUID(cfg.VLESS.UUID)
+	if err != nil {
+		return nil, common.NewError("invalid vless config").Base(err)
+	}
+	log.Debug("vless client created")
+	return &Client{
+		underlay: underlay,
+		id:       id,
+	}, nil
+}
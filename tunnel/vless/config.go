@@ -0,0 +1,17 @@
+package vless
+
+import "github.com/p4gefau1t/trojan-go/config"
+
+type VLESSConfig struct {
+	UUID string `json:"uuid" yaml:"uuid"`
+}
+
+type Config struct {
+	VLESS VLESSConfig `json:"vless" yaml:"vless"`
+}
+
+func init() {
+	config.RegisterConfigCreator(Name, func() interface{} {
+		return &Config{}
+	})
+}
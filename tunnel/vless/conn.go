@@ -0,0 +1,62 @@
+package vless
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// Conn is a VLESS connection to the server
+type Conn struct {
+	tunnel.Conn
+	id               [16]byte
+	metadata         *tunnel.Metadata
+	headerWritten    bool
+	responseReceived bool
+}
+
+func (c *Conn) Metadata() *tunnel.Metadata {
+	return c.metadata
+}
+
+// Write sends the request header along with the first payload
+func (c *Conn) Write(payload []byte) (int, error) {
+	if c.headerWritten {
+		return c.Conn.Write(payload)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 4096))
+	buf.WriteByte(Version)
+	buf.Write(c.id[:])
+	buf.WriteByte(0) // 不使用附加信息
+	buf.WriteByte(Connect)
+	if err := WriteAddress(buf, c.metadata.Address); err != nil {
+		return 0, common.NewError("failed to write vless header").Base(err)
+	}
+	buf.Write(payload)
+	if _, err := c.Conn.Write(buf.Bytes()); err != nil {
+		return 0, common.NewError("failed to write vless header").Base(err)
+	}
+	c.headerWritten = true
+	return len(payload), nil
+}
+
+// Read skips the response header before the first payload
+func (c *Conn) Read(p []byte) (int, error) {
+	if !c.responseReceived {
+		header := [2]byte{}
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			return 0, common.NewError("failed to read vless response").Base(err)
+		}
+		if header[0] != Version {
+			return 0, common.NewError("invalid vless response version")
+		}
+		if _, err := io.CopyN(ioutil.Discard, c.Conn, int64(header[1])); err != nil {
+			return 0, common.NewError("failed to read vless response addons").Base(err)
+		}
+		c.responseReceived = true
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,97 @@
+package vless
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/test/util"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
+	"github.com/p4gefau1t/trojan-go/tunnel/transport"
+)
+
+func TestVLESS(t *testing.T) {
+	port := common.PickPort("tcp", "127.0.0.1")
+	transportConfig := &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+	}
+	ctx := config.WithConfig(context.Background(), transport.Name, transportConfig)
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	ctx = config.WithConfig(ctx, Name, &Config{
+		VLESS: VLESSConfig{
+			UUID: "b831381d-6324-4d53-ad4f-8cda48b30811",
+		},
+	})
+	tcpClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	c, err := NewClient(ctx, tcpClient)
+	common.Must(err)
+
+	if _, err := c.DialPacket(nil); err == nil {
+		t.Fatal("udp should not be supported")
+	}
+
+	conn1, err := c.DialConn(&tunnel.Address{
+		DomainName:  "example.com",
+		AddressType: tunnel.DomainName,
+		Port:        443,
+	}, nil)
+	common.Must(err)
+	defer conn1.Close()
+	payload := util.GeneratePayload(1024)
+	common.Must2(conn1.Write(payload))
+
+	conn2, err := tcpServer.AcceptConn(nil)
+	common.Must(err)
+	defer conn2.Close()
+	header := make([]byte, 19)
+	common.Must2(io.ReadFull(conn2, header))
+	id, _ := ParseUUID("b831381d63244d53ad4f8cda48b30811")
+	if header[0] != Version || !bytes.Equal(header[1:17], id[:]) || header[17] != 0 || header[18] != Connect {
+		t.Fatal("invalid vless header", header)
+	}
+	addr, err := ReadAddress(conn2)
+	common.Must(err)
+	if addr.String() != "example.com:443" {
+		t.Fatal("invalid address", addr)
+	}
+	buf := make([]byte, len(payload))
+	common.Must2(io.ReadFull(conn2, buf))
+	if !bytes.Equal(buf, payload) {
+		t.Fatal("invalid payload")
+	}
+
+	// 响应带有附加信息时也应当被跳过
+	common.Must2(conn2.Write([]byte{Version, 3, 1, 2, 3}))
+	if !util.CheckConn(conn1, conn2) {
+		t.Fail()
+	}
+	c.Close()
+	tcpServer.Close()
+}
+
+func TestAddress(t *testing.T) {
+	for _, s := range []string{"1.2.3.4:80", "[2001:db8::1]:443", "example.com:8080"} {
+		addr, err := tunnel.NewAddressFromAddr("tcp", s)
+		common.Must(err)
+		buf := &bytes.Buffer{}
+		common.Must(WriteAddress(buf, addr))
+		decoded, err := ReadAddress(buf)
+		common.Must(err)
+		if decoded.String() != addr.String() {
+			t.Fatal("address mismatch", decoded, addr)
+		}
+	}
+	if _, err := ParseUUID("not-a-uuid"); err == nil {
+		t.Fatal("invalid uuid accepted")
+	}
+}
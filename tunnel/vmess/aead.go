@@ -0,0 +1,131 @@
+package vmess
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// KDF 的路径，与 V2Ray 保持一致
+const (
+	kdfSaltAuthID           = "AES Auth ID Encryption"
+	kdfSaltHeaderLenKey     = "VMess Header AEAD Key_Length"
+	kdfSaltHeaderLenIV      = "VMess Header AEAD Nonce_Length"
+	kdfSaltHeaderKey        = "VMess Header AEAD Key"
+	kdfSaltHeaderIV         = "VMess Header AEAD Nonce"
+	kdfSaltRespHeaderLenKey = "AEAD Resp Header Len Key"
+	kdfSaltRespHeaderLenIV  = "AEAD Resp Header Len IV"
+	kdfSaltRespHeaderKey    = "AEAD Resp Header Key"
+	kdfSaltRespHeaderIV     = "AEAD Resp Header IV"
+)
+
+// cmdKey derives the key of the user from the uuid
+func cmdKey(id [16]byte) []byte {
+	h := md5.New()
+	h.Write(id[:])
+	h.Write([]byte("c48619fe-8f02-49e0-b9e9-edf763e17e21"))
+	return h.Sum(nil)
+}
+
+// hmacCreator nests the hmacs, each level of the path uses the hmac of the upper level as its hash
+type hmacCreator struct {
+	parent *hmacCreator
+	value  []byte
+}
+
+func (h *hmacCreator) create() hash.Hash {
+	if h.parent == nil {
+		return hmac.New(sha256.New, h.value)
+	}
+	return hmac.New(h.parent.create, h.value)
+}
+
+func kdf(key []byte, path ...string) []byte {
+	creator := &hmacCreator{value: []byte("VMess AEAD KDF")}
+	for _, p := range path {
+		creator = &hmacCreator{parent: creator, value: []byte(p)}
+	}
+	h := creator.create()
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+func kdf16(key []byte, path ...string) []byte {
+	return kdf(key, path...)[:16]
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	common.Must(err)
+	aead, err := cipher.NewGCM(block)
+	common.Must(err)
+	return aead
+}
+
+// createAuthID encrypts the timestamp, the server uses it to identify the user and to reject the replays
+func createAuthID(key []byte, t time.Time) [16]byte {
+	var buf, id [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(t.Unix()))
+	common.Must2(rand.Read(buf[8:12]))
+	binary.BigEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(buf[:12]))
+	block, err := aes.NewCipher(kdf16(key, kdfSaltAuthID))
+	common.Must(err)
+	block.Encrypt(id[:], buf[:])
+	return id
+}
+
+// sealHeader encrypts the request header, the output is auth id, encrypted length, nonce and encrypted header
+func sealHeader(key []byte, header []byte) []byte {
+	authID := createAuthID(key, time.Now())
+	var nonce [8]byte
+	common.Must2(rand.Read(nonce[:]))
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(header)))
+	lenAEAD := newGCM(kdf16(key, kdfSaltHeaderLenKey, string(authID[:]), string(nonce[:])))
+	lenIV := kdf(key, kdfSaltHeaderLenIV, string(authID[:]), string(nonce[:]))[:12]
+	headerAEAD := newGCM(kdf16(key, kdfSaltHeaderKey, string(authID[:]), string(nonce[:])))
+	headerIV := kdf(key, kdfSaltHeaderIV, string(authID[:]), string(nonce[:]))[:12]
+
+	out := make([]byte, 0, 16+2+16+8+len(header)+16)
+	out = append(out, authID[:]...)
+	out = lenAEAD.Seal(out, lenIV, length[:], authID[:])
+	out = append(out, nonce[:]...)
+	return headerAEAD.Seal(out, headerIV, header, authID[:])
+}
+
+// openResponseHeader reads and decrypts the response header
+func openResponseHeader(r io.Reader, key []byte, iv []byte) ([]byte, error) {
+	lenAEAD := newGCM(kdf16(key, kdfSaltRespHeaderLenKey))
+	lenIV := kdf(iv, kdfSaltRespHeaderLenIV)[:12]
+	buf := make([]byte, 2+lenAEAD.Overhead())
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, common.NewError("failed to read vmess response header length").Base(err)
+	}
+	length, err := lenAEAD.Open(buf[:0], lenIV, buf, nil)
+	if err != nil {
+		return nil, common.NewError("failed to decrypt vmess response header length").Base(err)
+	}
+
+	headerAEAD := newGCM(kdf16(key, kdfSaltRespHeaderKey))
+	headerIV := kdf(iv, kdfSaltRespHeaderIV)[:12]
+	buf = make([]byte, int(binary.BigEndian.Uint16(length))+headerAEAD.Overhead())
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, common.NewError("failed to read vmess response header").Base(err)
+	}
+	header, err := headerAEAD.Open(buf[:0], headerIV, buf, nil)
+	if err != nil {
+		return nil, common.NewError("failed to decrypt vmess response header").Base(err)
+	}
+	return header, nil
+}
@@ -0,0 +1,198 @@
+package vmess
+
+import (
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+const (
+	maxChunkSize  = 2048 // 与 V2Ray 的缓冲区大小相同
+	maxPaddingLen = 64
+)
+
+// newBodyAEAD creates the cipher of the body with the key of the session
+func newBodyAEAD(security byte, key []byte) cipher.AEAD {
+	if security == securityChacha20Poly1305 {
+		// chacha20 需要 32 字节的密钥
+		k := make([]byte, 0, 32)
+		h := md5.Sum(key)
+		k = append(k, h[:]...)
+		h = md5.Sum(h[:])
+		k = append(k, h[:]...)
+		aead, err := chacha20poly1305.New(k)
+		common.Must(err)
+		return aead
+	}
+	return newGCM(key)
+}
+
+// shakeMask generates the masks of the chunk sizes and the padding lengths
+type shakeMask struct {
+	sha3.ShakeHash
+}
+
+func (m *shakeMask) next() uint16 {
+	var buf [2]byte
+	common.Must2(m.Read(buf[:]))
+	return binary.BigEndian.Uint16(buf[:])
+}
+
+func newShakeMask(iv []byte) *shakeMask {
+	h := sha3.NewShake128()
+	h.Write(iv)
+	return &shakeMask{h}
+}
+
+// chunkNonce returns the nonce of the count-th chunk
+type chunkNonce struct {
+	nonce []byte
+	count uint16
+}
+
+func (n *chunkNonce) next() []byte {
+	binary.BigEndian.PutUint16(n.nonce, n.count)
+	n.count++
+	return n.nonce
+}
+
+func newChunkNonce(iv []byte, size int) *chunkNonce {
+	nonce := make([]byte, size)
+	copy(nonce, iv)
+	return &chunkNonce{nonce: nonce}
+}
+
+// chunkWriter encrypts the body into chunks of masked size, encrypted data and random padding
+type chunkWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce *chunkNonce
+	mask  *shakeMask
+}
+
+// appendChunk appends a chunk of data to dst, an empty chunk marks the end of the body
+func (w *chunkWriter) appendChunk(dst []byte, data []byte) []byte {
+	padding := int(w.mask.next() % maxPaddingLen)
+	size := len(data) + w.aead.Overhead() + padding
+	var sizeBuf [2]byte
+	binary.BigEndian.PutUint16(sizeBuf[:], w.mask.next()^uint16(size))
+	dst = append(dst, sizeBuf[:]...)
+	dst = w.aead.Seal(dst, w.nonce.next(), data, nil)
+	if padding > 0 {
+		start := len(dst)
+		dst = append(dst, make([]byte, padding)...)
+		common.Must2(rand.Read(dst[start:]))
+	}
+	return dst
+}
+
+// appendChunks splits the payload into chunks and appends them to dst
+func (w *chunkWriter) appendChunks(dst []byte, payload []byte) []byte {
+	maxDataSize := maxChunkSize - w.aead.Overhead() - 2 - maxPaddingLen
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > maxDataSize {
+			n = maxDataSize
+		}
+		dst = w.appendChunk(dst, payload[:n])
+		payload = payload[n:]
+	}
+	return dst
+}
+
+func (w *chunkWriter) Write(payload []byte) (int, error) {
+	if len(payload) == 0 {
+		return 0, nil
+	}
+	if _, err := w.w.Write(w.appendChunks(nil, payload)); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+// WriteEnd tells the other side that the body has ended
+func (w *chunkWriter) WriteEnd() error {
+	_, err := w.w.Write(w.appendChunk(nil, nil))
+	return err
+}
+
+func newChunkWriter(w io.Writer, security byte, key []byte, iv []byte) *chunkWriter {
+	aead := newBodyAEAD(security, key)
+	return &chunkWriter{
+		w:     w,
+		aead:  aead,
+		nonce: newChunkNonce(iv, aead.NonceSize()),
+		mask:  newShakeMask(iv),
+	}
+}
+
+// chunkReader decrypts the chunks written by chunkWriter
+type chunkReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce *chunkNonce
+	mask  *shakeMask
+	buf   []byte
+	data  []byte // 尚未读取的数据
+	eof   bool
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *chunkReader) readChunk() error {
+	var sizeBuf [2]byte
+	if _, err := io.ReadFull(r.r, sizeBuf[:]); err != nil {
+		return err
+	}
+	padding := int(r.mask.next() % maxPaddingLen)
+	size := int(r.mask.next() ^ binary.BigEndian.Uint16(sizeBuf[:]))
+	if size == r.aead.Overhead()+padding {
+		r.eof = true
+		return nil
+	}
+	if size < r.aead.Overhead()+padding {
+		return common.NewError("invalid vmess chunk size")
+	}
+	if size > len(r.buf) { // Xray 等实现的块可能更大
+		r.buf = make([]byte, size)
+	}
+	if _, err := io.ReadFull(r.r, r.buf[:size]); err != nil {
+		return common.NewError("failed to read vmess chunk").Base(err)
+	}
+	data, err := r.aead.Open(r.buf[:0], r.nonce.next(), r.buf[:size-padding], nil)
+	if err != nil {
+		return common.NewError("failed to decrypt vmess chunk").Base(err)
+	}
+	r.data = data
+	return nil
+}
+
+func newChunkReader(r io.Reader, security byte, key []byte, iv []byte) *chunkReader {
+	aead := newBodyAEAD(security, key)
+	return &chunkReader{
+		r:     r,
+		aead:  aead,
+		nonce: newChunkNonce(iv, aead.NonceSize()),
+		mask:  newShakeMask(iv),
+		buf:   make([]byte, maxChunkSize),
+	}
+}
@@ -0,0 +1,92 @@
+package vmess
+
+import (
+	"context"
+	"runtime"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/vless"
+)
+
+const (
+	Version byte = 1
+	Connect byte = 1
+)
+
+// 正文的加密方式
+const (
+	securityAES128GCM        byte = 3
+	securityChacha20Poly1305 byte = 4
+)
+
+// 请求的选项
+const (
+	optionChunkStream   byte = 0x01
+	optionChunkMasking  byte = 0x04
+	optionGlobalPadding byte = 0x08
+)
+
+type Client struct {
+	underlay tunnel.Client
+	cmdKey   []byte
+	security byte
+}
+
+func (c *Client) DialConn(addr *tunnel.Address, t tunnel.Tunnel) (tunnel.Conn, error) {
+	conn, err := c.underlay.DialConn(addr, &Tunnel{})
+	if err != nil {
+		return nil, common.NewError("vmess failed to dial using underlying tunnel").Base(err)
+	}
+	return newConn(conn, c, &tunnel.Metadata{
+		Address: addr,
+	}), nil
+}
+
+func (c *Client) DialPacket(t tunnel.Tunnel) (tunnel.PacketConn, error) {
+	return nil, common.NewError("vmess udp is not supported")
+}
+
+func (c *Client) Close() error {
+	return c.underlay.Close()
+}
+
+func parseSecurity(s string) (byte, error) {
+	switch strings.ToLower(s) {
+	case "", "auto":
+		// 没有 AES 硬件加速的平台上 chacha20 更快
+		switch runtime.GOARCH {
+		case "amd64", "arm64", "s390x":
+			return securityAES128GCM, nil
+		default:
+			return securityChacha20Poly1305, nil
+		}
+	case "aes-128-gcm":
+		return securityAES128GCM, nil
+	case "chacha20-poly1305":
+		return securityChacha20Poly1305, nil
+	default:
+		return 0, common.NewError("unsupported vmess security " + s)
+	}
+}
+
+func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
+	cfg := config.FromContext(ctx, Name).(*Config)
+	id, err := vless.ParseUUID(cfg.VMess.UUID)
+	if err != nil {
+		return nil, common.NewError("invalid vmess config").Base(err)
+	}
+	security, err := parseSecurity(cfg.VMess.Security)
+	if err != nil {
+		return nil, common.NewError("invalid vmess config").Base(err)
+	}
+	log.Debug("vmess client created")
+	return &Client{
+		underlay: underlay,
+		cmdKey:   cmdKey(id),
+		security: security,
+	}, nil
+}
@@ -0,0 +1,22 @@
+package vmess
+
+import "github.com/p4gefau1t/trojan-go/config"
+
+type VMessConfig struct {
+	UUID     string `json:"uuid" yaml:"uuid"`
+	Security string `json:"security" yaml:"security"` // 正文的加密方式
+}
+
+type Config struct {
+	VMess VMessConfig `json:"vmess" yaml:"vmess"`
+}
+
+func init() {
+	config.RegisterConfigCreator(Name, func() interface{} {
+		return &Config{
+			VMess: VMessConfig{
+				Security: "auto",
+			},
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"hash/fnv"
+	mrand "math/rand"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/vless"
+)
+
+// Conn is a VMess connection to the server
+type Conn struct {
+	tunnel.Conn
+	client           *Client
+	metadata         *tunnel.Metadata
+	reqKey           [16]byte
+	reqIV            [16]byte
+	respV            byte
+	writer           *chunkWriter
+	reader           *chunkReader
+	headerWritten    bool
+	responseReceived bool
+}
+
+func (c *Conn) Metadata() *tunnel.Metadata {
+	return c.metadata
+}
+
+// header returns the plaintext of the request header
+func (c *Conn) header() ([]byte, error) {
+	padding := mrand.Intn(16)
+	buf := bytes.NewBuffer(make([]byte, 0, 128))
+	buf.WriteByte(Version)
+	buf.Write(c.reqIV[:])
+	buf.Write(c.reqKey[:])
+	buf.WriteByte(c.respV)
+	buf.WriteByte(optionChunkStream | optionChunkMasking | optionGlobalPadding)
+	buf.WriteByte(byte(padding<<4) | c.client.security)
+	buf.WriteByte(0) // 保留
+	buf.WriteByte(Connect)
+	if err := vless.WriteAddress(buf, c.metadata.Address); err != nil {
+		return nil, err
+	}
+	if padding > 0 {
+		p := make([]byte, padding)
+		common.Must2(rand.Read(p))
+		buf.Write(p)
+	}
+	h := fnv.New32a()
+	h.Write(buf.Bytes())
+	return h.Sum(buf.Bytes()), nil
+}
+
+// Write sends the request header along with the first payload
+func (c *Conn) Write(payload []byte) (int, error) {
+	if c.headerWritten {
+		return c.writer.Write(payload)
+	}
+	header, err := c.header()
+	if err != nil {
+		return 0, common.NewError("failed to write vmess header").Base(err)
+	}
+	buf := sealHeader(c.client.cmdKey, header)
+	buf = c.writer.appendChunks(buf, payload)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, common.NewError("failed to write vmess header").Base(err)
+	}
+	c.headerWritten = true
+	return len(payload), nil
+}
+
+// Read checks the response header before the first payload
+func (c *Conn) Read(p []byte) (int, error) {
+	if !c.responseReceived {
+		respKey := sha256.Sum256(c.reqKey[:])
+		respIV := sha256.Sum256(c.reqIV[:])
+		header, err := openResponseHeader(c.Conn, respKey[:16], respIV[:16])
+		if err != nil {
+			return 0, err
+		}
+		if len(header) < 4 || header[0] != c.respV {
+			return 0, common.NewError("invalid vmess response header")
+		}
+		c.reader = newChunkReader(c.Conn, c.client.security, respKey[:16], respIV[:16])
+		c.responseReceived = true
+	}
+	return c.reader.Read(p)
+}
+
+func (c *Conn) Close() error {
+	if c.headerWritten {
+		c.writer.WriteEnd()
+	}
+	return c.Conn.Close()
+}
+
+func newConn(conn tunnel.Conn, client *Client, metadata *tunnel.Metadata) *Conn {
+	c := &Conn{
+		Conn:     conn,
+		client:   client,
+		metadata: metadata,
+	}
+	common.Must2(rand.Read(c.reqKey[:]))
+	common.Must2(rand.Read(c.reqIV[:]))
+	var respV [1]byte
+	common.Must2(rand.Read(respV[:]))
+	c.respV = respV[0]
+	c.writer = newChunkWriter(conn, client.security, c.reqKey[:], c.reqIV[:])
+	return c
+}
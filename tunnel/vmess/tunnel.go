@@ -0,0 +1,30 @@
+// Package vmess implements the VMess AEAD outbound protocol, so that the router can send the requests to an existing
+// V2Ray/Xray server. Only the client side and TCP are supported
+package vmess
+
+import (
+	"context"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+const Name = "VMESS"
+
+type Tunnel struct{}
+
+func (*Tunnel) Name() string {
+	return Name
+}
+
+func (*Tunnel) NewServer(ctx context.Context, underlay tunnel.Server) (tunnel.Server, error) {
+	return nil, common.NewError("vmess server is not supported")
+}
+
+func (*Tunnel) NewClient(ctx context.Context, underlay tunnel.Client) (tunnel.Client, error) {
+	return NewClient(ctx, underlay)
+}
+
+func init() {
+	tunnel.RegisterTunnel(Name, &Tunnel{})
+}
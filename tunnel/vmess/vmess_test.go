@@ -0,0 +1,166 @@
+package vmess
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/test/util"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/freedom"
+	"github.com/p4gefau1t/trojan-go/tunnel/transport"
+	"github.com/p4gefau1t/trojan-go/tunnel/vless"
+)
+
+func TestKDF(t *testing.T) {
+	// V2Ray 中的测试向量
+	key := kdf([]byte("Demo Key for KDF Value Test"), "Demo Path for KDF Value Test", "Demo Path for KDF Value Test2", "Demo Path for KDF Value Test3")
+	if hex.EncodeToString(key) != "53e9d7e1bd7bd25022b71ead07d8a596efc8a845c7888652fd684b4903dc8892" {
+		t.Fatal("invalid kdf value", hex.EncodeToString(key))
+	}
+}
+
+// serverConn is the server side of a vmess connection in the test
+type serverConn struct {
+	net.Conn
+	reader *chunkReader
+	writer *chunkWriter
+}
+
+func (c *serverConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *serverConn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+// accept reads the request header like a vmess server, and replies with the response header
+func accept(t *testing.T, conn net.Conn, key []byte) (*serverConn, *tunnel.Address, byte) {
+	var authID, plain [16]byte
+	common.Must2(io.ReadFull(conn, authID[:]))
+	block, err := aes.NewCipher(kdf16(key, kdfSaltAuthID))
+	common.Must(err)
+	block.Decrypt(plain[:], authID[:])
+	if crc32.ChecksumIEEE(plain[:12]) != binary.BigEndian.Uint32(plain[12:]) {
+		t.Fatal("invalid auth id")
+	}
+	if d := time.Now().Unix() - int64(binary.BigEndian.Uint64(plain[:8])); d < -120 || d > 120 {
+		t.Fatal("invalid auth id time")
+	}
+
+	buf := make([]byte, 18+8)
+	common.Must2(io.ReadFull(conn, buf))
+	nonce := string(buf[18:])
+	length, err := newGCM(kdf16(key, kdfSaltHeaderLenKey, string(authID[:]), nonce)).
+		Open(nil, kdf(key, kdfSaltHeaderLenIV, string(authID[:]), nonce)[:12], buf[:18], authID[:])
+	common.Must(err)
+	buf = make([]byte, int(binary.BigEndian.Uint16(length))+16)
+	common.Must2(io.ReadFull(conn, buf))
+	header, err := newGCM(kdf16(key, kdfSaltHeaderKey, string(authID[:]), nonce)).
+		Open(nil, kdf(key, kdfSaltHeaderIV, string(authID[:]), nonce)[:12], buf, authID[:])
+	common.Must(err)
+
+	h := fnv.New32a()
+	h.Write(header[:len(header)-4])
+	if h.Sum32() != binary.BigEndian.Uint32(header[len(header)-4:]) {
+		t.Fatal("invalid header checksum")
+	}
+	if header[0] != Version || header[34] != optionChunkStream|optionChunkMasking|optionGlobalPadding || header[37] != Connect {
+		t.Fatal("invalid header", header)
+	}
+	reqIV, reqKey, respV, security := header[1:17], header[17:33], header[33], header[35]&0x0f
+	addr, err := vless.ReadAddress(bytes.NewReader(header[38:]))
+	common.Must(err)
+
+	respKey := sha256.Sum256(reqKey)
+	respIV := sha256.Sum256(reqIV)
+	resp := []byte{respV, 0, 0, 0}
+	var respLen [2]byte
+	binary.BigEndian.PutUint16(respLen[:], uint16(len(resp)))
+	out := newGCM(kdf16(respKey[:16], kdfSaltRespHeaderLenKey)).Seal(nil, kdf(respIV[:16], kdfSaltRespHeaderLenIV)[:12], respLen[:], nil)
+	out = newGCM(kdf16(respKey[:16], kdfSaltRespHeaderKey)).Seal(out, kdf(respIV[:16], kdfSaltRespHeaderIV)[:12], resp, nil)
+	common.Must2(conn.Write(out))
+
+	return &serverConn{
+		Conn:   conn,
+		reader: newChunkReader(conn, security, reqKey, reqIV),
+		writer: newChunkWriter(conn, security, respKey[:16], respIV[:16]),
+	}, addr, security
+}
+
+func TestVMess(t *testing.T) {
+	port := common.PickPort("tcp", "127.0.0.1")
+	transportConfig := &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+	}
+	ctx := config.WithConfig(context.Background(), transport.Name, transportConfig)
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	tcpClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	defer tcpServer.Close()
+
+	id, _ := vless.ParseUUID("b831381d-6324-4d53-ad4f-8cda48b30811")
+	for _, s := range []string{"aes-128-gcm", "chacha20-poly1305"} {
+		ctx := config.WithConfig(ctx, Name, &Config{
+			VMess: VMessConfig{
+				UUID:     "b831381d-6324-4d53-ad4f-8cda48b30811",
+				Security: s,
+			},
+		})
+		c, err := NewClient(ctx, tcpClient)
+		common.Must(err)
+
+		conn1, err := c.DialConn(&tunnel.Address{
+			IP:          net.ParseIP("1.2.3.4"),
+			AddressType: tunnel.IPv4,
+			Port:        80,
+		}, nil)
+		common.Must(err)
+		// 超过一个块的数据
+		payload := util.GeneratePayload(10000)
+		common.Must2(conn1.Write(payload))
+
+		raw, err := tcpServer.AcceptConn(nil)
+		common.Must(err)
+		conn2, addr, security := accept(t, raw, cmdKey(id))
+		if addr.String() != "1.2.3.4:80" {
+			t.Fatal("invalid address", addr)
+		}
+		if expected, _ := parseSecurity(s); security != expected {
+			t.Fatal("invalid security", security)
+		}
+		buf := make([]byte, len(payload))
+		common.Must2(io.ReadFull(conn2, buf))
+		if !bytes.Equal(buf, payload) {
+			t.Fatal("invalid payload")
+		}
+		if !util.CheckConn(conn1, conn2) {
+			t.Fail()
+		}
+
+		// 关闭时发送结束块
+		conn1.Close()
+		if n, err := conn2.Read(buf); n != 0 || err != io.EOF {
+			t.Fatal("end of the body expected", n, err)
+		}
+		conn2.Close()
+	}
+	tcpClient.Close()
+}
@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"context"
+	"net/http"
 	"strings"
 
 	"golang.org/x/net/websocket"
@@ -16,6 +17,7 @@ type Client struct {
 	underlay tunnel.Client
 	hostname string
 	path     string
+	header   http.Header // 握手请求中额外的头部
 }
 
 func (c *Client) DialConn(*tunnel.Address, tunnel.Tunnel) (tunnel.Conn, error) {
@@ -29,6 +31,7 @@ func (c *Client) DialConn(*tunnel.Address, tunnel.Tunnel) (tunnel.Conn, error) {
 	if err != nil {
 		return nil, common.NewError("invalid websocket config").Base(err)
 	}
+	wsConfig.Header = c.header
 	wsConn, err := websocket.NewClient(wsConfig, conn)
 	if err != nil {
 		return nil, common.NewError("websocket failed to handshake with server").Base(err)
@@ -56,10 +59,15 @@ func NewClient(ctx context.Context, underlay tunnel.Client) (*Client, error) {
 		cfg.Websocket.Host = cfg.RemoteHost
 		log.Warn("empty websocket hostname")
 	}
+	header, err := newHeader(cfg.Websocket.Headers)
+	if err != nil {
+		return nil, common.NewError("invalid websocket headers").Base(err)
+	}
 	log.Debug("websocket client created")
 	return &Client{
 		hostname: cfg.Websocket.Host,
 		path:     cfg.Websocket.Path,
+		header:   header,
 		underlay: underlay,
 	}, nil
 }
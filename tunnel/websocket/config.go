@@ -1,17 +1,68 @@
 package websocket
 
-import "github.com/p4gefau1t/trojan-go/config"
+import (
+	"strconv"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/tunnel/tls/parity"
+)
 
 type WebsocketConfig struct {
-	Enabled bool   `json:"enabled" yaml:"enabled"`
-	Host    string `json:"host" yaml:"host"`
-	Path    string `json:"path" yaml:"path"`
+	Enabled bool     `json:"enabled" yaml:"enabled"`
+	Host    string   `json:"host" yaml:"host"`
+	Path    string   `json:"path" yaml:"path"`
+	Paths   []string `json:"paths" yaml:"paths"` // 服务端额外接受的路径，用于轮换路径
+	// 服务端位于 CDN 之后时，信任这些地址发送的 CF-Connecting-IP 和 X-Forwarded-For 头部
+	TrustedProxies []string `json:"trusted_proxies" yaml:"trusted-proxies"`
+	// 客户端握手请求中额外的头部，例如 User-Agent，Cookie 和 CDN 的鉴权令牌
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	// 服务端要求握手请求带有的头部，值为空时只要求头部存在，不满足时回落
+	RequiredHeaders map[string]string `json:"required_headers" yaml:"required-headers"`
+	// 服务端握手响应中额外的头部，覆盖 parity 探测到的同名头部
+	ResponseHeaders map[string]string `json:"response_headers" yaml:"response-headers"`
+}
+
+// TLSConfig 服务端接受的域名，用于校验 websocket 请求的 Host
+type TLSConfig struct {
+	SNI          string        `json:"sni" yaml:"sni"`
+	SNIList      []string      `json:"sni_list" yaml:"sni-list"`
+	FallbackHost string        `json:"fallback_addr" yaml:"fallback-addr"`
+	FallbackPort int           `json:"fallback_port" yaml:"fallback-port"`
+	Parity       parity.Config `json:"parity" yaml:"parity"` // websocket 握手的响应带有回落网站的头部
 }
 
 type Config struct {
 	RemoteHost string          `json:"remote_addr" yaml:"remote-addr"`
 	RemotePort int             `json:"remote_port" yaml:"remote-port"`
 	Websocket  WebsocketConfig `json:"websocket" yaml:"websocket"`
+	TLS        TLSConfig       `json:"ssl" yaml:"ssl"`
+}
+
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if c.Websocket.Enabled && !strings.HasPrefix(c.Websocket.Path, "/") {
+		errs.Add("websocket.path", "must start with \"/\"")
+	}
+	for i, p := range c.Websocket.Paths {
+		if p != "" && !strings.HasPrefix(p, "/") {
+			errs.Add("websocket.paths["+strconv.Itoa(i)+"]", "must start with \"/\"")
+		}
+	}
+	if _, err := common.ParseIPNets(c.Websocket.TrustedProxies); err != nil {
+		errs.Add("websocket.trusted_proxies", err.Error())
+	}
+	if _, err := newHeader(c.Websocket.Headers); err != nil {
+		errs.Add("websocket.headers", err.Error())
+	}
+	if _, err := newHeader(c.Websocket.RequiredHeaders); err != nil {
+		errs.Add("websocket.required_headers", err.Error())
+	}
+	if _, err := newHeader(c.Websocket.ResponseHeaders); err != nil {
+		errs.Add("websocket.response_headers", err.Error())
+	}
+	return errs.Err()
 }
 
 func init() {
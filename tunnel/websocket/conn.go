@@ -18,6 +18,14 @@ func (c *OutboundConn) Metadata() *tunnel.Metadata {
 	return nil
 }
 
+func (c *OutboundConn) WireTraffic() (uint64, uint64, bool) {
+	return tunnel.WireTrafficOf(c.tcpConn)
+}
+
+func (c *OutboundConn) ClientRandom() []byte {
+	return tunnel.ClientRandomOf(c.tcpConn)
+}
+
 func (c *OutboundConn) RemoteAddr() net.Addr {
 	// override RemoteAddr of websocket.Conn, or it will return some url from "Origin"
 	return c.tcpConn.RemoteAddr()
@@ -25,8 +33,16 @@ func (c *OutboundConn) RemoteAddr() net.Addr {
 
 type InboundConn struct {
 	OutboundConn
-	ctx    context.Context
-	cancel context.CancelFunc
+	realAddr net.Addr // 可信代理转发的客户端地址，为空时使用 TCP 连接的地址
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func (c *InboundConn) RemoteAddr() net.Addr {
+	if c.realAddr != nil {
+		return c.realAddr
+	}
+	return c.OutboundConn.RemoteAddr()
 }
 
 func (c *InboundConn) Close() error {
@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// 握手使用的头部由 websocket 库生成，不能通过配置修改
+var reservedHeaders = []string{"Host", "Upgrade", "Connection", "Origin"}
+
+// checkHeaderName returns an error if the header can not be set by the config
+func checkHeaderName(name string) error {
+	if !httpguts.ValidHeaderFieldName(name) {
+		return common.NewError("invalid header name " + name)
+	}
+	canonical := http.CanonicalHeaderKey(name)
+	if strings.HasPrefix(canonical, "Sec-Websocket-") {
+		return common.NewError("header " + name + " is set by the websocket handshake")
+	}
+	for _, reserved := range reservedHeaders {
+		if canonical == reserved {
+			return common.NewError("header " + name + " is set by the websocket handshake")
+		}
+	}
+	return nil
+}
+
+// newHeader converts the headers in the config, nil is returned if there is none
+func newHeader(headers map[string]string) (http.Header, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	header := make(http.Header, len(headers))
+	for name, value := range headers {
+		if err := checkHeaderName(name); err != nil {
+			return nil, err
+		}
+		header.Set(name, value)
+	}
+	return header, nil
+}
+
+// hasHeaders reports whether the request carries all the required headers. An empty required value only
+// requires the header to be present
+func hasHeaders(header, required http.Header) bool {
+	for name, values := range required {
+		actual := header.Values(name)
+		if len(actual) == 0 {
+			return false
+		}
+		if values[0] == "" {
+			continue
+		}
+		matched := false
+		for _, v := range actual {
+			if v == values[0] {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
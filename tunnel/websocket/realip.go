@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+// trustedProxies are the proxies, e.g. the cdn nodes, whose forwarding headers are trusted
+type trustedProxies []*net.IPNet
+
+func newTrustedProxies(list []string) (trustedProxies, error) {
+	proxies, err := common.ParseIPNets(list)
+	if err != nil {
+		return nil, common.NewError("invalid trusted proxies").Base(err)
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) contains(ip net.IP) bool {
+	for _, ipNet := range p {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIP returns the ip of the client behind the trusted proxies. CF-Connecting-IP is preferred,
+// X-Forwarded-For is read from right to left and the first untrusted address is the client.
+// nil is returned if the peer is not trusted or there is no valid header
+func (p trustedProxies) realIP(peer net.Addr, header http.Header) net.IP {
+	if len(p) == 0 || peer == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(peer.String())
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !p.contains(ip) {
+		return nil // 不信任直接连接的对端发送的头部
+	}
+	if ip := net.ParseIP(strings.TrimSpace(header.Get("CF-Connecting-IP"))); ip != nil {
+		return ip
+	}
+	var forwarded []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	var client net.IP
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break // 无法解析的地址之前的内容都不可信
+		}
+		client = ip
+		if !p.contains(ip) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"context"
+	"strings"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// Route is the hostname and the paths accepted by the websocket server
+type Route struct {
+	Hostname string
+	Paths    []string
+	hosts    []string // 接受的 Host，为空时不校验
+}
+
+func (r *Route) hasPath(path string) bool {
+	for _, p := range r.Paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func newRoute(hostname, path string, paths []string) (*Route, error) {
+	r := &Route{
+		Hostname: hostname,
+	}
+	for _, p := range append([]string{path}, paths...) {
+		if p == "" || r.hasPath(p) {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") {
+			return nil, common.NewError("websocket path must start with \"/\": " + p)
+		}
+		r.Paths = append(r.Paths, p)
+	}
+	return r, nil
+}
+
+// reloadRoute updates the hostname and the paths of the server from the reloaded config,
+// the values changed through the API are overwritten, empty values leave the current ones unchanged
+func (s *Server) reloadRoute(ctx context.Context, data []byte, format string) error {
+	var err error
+	switch format {
+	case "", "json":
+		ctx, err = config.WithJSONConfig(ctx, data)
+	case "yaml":
+		ctx, err = config.WithYAMLConfig(ctx, data)
+	default:
+		err = common.NewError("unknown config format: " + format)
+	}
+	if err != nil {
+		return common.NewError("invalid websocket config").Base(err)
+	}
+	cfg := config.FromContext(ctx, Name).(*Config)
+	route, err := newRoute(cfg.Websocket.Host, cfg.Websocket.Path, cfg.Websocket.Paths)
+	if err == nil {
+		err = s.Update(route.Hostname, route.Paths)
+	}
+	if err != nil {
+		return common.NewError("websocket failed to reload the route").Base(err)
+	}
+	log.Info("websocket route reloaded, hostname:", s.Route().Hostname, "paths:", strings.Join(s.Route().Paths, ","))
+	return nil
+}
+
+// instanceKind 在注册表中记录运行中的 websocket 服务端
+const instanceKind = "websocket.server"
+
+func runningServers(ctx context.Context) []*Server {
+	instances := tunnel.RegistryFromContext(ctx).Instances(instanceKind)
+	servers := make([]*Server, 0, len(instances))
+	for _, instance := range instances {
+		servers = append(servers, instance.(*Server))
+	}
+	return servers
+}
+
+// UpdateRoute changes the hostname and the paths of the running websocket servers in the registry of ctx.
+// Empty hostname or paths leave the current value unchanged.
+// Established connections are not affected. It returns the number of servers updated
+func UpdateRoute(ctx context.Context, hostname string, paths []string) (int, error) {
+	if _, err := newRoute(hostname, "", paths); err != nil {
+		return 0, err
+	}
+	servers := runningServers(ctx)
+	for _, s := range servers {
+		common.Must(s.Update(hostname, paths))
+	}
+	if len(servers) != 0 {
+		log.Info("websocket route updated, hostname:", hostname, "paths:", paths)
+	}
+	return len(servers), nil
+}
+
+// CurrentRoutes returns the routes of the running websocket servers in the registry of ctx
+func CurrentRoutes(ctx context.Context) []*Route {
+	servers := runningServers(ctx)
+	result := make([]*Route, 0, len(servers))
+	for _, s := range servers {
+		result = append(result, s.Route())
+	}
+	return result
+}
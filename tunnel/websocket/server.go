@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/websocket"
@@ -16,6 +17,7 @@ import (
 	"github.com/p4gefau1t/trojan-go/log"
 	"github.com/p4gefau1t/trojan-go/redirector"
 	"github.com/p4gefau1t/trojan-go/tunnel"
+	"github.com/p4gefau1t/trojan-go/tunnel/tls/parity"
 )
 
 // Fake response writer
@@ -34,17 +36,22 @@ func (w *fakeHTTPResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 
 type Server struct {
 	underlay  tunnel.Server
-	hostname  string
-	path      string
-	enabled   bool // 开启 websocket
+	route     atomic.Value // *Route，可以在运行时更新
+	snis      []string     // sni 和 sni_list，websocket 请求的 Host 需要是其中之一或 websocket.host
+	enabled   bool         // 开启 websocket
 	redirAddr net.Addr
 	redir     *redirector.Redirector
 	ctx       context.Context
 	cancel    context.CancelFunc
-	timeout   time.Duration // 握手超时等待时间
+	timeout   time.Duration  // 握手超时等待时间
+	proxies   trustedProxies // 可信的反向代理，为空时不解析转发头部
+	header    http.Header    // 握手响应中额外的头部，与回落网站一致
+	required  http.Header    // 握手请求必须带有的头部
+	remove    func()         // 从注册表中移除
 }
 
 func (s *Server) Close() error {
+	s.remove()
 	s.cancel()
 	return s.underlay.Close()
 }
@@ -62,6 +69,7 @@ func (s *Server) AcceptConn(tunnel.Tunnel) (tunnel.Conn, error) {
 		})
 		return nil, common.NewError("websocket is disabled. redirecting http request from " + conn.RemoteAddr().String())
 	}
+	route := s.Route()
 	rewindConn := common.NewRewindConn(conn)
 	rewindConn.SetBufferSize(512)
 	defer rewindConn.StopBuffering()
@@ -77,7 +85,7 @@ func (s *Server) AcceptConn(tunnel.Tunnel) (tunnel.Conn, error) {
 		})
 		return nil, common.NewError("not a valid http request: " + conn.RemoteAddr().String()).Base(err)
 	}
-	if strings.ToLower(req.Header.Get("Upgrade")) != "websocket" || req.URL.Path != s.path {
+	if strings.ToLower(req.Header.Get("Upgrade")) != "websocket" || !route.hasPath(req.URL.Path) {
 		log.Debug("invalid http websocket handshake request")
 		rewindConn.Rewind()
 		rewindConn.StopBuffering()
@@ -88,15 +96,44 @@ func (s *Server) AcceptConn(tunnel.Tunnel) (tunnel.Conn, error) {
 		return nil, common.NewError("not a valid websocket handshake request: " + conn.RemoteAddr().String()).Base(err)
 	}
 
+	if !route.isHostAllowed(req.Host) {
+		log.Debug("websocket host not allowed:", req.Host)
+		rewindConn.Rewind()
+		rewindConn.StopBuffering()
+		s.redir.Redirect(&redirector.Redirection{
+			InboundConn: rewindConn,
+			RedirectTo:  s.redirAddr,
+		})
+		return nil, common.NewError("websocket host " + req.Host + " is not allowed: " + conn.RemoteAddr().String())
+	}
+
+	if !hasHeaders(req.Header, s.required) {
+		log.Debug("websocket request without the required headers")
+		rewindConn.Rewind()
+		rewindConn.StopBuffering()
+		s.redir.Redirect(&redirector.Redirection{
+			InboundConn: rewindConn,
+			RedirectTo:  s.redirAddr,
+		})
+		return nil, common.NewError("websocket request lacks the required headers: " + conn.RemoteAddr().String())
+	}
+
+	var realAddr net.Addr
+	if ip := s.proxies.realIP(conn.RemoteAddr(), req.Header); ip != nil {
+		realAddr = &net.TCPAddr{IP: ip}
+		log.Debug("websocket connection from", ip, "through proxy", conn.RemoteAddr())
+	}
+
 	handshake := make(chan struct{})
 
-	url := "wss://" + s.hostname + s.path
-	origin := "https://" + s.hostname
+	url := "wss://" + route.Hostname + req.URL.Path
+	origin := "https://" + route.Hostname
 	// 创建一个新的 WebSocket 配置对象。这个配置对象用于后续的 WebSocket 连接
 	wsConfig, err := websocket.NewConfig(url, origin)
 	if err != nil {
 		return nil, common.NewError("failed to create websocket config").Base(err)
 	}
+	wsConfig.Header = s.header
 	var wsConn *websocket.Conn
 	ctx, cancel := context.WithCancel(s.ctx)
 
@@ -141,11 +178,59 @@ func (s *Server) AcceptConn(tunnel.Tunnel) (tunnel.Conn, error) {
 			tcpConn: conn,
 			Conn:    wsConn,
 		},
-		ctx:    ctx,
-		cancel: cancel,
+		realAddr: realAddr,
+		ctx:      ctx,
+		cancel:   cancel,
 	}, nil
 }
 
+// Route returns the hostname and the paths currently accepted
+func (s *Server) Route() *Route {
+	return s.route.Load().(*Route)
+}
+
+// Update replaces the hostname and the paths accepted by the server, empty values are left unchanged
+func (s *Server) Update(hostname string, paths []string) error {
+	current := s.Route()
+	if hostname == "" {
+		hostname = current.Hostname
+	}
+	if len(paths) == 0 {
+		paths = current.Paths
+	}
+	route, err := newRoute(hostname, "", paths)
+	if err != nil {
+		return err
+	}
+	s.setRoute(route)
+	return nil
+}
+
+// setRoute stores the route, the Host of the requests is checked against the snis and the hostname whenever
+// any of them is set
+func (s *Server) setRoute(route *Route) {
+	route.hosts = append(route.hosts, s.snis...)
+	if route.Hostname != "" {
+		route.hosts = append(route.hosts, route.Hostname)
+	}
+	s.route.Store(route)
+}
+
+func (r *Route) isHostAllowed(host string) bool {
+	if len(r.hosts) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, pattern := range r.hosts {
+		if common.IsDomainNameMatched(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
 // 不支持向上层提供 UDP 包
 func (s *Server) AcceptPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
 	return nil, common.NewError("not supported")
@@ -158,6 +243,10 @@ func NewServer(ctx context.Context, underlay tunnel.Server) (*Server, error) {
 			return nil, common.NewError("websocket path must start with \"/\"")
 		}
 	}
+	route, err := newRoute(cfg.Websocket.Host, cfg.Websocket.Path, cfg.Websocket.Paths)
+	if err != nil {
+		return nil, err
+	}
 	if cfg.RemoteHost == "" {
 		log.Warn("empty websocket redirection hostname")
 		cfg.RemoteHost = cfg.Websocket.Host
@@ -166,17 +255,69 @@ func NewServer(ctx context.Context, underlay tunnel.Server) (*Server, error) {
 		log.Warn("empty websocket redirection port")
 		cfg.RemotePort = 80
 	}
+	snis := append([]string{}, cfg.TLS.SNIList...)
+	if cfg.TLS.SNI != "" {
+		snis = append(snis, cfg.TLS.SNI)
+	}
+	proxies, err := newTrustedProxies(cfg.Websocket.TrustedProxies)
+	if err != nil {
+		return nil, common.NewError("websocket failed to parse trusted proxies").Base(err)
+	}
+	var header http.Header
+	if cfg.Websocket.Enabled && cfg.TLS.Parity.Enabled {
+		fallbackHost := cfg.TLS.FallbackHost
+		if fallbackHost == "" {
+			fallbackHost = cfg.RemoteHost
+		}
+		addr, sni, err := cfg.TLS.Parity.Target(fallbackHost, cfg.TLS.FallbackPort, cfg.TLS.SNI)
+		if err != nil {
+			return nil, err
+		}
+		profile, err := parity.Probe(addr, sni)
+		if err != nil {
+			return nil, common.NewError("websocket failed to probe the fallback website").Base(err)
+		}
+		header = profile.Header
+	}
+	responseHeader, err := newHeader(cfg.Websocket.ResponseHeaders)
+	if err != nil {
+		return nil, common.NewError("invalid websocket response headers").Base(err)
+	}
+	if responseHeader != nil {
+		header = header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		for name, values := range responseHeader {
+			header[name] = values
+		}
+	}
+	required, err := newHeader(cfg.Websocket.RequiredHeaders)
+	if err != nil {
+		return nil, common.NewError("invalid websocket required headers").Base(err)
+	}
 	ctx, cancel := context.WithCancel(ctx)
-	log.Debug("websocket server created")
-	return &Server{
+	s := &Server{
 		enabled:   cfg.Websocket.Enabled,
-		hostname:  cfg.Websocket.Host,
-		path:      cfg.Websocket.Path,
+		snis:      snis,
 		ctx:       ctx,
 		cancel:    cancel,
 		underlay:  underlay,
 		timeout:   time.Second * time.Duration(rand.Intn(10)+5),
 		redir:     redirector.NewRedirector(ctx),
 		redirAddr: tunnel.NewAddressFromHostPort("tcp", cfg.RemoteHost, cfg.RemotePort),
-	}, nil
+		proxies:   proxies,
+		header:    header,
+		required:  required,
+	}
+	s.setRoute(route)
+	s.remove = tunnel.RegistryFromContext(ctx).AddInstance(instanceKind, s)
+	if cfg.Websocket.Enabled {
+		// 重新加载配置时更新路径和主机名，已建立的连接不受影响
+		config.OnReload(ctx, func(data []byte, format string) error {
+			return s.reloadRoute(ctx, data, format)
+		})
+	}
+	log.Debug("websocket server created")
+	return s, nil
 }
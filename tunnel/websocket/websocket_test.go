@@ -1,9 +1,11 @@
 package websocket
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
 	"testing"
@@ -122,3 +124,268 @@ func TestRedirect(t *testing.T) {
 
 	s.Close()
 }
+
+func TestHostAllowed(t *testing.T) {
+	s := &Route{}
+	if !s.isHostAllowed("anything.com") {
+		t.Fatal("host should not be checked without a list")
+	}
+	s.hosts = []string{"*.example.com", "example.org"}
+	for host, allowed := range map[string]bool{
+		"www.example.com":     true,
+		"WWW.Example.com:443": true,
+		"example.com":         false,
+		"a.b.example.com":     false,
+		"example.org":         true,
+		"evil.org":            false,
+	} {
+		if s.isHostAllowed(host) != allowed {
+			t.Fatal("wrong result for host", host)
+		}
+	}
+}
+
+func TestUpdateRoute(t *testing.T) {
+	s := &Server{snis: []string{"*.example.com"}}
+	route, err := newRoute("example.org", "/ws", []string{"/ws", "/old"})
+	common.Must(err)
+	s.setRoute(route)
+	if !s.Route().hasPath("/ws") || !s.Route().hasPath("/old") || len(s.Route().Paths) != 2 {
+		t.Fatal("wrong paths", s.Route().Paths)
+	}
+	if !s.Route().isHostAllowed("example.org") || s.Route().isHostAllowed("example.net") {
+		t.Fatal("wrong hosts")
+	}
+
+	if s.Update("", []string{"invalid"}) == nil {
+		t.Fatal("invalid path accepted")
+	}
+	common.Must(s.Update("example.net", []string{"/new"}))
+	if s.Route().hasPath("/ws") || !s.Route().hasPath("/new") {
+		t.Fatal("paths not updated", s.Route().Paths)
+	}
+	if !s.Route().isHostAllowed("example.net") || s.Route().isHostAllowed("example.org") || !s.Route().isHostAllowed("a.example.com") {
+		t.Fatal("hosts not updated")
+	}
+	common.Must(s.Update("", nil))
+	if s.Route().Hostname != "example.net" || !s.Route().hasPath("/new") {
+		t.Fatal("empty update should keep the route")
+	}
+
+	// 没有 sni_list 时同样校验 websocket.host
+	s = &Server{}
+	route, err = newRoute("example.org", "/ws", nil)
+	common.Must(err)
+	s.setRoute(route)
+	if !s.Route().isHostAllowed("example.org") || s.Route().isHostAllowed("example.net") {
+		t.Fatal("host not checked without sni list")
+	}
+	route, err = newRoute("", "/ws", nil)
+	common.Must(err)
+	s.setRoute(route)
+	if !s.Route().isHostAllowed("example.net") {
+		t.Fatal("host should not be checked without sni and hostname")
+	}
+}
+
+func TestReloadRoute(t *testing.T) {
+	ctx, cancel := context.WithCancel(config.WithScopedRegistry(context.Background()))
+	defer cancel()
+	ctx = config.WithConfig(ctx, Name, &Config{
+		RemoteHost: "127.0.0.1",
+		RemotePort: 80,
+		Websocket: WebsocketConfig{
+			Enabled: true,
+			Host:    "example.org",
+			Path:    "/ws",
+		},
+		TLS: TLSConfig{
+			SNI: "example.com",
+		},
+	})
+	s, err := NewServer(ctx, nil)
+	common.Must(err)
+	if !s.Route().isHostAllowed("example.com") || !s.Route().isHostAllowed("example.org") || s.Route().isHostAllowed("example.net") {
+		t.Fatal("sni and host not allowed")
+	}
+
+	if failed := config.Reload(ctx, []byte(`{"websocket": {"enabled": true, "host": "example.net", "path": "/new", "paths": ["/other"]}}`), "json"); failed != 0 {
+		t.Fatal("failed to reload")
+	}
+	if route := s.Route(); route.Hostname != "example.net" || len(route.Paths) != 2 || !route.hasPath("/new") || !route.hasPath("/other") {
+		t.Fatal("route not reloaded", route)
+	}
+	// 无效的路径不改变当前的路由
+	if failed := config.Reload(ctx, []byte(`{"websocket": {"enabled": true, "path": "invalid"}}`), "json"); failed != 1 {
+		t.Fatal("invalid path accepted")
+	}
+	if route := s.Route(); route.Hostname != "example.net" || !route.hasPath("/new") {
+		t.Fatal("route changed by an invalid config", route)
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	if _, err := newTrustedProxies([]string{"not an ip"}); err == nil {
+		t.Fatal("invalid proxy accepted")
+	}
+	proxies, err := newTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+	common.Must(err)
+	cdn := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 443}
+	cdn6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+
+	for _, c := range []struct {
+		peer     net.Addr
+		header   http.Header
+		expected string
+	}{
+		{cdn, http.Header{"Cf-Connecting-Ip": {"198.51.100.1"}, "X-Forwarded-For": {"198.51.100.2"}}, "198.51.100.1"},
+		{cdn6, http.Header{"Cf-Connecting-Ip": {"2001:db8::2"}}, "2001:db8::2"},
+		{cdn, http.Header{"X-Forwarded-For": {"198.51.100.9, 198.51.100.2, 10.0.0.2"}}, "198.51.100.2"},
+		{cdn, http.Header{"X-Forwarded-For": {"198.51.100.2", "10.0.0.2"}}, "198.51.100.2"},
+		{cdn, http.Header{"X-Forwarded-For": {"garbage, 10.0.0.2"}}, "10.0.0.2"},
+		{cdn, http.Header{}, "<nil>"},
+		{other, http.Header{"Cf-Connecting-Ip": {"198.51.100.1"}}, "<nil>"},
+	} {
+		if ip := proxies.realIP(c.peer, c.header); ip.String() != c.expected {
+			t.Fatal("wrong real ip", c.header, ip, "expected", c.expected)
+		}
+	}
+
+	cfg := &Config{
+		Websocket: WebsocketConfig{
+			Enabled:        true,
+			Host:           "localhost",
+			Path:           "/ws",
+			TrustedProxies: []string{"127.0.0.1"},
+		},
+	}
+	ctx := config.WithConfig(context.Background(), Name, cfg)
+	port := common.PickPort("tcp", "127.0.0.1")
+	ctx = config.WithConfig(ctx, transport.Name, &transport.Config{
+		LocalHost: "127.0.0.1",
+		LocalPort: port,
+	})
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+
+	accepted := make(chan tunnel.Conn, 1)
+	go func() {
+		conn, err := s.AcceptConn(nil)
+		common.Must(err)
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	common.Must(err)
+	wsConfig, err := websocket.NewConfig("wss://localhost/ws", "https://localhost")
+	common.Must(err)
+	wsConfig.Header.Set("CF-Connecting-IP", "198.51.100.1")
+	wsConn, err := websocket.NewClient(wsConfig, conn)
+	common.Must(err)
+	defer wsConn.Close()
+	inbound := <-accepted
+	defer inbound.Close()
+	if inbound.RemoteAddr().String() != "198.51.100.1:0" {
+		t.Fatal("wrong remote addr", inbound.RemoteAddr())
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	cfg := &Config{
+		RemoteHost: "127.0.0.1",
+		Websocket: WebsocketConfig{
+			Enabled: true,
+			Host:    "localhost",
+			Path:    "/ws",
+			Headers: map[string]string{
+				"User-Agent":  "Mozilla/5.0",
+				"x-cdn-token": "secret",
+			},
+			RequiredHeaders: map[string]string{
+				"X-CDN-Token": "secret",
+				"User-Agent":  "",
+			},
+			ResponseHeaders: map[string]string{
+				"Server": "nginx",
+			},
+		},
+	}
+	common.Must(cfg.Validate())
+	fmt.Sscanf(util.HTTPPort, "%d", &cfg.RemotePort)
+	ctx := config.WithConfig(context.Background(), Name, cfg)
+
+	port := common.PickPort("tcp", "127.0.0.1")
+	transportConfig := &transport.Config{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		RemoteHost: "127.0.0.1",
+		RemotePort: port,
+	}
+	ctx = config.WithConfig(ctx, transport.Name, transportConfig)
+	ctx = config.WithConfig(ctx, freedom.Name, &freedom.Config{})
+	tcpClient, err := transport.NewClient(ctx, nil)
+	common.Must(err)
+	tcpServer, err := transport.NewServer(ctx, nil)
+	common.Must(err)
+	c, err := NewClient(ctx, tcpClient)
+	common.Must(err)
+	s, err := NewServer(ctx, tcpServer)
+	common.Must(err)
+	defer s.Close()
+	defer c.Close()
+
+	accepted := make(chan error, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := s.AcceptConn(nil)
+			if err == nil {
+				conn.Close()
+			}
+			accepted <- err
+		}
+	}()
+	conn, err := c.DialConn(nil, nil)
+	common.Must(err)
+	conn.Close()
+	if err := <-accepted; err != nil {
+		t.Fatal("request with the required headers", err)
+	}
+
+	// 缺少令牌的请求被回落
+	raw, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	common.Must(err)
+	defer raw.Close()
+	wsConfig, err := websocket.NewConfig("wss://localhost/ws", "https://localhost")
+	common.Must(err)
+	wsConfig.Header = http.Header{"User-Agent": {"Mozilla/5.0"}}
+	if _, err := websocket.NewClient(wsConfig, raw); err == nil {
+		t.Fatal("request without the token should not be upgraded")
+	}
+	if err := <-accepted; err == nil {
+		t.Fatal("request without the token should be redirected")
+	}
+
+	// 握手响应带有配置的头部
+	raw2, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	common.Must(err)
+	defer raw2.Close()
+	go s.AcceptConn(nil)
+	fmt.Fprintf(raw2, "GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nOrigin: https://localhost\r\n"+
+		"User-Agent: curl\r\nX-CDN-Token: secret\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(raw2), nil)
+	common.Must(err)
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Server") != "nginx" {
+		t.Fatal("response", resp.Status, resp.Header)
+	}
+
+	cfg.Websocket.Headers["Sec-WebSocket-Key"] = "x"
+	cfg.Websocket.ResponseHeaders["bad header"] = "x"
+	errs, ok := cfg.Validate().(config.Errors)
+	if !ok || len(errs) != 2 || errs[0].Path != "websocket.headers" || errs[1].Path != "websocket.response_headers" {
+		t.Fatal("invalid headers", errs)
+	}
+}
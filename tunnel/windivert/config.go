@@ -0,0 +1,28 @@
+//go:build windows
+// +build windows
+
+package windivert
+
+import "github.com/p4gefau1t/trojan-go/config"
+
+type WinDivertConfig struct {
+	DLL   string `json:"dll" yaml:"dll"`
+	Ports []int  `json:"ports" yaml:"ports"` // 需要透明代理的目标端口，为空时代理所有端口
+}
+
+type Config struct {
+	LocalHost  string          `json:"local_addr" yaml:"local-addr"`
+	LocalPort  int             `json:"local_port" yaml:"local-port"`
+	RemoteHost string          `json:"remote_addr" yaml:"remote-addr"`
+	WinDivert  WinDivertConfig `json:"windivert" yaml:"windivert"`
+}
+
+func init() {
+	config.RegisterConfigCreator(Name, func() interface{} {
+		return &Config{
+			WinDivert: WinDivertConfig{
+				DLL: "WinDivert.dll",
+			},
+		}
+	})
+}
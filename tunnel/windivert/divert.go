@@ -0,0 +1,110 @@
+//go:build windows
+// +build windows
+
+package windivert
+
+import (
+	"encoding/binary"
+	"syscall"
+	"unsafe"
+
+	"github.com/p4gefau1t/trojan-go/common"
+)
+
+const (
+	layerNetwork  = 0
+	shutdownBoth  = 3
+	addressSize   = 80 // sizeof(WINDIVERT_ADDRESS)
+	outboundFlag  = 1 << 17
+	flagsOffset   = 8
+	maxPacketSize = 0xffff
+)
+
+// address is WINDIVERT_ADDRESS
+type address [addressSize]byte
+
+func (a *address) setOutbound(outbound bool) {
+	flags := binary.LittleEndian.Uint32(a[flagsOffset:])
+	if outbound {
+		flags |= outboundFlag
+	} else {
+		flags &^= outboundFlag
+	}
+	binary.LittleEndian.PutUint32(a[flagsOffset:], flags)
+}
+
+// divert is a WinDivert handle, the functions are loaded from WinDivert.dll at runtime
+type divert struct {
+	handle        uintptr
+	recv          *syscall.LazyProc
+	send          *syscall.LazyProc
+	calcChecksums *syscall.LazyProc
+	shutdown      *syscall.LazyProc
+	close         *syscall.LazyProc
+}
+
+// uint64Args returns the arguments used to pass an UINT64 parameter
+func uint64Args(v uint64) []uintptr {
+	if unsafe.Sizeof(uintptr(0)) == 4 {
+		return []uintptr{uintptr(v), uintptr(v >> 32)}
+	}
+	return []uintptr{uintptr(v)}
+}
+
+func openDivert(dll, filter string) (*divert, error) {
+	lib := syscall.NewLazyDLL(dll)
+	if err := lib.Load(); err != nil {
+		return nil, common.NewError("failed to load " + dll).Base(err)
+	}
+	open := lib.NewProc("WinDivertOpen")
+	filterPtr, err := syscall.BytePtrFromString(filter)
+	if err != nil {
+		return nil, common.NewError("invalid windivert filter").Base(err)
+	}
+	args := append([]uintptr{uintptr(unsafe.Pointer(filterPtr)), layerNetwork, 0}, uint64Args(0)...)
+	handle, _, err := open.Call(args...)
+	if handle == uintptr(syscall.InvalidHandle) {
+		return nil, common.NewError("failed to open windivert handle, make sure trojan-go is running as administrator").Base(err)
+	}
+	return &divert{
+		handle:        handle,
+		recv:          lib.NewProc("WinDivertRecv"),
+		send:          lib.NewProc("WinDivertSend"),
+		calcChecksums: lib.NewProc("WinDivertHelperCalcChecksums"),
+		shutdown:      lib.NewProc("WinDivertShutdown"),
+		close:         lib.NewProc("WinDivertClose"),
+	}, nil
+}
+
+func (d *divert) Recv(packet []byte, addr *address) (int, error) {
+	var n uint32
+	r, _, err := d.recv.Call(d.handle, uintptr(unsafe.Pointer(&packet[0])), uintptr(len(packet)),
+		uintptr(unsafe.Pointer(&n)), uintptr(unsafe.Pointer(&addr[0])))
+	if r == 0 {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (d *divert) Send(packet []byte, addr *address) error {
+	var n uint32
+	r, _, err := d.send.Call(d.handle, uintptr(unsafe.Pointer(&packet[0])), uintptr(len(packet)),
+		uintptr(unsafe.Pointer(&n)), uintptr(unsafe.Pointer(&addr[0])))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (d *divert) CalcChecksums(packet []byte, addr *address) {
+	args := append([]uintptr{uintptr(unsafe.Pointer(&packet[0])), uintptr(len(packet)), uintptr(unsafe.Pointer(&addr[0]))}, uint64Args(0)...)
+	d.calcChecksums.Call(args...)
+}
+
+func (d *divert) Close() error {
+	d.shutdown.Call(d.handle, shutdownBoth)
+	if r, _, err := d.close.Call(d.handle); r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+//go:build windows
+// +build windows
+
+package windivert
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/p4gefau1t/trojan-go/common"
+	"github.com/p4gefau1t/trojan-go/config"
+	"github.com/p4gefau1t/trojan-go/log"
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+// mappingTimeout is the idle time after which the original destination of a connection is forgotten
+const mappingTimeout = time.Minute * 10
+
+// 不代理局域网和保留地址
+var excludedRanges = [][2]string{
+	{"0.0.0.0", "0.255.255.255"},
+	{"10.0.0.0", "10.255.255.255"},
+	{"100.64.0.0", "100.127.255.255"},
+	{"127.0.0.0", "127.255.255.255"},
+	{"169.254.0.0", "169.254.255.255"},
+	{"172.16.0.0", "172.31.255.255"},
+	{"192.168.0.0", "192.168.255.255"},
+	{"224.0.0.0", "255.255.255.255"},
+}
+
+type Conn struct {
+	net.Conn
+	metadata *tunnel.Metadata
+}
+
+func (c *Conn) Metadata() *tunnel.Metadata {
+	return c.metadata
+}
+
+type mapping struct {
+	port     uint16 // 原始目标端口
+	lastSeen time.Time
+}
+
+// Server redirects the outbound TCP connections of the system to the local listener with WinDivert.
+// Packets to the original destination are rewritten to the listener, with the addresses swapped,
+// and the responses of the listener are rewritten back, like the streamdump example of WinDivert
+type Server struct {
+	listener    net.Listener
+	divert      *divert
+	port        uint16
+	mappingLock sync.Mutex
+	mapping     map[uint16]*mapping // 客户端源端口 -> 原始目标端口
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+func (s *Server) Close() error {
+	s.cancel()
+	s.divert.Close()
+	return s.listener.Close()
+}
+
+// rewrite modifies the IPv4 TCP packet, it returns false if the packet should be dropped
+func (s *Server) rewrite(packet []byte) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return false
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	if len(packet) < ihl+20 {
+		return false
+	}
+	tcp := packet[ihl:]
+	srcPort := binary.BigEndian.Uint16(tcp[0:])
+	dstPort := binary.BigEndian.Uint16(tcp[2:])
+
+	s.mappingLock.Lock()
+	defer s.mappingLock.Unlock()
+	if srcPort == s.port { // 本地监听端口的响应，恢复为原始目标发出的数据包
+		m, found := s.mapping[dstPort]
+		if !found {
+			return false
+		}
+		m.lastSeen = time.Now()
+		binary.BigEndian.PutUint16(tcp[0:], m.port)
+	} else { // 发往原始目标的数据包，重定向到本地监听端口
+		m, found := s.mapping[srcPort]
+		if !found || m.port != dstPort {
+			m = &mapping{port: dstPort}
+			s.mapping[srcPort] = m
+		}
+		m.lastSeen = time.Now()
+		binary.BigEndian.PutUint16(tcp[2:], s.port)
+	}
+	src := [4]byte{}
+	copy(src[:], packet[12:16])
+	copy(packet[12:16], packet[16:20])
+	copy(packet[16:20], src[:])
+	return true
+}
+
+func (s *Server) divertLoop() {
+	buf := make([]byte, maxPacketSize)
+	addr := &address{}
+	for {
+		n, err := s.divert.Recv(buf, addr)
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+			default:
+				log.Error(common.NewError("windivert failed to receive packet").Base(err))
+				s.Close()
+			}
+			return
+		}
+		packet := buf[:n]
+		if !s.rewrite(packet) {
+			continue
+		}
+		// 以入站的方式重新注入，使数据包被交给本地的协议栈
+		addr.setOutbound(false)
+		s.divert.CalcChecksums(packet, addr)
+		if err := s.divert.Send(packet, addr); err != nil {
+			log.Debug(common.NewError("windivert failed to send packet").Base(err))
+		}
+	}
+}
+
+func (s *Server) cleanLoop() {
+	ticker := time.NewTicker(mappingTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mappingLock.Lock()
+			for port, m := range s.mapping {
+				if time.Since(m.lastSeen) > mappingTimeout {
+					delete(s.mapping, port)
+				}
+			}
+			s.mappingLock.Unlock()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// 让上一层协议获取当前层协议的连接
+func (s *Server) AcceptConn(tunnel.Tunnel) (tunnel.Conn, error) {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		// 由上层的接收循环等待后重试
+		return nil, common.NewError("windivert failed to accept conn").Base(err)
+	}
+	// 重定向后连接的来源地址为原始目标的 IP 和客户端的源端口
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	s.mappingLock.Lock()
+	m, found := s.mapping[uint16(remote.Port)]
+	s.mappingLock.Unlock()
+	if !found {
+		conn.Close()
+		return nil, common.NewError("windivert failed to obtain original address of " + remote.String())
+	}
+	address := tunnel.NewAddressFromHostPort("tcp", remote.IP.String(), int(m.port))
+	log.Info("windivert connection from port", remote.Port, "metadata", address)
+	return &Conn{
+		metadata: &tunnel.Metadata{
+			Address: address,
+		},
+		Conn: conn,
+	}, nil
+}
+
+// 不支持向上层提供 UDP 包
+func (s *Server) AcceptPacket(tunnel.Tunnel) (tunnel.PacketConn, error) {
+	<-s.ctx.Done()
+	return nil, common.NewError("windivert udp is not supported")
+}
+
+func buildFilter(cfg *Config, port int) (string, error) {
+	conditions := []string{fmt.Sprintf("tcp.DstPort != %d", port)}
+	for _, r := range excludedRanges {
+		conditions = append(conditions, fmt.Sprintf("(ip.DstAddr < %s or ip.DstAddr > %s)", r[0], r[1]))
+	}
+	// 不代理到服务器的连接
+	if cfg.RemoteHost != "" {
+		ips, err := net.LookupIP(cfg.RemoteHost)
+		if err != nil {
+			return "", common.NewError("windivert failed to resolve " + cfg.RemoteHost).Base(err)
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				conditions = append(conditions, "ip.DstAddr != "+ip.String())
+			}
+		}
+	}
+	if len(cfg.WinDivert.Ports) != 0 {
+		ports := make([]string, 0, len(cfg.WinDivert.Ports))
+		for _, p := range cfg.WinDivert.Ports {
+			ports = append(ports, fmt.Sprintf("tcp.DstPort == %d", p))
+		}
+		conditions = append(conditions, "("+strings.Join(ports, " or ")+")")
+	}
+	return fmt.Sprintf("outbound and !loopback and ip and tcp and (tcp.SrcPort == %d or (%s))",
+		port, strings.Join(conditions, " and ")), nil
+}
+
+func NewServer(ctx context.Context, _ tunnel.Server) (*Server, error) {
+	cfg := config.FromContext(ctx, Name).(*Config)
+	listenAddr := tunnel.NewAddressFromHostPort("tcp", cfg.LocalHost, cfg.LocalPort)
+	listener, err := net.Listen("tcp", listenAddr.String())
+	if err != nil {
+		return nil, common.NewError("windivert failed to listen tcp").Base(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	filter, err := buildFilter(cfg, port)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	log.Debug("windivert filter:", filter)
+	d, err := openDivert(cfg.WinDivert.DLL, filter)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Server{
+		listener: listener,
+		divert:   d,
+		port:     uint16(port),
+		mapping:  make(map[uint16]*mapping),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	go s.divertLoop()
+	go s.cleanLoop()
+	log.Info("windivert transparent proxy is listening on", listener.Addr().String())
+	return s, nil
+}
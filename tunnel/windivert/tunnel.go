@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+package windivert
+
+import (
+	"context"
+
+	"github.com/p4gefau1t/trojan-go/tunnel"
+)
+
+const Name = "WINDIVERT"
+
+type Tunnel struct{}
+
+func (t *Tunnel) Name() string {
+	return Name
+}
+
+func (t *Tunnel) NewClient(ctx context.Context, client tunnel.Client) (tunnel.Client, error) {
+	panic("not supported")
+}
+
+func (t *Tunnel) NewServer(ctx context.Context, server tunnel.Server) (tunnel.Server, error) {
+	return NewServer(ctx, server)
+}
+
+func init() {
+	tunnel.RegisterTunnel(Name, &Tunnel{})
+}
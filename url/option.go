@@ -22,7 +22,8 @@ type Websocket struct {
 }
 
 type TLS struct {
-	SNI string `json:"sni"`
+	SNI    string `json:"sni"`
+	Verify bool   `json:"verify"`
 }
 
 type Shadowsocks struct {
@@ -147,7 +148,8 @@ func (u *url) Handle() error {
 		RemotePort: int(info.Port),
 		Password:   []string{info.TrojanPassword},
 		TLS: TLS{
-			SNI: info.SNI,
+			SNI:    info.SNI,
+			Verify: !info.AllowInsecure,
 		},
 		Websocket: Websocket{
 			Enabled: wsEnabled,
@@ -186,7 +188,7 @@ func (u *url) Priority() int {
 
 func init() {
 	option.RegisterHandler(&url{
-		url:    flag.String("url", "", "Setup trojan-go client with a url link"),
+		url:    flag.String("url", "", "Setup trojan-go client with a trojan-go:// or trojan:// url link"),
 		option: flag.String("url-option", "mux=true;listen=127.0.0.1:1080", "URL mode options"),
 	})
 }
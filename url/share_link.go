@@ -3,6 +3,7 @@ package url
 import (
 	"errors"
 	"fmt"
+	"net"
 	neturl "net/url"
 	"strconv"
 	"strings"
@@ -43,6 +44,8 @@ type ShareInfo struct {
 	Plugin     string // 插件设定
 
 	Description string // 节点说明
+
+	AllowInsecure bool // 不验证服务端证书，仅用于 trojan:// 链接
 }
 
 func NewShareInfoFromURL(shareLink string) (info ShareInfo, e error) {
@@ -53,9 +56,14 @@ func NewShareInfoFromURL(shareLink string) (info ShareInfo, e error) {
 		return
 	}
 
-	// share link must have `trojan-go://` scheme
+	// 其他客户端通用的 trojan:// 链接
+	if parse.Scheme == "trojan" {
+		return newShareInfoFromTrojanURL(parse)
+	}
+
+	// share link must have `trojan-go://` or `trojan://` scheme
 	if parse.Scheme != "trojan-go" {
-		e = errors.New("url does not have a trojan-go:// scheme")
+		e = errors.New("url does not have a trojan-go:// or trojan:// scheme")
 		return
 	}
 
@@ -200,6 +208,101 @@ func NewShareInfoFromURL(shareLink string) (info ShareInfo, e error) {
 	return
 }
 
+// newShareInfoFromTrojanURL parses the trojan:// link, e.g. trojan://password@host:port?sni=...&type=ws&path=...#name.
+// The parameters not supported by trojan-go, such as alpn and fingerprint, are ignored
+func newShareInfoFromTrojanURL(parse *neturl.URL) (info ShareInfo, e error) {
+	// 其他客户端生成的链接中密码可能没有转义冒号
+	info.TrojanPassword = parse.User.Username()
+	if password, hasPassword := parse.User.Password(); hasPassword {
+		info.TrojanPassword += ":" + password
+	}
+	if info.TrojanPassword == "" {
+		e = errors.New("no password specified")
+		return
+	}
+
+	if info.TrojanHost = parse.Hostname(); info.TrojanHost == "" {
+		e = errors.New("host is empty")
+		return
+	}
+
+	if info.Port, e = handleTrojanPort(parse.Port()); e != nil {
+		return
+	}
+
+	query, e := neturl.ParseQuery(parse.RawQuery)
+	if e != nil {
+		return
+	}
+
+	// 旧的链接使用 peer 指定 SNI
+	if info.SNI = query.Get("sni"); info.SNI == "" {
+		if info.SNI = query.Get("peer"); info.SNI == "" {
+			info.SNI = info.TrojanHost
+		}
+	}
+
+	if security := query.Get("security"); security != "" && security != "tls" {
+		e = fmt.Errorf("unsupported security: %s", security)
+		return
+	}
+
+	switch t := query.Get("type"); t {
+	case "", "tcp":
+		info.Type = ShareInfoTypeOriginal
+	case ShareInfoTypeWebSocket:
+		info.Type = ShareInfoTypeWebSocket
+	default:
+		e = fmt.Errorf("unsupported transport type: %s", t)
+		return
+	}
+
+	if info.Host = query.Get("host"); info.Host == "" {
+		info.Host = info.TrojanHost
+	}
+
+	if info.Type == ShareInfoTypeWebSocket {
+		if info.Path = query.Get("path"); info.Path == "" {
+			info.Path = "/"
+		}
+		if !strings.HasPrefix(info.Path, "/") {
+			e = errors.New("path must start with /")
+			return
+		}
+	}
+
+	switch query.Get("allowInsecure") {
+	case "1", "true":
+		info.AllowInsecure = true
+	}
+
+	info.Description = parse.Fragment
+	return
+}
+
+// TrojanURL returns the trojan:// share link of the info, which is understood by most trojan clients.
+// The encryption and plugin are not included since they are specific to trojan-go
+func (info *ShareInfo) TrojanURL() string {
+	query := neturl.Values{}
+	query.Set("sni", info.SNI)
+	if info.Type == ShareInfoTypeWebSocket {
+		query.Set("type", ShareInfoTypeWebSocket)
+		query.Set("host", info.Host)
+		query.Set("path", info.Path)
+	}
+	if info.AllowInsecure {
+		query.Set("allowInsecure", "1")
+	}
+	u := neturl.URL{
+		Scheme:   "trojan",
+		User:     neturl.User(info.TrojanPassword),
+		Host:     net.JoinHostPort(info.TrojanHost, strconv.Itoa(int(info.Port))),
+		RawQuery: query.Encode(),
+		Fragment: info.Description,
+	}
+	return u.String()
+}
+
 func handleTrojanPort(p string) (port uint16, e error) {
 	if p == "" {
 		return 443, nil